@@ -0,0 +1,324 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+)
+
+var (
+	privateCIDRs = mustParseCIDRs(
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"224.0.0.0/4",
+		"240.0.0.0/4",
+		"::/128",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+		"ff00::/8",
+	)
+)
+
+// Destination describes the upstream destination of a proxied request.
+type Destination struct {
+	// Host is the host as requested by the client, either a hostname or an IP
+	Host string
+
+	// Port is the destination port
+	Port int
+
+	// IP is the destination IP if Host is an IP literal, otherwise nil
+	IP net.IP
+
+	lookupIPs func(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// Addr returns the host:port of this destination.
+func (dest *Destination) Addr() string {
+	return net.JoinHostPort(dest.Host, strconv.Itoa(dest.Port))
+}
+
+// IPs returns the destination IP if Host is an IP literal and otherwise
+// resolves Host using the proxy's Resolver (or the default resolver). The
+// proxy then dials one of the returned IPs rather than resolving Host again.
+func (dest *Destination) IPs(ctx context.Context) ([]net.IP, error) {
+	if dest.IP != nil {
+		return []net.IP{dest.IP}, nil
+	}
+	var ips []net.IP
+	if dest.lookupIPs != nil {
+		var err error
+		ips, err = dest.lookupIPs(ctx, dest.Host)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, dest.Host)
+		if err != nil {
+			return nil, err
+		}
+		ips = make([]net.IP, 0, len(addrs))
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	setResolvedIPs(ctx, dest.Host, ips)
+	return ips, nil
+}
+
+// parseDestination parses a host[:port] into a Destination, using defaultPort
+// if addr doesn't include a port.
+func parseDestination(addr string, defaultPort int) (*Destination, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		if defaultPort == 0 {
+			return nil, err
+		}
+		host = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+		portString = strconv.Itoa(defaultPort)
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, errors.New("Invalid port in %v: %v", addr, err)
+	}
+	return &Destination{Host: host, Port: port, IP: net.ParseIP(host)}, nil
+}
+
+// requestDestination determines the Destination for the given request.
+func requestDestination(req *http.Request) (*Destination, error) {
+	if isConnectUDP(req) || isExtendedConnectUDP(req) {
+		// The target is in the path, the host is the proxy's
+		if target, err := connectUDPTarget(req); err == nil {
+			return parseDestination(target, 0)
+		}
+	}
+	defaultPort := 80
+	if req.Method == http.MethodConnect {
+		defaultPort = 0
+	} else if req.URL.Scheme == "https" {
+		defaultPort = 443
+	}
+	host := req.URL.Host
+	if host == "" {
+		host = req.Host
+	}
+	return parseDestination(host, defaultPort)
+}
+
+// AccessControl decides whether clients may access upstream destinations.
+type AccessControl interface {
+	// Check is consulted before dialing dest on behalf of the client at clientIP
+	// (which may be nil if unknown). It returns nil if access is allowed and
+	// otherwise an error explaining why access was denied.
+	Check(ctx context.Context, clientIP net.IP, dest *Destination) error
+}
+
+// AccessControlFunc adapts a function to an AccessControl
+type AccessControlFunc func(ctx context.Context, clientIP net.IP, dest *Destination) error
+
+// Check implements the interface AccessControl
+func (f AccessControlFunc) Check(ctx context.Context, clientIP net.IP, dest *Destination) error {
+	return f(ctx, clientIP, dest)
+}
+
+// AccessControls combines multiple AccessControls, only allowing access if all
+// of them allow it.
+func AccessControls(acs ...AccessControl) AccessControl {
+	return AccessControlFunc(func(ctx context.Context, clientIP net.IP, dest *Destination) error {
+		for _, ac := range acs {
+			if err := ac.Check(ctx, clientIP, dest); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DenyPrivateDestinations returns an AccessControl that denies access to
+// loopback, private, link-local, multicast and otherwise reserved IP ranges,
+// protecting internal services from server-side request forgery (SSRF).
+// Hostnames are resolved and denied if any of their addresses is private, and
+// dialed at the addresses that were checked, so that they can't be rebound to
+// private addresses in between.
+func DenyPrivateDestinations() AccessControl {
+	return denyDestinationCIDRs(privateCIDRs)
+}
+
+// DenyDestinationCIDRs returns an AccessControl that denies access to the given
+// destination CIDRs.
+func DenyDestinationCIDRs(cidrs ...string) (AccessControl, error) {
+	nets, err := parseCIDRs(cidrs...)
+	if err != nil {
+		return nil, err
+	}
+	return denyDestinationCIDRs(nets), nil
+}
+
+func denyDestinationCIDRs(nets []*net.IPNet) AccessControl {
+	return AccessControlFunc(func(ctx context.Context, clientIP net.IP, dest *Destination) error {
+		ips, err := dest.IPs(ctx)
+		if err != nil {
+			return errors.New("Unable to resolve %v: %v", dest.Host, err)
+		}
+		for _, ip := range ips {
+			if containsIP(nets, ip) {
+				return errors.New("Access to %v (%v) is not allowed", dest.Host, ip)
+			}
+		}
+		return nil
+	})
+}
+
+// AllowPorts returns an AccessControl that only allows access to the given
+// destination ports, for example 80 and 443.
+func AllowPorts(ports ...int) AccessControl {
+	allowed := make(map[int]bool, len(ports))
+	for _, port := range ports {
+		allowed[port] = true
+	}
+	return AccessControlFunc(func(ctx context.Context, clientIP net.IP, dest *Destination) error {
+		if !allowed[dest.Port] {
+			return errors.New("Access to port %d is not allowed", dest.Port)
+		}
+		return nil
+	})
+}
+
+// DenyDomains returns an AccessControl that denies access to destinations
+// whose host matches m. Since m's rules can be replaced at any time, this
+// works for blocklists that are updated while the proxy is running.
+func DenyDomains(m *DomainMatcher) AccessControl {
+	return AccessControlFunc(func(ctx context.Context, clientIP net.IP, dest *Destination) error {
+		if m.Match(dest.Host) {
+			return errors.New("Access to %v is not allowed: %v", dest.Host, ErrBlocked)
+		}
+		return nil
+	})
+}
+
+// AllowDomains returns an AccessControl that only allows access to
+// destinations whose host matches m.
+func AllowDomains(m *DomainMatcher) AccessControl {
+	return AccessControlFunc(func(ctx context.Context, clientIP net.IP, dest *Destination) error {
+		if !m.Match(dest.Host) {
+			return errors.New("Access to %v is not allowed: %v", dest.Host, ErrBlocked)
+		}
+		return nil
+	})
+}
+
+// AllowClientCIDRs returns an AccessControl that only allows clients whose IP
+// falls within one of the given CIDRs.
+func AllowClientCIDRs(cidrs ...string) (AccessControl, error) {
+	nets, err := parseCIDRs(cidrs...)
+	if err != nil {
+		return nil, err
+	}
+	return AccessControlFunc(func(ctx context.Context, clientIP net.IP, dest *Destination) error {
+		if clientIP == nil || !containsIP(nets, clientIP) {
+			return errors.New("Client %v is not allowed", clientIP)
+		}
+		return nil
+	}), nil
+}
+
+// accessControlFilter returns a filter that responds 403 Forbidden to requests
+// whose destination isn't allowed by ac.
+func (opts *Opts) accessControlFilter(ac AccessControl) filters.Filter {
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		dest, err := requestDestination(req)
+		if err == nil {
+			dest.lookupIPs = opts.lookupIPs
+			err = ac.Check(ctx, clientIPFromAddr(req.RemoteAddr), dest)
+		}
+		if err != nil {
+			log.Debugf("Denying access to %v for %v: %v", req.Host, req.RemoteAddr, err)
+			filters.Discard(ctx, req)
+			body := err.Error()
+			return filters.ShortCircuit(ctx, req, &http.Response{
+				StatusCode:    http.StatusForbidden,
+				Body:          ioutil.NopCloser(strings.NewReader(body)),
+				ContentLength: int64(len(body)),
+			})
+		}
+		return next(ctx, req)
+	})
+}
+
+// checkTunnelAccess consults AccessControl, if configured, for tunnels that
+// don't pass through the HTTP filter chain (e.g. SOCKS5).
+func (proxy *proxy) checkTunnelAccess(ctx context.Context, downstream net.Conn, addr string) error {
+	ac := proxy.currentConfig().AccessControl
+	if ac == nil {
+		return nil
+	}
+	dest, err := parseDestination(addr, 0)
+	if err == nil {
+		dest.lookupIPs = proxy.lookupIPs
+		err = ac.Check(ctx, connClientIP(downstream), dest)
+	}
+	if err != nil {
+		return &PolicyDeniedError{Addr: addr, Phase: PhaseAdmission, Policy: PolicyAccessControl, Err: errors.New("Access to %v denied: %v", addr, err)}
+	}
+	return nil
+}
+
+// clientIPFromAddr extracts the IP from a host:port address, returning nil if
+// there is none.
+func clientIPFromAddr(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
+
+// connClientIP returns the IP of the remote end of conn, or nil if unknown.
+func connClientIP(conn net.Conn) net.IP {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return nil
+	}
+	return clientIPFromAddr(addr.String())
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.New("Unable to parse CIDR %v: %v", cidr, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets, err := parseCIDRs(cidrs...)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
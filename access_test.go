@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/mockconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDenyPrivateDestinations(t *testing.T) {
+	ac := DenyPrivateDestinations()
+	for _, addr := range []string{"127.0.0.1:80", "10.1.2.3:443", "[::1]:80", "[::ffff:192.168.1.1]:80", "169.254.169.254:80", "localhost:80"} {
+		dest, err := parseDestination(addr, 0)
+		if assert.NoError(t, err) {
+			assert.Error(t, ac.Check(context.Background(), nil, dest), addr)
+		}
+	}
+	dest, _ := parseDestination("8.8.8.8:53", 0)
+	assert.NoError(t, ac.Check(context.Background(), nil, dest))
+}
+
+func TestAllowPortsAndClients(t *testing.T) {
+	clients, err := AllowClientCIDRs("192.168.0.0/16")
+	if !assert.NoError(t, err) {
+		return
+	}
+	ac := AccessControls(AllowPorts(80, 443), clients)
+	dest, _ := parseDestination("example.com", 443)
+	assert.NoError(t, ac.Check(context.Background(), net.ParseIP("192.168.1.1"), dest))
+	assert.Error(t, ac.Check(context.Background(), net.ParseIP("10.0.0.1"), dest))
+	dest, _ = parseDestination("example.com:22", 443)
+	assert.Error(t, ac.Check(context.Background(), net.ParseIP("192.168.1.1"), dest))
+
+	_, err = AllowClientCIDRs("bogus")
+	assert.Error(t, err)
+}
+
+func TestAccessControlFilter(t *testing.T) {
+	d := mockconn.SucceedingDialer([]byte{})
+	p := newProxy(&Opts{
+		OKWaitsForUpstream: true,
+		AccessControl:      AllowPorts(443),
+		Dial: func(ctx context.Context, isConnect bool, net, addr string) (net.Conn, error) {
+			return d.Dial(net, addr)
+		},
+	})
+
+	req, _ := http.NewRequest(http.MethodConnect, "http://thehost:22", nil)
+	resp, _, _ := roundTrip(p, req, true)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(body), "port 22")
+	assert.Empty(t, d.LastDialed())
+
+	req, _ = http.NewRequest(http.MethodConnect, "http://thehost:443", nil)
+	resp, _, _ = roundTrip(p, req, true)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "thehost:443", d.LastDialed())
+}
+
+func TestDomainAccessControls(t *testing.T) {
+	m, err := NewDomainMatcher(".blocked.com")
+	if !assert.NoError(t, err) {
+		return
+	}
+	deny := DenyDomains(m)
+	allow := AllowDomains(m)
+	check := func(ac AccessControl, addr string) error {
+		dest, err := parseDestination(addr, 0)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		return ac.Check(context.Background(), nil, dest)
+	}
+
+	assert.Error(t, check(deny, "www.blocked.com:443"))
+	assert.NoError(t, check(deny, "example.com:443"))
+	assert.NoError(t, check(allow, "www.blocked.com:443"))
+	assert.Error(t, check(allow, "example.com:443"))
+	assert.Equal(t, http.StatusForbidden, ErrorStatus(check(deny, "blocked.com:80")))
+
+	// Updated rules apply right away
+	assert.NoError(t, m.Set("example.com"))
+	assert.NoError(t, check(deny, "www.blocked.com:443"))
+	assert.Error(t, check(deny, "example.com:443"))
+}
+
+func TestDenyPrivateDestinationsRebinding(t *testing.T) {
+	var lookups int32
+	rebinding := ResolverFunc(func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		if atomic.AddInt32(&lookups, 1) == 1 {
+			return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, nil
+		}
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+	})
+	dialed := make(chan string, 10)
+	l := serveProxy(t, &Opts{
+		OKWaitsForUpstream: true,
+		Resolver:           rebinding,
+		AccessControl:      DenyPrivateDestinations(),
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			dialed <- addr
+			return nil, errors.New("not dialing")
+		},
+	})
+	defer l.Close()
+
+	assertDialedChecked := func(expected string) {
+		assert.Equal(t, expected, <-dialed, "Should dial the IP that was checked")
+		for len(dialed) > 0 {
+			assert.Equal(t, expected, <-dialed, "Retries should dial the IP that was checked")
+		}
+	}
+	atomic.StoreInt32(&lookups, 0)
+	proxiedRequest(t, l.Addr().String(), http.MethodGet, "http://rebind.example:8080/")
+	assertDialedChecked("192.0.2.1:8080")
+
+	atomic.StoreInt32(&lookups, 0)
+	conn, _, _ := openTunnel(t, l.Addr().String(), "rebind.example:8443")
+	conn.Close()
+	assertDialedChecked("192.0.2.1:8443")
+}
+
+func TestResolveAddrUsesCheckedIPs(t *testing.T) {
+	ctx := withResolvedIPs(context.Background())
+	dest, _ := parseDestination("localhost:80", 0)
+	dest.lookupIPs = func(ctx context.Context, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("192.0.2.1")}, nil
+	}
+	_, err := dest.IPs(ctx)
+	assert.NoError(t, err)
+	addrs, err := (&Opts{}).resolveAddr(ctx, "LOCALHOST:80")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1:80"}, addrs, "Host shouldn't be resolved again, even without a Resolver")
+	addrs, _ = (&Opts{}).resolveAddr(context.Background(), "localhost:80")
+	assert.Equal(t, []string{"localhost:80"}, addrs)
+}
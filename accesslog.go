@@ -0,0 +1,289 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// AccessProtocolHTTP identifies requests (including CONNECT) received over
+	// HTTP
+	AccessProtocolHTTP = "http"
+
+	// AccessProtocolSOCKS5 identifies SOCKS5 tunnels
+	AccessProtocolSOCKS5 = "socks5"
+
+	// AccessProtocolSOCKS4 identifies SOCKS4 and SOCKS4a tunnels
+	AccessProtocolSOCKS4 = "socks4"
+
+	// AccessProtocolTransparent identifies transparently proxied TLS tunnels
+	AccessProtocolTransparent = "transparent"
+
+	combinedTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+// AccessRecord describes a single proxied request or tunnel.
+type AccessRecord struct {
+	// bodyBytes counts request body bytes, kept first for 64-bit alignment
+	bodyBytes int64
+
+	// Time is when the request was received
+	Time time.Time
+
+	// ClientAddr is the address of the client
+	ClientAddr string
+
+	// Identity is the authenticated identity of the client, if any
+	Identity string
+
+	// Protocol is one of the AccessProtocol constants
+	Protocol string
+
+	// Method is the HTTP request method, CONNECT for tunnels
+	Method string
+
+	// Host is the requested host, including the port for tunnels
+	Host string
+
+	// URL is the request URI as sent by the client
+	URL string
+
+	// Proto is the HTTP protocol version of the request, e.g. HTTP/1.1
+	Proto string
+
+	// StatusCode is the status of the response sent to the client, or 0 if
+	// there was none (e.g. for SOCKS5)
+	StatusCode int
+
+	// BytesUp is the number of bytes sent from the client to upstream
+	BytesUp int64
+
+	// BytesDown is the number of bytes sent from upstream (or the proxy) to the
+	// client
+	BytesDown int64
+
+	// Duration is how long the request or tunnel lasted
+	Duration time.Duration
+
+	// Err is the error, if any, encountered dialing or talking to upstream
+	Err error
+
+	// Referer is the Referer header of the request
+	Referer string
+
+	// UserAgent is the User-Agent header of the request
+	UserAgent string
+}
+
+// AccessLogger receives an AccessRecord for every request or tunnel once it
+// completes.
+type AccessLogger interface {
+	LogAccess(record *AccessRecord)
+}
+
+// AccessLoggerFunc adapts a function to an AccessLogger
+type AccessLoggerFunc func(record *AccessRecord)
+
+// LogAccess implements the interface AccessLogger
+func (f AccessLoggerFunc) LogAccess(record *AccessRecord) {
+	f(record)
+}
+
+type jsonAccessRecord struct {
+	Time       string  `json:"time"`
+	ClientAddr string  `json:"client_addr"`
+	Identity   string  `json:"identity,omitempty"`
+	Protocol   string  `json:"protocol"`
+	Method     string  `json:"method"`
+	Host       string  `json:"host"`
+	URL        string  `json:"url,omitempty"`
+	Proto      string  `json:"proto,omitempty"`
+	StatusCode int     `json:"status,omitempty"`
+	BytesUp    int64   `json:"bytes_up"`
+	BytesDown  int64   `json:"bytes_down"`
+	DurationMS float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+	Referer    string  `json:"referer,omitempty"`
+	UserAgent  string  `json:"user_agent,omitempty"`
+}
+
+// JSONAccessLogger returns an AccessLogger that writes one JSON object per
+// line to w.
+func JSONAccessLogger(w io.Writer) AccessLogger {
+	var mx sync.Mutex
+	enc := json.NewEncoder(w)
+	return AccessLoggerFunc(func(record *AccessRecord) {
+		jr := &jsonAccessRecord{
+			Time:       record.Time.UTC().Format(time.RFC3339Nano),
+			ClientAddr: record.ClientAddr,
+			Identity:   record.Identity,
+			Protocol:   record.Protocol,
+			Method:     record.Method,
+			Host:       record.Host,
+			URL:        record.URL,
+			Proto:      record.Proto,
+			StatusCode: record.StatusCode,
+			BytesUp:    record.BytesUp,
+			BytesDown:  record.BytesDown,
+			DurationMS: float64(record.Duration) / float64(time.Millisecond),
+			Referer:    record.Referer,
+			UserAgent:  record.UserAgent,
+		}
+		if record.Err != nil {
+			jr.Error = record.Err.Error()
+		}
+		mx.Lock()
+		defer mx.Unlock()
+		if err := enc.Encode(jr); err != nil {
+			log.Errorf("Unable to write access log: %v", err)
+		}
+	})
+}
+
+// CombinedAccessLogger returns an AccessLogger that writes records to w in the
+// Apache combined log format.
+func CombinedAccessLogger(w io.Writer) AccessLogger {
+	var mx sync.Mutex
+	return AccessLoggerFunc(func(record *AccessRecord) {
+		clientIP := clientIPFromAddr(record.ClientAddr)
+		client := "-"
+		if clientIP != nil {
+			client = clientIP.String()
+		}
+		status := "-"
+		if record.StatusCode > 0 {
+			status = fmt.Sprint(record.StatusCode)
+		}
+		line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %s %d \"%s\" \"%s\"\n",
+			client,
+			dashIfEmpty(record.Identity),
+			record.Time.Format(combinedTimeFormat),
+			record.Method,
+			dashIfEmpty(record.URL),
+			dashIfEmpty(record.Proto),
+			status,
+			record.BytesDown,
+			dashIfEmpty(record.Referer),
+			dashIfEmpty(record.UserAgent))
+		mx.Lock()
+		defer mx.Unlock()
+		if _, err := io.WriteString(w, line); err != nil {
+			log.Errorf("Unable to write access log: %v", err)
+		}
+	})
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// newAccessRecord starts an AccessRecord for the given request, returning nil
+// if access logging is disabled.
+func (proxy *proxy) newAccessRecord(req *http.Request) *AccessRecord {
+	if proxy.AccessLogger == nil {
+		return nil
+	}
+	rec := &AccessRecord{
+		Time:       time.Now(),
+		ClientAddr: req.RemoteAddr,
+		Protocol:   AccessProtocolHTTP,
+		Method:     req.Method,
+		Host:       req.Host,
+		URL:        req.RequestURI,
+		Proto:      req.Proto,
+		Referer:    req.Referer(),
+		UserAgent:  req.UserAgent(),
+	}
+	if rec.URL == "" {
+		rec.URL = req.URL.String()
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &countingReadCloser{ReadCloser: req.Body, n: &rec.bodyBytes}
+	}
+	return rec
+}
+
+// newTunnelAccessRecord starts an AccessRecord for a tunnel that didn't begin
+// with an HTTP request, returning nil if access logging is disabled.
+func (proxy *proxy) newTunnelAccessRecord(protocol string, downstream net.Conn, upstreamAddr string) *AccessRecord {
+	if proxy.AccessLogger == nil {
+		return nil
+	}
+	rec := &AccessRecord{
+		Time:     time.Now(),
+		Protocol: protocol,
+		Method:   http.MethodConnect,
+		Host:     upstreamAddr,
+		URL:      upstreamAddr,
+	}
+	if remoteAddr := downstream.RemoteAddr(); remoteAddr != nil {
+		rec.ClientAddr = remoteAddr.String()
+	}
+	return rec
+}
+
+// logAccess completes the given record (if any) and passes it to the
+// AccessLogger.
+func (proxy *proxy) logAccess(ctx context.Context, rec *AccessRecord, err error) {
+	if rec == nil {
+		return
+	}
+	rec.Duration = time.Since(rec.Time)
+	rec.BytesUp += atomic.LoadInt64(&rec.bodyBytes)
+	if rec.Identity == "" {
+		rec.Identity = AuthenticatedIdentity(ctx)
+	}
+	if rec.Err == nil {
+		rec.Err = err
+	}
+	proxy.AccessLogger.LogAccess(rec)
+}
+
+func accessRecord(ctx context.Context) *AccessRecord {
+	rec, _ := ctx.Value(ctxKeyAccessRecord).(*AccessRecord)
+	return rec
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (rc *countingReadCloser) Read(b []byte) (int, error) {
+	n, err := rc.ReadCloser.Read(b)
+	atomic.AddInt64(rc.n, int64(n))
+	return n, err
+}
+
+// countingConn counts bytes written to (up) and read from (down) an upstream
+// connection into TunnelStats.
+type countingConn struct {
+	net.Conn
+	stats *TunnelStats
+}
+
+func (conn *countingConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	atomic.AddInt64(&conn.stats.bytesDown, int64(n))
+	return n, err
+}
+
+func (conn *countingConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	atomic.AddInt64(&conn.stats.bytesUp, int64(n))
+	return n, err
+}
+
+func (conn *countingConn) Wrapped() net.Conn {
+	return conn.Conn
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	ht "net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessLogForwarded(t *testing.T) {
+	origin := ht.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+	defer origin.Close()
+
+	out := &bytes.Buffer{}
+	p := newProxy(&Opts{AccessLogger: JSONAccessLogger(out)})
+	req, _ := http.NewRequest(http.MethodPost, origin.URL+"/things", strings.NewReader("some body"))
+	req.Header.Set("User-Agent", "test-agent")
+	resp, roundTripErr, handleErr := roundTrip(p, req, true)
+	if !assert.NoError(t, roundTripErr) || !assert.NoError(t, handleErr) {
+		return
+	}
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var record map[string]interface{}
+	if !assert.NoError(t, json.Unmarshal(out.Bytes(), &record), out.String()) {
+		return
+	}
+	assert.Equal(t, "http", record["protocol"])
+	assert.Equal(t, "POST", record["method"])
+	assert.Equal(t, "/things", record["url"])
+	assert.EqualValues(t, http.StatusCreated, record["status"])
+	assert.EqualValues(t, len("some body"), record["bytes_up"])
+	assert.True(t, record["bytes_down"].(float64) > float64(len("created")), "Bytes down should include the response")
+	assert.Equal(t, "test-agent", record["user_agent"])
+	assert.Nil(t, record["error"])
+}
+
+func TestCombinedAccessLogger(t *testing.T) {
+	out := &bytes.Buffer{}
+	CombinedAccessLogger(out).LogAccess(&AccessRecord{
+		Time:       time.Date(2020, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600)),
+		ClientAddr: "127.0.0.1:51234",
+		Identity:   "frank",
+		Method:     http.MethodConnect,
+		URL:        "example.com:443",
+		Proto:      "HTTP/1.1",
+		StatusCode: http.StatusOK,
+		BytesDown:  2326,
+		Err:        errors.New("ignored"),
+	})
+	assert.Equal(t, `127.0.0.1 - frank [10/Oct/2020:13:55:36 -0700] "CONNECT example.com:443 HTTP/1.1" 200 2326 "-" "-"`+"\n", out.String())
+}
@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	defaultUsageWindow        = 1 * time.Hour
+	defaultUsageFlushInterval = 1 * time.Minute
+)
+
+// Usage is an amount of tunneled traffic.
+type Usage struct {
+	// BytesUp is the number of bytes sent from clients to upstream
+	BytesUp int64
+
+	// BytesDown is the number of bytes sent from upstream to clients
+	BytesDown int64
+}
+
+func (u *Usage) add(other Usage) {
+	u.BytesUp += other.BytesUp
+	u.BytesDown += other.BytesDown
+}
+
+// UsageRecord is the usage of a single client during the window starting at
+// Window.
+type UsageRecord struct {
+	Client string
+	Window time.Time
+	Usage
+}
+
+// UsageStore persists the usage aggregated by Accounting. See
+// NewMemoryUsageStore and NewSQLiteUsageStore.
+type UsageStore interface {
+	// Add adds the given usage to what's already stored for each client and
+	// window.
+	Add(records []UsageRecord) error
+
+	// Usage returns the total stored usage of client in all windows starting
+	// at or after since.
+	Usage(client string, since time.Time) (Usage, error)
+}
+
+// AccountingOpts configures aggregating the traffic of each client's tunnels,
+// see Opts.Accounting.
+type AccountingOpts struct {
+	// Store is where usage is flushed to.
+	Store UsageStore
+
+	// Window is the granularity at which usage is aggregated, defaults to an
+	// hour.
+	Window time.Duration
+
+	// FlushInterval is how often usage, including that of tunnels that are
+	// still open, is flushed to Store. Defaults to a minute.
+	FlushInterval time.Duration
+}
+
+// accountant aggregates the traffic of open tunnels per client and window,
+// periodically flushing it to the store.
+type accountant struct {
+	opts AccountingOpts
+
+	// flushMx is held while flushing so that usage queries don't miss records
+	// in flight to the store
+	flushMx sync.Mutex
+	mx      sync.Mutex
+	pending map[usageKey]*Usage
+	tunnels map[*accountedTunnel]bool
+
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+type usageKey struct {
+	client string
+	window int64
+}
+
+// accountedTunnel tracks how much of a tunnel's traffic was already counted.
+type accountedTunnel struct {
+	client string
+	stats  *TunnelStats
+	Usage
+}
+
+func newAccountant(opts AccountingOpts) *accountant {
+	a := &accountant{
+		opts:    opts,
+		pending: make(map[usageKey]*Usage),
+		tunnels: make(map[*accountedTunnel]bool),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (proxy *proxy) initAccounting() {
+	if proxy.Accounting == nil {
+		return
+	}
+	opts := *proxy.Accounting
+	if opts.Window <= 0 {
+		opts.Window = defaultUsageWindow
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultUsageFlushInterval
+	}
+	proxy.accounting = newAccountant(opts)
+}
+
+func (a *accountant) run() {
+	defer close(a.stopped)
+	ticker := time.NewTicker(a.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stop:
+			a.flush()
+			return
+		case <-ticker.C:
+			a.flush()
+		}
+	}
+}
+
+// track starts accounting the traffic counted by stats to client. The
+// returned function counts the remaining traffic once the tunnel is done.
+func (a *accountant) track(client string, stats *TunnelStats) func() {
+	t := &accountedTunnel{client: client, stats: stats}
+	a.mx.Lock()
+	a.tunnels[t] = true
+	a.mx.Unlock()
+	return func() {
+		a.mx.Lock()
+		defer a.mx.Unlock()
+		a.sampleLocked(t, time.Now())
+		delete(a.tunnels, t)
+	}
+}
+
+// sampleLocked counts the traffic of t since it was last sampled towards the
+// window containing now.
+func (a *accountant) sampleLocked(t *accountedTunnel, now time.Time) {
+	current := Usage{BytesUp: t.stats.BytesUp(), BytesDown: t.stats.BytesDown()}
+	delta := Usage{BytesUp: current.BytesUp - t.BytesUp, BytesDown: current.BytesDown - t.BytesDown}
+	if delta.BytesUp == 0 && delta.BytesDown == 0 {
+		return
+	}
+	t.Usage = current
+	key := usageKey{t.client, now.Truncate(a.opts.Window).UnixNano()}
+	usage := a.pending[key]
+	if usage == nil {
+		usage = &Usage{}
+		a.pending[key] = usage
+	}
+	usage.add(delta)
+}
+
+func (a *accountant) sampleAllLocked() {
+	now := time.Now()
+	for t := range a.tunnels {
+		a.sampleLocked(t, now)
+	}
+}
+
+// flush writes the pending usage to the store. If that fails, the usage is
+// kept for the next attempt.
+func (a *accountant) flush() {
+	a.flushMx.Lock()
+	defer a.flushMx.Unlock()
+
+	a.mx.Lock()
+	a.sampleAllLocked()
+	pending := a.pending
+	a.pending = make(map[usageKey]*Usage)
+	a.mx.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	records := make([]UsageRecord, 0, len(pending))
+	for key, usage := range pending {
+		records = append(records, UsageRecord{Client: key.client, Window: time.Unix(0, key.window), Usage: *usage})
+	}
+	if err := a.opts.Store.Add(records); err != nil {
+		log.Errorf("Unable to flush usage of %d clients, will retry: %v", len(records), err)
+		a.mx.Lock()
+		for key, usage := range pending {
+			if existing := a.pending[key]; existing != nil {
+				existing.add(*usage)
+			} else {
+				a.pending[key] = usage
+			}
+		}
+		a.mx.Unlock()
+	}
+}
+
+// usage returns the usage of client since the start of the window containing
+// since, from the store and what's pending.
+func (a *accountant) usage(client string, since time.Time) (Usage, error) {
+	a.flushMx.Lock()
+	defer a.flushMx.Unlock()
+
+	since = since.Truncate(a.opts.Window)
+	result, err := a.opts.Store.Usage(client, since)
+	if err != nil {
+		return Usage{}, errors.New("Unable to query usage of %v: %v", client, err)
+	}
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	a.sampleAllLocked()
+	for key, usage := range a.pending {
+		if key.client == client && key.window >= since.UnixNano() {
+			result.add(*usage)
+		}
+	}
+	return result, nil
+}
+
+// close stops flushing periodically, flushing one last time.
+func (a *accountant) close() {
+	a.closeOnce.Do(func() {
+		close(a.stop)
+	})
+	<-a.stopped
+}
+
+// ClientUsage implements the interface Proxy
+func (proxy *proxy) ClientUsage(client string, since time.Time) (Usage, error) {
+	if proxy.accounting == nil {
+		return Usage{}, errors.New("Accounting isn't enabled")
+	}
+	return proxy.accounting.usage(client, since)
+}
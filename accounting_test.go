@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccounting(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	store := NewMemoryUsageStore()
+	p := newProxy(&Opts{Accounting: &AccountingOpts{Store: store, FlushInterval: time.Hour}})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go p.Serve(l)
+
+	conn, br, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(br, make([]byte, 5))
+	require.NoError(t, err)
+
+	usage, err := p.ClientUsage("127.0.0.1", time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, Usage{BytesUp: 5, BytesDown: 5}, usage, "Open tunnels should be accounted before flushing")
+	stored, _ := store.Usage("127.0.0.1", time.Time{})
+	assert.Equal(t, Usage{}, stored)
+
+	usage, err = p.ClientUsage("127.0.0.1", time.Now().Add(2*defaultUsageWindow))
+	require.NoError(t, err)
+	assert.Equal(t, Usage{}, usage, "Usage in earlier windows shouldn't count")
+
+	conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _, err = p.Shutdown(ctx)
+	require.NoError(t, err)
+	stored, _ = store.Usage("127.0.0.1", time.Time{})
+	assert.Equal(t, Usage{BytesUp: 5, BytesDown: 5}, stored, "Shutdown should flush usage")
+
+	_, err = newProxy(&Opts{}).ClientUsage("127.0.0.1", time.Now())
+	assert.Error(t, err)
+}
+
+// failingUsageStore fails to add records until told otherwise.
+type failingUsageStore struct {
+	UsageStore
+	mx   sync.Mutex
+	fail bool
+}
+
+func (s *failingUsageStore) Add(records []UsageRecord) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.fail {
+		return errors.New("Store unavailable")
+	}
+	return s.UsageStore.Add(records)
+}
+
+func TestAccountingRetriesFailedFlush(t *testing.T) {
+	store := &failingUsageStore{UsageStore: NewMemoryUsageStore(), fail: true}
+	a := newAccountant(AccountingOpts{Store: store, Window: time.Hour, FlushInterval: time.Hour})
+	defer a.close()
+
+	stats := &TunnelStats{}
+	done := a.track("alice", stats)
+	stats.bytesUp, stats.bytesDown = 10, 100
+	a.flush()
+	usage, err := a.usage("alice", time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, Usage{BytesUp: 10, BytesDown: 100}, usage, "Failed flush should keep usage pending")
+
+	stats.bytesUp = 15
+	done()
+	store.mx.Lock()
+	store.fail = false
+	store.mx.Unlock()
+	a.flush()
+	stored, _ := store.Usage("alice", time.Time{})
+	assert.Equal(t, Usage{BytesUp: 15, BytesDown: 100}, stored)
+	usage, err = a.usage("alice", time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, stored, usage, "Flushed usage shouldn't be counted twice")
+}
@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tunnelRegistry keeps track of open tunnels so that they can be listed and
+// force-closed from the admin handler.
+type tunnelRegistry struct {
+	nextID  uint64
+	mx      sync.Mutex
+	tunnels map[uint64]*activeTunnel
+}
+
+type activeTunnel struct {
+	id           uint64
+	client       string
+	identity     string
+	protocol     string
+	upstreamAddr string
+	start        time.Time
+	stats        *TunnelStats
+	close        func()
+}
+
+func newTunnelRegistry() *tunnelRegistry {
+	return &tunnelRegistry{tunnels: make(map[uint64]*activeTunnel)}
+}
+
+// add registers a tunnel, returning a function that unregisters it.
+func (r *tunnelRegistry) add(tunnel *activeTunnel) func() {
+	tunnel.id = atomic.AddUint64(&r.nextID, 1)
+	r.mx.Lock()
+	r.tunnels[tunnel.id] = tunnel
+	r.mx.Unlock()
+	return func() {
+		r.mx.Lock()
+		delete(r.tunnels, tunnel.id)
+		r.mx.Unlock()
+	}
+}
+
+func (r *tunnelRegistry) get(id uint64) *activeTunnel {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.tunnels[id]
+}
+
+// list returns the open tunnels, oldest first.
+func (r *tunnelRegistry) list() []*activeTunnel {
+	r.mx.Lock()
+	result := make([]*activeTunnel, 0, len(r.tunnels))
+	for _, tunnel := range r.tunnels {
+		result = append(result, tunnel)
+	}
+	r.mx.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].id < result[j].id
+	})
+	return result
+}
+
+// registerTunnel registers a tunnel that's about to start piping, returning a
+// function that unregisters it.
+func (proxy *proxy) registerTunnel(ctx context.Context, upstreamAddr string, upstream net.Conn, downstream net.Conn, start time.Time) func() {
+	tunnel := &activeTunnel{
+		identity:     AuthenticatedIdentity(ctx),
+		upstreamAddr: upstreamAddr,
+		start:        start,
+		stats:        CurrentTunnelStats(ctx),
+		close: func() {
+			upstream.Close()
+			downstream.Close()
+		},
+	}
+	if addr := downstream.RemoteAddr(); addr != nil {
+		tunnel.client = addr.String()
+	}
+	if rec := accessRecord(ctx); rec != nil {
+		tunnel.protocol = rec.Protocol
+	}
+	return proxy.tunnels.add(tunnel)
+}
+
+// AdminTunnel describes an open tunnel in the output of AdminHandler.
+type AdminTunnel struct {
+	ID           uint64 `json:"id"`
+	Client       string `json:"client"`
+	Identity     string `json:"identity,omitempty"`
+	Protocol     string `json:"protocol,omitempty"`
+	UpstreamAddr string `json:"upstreamAddr"`
+	Start        string `json:"start"`
+	AgeSeconds   int64  `json:"ageSeconds"`
+
+	// BytesUp and BytesDown are only included when bytes are being counted,
+	// see Opts.CountTunnelBytes
+	BytesUp   *int64 `json:"bytesUp,omitempty"`
+	BytesDown *int64 `json:"bytesDown,omitempty"`
+}
+
+// AdminHandler implements the interface Proxy
+func (proxy *proxy) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tunnels", proxy.adminTunnels)
+	mux.HandleFunc("/tunnels/", proxy.adminTunnel)
+	mux.HandleFunc("/config", proxy.adminConfig)
+	mux.HandleFunc("/limits", proxy.adminLimits)
+	mux.HandleFunc("/pool", proxy.adminPool)
+	mux.HandleFunc("/slo", proxy.adminSLO)
+	mux.HandleFunc("/har", proxy.adminHAR)
+	mux.HandleFunc("/bandwidth", proxy.adminBandwidth)
+	mux.HandleFunc(healthzPath, proxy.adminHealth)
+	mux.HandleFunc(readyzPath, proxy.adminHealth)
+	return mux
+}
+
+func (proxy *proxy) adminTunnels(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	now := time.Now()
+	tunnels := make([]*AdminTunnel, 0)
+	for _, tunnel := range proxy.tunnels.list() {
+		at := &AdminTunnel{
+			ID:           tunnel.id,
+			Client:       tunnel.client,
+			Identity:     tunnel.identity,
+			Protocol:     tunnel.protocol,
+			UpstreamAddr: tunnel.upstreamAddr,
+			Start:        tunnel.start.UTC().Format(time.RFC3339),
+			AgeSeconds:   int64(now.Sub(tunnel.start) / time.Second),
+		}
+		if tunnel.stats != nil {
+			up, down := tunnel.stats.BytesUp(), tunnel.stats.BytesDown()
+			at.BytesUp, at.BytesDown = &up, &down
+		}
+		tunnels = append(tunnels, at)
+	}
+	writeAdminJSON(w, tunnels)
+}
+
+// adminTunnel force-closes the tunnel whose ID follows /tunnels/ in response
+// to DELETE or POST.
+func (proxy *proxy) adminTunnel(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodDelete && req.Method != http.MethodPost {
+		http.Error(w, "Only DELETE and POST are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(req.URL.Path, "/tunnels/"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid tunnel ID", http.StatusBadRequest)
+		return
+	}
+	tunnel := proxy.tunnels.get(id)
+	if tunnel == nil {
+		http.Error(w, "Unknown tunnel", http.StatusNotFound)
+		return
+	}
+	log.Debugf("Force-closing tunnel %d from %v to %v", id, tunnel.client, tunnel.upstreamAddr)
+	tunnel.close()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (proxy *proxy) adminConfig(w http.ResponseWriter, req *http.Request) {
+	cfg := proxy.currentConfig()
+	writeAdminJSON(w, map[string]interface{}{
+		"accessControl":      cfg.AccessControl != nil,
+		"authenticator":      cfg.Authenticator != nil,
+		"rateLimiter":        cfg.RateLimiter != nil,
+		"idleTimeout":        proxy.IdleTimeout.String(),
+		"okWaitsForUpstream": proxy.OKWaitsForUpstream,
+		"countTunnelBytes":   proxy.countTunnelBytes(),
+		"mitm":               proxy.mitmIC != nil,
+		"timeouts": map[string]string{
+			"dial":              proxy.dialTimeout().String(),
+			"tlsHandshake":      proxy.Timeouts.TLSHandshake.String(),
+			"responseHeader":    proxy.Timeouts.ResponseHeader.String(),
+			"request":           proxy.Timeouts.Request.String(),
+			"maxTunnelDuration": proxy.Timeouts.MaxTunnelDuration.String(),
+		},
+	})
+}
+
+func (proxy *proxy) adminLimits(w http.ResponseWriter, req *http.Request) {
+	limits := map[string]interface{}{
+		"concurrencyLimit":            proxy.ConcurrencyLimit,
+		"concurrencyQueueTimeout":     proxy.ConcurrencyQueueTimeout.String(),
+		"clientTunnelQuota":           proxy.ClientTunnelQuota,
+		"destinationConcurrencyLimit": proxy.DestinationConcurrencyLimit,
+		"activeTunnels":               len(proxy.tunnels.list()),
+		"tunnelsByClient":             proxy.ActiveTunnelsByClient(),
+		"connectionsByDestination":    proxy.ActiveConnectionsByDestination(),
+	}
+	if proxy.limiter != nil {
+		limits["concurrencySlotsInUse"] = len(proxy.limiter.slots)
+	}
+	writeAdminJSON(w, limits)
+}
+
+func (proxy *proxy) adminPool(w http.ResponseWriter, req *http.Request) {
+	pool := map[string]interface{}{
+		"enabled": proxy.pool != nil,
+	}
+	if proxy.pool != nil {
+		pool["maxIdleConnsPerHost"] = proxy.pool.MaxIdleConnsPerHost
+		pool["idleConnTimeout"] = proxy.pool.IdleConnTimeout.String()
+		pool["dials"] = atomic.LoadInt64(&proxy.poolStats.dials)
+		pool["openConns"] = atomic.LoadInt64(&proxy.poolStats.open)
+	}
+	writeAdminJSON(w, pool)
+}
+
+func writeAdminJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(value); err != nil {
+		log.Debugf("Unable to write admin response: %v", err)
+	}
+}
+
+func (proxy *proxy) countTunnelBytes() bool {
+	return proxy.CountTunnelBytes || proxy.OnTunnelComplete != nil || proxy.accounting != nil
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	ht "net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminHandler(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	p := newProxy(&Opts{
+		CountTunnelBytes:            true,
+		ConcurrencyLimit:            5,
+		MaxIdleUpstreamConnsPerHost: 2,
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go p.Serve(l)
+	admin := ht.NewServer(p.AdminHandler())
+	defer admin.Close()
+
+	getJSON := func(path string, value interface{}) {
+		resp, err := http.Get(admin.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(value))
+	}
+	closeTunnel := func(id string) int {
+		req, _ := http.NewRequest(http.MethodDelete, admin.URL+"/tunnels/"+id, nil)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	conn, br, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+	defer conn.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(br, make([]byte, 5))
+	require.NoError(t, err)
+
+	var tunnels []*AdminTunnel
+	getJSON("/tunnels", &tunnels)
+	require.Len(t, tunnels, 1)
+	tunnel := tunnels[0]
+	assert.Equal(t, origin.Addr().String(), tunnel.UpstreamAddr)
+	assert.Equal(t, conn.LocalAddr().String(), tunnel.Client)
+	if assert.NotNil(t, tunnel.BytesUp) && assert.NotNil(t, tunnel.BytesDown) {
+		assert.EqualValues(t, 5, *tunnel.BytesUp)
+		assert.EqualValues(t, 5, *tunnel.BytesDown)
+	}
+
+	var limits map[string]interface{}
+	getJSON("/limits", &limits)
+	assert.EqualValues(t, 5, limits["concurrencyLimit"])
+	assert.EqualValues(t, 1, limits["activeTunnels"])
+
+	var pool map[string]interface{}
+	getJSON("/pool", &pool)
+	assert.Equal(t, true, pool["enabled"])
+	assert.EqualValues(t, 2, pool["maxIdleConnsPerHost"])
+
+	var config map[string]interface{}
+	getJSON("/config", &config)
+	assert.Equal(t, true, config["countTunnelBytes"])
+	assert.Equal(t, false, config["authenticator"])
+
+	assert.Equal(t, http.StatusNotFound, closeTunnel("12345"))
+	assert.Equal(t, http.StatusBadRequest, closeTunnel("bogus"))
+	assert.Equal(t, http.StatusNoContent, closeTunnel(fmt.Sprint(tunnel.ID)))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = ioutil.ReadAll(br)
+	assert.NoError(t, err, "Force-closed tunnel should end with EOF")
+
+	for i := 0; i < 50; i++ {
+		getJSON("/tunnels", &tunnels)
+		if len(tunnels) == 0 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Empty(t, tunnels, "Closed tunnel should no longer be listed")
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"net"
+)
+
+const (
+	// ACMETLSALPNProtocol is the ALPN protocol with which ACME servers
+	// validate the TLS-ALPN-01 challenge (RFC 8737).
+	ACMETLSALPNProtocol = "acme-tls/1"
+)
+
+// ALPNRoute routes transparent TLS connections whose ClientHello offers
+// Protocol, see Opts.ALPNRoutes.
+type ALPNRoute struct {
+	// Protocol is the ALPN protocol to match, for example ACMETLSALPNProtocol.
+	Protocol string
+
+	// Addr, if specified, is the address that matching connections are sent
+	// to instead of port 443 of the host named by SNI, for example that of a
+	// dedicated ACME client. With Addr, the ClientHello needn't include SNI.
+	Addr string
+
+	// Bypass dials matching connections directly instead of through the
+	// configured Dial, Rewriter and upstreams, which validation requests of
+	// ACME servers wouldn't get through. If Addr is specified, they're also
+	// exempt from access control and tunnel limits; otherwise, since the
+	// destination comes from the client, those still apply. Bypass routes
+	// only match ClientHellos that offer Protocol and nothing else, so that
+	// clients can't sneak other connections through by adding it to their
+	// offer.
+	Bypass bool
+}
+
+// ACMEPassthrough returns an ALPNRoute that passes TLS-ALPN-01 validation
+// requests, which offer only ACMETLSALPNProtocol (RFC 8737), straight through
+// to addr, or to the host named by SNI if addr is empty.
+func ACMEPassthrough(addr string) *ALPNRoute {
+	return &ALPNRoute{Protocol: ACMETLSALPNProtocol, Addr: addr, Bypass: true}
+}
+
+// alpnRoute returns the first route matching the offered protocols, or nil if
+// none does.
+func (proxy *proxy) alpnRoute(protocols []string) *ALPNRoute {
+	for _, route := range proxy.ALPNRoutes {
+		if route.Bypass {
+			if len(protocols) == 1 && protocols[0] == route.Protocol {
+				return route
+			}
+			continue
+		}
+		for _, protocol := range protocols {
+			if protocol == route.Protocol {
+				return route
+			}
+		}
+	}
+	return nil
+}
+
+// exemptsFromLimits indicates whether connections following route skip access
+// control and tunnel limits.
+func (route *ALPNRoute) exemptsFromLimits() bool {
+	return route != nil && route.Bypass && route.Addr != ""
+}
+
+// dialBypassing dials addr directly for a Bypass route, at the IPs that access
+// control checked, if any.
+func (proxy *proxy) dialBypassing(ctx context.Context, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, proxy.dialTimeout())
+	defer cancel()
+	addrs, err := proxy.resolveAddr(ctx, addr)
+	if err != nil {
+		return nil, dialError(addr, PhaseResolve, err)
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addrs[0])
+	if err != nil {
+		return nil, dialError(addr, PhaseDial, err)
+	}
+	setDialedAddr(ctx, conn.RemoteAddr().String())
+	return conn, nil
+}
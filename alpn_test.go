@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	ht "net/http/httptest"
+	"testing"
+
+	"github.com/getlantern/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestALPNRoutes(t *testing.T) {
+	acme := ht.NewUnstartedServer(http.NotFoundHandler())
+	acme.TLS = &tls.Config{NextProtos: []string{ACMETLSALPNProtocol}}
+	acme.StartTLS()
+	defer acme.Close()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go newProxy(&Opts{
+		AccessControl: AccessControlFunc(func(ctx context.Context, clientIP net.IP, dest *Destination) error {
+			return errors.New("denied")
+		}),
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			return nil, errors.New("Bypassing routes shouldn't use Dial")
+		},
+		ALPNRoutes: []*ALPNRoute{ACMEPassthrough(acme.Listener.Addr().String())},
+	}).ServeTransparent(l)
+
+	handshake := func(protos ...string) (tls.ConnectionState, error) {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			ServerName:         "www.example.com",
+			NextProtos:         protos,
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return tls.ConnectionState{}, err
+		}
+		defer conn.Close()
+		return conn.ConnectionState(), nil
+	}
+	state, err := handshake(ACMETLSALPNProtocol)
+	require.NoError(t, err, "ACME validation should be passed through despite access control")
+	assert.Equal(t, ACMETLSALPNProtocol, state.NegotiatedProtocol)
+
+	_, err = handshake("h2", "http/1.1")
+	assert.Error(t, err, "Other connections should still be subject to access control")
+	_, err = handshake("h2", ACMETLSALPNProtocol)
+	assert.Error(t, err, "Offering other protocols along with ACME shouldn't bypass access control")
+}
+
+func TestALPNRouteWithoutAddr(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	checked := make(chan string, 1)
+	go newProxy(&Opts{
+		AccessControl: AccessControlFunc(func(ctx context.Context, clientIP net.IP, dest *Destination) error {
+			checked <- dest.Host
+			return errors.New("denied")
+		}),
+		ALPNRoutes: []*ALPNRoute{ACMEPassthrough("")},
+	}).ServeTransparent(l)
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		ServerName:         "internal.example",
+		NextProtos:         []string{ACMETLSALPNProtocol},
+		InsecureSkipVerify: true,
+	})
+	if err == nil {
+		conn.Close()
+	}
+	assert.Error(t, err, "Destinations named by the client should be subject to access control")
+	assert.Equal(t, "internal.example", <-checked)
+}
+
+func TestALPNRoute(t *testing.T) {
+	route := &ALPNRoute{Protocol: "special"}
+	p := newProxy(&Opts{ALPNRoutes: []*ALPNRoute{ACMEPassthrough(""), route}}).(*proxy)
+	assert.Equal(t, route, p.alpnRoute([]string{"h2", "special"}))
+	assert.Equal(t, ACMETLSALPNProtocol, p.alpnRoute([]string{ACMETLSALPNProtocol}).Protocol)
+	assert.Nil(t, p.alpnRoute([]string{"h2"}))
+	assert.Nil(t, p.alpnRoute([]string{ACMETLSALPNProtocol, "h2"}), "Bypass routes should only match sole offers")
+	assert.Nil(t, p.alpnRoute(nil))
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAltSvcMaxAge = 24 * time.Hour
+)
+
+// altSvcCache remembers which origins have advertised HTTP/3 support via the
+// Alt-Svc header (RFC 7838). Only alternatives on the same host are supported.
+type altSvcCache struct {
+	mx      sync.Mutex
+	entries map[string]*altSvcEntry
+}
+
+type altSvcEntry struct {
+	port    string
+	expires time.Time
+}
+
+func newAltSvcCache() *altSvcCache {
+	return &altSvcCache{entries: make(map[string]*altSvcEntry)}
+}
+
+// h3Addr returns the host:port at which the given origin host:port supports
+// HTTP/3, or "" if it hasn't advertised support.
+func (c *altSvcCache) h3Addr(origin string) string {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	entry := c.entries[origin]
+	if entry == nil {
+		return ""
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, origin)
+		return ""
+	}
+	host, _, err := net.SplitHostPort(origin)
+	if err != nil {
+		return ""
+	}
+	return net.JoinHostPort(host, entry.port)
+}
+
+func (c *altSvcCache) remove(origin string) {
+	c.mx.Lock()
+	delete(c.entries, origin)
+	c.mx.Unlock()
+}
+
+// update records the HTTP/3 alternative advertised by origin in the given
+// Alt-Svc header values, if any.
+func (c *altSvcCache) update(origin string, values []string) {
+	if len(values) == 0 {
+		return
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	for _, value := range values {
+		if strings.TrimSpace(value) == "clear" {
+			delete(c.entries, origin)
+			return
+		}
+		for _, alternative := range strings.Split(value, ",") {
+			if entry := parseH3Alternative(alternative); entry != nil {
+				c.entries[origin] = entry
+				return
+			}
+		}
+	}
+}
+
+// parseH3Alternative parses a single Alt-Svc alternative like
+// h3=":443"; ma=3600, returning nil if it's not a same-host HTTP/3
+// alternative.
+func parseH3Alternative(alternative string) *altSvcEntry {
+	params := strings.Split(alternative, ";")
+	protocolAndAuthority := strings.SplitN(strings.TrimSpace(params[0]), "=", 2)
+	if len(protocolAndAuthority) != 2 {
+		return nil
+	}
+	protocol := protocolAndAuthority[0]
+	if protocol != "h3" && !strings.HasPrefix(protocol, "h3-") {
+		return nil
+	}
+	authority := strings.Trim(protocolAndAuthority[1], `"`)
+	if !strings.HasPrefix(authority, ":") {
+		// alternative host, not supported
+		return nil
+	}
+	entry := &altSvcEntry{port: authority[1:], expires: time.Now().Add(defaultAltSvcMaxAge)}
+	for _, param := range params[1:] {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) == 2 && kv[0] == "ma" {
+			if maxAge, err := strconv.Atoi(strings.Trim(kv[1], `"`)); err == nil {
+				entry.expires = time.Now().Add(time.Duration(maxAge) * time.Second)
+			}
+		}
+	}
+	return entry
+}
+
+// h3Transport sends requests to origins that have advertised HTTP/3 support
+// using an HTTP/3 RoundTripper, falling back to the regular TCP transport if
+// that fails.
+type h3Transport struct {
+	idleClosingTransport
+	h3     http.RoundTripper
+	altSvc *altSvcCache
+}
+
+func (t *h3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	origin := req.URL.Host
+	if req.URL.Scheme == "https" {
+		if req.URL.Port() == "" {
+			origin = net.JoinHostPort(req.URL.Hostname(), "443")
+		}
+		if h3Addr := t.altSvc.h3Addr(origin); h3Addr != "" {
+			h3Req := req
+			if h3Addr != origin {
+				// Keep the Host as is, but connect to the alternative port
+				h3Req = new(http.Request)
+				*h3Req = *req
+				h3Req.URL = cloneURL(req.URL)
+				h3Req.URL.Host = h3Addr
+				if h3Req.Host == "" {
+					h3Req.Host = req.URL.Host
+				}
+			}
+			resp, err := t.h3.RoundTrip(h3Req)
+			if err == nil {
+				t.altSvc.update(origin, resp.Header["Alt-Svc"])
+				return resp, nil
+			}
+			log.Debugf("Unable to round-trip to %v over HTTP/3, falling back to TCP: %v", h3Addr, err)
+			t.altSvc.remove(origin)
+			if req.Body != nil && req.Body != http.NoBody {
+				if req.GetBody == nil {
+					return nil, err
+				}
+				body, bodyErr := req.GetBody()
+				if bodyErr != nil {
+					return nil, err
+				}
+				req.Body = body
+			}
+		}
+	}
+
+	resp, err := t.idleClosingTransport.RoundTrip(req)
+	if err == nil && req.URL.Scheme == "https" {
+		t.altSvc.update(origin, resp.Header["Alt-Svc"])
+	}
+	return resp, err
+}
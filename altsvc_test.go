@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func (f roundTripperFunc) CloseIdleConnections() {
+}
+
+func TestH3Transport(t *testing.T) {
+	var h3Fails bool
+	var viaTCP, viaH3 []string
+	tcp := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		viaTCP = append(viaTCP, req.URL.Host)
+		header := make(http.Header)
+		header.Set("Alt-Svc", `h2=":443", h3=":8443"; ma=60`)
+		return &http.Response{StatusCode: http.StatusOK, Header: header}, nil
+	})
+	h3 := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if h3Fails {
+			return nil, errors.New("handshake timeout")
+		}
+		viaH3 = append(viaH3, req.URL.Host)
+		return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header)}, nil
+	})
+	tr := &h3Transport{tcp, h3, newAltSvcCache()}
+
+	get := func() {
+		req, _ := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+		_, err := tr.RoundTrip(req)
+		assert.NoError(t, err)
+	}
+
+	get()
+	assert.Equal(t, []string{"example.com"}, viaTCP, "First request should go over TCP")
+	get()
+	assert.Equal(t, []string{"example.com:8443"}, viaH3, "Once advertised, requests should use HTTP/3 on the alternative port")
+
+	h3Fails = true
+	get()
+	assert.Len(t, viaTCP, 2, "Failed HTTP/3 request should be retried over TCP")
+	h3Fails = false
+	tr.altSvc.remove("example.com:443")
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	tr.RoundTrip(req)
+	tr.RoundTrip(req)
+	assert.Len(t, viaH3, 1, "Plain http requests should never use HTTP/3")
+}
+
+func TestParseH3Alternative(t *testing.T) {
+	entry := parseH3Alternative(`h3=":443"; ma=3600`)
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, "443", entry.port)
+	}
+	assert.NotNil(t, parseH3Alternative(`h3-29=":443"`))
+	assert.Nil(t, parseH3Alternative(`h2=":443"`))
+	assert.Nil(t, parseH3Alternative(`h3="alt.example.com:443"`))
+}
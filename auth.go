@@ -0,0 +1,325 @@
+package proxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+)
+
+const (
+	ctxKeyIdentity = contextKey("identity")
+
+	digestNonceTTL = 5 * time.Minute
+)
+
+// Authenticator authenticates proxy users based on the Proxy-Authorization
+// header of their requests.
+type Authenticator interface {
+	// Authenticate checks the credentials in the Proxy-Authorization header of
+	// the given request and returns the authenticated identity. If the request
+	// doesn't carry valid credentials, ok is false.
+	Authenticate(ctx context.Context, req *http.Request) (identity string, ok bool)
+
+	// Challenges returns the values of the Proxy-Authenticate headers to send
+	// to clients that failed to authenticate. The request carries the context
+	// that was passed to Authenticate.
+	Challenges(req *http.Request) []string
+}
+
+// AuthenticatedIdentity returns the identity of the proxy user authenticated
+// by the configured Authenticator, or "" if there is none.
+func AuthenticatedIdentity(ctx context.Context) string {
+	identity := ctx.Value(ctxKeyIdentity)
+	if identity == nil {
+		return ""
+	}
+	return identity.(string)
+}
+
+// authFilter returns a filter that rejects requests that can't be
+// authenticated by auth with a 407 Proxy Authentication Required, or for
+// plain HTTP requests with auth's Interstitial, if it has one. Requests in
+// MITM'ed tunnels aren't checked again, since clients send credentials to the
+// proxy only with their CONNECT. Other requests on a keep-alive connection are
+// each authenticated, since proxies in front of this one may pool connections
+// of different users. Only connection-based schemes like Negotiate carry an
+// identity over, which they track themselves.
+func authFilter(auth Authenticator) filters.Filter {
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		if ctx.IsMITMing() {
+			return next(ctx, req)
+		}
+		var identity string
+		ok := false
+		if !takeEarlyAuthFailure(ctx) {
+			identity, ok = auth.Authenticate(ctx, req)
+		}
+		if !ok {
+			// Make sure the body is consumed so the client can retry with
+			// credentials on the same connection.
+			if req.Body != nil {
+				io.Copy(ioutil.Discard, req.Body)
+				req.Body.Close()
+			}
+			// Failed credentials deauthenticate the connection
+			ctx = ctx.WithValue(ctxKeyIdentity, nil)
+			if interstitial, ok := auth.(Interstitial); ok && req.Method != http.MethodConnect {
+				if resp := interstitial.Interstitial(req.WithContext(ctx)); resp != nil {
+					return filters.ShortCircuit(ctx, req, resp)
+				}
+			}
+			resp := &http.Response{
+				StatusCode: http.StatusProxyAuthRequired,
+				Header:     make(http.Header),
+			}
+			for _, challenge := range auth.Challenges(req.WithContext(ctx)) {
+				resp.Header.Add("Proxy-Authenticate", challenge)
+			}
+			return filters.ShortCircuit(ctx, req, resp)
+		}
+		ctx = ctx.WithValue(ctxKeyIdentity, identity)
+		return next(ctx, req.WithContext(ctx))
+	})
+}
+
+// BasicAuth returns an Authenticator for the Basic scheme that uses verify to
+// check usernames and passwords. The authenticated identity is the username.
+func BasicAuth(realm string, verify func(username, password string) bool) Authenticator {
+	return &basicAuth{realm, verify}
+}
+
+type basicAuth struct {
+	realm  string
+	verify func(username, password string) bool
+}
+
+func (a *basicAuth) Authenticate(ctx context.Context, req *http.Request) (string, bool) {
+	username, password, ok := proxyBasicAuth(req)
+	if !ok || !a.verify(username, password) {
+		return "", false
+	}
+	return username, true
+}
+
+func (a *basicAuth) Challenges(req *http.Request) []string {
+	return []string{fmt.Sprintf("Basic realm=%q", a.realm)}
+}
+
+// proxyBasicAuth is like http.Request.BasicAuth but uses Proxy-Authorization.
+func proxyBasicAuth(req *http.Request) (username, password string, ok bool) {
+	credentials, ok := authCredentials(req, "Basic")
+	if !ok {
+		return
+	}
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", "", false
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// BearerAuth returns an Authenticator for the Bearer scheme that uses verify to
+// check tokens and map them to identities.
+func BearerAuth(realm string, verify func(token string) (identity string, ok bool)) Authenticator {
+	return &bearerAuth{realm, verify}
+}
+
+type bearerAuth struct {
+	realm  string
+	verify func(token string) (string, bool)
+}
+
+func (a *bearerAuth) Authenticate(ctx context.Context, req *http.Request) (string, bool) {
+	token, ok := authCredentials(req, "Bearer")
+	if !ok {
+		return "", false
+	}
+	return a.verify(token)
+}
+
+func (a *bearerAuth) Challenges(req *http.Request) []string {
+	return []string{fmt.Sprintf("Bearer realm=%q", a.realm)}
+}
+
+// DigestAuth returns an Authenticator for the Digest scheme (RFC 7616, MD5 with
+// qop=auth) that uses password to look up the password for a given username.
+// Nonces are stateless and expire after 5 minutes; nonce counts aren't tracked.
+func DigestAuth(realm string, password func(username string) (string, bool)) Authenticator {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return &digestAuth{realm: realm, password: password, secret: secret}
+}
+
+type digestAuth struct {
+	realm    string
+	password func(username string) (string, bool)
+	secret   []byte
+}
+
+func (a *digestAuth) Authenticate(ctx context.Context, req *http.Request) (string, bool) {
+	credentials, ok := authCredentials(req, "Digest")
+	if !ok {
+		return "", false
+	}
+	params := parseAuthParams(credentials)
+	username := params["username"]
+	if params["realm"] != a.realm || !a.validNonce(params["nonce"]) || !digestURIMatches(req, params["uri"]) {
+		return "", false
+	}
+	password, found := a.password(username)
+	if !found {
+		return "", false
+	}
+
+	ha1 := md5Hex(username + ":" + a.realm + ":" + password)
+	ha2 := md5Hex(req.Method + ":" + params["uri"])
+	var expected string
+	if params["qop"] == "" {
+		expected = md5Hex(ha1 + ":" + params["nonce"] + ":" + ha2)
+	} else {
+		expected = md5Hex(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], params["qop"], ha2}, ":"))
+	}
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(params["response"])) != 1 {
+		return "", false
+	}
+	return username, true
+}
+
+// digestURIMatches checks that the uri the client signed is the target of req,
+// so that credentials can't be replayed for other requests.
+func digestURIMatches(req *http.Request, uri string) bool {
+	if req.RequestURI != "" {
+		return uri == req.RequestURI
+	}
+	if req.Method == http.MethodConnect {
+		return uri == req.Host
+	}
+	return uri == req.URL.RequestURI()
+}
+
+func (a *digestAuth) Challenges(req *http.Request) []string {
+	return []string{fmt.Sprintf(`Digest realm=%q, qop="auth", algorithm=MD5, nonce=%q`, a.realm, a.newNonce(time.Now()))}
+}
+
+// newNonce creates a nonce containing a timestamp and an HMAC over it, which
+// allows validating nonces without keeping state.
+func (a *digestAuth) newNonce(ts time.Time) string {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(ts.Unix()))
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(b)
+	return base64.RawURLEncoding.EncodeToString(append(b, mac.Sum(nil)...))
+}
+
+func (a *digestAuth) validNonce(nonce string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != 8+sha256.Size {
+		return false
+	}
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(b[:8])
+	if !hmac.Equal(mac.Sum(nil), b[8:]) {
+		return false
+	}
+	ts := time.Unix(int64(binary.BigEndian.Uint64(b[:8])), 0)
+	return time.Since(ts) < digestNonceTTL
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// MultiAuth returns an Authenticator that accepts credentials for any of the
+// given Authenticators and challenges clients with all of their schemes.
+func MultiAuth(auths ...Authenticator) Authenticator {
+	return multiAuth(auths)
+}
+
+type multiAuth []Authenticator
+
+func (auths multiAuth) Authenticate(ctx context.Context, req *http.Request) (string, bool) {
+	for _, auth := range auths {
+		identity, ok := auth.Authenticate(ctx, req)
+		if ok {
+			return identity, true
+		}
+	}
+	return "", false
+}
+
+func (auths multiAuth) Challenges(req *http.Request) []string {
+	var challenges []string
+	for _, auth := range auths {
+		challenges = append(challenges, auth.Challenges(req)...)
+	}
+	return challenges
+}
+
+// authCredentials returns the credentials from the Proxy-Authorization header
+// if it uses the given scheme.
+func authCredentials(req *http.Request, scheme string) (string, bool) {
+	header := req.Header.Get("Proxy-Authorization")
+	if len(header) <= len(scheme) || !strings.EqualFold(header[:len(scheme)], scheme) || header[len(scheme)] != ' ' {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(scheme)+1:]), true
+}
+
+// parseAuthParams parses comma-separated key=value pairs as used by the Digest
+// scheme, where values may be quoted strings.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " ")
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			value = b.String()
+			if i < len(s) {
+				i++
+			}
+			s = s[i:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		params[key] = value
+	}
+	return params
+}
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	ht "net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/getlantern/mitm"
+	"github.com/getlantern/mockconn"
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBasicAuth(t *testing.T) {
+	var identity string
+	d := mockconn.SucceedingDialer([]byte{})
+	p := newProxy(&Opts{
+		OKWaitsForUpstream: true,
+		Authenticator: BasicAuth("test", func(username, password string) bool {
+			return username == "user" && password == "pass"
+		}),
+		Filter: filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+			identity = AuthenticatedIdentity(ctx)
+			return next(ctx, req)
+		}),
+		Dial: func(ctx context.Context, isConnect bool, net, addr string) (net.Conn, error) {
+			return d.Dial(net, addr)
+		},
+	})
+
+	req, _ := http.NewRequest(http.MethodConnect, "http://thehost:123", nil)
+	resp, _, _ := roundTrip(p, req, true)
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	assert.Equal(t, `Basic realm="test"`, resp.Header.Get("Proxy-Authenticate"))
+	assert.Empty(t, d.LastDialed())
+
+	req.SetBasicAuth("user", "wrong")
+	req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+	resp, _, _ = roundTrip(p, req, true)
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+
+	req.SetBasicAuth("user", "pass")
+	req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+	resp, _, handleErr := roundTrip(p, req, true)
+	assert.NoError(t, handleErr)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "user", identity)
+	assert.Equal(t, "thehost:123", d.LastDialed())
+}
+
+func TestDigestAuth(t *testing.T) {
+	auth := DigestAuth("test", func(username string) (string, bool) {
+		return "pass", username == "user"
+	})
+	req, _ := http.NewRequest(http.MethodGet, "http://thehost/path", nil)
+	_, ok := auth.Authenticate(context.Background(), req)
+	assert.False(t, ok)
+
+	challenge := parseAuthParams(strings.TrimPrefix(auth.Challenges(req)[0], "Digest "))
+	nonce := challenge["nonce"]
+	assert.Equal(t, "test", challenge["realm"])
+	assert.Equal(t, "auth", challenge["qop"])
+
+	ha1 := md5Hex("user:test:pass")
+	ha2 := md5Hex("GET:/path")
+	response := md5Hex(ha1 + ":" + nonce + ":00000001:abc:auth:" + ha2)
+	req.Header.Set("Proxy-Authorization", `Digest username="user", realm="test", nonce="`+nonce+`", uri="/path", qop=auth, nc=00000001, cnonce="abc", response="`+response+`"`)
+	identity, ok := auth.Authenticate(context.Background(), req)
+	assert.True(t, ok)
+	assert.Equal(t, "user", identity)
+
+	req.Header.Set("Proxy-Authorization", `Digest username="user", realm="test", nonce="bogus", uri="/path", qop=auth, nc=00000001, cnonce="abc", response="`+response+`"`)
+	_, ok = auth.Authenticate(context.Background(), req)
+	assert.False(t, ok, "Forged nonce should be rejected")
+
+	ha2 = md5Hex("GET:/other")
+	response = md5Hex(ha1 + ":" + nonce + ":00000001:abc:auth:" + ha2)
+	req.Header.Set("Proxy-Authorization", `Digest username="user", realm="test", nonce="`+nonce+`", uri="/other", qop=auth, nc=00000001, cnonce="abc", response="`+response+`"`)
+	_, ok = auth.Authenticate(context.Background(), req)
+	assert.False(t, ok, "Credentials for other URIs should be rejected")
+}
+
+func TestBasicAuthMITM(t *testing.T) {
+	dir := t.TempDir()
+	origin := ht.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	var identity string
+	configFor, _ := upstreamTLSConfigFor(origin)
+	p := newProxy(&Opts{
+		Authenticator: BasicAuth("test", func(username, password string) bool {
+			return username == "user" && password == "pass"
+		}),
+		Filter: filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+			if ctx.IsMITMing() {
+				identity = AuthenticatedIdentity(ctx)
+			}
+			return next(ctx, req)
+		}),
+		MITMOpts: &mitm.Opts{
+			PKFile:   filepath.Join(dir, "proxypk.pem"),
+			CertFile: filepath.Join(dir, "proxycert.pem"),
+			Domains:  []string{"example.com"},
+		},
+		UpstreamTLSConfig: configFor,
+		Dial: func(ctx context.Context, isConnect bool, network, addr string) (net.Conn, error) {
+			return net.Dial(network, origin.Listener.Addr().String())
+		},
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	credentials := base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nProxy-Authorization: Basic %v\r\n\r\n", credentials)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+	require.NoError(t, req.Write(tlsConn))
+	resp, err = http.ReadResponse(bufio.NewReader(tlsConn), req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "MITM'ed requests shouldn't need credentials again")
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, "user", identity, "MITM'ed requests should keep the identity from the CONNECT")
+}
+
+func TestBasicAuthKeepAlive(t *testing.T) {
+	origin := newBodyEchoServer()
+	defer origin.Close()
+	l := serveProxy(t, &Opts{
+		Authenticator: BasicAuth("test", func(username, password string) bool {
+			return username == "user" && password == "pass"
+		}),
+	})
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	get := func(credentials string) int {
+		req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+		if credentials != "" {
+			req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+		}
+		require.NoError(t, req.WriteProxy(conn))
+		resp, readErr := http.ReadResponse(br, req)
+		require.NoError(t, readErr)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, get("user:pass"))
+	assert.Equal(t, http.StatusProxyAuthRequired, get(""), "Requests without credentials shouldn't inherit the identity of earlier ones on the connection")
+	assert.Equal(t, http.StatusOK, get("user:pass"))
+}
@@ -0,0 +1,441 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	// DefaultBalancerFailureThreshold is how many consecutive failed dials
+	// mark a target unhealthy if BalancerOpts.FailureThreshold isn't set.
+	DefaultBalancerFailureThreshold = 3
+
+	// DefaultBalancerCooldown is how long an unhealthy target is avoided if
+	// BalancerOpts.Cooldown isn't set.
+	DefaultBalancerCooldown = 30 * time.Second
+
+	// DefaultBalancerAffinityTTL is how long a client stays pinned to a
+	// target after its last dial if BalancerOpts.AffinityTTL isn't set.
+	DefaultBalancerAffinityTTL = 1 * time.Hour
+
+	ewmaWeight = 0.3
+)
+
+// BalancingStrategy determines how a Balancer picks among its healthy
+// targets.
+type BalancingStrategy int
+
+const (
+	// RoundRobin uses each target in turn
+	RoundRobin BalancingStrategy = iota
+
+	// LeastConnections uses the target with the fewest open connections
+	LeastConnections
+
+	// EWMALatency uses the target with the lowest exponentially weighted
+	// moving average of dial latency
+	EWMALatency
+)
+
+// SessionAffinity determines which clients a Balancer keeps on the same
+// target.
+type SessionAffinity int
+
+const (
+	// NoAffinity picks a target for every dial
+	NoAffinity SessionAffinity = iota
+
+	// ClientIPAffinity keeps all dials on behalf of a client IP on the same
+	// target
+	ClientIPAffinity
+
+	// ClientAffinity keeps all dials on behalf of an authenticated identity,
+	// or of the client IP for unauthenticated clients, on the same target
+	ClientAffinity
+)
+
+// BalancerTarget is one of the upstream servers or proxies among which a
+// Balancer distributes dials.
+type BalancerTarget struct {
+	// Addr is the host:port of the target. The default health check dials it.
+	Addr string
+
+	// Dial dials the requested destination through this target. If nil, dials
+	// go to Addr itself regardless of the requested destination, for balancing
+	// across replicas of a server.
+	Dial DialFunc
+}
+
+// UpstreamTarget returns a BalancerTarget that tunnels through the given
+// upstream proxy.
+func UpstreamTarget(upstream *Upstream) *BalancerTarget {
+	return &BalancerTarget{Addr: upstream.Addr, Dial: ChainDial(nil, upstream)}
+}
+
+// BalancerOpts configures a Balancer.
+type BalancerOpts struct {
+	// Strategy is how targets are picked, defaults to RoundRobin.
+	Strategy BalancingStrategy
+
+	// Targets are the targets to balance across.
+	Targets []*BalancerTarget
+
+	// FailureThreshold is how many consecutive failed dials mark a target
+	// unhealthy. Defaults to DefaultBalancerFailureThreshold.
+	FailureThreshold int
+
+	// Cooldown is how long an unhealthy target is avoided before dials are
+	// attempted through it again. Defaults to DefaultBalancerCooldown.
+	Cooldown time.Duration
+
+	// HealthCheckInterval, if specified, actively checks every target at this
+	// interval, marking it healthy or unhealthy based on the outcome.
+	HealthCheckInterval time.Duration
+
+	// HealthCheck checks a single target. Defaults to a TCP dial of the
+	// target's Addr.
+	HealthCheck func(ctx context.Context, target *BalancerTarget) error
+
+	// Affinity, if specified, pins each client to the target its first dial
+	// went through, so that all of its tunnels use the same upstream (e.g.
+	// for sites that check that a client's IP stays the same). If the target
+	// fails or is unhealthy, the client fails over to and is pinned to the
+	// next target picked by Strategy.
+	Affinity SessionAffinity
+
+	// AffinityTTL is how long a client stays pinned after its last dial.
+	// Defaults to DefaultBalancerAffinityTTL.
+	AffinityTTL time.Duration
+}
+
+// TargetStatus is a snapshot of the state of a BalancerTarget.
+type TargetStatus struct {
+	Addr        string
+	Healthy     bool
+	ActiveConns int
+	Latency     time.Duration
+}
+
+// Balancer distributes dials across a set of targets, failing over to the
+// next target when a dial fails and avoiding targets that keep failing. Use
+// its Dial method as Opts.Dial or as the Dial of a Route.
+type Balancer struct {
+	opts    *BalancerOpts
+	targets []*balancedTarget
+	stop    chan struct{}
+	stopped sync.Once
+
+	mx        sync.Mutex
+	next      int
+	pins      map[string]*balancerPin
+	nextSweep time.Time
+}
+
+// balancerPin is the target that a client is pinned to.
+type balancerPin struct {
+	target   *balancedTarget
+	lastUsed time.Time
+}
+
+type balancedTarget struct {
+	*BalancerTarget
+	active int64
+
+	failures       int
+	unhealthyUntil time.Time
+	latency        float64
+	sampled        bool
+}
+
+// NewBalancer creates a Balancer using the given opts. Call Close to stop its
+// health checks.
+func NewBalancer(opts *BalancerOpts) (*Balancer, error) {
+	if len(opts.Targets) == 0 {
+		return nil, errors.New("Balancer needs at least one target")
+	}
+	b := &Balancer{opts: opts, stop: make(chan struct{}), pins: make(map[string]*balancerPin)}
+	for _, target := range opts.Targets {
+		bt := &balancedTarget{BalancerTarget: target}
+		if bt.Dial == nil {
+			addr := target.Addr
+			dialer := &net.Dialer{}
+			bt.BalancerTarget = &BalancerTarget{
+				Addr: addr,
+				Dial: func(ctx context.Context, isCONNECT bool, network, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, network, addr)
+				},
+			}
+		}
+		b.targets = append(b.targets, bt)
+	}
+	if opts.HealthCheckInterval > 0 {
+		go b.healthCheckLoop()
+	}
+	return b, nil
+}
+
+// Dial is a DialFunc that dials addr through one of the targets.
+func (b *Balancer) Dial(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+	tried := make(map[*balancedTarget]bool, len(b.targets))
+	client := b.affinityKey(ctx)
+	var lastErr error
+	for range b.targets {
+		target := b.pinned(client)
+		if target == nil || tried[target] {
+			target = b.pick(tried)
+		}
+		tried[target] = true
+		start := time.Now()
+		conn, err := target.Dial(ctx, isCONNECT, network, addr)
+		b.record(target, time.Since(start), err)
+		if err == nil {
+			b.pin(client, target)
+			atomic.AddInt64(&target.active, 1)
+			return &balancedConn{Conn: conn, target: target}, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+		log.Debugf("Unable to dial %v through %v, trying next target: %v", addr, target.Addr, err)
+	}
+	return nil, errors.New("Unable to dial %v through any target: %v", addr, lastErr)
+}
+
+// affinityKey identifies the client on whose behalf ctx dials according to
+// Affinity, or returns "" if the client shouldn't be pinned.
+func (b *Balancer) affinityKey(ctx context.Context) string {
+	switch b.opts.Affinity {
+	case ClientAffinity:
+		if identity := AuthenticatedIdentity(ctx); identity != "" {
+			return "identity:" + identity
+		}
+		fallthrough
+	case ClientIPAffinity:
+		if ip := clientIPFromContext(ctx); ip != nil {
+			return "ip:" + ip.String()
+		}
+	}
+	return ""
+}
+
+// pinned returns the healthy target that client is pinned to, if any.
+func (b *Balancer) pinned(client string) *balancedTarget {
+	if client == "" {
+		return nil
+	}
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	pin := b.pins[client]
+	now := time.Now()
+	if pin == nil || now.Sub(pin.lastUsed) > b.affinityTTL() || now.Before(pin.target.unhealthyUntil) {
+		return nil
+	}
+	return pin.target
+}
+
+// pin pins client to target, forgetting pins that expired in the meantime.
+func (b *Balancer) pin(client string, target *balancedTarget) {
+	if client == "" {
+		return
+	}
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	now := time.Now()
+	if now.After(b.nextSweep) {
+		for key, pin := range b.pins {
+			if now.Sub(pin.lastUsed) > b.affinityTTL() {
+				delete(b.pins, key)
+			}
+		}
+		b.nextSweep = now.Add(b.affinityTTL())
+	}
+	if pin := b.pins[client]; pin != nil && pin.target != target {
+		log.Debugf("Moving client %v from %v to %v", client, pin.target.Addr, target.Addr)
+	}
+	b.pins[client] = &balancerPin{target: target, lastUsed: now}
+}
+
+// pick chooses the best untried target according to the strategy, preferring
+// healthy targets.
+func (b *Balancer) pick(tried map[*balancedTarget]bool) *balancedTarget {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	now := time.Now()
+	var best *balancedTarget
+	bestIdx := 0
+	bestHealthy := false
+	var bestScore float64
+	for i := range b.targets {
+		idx := (b.next + i) % len(b.targets)
+		target := b.targets[idx]
+		if tried[target] {
+			continue
+		}
+		healthy := !now.Before(target.unhealthyUntil)
+		score := b.score(target)
+		if best == nil || (healthy && !bestHealthy) || (healthy == bestHealthy && score < bestScore) {
+			best, bestIdx, bestHealthy, bestScore = target, idx, healthy, score
+		}
+	}
+	b.next = (bestIdx + 1) % len(b.targets)
+	return best
+}
+
+func (b *Balancer) score(target *balancedTarget) float64 {
+	switch b.opts.Strategy {
+	case LeastConnections:
+		return float64(atomic.LoadInt64(&target.active))
+	case EWMALatency:
+		// Targets without samples score 0 so that they get tried
+		return target.latency
+	default:
+		return 0
+	}
+}
+
+func (b *Balancer) record(target *balancedTarget, latency time.Duration, err error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if err != nil {
+		b.markFailed(target)
+		return
+	}
+	b.markHealthy(target)
+	if target.sampled {
+		target.latency = ewmaWeight*float64(latency) + (1-ewmaWeight)*target.latency
+	} else {
+		target.latency = float64(latency)
+		target.sampled = true
+	}
+}
+
+func (b *Balancer) markFailed(target *balancedTarget) {
+	target.failures++
+	if target.failures >= b.failureThreshold() {
+		if time.Now().After(target.unhealthyUntil) {
+			log.Debugf("Marking %v unhealthy after %d failures", target.Addr, target.failures)
+		}
+		target.unhealthyUntil = time.Now().Add(b.cooldown())
+	}
+}
+
+func (b *Balancer) markHealthy(target *balancedTarget) {
+	target.failures = 0
+	target.unhealthyUntil = time.Time{}
+}
+
+func (b *Balancer) failureThreshold() int {
+	if b.opts.FailureThreshold > 0 {
+		return b.opts.FailureThreshold
+	}
+	return DefaultBalancerFailureThreshold
+}
+
+func (b *Balancer) cooldown() time.Duration {
+	if b.opts.Cooldown > 0 {
+		return b.opts.Cooldown
+	}
+	return DefaultBalancerCooldown
+}
+
+func (b *Balancer) affinityTTL() time.Duration {
+	if b.opts.AffinityTTL > 0 {
+		return b.opts.AffinityTTL
+	}
+	return DefaultBalancerAffinityTTL
+}
+
+func (b *Balancer) healthCheckLoop() {
+	ticker := time.NewTicker(b.opts.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			b.checkHealth()
+		}
+	}
+}
+
+func (b *Balancer) checkHealth() {
+	check := b.opts.HealthCheck
+	if check == nil {
+		check = dialHealthCheck
+	}
+	var wg sync.WaitGroup
+	for _, target := range b.targets {
+		wg.Add(1)
+		go func(target *balancedTarget) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), b.opts.HealthCheckInterval)
+			defer cancel()
+			err := check(ctx, target.BalancerTarget)
+			b.mx.Lock()
+			defer b.mx.Unlock()
+			if err != nil {
+				target.failures = b.failureThreshold() - 1
+				b.markFailed(target)
+			} else {
+				b.markHealthy(target)
+			}
+		}(target)
+	}
+	wg.Wait()
+}
+
+func dialHealthCheck(ctx context.Context, target *BalancerTarget) error {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", target.Addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Status returns the current status of each target.
+func (b *Balancer) Status() []TargetStatus {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	now := time.Now()
+	statuses := make([]TargetStatus, 0, len(b.targets))
+	for _, target := range b.targets {
+		statuses = append(statuses, TargetStatus{
+			Addr:        target.Addr,
+			Healthy:     !now.Before(target.unhealthyUntil),
+			ActiveConns: int(atomic.LoadInt64(&target.active)),
+			Latency:     time.Duration(target.latency),
+		})
+	}
+	return statuses
+}
+
+// Close stops health checks.
+func (b *Balancer) Close() {
+	b.stopped.Do(func() {
+		close(b.stop)
+	})
+}
+
+// balancedConn tracks open connections for LeastConnections.
+type balancedConn struct {
+	net.Conn
+	target    *balancedTarget
+	closeOnce sync.Once
+}
+
+func (conn *balancedConn) Close() error {
+	conn.closeOnce.Do(func() {
+		atomic.AddInt64(&conn.target.active, -1)
+	})
+	return conn.Conn.Close()
+}
+
+func (conn *balancedConn) Wrapped() net.Conn {
+	return conn.Conn
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// namedTarget returns a BalancerTarget whose connections report name as their
+// remote address. Dials fail while fail is set to 1.
+func namedTarget(name string, fail *int32) *BalancerTarget {
+	return &BalancerTarget{
+		Addr: name,
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			if fail != nil && atomic.LoadInt32(fail) == 1 {
+				return nil, errors.New("%v is down", name)
+			}
+			client, server := net.Pipe()
+			server.Close()
+			return &fixedRemoteAddrConn{Conn: client, remoteAddr: &stringAddr{"tcp", name}}, nil
+		},
+	}
+}
+
+func dialVia(t *testing.T, b *Balancer) net.Conn {
+	conn, err := b.Dial(context.Background(), true, "tcp", "example.com:443")
+	require.NoError(t, err)
+	return conn
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b, err := NewBalancer(&BalancerOpts{Targets: []*BalancerTarget{namedTarget("a", nil), namedTarget("b", nil), namedTarget("c", nil)}})
+	require.NoError(t, err)
+	defer b.Close()
+
+	var picked []string
+	for i := 0; i < 6; i++ {
+		conn := dialVia(t, b)
+		picked = append(picked, conn.RemoteAddr().String())
+		conn.Close()
+	}
+	assert.Equal(t, []string{"a", "b", "c", "a", "b", "c"}, picked)
+}
+
+func TestBalancerFailover(t *testing.T) {
+	var aDown, bDown int32 = 1, 0
+	b, err := NewBalancer(&BalancerOpts{
+		Targets:          []*BalancerTarget{namedTarget("a", &aDown), namedTarget("b", &bDown)},
+		FailureThreshold: 1,
+		Cooldown:         time.Hour,
+	})
+	require.NoError(t, err)
+	defer b.Close()
+
+	for i := 0; i < 3; i++ {
+		conn := dialVia(t, b)
+		assert.Equal(t, "b", conn.RemoteAddr().String())
+		conn.Close()
+	}
+	status := b.Status()
+	assert.False(t, status[0].Healthy)
+	assert.True(t, status[1].Healthy)
+
+	// With every target down, dials fail
+	atomic.StoreInt32(&bDown, 1)
+	_, err = b.Dial(context.Background(), true, "tcp", "example.com:443")
+	assert.Error(t, err)
+
+	_, err = NewBalancer(&BalancerOpts{})
+	assert.Error(t, err, "Balancer without targets should be rejected")
+}
+
+// clientContext returns a dial context on behalf of a client at ip,
+// authenticated as identity if that's not empty.
+func clientContext(ip string, identity string) context.Context {
+	client, server := net.Pipe()
+	server.Close()
+	ctx := context.Context(filters.WrapContext(context.Background(), &fixedRemoteAddrConn{Conn: client, remoteAddr: &stringAddr{"tcp", ip + ":1234"}}))
+	if identity != "" {
+		ctx = context.WithValue(ctx, ctxKeyIdentity, identity)
+	}
+	return ctx
+}
+
+func TestBalancerAffinity(t *testing.T) {
+	var aDown, bDown, cDown int32
+	b, err := NewBalancer(&BalancerOpts{
+		Targets:          []*BalancerTarget{namedTarget("a", &aDown), namedTarget("b", &bDown), namedTarget("c", &cDown)},
+		Affinity:         ClientAffinity,
+		FailureThreshold: 1,
+		Cooldown:         time.Hour,
+	})
+	require.NoError(t, err)
+	defer b.Close()
+
+	dialFor := func(ctx context.Context) string {
+		conn, err := b.Dial(ctx, true, "tcp", "example.com:443")
+		require.NoError(t, err)
+		defer conn.Close()
+		return conn.RemoteAddr().String()
+	}
+
+	alice := clientContext("10.0.0.1", "")
+	bob := clientContext("10.0.0.2", "")
+	first := dialFor(alice)
+	assert.NotEqual(t, first, dialFor(bob), "Clients should still be balanced")
+	for i := 0; i < 3; i++ {
+		dialFor(bob)
+		assert.Equal(t, first, dialFor(alice), "Client should stick to its target")
+	}
+	carol := dialFor(clientContext("10.0.0.1", "carol"))
+	assert.Equal(t, carol, dialFor(clientContext("10.0.0.3", "carol")), "Authenticated clients should be pinned by identity")
+
+	// Fail over and stay on the new target
+	down := map[string]*int32{"a": &aDown, "b": &bDown, "c": &cDown}
+	atomic.StoreInt32(down[first], 1)
+	next := dialFor(alice)
+	assert.NotEqual(t, first, next)
+	atomic.StoreInt32(down[first], 0)
+	assert.Equal(t, next, dialFor(alice), "Client should stay on the target it failed over to")
+
+	unpinned, err := NewBalancer(&BalancerOpts{Targets: []*BalancerTarget{namedTarget("a", nil), namedTarget("b", nil)}, Affinity: ClientIPAffinity, AffinityTTL: time.Nanosecond})
+	require.NoError(t, err)
+	defer unpinned.Close()
+	var picked []string
+	for i := 0; i < 2; i++ {
+		conn, err := unpinned.Dial(alice, true, "tcp", "example.com:443")
+		require.NoError(t, err)
+		picked = append(picked, conn.RemoteAddr().String())
+		conn.Close()
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, []string{"a", "b"}, picked, "Expired pins should be forgotten")
+}
+
+func TestBalancerLeastConnections(t *testing.T) {
+	b, err := NewBalancer(&BalancerOpts{
+		Strategy: LeastConnections,
+		Targets:  []*BalancerTarget{namedTarget("a", nil), namedTarget("b", nil)},
+	})
+	require.NoError(t, err)
+	defer b.Close()
+
+	held := dialVia(t, b)
+	assert.Equal(t, "a", held.RemoteAddr().String())
+	for i := 0; i < 3; i++ {
+		conn := dialVia(t, b)
+		assert.Equal(t, "b", conn.RemoteAddr().String(), "Should avoid target with open connection")
+		conn.Close()
+	}
+	held.Close()
+	held.Close()
+	assert.Equal(t, 0, b.Status()[0].ActiveConns)
+}
+
+func TestBalancerEWMALatency(t *testing.T) {
+	slow := namedTarget("slow", nil)
+	slowDial := slow.Dial
+	slow.Dial = func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		time.Sleep(20 * time.Millisecond)
+		return slowDial(ctx, isCONNECT, network, addr)
+	}
+	b, err := NewBalancer(&BalancerOpts{Strategy: EWMALatency, Targets: []*BalancerTarget{slow, namedTarget("fast", nil)}})
+	require.NoError(t, err)
+	defer b.Close()
+
+	// Both get sampled first, after that the fast one wins
+	for i := 0; i < 2; i++ {
+		dialVia(t, b).Close()
+	}
+	for i := 0; i < 3; i++ {
+		conn := dialVia(t, b)
+		assert.Equal(t, "fast", conn.RemoteAddr().String())
+		conn.Close()
+	}
+}
+
+func TestBalancerHealthCheck(t *testing.T) {
+	var healthy int32
+	b, err := NewBalancer(&BalancerOpts{
+		Targets:             []*BalancerTarget{namedTarget("a", nil)},
+		HealthCheckInterval: 10 * time.Millisecond,
+		HealthCheck: func(ctx context.Context, target *BalancerTarget) error {
+			if atomic.LoadInt32(&healthy) == 0 {
+				return errors.New("unhealthy")
+			}
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	defer b.Close()
+
+	assert.Eventually(t, func() bool { return !b.Status()[0].Healthy }, time.Second, 5*time.Millisecond)
+	atomic.StoreInt32(&healthy, 1)
+	assert.Eventually(t, func() bool { return b.Status()[0].Healthy }, time.Second, 5*time.Millisecond)
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+)
+
+// bandwidthQuantum is the most that a connection reads or writes at once
+// under a BandwidthLimit. Since tokens are reserved in order, connections
+// waiting for bandwidth take turns in slices of this size, so that busy
+// connections can't starve the others.
+const bandwidthQuantum = 16 * 1024
+
+// BandwidthLimit caps the total rate at which bytes flow between the proxy
+// and upstream, shared across all tunnels and forwarded requests, see
+// Opts.BandwidthLimit. Egress is what's sent upstream and ingress what's
+// received from upstream. The limits can be changed at any time, including
+// with AdminHandler, and apply in addition to any RateLimiter.
+type BandwidthLimit struct {
+	egress  *tokenBucket
+	ingress *tokenBucket
+}
+
+// BandwidthLimits are the limits of a BandwidthLimit in bytes per second, 0
+// meaning unlimited. It's also the JSON that AdminHandler serves and accepts
+// at /bandwidth.
+type BandwidthLimits struct {
+	Egress  int `json:"egressBytesPerSecond"`
+	Ingress int `json:"ingressBytesPerSecond"`
+}
+
+// NewBandwidthLimit creates a BandwidthLimit with the given limits in bytes per
+// second, 0 meaning unlimited.
+func NewBandwidthLimit(egress int, ingress int) *BandwidthLimit {
+	return &BandwidthLimit{
+		egress:  newTokenBucket(egress),
+		ingress: newTokenBucket(ingress),
+	}
+}
+
+// Limits returns the current limits.
+func (bl *BandwidthLimit) Limits() BandwidthLimits {
+	return BandwidthLimits{Egress: bl.egress.burst(), Ingress: bl.ingress.burst()}
+}
+
+// SetLimits changes the limits, which applies to open connections too.
+func (bl *BandwidthLimit) SetLimits(limits BandwidthLimits) {
+	bl.egress.setRate(limits.Egress)
+	bl.ingress.setRate(limits.Ingress)
+}
+
+// wrap wraps the given upstream connection so that its reads and writes count
+// against the limits.
+func (bl *BandwidthLimit) wrap(conn net.Conn) net.Conn {
+	return &bandwidthLimitedConn{Conn: conn, bl: bl}
+}
+
+// quantum returns how much may be transferred at once with bucket, or 0 if
+// it's unlimited.
+func quantum(bucket *tokenBucket) int {
+	q := bucket.burst()
+	if q > bandwidthQuantum {
+		q = bandwidthQuantum
+	}
+	return q
+}
+
+// bandwidthLimitedConn is an upstream connection whose reads and writes are
+// throttled by a BandwidthLimit.
+type bandwidthLimitedConn struct {
+	net.Conn
+	bl *BandwidthLimit
+}
+
+func (conn *bandwidthLimitedConn) Read(b []byte) (int, error) {
+	q := quantum(conn.bl.ingress)
+	if q == 0 {
+		return conn.Conn.Read(b)
+	}
+	if len(b) > q {
+		b = b[:q]
+	}
+	n, err := conn.Conn.Read(b)
+	conn.bl.ingress.take(n)
+	return n, err
+}
+
+func (conn *bandwidthLimitedConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if q := quantum(conn.bl.egress); q > 0 {
+			if len(chunk) > q {
+				chunk = chunk[:q]
+			}
+			conn.bl.egress.take(len(chunk))
+		}
+		n, err := conn.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (conn *bandwidthLimitedConn) Wrapped() net.Conn {
+	return conn.Conn
+}
+
+// adminBandwidth reports the BandwidthLimit in response to GET and changes it
+// in response to PUT or POST.
+func (proxy *proxy) adminBandwidth(w http.ResponseWriter, req *http.Request) {
+	if proxy.BandwidthLimit == nil {
+		http.Error(w, "No bandwidth limit configured", http.StatusNotFound)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var limits BandwidthLimits
+		if err := json.NewDecoder(req.Body).Decode(&limits); err != nil || limits.Egress < 0 || limits.Ingress < 0 {
+			http.Error(w, "Invalid bandwidth limits", http.StatusBadRequest)
+			return
+		}
+		log.Debugf("Changing bandwidth limits to %d bytes/s egress and %d bytes/s ingress", limits.Egress, limits.Ingress)
+		proxy.BandwidthLimit.SetLimits(limits)
+	default:
+		http.Error(w, "Only GET, PUT and POST are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	writeAdminJSON(w, proxy.BandwidthLimit.Limits())
+}
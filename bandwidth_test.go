@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	ht "net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingSink is a connection that counts what's written to it until it's
+// stopped.
+type countingSink struct {
+	net.Conn
+	written int64
+	stopped int32
+}
+
+func (conn *countingSink) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&conn.stopped) == 1 {
+		return 0, errors.New("stopped")
+	}
+	atomic.AddInt64(&conn.written, int64(len(b)))
+	return len(b), nil
+}
+
+func TestBandwidthLimitFairness(t *testing.T) {
+	bl := NewBandwidthLimit(1000000, 0)
+	// Use up the initial burst
+	bl.egress.take(1000000)
+
+	busy, other := &countingSink{}, &countingSink{}
+	var wg sync.WaitGroup
+	for _, sink := range []*countingSink{busy, other} {
+		wg.Add(1)
+		go func(sink *countingSink) {
+			defer wg.Done()
+			bl.wrap(sink).Write(make([]byte, 10000000))
+		}(sink)
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(500 * time.Millisecond)
+	atomic.StoreInt32(&busy.stopped, 1)
+	atomic.StoreInt32(&other.stopped, 1)
+	busyWritten, otherWritten := atomic.LoadInt64(&busy.written), atomic.LoadInt64(&other.written)
+	assert.True(t, busyWritten+otherWritten <= 700000, "Total bandwidth should be limited, wrote %d", busyWritten+otherWritten)
+	assert.True(t, otherWritten >= busyWritten/2, "Connections should share bandwidth fairly, wrote %d and %d", busyWritten, otherWritten)
+
+	// Lifting the limit unblocks writers
+	bl.SetLimits(BandwidthLimits{})
+	wg.Wait()
+	start := time.Now()
+	_, err := bl.wrap(&countingSink{}).Write(make([]byte, 10000000))
+	require.NoError(t, err)
+	assert.True(t, time.Since(start) < 100*time.Millisecond, "Unlimited writes shouldn't block")
+}
+
+func TestAdminBandwidth(t *testing.T) {
+	bl := NewBandwidthLimit(1000, 2000)
+	p := newProxy(&Opts{BandwidthLimit: bl})
+	admin := ht.NewServer(p.AdminHandler())
+	defer admin.Close()
+	client := admin.Client()
+
+	var limits BandwidthLimits
+	resp, err := client.Get(admin.URL + "/bandwidth")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&limits))
+	resp.Body.Close()
+	assert.Equal(t, BandwidthLimits{Egress: 1000, Ingress: 2000}, limits)
+
+	req, _ := http.NewRequest(http.MethodPut, admin.URL+"/bandwidth", bytes.NewReader([]byte(`{"egressBytesPerSecond": 5000, "ingressBytesPerSecond": 0}`)))
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, BandwidthLimits{Egress: 5000}, bl.Limits())
+
+	req, _ = http.NewRequest(http.MethodPut, admin.URL+"/bandwidth", bytes.NewReader([]byte(`{"egressBytesPerSecond": -1}`)))
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	unlimited := ht.NewServer(newProxy(&Opts{}).AdminHandler())
+	defer unlimited.Close()
+	resp, err = unlimited.Client().Get(unlimited.URL + "/bandwidth")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
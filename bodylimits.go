@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+)
+
+// limitedBody fails reads once more than limit bytes have been read from
+// body, remembering that it did.
+type limitedBody struct {
+	io.ReadCloser
+	limit    int64
+	read     int64
+	exceeded int32
+	err      error
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&b.exceeded) == 1 {
+		return 0, b.err
+	}
+	// Read one byte beyond the limit to tell a body of exactly limit bytes from
+	// a larger one
+	if remaining := b.limit + 1 - b.read; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.read > b.limit {
+		atomic.StoreInt32(&b.exceeded, 1)
+		return n - int(b.read-b.limit), b.err
+	}
+	return n, err
+}
+
+func (b *limitedBody) wasExceeded() bool {
+	return atomic.LoadInt32(&b.exceeded) == 1
+}
+
+// bodyLimitsFilter enforces MaxRequestBodySize and MaxResponseBodySize on
+// forwarded requests.
+func (proxy *proxy) bodyLimitsFilter() filters.Filter {
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		if req.Method == http.MethodConnect || isWebSocketUpgrade(req.Header) || isConnectUDP(req) || (ctx.IsMITMing() && !proxy.LimitMITMBodies) {
+			return next(ctx, req)
+		}
+
+		var reqBody *limitedBody
+		if max := proxy.MaxRequestBodySize; max > 0 && req.Body != nil && req.Body != http.NoBody {
+			if req.ContentLength > max {
+				return filters.Fail(ctx, req, http.StatusRequestEntityTooLarge, errors.New("Request body of %d bytes exceeds %d bytes", req.ContentLength, max))
+			}
+			reqBody = &limitedBody{ReadCloser: req.Body, limit: max, err: errors.New("Request body exceeds %d bytes", max)}
+			req.Body = reqBody
+		}
+
+		resp, ctx, err := next(ctx, req)
+		if reqBody != nil && reqBody.wasExceeded() {
+			if resp != nil && resp.Body != nil {
+				resp.Body.Close()
+			}
+			log.Debugf("Aborted request to %v: %v", req.Host, reqBody.err)
+			return filters.Fail(ctx, req, http.StatusRequestEntityTooLarge, reqBody.err)
+		}
+		if err != nil || resp == nil {
+			return resp, ctx, err
+		}
+
+		if max := proxy.MaxResponseBodySize; max > 0 && resp.Body != nil && resp.Body != http.NoBody {
+			if resp.ContentLength > max {
+				resp.Body.Close()
+				return proxy.errorResponse(ctx, req, errors.New("Response body of %d bytes from %v exceeds %d bytes", resp.ContentLength, req.Host, max))
+			}
+			// Headers are already on their way, so all we can do is cut the
+			// transfer short, which closes the client connection
+			resp.Body = &limitedBody{ReadCloser: resp.Body, limit: max, err: errors.New("Response body from %v exceeds %d bytes", req.Host, max)}
+		}
+		return resp, ctx, nil
+	})
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitedBody(t *testing.T) {
+	body := &limitedBody{ReadCloser: ioutil.NopCloser(strings.NewReader("0123456789")), limit: 10, err: io.ErrUnexpectedEOF}
+	read, err := ioutil.ReadAll(body)
+	assert.NoError(t, err, "Body of exactly the limit should be fine")
+	assert.Equal(t, "0123456789", string(read))
+	assert.False(t, body.wasExceeded())
+
+	body = &limitedBody{ReadCloser: ioutil.NopCloser(strings.NewReader("0123456789")), limit: 4, err: io.ErrUnexpectedEOF}
+	read, err = ioutil.ReadAll(body)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, "0123", string(read), "Should only return data up to the limit")
+	assert.True(t, body.wasExceeded())
+}
+
+func TestBodyLimits(t *testing.T) {
+	var originRequests int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&originRequests, 1)
+		io.Copy(ioutil.Discard, req.Body)
+		switch req.URL.Path {
+		case "/big":
+			w.Header().Set("Content-Length", "100")
+			w.Write(make([]byte, 100))
+		case "/stream":
+			for i := 0; i < 10; i++ {
+				w.Write(make([]byte, 10))
+				w.(http.Flusher).Flush()
+			}
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer origin.Close()
+
+	l := serveProxy(t, &Opts{MaxRequestBodySize: 10, MaxResponseBodySize: 50})
+	defer l.Close()
+
+	send := func(method, path string, body io.Reader, contentLength int64) (*http.Response, error) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		req, _ := http.NewRequest(method, origin.URL+path, body)
+		req.ContentLength = contentLength
+		require.NoError(t, req.WriteProxy(conn))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		require.NoError(t, err)
+		_, err = ioutil.ReadAll(resp.Body)
+		conn.Close()
+		return resp, err
+	}
+
+	resp, err := send(http.MethodPost, "/", strings.NewReader("0123456789"), 10)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	before := atomic.LoadInt32(&originRequests)
+	resp, _ = send(http.MethodPost, "/", strings.NewReader(strings.Repeat("x", 20)), 20)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assert.Equal(t, before, atomic.LoadInt32(&originRequests), "Declared oversized body shouldn't be forwarded")
+
+	// A body of unknown length is sent chunked
+	resp, _ = send(http.MethodPost, "/", ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 20))), -1)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	resp, _ = send(http.MethodGet, "/big", nil, 0)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	resp, err = send(http.MethodGet, "/stream", nil, 0)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Error(t, err, "Oversized response of unknown length should be cut short")
+}
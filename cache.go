@@ -0,0 +1,562 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	// DefaultMaxCacheEntrySize is the default maximum size of response bodies
+	// stored by a ResponseCache.
+	DefaultMaxCacheEntrySize = 10 * 1024 * 1024
+
+	maxHeuristicFreshness = 24 * time.Hour
+)
+
+// heuristicallyCacheable are the status codes that may be cached without
+// explicit freshness information, per RFC 7231 section 6.1.
+var heuristicallyCacheable = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// CachedResponse is a response stored by a ResponseCache.
+type CachedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+
+	// RequestTime and ResponseTime are when the request that produced this
+	// response was sent and when its response was received
+	RequestTime  time.Time
+	ResponseTime time.Time
+
+	// VaryHeader holds the values of the request headers named by the
+	// response's Vary header
+	VaryHeader http.Header
+}
+
+// size approximates the memory used by this response.
+func (cr *CachedResponse) size() int64 {
+	size := int64(len(cr.Body))
+	for _, h := range []http.Header{cr.Header, cr.VaryHeader} {
+		for k, vv := range h {
+			size += int64(len(k))
+			for _, v := range vv {
+				size += int64(len(v))
+			}
+		}
+	}
+	return size
+}
+
+// CacheStorage stores CachedResponses by key.
+type CacheStorage interface {
+	// Get returns the response stored under key, or nil if there is none
+	Get(key string) *CachedResponse
+
+	// Put stores resp under key
+	Put(key string, resp *CachedResponse)
+
+	// Delete removes the response stored under key, if any
+	Delete(key string)
+}
+
+// NewMemoryCacheStorage returns a CacheStorage that keeps responses in memory,
+// evicting the least recently used ones once they total more than maxBytes.
+func NewMemoryCacheStorage(maxBytes int64) CacheStorage {
+	return &memoryCacheStorage{
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+type memoryCacheStorage struct {
+	maxBytes int64
+	mx       sync.Mutex
+	size     int64
+	entries  map[string]*list.Element
+	lru      *list.List
+}
+
+type memoryCacheEntry struct {
+	key  string
+	resp *CachedResponse
+	size int64
+}
+
+func (s *memoryCacheStorage) Get(key string) *CachedResponse {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	el := s.entries[key]
+	if el == nil {
+		return nil
+	}
+	s.lru.MoveToFront(el)
+	return el.Value.(*memoryCacheEntry).resp
+}
+
+func (s *memoryCacheStorage) Put(key string, resp *CachedResponse) {
+	size := resp.size()
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.remove(key)
+	if size > s.maxBytes {
+		return
+	}
+	s.entries[key] = s.lru.PushFront(&memoryCacheEntry{key: key, resp: resp, size: size})
+	s.size += size
+	for s.size > s.maxBytes {
+		s.remove(s.lru.Back().Value.(*memoryCacheEntry).key)
+	}
+}
+
+func (s *memoryCacheStorage) Delete(key string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.remove(key)
+}
+
+func (s *memoryCacheStorage) remove(key string) {
+	el := s.entries[key]
+	if el == nil {
+		return
+	}
+	s.lru.Remove(el)
+	delete(s.entries, key)
+	s.size -= el.Value.(*memoryCacheEntry).size
+}
+
+// NewDiskCacheStorage returns a CacheStorage that keeps each response in its
+// own file in dir, creating dir if necessary.
+func NewDiskCacheStorage(dir string) (CacheStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.New("Unable to create cache directory %v: %v", dir, err)
+	}
+	return &diskCacheStorage{dir: dir}, nil
+}
+
+type diskCacheStorage struct {
+	dir string
+}
+
+func (s *diskCacheStorage) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+func (s *diskCacheStorage) Get(key string) *CachedResponse {
+	file, err := os.Open(s.path(key))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	resp := &CachedResponse{}
+	if err := gob.NewDecoder(file).Decode(resp); err != nil {
+		log.Debugf("Unable to decode cached response for %v: %v", key, err)
+		return nil
+	}
+	return resp
+}
+
+func (s *diskCacheStorage) Put(key string, resp *CachedResponse) {
+	tmp, err := ioutil.TempFile(s.dir, "tmp")
+	if err != nil {
+		log.Errorf("Unable to create cache file: %v", err)
+		return
+	}
+	err = gob.NewEncoder(tmp).Encode(resp)
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path(key))
+	}
+	if err != nil {
+		log.Errorf("Unable to write cache file for %v: %v", key, err)
+		os.Remove(tmp.Name())
+	}
+}
+
+func (s *diskCacheStorage) Delete(key string) {
+	os.Remove(s.path(key))
+}
+
+// CacheStats reports how a ResponseCache has been used.
+type CacheStats struct {
+	// Hits counts requests answered from the cache, including after successful
+	// revalidation
+	Hits int64
+
+	// Misses counts cacheable requests that had to be forwarded upstream
+	Misses int64
+
+	// Revalidations counts stale responses that upstream confirmed were still
+	// valid
+	Revalidations int64
+}
+
+// ResponseCache is a shared HTTP cache (RFC 7234) for forwarded GET requests.
+type ResponseCache struct {
+	hits          int64
+	misses        int64
+	revalidations int64
+
+	storage      CacheStorage
+	maxEntrySize int64
+}
+
+// NewResponseCache creates a ResponseCache backed by storage. Response bodies
+// larger than maxEntrySize aren't cached, DefaultMaxCacheEntrySize is used if
+// maxEntrySize is 0.
+func NewResponseCache(storage CacheStorage, maxEntrySize int64) *ResponseCache {
+	if maxEntrySize <= 0 {
+		maxEntrySize = DefaultMaxCacheEntrySize
+	}
+	return &ResponseCache{storage: storage, maxEntrySize: maxEntrySize}
+}
+
+// Stats returns the current usage statistics for this cache.
+func (c *ResponseCache) Stats() CacheStats {
+	return CacheStats{
+		Hits:          atomic.LoadInt64(&c.hits),
+		Misses:        atomic.LoadInt64(&c.misses),
+		Revalidations: atomic.LoadInt64(&c.revalidations),
+	}
+}
+
+// roundTrip answers req from the cache if possible, otherwise round-tripping
+// it with tr and caching the response if allowed.
+func (c *ResponseCache) roundTrip(tr http.RoundTripper, req *http.Request) (*http.Response, error) {
+	key := req.URL.String()
+	if req.Method != http.MethodGet {
+		resp, err := tr.RoundTrip(req)
+		if err == nil && !isSafeMethod(req.Method) && resp.StatusCode < 400 {
+			// Unsafe methods invalidate the target, see RFC 7234 section 4.4
+			c.storage.Delete(key)
+		}
+		return resp, err
+	}
+
+	reqCC := parseCacheControl(req.Header)
+	if _, noStore := reqCC["no-store"]; noStore {
+		atomic.AddInt64(&c.misses, 1)
+		return tr.RoundTrip(req)
+	}
+
+	now := time.Now()
+	entry := c.storage.Get(key)
+	if entry != nil && !entry.varyMatches(req) {
+		entry = nil
+	}
+	if entry != nil && entry.fresh(now, reqCC) {
+		atomic.AddInt64(&c.hits, 1)
+		return entry.response(req, now), nil
+	}
+	if _, onlyIfCached := reqCC["only-if-cached"]; onlyIfCached && entry == nil {
+		atomic.AddInt64(&c.misses, 1)
+		return &http.Response{
+			StatusCode: http.StatusGatewayTimeout,
+			Header:     make(http.Header),
+			Body:       http.NoBody,
+			Request:    req,
+		}, nil
+	}
+
+	upstreamReq := req
+	conditional := entry != nil && !hasConditional(req.Header) && entry.hasValidator()
+	if conditional {
+		upstreamReq = req.WithContext(req.Context())
+		upstreamReq.Header = cloneHeader(req.Header)
+		entry.addConditional(upstreamReq)
+	}
+	resp, err := tr.RoundTrip(upstreamReq)
+	if err != nil {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, err
+	}
+	responseTime := time.Now()
+	if conditional && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		entry = entry.revalidated(resp.Header, now, responseTime)
+		c.storage.Put(key, entry)
+		atomic.AddInt64(&c.hits, 1)
+		atomic.AddInt64(&c.revalidations, 1)
+		return entry.response(req, responseTime), nil
+	}
+
+	atomic.AddInt64(&c.misses, 1)
+	if !storable(req, resp) {
+		return resp, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, c.maxEntrySize+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, errors.New("Unable to read response body for caching: %v", err)
+	}
+	if int64(len(body)) > c.maxEntrySize {
+		// Too big to cache, pass through what we've read followed by the rest
+		resp.Body = &prefixedReadCloser{Reader: io.MultiReader(bytes.NewReader(body), resp.Body), Closer: resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	c.storage.Put(key, &CachedResponse{
+		StatusCode:   resp.StatusCode,
+		Header:       cloneHeader(resp.Header),
+		Body:         body,
+		RequestTime:  now,
+		ResponseTime: responseTime,
+		VaryHeader:   varyHeader(req, resp.Header),
+	})
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	return resp, nil
+}
+
+// storable determines whether resp may be stored by a shared cache, see RFC
+// 7234 section 3.
+func storable(req *http.Request, resp *http.Response) bool {
+	if !heuristicallyCacheable[resp.StatusCode] {
+		return false
+	}
+	respCC := parseCacheControl(resp.Header)
+	if _, noStore := respCC["no-store"]; noStore {
+		return false
+	}
+	if _, private := respCC["private"]; private {
+		return false
+	}
+	if resp.Header.Get("Vary") == "*" {
+		return false
+	}
+	_, public := respCC["public"]
+	_, sMaxAge := respCC["s-maxage"]
+	if req.Header.Get("Authorization") != "" {
+		_, mustRevalidate := respCC["must-revalidate"]
+		if !public && !sMaxAge && !mustRevalidate {
+			return false
+		}
+	}
+	if resp.Header.Get("Set-Cookie") != "" && !public && !sMaxAge {
+		// Cookies are usually meant for one client only
+		return false
+	}
+	entry := &CachedResponse{StatusCode: resp.StatusCode, Header: resp.Header, ResponseTime: time.Now()}
+	return entry.freshnessLifetime() > 0 || entry.hasValidator()
+}
+
+// freshnessLifetime calculates how long this response is fresh for, see RFC
+// 7234 section 4.2.1.
+func (cr *CachedResponse) freshnessLifetime() time.Duration {
+	cc := parseCacheControl(cr.Header)
+	if seconds, ok := cacheControlSeconds(cc, "s-maxage"); ok {
+		return seconds
+	}
+	if seconds, ok := cacheControlSeconds(cc, "max-age"); ok {
+		return seconds
+	}
+	date := cr.date()
+	if expiresHeader := cr.Header.Get("Expires"); expiresHeader != "" {
+		expires, err := http.ParseTime(expiresHeader)
+		if err != nil {
+			// Invalid Expires means already expired
+			return 0
+		}
+		return expires.Sub(date)
+	}
+	if lastModified, err := http.ParseTime(cr.Header.Get("Last-Modified")); err == nil && heuristicallyCacheable[cr.StatusCode] {
+		heuristic := date.Sub(lastModified) / 10
+		if heuristic > maxHeuristicFreshness {
+			heuristic = maxHeuristicFreshness
+		}
+		return heuristic
+	}
+	return 0
+}
+
+func (cr *CachedResponse) date() time.Time {
+	if date, err := http.ParseTime(cr.Header.Get("Date")); err == nil {
+		return date
+	}
+	return cr.ResponseTime
+}
+
+// age calculates the current age of this response, see RFC 7234 section 4.2.3.
+func (cr *CachedResponse) age(now time.Time) time.Duration {
+	apparentAge := cr.ResponseTime.Sub(cr.date())
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+	ageValue, _ := strconv.Atoi(cr.Header.Get("Age"))
+	correctedAge := time.Duration(ageValue)*time.Second + cr.ResponseTime.Sub(cr.RequestTime)
+	if apparentAge > correctedAge {
+		correctedAge = apparentAge
+	}
+	return correctedAge + now.Sub(cr.ResponseTime)
+}
+
+func (cr *CachedResponse) fresh(now time.Time, reqCC map[string]string) bool {
+	respCC := parseCacheControl(cr.Header)
+	if _, noCache := respCC["no-cache"]; noCache {
+		return false
+	}
+	if _, noCache := reqCC["no-cache"]; noCache {
+		return false
+	}
+	age := cr.age(now)
+	lifetime := cr.freshnessLifetime()
+	if maxAge, ok := cacheControlSeconds(reqCC, "max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := cacheControlSeconds(reqCC, "min-fresh"); ok {
+		lifetime -= minFresh
+	}
+	return age < lifetime
+}
+
+func (cr *CachedResponse) varyMatches(req *http.Request) bool {
+	for name, values := range cr.VaryHeader {
+		if strings.Join(req.Header[name], ",") != strings.Join(values, ",") {
+			return false
+		}
+	}
+	return true
+}
+
+func (cr *CachedResponse) hasValidator() bool {
+	return cr.Header.Get("ETag") != "" || cr.Header.Get("Last-Modified") != ""
+}
+
+// addConditional makes req conditional on the validators of this response.
+func (cr *CachedResponse) addConditional(req *http.Request) {
+	if etag := cr.Header.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := cr.Header.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+}
+
+// revalidated returns a copy of this response updated with the headers of a
+// 304 Not Modified, see RFC 7234 section 4.3.4. This response is left alone
+// since other requests may be reading it from the storage concurrently.
+func (cr *CachedResponse) revalidated(header http.Header, requestTime time.Time, responseTime time.Time) *CachedResponse {
+	updated := *cr
+	updated.Header = cloneHeader(cr.Header)
+	for name, values := range header {
+		if name == "Content-Length" {
+			continue
+		}
+		updated.Header[name] = values
+	}
+	updated.RequestTime = requestTime
+	updated.ResponseTime = responseTime
+	return &updated
+}
+
+// response builds an http.Response for req from this cached response.
+func (cr *CachedResponse) response(req *http.Request, now time.Time) *http.Response {
+	header := cloneHeader(cr.Header)
+	header.Set("Age", strconv.Itoa(int(cr.age(now)/time.Second)))
+	return &http.Response{
+		Status:        strconv.Itoa(cr.StatusCode) + " " + http.StatusText(cr.StatusCode),
+		StatusCode:    cr.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(cr.Body)),
+		ContentLength: int64(len(cr.Body)),
+		Request:       req,
+	}
+}
+
+func varyHeader(req *http.Request, respHeader http.Header) http.Header {
+	var vary http.Header
+	for _, v := range respHeader["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if vary == nil {
+				vary = make(http.Header)
+			}
+			vary[name] = req.Header[name]
+		}
+	}
+	return vary
+}
+
+func parseCacheControl(header http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, v := range header["Cache-Control"] {
+		for _, directive := range strings.Split(v, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, value := directive, ""
+			if eq := strings.IndexByte(directive, '='); eq >= 0 {
+				name, value = directive[:eq], strings.Trim(directive[eq+1:], `"`)
+			}
+			cc[strings.ToLower(name)] = value
+		}
+	}
+	return cc
+}
+
+func cacheControlSeconds(cc map[string]string, name string) (time.Duration, bool) {
+	value, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, true
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+func hasConditional(header http.Header) bool {
+	return header.Get("If-None-Match") != "" || header.Get("If-Modified-Since") != ""
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+func cloneHeader(header http.Header) http.Header {
+	clone := make(http.Header, len(header))
+	for k, vv := range header {
+		clone[k] = append([]string(nil), vv...)
+	}
+	return clone
+}
+
+type prefixedReadCloser struct {
+	io.Reader
+	io.Closer
+}
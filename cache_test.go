@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// cacheOrigin simulates an origin serving responses with the given headers,
+// answering conditional requests with 304 if the ETag matches.
+type cacheOrigin struct {
+	header   http.Header
+	requests []*http.Request
+}
+
+func (o *cacheOrigin) RoundTrip(req *http.Request) (*http.Response, error) {
+	o.requests = append(o.requests, req)
+	header := cloneHeader(o.header)
+	header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	status := http.StatusOK
+	body := "hello"
+	if etag := o.header.Get("ETag"); etag != "" && req.Header.Get("If-None-Match") == etag {
+		status, body = http.StatusNotModified, ""
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     header,
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func cacheGet(t *testing.T, c *ResponseCache, origin http.RoundTripper, header http.Header) (*http.Response, string) {
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/thing", nil)
+	for k, vv := range header {
+		req.Header[k] = vv
+	}
+	resp, err := c.roundTrip(origin, req)
+	if !assert.NoError(t, err) {
+		return nil, ""
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp, string(body)
+}
+
+func TestResponseCacheFresh(t *testing.T) {
+	origin := &cacheOrigin{header: http.Header{"Cache-Control": {"max-age=60"}}}
+	c := NewResponseCache(NewMemoryCacheStorage(1024), 0)
+
+	_, body := cacheGet(t, c, origin, nil)
+	assert.Equal(t, "hello", body)
+	resp, body := cacheGet(t, c, origin, nil)
+	assert.Equal(t, "hello", body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Age"))
+	assert.Len(t, origin.requests, 1, "Second request should have been served from cache")
+
+	cacheGet(t, c, origin, http.Header{"Cache-Control": {"no-cache"}})
+	assert.Len(t, origin.requests, 2, "no-cache request should go upstream")
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 2}, c.Stats())
+
+	post, _ := http.NewRequest(http.MethodPost, "http://example.com/thing", nil)
+	_, err := c.roundTrip(origin, post)
+	assert.NoError(t, err)
+	cacheGet(t, c, origin, nil)
+	assert.Len(t, origin.requests, 4, "POST should have invalidated the cached response")
+}
+
+func TestResponseCacheRevalidate(t *testing.T) {
+	origin := &cacheOrigin{header: http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"v1"`}}}
+	c := NewResponseCache(NewMemoryCacheStorage(1024), 0)
+
+	cacheGet(t, c, origin, nil)
+	resp, body := cacheGet(t, c, origin, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello", body, "Revalidated response should come from cache")
+	if assert.Len(t, origin.requests, 2) {
+		assert.Equal(t, `"v1"`, origin.requests[1].Header.Get("If-None-Match"))
+	}
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 1, Revalidations: 1}, c.Stats())
+}
+
+func TestResponseCacheConcurrentRevalidation(t *testing.T) {
+	var mx sync.Mutex
+	origin := &cacheOrigin{header: http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`"v1"`}}}
+	locked := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		mx.Lock()
+		defer mx.Unlock()
+		return origin.RoundTrip(req)
+	})
+	c := NewResponseCache(NewMemoryCacheStorage(1024), 0)
+	cacheGet(t, c, locked, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(revalidate bool) {
+			defer wg.Done()
+			var header http.Header
+			if revalidate {
+				header = http.Header{"Cache-Control": {"no-cache"}}
+			}
+			for j := 0; j < 20; j++ {
+				resp, body := cacheGet(t, c, locked, header)
+				assert.Equal(t, "hello", body)
+				assert.Equal(t, `"v1"`, resp.Header.Get("ETag"))
+			}
+		}(i%2 == 0)
+	}
+	wg.Wait()
+	assert.EqualValues(t, 200, c.Stats().Revalidations)
+}
+
+func TestResponseCacheNotStorable(t *testing.T) {
+	for _, cc := range []string{"no-store", "private, max-age=60"} {
+		origin := &cacheOrigin{header: http.Header{"Cache-Control": {cc}}}
+		c := NewResponseCache(NewMemoryCacheStorage(1024), 0)
+		cacheGet(t, c, origin, nil)
+		cacheGet(t, c, origin, nil)
+		assert.Len(t, origin.requests, 2, cc)
+	}
+
+	// Vary
+	origin := &cacheOrigin{header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Language"}}}
+	c := NewResponseCache(NewMemoryCacheStorage(1024), 0)
+	cacheGet(t, c, origin, http.Header{"Accept-Language": {"en"}})
+	cacheGet(t, c, origin, http.Header{"Accept-Language": {"en"}})
+	cacheGet(t, c, origin, http.Header{"Accept-Language": {"fr"}})
+	assert.Len(t, origin.requests, 2, "Only the request with a different Accept-Language should go upstream")
+
+	// Cookies
+	origin = &cacheOrigin{header: http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"session=secret"}}}
+	c = NewResponseCache(NewMemoryCacheStorage(1024), 0)
+	cacheGet(t, c, origin, nil)
+	cacheGet(t, c, origin, nil)
+	assert.Len(t, origin.requests, 2, "Responses setting cookies shouldn't be stored")
+	origin = &cacheOrigin{header: http.Header{"Cache-Control": {"public, max-age=60"}, "Set-Cookie": {"tracking=1"}}}
+	c = NewResponseCache(NewMemoryCacheStorage(1024), 0)
+	cacheGet(t, c, origin, nil)
+	cacheGet(t, c, origin, nil)
+	assert.Len(t, origin.requests, 1, "Public responses setting cookies may be stored")
+
+	// Too big
+	origin = &cacheOrigin{header: http.Header{"Cache-Control": {"max-age=60"}}}
+	c = NewResponseCache(NewMemoryCacheStorage(1024), 3)
+	_, body := cacheGet(t, c, origin, nil)
+	assert.Equal(t, "hello", body, "Oversized body should be passed through intact")
+	cacheGet(t, c, origin, nil)
+	assert.Len(t, origin.requests, 2)
+}
+
+func TestMemoryCacheStorageEviction(t *testing.T) {
+	s := NewMemoryCacheStorage(10)
+	s.Put("a", &CachedResponse{Body: []byte("aaaa")})
+	s.Put("b", &CachedResponse{Body: []byte("bbbb")})
+	assert.NotNil(t, s.Get("a"))
+	s.Put("c", &CachedResponse{Body: []byte("cccc")})
+	assert.NotNil(t, s.Get("a"))
+	assert.Nil(t, s.Get("b"), "Least recently used entry should have been evicted")
+	assert.NotNil(t, s.Get("c"))
+}
+
+func TestDiskCacheStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewDiskCacheStorage(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Nil(t, s.Get("http://example.com/"))
+	s.Put("http://example.com/", &CachedResponse{StatusCode: 200, Header: http.Header{"Etag": {"x"}}, Body: []byte("body")})
+	cached := s.Get("http://example.com/")
+	if assert.NotNil(t, cached) {
+		assert.Equal(t, "body", string(cached.Body))
+		assert.Equal(t, "x", cached.Header.Get("ETag"))
+	}
+	s.Delete("http://example.com/")
+	assert.Nil(t, s.Get("http://example.com/"))
+}
@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	defaultCaptivePortalTTL = 24 * time.Hour
+)
+
+// Interstitial is implemented by Authenticators that answer unauthenticated
+// plain HTTP requests with a page of their own instead of 407 Proxy
+// Authentication Required, such as the login or terms of use page of a
+// captive portal. CONNECT requests, whose responses browsers don't display,
+// still receive 407.
+type Interstitial interface {
+	// Interstitial returns the response to send for req, which failed to
+	// authenticate. It returns nil to fall back to 407.
+	Interstitial(req *http.Request) *http.Response
+}
+
+// CaptivePortalPage is the data that CaptivePortalOptions.Page is rendered
+// with.
+type CaptivePortalPage struct {
+	// URL is the URL that the client requested
+	URL string
+
+	// PortalURL is the URL of the portal, with URL in its "url" query
+	// parameter
+	PortalURL string
+}
+
+// CaptivePortalOptions configures a CaptivePortal.
+type CaptivePortalOptions struct {
+	// PortalURL is the absolute URL of the page where users log in or accept
+	// the terms of use. Unauthenticated HTTP requests are redirected to it
+	// with the URL they requested in the "url" query parameter, unless Page
+	// is specified. Once users are done, the portal admits them with
+	// CaptivePortal.Admit.
+	PortalURL string
+
+	// Page, if specified, is served to unauthenticated HTTP requests instead
+	// of redirecting them, with status 511 Network Authentication Required.
+	// It's rendered with a CaptivePortalPage.
+	Page Template
+
+	// ContentType is the content type of Page, defaults to "text/html;
+	// charset=utf-8".
+	ContentType string
+
+	// Exempt, if specified, matches the hosts that clients may access
+	// without authenticating, for example where the portal's assets are
+	// hosted. The host of PortalURL is always exempt.
+	Exempt *DomainMatcher
+
+	// TTL is how long clients stay admitted, defaults to 24 hours.
+	TTL time.Duration
+
+	// Authenticator, if specified, also authenticates clients that send
+	// credentials in Proxy-Authorization, and provides the challenges sent
+	// with 407 responses.
+	Authenticator Authenticator
+}
+
+// CaptivePortal is an Authenticator for guest networks, which authenticates
+// clients by their IP once they were admitted by a portal, for example after
+// accepting terms of use. Until then, plain HTTP requests are answered with
+// a redirect to the portal or an interstitial page (see Interstitial), while
+// CONNECT requests receive 407 Proxy Authentication Required. Use it as
+// Opts.Authenticator.
+type CaptivePortal struct {
+	opts       *CaptivePortalOptions
+	portal     *url.URL
+	portalHost string
+	admitted   map[string]*admission
+	admitMx    sync.Mutex
+}
+
+type admission struct {
+	identity string
+	expires  time.Time
+}
+
+// NewCaptivePortal creates a CaptivePortal configured with opts.
+func NewCaptivePortal(opts *CaptivePortalOptions) (*CaptivePortal, error) {
+	portal, err := url.Parse(opts.PortalURL)
+	if err != nil {
+		return nil, errors.New("Unable to parse portal URL %v: %v", opts.PortalURL, err)
+	}
+	if (portal.Scheme != "http" && portal.Scheme != "https") || portal.Host == "" {
+		return nil, errors.New("Portal URL %v isn't an absolute http or https URL", opts.PortalURL)
+	}
+	if opts.ContentType == "" {
+		opts.ContentType = "text/html; charset=utf-8"
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = defaultCaptivePortalTTL
+	}
+	return &CaptivePortal{
+		opts:       opts,
+		portal:     portal,
+		portalHost: portal.Hostname(),
+		admitted:   make(map[string]*admission),
+	}, nil
+}
+
+// Admit authenticates the client at ip as identity for the configured TTL.
+// If identity is empty, the client is identified by its IP.
+func (p *CaptivePortal) Admit(ip net.IP, identity string) {
+	if identity == "" {
+		identity = ip.String()
+	}
+	p.admitMx.Lock()
+	p.admitted[ip.String()] = &admission{identity, time.Now().Add(p.opts.TTL)}
+	p.admitMx.Unlock()
+}
+
+// Revoke deauthenticates the client at ip. Connections that already
+// authenticated stay authenticated.
+func (p *CaptivePortal) Revoke(ip net.IP) {
+	p.admitMx.Lock()
+	delete(p.admitted, ip.String())
+	p.admitMx.Unlock()
+}
+
+// Admitted returns the identity of the client at ip, if it's admitted.
+func (p *CaptivePortal) Admitted(ip net.IP) (identity string, ok bool) {
+	if ip == nil {
+		return "", false
+	}
+	p.admitMx.Lock()
+	defer p.admitMx.Unlock()
+	a := p.admitted[ip.String()]
+	if a == nil {
+		return "", false
+	}
+	if time.Now().After(a.expires) {
+		delete(p.admitted, ip.String())
+		return "", false
+	}
+	return a.identity, true
+}
+
+// Authenticate implements the interface Authenticator. Requests to exempt
+// hosts are allowed without an identity.
+func (p *CaptivePortal) Authenticate(ctx context.Context, req *http.Request) (string, bool) {
+	if p.opts.Authenticator != nil && req.Header.Get("Proxy-Authorization") != "" {
+		if identity, ok := p.opts.Authenticator.Authenticate(ctx, req); ok {
+			return identity, true
+		}
+	}
+	if identity, ok := p.Admitted(clientIPFromContext(ctx)); ok {
+		return identity, true
+	}
+	return "", p.exempt(req)
+}
+
+func (p *CaptivePortal) exempt(req *http.Request) bool {
+	dest, err := requestDestination(req)
+	if err != nil {
+		return false
+	}
+	return dest.Host == p.portalHost || (p.opts.Exempt != nil && p.opts.Exempt.Match(dest.Host))
+}
+
+// Challenges implements the interface Authenticator, returning the challenges
+// of the configured Authenticator, if any.
+func (p *CaptivePortal) Challenges(req *http.Request) []string {
+	if p.opts.Authenticator == nil {
+		return nil
+	}
+	return p.opts.Authenticator.Challenges(req)
+}
+
+// Interstitial implements the interface Interstitial.
+func (p *CaptivePortal) Interstitial(req *http.Request) *http.Response {
+	portal := *p.portal
+	query := portal.Query()
+	query.Set("url", req.URL.String())
+	portal.RawQuery = query.Encode()
+
+	resp := &http.Response{
+		Header: make(http.Header),
+		Body:   http.NoBody,
+	}
+	// Browsers and OS connectivity checks mustn't cache the interstitial
+	resp.Header.Set("Cache-Control", "no-store")
+	if p.opts.Page == nil {
+		resp.StatusCode = http.StatusFound
+		resp.Header.Set("Location", portal.String())
+		return resp
+	}
+	body := &bytes.Buffer{}
+	if err := p.opts.Page.Execute(body, &CaptivePortalPage{URL: req.URL.String(), PortalURL: portal.String()}); err != nil {
+		log.Errorf("Unable to render captive portal page: %v", err)
+		return nil
+	}
+	resp.StatusCode = http.StatusNetworkAuthenticationRequired
+	resp.Header.Set("Content-Type", p.opts.ContentType)
+	resp.Body = ioutil.NopCloser(body)
+	resp.ContentLength = int64(body.Len())
+	return resp
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	ht "net/http/httptest"
+	"net/url"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptivePortal(t *testing.T) {
+	origin := newBodyEchoServer()
+	defer origin.Close()
+	portalServer := ht.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer portalServer.Close()
+	_, port, _ := net.SplitHostPort(portalServer.Listener.Addr().String())
+	portalURL := "http://localhost:" + port + "/terms"
+
+	portal, err := NewCaptivePortal(&CaptivePortalOptions{PortalURL: portalURL})
+	require.NoError(t, err)
+	l := serveProxy(t, &Opts{Authenticator: portal, OKWaitsForUpstream: true})
+	defer l.Close()
+	originAddr := origin.Listener.Addr().String()
+
+	resp, err := proxiedRequest(t, l.Addr().String(), http.MethodGet, origin.URL+"/page?q=1")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, portalURL+"?url="+url.QueryEscape(origin.URL+"/page?q=1"), resp.Header.Get("Location"))
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+	conn, _, resp := openTunnel(t, l.Addr().String(), originAddr)
+	conn.Close()
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+
+	resp, err = proxiedRequest(t, l.Addr().String(), http.MethodGet, portalURL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Portal should be reachable without authenticating")
+
+	portal.Admit(net.ParseIP("127.0.0.1"), "guest")
+	identity, ok := portal.Admitted(net.ParseIP("127.0.0.1"))
+	assert.True(t, ok)
+	assert.Equal(t, "guest", identity)
+	resp, err = proxiedRequest(t, l.Addr().String(), http.MethodGet, origin.URL+"/page")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	conn, _, resp = openTunnel(t, l.Addr().String(), originAddr)
+	conn.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	portal.Revoke(net.ParseIP("127.0.0.1"))
+	resp, err = proxiedRequest(t, l.Addr().String(), http.MethodGet, origin.URL+"/page")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+}
+
+func TestCaptivePortalPage(t *testing.T) {
+	origin := newBodyEchoServer()
+	defer origin.Close()
+	portal, err := NewCaptivePortal(&CaptivePortalOptions{
+		PortalURL: "https://portal.example/terms",
+		Page:      template.Must(template.New("page").Parse(`<a href="{{.PortalURL}}">Continue to {{.URL}}</a>`)),
+		Authenticator: BasicAuth("guests", func(username, password string) bool {
+			return username == "user" && password == "pass"
+		}),
+	})
+	require.NoError(t, err)
+	l := serveProxy(t, &Opts{Authenticator: portal, OKWaitsForUpstream: true})
+	defer l.Close()
+
+	resp, err := proxiedRequest(t, l.Addr().String(), http.MethodGet, origin.URL+"/")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNetworkAuthenticationRequired, resp.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	// proxiedRequest discards the body, so read this one directly
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	req, _ := http.NewRequest(http.MethodGet, origin.URL+"/", nil)
+	require.NoError(t, req.WriteProxy(conn))
+	resp, err = http.ReadResponse(bufio.NewReader(conn), req)
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, `<a href="https://portal.example/terms?url=`+url.QueryEscape(origin.URL+"/")+`">Continue to `+origin.URL+`/</a>`, string(body))
+
+	conn, _, resp = openTunnel(t, l.Addr().String(), origin.Listener.Addr().String())
+	conn.Close()
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	assert.Equal(t, `Basic realm="guests"`, resp.Header.Get("Proxy-Authenticate"))
+
+	req, _ = http.NewRequest(http.MethodGet, origin.URL+"/", nil)
+	req.SetBasicAuth("user", "pass")
+	req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+	conn, err = net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, req.WriteProxy(conn))
+	resp, err = http.ReadResponse(bufio.NewReader(conn), req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Credentials should authenticate too")
+}
+
+func TestNewCaptivePortalInvalidURL(t *testing.T) {
+	for _, u := range []string{"", "/terms", "ftp://portal.example"} {
+		_, err := NewCaptivePortal(&CaptivePortalOptions{PortalURL: u})
+		assert.Error(t, err, u)
+	}
+}
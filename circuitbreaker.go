@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+var (
+	// ErrCircuitOpen is the cause of errors dialing destinations whose circuit
+	// is open, see CircuitBreaker.
+	ErrCircuitOpen = errors.New("Circuit open")
+)
+
+// CircuitBreaker tracks failures dialing and forwarding requests to each
+// upstream destination (host:port). Once a destination has failed threshold
+// times in a row, its circuit opens and dials to it fail immediately with
+// ErrCircuitOpen, sparing clients from waiting on connect timeouts to dead
+// hosts. After openDuration, a single probe is let through (half-open); if it
+// succeeds the circuit closes, otherwise it opens again.
+type CircuitBreaker struct {
+	threshold    int
+	openDuration time.Duration
+
+	mx       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewCircuitBreaker creates a CircuitBreaker that opens a destination's
+// circuit after threshold consecutive failures, for openDuration at a time.
+func NewCircuitBreaker(threshold int, openDuration time.Duration) *CircuitBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &CircuitBreaker{
+		threshold:    threshold,
+		openDuration: openDuration,
+		circuits:     make(map[string]*circuit),
+	}
+}
+
+// allow returns ErrCircuitOpen if addr may not be dialed right now.
+func (cb *CircuitBreaker) allow(addr string) error {
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+	c := cb.circuits[addr]
+	if c == nil || c.failures < cb.threshold {
+		return nil
+	}
+	if c.probing || time.Since(c.openedAt) < cb.openDuration {
+		return ErrCircuitOpen
+	}
+	log.Debugf("Probing half-open circuit to %v", addr)
+	c.probing = true
+	return nil
+}
+
+// record records the outcome of dialing or forwarding to addr.
+func (cb *CircuitBreaker) record(addr string, err error) {
+	if err != nil && causedBy(err, func(cause error) bool { return cause == ErrCircuitOpen }) {
+		return
+	}
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+	if err == nil {
+		if c := cb.circuits[addr]; c != nil && c.failures >= cb.threshold {
+			log.Debugf("Closing circuit to %v", addr)
+		}
+		delete(cb.circuits, addr)
+		return
+	}
+	c := cb.circuits[addr]
+	if c == nil {
+		c = &circuit{}
+		cb.circuits[addr] = c
+	}
+	c.failures++
+	c.probing = false
+	if c.failures >= cb.threshold {
+		if c.failures == cb.threshold {
+			log.Debugf("Opening circuit to %v after %d failures: %v", addr, c.failures, err)
+		}
+		c.openedAt = time.Now()
+	}
+}
+
+// OpenCircuits returns the destinations whose circuits are currently open or
+// half-open, sorted.
+func (cb *CircuitBreaker) OpenCircuits() []string {
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+	var open []string
+	for addr, c := range cb.circuits {
+		if c.failures >= cb.threshold {
+			open = append(open, addr)
+		}
+	}
+	sort.Strings(open)
+	return open
+}
+
+// traceForwarding prepares req so that the outcome of forwarding it can be
+// recorded. Failures are only counted if the transport got a connection, since
+// dial failures are already recorded by dialUpstream. The returned function
+// records the outcome.
+func (cb *CircuitBreaker) traceForwarding(req *http.Request) (*http.Request, func(err error)) {
+	dest, err := requestDestination(req)
+	if err != nil {
+		return req, func(error) {}
+	}
+	var mx sync.Mutex
+	gotConn := false
+	trace := &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			mx.Lock()
+			gotConn = true
+			mx.Unlock()
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	return req, func(err error) {
+		mx.Lock()
+		connected := gotConn
+		mx.Unlock()
+		if err == nil || connected {
+			cb.record(dest.Addr(), err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	var dials, down int32
+	down = 1
+	cb := NewCircuitBreaker(2, 100*time.Millisecond)
+	l := serveProxy(t, &Opts{
+		OKWaitsForUpstream: true,
+		CircuitBreaker:     cb,
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			if atomic.LoadInt32(&down) == 1 {
+				return nil, errors.New("connection refused")
+			}
+			return net.Dial(network, addr)
+		},
+	})
+	defer l.Close()
+
+	connect := func() int {
+		conn, _, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+		conn.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusBadGateway, connect())
+	assert.Equal(t, http.StatusBadGateway, connect())
+	assert.Equal(t, []string{origin.Addr().String()}, cb.OpenCircuits())
+	assert.Equal(t, http.StatusBadGateway, connect())
+	assert.EqualValues(t, 2, atomic.LoadInt32(&dials), "Open circuit should not have been dialed")
+
+	// Once half-open, a failed probe opens the circuit again
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, http.StatusBadGateway, connect())
+	assert.Equal(t, http.StatusBadGateway, connect())
+	assert.EqualValues(t, 3, atomic.LoadInt32(&dials))
+
+	// And a successful probe closes it
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, connect())
+	assert.Empty(t, cb.OpenCircuits())
+	assert.Equal(t, http.StatusOK, connect())
+	assert.EqualValues(t, 5, atomic.LoadInt32(&dials))
+}
+
+func TestCircuitBreakerHalfOpenProbe(t *testing.T) {
+	cb := NewCircuitBreaker(1, 0)
+	cb.record("example.com:443", errors.New("timeout"))
+	assert.NoError(t, cb.allow("example.com:443"), "First probe should be allowed")
+	assert.Equal(t, ErrCircuitOpen, cb.allow("example.com:443"), "Only one probe at a time")
+	cb.record("example.com:443", nil)
+	assert.NoError(t, cb.allow("example.com:443"))
+	assert.NoError(t, cb.allow("other.com:443"))
+}
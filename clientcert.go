@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	ctxKeyClientCert = contextKey("clientCert")
+)
+
+// ClientCertificate returns the verified TLS client certificate with which
+// the proxy user authenticated (see TLSServerOpts.ClientCAs), or nil if there
+// is none.
+func ClientCertificate(ctx context.Context) *x509.Certificate {
+	cert, _ := ctx.Value(ctxKeyClientCert).(*x509.Certificate)
+	return cert
+}
+
+// CommonNameIdentity maps a client certificate to its subject common name.
+// It's the default TLSServerOpts.ClientIdentity.
+func CommonNameIdentity(cert *x509.Certificate) string {
+	return cert.Subject.CommonName
+}
+
+// RevocationChecker checks whether client certificates have been revoked,
+// e.g. using CRLs or OCSP.
+type RevocationChecker interface {
+	// CheckRevocation returns an error if cert, issued by issuer, has been
+	// revoked or its status can't be established.
+	CheckRevocation(ctx context.Context, cert *x509.Certificate, issuer *x509.Certificate) error
+}
+
+// RevocationCheckerFunc adapts a function to a RevocationChecker. This makes
+// it easy to plug in an OCSP client, e.g. based on golang.org/x/crypto/ocsp.
+type RevocationCheckerFunc func(ctx context.Context, cert *x509.Certificate, issuer *x509.Certificate) error
+
+// CheckRevocation implements the interface RevocationChecker
+func (f RevocationCheckerFunc) CheckRevocation(ctx context.Context, cert *x509.Certificate, issuer *x509.Certificate) error {
+	return f(ctx, cert, issuer)
+}
+
+// CRLChecker is a RevocationChecker that consults certificate revocation
+// lists. Certificates from issuers without a CRL are accepted.
+type CRLChecker struct {
+	mx   sync.RWMutex
+	crls []*pkix.CertificateList
+}
+
+// NewCRLChecker creates a CRLChecker from the given CRLs, each in PEM or DER
+// form.
+func NewCRLChecker(crls ...[]byte) (*CRLChecker, error) {
+	c := &CRLChecker{}
+	if err := c.Update(crls...); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Update replaces the CRLs, for example when newer ones have been fetched.
+func (c *CRLChecker) Update(crls ...[]byte) error {
+	var parsed []*pkix.CertificateList
+	for _, data := range crls {
+		for _, der := range pemOrDER(data, "X509 CRL") {
+			crl, err := x509.ParseCRL(der)
+			if err != nil {
+				return errors.New("Unable to parse CRL: %v", err)
+			}
+			parsed = append(parsed, crl)
+		}
+	}
+	c.mx.Lock()
+	c.crls = parsed
+	c.mx.Unlock()
+	return nil
+}
+
+// CheckRevocation implements the interface RevocationChecker
+func (c *CRLChecker) CheckRevocation(ctx context.Context, cert *x509.Certificate, issuer *x509.Certificate) error {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	for _, crl := range c.crls {
+		crlIssuer, err := asn1.Marshal(crl.TBSCertList.Issuer)
+		if err != nil || !bytes.Equal(crlIssuer, issuer.RawSubject) {
+			continue
+		}
+		if err := issuer.CheckCRLSignature(crl); err != nil {
+			return errors.New("Invalid CRL for %v: %v", issuer.Subject, err)
+		}
+		if crl.HasExpired(time.Now()) {
+			return errors.New("CRL for %v has expired", issuer.Subject)
+		}
+		for _, revoked := range crl.TBSCertList.RevokedCertificates {
+			if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return errors.New("Certificate %v for %v has been revoked", cert.SerialNumber, cert.Subject)
+			}
+		}
+	}
+	return nil
+}
+
+// pemOrDER returns the DER contents of the PEM blocks of the given type in
+// data, or data itself if it isn't PEM.
+func pemOrDER(data []byte, blockType string) [][]byte {
+	var ders [][]byte
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == blockType {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = append(ders, data)
+	}
+	return ders
+}
+
+// verifyRevocation returns a tls.Config VerifyPeerCertificate function that
+// checks every certificate in the verified chains against checker.
+func verifyRevocation(checker RevocationChecker) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		ctx, cancel := context.WithTimeout(context.Background(), tlsServerHandshakeTimeout)
+		defer cancel()
+		for _, chain := range verifiedChains {
+			for i := 0; i < len(chain)-1; i++ {
+				if err := checker.CheckRevocation(ctx, chain[i], chain[i+1]); err != nil {
+					log.Debugf("Rejecting client certificate: %v", err)
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// withClientIdentity adds the verified client certificate in state (if any)
+// and the identity that identify maps it to to ctx. If identify is nil,
+// CommonNameIdentity is used.
+func withClientIdentity(ctx context.Context, state *tls.ConnectionState, identify func(cert *x509.Certificate) string) context.Context {
+	cert := verifiedClientCert(state)
+	if cert == nil {
+		return ctx
+	}
+	if identify == nil {
+		identify = CommonNameIdentity
+	}
+	ctx = context.WithValue(ctx, ctxKeyClientCert, cert)
+	if identity := identify(cert); identity != "" {
+		ctx = context.WithValue(ctx, ctxKeyIdentity, identity)
+	}
+	return ctx
+}
+
+func verifiedClientCert(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func issueTestCRL(t *testing.T, ca *tls.Certificate, revoked ...*tls.Certificate) []byte {
+	var revokedCerts []pkix.RevokedCertificate
+	for _, cert := range revoked {
+		revokedCerts = append(revokedCerts, pkix.RevokedCertificate{SerialNumber: cert.Leaf.SerialNumber, RevocationTime: time.Now()})
+	}
+	der, err := ca.Leaf.CreateCRL(rand.Reader, ca.PrivateKey, revokedCerts, time.Now(), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func TestCRLChecker(t *testing.T) {
+	ca := issueTestCert(t, "ca", 1, nil)
+	otherCA := issueTestCert(t, "other", 2, nil)
+	alice := issueTestCert(t, "alice", 3, ca)
+	bob := issueTestCert(t, "bob", 4, ca)
+	carol := issueTestCert(t, "carol", 4, otherCA)
+
+	checker, err := NewCRLChecker(issueTestCRL(t, ca, bob))
+	require.NoError(t, err)
+	ctx := context.Background()
+	assert.NoError(t, checker.CheckRevocation(ctx, alice.Leaf, ca.Leaf))
+	assert.Error(t, checker.CheckRevocation(ctx, bob.Leaf, ca.Leaf))
+	assert.NoError(t, checker.CheckRevocation(ctx, carol.Leaf, otherCA.Leaf), "Same serial from another issuer isn't revoked")
+
+	require.NoError(t, checker.Update(issueTestCRL(t, ca)))
+	assert.NoError(t, checker.CheckRevocation(ctx, bob.Leaf, ca.Leaf), "Updated CRL no longer revokes bob")
+
+	otherChecker, err := NewCRLChecker(issueTestCRL(t, otherCA, alice))
+	require.NoError(t, err)
+	assert.NoError(t, otherChecker.CheckRevocation(ctx, alice.Leaf, ca.Leaf), "CRL of other issuer should be ignored")
+
+	_, err = NewCRLChecker([]byte("not a crl"))
+	assert.Error(t, err)
+}
+
+func TestServeTLSRevokedClientCert(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	dir, err := ioutil.TempDir("", "clientcert")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, issueTestCert(t, "proxy", 1, nil), certFile, keyFile)
+	ca := issueTestCert(t, "ca", 2, nil)
+	alice := issueTestCert(t, "alice", 3, ca)
+	bob := issueTestCert(t, "bob", 4, ca)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Leaf)
+	checker, err := NewCRLChecker(issueTestCRL(t, ca, bob))
+	require.NoError(t, err)
+
+	var mx sync.Mutex
+	var identities, serials []string
+	l := serveTLSProxy(t, &Opts{
+		OKWaitsForUpstream: true,
+		Filter: filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+			mx.Lock()
+			identities = append(identities, AuthenticatedIdentity(ctx))
+			if cert := ClientCertificate(ctx); cert != nil {
+				serials = append(serials, cert.SerialNumber.String())
+			}
+			mx.Unlock()
+			return next(ctx, req)
+		}),
+	}, &TLSServerOpts{
+		CertFile:          certFile,
+		KeyFile:           keyFile,
+		ClientCAs:         clientCAs,
+		RevocationChecker: checker,
+		ClientIdentity: func(cert *x509.Certificate) string {
+			return "user:" + cert.Subject.CommonName
+		},
+		DisableHTTP2: true,
+	})
+	defer l.Close()
+
+	connect := func(cert *tls.Certificate) (*http.Response, error) {
+		conn, dialErr := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{*cert},
+		})
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		defer conn.Close()
+		req, _ := http.NewRequest(http.MethodConnect, "http://"+origin.Addr().String(), nil)
+		req.Write(conn)
+		return http.ReadResponse(bufio.NewReader(conn), req)
+	}
+
+	_, err = connect(bob)
+	assert.Error(t, err, "Revoked certificate should be rejected")
+
+	resp, err := connect(alice)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	mx.Lock()
+	defer mx.Unlock()
+	assert.Equal(t, []string{"user:alice"}, identities)
+	assert.Equal(t, []string{big.NewInt(3).String()}, serials)
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	ctxKeyClientGone = contextKey("clientGone")
+)
+
+var (
+	aLongTimeAgo = time.Unix(1, 0)
+)
+
+// downstreamWatch notices clients that disconnect while the proxy is dialing
+// or waiting on upstream, by reading from the downstream connection in the
+// background (like net/http's server does). Data read in the meantime stays
+// buffered in the bufio.Reader.
+type downstreamWatch struct {
+	conn net.Conn
+	gone chan struct{}
+	done chan struct{}
+}
+
+// watchDownstream starts watching conn, which br reads from. Nothing else may
+// read from br until stop is called. Returns nil if conn doesn't support read
+// deadlines, since the watch couldn't be stopped.
+func watchDownstream(conn net.Conn, br *bufio.Reader) *downstreamWatch {
+	if conn.SetReadDeadline(time.Time{}) != nil {
+		return nil
+	}
+	w := &downstreamWatch{
+		conn: conn,
+		gone: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(w.done)
+		if _, err := br.Peek(1); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				// stopped
+				return
+			}
+			close(w.gone)
+		}
+	}()
+	return w
+}
+
+// stop stops watching and waits for the background read to finish.
+func (w *downstreamWatch) stop() {
+	w.conn.SetReadDeadline(aLongTimeAgo)
+	<-w.done
+	w.conn.SetReadDeadline(time.Time{})
+}
+
+// shouldWatchDownstream determines whether the client should be watched while
+// req is being processed. That's the case for CONNECT requests that wait for
+// upstream before responding, since clients can't send anything until they
+// get the response. Other clients may legitimately half-close their side of
+// the connection after sending a request, which looks the same as going away.
+func (proxy *proxy) shouldWatchDownstream(req *http.Request) bool {
+	return req.Method == http.MethodConnect && proxy.OKWaitsForUpstream
+}
+
+// cancelWhenClientGone returns a context that's canceled once the client that
+// sent the current request disconnects, if that's being watched.
+func cancelWhenClientGone(ctx context.Context) (context.Context, context.CancelFunc) {
+	gone, _ := ctx.Value(ctxKeyClientGone).(chan struct{})
+	if gone == nil {
+		return ctx, noopCancel
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-gone:
+			log.Debug("Client disconnected, canceling upstream request")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialCanceledWhenClientGone(t *testing.T) {
+	dialCanceled := make(chan error, 1)
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	p := newProxy(&Opts{
+		OKWaitsForUpstream: true,
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			select {
+			case <-ctx.Done():
+				dialCanceled <- ctx.Err()
+				return nil, ctx.Err()
+			case <-time.After(10 * time.Second):
+				return nil, io.EOF
+			}
+		},
+	})
+	go p.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	req, _ := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+	require.NoError(t, req.Write(conn))
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+
+	select {
+	case err := <-dialCanceled:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Dial wasn't canceled when client disconnected")
+	}
+}
+
+func TestTunnelAbortedOnContextCancel(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	p := newProxy(&Opts{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handled := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			handled <- err
+			return
+		}
+		handled <- p.Handle(ctx, conn, conn)
+	}()
+
+	tunnel, br, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+	defer tunnel.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = tunnel.Write([]byte("hello"))
+	require.NoError(t, err)
+	echoed := make([]byte, len("hello"))
+	_, err = io.ReadFull(br, echoed)
+	require.NoError(t, err)
+
+	cancel()
+	select {
+	case <-handled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Handle didn't return after context was canceled")
+	}
+	tunnel.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = br.ReadByte()
+	assert.Equal(t, io.EOF, err, "Tunnel should have been closed")
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the configuration of the proxy binary. It can be loaded from a
+// YAML file, with command-line flags taking precedence.
+type Config struct {
+	// Addr is the address at which to serve the HTTP proxy.
+	Addr string `yaml:"addr"`
+
+	// TLSCert and TLSKey, if specified, serve an HTTPS proxy at Addr instead.
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+
+	// SOCKS5Addr, if specified, also serves a SOCKS5 proxy at this address,
+	// which accepts SOCKS4 and SOCKS4a clients too unless users have to
+	// authenticate.
+	SOCKS5Addr string `yaml:"socks5_addr"`
+
+	// Users are username:password pairs. If any are specified, clients have
+	// to authenticate with Basic auth (or RFC 1929 for SOCKS5).
+	Users []string `yaml:"users"`
+
+	// HtpasswdFile, if specified, is an htpasswd file with the users allowed
+	// to use the proxy instead of Users, see proxy.LoadHtpasswd.
+	HtpasswdFile string `yaml:"htpasswd_file"`
+
+	// Realm is the realm of the Basic auth challenge.
+	Realm string `yaml:"realm"`
+
+	// Upstreams are upstream proxy URLs (http, https or socks5) through which
+	// to chain all dials, in order.
+	Upstreams []string `yaml:"upstreams"`
+
+	// TunnelCompression agrees to compress tunnels for downstream proxies
+	// chaining through this one with ?compress=true upstream URLs.
+	TunnelCompression bool `yaml:"tunnel_compression"`
+
+	// AllowPorts, if specified, limits the destination ports clients may
+	// access.
+	AllowPorts []int `yaml:"allow_ports"`
+
+	// DenyPrivate denies access to private, loopback and link-local
+	// destinations.
+	DenyPrivate bool `yaml:"deny_private"`
+
+	// DenyCIDRs denies access to destinations in these ranges.
+	DenyCIDRs []string `yaml:"deny_cidrs"`
+
+	// AllowClientCIDRs, if specified, only accepts clients in these ranges.
+	AllowClientCIDRs []string `yaml:"allow_client_cidrs"`
+
+	// Rules decide per request how to handle it, see proxy.ParseRules. They
+	// can only be specified in the config file.
+	Rules []*proxy.Rule `yaml:"rules"`
+
+	// AccessLog is the file to write access logs to, "-" for stdout.
+	AccessLog string `yaml:"access_log"`
+
+	// AccessLogFormat is either "json" or "combined".
+	AccessLogFormat string `yaml:"access_log_format"`
+
+	// MetricsAddr, if specified, serves Prometheus metrics at /metrics on this
+	// address.
+	MetricsAddr string `yaml:"metrics_addr"`
+
+	// AdminAddr, if specified, serves the admin endpoints (open tunnels,
+	// configuration, limits, pool stats and health checks) on this address. It should not be
+	// publicly reachable.
+	AdminAddr string `yaml:"admin_addr"`
+
+	// HealthChecks, if true, also serves /healthz and /readyz on the proxy
+	// port for liveness and readiness probes. They're always served on the
+	// admin address.
+	HealthChecks bool `yaml:"health_checks"`
+
+	// IdleTimeout closes connections that see no traffic for this long.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+
+	// ShutdownTimeout is how long to wait for connections to finish on
+	// shutdown.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+const (
+	// maxFailedAttempts and failedAttemptsLockout slow down password guessing
+	maxFailedAttempts     = 10
+	failedAttemptsLockout = time.Minute
+)
+
+func defaultConfig() *Config {
+	return &Config{
+		Addr:            proxy.DefaultServerAddr,
+		Realm:           "proxy",
+		AccessLogFormat: "combined",
+		IdleTimeout:     70 * time.Second,
+		ShutdownTimeout: 30 * time.Second,
+	}
+}
+
+// parseConfig parses the command-line arguments, loading the YAML config
+// file given with -config (if any) first so that flags override it. Flags
+// that can be repeated add to the lists from the file.
+func parseConfig(args []string, output io.Writer) (*Config, error) {
+	var configFile string
+	probe := newFlagSet(defaultConfig(), &configFile, ioutil.Discard)
+	if err := probe.Parse(args); err != nil {
+		// Parse again to print usage
+		return nil, newFlagSet(defaultConfig(), &configFile, output).Parse(args)
+	}
+
+	cfg := defaultConfig()
+	if configFile != "" {
+		data, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			return nil, errors.New("Unable to read config file %v: %v", configFile, err)
+		}
+		if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+			return nil, errors.New("Unable to parse config file %v: %v", configFile, err)
+		}
+	}
+	if err := newFlagSet(cfg, &configFile, output).Parse(args); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func newFlagSet(cfg *Config, configFile *string, output io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.StringVar(configFile, "config", "", "YAML config file, overridden by flags")
+	fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "address at which to serve the HTTP proxy")
+	fs.StringVar(&cfg.TLSCert, "tls-cert", cfg.TLSCert, "certificate file, serves an HTTPS proxy if specified with -tls-key")
+	fs.StringVar(&cfg.TLSKey, "tls-key", cfg.TLSKey, "private key file for -tls-cert")
+	fs.StringVar(&cfg.SOCKS5Addr, "socks5-addr", cfg.SOCKS5Addr, "address at which to also serve a SOCKS5 proxy")
+	fs.Var((*stringsFlag)(&cfg.Users), "user", "username:password allowed to use the proxy, may be repeated")
+	fs.StringVar(&cfg.HtpasswdFile, "htpasswd", cfg.HtpasswdFile, "htpasswd file with the users allowed to use the proxy, instead of -user")
+	fs.StringVar(&cfg.Realm, "realm", cfg.Realm, "realm for proxy authentication")
+	fs.Var((*stringsFlag)(&cfg.Upstreams), "upstream", "upstream proxy URL to chain through, may be repeated")
+	fs.BoolVar(&cfg.TunnelCompression, "tunnel-compression", cfg.TunnelCompression, "compress tunnels for downstream proxies that ask for it")
+	fs.Var((*portsFlag)(&cfg.AllowPorts), "allow-ports", "comma-separated destination ports clients may access")
+	fs.BoolVar(&cfg.DenyPrivate, "deny-private", cfg.DenyPrivate, "deny access to private destinations")
+	fs.Var((*stringsFlag)(&cfg.DenyCIDRs), "deny-cidr", "destination range to deny, may be repeated")
+	fs.Var((*stringsFlag)(&cfg.AllowClientCIDRs), "allow-client-cidr", "client range to accept, may be repeated")
+	fs.StringVar(&cfg.AccessLog, "access-log", cfg.AccessLog, "access log file, - for stdout")
+	fs.StringVar(&cfg.AccessLogFormat, "access-log-format", cfg.AccessLogFormat, "access log format, json or combined")
+	fs.StringVar(&cfg.MetricsAddr, "metrics-addr", cfg.MetricsAddr, "address at which to serve Prometheus metrics")
+	fs.StringVar(&cfg.AdminAddr, "admin-addr", cfg.AdminAddr, "private address at which to serve the admin endpoints")
+	fs.BoolVar(&cfg.HealthChecks, "health-checks", cfg.HealthChecks, "serve /healthz and /readyz on the proxy port")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", cfg.IdleTimeout, "close connections that are idle for this long")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "how long to wait for connections on shutdown")
+	return fs
+}
+
+// opts builds the proxy.Opts for cfg. The returned io.Closer closes the
+// access log, if any.
+func (cfg *Config) opts(metrics proxy.Metrics) (*proxy.Opts, io.Closer, error) {
+	opts := &proxy.Opts{
+		IdleTimeout:       cfg.IdleTimeout,
+		Metrics:           metrics,
+		CountTunnelBytes:  cfg.AdminAddr != "",
+		TunnelCompression: cfg.TunnelCompression,
+	}
+	if cfg.HealthChecks {
+		opts.HealthChecks = &proxy.HealthCheckOptions{ServeOnProxyPort: true}
+	}
+
+	var credentials proxy.CredentialStore
+	switch {
+	case len(cfg.Users) > 0 && cfg.HtpasswdFile != "":
+		return nil, nil, errors.New("Only one of users and htpasswd_file may be specified")
+	case len(cfg.Users) > 0:
+		passwords := make(map[string]string, len(cfg.Users))
+		for _, user := range cfg.Users {
+			parts := strings.SplitN(user, ":", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return nil, nil, errors.New("Invalid user %v, expected username:password", user)
+			}
+			passwords[parts[0]] = parts[1]
+		}
+		credentials = proxy.StaticCredentials(passwords)
+	case cfg.HtpasswdFile != "":
+		htpasswd, err := proxy.LoadHtpasswd(cfg.HtpasswdFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		credentials = htpasswd
+	}
+	if credentials != nil {
+		opts.Authenticator = proxy.CredentialAuth(cfg.Realm, proxy.LimitFailedAttempts(credentials, maxFailedAttempts, failedAttemptsLockout))
+	}
+
+	if len(cfg.Upstreams) > 0 {
+		upstreams := make([]*proxy.Upstream, 0, len(cfg.Upstreams))
+		for _, rawurl := range cfg.Upstreams {
+			upstream, err := proxy.ParseUpstream(rawurl)
+			if err != nil {
+				return nil, nil, err
+			}
+			upstreams = append(upstreams, upstream)
+		}
+		opts.Dial = proxy.ChainDial(nil, upstreams...)
+	}
+
+	var acs []proxy.AccessControl
+	if len(cfg.AllowPorts) > 0 {
+		acs = append(acs, proxy.AllowPorts(cfg.AllowPorts...))
+	}
+	if cfg.DenyPrivate {
+		acs = append(acs, proxy.DenyPrivateDestinations())
+	}
+	if len(cfg.DenyCIDRs) > 0 {
+		ac, err := proxy.DenyDestinationCIDRs(cfg.DenyCIDRs...)
+		if err != nil {
+			return nil, nil, err
+		}
+		acs = append(acs, ac)
+	}
+	if len(cfg.AllowClientCIDRs) > 0 {
+		ac, err := proxy.AllowClientCIDRs(cfg.AllowClientCIDRs...)
+		if err != nil {
+			return nil, nil, err
+		}
+		acs = append(acs, ac)
+	}
+	if len(acs) > 0 {
+		opts.AccessControl = proxy.AccessControls(acs...)
+	}
+
+	if len(cfg.Rules) > 0 {
+		rules, err := proxy.NewRules(cfg.Rules...)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts.Rules = rules
+	}
+
+	var closer io.Closer = nopCloser{}
+	if cfg.AccessLog != "" {
+		var w io.Writer = os.Stdout
+		if cfg.AccessLog != "-" {
+			file, err := os.OpenFile(cfg.AccessLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return nil, nil, errors.New("Unable to open access log %v: %v", cfg.AccessLog, err)
+			}
+			w, closer = file, file
+		}
+		switch cfg.AccessLogFormat {
+		case "json":
+			opts.AccessLogger = proxy.JSONAccessLogger(w)
+		case "combined", "":
+			opts.AccessLogger = proxy.CombinedAccessLogger(w)
+		default:
+			closer.Close()
+			return nil, nil, errors.New("Unknown access log format %v", cfg.AccessLogFormat)
+		}
+	}
+
+	return opts, closer, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// stringsFlag is a flag that may be repeated.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// portsFlag is a comma-separated list of ports.
+type portsFlag []int
+
+func (f *portsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	ports := make([]string, 0, len(*f))
+	for _, port := range *f {
+		ports = append(ports, strconv.Itoa(port))
+	}
+	return strings.Join(ports, ",")
+}
+
+func (f *portsFlag) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		port, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || port < 1 || port > 65535 {
+			return errors.New("Invalid port %v", part)
+		}
+		*f = append(*f, port)
+	}
+	return nil
+}
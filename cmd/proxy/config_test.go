@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxycmd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "proxy.yaml")
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(`
+addr: :3128
+users:
+  - alice:secret
+allow_ports: [80, 443]
+idle_timeout: 10s
+tunnel_compression: true
+access_log_format: json
+rules:
+  - hosts: ["ads.example.com"]
+    action: block
+`), 0600))
+
+	cfg, err := parseConfig([]string{"-config", configFile, "-addr", "localhost:8888", "-user", "bob:hunter2", "-deny-private", "-health-checks"}, ioutil.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:8888", cfg.Addr, "Flag should override file")
+	assert.Equal(t, []string{"alice:secret", "bob:hunter2"}, cfg.Users)
+	assert.Equal(t, []int{80, 443}, cfg.AllowPorts)
+	assert.Equal(t, 10*time.Second, cfg.IdleTimeout)
+	assert.Equal(t, "json", cfg.AccessLogFormat)
+	assert.True(t, cfg.DenyPrivate)
+	assert.Equal(t, "proxy", cfg.Realm, "Unset options keep their defaults")
+
+	opts, accessLog, err := cfg.opts(nil)
+	require.NoError(t, err)
+	defer accessLog.Close()
+	assert.NotNil(t, opts.Authenticator)
+	assert.NotNil(t, opts.AccessControl)
+	assert.NotNil(t, opts.Rules)
+	assert.True(t, opts.TunnelCompression)
+	if assert.NotNil(t, opts.HealthChecks) {
+		assert.True(t, opts.HealthChecks.ServeOnProxyPort)
+	}
+	assert.Nil(t, opts.Dial)
+
+	require.NoError(t, ioutil.WriteFile(configFile, []byte("unknown_option: true\n"), 0600))
+	_, err = parseConfig([]string{"-config", configFile}, ioutil.Discard)
+	assert.Error(t, err, "Unknown options in config file should be rejected")
+
+	_, err = parseConfig([]string{"-allow-ports", "http"}, ioutil.Discard)
+	assert.Error(t, err)
+}
+
+func TestConfigOptsErrors(t *testing.T) {
+	for _, cfg := range []*Config{
+		{Users: []string{"nopassword"}},
+		{Users: []string{"alice:secret"}, HtpasswdFile: "htpasswd"},
+		{HtpasswdFile: "does-not-exist"},
+		{Upstreams: []string{"ftp://example.com:21"}},
+		{DenyCIDRs: []string{"not a cidr"}},
+		{AccessLog: "-", AccessLogFormat: "xml"},
+		{Rules: []*proxy.Rule{{Action: "teleport"}}},
+	} {
+		_, _, err := cfg.opts(nil)
+		assert.Error(t, err, "%+v", cfg)
+	}
+
+	cfg := defaultConfig()
+	cfg.Upstreams = []string{"socks5://localhost:1080"}
+	opts, _, err := cfg.opts(nil)
+	require.NoError(t, err)
+	assert.NotNil(t, opts.Dial)
+}
@@ -0,0 +1,171 @@
+// Command proxy runs an HTTP(S) and SOCKS5 proxy server configured with
+// flags and/or a YAML config file. For example:
+//
+//	proxy -addr :8080 -user alice:secret -deny-private -metrics-addr localhost:9090
+//
+// A config file uses the same names as the flags, with underscores:
+//
+//	addr: :8080
+//	users:
+//	  - alice:secret
+//	upstreams:
+//	  - socks5://upstream.example.com:1080
+//	allow_ports: [80, 443]
+//	access_log: "-"
+//	access_log_format: json
+//
+// With systemd socket activation, the inherited sockets are served instead of
+// listening at the configured addresses: sockets named socks5, metrics and
+// admin (see FileDescriptorName=) replace socks5_addr, metrics_addr and
+// admin_addr, and all others serve the proxy instead of addr.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/proxy"
+)
+
+var (
+	log = golog.LoggerFor("proxy-cmd")
+)
+
+func main() {
+	cfg, err := parseConfig(os.Args[1:], os.Stderr)
+	if err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(2)
+	}
+	if err := run(cfg); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}
+
+func run(cfg *Config) error {
+	// With systemd socket activation, sockets named socks5, metrics and admin
+	// replace the corresponding addresses and any others replace Addr
+	inherited, err := proxy.SystemdListeners()
+	if err != nil {
+		return err
+	}
+	var proxyListeners []net.Listener
+	var socksListener, metricsListener, adminListener net.Listener
+	for _, l := range inherited {
+		log.Debugf("Inherited %v listener at %v", l.Name, l.Addr())
+		switch l.Name {
+		case "socks5":
+			socksListener = l
+		case "metrics":
+			metricsListener = l
+		case "admin":
+			adminListener = l
+		default:
+			proxyListeners = append(proxyListeners, l)
+		}
+	}
+
+	var metrics *proxy.PrometheusMetrics
+	var pm proxy.Metrics
+	if cfg.MetricsAddr != "" || metricsListener != nil {
+		metrics = proxy.NewPrometheusMetrics("proxy")
+		pm = metrics
+	}
+	opts, accessLog, err := cfg.opts(pm)
+	if err != nil {
+		return err
+	}
+	defer accessLog.Close()
+
+	p, err := proxy.New(opts)
+	if err != nil {
+		return err
+	}
+
+	if len(proxyListeners) == 0 {
+		l, err := net.Listen("tcp", cfg.Addr)
+		if err != nil {
+			return log.Errorf("Unable to listen at %v: %v", cfg.Addr, err)
+		}
+		proxyListeners = append(proxyListeners, l)
+	}
+	if socksListener == nil && cfg.SOCKS5Addr != "" {
+		socksListener, err = net.Listen("tcp", cfg.SOCKS5Addr)
+		if err != nil {
+			return log.Errorf("Unable to listen for SOCKS5 at %v: %v", cfg.SOCKS5Addr, err)
+		}
+	}
+
+	var specs []*proxy.ListenerSpec
+	for _, l := range proxyListeners {
+		if cfg.TLSCert != "" || cfg.TLSKey != "" {
+			log.Debugf("Serving HTTPS proxy at %v", l.Addr())
+			specs = append(specs, &proxy.ListenerSpec{
+				Listener: l,
+				Protocol: proxy.ListenerHTTPS,
+				TLSOpts:  &proxy.TLSServerOpts{CertFile: cfg.TLSCert, KeyFile: cfg.TLSKey},
+			})
+		} else {
+			log.Debugf("Serving HTTP proxy at %v", l.Addr())
+			specs = append(specs, &proxy.ListenerSpec{Listener: l, Protocol: proxy.ListenerHTTP})
+		}
+	}
+	if socksListener != nil {
+		log.Debugf("Serving SOCKS5 proxy at %v", socksListener.Addr())
+		specs = append(specs, &proxy.ListenerSpec{Listener: socksListener, Protocol: proxy.ListenerSOCKS})
+	}
+
+	errs := make(chan error, 3)
+	go func() {
+		errs <- proxy.ServeListeners(p, specs...)
+	}()
+	if metrics != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		go func() {
+			errs <- serveHTTP(metricsListener, cfg.MetricsAddr, "metrics at /metrics", mux)
+		}()
+	}
+	if cfg.AdminAddr != "" || adminListener != nil {
+		go func() {
+			errs <- serveHTTP(adminListener, cfg.AdminAddr, "admin endpoints", p.AdminHandler())
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		log.Debugf("Shutting down on %v", sig)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	drained, aborted, err := p.Shutdown(ctx)
+	log.Debugf("Drained %d and aborted %d connections", drained, aborted)
+	return err
+}
+
+// serveHTTP serves handler on l, or else at addr.
+func serveHTTP(l net.Listener, addr string, what string, handler http.Handler) error {
+	if l == nil {
+		var err error
+		l, err = net.Listen("tcp", addr)
+		if err != nil {
+			return log.Errorf("Unable to listen for %v at %v: %v", what, addr, err)
+		}
+	}
+	log.Debugf("Serving %v on http://%v", what, l.Addr())
+	return http.Serve(l, handler)
+}
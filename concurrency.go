@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+)
+
+// tunnelLimiter limits the number of concurrent tunnels.
+type tunnelLimiter struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+}
+
+func (proxy *proxy) initConcurrencyLimit() {
+	proxy.clientTunnels = newClientTunnels(proxy.ClientTunnelQuota)
+	proxy.Filter = filters.Join(proxy.Filter, filters.FilterFunc(proxy.limitClientTunnels))
+	if proxy.ConcurrencyLimit <= 0 {
+		return
+	}
+	proxy.limiter = &tunnelLimiter{
+		slots:        make(chan struct{}, proxy.ConcurrencyLimit),
+		queueTimeout: proxy.ConcurrencyQueueTimeout,
+	}
+	proxy.Filter = filters.Join(proxy.Filter, filters.FilterFunc(proxy.limitTunnels))
+}
+
+// acquire waits up to queueTimeout for a free slot, returning a function that
+// releases the slot (safe to call multiple times), or nil if no slot became
+// available.
+func (l *tunnelLimiter) acquire(ctx context.Context) func() {
+	select {
+	case l.slots <- struct{}{}:
+		return l.releaser()
+	default:
+	}
+	if l.queueTimeout <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return l.releaser()
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+func (l *tunnelLimiter) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-l.slots
+		})
+	}
+}
+
+// limitTunnels is a filter that responds 503 Service Unavailable to CONNECT
+// requests once ConcurrencyLimit tunnels are open. The slot is held until the
+// tunnel finishes, see releaseTunnel.
+func (proxy *proxy) limitTunnels(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+	if req.Method != http.MethodConnect {
+		return next(ctx, req)
+	}
+	release := proxy.limiter.acquire(ctx)
+	if release == nil {
+		log.Debugf("Too many concurrent tunnels, rejecting CONNECT to %v", req.URL.Host)
+		filters.Discard(ctx, req)
+		resp, ctx, err := filters.ShortCircuit(ctx, req, &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Header:     http.Header{"Retry-After": []string{strconv.Itoa(retryAfterSeconds(proxy.ConcurrencyQueueTimeout))}},
+		})
+		return resp, ctx, err
+	}
+	return holdUntilTunnelDone(release, next)(ctx, req)
+}
+
+// holdUntilTunnelDone wraps next so that release is called once the tunnel
+// resulting from the request finishes, or immediately if there won't be one.
+func holdUntilTunnelDone(release func(), next filters.Next) filters.Next {
+	return func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+		resp, nextCtx, err := next(ctx, req)
+		if err != nil || (upstreamConn(nextCtx) == nil && upstreamAddr(nextCtx) == "") {
+			// No tunnel will follow
+			release()
+			return resp, nextCtx, err
+		}
+		if previous, ok := nextCtx.Value(ctxKeyReleaseTunnel).(func()); ok {
+			inner := release
+			release = func() {
+				inner()
+				previous()
+			}
+		}
+		return resp, nextCtx.WithValue(ctxKeyReleaseTunnel, release), err
+	}
+}
+
+// acquireTunnel acquires a concurrency slot, counts the client's tunnel and
+// acquires a slot for its destination for a tunnel that doesn't pass through
+// the HTTP filter chain, returning a function that releases all of them.
+func (proxy *proxy) acquireTunnel(ctx context.Context) (func(), error) {
+	releaseClient, err := proxy.acquireClientTunnel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	releaseAll := releaseClient
+	if proxy.limiter != nil {
+		release := proxy.limiter.acquire(ctx)
+		if release == nil {
+			releaseClient()
+			return nil, &PolicyDeniedError{Phase: PhaseAdmission, Policy: PolicyConcurrencyLimit, Err: errors.New("Too many concurrent tunnels")}
+		}
+		releaseAll = func() {
+			release()
+			releaseClient()
+		}
+	}
+	if proxy.destinationLimiter != nil {
+		releaseDestination, err := proxy.acquireDestination(ctx)
+		if err != nil {
+			releaseAll()
+			return nil, err
+		}
+		releaseOthers := releaseAll
+		releaseAll = func() {
+			releaseDestination()
+			releaseOthers()
+		}
+	}
+	return releaseAll, nil
+}
+
+// releaseTunnel releases the concurrency slot held for the tunnel in ctx, if
+// any.
+func releaseTunnel(ctx context.Context) {
+	if release, ok := ctx.Value(ctxKeyReleaseTunnel).(func()); ok {
+		release()
+	}
+}
+
+func retryAfterSeconds(d time.Duration) int {
+	seconds := int(d / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+)
+
+// Config is the part of a proxy's configuration that can be changed while
+// it's running, see Proxy.ApplyConfig. The corresponding fields of Opts
+// provide the initial Config.
+//
+// Changes apply to new connections and requests. Open tunnels aren't
+// affected, in particular they keep the rate limits they were opened with.
+type Config struct {
+	// AccessControl decides whether clients may access destinations, see
+	// Opts.AccessControl. If nil, all destinations are allowed.
+	AccessControl AccessControl
+
+	// Authenticator authenticates proxy users, see Opts.Authenticator. If
+	// nil, clients don't need to authenticate.
+	Authenticator Authenticator
+
+	// RateLimiter throttles upstream connections, see Opts.RateLimiter. If
+	// nil, connections aren't throttled.
+	RateLimiter *RateLimiter
+
+	// Dial dials upstream, typically implementing routing rules with a Router
+	// or Balancer. If nil, destinations are dialed like when Opts.Dial is nil.
+	Dial DialFunc
+}
+
+// currentConfig returns the Config that's currently in effect.
+func (proxy *proxy) currentConfig() *Config {
+	return proxy.config.Load().(*Config)
+}
+
+// ApplyConfig implements the interface Proxy
+func (proxy *proxy) ApplyConfig(cfg *Config) {
+	applied := &Config{}
+	if cfg != nil {
+		*applied = *cfg
+	}
+	if applied.Dial == nil {
+		applied.Dial = defaultDial(proxy.Opts)
+	}
+	applied.Dial = WrapDial(applied.Dial, proxy.DialMiddleware...)
+	proxy.config.Store(applied)
+	log.Debug("Applied new config")
+}
+
+// defaultDial returns the DialFunc to use when opts don't configure Dial, which
+// is a Dialer if DialerOptions are given.
+func defaultDial(opts *Opts) DialFunc {
+	if opts.DialerOptions != nil {
+		return NewDialer(opts.DialerOptions)
+	}
+	return directDial
+}
+
+func directDial(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+	timeout := 30 * time.Second
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		timeout = deadline.Sub(time.Now())
+	}
+	return net.DialTimeout(network, addr, timeout)
+}
+
+// configuredAuthFilter authenticates requests with the currently configured
+// Authenticator, if any.
+func (proxy *proxy) configuredAuthFilter() filters.Filter {
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		auth := proxy.currentConfig().Authenticator
+		if auth == nil {
+			return next(ctx, req)
+		}
+		return authFilter(auth).Apply(ctx, req, next)
+	})
+}
+
+// configuredAccessControlFilter checks requests with the currently configured
+// AccessControl, if any.
+func (proxy *proxy) configuredAccessControlFilter() filters.Filter {
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		ac := proxy.currentConfig().AccessControl
+		if ac == nil {
+			return next(ctx, req)
+		}
+		return proxy.accessControlFilter(ac).Apply(ctx, req, next)
+	})
+}
+
+// WatchConfigFile loads a Config from file using load and applies it to p,
+// then does so again whenever the file changes (checked every interval) or
+// the process receives SIGHUP, until stop is called. If interval is zero, the
+// file is only reloaded on SIGHUP. If reloading fails, the current Config
+// stays in effect. An error is only returned if the initial load fails.
+func WatchConfigFile(p Proxy, file string, interval time.Duration, load func(file string) (*Config, error)) (stop func(), err error) {
+	cfg, err := load(file)
+	if err != nil {
+		return nil, err
+	}
+	p.ApplyConfig(cfg)
+	modTime := fileModTime(file)
+	changed := func() bool {
+		latest := fileModTime(file)
+		if latest.Equal(modTime) {
+			return false
+		}
+		modTime = latest
+		return true
+	}
+	return watchConfig(p, interval, changed, func() (*Config, error) {
+		return load(file)
+	}), nil
+}
+
+// ReloadOnSIGHUP applies the Config returned by load to p whenever the process
+// receives SIGHUP, until stop is called. If loading fails, the current Config
+// stays in effect.
+func ReloadOnSIGHUP(p Proxy, load func() (*Config, error)) (stop func()) {
+	return watchConfig(p, 0, nil, load)
+}
+
+func watchConfig(p Proxy, interval time.Duration, changed func() bool, load func() (*Config, error)) func() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	var ticker *time.Ticker
+	if interval > 0 && changed != nil {
+		ticker = time.NewTicker(interval)
+		tick = ticker.C
+	}
+	done := make(chan struct{})
+	go func() {
+		defer signal.Stop(hup)
+		if ticker != nil {
+			defer ticker.Stop()
+		}
+		for {
+			select {
+			case <-done:
+				return
+			case <-hup:
+			case <-tick:
+				if !changed() {
+					continue
+				}
+			}
+			cfg, err := load()
+			if err != nil {
+				log.Errorf("Unable to reload config: %v", err)
+				continue
+			}
+			p.ApplyConfig(cfg)
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
+
+func fileModTime(file string) time.Time {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
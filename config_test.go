@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyConfig(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	p := newProxy(&Opts{OKWaitsForUpstream: true})
+	go p.Serve(l)
+
+	tunnel, br, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+	defer tunnel.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var dials int32
+	p.ApplyConfig(&Config{
+		Authenticator: BasicAuth("test", func(username, password string) bool { return true }),
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return net.Dial(network, addr)
+		},
+	})
+
+	conn, _, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+	conn.Close()
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode, "New config should require authentication")
+
+	// The tunnel opened under the old config keeps working
+	_, err = tunnel.Write([]byte("still open"))
+	require.NoError(t, err)
+	echoed := make([]byte, len("still open"))
+	_, err = io.ReadFull(br, echoed)
+	require.NoError(t, err)
+	assert.Equal(t, "still open", string(echoed))
+
+	p.ApplyConfig(&Config{
+		AccessControl: AccessControlFunc(func(ctx context.Context, clientIP net.IP, dest *Destination) error {
+			return errors.New("denied")
+		}),
+	})
+	conn, _, resp = openTunnel(t, l.Addr().String(), origin.Addr().String())
+	conn.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	p.ApplyConfig(nil)
+	conn, _, resp = openTunnel(t, l.Addr().String(), origin.Addr().String())
+	conn.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Empty config should dial directly")
+	assert.Zero(t, atomic.LoadInt32(&dials))
+}
+
+func TestWatchConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "ports")
+	require.NoError(t, ioutil.WriteFile(file, []byte("80"), 0600))
+
+	var loads int32
+	load := func(file string) (*Config, error) {
+		atomic.AddInt32(&loads, 1)
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(string(data)) == "broken" {
+			return nil, errors.New("broken config")
+		}
+		return &Config{AccessControl: AllowPorts(80)}, nil
+	}
+
+	p := newProxy(&Opts{}).(*proxy)
+	stop, err := WatchConfigFile(p, file, 10*time.Millisecond, load)
+	require.NoError(t, err)
+	defer stop()
+	assert.NotNil(t, p.currentConfig().AccessControl)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&loads))
+
+	// Unchanged files aren't reloaded
+	time.Sleep(50 * time.Millisecond)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&loads))
+
+	// Replace the file atomically so that the watcher never sees it half
+	// written
+	replace := func(content string, modTime time.Time) {
+		tmp := file + ".tmp"
+		require.NoError(t, ioutil.WriteFile(tmp, []byte(content), 0600))
+		require.NoError(t, os.Chtimes(tmp, modTime, modTime))
+		require.NoError(t, os.Rename(tmp, file))
+	}
+
+	// Failed reloads keep the current config
+	current := p.currentConfig()
+	replace("broken", time.Now().Add(time.Minute))
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&loads) == 2 }, time.Second, 5*time.Millisecond)
+	assert.True(t, current == p.currentConfig())
+
+	replace("80", time.Now().Add(2*time.Minute))
+	assert.Eventually(t, func() bool { return current != p.currentConfig() }, time.Second, 5*time.Millisecond)
+
+	_, err = WatchConfigFile(p, filepath.Join(dir, "missing"), 0, load)
+	assert.Error(t, err)
+}
@@ -0,0 +1,290 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+)
+
+const (
+	// DefaultUDPIdleTimeout is how long a CONNECT-UDP association may go
+	// without datagrams in either direction before it's closed, if
+	// Opts.UDPIdleTimeout isn't set.
+	DefaultUDPIdleTimeout = 2 * time.Minute
+
+	connectUDPProtocol   = "connect-udp"
+	connectUDPPathPrefix = "/.well-known/masque/udp/"
+
+	capsuleTypeDatagram = 0x00
+	maxUDPPayload       = 65527
+	maxCapsuleLength    = maxUDPPayload + 8
+)
+
+// isConnectUDP indicates whether req asks to proxy UDP using CONNECT-UDP over
+// HTTP/1.1 (RFC 9298), i.e. a GET to the well-known URI template that asks to
+// upgrade to connect-udp.
+func isConnectUDP(req *http.Request) bool {
+	return req.Method == http.MethodGet &&
+		isUpgradeTo(req.Header, connectUDPProtocol) &&
+		strings.HasPrefix(req.URL.EscapedPath(), connectUDPPathPrefix)
+}
+
+// isExtendedConnectUDP indicates whether req asks to proxy UDP using
+// CONNECT-UDP over HTTP/2 or HTTP/3 (RFC 9298), i.e. an extended CONNECT
+// (RFC 8441 and RFC 9220) with the connect-udp protocol to the well-known URI
+// template. net/http exposes the protocol as the :protocol header, though its
+// HTTP/2 server only accepts extended CONNECTs with GODEBUG=http2xconnect=1.
+// HTTP/3 servers like quic-go's set it as the Proto of the request.
+func isExtendedConnectUDP(req *http.Request) bool {
+	return req.Method == http.MethodConnect &&
+		(req.Proto == connectUDPProtocol || req.Header.Get(":protocol") == connectUDPProtocol) &&
+		strings.HasPrefix(req.URL.EscapedPath(), connectUDPPathPrefix)
+}
+
+// connectUDPTarget extracts the target address from a CONNECT-UDP request path
+// of the form /.well-known/masque/udp/{target_host}/{target_port}/.
+func connectUDPTarget(req *http.Request) (string, error) {
+	rest := strings.TrimPrefix(req.URL.EscapedPath(), connectUDPPathPrefix)
+	parts := strings.Split(strings.TrimSuffix(rest, "/"), "/")
+	if len(parts) != 2 {
+		return "", errors.New("Malformed CONNECT-UDP path %v", req.URL.EscapedPath())
+	}
+	host, err := url.PathUnescape(parts[0])
+	if err != nil || host == "" {
+		return "", errors.New("Malformed CONNECT-UDP target host %v", parts[0])
+	}
+	port, err := strconv.Atoi(parts[1])
+	if err != nil || port < 1 || port > 65535 {
+		return "", errors.New("Malformed CONNECT-UDP target port %v", parts[1])
+	}
+	return net.JoinHostPort(host, parts[1]), nil
+}
+
+// connectUDP dials the UDP target of a CONNECT-UDP request and, if successful,
+// records the association as the upgraded upstream so that processRequests
+// (or serveHTTP2) tunnels it after writing the 101 response (or, over HTTP/2
+// and HTTP/3, the 200 response).
+func (proxy *proxy) connectUDP(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+	target, err := connectUDPTarget(req)
+	if err != nil {
+		log.Debugf("Rejecting CONNECT-UDP request: %v", err)
+		return &http.Response{
+			StatusCode: http.StatusBadRequest,
+			Header:     make(http.Header),
+			Close:      true,
+		}, ctx, nil
+	}
+	conn, err := proxy.dialUpstream(ctx, true, "udp", target)
+	if err != nil {
+		return nil, ctx, errors.New("Unable to dial UDP target %v: %v", target, err)
+	}
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+	}
+	if req.ProtoMajor < 2 {
+		resp.StatusCode = http.StatusSwitchingProtocols
+		resp.Header.Set("Upgrade", connectUDPProtocol)
+	}
+	resp.Header.Set("Capsule-Protocol", "?1")
+	return resp, ctx.WithValue(ctxKeyUpgradedUpstream, newUDPCapsuleConn(conn, proxy.udpIdleTimeout())), nil
+}
+
+func (opts *Opts) udpIdleTimeout() time.Duration {
+	if opts.UDPIdleTimeout > 0 {
+		return opts.UDPIdleTimeout
+	}
+	return DefaultUDPIdleTimeout
+}
+
+// udpCapsuleConn adapts a connected UDP socket to the capsule stream of a
+// CONNECT-UDP tunnel (RFC 9297). Writes are parsed into DATAGRAM capsules whose
+// payloads are sent as UDP datagrams, and received datagrams are read out as
+// DATAGRAM capsules. Once no datagrams have been sent or received for
+// idleTimeout, reads return io.EOF.
+type udpCapsuleConn struct {
+	net.Conn
+	idleTimeout  time.Duration
+	lastActivity int64
+
+	readBuf []byte
+	pending []byte
+
+	writeMx  sync.Mutex
+	writeBuf []byte
+
+	deadlineMx   sync.Mutex
+	readDeadline time.Time
+}
+
+func newUDPCapsuleConn(conn net.Conn, idleTimeout time.Duration) *udpCapsuleConn {
+	return &udpCapsuleConn{
+		Conn:         conn,
+		idleTimeout:  idleTimeout,
+		lastActivity: time.Now().UnixNano(),
+		readBuf:      make([]byte, maxUDPPayload),
+	}
+}
+
+func (conn *udpCapsuleConn) touch() {
+	atomic.StoreInt64(&conn.lastActivity, time.Now().UnixNano())
+}
+
+func (conn *udpCapsuleConn) idleDeadline() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&conn.lastActivity)).Add(conn.idleTimeout)
+}
+
+func (conn *udpCapsuleConn) Read(b []byte) (int, error) {
+	for len(conn.pending) == 0 {
+		conn.deadlineMx.Lock()
+		readDeadline := conn.readDeadline
+		conn.deadlineMx.Unlock()
+		deadline := conn.idleDeadline()
+		if !readDeadline.IsZero() && readDeadline.Before(deadline) {
+			deadline = readDeadline
+		}
+		conn.Conn.SetReadDeadline(deadline)
+		n, err := conn.Conn.Read(conn.readBuf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				now := time.Now()
+				if !now.Before(conn.idleDeadline()) {
+					return 0, io.EOF
+				}
+				conn.deadlineMx.Lock()
+				readDeadline = conn.readDeadline
+				conn.deadlineMx.Unlock()
+				if !readDeadline.IsZero() && !now.Before(readDeadline) {
+					return 0, err
+				}
+				continue
+			}
+			return 0, err
+		}
+		conn.touch()
+		conn.pending = appendDatagramCapsule(conn.pending[:0], conn.readBuf[:n])
+	}
+	n := copy(b, conn.pending)
+	conn.pending = conn.pending[n:]
+	return n, nil
+}
+
+func (conn *udpCapsuleConn) Write(b []byte) (int, error) {
+	conn.writeMx.Lock()
+	defer conn.writeMx.Unlock()
+	conn.writeBuf = append(conn.writeBuf, b...)
+	for {
+		capsuleType, value, consumed, err := parseCapsule(conn.writeBuf)
+		if err != nil {
+			return 0, err
+		}
+		if consumed == 0 {
+			// Incomplete capsule, wait for more
+			return len(b), nil
+		}
+		if capsuleType == capsuleTypeDatagram {
+			// Only context ID 0 (UDP payload) is defined, drop anything else
+			contextID, n := readVarint(value)
+			if n > 0 && contextID == 0 {
+				conn.touch()
+				if _, writeErr := conn.Conn.Write(value[n:]); writeErr != nil {
+					log.Debugf("Unable to send UDP datagram to %v: %v", conn.RemoteAddr(), writeErr)
+				}
+			}
+		}
+		// Unknown capsule types are silently skipped, as required by RFC 9297
+		conn.writeBuf = conn.writeBuf[:copy(conn.writeBuf, conn.writeBuf[consumed:])]
+	}
+}
+
+func (conn *udpCapsuleConn) SetDeadline(t time.Time) error {
+	conn.SetReadDeadline(t)
+	return conn.Conn.SetWriteDeadline(t)
+}
+
+func (conn *udpCapsuleConn) SetReadDeadline(t time.Time) error {
+	conn.deadlineMx.Lock()
+	conn.readDeadline = t
+	conn.deadlineMx.Unlock()
+	// Interrupt any pending read so it picks up the new deadline
+	return conn.Conn.SetReadDeadline(time.Now())
+}
+
+func (conn *udpCapsuleConn) Wrapped() net.Conn {
+	return conn.Conn
+}
+
+// parseCapsule parses the capsule at the start of b, returning consumed == 0
+// if b doesn't yet hold a complete capsule.
+func parseCapsule(b []byte) (capsuleType uint64, value []byte, consumed int, err error) {
+	capsuleType, n := readVarint(b)
+	if n == 0 {
+		return 0, nil, 0, nil
+	}
+	length, m := readVarint(b[n:])
+	if m == 0 {
+		return 0, nil, 0, nil
+	}
+	if length > maxCapsuleLength {
+		return 0, nil, 0, errors.New("Capsule of %d bytes exceeds maximum of %d", length, maxCapsuleLength)
+	}
+	end := n + m + int(length)
+	if len(b) < end {
+		return 0, nil, 0, nil
+	}
+	return capsuleType, b[n+m : end], end, nil
+}
+
+// appendDatagramCapsule appends a DATAGRAM capsule carrying payload with
+// context ID 0 to b.
+func appendDatagramCapsule(b []byte, payload []byte) []byte {
+	b = appendVarint(b, capsuleTypeDatagram)
+	b = appendVarint(b, uint64(len(payload)+1))
+	b = appendVarint(b, 0)
+	return append(b, payload...)
+}
+
+// readVarint reads a QUIC variable-length integer (RFC 9000 section 16) from
+// the start of b, returning n == 0 if b is too short.
+func readVarint(b []byte) (v uint64, n int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	n = 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0
+	}
+	v = uint64(b[0] & 0x3f)
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, n
+}
+
+// appendVarint appends v to b as a QUIC variable-length integer.
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		var buf [4]byte
+		binary.BigEndian.PutUint32(buf[:], uint32(v)|0x80<<24)
+		return append(b, buf[:]...)
+	default:
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], v|0xc0<<56)
+		return append(b, buf[:]...)
+	}
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVarint(t *testing.T) {
+	for _, v := range []uint64{0, 37, 63, 64, 15293, 16383, 16384, 494878333, 1 << 30, 151288809941952652} {
+		b := appendVarint(nil, v)
+		decoded, n := readVarint(b)
+		assert.Equal(t, len(b), n)
+		assert.Equal(t, v, decoded)
+		_, n = readVarint(b[:len(b)-1])
+		assert.Zero(t, n, "Truncated varint should not decode")
+	}
+	// Examples from RFC 9000 appendix A.1
+	decoded, _ := readVarint([]byte{0x7b, 0xbd})
+	assert.EqualValues(t, 15293, decoded)
+	decoded, _ = readVarint([]byte{0x9d, 0x7f, 0x3e, 0x7d})
+	assert.EqualValues(t, 494878333, decoded)
+}
+
+func TestConnectUDPTarget(t *testing.T) {
+	target := func(path string) (string, error) {
+		req, _ := http.NewRequest(http.MethodGet, "http://proxy"+path, nil)
+		return connectUDPTarget(req)
+	}
+	addr, err := target("/.well-known/masque/udp/192.0.2.6/443/")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.6:443", addr)
+	addr, err = target("/.well-known/masque/udp/2001%3Adb8%3A%3A42/53/")
+	assert.NoError(t, err)
+	assert.Equal(t, "[2001:db8::42]:53", addr)
+	_, err = target("/.well-known/masque/udp/example.com/")
+	assert.Error(t, err)
+	_, err = target("/.well-known/masque/udp/example.com/0/")
+	assert.Error(t, err)
+}
+
+func newUDPEchoServer(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		b := make([]byte, maxUDPPayload)
+		for {
+			n, addr, readErr := pc.ReadFrom(b)
+			if readErr != nil {
+				return
+			}
+			pc.WriteTo(b[:n], addr)
+		}
+	}()
+	return pc
+}
+
+func TestConnectUDP(t *testing.T) {
+	origin := newUDPEchoServer(t)
+	defer origin.Close()
+
+	l := serveProxy(t, &Opts{ConnectUDP: true, UDPIdleTimeout: 250 * time.Millisecond})
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, port, _ := net.SplitHostPort(origin.LocalAddr().String())
+	req, _ := http.NewRequest(http.MethodGet, "http://"+l.Addr().String()+"/.well-known/masque/udp/127.0.0.1/"+port+"/", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "connect-udp")
+	req.Header.Set("Capsule-Protocol", "?1")
+	req.Write(conn)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "connect-udp", resp.Header.Get("Upgrade"))
+	assert.Equal(t, "?1", resp.Header.Get("Capsule-Protocol"))
+
+	// An unknown capsule type followed by a datagram, split across writes
+	capsules := append([]byte{0x17, 0x02, 'x', 'y'}, appendDatagramCapsule(nil, []byte("hello"))...)
+	conn.Write(capsules[:6])
+	conn.Write(capsules[6:])
+
+	echoed := appendDatagramCapsule(nil, []byte("hello"))
+	b := make([]byte, len(echoed))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.ReadFull(br, b)
+	require.NoError(t, err)
+	assert.Equal(t, echoed, b)
+
+	// Once idle, the association is closed
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = br.ReadByte()
+	assert.Equal(t, io.EOF, err)
+	assert.True(t, time.Since(start) < 4*time.Second, "Idle association should have been closed")
+}
+
+func TestIsConnectUDP(t *testing.T) {
+	assert.False(t, isConnectUDP(&http.Request{Method: http.MethodGet, Header: http.Header{}}))
+	req, _ := http.NewRequest(http.MethodGet, "http://proxy/.well-known/masque/udp/127.0.0.1/53/", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "connect-udp")
+	assert.True(t, isConnectUDP(req))
+	req.Header.Set("Upgrade", "websocket")
+	assert.False(t, isConnectUDP(req))
+}
+
+// streamResponseWriter is an http.ResponseWriter for the request stream of an
+// HTTP/2 or HTTP/3 server.
+type streamResponseWriter struct {
+	header http.Header
+	status chan int
+	w      *io.PipeWriter
+}
+
+func (w *streamResponseWriter) Header() http.Header         { return w.header }
+func (w *streamResponseWriter) WriteHeader(status int)      { w.status <- status }
+func (w *streamResponseWriter) Write(b []byte) (int, error) { return w.w.Write(b) }
+func (w *streamResponseWriter) Flush()                      {}
+
+func TestExtendedConnectUDP(t *testing.T) {
+	origin := newUDPEchoServer(t)
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(origin.LocalAddr().String())
+	p := newProxy(&Opts{ConnectUDP: true})
+
+	for name, setProtocol := range map[string]func(req *http.Request){
+		"HTTP/2": func(req *http.Request) {
+			req.ProtoMajor = 2
+			req.Header.Set(":protocol", "connect-udp")
+		},
+		// HTTP/3 servers like quic-go's set the protocol of extended CONNECTs
+		// as the Proto of the request
+		"HTTP/3": func(req *http.Request) {
+			req.Proto, req.ProtoMajor = "connect-udp", 3
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			reqBody, toProxy := io.Pipe()
+			fromProxy, respBody := io.Pipe()
+			req, _ := http.NewRequest(http.MethodConnect, "https://proxy/.well-known/masque/udp/127.0.0.1/"+port+"/", reqBody)
+			req.ProtoMinor = 0
+			setProtocol(req)
+			req.RemoteAddr = "127.0.0.1:5000"
+			w := &streamResponseWriter{header: make(http.Header), status: make(chan int, 1), w: respBody}
+			done := make(chan interface{})
+			go func() {
+				p.ServeHTTP(w, req)
+				respBody.Close()
+				close(done)
+			}()
+			require.Equal(t, http.StatusOK, <-w.status)
+			assert.Equal(t, "?1", w.header.Get("Capsule-Protocol"))
+
+			_, err := toProxy.Write(appendDatagramCapsule(nil, []byte("hello")))
+			require.NoError(t, err)
+			echoed := appendDatagramCapsule(nil, []byte("hello"))
+			b := make([]byte, len(echoed))
+			_, err = io.ReadFull(fromProxy, b)
+			require.NoError(t, err)
+			assert.Equal(t, echoed, b)
+			toProxy.Close()
+			fromProxy.Close()
+			<-done
+		})
+	}
+}
+
+func TestIsExtendedConnectUDP(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodConnect, "https://proxy/.well-known/masque/udp/127.0.0.1/53/", nil)
+	assert.False(t, isExtendedConnectUDP(req))
+	req.Header.Set(":protocol", "connect-udp")
+	assert.True(t, isExtendedConnectUDP(req))
+	req.Header.Set(":protocol", "websocket")
+	assert.False(t, isExtendedConnectUDP(req))
+	req.Proto = "connect-udp"
+	assert.True(t, isExtendedConnectUDP(req))
+}
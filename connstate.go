@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/getlantern/errors"
+)
+
+var (
+	errResponseSuppressed = errors.New("Response suppressed")
+)
+
+// connPhase is where a client connection is in the protocol.
+type connPhase int
+
+const (
+	// connAwaitingResponse means that the current request, or the one that
+	// couldn't be read, hasn't been responded to yet
+	connAwaitingResponse connPhase = iota
+
+	// connResponded means that the current request has been responded to and
+	// the next one may be read
+	connResponded
+
+	// connTunneling means that a CONNECT was answered with a 2xx or an
+	// upgrade with a 101, so the connection now belongs to the tunnel
+	connTunneling
+
+	// connClosed means that a final response was written or that the client
+	// went away, so nothing may be written anymore
+	connClosed
+)
+
+func (phase connPhase) String() string {
+	switch phase {
+	case connAwaitingResponse:
+		return "awaiting response"
+	case connResponded:
+		return "responded"
+	case connTunneling:
+		return "tunneling"
+	default:
+		return "closed"
+	}
+}
+
+// connState is the state machine of a single client connection. It makes
+// sure that every request gets at most one response, so that e.g. a CONNECT
+// never gets a second 200 OK and nothing follows a 502 that ends the
+// connection.
+type connState struct {
+	mx    sync.Mutex
+	phase connPhase
+}
+
+// respond moves on from answering the current request with resp, returning
+// false if that response mustn't be written.
+func (s *connState) respond(req *http.Request, resp *http.Response) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.phase != connAwaitingResponse {
+		return false
+	}
+	switch {
+	case resp.Close || req != nil && req.Close:
+		s.phase = connClosed
+	case req != nil && req.Method == http.MethodConnect && resp.StatusCode/100 == 2,
+		resp.StatusCode == http.StatusSwitchingProtocols:
+		s.phase = connTunneling
+	default:
+		s.phase = connResponded
+	}
+	return true
+}
+
+// nextRequest is called before reading the next request from the
+// connection, returning false if there mustn't be one.
+func (s *connState) nextRequest() bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.phase == connTunneling || s.phase == connClosed {
+		return false
+	}
+	s.phase = connAwaitingResponse
+	return true
+}
+
+// close makes sure nothing more is written to the connection.
+func (s *connState) close() {
+	s.mx.Lock()
+	s.phase = connClosed
+	s.mx.Unlock()
+}
+
+func (s *connState) current() connPhase {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.phase
+}
+
+// respond writes resp to downstream if state allows it, otherwise it discards
+// resp and returns errResponseSuppressed.
+func (proxy *proxy) respond(state *connState, downstream io.Writer, req *http.Request, resp *http.Response) error {
+	if !state.respond(req, resp) {
+		log.Debugf("Suppressing %d response to %v, connection is %v", resp.StatusCode, requestTarget(req), state.current())
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
+		return errResponseSuppressed
+	}
+	return proxy.writeResponse(downstream, req, resp)
+}
+
+func requestTarget(req *http.Request) string {
+	if req == nil || req.URL == nil {
+		return "unreadable request"
+	}
+	if req.Method == http.MethodConnect {
+		return req.URL.Host
+	}
+	return req.URL.String()
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnStateSuppressesDuplicateResponses(t *testing.T) {
+	p := newProxy(&Opts{}).(*proxy)
+	connect, _ := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+	ok := func() *http.Response {
+		return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: http.NoBody}
+	}
+
+	state := &connState{}
+	out := &bytes.Buffer{}
+	require.NoError(t, p.respond(state, out, connect, ok()))
+	written := out.Len()
+	assert.True(t, written > 0)
+	assert.Equal(t, connTunneling, state.current())
+	assert.Equal(t, errResponseSuppressed, p.respond(state, out, connect, ok()), "Second 200 OK should be suppressed")
+	assert.Equal(t, written, out.Len())
+	assert.False(t, state.nextRequest(), "Shouldn't read requests from a tunnel")
+
+	state = &connState{}
+	out.Reset()
+	badGateway := &http.Response{StatusCode: http.StatusBadGateway, Header: make(http.Header), Body: http.NoBody, Close: true}
+	require.NoError(t, p.respond(state, out, connect, badGateway))
+	written = out.Len()
+	assert.Equal(t, errResponseSuppressed, p.respond(state, out, connect, ok()), "Nothing should follow a final 502")
+	assert.Equal(t, written, out.Len())
+
+	get, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	state = &connState{}
+	require.NoError(t, p.respond(state, ioutil.Discard, get, ok()))
+	assert.Equal(t, errResponseSuppressed, p.respond(state, ioutil.Discard, get, ok()))
+	require.True(t, state.nextRequest())
+	assert.NoError(t, p.respond(state, ioutil.Discard, get, ok()), "Next request should get its own response")
+
+	state.close()
+	assert.Equal(t, errResponseSuppressed, p.respond(state, ioutil.Discard, get, ok()))
+}
+
+// upstreamPipe is a dialer whose connections are observed by the test through
+// the other end of a pipe.
+func upstreamPipe(dialed chan net.Conn, release <-chan struct{}) DialFunc {
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		if release != nil {
+			// Ignore cancellation so that the dial succeeds after the client left
+			<-release
+		}
+		upstream, remote := net.Pipe()
+		dialed <- remote
+		return upstream, nil
+	}
+}
+
+// requireClosed talks to the client through the tunnel behind remote until
+// that's closed, which happens once the proxy notices that the client is gone.
+func requireClosed(t *testing.T, remote net.Conn, msg string) {
+	remote.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, err := remote.Write([]byte("hello")); err != nil {
+			require.Equal(t, io.ErrClosedPipe, err, msg)
+			return
+		}
+	}
+}
+
+func TestOKWaitsForUpstreamDialSucceedsAfterClientGone(t *testing.T) {
+	dialed := make(chan net.Conn, 1)
+	release := make(chan struct{})
+	p := newProxy(&Opts{
+		OKWaitsForUpstream: true,
+		Dial:               upstreamPipe(dialed, release),
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	handled := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			handled <- err
+			return
+		}
+		handled <- p.Handle(context.Background(), conn, conn)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	req, _ := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+	require.NoError(t, req.Write(conn))
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	remote := <-dialed
+	requireClosed(t, remote, "Upstream dialed for a client that left should be closed")
+	select {
+	case <-handled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Handle didn't return")
+	}
+}
+
+func TestOKWaitsForUpstreamDialRacesClientClose(t *testing.T) {
+	dialed := make(chan net.Conn, 1)
+	l := serveProxy(t, &Opts{
+		OKWaitsForUpstream: true,
+		Dial:               upstreamPipe(dialed, nil),
+	})
+	defer l.Close()
+
+	for i := 0; i < 20; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		req, _ := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+		require.NoError(t, req.Write(conn))
+		go func(conn net.Conn, delay time.Duration) {
+			time.Sleep(delay)
+			conn.Close()
+		}(conn, time.Duration(i%5)*time.Millisecond)
+		requireClosed(t, <-dialed, "Upstream should be closed whether or not the tunnel was established")
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"context"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 type contextKey string
@@ -16,6 +19,18 @@ const (
 	ctxKeyOrigURLHost   = contextKey("origURLHost")
 	ctxKeyOrigHost      = contextKey("origHost")
 	ctxKeyAwareConn     = contextKey("awareConn")
+
+	ctxKeyUpgradedUpstream = contextKey("upgradedUpstream")
+	ctxKeyTrackedConn      = contextKey("trackedConn")
+	ctxKeyAccessRecord     = contextKey("accessRecord")
+	ctxKeyDialedAddr       = contextKey("dialedAddr")
+	ctxKeyTunnelStats      = contextKey("tunnelStats")
+	ctxKeyRequestSpan      = contextKey("requestSpan")
+	ctxKeyReleaseTunnel    = contextKey("releaseTunnel")
+	ctxKeyHARTimings       = contextKey("harTimings")
+	ctxKeyResolvedIPs      = contextKey("resolvedIPs")
+	ctxKeyClientConn       = contextKey("clientConn")
+	ctxKeyEarlyAuthFailure = contextKey("earlyAuthFailure")
 )
 
 func upstreamConn(ctx context.Context) net.Conn {
@@ -34,6 +49,11 @@ func upstreamAddr(ctx context.Context) string {
 	return upstreamAddr.(string)
 }
 
+func upgradedUpstream(ctx context.Context) net.Conn {
+	upstream, _ := ctx.Value(ctxKeyUpgradedUpstream).(net.Conn)
+	return upstream
+}
+
 func origURLScheme(ctx context.Context) string {
 	origHost := ctx.Value(ctxKeyOrigURLScheme)
 	if origHost == nil {
@@ -58,6 +78,87 @@ func origHost(ctx context.Context) string {
 	return origHost.(string)
 }
 
+func withDialedAddr(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKeyDialedAddr, &atomic.Value{})
+}
+
+// dialedAddrs is what's stored in the holder installed by withDialedAddr
+type dialedAddrs struct {
+	dialed   string
+	original string
+}
+
+func setDialedAddr(ctx context.Context, addr string) {
+	if holder, ok := ctx.Value(ctxKeyDialedAddr).(*atomic.Value); ok {
+		addrs, _ := holder.Load().(dialedAddrs)
+		addrs.dialed = addr
+		holder.Store(addrs)
+	}
+}
+
+func setOriginalAddr(ctx context.Context, addr string) {
+	if holder, ok := ctx.Value(ctxKeyDialedAddr).(*atomic.Value); ok {
+		addrs, _ := holder.Load().(dialedAddrs)
+		addrs.original = addr
+		holder.Store(addrs)
+	}
+}
+
+// resolvedIPs holds the IPs that hostnames resolved to when access control
+// checked them, so that exactly those are dialed. Otherwise, a hostname that
+// resolves differently the second time (DNS rebinding) could pass the check
+// with a public IP and then be dialed at a private one.
+type resolvedIPs struct {
+	mx     sync.Mutex
+	byHost map[string][]net.IP
+}
+
+func withResolvedIPs(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKeyResolvedIPs, &resolvedIPs{byHost: make(map[string][]net.IP)})
+}
+
+func setResolvedIPs(ctx context.Context, host string, ips []net.IP) {
+	if resolved, ok := ctx.Value(ctxKeyResolvedIPs).(*resolvedIPs); ok {
+		resolved.mx.Lock()
+		resolved.byHost[strings.ToLower(host)] = ips
+		resolved.mx.Unlock()
+	}
+}
+
+// resolvedIPsFor returns the IPs that host resolved to for access control, or
+// nil if it wasn't resolved.
+func resolvedIPsFor(ctx context.Context, host string) []net.IP {
+	resolved, ok := ctx.Value(ctxKeyResolvedIPs).(*resolvedIPs)
+	if !ok {
+		return nil
+	}
+	resolved.mx.Lock()
+	defer resolved.mx.Unlock()
+	return resolved.byHost[strings.ToLower(host)]
+}
+
+// withEarlyAuthFailure installs a holder for whether the first request on a
+// connection already failed to authenticate before it reached the filter
+// chain, like in HandleCONNECT, so that it isn't authenticated again. That
+// would count failed attempts twice and consume the state of schemes like
+// Digest and Negotiate.
+func withEarlyAuthFailure(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKeyEarlyAuthFailure, new(int32))
+}
+
+func setEarlyAuthFailure(ctx context.Context) {
+	if failed, ok := ctx.Value(ctxKeyEarlyAuthFailure).(*int32); ok {
+		atomic.StoreInt32(failed, 1)
+	}
+}
+
+// takeEarlyAuthFailure indicates whether authentication failed early, only
+// returning true once.
+func takeEarlyAuthFailure(ctx context.Context) bool {
+	failed, ok := ctx.Value(ctxKeyEarlyAuthFailure).(*int32)
+	return ok && atomic.CompareAndSwapInt32(failed, 1, 0)
+}
+
 func withAwareConn(ctx context.Context) context.Context {
 	return context.WithValue(ctx, ctxKeyAwareConn, make(map[string]interface{}, 2))
 }
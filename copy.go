@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"io"
+	"math/bits"
+	"net"
+	"sync"
+)
+
+const (
+	// copyQueueLength is how many buffers a tunnel direction uses at most,
+	// which bounds how far its reads get ahead of writing them
+	copyQueueLength = 4
+
+	defaultMaxTunnelBufferSize = 256 << 10
+)
+
+// TunnelBufferOptions makes tunnels that aren't spliced copy with buffers that
+// adapt to their throughput: a direction starts with MinSize buffers, which
+// double up to MaxSize while reads keep filling them and halve again as
+// traffic slows, so that bulk transfers need fewer system calls while idle
+// and interactive tunnels hold on to little memory. Each direction uses up to
+// 4 buffers at a time. Buffers come from shared pools rather than from
+// BufferSource.
+type TunnelBufferOptions struct {
+	// MinSize is the initial and smallest buffer size, defaults to 4KB.
+	MinSize int
+
+	// MaxSize is the largest buffer size, defaults to 256KB.
+	MaxSize int
+}
+
+// copyBuffers provides the buffers for copying one direction of a tunnel.
+type copyBuffers interface {
+	// get returns a buffer for the next read
+	get() []byte
+
+	// put returns buf after it has been written, along with how much of it the
+	// read filled
+	put(buf []byte, n int)
+
+	// release gives up the buffers kept for reuse once copying is done
+	release()
+}
+
+// freeList keeps a few buffers at hand for reuse by one direction of a tunnel,
+// which avoids the allocation of putting slices into a sync.Pool for every
+// chunk. Buffers that don't fit go back to the pool.
+type freeList chan []byte
+
+func newFreeList() freeList {
+	return make(freeList, copyQueueLength)
+}
+
+func (fl freeList) get() ([]byte, bool) {
+	select {
+	case buf := <-fl:
+		return buf, true
+	default:
+		return nil, false
+	}
+}
+
+// drain passes the buffers in fl to put.
+func (fl freeList) drain(put func([]byte)) {
+	for {
+		buf, ok := fl.get()
+		if !ok {
+			return
+		}
+		put(buf)
+	}
+}
+
+func (fl freeList) put(buf []byte) bool {
+	select {
+	case fl <- buf:
+		return true
+	default:
+		return false
+	}
+}
+
+// fixedBuffers provides buffers from a BufferSource.
+type fixedBuffers struct {
+	source BufferSource
+	free   freeList
+}
+
+func newFixedBuffers(source BufferSource) *fixedBuffers {
+	return &fixedBuffers{source: source, free: newFreeList()}
+}
+
+func (fb *fixedBuffers) get() []byte {
+	if buf, ok := fb.free.get(); ok {
+		return buf
+	}
+	return fb.source.Get()
+}
+
+func (fb *fixedBuffers) put(buf []byte, n int) {
+	if !fb.free.put(buf) {
+		fb.source.Put(buf)
+	}
+}
+
+func (fb *fixedBuffers) release() {
+	fb.free.drain(fb.source.Put)
+}
+
+// adaptivePools pools adaptive buffers by size, indexed by the power of two.
+var adaptivePools [64]sync.Pool
+
+func getAdaptiveBuffer(size int) []byte {
+	if buf, ok := adaptivePools[bits.Len(uint(size))].Get().([]byte); ok {
+		return buf
+	}
+	return make([]byte, size)
+}
+
+func putAdaptiveBuffer(buf []byte) {
+	adaptivePools[bits.Len(uint(len(buf)))].Put(buf)
+}
+
+// adaptiveBuffers grows the buffers of a direction while reads fill them and
+// shrinks them when reads come back mostly empty.
+type adaptiveBuffers struct {
+	min, max int
+	// size is only accessed by the reading goroutine
+	size int
+	free freeList
+}
+
+func newAdaptiveBuffers(opts *TunnelBufferOptions) *adaptiveBuffers {
+	min, max := roundUpPowerOfTwo(opts.MinSize), roundUpPowerOfTwo(opts.MaxSize)
+	if opts.MinSize <= 0 {
+		min = defaultBufferSize
+	}
+	if opts.MaxSize <= 0 {
+		max = defaultMaxTunnelBufferSize
+	}
+	if max < min {
+		max = min
+	}
+	return &adaptiveBuffers{min: min, max: max, size: min, free: newFreeList()}
+}
+
+func (ab *adaptiveBuffers) get() []byte {
+	for {
+		buf, ok := ab.free.get()
+		if !ok {
+			return getAdaptiveBuffer(ab.size)
+		}
+		if len(buf) == ab.size {
+			return buf
+		}
+		// Left over from before the size changed
+		putAdaptiveBuffer(buf)
+	}
+}
+
+func (ab *adaptiveBuffers) put(buf []byte, n int) {
+	if !ab.free.put(buf) {
+		putAdaptiveBuffer(buf)
+	}
+}
+
+func (ab *adaptiveBuffers) release() {
+	ab.free.drain(putAdaptiveBuffer)
+}
+
+// adapt picks the size of the next buffer after a read of n bytes into a
+// buffer of size bytes.
+func (ab *adaptiveBuffers) adapt(size int, n int) {
+	switch {
+	case n == size && ab.size < ab.max:
+		ab.size *= 2
+	case n < size/4 && ab.size > ab.min:
+		ab.size /= 2
+	}
+}
+
+func roundUpPowerOfTwo(n int) int {
+	size := 1
+	for size < n {
+		size <<= 1
+	}
+	return size
+}
+
+// vectoredCopy copies from src to dst until src is done, like io.Copy. Reads
+// run ahead of writes, so that a slow write doesn't hold up the next read, and
+// whatever has been read by the time dst is ready is written at once as
+// net.Buffers, i.e. with writev(2) if dst is a plain TCP connection. It
+// returns when src reaches EOF (with a nil error) or either side fails, and
+// releases the buffers once the reads are done.
+func vectoredCopy(dst net.Conn, src io.Reader, buffers copyBuffers) (int64, error) {
+	chunks := make(chan []byte, copyQueueLength)
+	done := make(chan struct{})
+	inFlight := make(chan struct{}, copyQueueLength)
+	var readErr error
+	go func() {
+		defer close(chunks)
+		adaptive, _ := buffers.(*adaptiveBuffers)
+		for {
+			select {
+			case inFlight <- struct{}{}:
+			case <-done:
+				return
+			}
+			buf := buffers.get()
+			n, err := src.Read(buf)
+			if adaptive != nil {
+				adaptive.adapt(len(buf), n)
+			}
+			if n > 0 {
+				// Never blocks, since chunks has room for all buffers in flight
+				chunks <- buf[:n]
+			} else {
+				buffers.put(buf, 0)
+				<-inFlight
+			}
+			if err != nil {
+				if err != io.EOF {
+					readErr = err
+				}
+				return
+			}
+		}
+	}()
+
+	var written int64
+	batch := make([][]byte, 0, copyQueueLength)
+	// WriteTo consumes the slices it's given, so it gets a copy of batch
+	vecs := make([][]byte, 0, copyQueueLength)
+	var toWrite net.Buffers
+	for chunk := range chunks {
+		batch = append(batch[:0], chunk)
+	gather:
+		for len(batch) < copyQueueLength {
+			select {
+			case next, ok := <-chunks:
+				if !ok {
+					break gather
+				}
+				batch = append(batch, next)
+			default:
+				break gather
+			}
+		}
+		toWrite = append(vecs[:0], batch...)
+		n, err := toWrite.WriteTo(dst)
+		written += n
+		for _, b := range batch {
+			buffers.put(b[:cap(b)], len(b))
+			<-inFlight
+		}
+		if err != nil {
+			close(done)
+			// Return the buffers that the reader still queues
+			go func() {
+				for b := range chunks {
+					buffers.put(b[:cap(b)], len(b))
+					<-inFlight
+				}
+				buffers.release()
+			}()
+			return written, err
+		}
+	}
+	// chunks is closed, so the reader is done with readErr
+	buffers.release()
+	return written, readErr
+}
+
+// tunnelBuffers returns the buffers for copying one direction of a tunnel.
+func (proxy *proxy) tunnelBuffers() copyBuffers {
+	if proxy.TunnelBuffers != nil {
+		return newAdaptiveBuffers(proxy.TunnelBuffers)
+	}
+	return newFixedBuffers(proxy.BufferSource)
+}
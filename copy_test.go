@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(tb, err)
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(tb, err)
+	return conn, <-accepted
+}
+
+// readerOnly hides the io.WriterTo of a connection, like the wrappers that
+// keep tunnels from being spliced.
+type readerOnly struct {
+	io.Reader
+}
+
+func TestVectoredCopy(t *testing.T) {
+	data := make([]byte, 1<<20)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	for name, buffers := range map[string]func() copyBuffers{
+		"fixed": func() copyBuffers {
+			return newFixedBuffers(newProxy(&Opts{}).(*proxy).BufferSource)
+		},
+		"adaptive": func() copyBuffers {
+			return newAdaptiveBuffers(&TunnelBufferOptions{})
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dst, sink := tcpPair(t)
+			defer dst.Close()
+			defer sink.Close()
+			received := make(chan []byte)
+			go func() {
+				b, _ := ioutil.ReadAll(sink)
+				received <- b
+			}()
+
+			n, err := vectoredCopy(dst, readerOnly{bytes.NewReader(data)}, buffers())
+			require.NoError(t, err)
+			assert.EqualValues(t, len(data), n)
+			dst.(*net.TCPConn).CloseWrite()
+			assert.True(t, bytes.Equal(data, <-received), "Should copy data intact")
+		})
+	}
+}
+
+func TestVectoredCopyWriteError(t *testing.T) {
+	dst, sink := tcpPair(t)
+	sink.Close()
+	dst.Close()
+	_, err := vectoredCopy(dst, readerOnly{bytes.NewReader(make([]byte, 1<<20))}, newAdaptiveBuffers(&TunnelBufferOptions{}))
+	assert.Error(t, err)
+}
+
+// countingBufferSource counts the buffers that are taken from it and not put
+// back yet.
+type countingBufferSource struct {
+	out int32
+}
+
+func (bs *countingBufferSource) Get() []byte {
+	atomic.AddInt32(&bs.out, 1)
+	return make([]byte, defaultBufferSize)
+}
+
+func (bs *countingBufferSource) Put(buf []byte) {
+	atomic.AddInt32(&bs.out, -1)
+}
+
+func TestFixedBuffersReleased(t *testing.T) {
+	source := &countingBufferSource{}
+	dst, sink := tcpPair(t)
+	go ioutil.ReadAll(sink)
+	_, err := vectoredCopy(dst, readerOnly{bytes.NewReader(make([]byte, 1<<20))}, newFixedBuffers(source))
+	require.NoError(t, err)
+	assert.Zero(t, atomic.LoadInt32(&source.out), "All buffers should be returned once copying is done")
+	dst.Close()
+	sink.Close()
+
+	dst, sink = tcpPair(t)
+	sink.Close()
+	dst.Close()
+	_, err = vectoredCopy(dst, readerOnly{bytes.NewReader(make([]byte, 1<<20))}, newFixedBuffers(source))
+	assert.Error(t, err)
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&source.out) == 0
+	}, time.Second, 10*time.Millisecond, "All buffers should be returned after a failed write")
+}
+
+func TestAdaptiveBuffers(t *testing.T) {
+	ab := newAdaptiveBuffers(&TunnelBufferOptions{MinSize: 3000, MaxSize: 20000})
+	assert.Equal(t, 4096, ab.min, "Sizes should be rounded up to powers of two")
+	assert.Equal(t, 32768, ab.max)
+
+	for i := 0; i < 10; i++ {
+		buf := ab.get()
+		ab.adapt(len(buf), len(buf))
+		ab.put(buf, len(buf))
+	}
+	assert.Equal(t, ab.max, ab.size, "Should grow while reads fill buffers")
+	assert.Len(t, ab.get(), ab.max)
+
+	ab.adapt(ab.size, ab.size/2)
+	assert.Equal(t, ab.max, ab.size, "Should keep size while reads are reasonably full")
+
+	for i := 0; i < 10; i++ {
+		ab.adapt(ab.size, 10)
+	}
+	assert.Equal(t, ab.min, ab.size, "Should shrink when reads are small")
+
+	ab = newAdaptiveBuffers(&TunnelBufferOptions{})
+	assert.Equal(t, defaultBufferSize, ab.min)
+	assert.Equal(t, defaultMaxTunnelBufferSize, ab.max)
+}
+
+// benchmarkCopy measures copying between loopback TCP connections, where src
+// receives writes of chunkSize bytes.
+func benchmarkCopy(b *testing.B, chunkSize int, copy func(dst net.Conn, src io.Reader) error) {
+	in, src := tcpPair(b)
+	dst, sink := tcpPair(b)
+	defer src.Close()
+	defer dst.Close()
+	defer sink.Close()
+	go io.Copy(ioutil.Discard, sink)
+	go func() {
+		defer in.Close()
+		chunk := make([]byte, chunkSize)
+		for i := 0; i < b.N; i++ {
+			if _, err := in.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+
+	b.SetBytes(int64(chunkSize))
+	b.ReportAllocs()
+	b.ResetTimer()
+	if err := copy(dst, readerOnly{src}); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func benchmarkCopies(b *testing.B, chunkSize int) {
+	b.Run("CopyBuffer", func(b *testing.B) {
+		// Hide io.ReaderFrom too, so that the buffer is actually used
+		benchmarkCopy(b, chunkSize, func(dst net.Conn, src io.Reader) error {
+			_, err := io.CopyBuffer(struct{ io.Writer }{dst}, src, make([]byte, defaultBufferSize))
+			return err
+		})
+	})
+	b.Run("VectoredFixed", func(b *testing.B) {
+		buffers := newFixedBuffers(newProxy(&Opts{}).(*proxy).BufferSource)
+		benchmarkCopy(b, chunkSize, func(dst net.Conn, src io.Reader) error {
+			_, err := vectoredCopy(dst, src, buffers)
+			return err
+		})
+	})
+	b.Run("VectoredAdaptive", func(b *testing.B) {
+		benchmarkCopy(b, chunkSize, func(dst net.Conn, src io.Reader) error {
+			_, err := vectoredCopy(dst, src, newAdaptiveBuffers(&TunnelBufferOptions{}))
+			return err
+		})
+	})
+}
+
+func BenchmarkCopyBulk(b *testing.B) {
+	benchmarkCopies(b, 64<<10)
+}
+
+func BenchmarkCopyInteractive(b *testing.B) {
+	benchmarkCopies(b, 512)
+}
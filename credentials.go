@@ -0,0 +1,404 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+var (
+	// ErrTooManyFailedAttempts is returned by the CredentialStores of
+	// LimitFailedAttempts while a user is locked out.
+	ErrTooManyFailedAttempts = errors.New("Too many failed attempts")
+)
+
+// CredentialStore looks up and verifies the credentials of proxy users, see
+// CredentialAuth. Implementations must be safe for concurrent use.
+type CredentialStore interface {
+	// Lookup returns the password of username in the clear, for schemes like
+	// Digest that need it. ok is false if the user is unknown or if the store
+	// doesn't know passwords in the clear.
+	Lookup(ctx context.Context, username string) (password string, ok bool)
+
+	// Verify checks the password of username. It returns an error if the
+	// credentials couldn't be checked, for example because an external service
+	// is unavailable, in which case they're rejected too.
+	Verify(ctx context.Context, username string, password string) (bool, error)
+}
+
+// CredentialAuth returns an Authenticator for the Basic scheme that checks
+// usernames and passwords with store. The authenticated identity is the
+// username. For Digest, pass store's Lookup to DigestAuth instead.
+func CredentialAuth(realm string, store CredentialStore) Authenticator {
+	return &credentialAuth{realm, store}
+}
+
+type credentialAuth struct {
+	realm string
+	store CredentialStore
+}
+
+func (a *credentialAuth) Authenticate(ctx context.Context, req *http.Request) (string, bool) {
+	username, password, ok := proxyBasicAuth(req)
+	if !ok {
+		return "", false
+	}
+	verified, err := a.store.Verify(ctx, username, password)
+	if err != nil {
+		log.Debugf("Unable to verify credentials of %v: %v", username, err)
+		return "", false
+	}
+	if !verified {
+		return "", false
+	}
+	return username, true
+}
+
+func (a *credentialAuth) Challenges(req *http.Request) []string {
+	return []string{fmt.Sprintf("Basic realm=%q", a.realm)}
+}
+
+// StaticCredentials returns a CredentialStore for a fixed map of usernames to
+// passwords in the clear.
+func StaticCredentials(passwords map[string]string) CredentialStore {
+	copied := make(staticCredentials, len(passwords))
+	for username, password := range passwords {
+		copied[username] = password
+	}
+	return copied
+}
+
+type staticCredentials map[string]string
+
+func (sc staticCredentials) Lookup(ctx context.Context, username string) (string, bool) {
+	password, ok := sc[username]
+	return password, ok
+}
+
+func (sc staticCredentials) Verify(ctx context.Context, username string, password string) (bool, error) {
+	expected, ok := sc[username]
+	return ok && subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1, nil
+}
+
+// HtpasswdFile is a CredentialStore backed by a file in the format of Apache's
+// htpasswd, with one username:hash entry per line. Hashes may use MD5
+// ($apr1$, htpasswd -m) or SHA-1 ({SHA}, htpasswd -s). Since passwords aren't
+// known in the clear, Lookup always fails.
+type HtpasswdFile struct {
+	path    string
+	mx      sync.RWMutex
+	entries map[string]string
+}
+
+// LoadHtpasswd loads the htpasswd file at path. Call Reload to pick up
+// changes to the file.
+func LoadHtpasswd(path string) (*HtpasswdFile, error) {
+	f := &HtpasswdFile{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reloads the file, keeping the previous entries if it can't be read
+// or contains unsupported hashes.
+func (f *HtpasswdFile) Reload() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return errors.New("Unable to open htpasswd file %v: %v", f.path, err)
+	}
+	defer file.Close()
+	entries, err := parseHtpasswd(file)
+	if err != nil {
+		return errors.New("Unable to parse htpasswd file %v: %v", f.path, err)
+	}
+	f.mx.Lock()
+	f.entries = entries
+	f.mx.Unlock()
+	return nil
+}
+
+func parseHtpasswd(r io.Reader) (map[string]string, error) {
+	entries := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("Invalid entry on line %d", line)
+		}
+		hash := parts[1]
+		if !strings.HasPrefix(hash, "$apr1$") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, errors.New("Unsupported hash for %v on line %d, only MD5 ($apr1$) and SHA-1 ({SHA}) are supported", parts[0], line)
+		}
+		entries[parts[0]] = hash
+	}
+	return entries, scanner.Err()
+}
+
+// Lookup implements the interface CredentialStore
+func (f *HtpasswdFile) Lookup(ctx context.Context, username string) (string, bool) {
+	return "", false
+}
+
+// Verify implements the interface CredentialStore
+func (f *HtpasswdFile) Verify(ctx context.Context, username string, password string) (bool, error) {
+	f.mx.RLock()
+	hash, ok := f.entries[username]
+	f.mx.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	var computed string
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	} else {
+		salt := strings.TrimPrefix(hash, "$apr1$")
+		if i := strings.IndexByte(salt, '$'); i >= 0 {
+			salt = salt[:i]
+		}
+		computed = apr1(password, salt)
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1, nil
+}
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1 computes Apache's variant of the MD5-based crypt(3) hash.
+func apr1(password string, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+	alt := md5.Sum([]byte(password + salt + password))
+	h := md5.New()
+	h.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(alt[:])
+		} else {
+			h.Write(alt[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	final := h.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write(pw)
+		}
+		final = h.Sum(nil)
+	}
+
+	var encoded bytes.Buffer
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			encoded.WriteByte(cryptAlphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, group := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[group[0]])<<16|uint32(final[group[1]])<<8|uint32(final[group[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+	return magic + salt + "$" + encoded.String()
+}
+
+// HTTPCredentialVerifier returns a CredentialStore that verifies credentials
+// by POSTing them to url as a JSON object with "username" and "password".
+// A 2xx response means they're valid and a 401 or 403 that they aren't. client
+// defaults to an http.Client with a 10 second timeout. Lookup always fails.
+func HTTPCredentialVerifier(url string, client *http.Client) CredentialStore {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &httpCredentialVerifier{url, client}
+}
+
+type httpCredentialVerifier struct {
+	url    string
+	client *http.Client
+}
+
+func (v *httpCredentialVerifier) Lookup(ctx context.Context, username string) (string, bool) {
+	return "", false
+}
+
+func (v *httpCredentialVerifier) Verify(ctx context.Context, username string, password string) (bool, error) {
+	body, err := json.Marshal(map[string]string{"username": username, "password": password})
+	if err != nil {
+		return false, errors.New("Unable to encode credentials: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, v.url, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.New("Unable to create verification request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return false, errors.New("Unable to verify credentials at %v: %v", v.url, err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return true, nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return false, nil
+	default:
+		return false, errors.New("Unexpected response verifying credentials at %v: %v", v.url, resp.Status)
+	}
+}
+
+// LimitFailedAttempts returns a CredentialStore that verifies credentials with
+// store, but locks a username out for lockout once maxFailures attempts in a
+// row have failed for it from the same client IP (or, if the IP is unknown,
+// on the same connection). Meanwhile, Verify fails with
+// ErrTooManyFailedAttempts without consulting store, which slows down
+// password guessing. A successful attempt resets the count. Concurrent
+// attempts wait for each other rather than exceed maxFailures together.
+func LimitFailedAttempts(store CredentialStore, maxFailures int, lockout time.Duration) CredentialStore {
+	if maxFailures < 1 {
+		maxFailures = 1
+	}
+	s := &failureLimitedStore{
+		CredentialStore: store,
+		maxFailures:     maxFailures,
+		lockout:         lockout,
+		failures:        make(map[string]*failedAttempts),
+	}
+	s.attemptDone = sync.NewCond(&s.mx)
+	return s
+}
+
+type failureLimitedStore struct {
+	CredentialStore
+	maxFailures int
+	lockout     time.Duration
+
+	mx          sync.Mutex
+	attemptDone *sync.Cond
+	failures    map[string]*failedAttempts
+	lastSweep   time.Time
+}
+
+type failedAttempts struct {
+	count   int
+	pending int
+	last    time.Time
+}
+
+// failureKey identifies the attempts for username that count together, so
+// that clients can only lock out themselves. Without a client IP or
+// connection, as when used outside the proxy, they're counted per username.
+func failureKey(ctx context.Context, username string) string {
+	if ip := clientIPFromContext(ctx); ip != nil {
+		return username + "|" + ip.String()
+	}
+	if conn := clientConnFromContext(ctx); conn != nil {
+		return fmt.Sprintf("%v|conn %p", username, conn)
+	}
+	return username
+}
+
+func (s *failureLimitedStore) Verify(ctx context.Context, username string, password string) (bool, error) {
+	key := failureKey(ctx, username)
+	s.mx.Lock()
+	var attempts *failedAttempts
+	for {
+		now := time.Now()
+		s.sweep(now)
+		attempts = s.failures[key]
+		if attempts == nil || (attempts.pending == 0 && now.Sub(attempts.last) >= s.lockout) {
+			attempts = &failedAttempts{}
+			s.failures[key] = attempts
+		}
+		if attempts.count >= s.maxFailures {
+			s.mx.Unlock()
+			return false, ErrTooManyFailedAttempts
+		}
+		if attempts.count+attempts.pending < s.maxFailures {
+			break
+		}
+		// Pending attempts could use up the remaining ones
+		s.attemptDone.Wait()
+	}
+	attempts.pending++
+	s.mx.Unlock()
+
+	verified, err := s.CredentialStore.Verify(ctx, username, password)
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	defer s.attemptDone.Broadcast()
+	attempts.pending--
+	switch {
+	case verified:
+		attempts.count = 0
+	case err != nil:
+		// The credentials weren't necessarily wrong
+	default:
+		attempts.count++
+		attempts.last = time.Now()
+		if attempts.count == s.maxFailures {
+			log.Debugf("Locking out %v for %v after %d failed attempts", key, s.lockout, attempts.count)
+		}
+	}
+	if attempts.count == 0 && attempts.pending == 0 && s.failures[key] == attempts {
+		delete(s.failures, key)
+	}
+	return verified, err
+}
+
+// sweep forgets attempts that are no longer locked out, at most once per
+// lockout period.
+func (s *failureLimitedStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < s.lockout {
+		return
+	}
+	for k, attempts := range s.failures {
+		if attempts.pending == 0 && now.Sub(attempts.last) >= s.lockout {
+			delete(s.failures, k)
+		}
+	}
+	s.lastSweep = now
+}
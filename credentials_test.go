@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	ht "net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/mockconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPR1(t *testing.T) {
+	// From openssl passwd -apr1 -salt abcdefgh secret
+	assert.Equal(t, "$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/", apr1("secret", "abcdefgh"))
+}
+
+func TestHtpasswdFile(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	require.NoError(t, ioutil.WriteFile(path, []byte("# users\nmd5:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\nsha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0600))
+	store, err := LoadHtpasswd(path)
+	require.NoError(t, err)
+	for _, username := range []string{"md5", "sha"} {
+		verified, err := store.Verify(ctx, username, "secret")
+		require.NoError(t, err)
+		assert.True(t, verified, username)
+		verified, _ = store.Verify(ctx, username, "wrong")
+		assert.False(t, verified, username)
+	}
+	_, ok := store.Lookup(ctx, "md5")
+	assert.False(t, ok, "Passwords shouldn't be known in the clear")
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("bcrypt:$2y$05$abcdefghijklmnopqrstuv\n"), 0600))
+	assert.Error(t, store.Reload(), "Unsupported hashes should be rejected")
+	verified, _ := store.Verify(ctx, "md5", "secret")
+	assert.True(t, verified, "Failed reload should keep previous entries")
+	require.NoError(t, ioutil.WriteFile(path, []byte("sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0600))
+	require.NoError(t, store.Reload())
+	verified, _ = store.Verify(ctx, "md5", "secret")
+	assert.False(t, verified, "Removed user should be gone after reload")
+}
+
+func TestHTTPCredentialVerifier(t *testing.T) {
+	verifier := ht.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var credentials map[string]string
+		json.NewDecoder(req.Body).Decode(&credentials)
+		switch {
+		case credentials["username"] == "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case credentials["username"] != "user" || credentials["password"] != "pass":
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer verifier.Close()
+	store := HTTPCredentialVerifier(verifier.URL, verifier.Client())
+	ctx := context.Background()
+
+	verified, err := store.Verify(ctx, "user", "pass")
+	require.NoError(t, err)
+	assert.True(t, verified)
+	verified, err = store.Verify(ctx, "user", "wrong")
+	require.NoError(t, err)
+	assert.False(t, verified)
+	_, err = store.Verify(ctx, "broken", "pass")
+	assert.Error(t, err)
+}
+
+func TestLimitFailedAttempts(t *testing.T) {
+	ctx := context.Background()
+	store := LimitFailedAttempts(StaticCredentials(map[string]string{"user": "pass"}), 2, 100*time.Millisecond)
+	verified, err := store.Verify(ctx, "user", "wrong")
+	assert.False(t, verified)
+	assert.NoError(t, err)
+	verified, err = store.Verify(ctx, "user", "pass")
+	assert.True(t, verified, "Success should reset failed attempts")
+	assert.NoError(t, err)
+
+	store.Verify(ctx, "user", "wrong")
+	store.Verify(ctx, "user", "wrong")
+	verified, err = store.Verify(ctx, "user", "pass")
+	assert.False(t, verified, "User should be locked out")
+	assert.Equal(t, ErrTooManyFailedAttempts, err)
+	password, ok := store.Lookup(ctx, "user")
+	assert.True(t, ok)
+	assert.Equal(t, "pass", password)
+
+	time.Sleep(150 * time.Millisecond)
+	verified, err = store.Verify(ctx, "user", "pass")
+	assert.True(t, verified, "Lockout should expire")
+	assert.NoError(t, err)
+}
+
+func TestLimitFailedAttemptsPerClient(t *testing.T) {
+	store := LimitFailedAttempts(StaticCredentials(map[string]string{"user": "pass"}), 1, time.Minute)
+	clientCtx := func(remoteAddr net.Addr) context.Context {
+		return withClientConn(context.Background(), &fixedRemoteAddrConn{remoteAddr: remoteAddr})
+	}
+	attacker := clientCtx(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1})
+	store.Verify(attacker, "user", "wrong")
+	_, err := store.Verify(attacker, "user", "pass")
+	assert.Equal(t, ErrTooManyFailedAttempts, err)
+	verified, err := store.Verify(clientCtx(&net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1}), "user", "pass")
+	assert.NoError(t, err)
+	assert.True(t, verified, "Other clients shouldn't be locked out")
+
+	// Without an IP, attempts count per connection
+	unknown := clientCtx(&net.UnixAddr{Name: "@", Net: "unix"})
+	store.Verify(unknown, "user", "wrong")
+	_, err = store.Verify(unknown, "user", "pass")
+	assert.Equal(t, ErrTooManyFailedAttempts, err)
+	verified, err = store.Verify(clientCtx(&net.UnixAddr{Name: "@", Net: "unix"}), "user", "pass")
+	assert.NoError(t, err)
+	assert.True(t, verified, "Other connections shouldn't be locked out")
+	verified, _ = store.Verify(context.Background(), "user", "pass")
+	assert.True(t, verified)
+}
+
+func TestLimitFailedAttemptsConcurrent(t *testing.T) {
+	var mx sync.Mutex
+	verified := 0
+	slow := &verifyingStore{verify: func(username, password string) bool {
+		time.Sleep(10 * time.Millisecond)
+		mx.Lock()
+		verified++
+		mx.Unlock()
+		return false
+	}}
+	store := LimitFailedAttempts(slow, 3, time.Minute)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store.Verify(context.Background(), "user", "guess")
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 3, verified, "Concurrent guesses shouldn't get past maxFailures")
+}
+
+type verifyingStore struct {
+	verify func(username, password string) bool
+}
+
+func (s *verifyingStore) Lookup(ctx context.Context, username string) (string, bool) {
+	return "", false
+}
+
+func (s *verifyingStore) Verify(ctx context.Context, username, password string) (bool, error) {
+	return s.verify(username, password), nil
+}
+
+func TestCredentialAuth(t *testing.T) {
+	d := mockconn.SucceedingDialer([]byte{})
+	p := newProxy(&Opts{
+		OKWaitsForUpstream: true,
+		Authenticator:      CredentialAuth("test", StaticCredentials(map[string]string{"user": "pass"})),
+		Dial: func(ctx context.Context, isConnect bool, net, addr string) (net.Conn, error) {
+			return d.Dial(net, addr)
+		},
+	})
+
+	req, _ := http.NewRequest(http.MethodConnect, "http://thehost:123", nil)
+	resp, _, _ := roundTrip(p, req, true)
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	assert.Equal(t, `Basic realm="test"`, resp.Header.Get("Proxy-Authenticate"))
+
+	req.SetBasicAuth("user", "pass")
+	req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+	resp, _, handleErr := roundTrip(p, req, true)
+	assert.NoError(t, handleErr)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "thehost:123", d.LastDialed())
+}
+
+type clientIPRecordingAuth struct {
+	ips chan net.IP
+}
+
+func (a *clientIPRecordingAuth) Authenticate(ctx context.Context, req *http.Request) (string, bool) {
+	a.ips <- clientIPFromContext(ctx)
+	return "", false
+}
+
+func (a *clientIPRecordingAuth) Challenges(req *http.Request) []string {
+	return nil
+}
+
+func TestAuthenticationKnowsClientIP(t *testing.T) {
+	auth := &clientIPRecordingAuth{make(chan net.IP, 10)}
+	p := newProxy(&Opts{Authenticator: auth})
+
+	socks, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer socks.Close()
+	go p.ServeSOCKS5(socks)
+	conn, err := net.Dial("tcp", socks.Addr().String())
+	require.NoError(t, err)
+	conn.Write([]byte{socks5Version, 1, socksAuthPassword, socksPasswordVersion, 1, 'u', 1, 'p'})
+	assert.Equal(t, "127.0.0.1", (<-auth.ips).String(), "SOCKS5 authentication should know the client IP")
+	conn.Close()
+
+	fast, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer fast.Close()
+	go p.ServeCONNECT(fast)
+	conn, err = net.Dial("tcp", fast.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nProxy-Authorization: Basic dTpw\r\n\r\n"))
+	assert.Equal(t, "127.0.0.1", (<-auth.ips).String(), "HandleCONNECT authentication should know the client IP")
+}
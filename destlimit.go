@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+)
+
+// destinationLimiter limits the number of concurrent tunnels and requests to
+// each destination host.
+type destinationLimiter struct {
+	limit        int
+	queueTimeout time.Duration
+	metrics      Metrics
+	mx           sync.Mutex
+	hosts        map[string]*destinationSlots
+}
+
+// destinationSlots are the slots for one host, which are dropped once nothing
+// holds or waits for them anymore.
+type destinationSlots struct {
+	slots chan struct{}
+	refs  int
+}
+
+func (proxy *proxy) initDestinationLimit() {
+	if proxy.DestinationConcurrencyLimit <= 0 {
+		return
+	}
+	proxy.destinationLimiter = &destinationLimiter{
+		limit:        proxy.DestinationConcurrencyLimit,
+		queueTimeout: proxy.ConcurrencyQueueTimeout,
+		metrics:      proxy.Metrics,
+		hosts:        make(map[string]*destinationSlots),
+	}
+	proxy.Filter = filters.Join(proxy.Filter, filters.FilterFunc(proxy.limitDestinations))
+}
+
+// destinationHost returns the host that addr (host or host:port) is limited
+// as.
+func destinationHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// acquire waits up to queueTimeout for a free slot for host, returning a
+// function that releases the slot (safe to call multiple times), or nil if no
+// slot became available.
+func (l *destinationLimiter) acquire(ctx context.Context, host string) func() {
+	l.mx.Lock()
+	ds := l.hosts[host]
+	if ds == nil {
+		ds = &destinationSlots{slots: make(chan struct{}, l.limit)}
+		l.hosts[host] = ds
+	}
+	ds.refs++
+	l.mx.Unlock()
+
+	select {
+	case ds.slots <- struct{}{}:
+		return l.releaser(host, ds)
+	default:
+	}
+	if l.queueTimeout <= 0 {
+		l.unref(host, ds)
+		l.metrics.DestinationLimited(host, false)
+		return nil
+	}
+	l.metrics.DestinationLimited(host, true)
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case ds.slots <- struct{}{}:
+		return l.releaser(host, ds)
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	l.unref(host, ds)
+	l.metrics.DestinationLimited(host, false)
+	return nil
+}
+
+func (l *destinationLimiter) releaser(host string, ds *destinationSlots) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-ds.slots
+			l.unref(host, ds)
+		})
+	}
+}
+
+func (l *destinationLimiter) unref(host string, ds *destinationSlots) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	ds.refs--
+	if ds.refs <= 0 {
+		delete(l.hosts, host)
+	}
+}
+
+func (l *destinationLimiter) snapshot() map[string]int {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	result := make(map[string]int, len(l.hosts))
+	for host, ds := range l.hosts {
+		if inUse := len(ds.slots); inUse > 0 {
+			result[host] = inUse
+		}
+	}
+	return result
+}
+
+// limitDestinations is a filter that responds 503 Service Unavailable to
+// requests once DestinationConcurrencyLimit tunnels and requests to their
+// host are in progress. For CONNECT, the slot is held until the tunnel
+// finishes, for other requests until the response body is closed. Requests
+// in MITM'ed tunnels are already counted with their CONNECT.
+func (proxy *proxy) limitDestinations(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+	if ctx.IsMITMing() {
+		return next(ctx, req)
+	}
+	addr := req.URL.Host
+	if addr == "" {
+		addr = req.Host
+	}
+	host := destinationHost(addr)
+	release := proxy.destinationLimiter.acquire(ctx, host)
+	if release == nil {
+		log.Debugf("Too many concurrent connections to %v, rejecting %v %v", host, req.Method, addr)
+		filters.Discard(ctx, req)
+		return filters.ShortCircuit(ctx, req, &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Header:     http.Header{"Retry-After": []string{strconv.Itoa(retryAfterSeconds(proxy.ConcurrencyQueueTimeout))}},
+		})
+	}
+	if req.Method == http.MethodConnect {
+		return holdUntilTunnelDone(release, next)(ctx, req)
+	}
+	resp, nextCtx, err := next(ctx, req)
+	if resp == nil || resp.Body == nil {
+		release()
+	} else {
+		resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	}
+	return resp, nextCtx, err
+}
+
+// acquireDestination acquires a slot for the destination of a tunnel that
+// doesn't pass through the HTTP filter chain.
+func (proxy *proxy) acquireDestination(ctx context.Context) (func(), error) {
+	host := destinationHost(upstreamAddr(ctx))
+	release := proxy.destinationLimiter.acquire(ctx, host)
+	if release == nil {
+		return nil, &PolicyDeniedError{Phase: PhaseAdmission, Policy: PolicyDestinationConcurrencyLimit, Err: errors.New("Too many concurrent connections to %v", host)}
+	}
+	return release, nil
+}
+
+// ActiveConnectionsByDestination implements the interface Proxy
+func (proxy *proxy) ActiveConnectionsByDestination() map[string]int {
+	if proxy.destinationLimiter == nil {
+		return map[string]int{}
+	}
+	return proxy.destinationLimiter.snapshot()
+}
+
+// releasingBody is a response body that releases a destination slot once it's
+// closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (rb *releasingBody) Close() error {
+	err := rb.ReadCloser.Close()
+	rb.release()
+	return err
+}
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	ht "net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newHoldingServer serves connections that stay open until hangUp is closed.
+func newHoldingServer(t *testing.T) (l net.Listener, hangUp chan interface{}) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	hangUp = make(chan interface{})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				<-hangUp
+				conn.Close()
+			}()
+		}
+	}()
+	return l, hangUp
+}
+
+func TestDestinationHost(t *testing.T) {
+	assert.Equal(t, "example.com", destinationHost("Example.COM.:443"))
+	assert.Equal(t, "example.com", destinationHost("example.com"))
+	assert.Equal(t, "::1", destinationHost("[::1]:80"))
+}
+
+func TestDestinationLimiterQueue(t *testing.T) {
+	metrics := NewPrometheusMetrics("proxy")
+	l := &destinationLimiter{limit: 1, queueTimeout: 5 * time.Second, metrics: metrics, hosts: make(map[string]*destinationSlots)}
+	release := l.acquire(context.Background(), "a")
+	require.NotNil(t, release)
+	otherRelease := l.acquire(context.Background(), "b")
+	require.NotNil(t, otherRelease, "Other hosts should have their own slots")
+	assert.Equal(t, map[string]int{"a": 1, "b": 1}, l.snapshot())
+
+	acquired := make(chan func())
+	go func() {
+		acquired <- l.acquire(context.Background(), "a")
+	}()
+	time.Sleep(50 * time.Millisecond)
+	release()
+	release()
+	queuedRelease := <-acquired
+	require.NotNil(t, queuedRelease, "Queued acquire should get the released slot")
+	queuedRelease()
+	otherRelease()
+	assert.Empty(t, l.hosts, "Unused hosts should be dropped")
+
+	var buf bytes.Buffer
+	metrics.WriteTo(&buf)
+	assert.Contains(t, buf.String(), `proxy_destination_limited_total{result="queued"} 1`)
+	assert.Contains(t, buf.String(), `proxy_destination_limited_total{result="rejected"} 0`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	release = l.acquire(ctx, "a")
+	cancel()
+	assert.Nil(t, l.acquire(ctx, "a"), "Cancelled acquire should give up")
+	release()
+	assert.Empty(t, l.hosts)
+}
+
+func TestDestinationConcurrencyLimit(t *testing.T) {
+	origin, hangUp := newHoldingServer(t)
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(origin.Addr().String())
+
+	metrics := NewPrometheusMetrics("proxy")
+	p := newProxy(&Opts{
+		OKWaitsForUpstream:          true,
+		DestinationConcurrencyLimit: 1,
+		Metrics:                     metrics,
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go p.Serve(l)
+
+	first, _, resp := openTunnel(t, l.Addr().String(), "127.0.0.1:"+port)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, map[string]int{"127.0.0.1": 1}, p.ActiveConnectionsByDestination())
+
+	second, _, resp := openTunnel(t, l.Addr().String(), "127.0.0.1:"+port)
+	second.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "Tunnel beyond the destination's limit should be rejected")
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	other, _, resp := openTunnel(t, l.Addr().String(), "localhost:"+port)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Other destinations shouldn't be limited")
+
+	var buf bytes.Buffer
+	metrics.WriteTo(&buf)
+	assert.Contains(t, buf.String(), `proxy_destination_limited_total{result="rejected"} 1`)
+
+	// The slots are released once the tunnels finish
+	first.Close()
+	other.Close()
+	close(hangUp)
+	require.Eventually(t, func() bool {
+		return len(p.ActiveConnectionsByDestination()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestDestinationConcurrencyLimitHTTP(t *testing.T) {
+	arrived := make(chan interface{}, 1)
+	respond := make(chan interface{})
+	origin := ht.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		arrived <- nil
+		<-respond
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+	p := newProxy(&Opts{DestinationConcurrencyLimit: 1})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go p.Serve(l)
+
+	first := make(chan int)
+	go func() {
+		resp, err := proxiedRequest(t, l.Addr().String(), http.MethodGet, origin.URL)
+		if err != nil {
+			first <- 0
+			return
+		}
+		first <- resp.StatusCode
+	}()
+	<-arrived
+
+	resp, err := proxiedRequest(t, l.Addr().String(), http.MethodGet, origin.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "Request beyond the destination's limit should be rejected")
+
+	close(respond)
+	assert.Equal(t, http.StatusOK, <-first)
+	require.Eventually(t, func() bool {
+		return len(p.ActiveConnectionsByDestination()) == 0
+	}, 5*time.Second, 10*time.Millisecond, "Slot should be released once the response is written")
+
+	resp, err = proxiedRequest(t, l.Addr().String(), http.MethodGet, origin.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestDestinationConcurrencyLimitSOCKS(t *testing.T) {
+	origin, hangUp := newHoldingServer(t)
+	defer origin.Close()
+	defer close(hangUp)
+
+	p := newProxy(&Opts{DestinationConcurrencyLimit: 1})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go p.ServeSOCKS5(l)
+
+	dial := ChainDial(nil, &Upstream{Protocol: UpstreamSOCKS5, Addr: l.Addr().String()})
+	first, err := dial(context.Background(), true, "tcp", origin.Addr().String())
+	require.NoError(t, err)
+	defer first.Close()
+	_, err = dial(context.Background(), true, "tcp", origin.Addr().String())
+	assert.Error(t, err, "SOCKS tunnel beyond the destination's limit should be rejected")
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+// dialUpstream dials upstream using the configured DialFunc, recording dial
+// metrics and metering and throttling the resulting connection.
+func (proxy *proxy) dialUpstream(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+	setOriginalAddr(ctx, addr)
+	if proxy.Rewriter != nil {
+		rewritten, err := proxy.Rewriter.Rewrite(ctx, addr)
+		if err != nil {
+			return nil, errors.New("Unable to rewrite %v: %v", addr, err)
+		}
+		if rewritten != addr {
+			log.Tracef("Rewrote %v to %v", addr, rewritten)
+			addr = rewritten
+		}
+	}
+	if proxy.NetworkRouter != nil {
+		routedNetwork, routedAddr, err := proxy.NetworkRouter.RouteNetwork(ctx, network, addr)
+		if err != nil {
+			return nil, errors.New("Unable to route %v: %v", addr, err)
+		}
+		if routedNetwork != network || routedAddr != addr {
+			log.Tracef("Routed %v to %v over %v", addr, routedAddr, routedNetwork)
+			network, addr = routedNetwork, routedAddr
+		}
+	}
+	if proxy.CircuitBreaker != nil {
+		if err := proxy.CircuitBreaker.allow(addr); err != nil {
+			return nil, &DialError{Addr: addr, Phase: PhaseDial, Err: errors.New("Unable to dial %v: %v", addr, err)}
+		}
+	}
+	cacheFailures := proxy.dialFailures != nil && !isRetry(ctx)
+	if cacheFailures {
+		if err := proxy.dialFailures.check(network, addr); err != nil {
+			return nil, err
+		}
+	}
+	var conn net.Conn
+	if proxy.warm != nil && isCONNECT && network == "tcp" {
+		conn = proxy.warm.take(addr)
+	}
+	if conn != nil {
+		log.Tracef("Using prewarmed connection to %v", addr)
+	} else {
+		start := time.Now()
+		spanCtx, span := proxy.Tracer.StartSpan(ctx, SpanDial)
+		span.SetAttribute("net.peer.name", addr)
+		var err error
+		conn, err = proxy.dialResolved(spanCtx, isCONNECT, network, addr)
+		endSpan(span, err)
+		latency := time.Since(start)
+		proxy.Metrics.UpstreamDialed(addr, isCONNECT, latency, err)
+		proxy.EventListener.UpstreamDialed(ctx, network, addr, conn, latency, err)
+		if proxy.CircuitBreaker != nil {
+			proxy.CircuitBreaker.record(addr, err)
+		}
+		proxy.dialHealth.record(err)
+		if proxy.SLO != nil && isCONNECT {
+			proxy.SLO.record(ctx, addr, latency, err == nil)
+		}
+		if cacheFailures {
+			proxy.dialFailures.record(ctx, network, addr, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rl := proxy.currentConfig().RateLimiter; rl != nil {
+		conn = rl.wrap(ctx, conn)
+	}
+	if proxy.BandwidthLimit != nil {
+		conn = proxy.BandwidthLimit.wrap(conn)
+	}
+	if proxy.Metrics != noopMetrics {
+		conn = &meteredConn{conn, proxy.Metrics}
+	}
+	return conn, nil
+}
+
+// dialResolved resolves addr if necessary and dials the resulting address,
+// falling back to alternate addresses if so configured.
+func (proxy *proxy) dialResolved(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, proxy.dialTimeout())
+	defer cancel()
+	dial := ruleDial(ctx)
+	if dial == nil {
+		dial = proxy.currentConfig().Dial
+	}
+	addrs := []string{addr}
+	var err error
+	var resolveTime time.Duration
+	if isIPNetwork(network) {
+		start := time.Now()
+		addrs, err = proxy.resolveAddr(dialCtx, addr)
+		if err != nil {
+			return nil, dialError(addr, PhaseResolve, err)
+		}
+		if len(addrs) != 1 || addrs[0] != addr {
+			// addr was actually looked up
+			resolveTime = time.Since(start)
+		}
+	}
+	failed, _ := ctx.Value(ctxKeyFailedAddrs).(*failedAddrs)
+	if failed != nil {
+		addrs = failed.without(addrs)
+	}
+	if !proxy.TryAlternateAddrs {
+		addrs = addrs[:1]
+	}
+
+	connectStart := time.Now()
+	for i, resolved := range addrs {
+		attemptCtx, cancelAttempt := dialCtx, noopCancel
+		if proxy.DialAttemptTimeout > 0 {
+			attemptCtx, cancelAttempt = context.WithTimeout(dialCtx, proxy.DialAttemptTimeout)
+		}
+		var conn net.Conn
+		conn, err = dial(attemptCtx, isCONNECT, network, resolved)
+		cancelAttempt()
+		if err == nil {
+			setDialedAddr(ctx, resolved)
+			if timings := harTimingsFrom(ctx); timings != nil {
+				timings.recordDial(resolveTime, time.Since(connectStart))
+			}
+			return conn, nil
+		}
+		if failed != nil {
+			failed.add(resolved)
+		}
+		if dialCtx.Err() != nil {
+			break
+		}
+		if i < len(addrs)-1 {
+			log.Debugf("Unable to dial %v at %v, trying next address: %v", addr, resolved, err)
+		}
+	}
+	return nil, dialError(addr, PhaseDial, err)
+}
+
+// DialedAddr returns the address that was most recently dialed upstream for the
+// connection associated with ctx. When hostnames are resolved by the proxy
+// (see Resolver and TryAlternateAddrs), this is the IP:port that succeeded.
+func DialedAddr(ctx context.Context) string {
+	holder, ok := ctx.Value(ctxKeyDialedAddr).(*atomic.Value)
+	if !ok {
+		return ""
+	}
+	addrs, _ := holder.Load().(dialedAddrs)
+	return addrs.dialed
+}
+
+// OriginalAddr returns the destination that was requested for the most recent
+// upstream dial of the connection associated with ctx, before it was changed
+// by Opts.Rewriter. Without a Rewriter, this is simply the requested
+// destination.
+func OriginalAddr(ctx context.Context) string {
+	holder, ok := ctx.Value(ctxKeyDialedAddr).(*atomic.Value)
+	if !ok {
+		return ""
+	}
+	addrs, _ := holder.Load().(dialedAddrs)
+	return addrs.original
+}
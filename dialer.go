@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"net"
+)
+
+// Dialer dials connections without a context. It matches
+// golang.org/x/net/proxy.Dialer, so dialers from that package (and DialFunc)
+// can be used interchangeably with it.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// ContextDialer dials connections with a context. It matches
+// golang.org/x/net/proxy.ContextDialer and is implemented by *net.Dialer.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// DialFuncFor adapts dialer to a DialFunc, for example to dial through a
+// SOCKS5 proxy from golang.org/x/net/proxy. If dialer is a ContextDialer, its
+// DialContext is used. Otherwise a canceled context abandons the pending Dial,
+// closing the connection if it still succeeds.
+func DialFuncFor(dialer Dialer) DialFunc {
+	if contextDialer, ok := dialer.(ContextDialer); ok {
+		return DialContextFunc(contextDialer.DialContext)
+	}
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		done := ctx.Done()
+		if done == nil {
+			return dialer.Dial(network, addr)
+		}
+		type result struct {
+			conn net.Conn
+			err  error
+		}
+		results := make(chan result, 1)
+		go func() {
+			conn, err := dialer.Dial(network, addr)
+			results <- result{conn, err}
+		}()
+		select {
+		case r := <-results:
+			return r.conn, r.err
+		case <-done:
+			go func() {
+				if r := <-results; r.conn != nil {
+					r.conn.Close()
+				}
+			}()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// DialContextFunc adapts a dial function like (*net.Dialer).DialContext to a
+// DialFunc, which ignores isCONNECT.
+func DialContextFunc(dial func(ctx context.Context, network, addr string) (net.Conn, error)) DialFunc {
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		return dial(ctx, network, addr)
+	}
+}
+
+// Dial implements the interface Dialer, which makes dial usable as a
+// golang.org/x/net/proxy.Dialer, e.g. to share a dialer from ChainDial with
+// other packages. Connections are dialed like for CONNECT requests.
+func (dial DialFunc) Dial(network, addr string) (net.Conn, error) {
+	return dial(context.Background(), true, network, addr)
+}
+
+// DialContext implements the interface ContextDialer, see Dial.
+func (dial DialFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dial(ctx, true, network, addr)
+}
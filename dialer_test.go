@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// plainDialer only implements Dialer.
+type plainDialer struct {
+	delay  time.Duration
+	closed chan net.Conn
+}
+
+func (d *plainDialer) Dial(network, addr string) (net.Conn, error) {
+	time.Sleep(d.delay)
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &closeNotifyingConn{Conn: conn, closed: d.closed}, nil
+}
+
+type closeNotifyingConn struct {
+	net.Conn
+	closed chan net.Conn
+}
+
+func (conn *closeNotifyingConn) Close() error {
+	conn.closed <- conn
+	return conn.Conn.Close()
+}
+
+func TestDialFuncFor(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	conn, err := DialFuncFor(&net.Dialer{})(context.Background(), true, "tcp", origin.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+
+	dialer := &plainDialer{closed: make(chan net.Conn, 1)}
+	conn, err = DialFuncFor(dialer)(context.Background(), false, "tcp", origin.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+	<-dialer.closed
+
+	dialer.delay = 250 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = DialFuncFor(dialer)(ctx, true, "tcp", origin.Addr().String())
+	assert.Equal(t, context.DeadlineExceeded, err)
+	select {
+	case <-dialer.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connection dialed after cancellation should be closed")
+	}
+}
+
+func TestDialFuncAsDialer(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	var dialedCONNECT bool
+	var dial DialFunc = func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		dialedCONNECT = isCONNECT
+		return net.Dial(network, addr)
+	}
+	var dialer Dialer = dial
+	conn, err := dialer.Dial("tcp", origin.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+	assert.True(t, dialedCONNECT)
+
+	var contextDialer ContextDialer = ChainDial(nil)
+	conn, err = contextDialer.DialContext(context.Background(), "tcp", origin.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+var (
+	// ErrRecentlyFailed is the cause of errors dialing destinations that
+	// failed to resolve or dial within the last DialFailureTTL.
+	ErrRecentlyFailed = errors.New("Recently failed")
+)
+
+// dialFailureCache remembers destinations (network and host:port) that
+// recently failed to resolve or dial, so that new tunnels and requests to them
+// fail immediately instead of waiting on the dial timeout again.
+type dialFailureCache struct {
+	ttl      time.Duration
+	mx       sync.Mutex
+	failures map[string]*dialFailure
+}
+
+type dialFailure struct {
+	err     error
+	expires time.Time
+}
+
+func (proxy *proxy) initDialFailureCache() {
+	if proxy.DialFailureTTL <= 0 {
+		return
+	}
+	proxy.dialFailures = &dialFailureCache{
+		ttl:      proxy.DialFailureTTL,
+		failures: make(map[string]*dialFailure),
+	}
+}
+
+// check returns an error wrapping the cached failure if network and addr
+// failed within the TTL.
+func (c *dialFailureCache) check(network, addr string) error {
+	key := network + "|" + addr
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	failure := c.failures[key]
+	if failure == nil {
+		return nil
+	}
+	if time.Now().After(failure.expires) {
+		delete(c.failures, key)
+		return nil
+	}
+	phase := PhaseDial
+	if dialErr := asDialError(failure.err); dialErr != nil {
+		phase = dialErr.Phase
+	}
+	return &DialError{Addr: addr, Phase: phase, Err: errors.New("Unable to dial %v: %v: %v", addr, ErrRecentlyFailed, failure.err)}
+}
+
+// record caches err for network and addr, or forgets about earlier failures
+// if err is nil. Failures due to ctx being done, e.g. because the client went
+// away, say nothing about the destination and aren't cached, nor are dials
+// that were denied by policy.
+func (c *dialFailureCache) record(ctx context.Context, network, addr string, err error) {
+	if err != nil && (ctx.Err() != nil || causedBy(err, isPolicyDenied)) {
+		return
+	}
+	key := network + "|" + addr
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if err == nil {
+		delete(c.failures, key)
+		return
+	}
+	now := time.Now()
+	for k, failure := range c.failures {
+		if now.After(failure.expires) {
+			delete(c.failures, k)
+		}
+	}
+	log.Debugf("Caching failure to dial %v for %v: %v", addr, c.ttl, err)
+	c.failures[key] = &dialFailure{err: err, expires: now.Add(c.ttl)}
+}
+
+func isPolicyDenied(err error) bool {
+	_, ok := err.(*PolicyDeniedError)
+	return ok
+}
+
+func asDialError(err error) *DialError {
+	var dialErr *DialError
+	causedBy(err, func(cause error) bool {
+		dialErr, _ = cause.(*DialError)
+		return dialErr != nil
+	})
+	return dialErr
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialFailureTTL(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	var dials, down int32
+	down = 1
+	l := serveProxy(t, &Opts{
+		OKWaitsForUpstream: true,
+		DialFailureTTL:     100 * time.Millisecond,
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			if atomic.LoadInt32(&down) == 1 {
+				return nil, errors.New("connection refused")
+			}
+			return net.Dial(network, addr)
+		},
+	})
+	defer l.Close()
+
+	connect := func() int {
+		conn, _, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+		conn.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusBadGateway, connect())
+	assert.Equal(t, http.StatusBadGateway, connect())
+	assert.EqualValues(t, 1, atomic.LoadInt32(&dials), "Recently failed destination should not have been dialed")
+
+	// Once the failure expires, the destination is dialed again
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, connect())
+	assert.Equal(t, http.StatusOK, connect())
+	assert.EqualValues(t, 3, atomic.LoadInt32(&dials))
+}
+
+func TestDialFailureCache(t *testing.T) {
+	c := &dialFailureCache{ttl: time.Minute, failures: make(map[string]*dialFailure)}
+	ctx := context.Background()
+	c.record(ctx, "tcp", "a:80", dialError("a:80", PhaseResolve, errors.New("no such host")))
+	err := c.check("tcp", "a:80")
+	assert.True(t, errors.Is(err, &DialError{Addr: "a:80", Phase: PhaseResolve}), "Cached failure should keep its phase")
+	assert.True(t, causedBy(err, func(cause error) bool { return cause == ErrRecentlyFailed }))
+	assert.NoError(t, c.check("udp", "a:80"), "Failures should be cached per network")
+	c.record(ctx, "tcp", "a:80", nil)
+	assert.NoError(t, c.check("tcp", "a:80"), "Success should forget the failure")
+
+	c.record(ctx, "tcp", "b:80", dialError("b:80", PhaseDial, ErrBlocked))
+	assert.NoError(t, c.check("tcp", "b:80"), "Policy denials shouldn't be cached")
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	c.record(cancelled, "tcp", "b:80", dialError("b:80", PhaseDial, context.Canceled))
+	assert.NoError(t, c.check("tcp", "b:80"), "Failures of cancelled dials shouldn't be cached")
+}
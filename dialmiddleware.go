@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+// DialMiddleware wraps a DialFunc to add behavior around dialing, the way
+// HTTP middleware wraps an http.Handler. See WrapDial and Opts.DialMiddleware.
+type DialMiddleware func(DialFunc) DialFunc
+
+// WrapDial wraps dial in middleware, the first of which is outermost, i.e.
+// sees each dial first. If dial is nil, destinations are dialed directly.
+func WrapDial(dial DialFunc, middleware ...DialMiddleware) DialFunc {
+	if dial == nil {
+		dial = directDial
+	}
+	for i := len(middleware) - 1; i >= 0; i-- {
+		dial = middleware[i](dial)
+	}
+	return dial
+}
+
+// LogDials logs every dial along with how long it took and its error, if any,
+// at debug level.
+func LogDials() DialMiddleware {
+	return func(dial DialFunc) DialFunc {
+		return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			start := time.Now()
+			conn, err := dial(ctx, isCONNECT, network, addr)
+			if err != nil {
+				log.Debugf("Unable to dial %v %v after %v: %v", network, addr, time.Since(start), err)
+			} else {
+				log.Debugf("Dialed %v %v in %v", network, addr, time.Since(start))
+			}
+			return conn, err
+		}
+	}
+}
+
+// RetryDials retries failed dials up to retries times, waiting backoff before
+// the first retry and twice as long before each one after. Dials aren't
+// retried once their context is done or if they were refused by policy, see
+// PolicyDeniedError and ErrBlocked.
+func RetryDials(retries int, backoff time.Duration) DialMiddleware {
+	return func(dial DialFunc) DialFunc {
+		return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			wait := backoff
+			for attempt := 0; ; attempt++ {
+				conn, err := dial(ctx, isCONNECT, network, addr)
+				if err == nil || attempt == retries || ctx.Err() != nil || isRefused(err) {
+					return conn, err
+				}
+				log.Debugf("Retrying dial to %v after failed attempt %d: %v", addr, attempt+1, err)
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return nil, err
+				}
+				wait *= 2
+			}
+		}
+	}
+}
+
+// isRefused indicates whether err is a dial being refused by policy.
+func isRefused(err error) bool {
+	return causedBy(err, func(cause error) bool {
+		_, denied := cause.(*PolicyDeniedError)
+		return denied || cause == ErrBlocked
+	})
+}
+
+// TimeoutDials limits how long each dial may take.
+func TimeoutDials(timeout time.Duration) DialMiddleware {
+	return func(dial DialFunc) DialFunc {
+		return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			conn, err := dial(ctx, isCONNECT, network, addr)
+			if err != nil && ctx.Err() == context.DeadlineExceeded {
+				return nil, &TimeoutError{Addr: addr, Phase: PhaseDial, Err: errors.New("Unable to dial %v within %v: %v", addr, timeout, err)}
+			}
+			return conn, err
+		}
+	}
+}
+
+// MeterDials reports every dial to metrics as Metrics.UpstreamDialed, for
+// DialFuncs used outside a proxy, which reports the dials of Opts.Dial
+// itself.
+func MeterDials(metrics Metrics) DialMiddleware {
+	return func(dial DialFunc) DialFunc {
+		return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			start := time.Now()
+			conn, err := dial(ctx, isCONNECT, network, addr)
+			metrics.UpstreamDialed(addr, isCONNECT, time.Since(start), err)
+			return conn, err
+		}
+	}
+}
+
+// RestrictDials only dials destinations that ac allows, refusing the others
+// with ErrBlocked. With access controls like AllowDomains and AllowPorts, it
+// implements an allowlist. ac sees the IP of the client that the dial is for,
+// if known.
+func RestrictDials(ac AccessControl) DialMiddleware {
+	return func(dial DialFunc) DialFunc {
+		return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			dest, err := parseDestination(addr, 0)
+			if err == nil {
+				err = ac.Check(ctx, clientIPFromContext(ctx), dest)
+			}
+			if err != nil {
+				// ErrBlocked needs to come first to be the cause
+				return nil, errors.New("Unable to dial %v: %v: %v", addr, ErrBlocked, err.Error())
+			}
+			return dial(ctx, isCONNECT, network, addr)
+		}
+	}
+}
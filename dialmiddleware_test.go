@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"context"
+	stderrors "errors"
+	"net"
+	"net/http"
+	ht "net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrapDialOrder(t *testing.T) {
+	var order []string
+	tag := func(name string) DialMiddleware {
+		return func(dial DialFunc) DialFunc {
+			return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+				order = append(order, name)
+				return dial(ctx, isCONNECT, network, addr)
+			}
+		}
+	}
+	dial := WrapDial(func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		order = append(order, "dial")
+		return nil, errors.New("failed")
+	}, tag("outer"), tag("inner"))
+	dial(context.Background(), true, "tcp", "example.com:443")
+	assert.Equal(t, []string{"outer", "inner", "dial"}, order)
+}
+
+func TestRetryDials(t *testing.T) {
+	var attempts int32
+	failing := func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&attempts, 1)
+		return nil, errors.New("failed")
+	}
+	_, err := WrapDial(failing, RetryDials(2, time.Millisecond))(context.Background(), true, "tcp", "example.com:443")
+	assert.Error(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+
+	atomic.StoreInt32(&attempts, 0)
+	blocked := func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&attempts, 1)
+		return BlockDial(ctx, isCONNECT, network, addr)
+	}
+	_, err = WrapDial(blocked, RetryDials(2, time.Millisecond))(context.Background(), true, "tcp", "example.com:443")
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&attempts), "Refused dials shouldn't be retried")
+
+	origin, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer origin.Close()
+	atomic.StoreInt32(&attempts, 0)
+	flaky := func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			return nil, errors.New("failed")
+		}
+		return net.Dial(network, addr)
+	}
+	conn, err := WrapDial(flaky, RetryDials(2, time.Millisecond))(context.Background(), true, "tcp", origin.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestTimeoutDials(t *testing.T) {
+	hanging := func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	_, err := WrapDial(hanging, TimeoutDials(10*time.Millisecond))(context.Background(), true, "tcp", "example.com:443")
+	var timeoutErr *TimeoutError
+	require.True(t, stderrors.As(err, &timeoutErr))
+	assert.Equal(t, PhaseDial, timeoutErr.Phase)
+}
+
+func TestMeterDials(t *testing.T) {
+	metrics := &recordingMetrics{}
+	WrapDial(BlockDial, MeterDials(metrics))(context.Background(), true, "tcp", "example.com:443")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&metrics.dials))
+}
+
+// recordingMetrics counts dials.
+type recordingMetrics struct {
+	nullMetrics
+	dials int32
+}
+
+func (m *recordingMetrics) UpstreamDialed(addr string, isCONNECT bool, latency time.Duration, err error) {
+	atomic.AddInt32(&m.dials, 1)
+}
+
+func TestRestrictDials(t *testing.T) {
+	origin := ht.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer origin.Close()
+	l := serveProxy(t, &Opts{OKWaitsForUpstream: true, DialMiddleware: []DialMiddleware{LogDials(), RestrictDials(AllowPorts(1))}})
+	defer l.Close()
+	conn, _, resp := openTunnel(t, l.Addr().String(), origin.Listener.Addr().String())
+	conn.Close()
+	assert.NotEqual(t, http.StatusOK, resp.StatusCode, "Dials outside the allowlist should be refused")
+
+	_, err := WrapDial(nil, RestrictDials(AllowPorts(1)))(context.Background(), true, "tcp", origin.Listener.Addr().String())
+	assert.True(t, stderrors.Is(err, ErrBlocked))
+	conn, err = WrapDial(nil, RestrictDials(AllowPorts(1)))(context.Background(), true, "tcp", "localhost:1")
+	if err == nil {
+		conn.Close()
+	}
+	assert.False(t, stderrors.Is(err, ErrBlocked), "Allowed destinations should be dialed")
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsHeaderLen     = 12
+	dnsFlagRD        = 0x0100
+	dnsRcodeMask     = 0x000f
+	dnsRcodeNXDomain = 3
+)
+
+// buildDNSQuery builds a recursive DNS query message for host. The ID is 0 as
+// recommended for DNS over HTTPS.
+func buildDNSQuery(host string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, dnsHeaderLen, dnsHeaderLen+len(host)+6)
+	binary.BigEndian.PutUint16(msg[2:], dnsFlagRD)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, errors.New("Invalid hostname %v", host)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(msg[len(msg)-4:], qtype)
+	binary.BigEndian.PutUint16(msg[len(msg)-2:], dnsClassIN)
+	return msg, nil
+}
+
+// parseDNSResponse extracts the A and AAAA records from a DNS response message.
+func parseDNSResponse(host string, msg []byte) ([]net.IPAddr, error) {
+	if len(msg) < dnsHeaderLen {
+		return nil, errors.New("DNS response for %v too short", host)
+	}
+	rcode := binary.BigEndian.Uint16(msg[2:]) & dnsRcodeMask
+	if rcode == dnsRcodeNXDomain {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if rcode != 0 {
+		return nil, errors.New("DNS query for %v failed with rcode %d", host, rcode)
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+
+	offset := dnsHeaderLen
+	var err error
+	for i := 0; i < qdcount; i++ {
+		if offset, err = skipDNSName(msg, offset); err != nil {
+			return nil, err
+		}
+		offset += 4
+	}
+
+	var ips []net.IPAddr
+	for i := 0; i < ancount; i++ {
+		if offset, err = skipDNSName(msg, offset); err != nil {
+			return nil, err
+		}
+		if offset+10 > len(msg) {
+			return nil, errors.New("Truncated DNS answer for %v", host)
+		}
+		rtype := binary.BigEndian.Uint16(msg[offset:])
+		rdlength := int(binary.BigEndian.Uint16(msg[offset+8:]))
+		offset += 10
+		if offset+rdlength > len(msg) {
+			return nil, errors.New("Truncated DNS answer for %v", host)
+		}
+		rdata := msg[offset : offset+rdlength]
+		offset += rdlength
+		if (rtype == dnsTypeA && rdlength == net.IPv4len) || (rtype == dnsTypeAAAA && rdlength == net.IPv6len) {
+			ips = append(ips, net.IPAddr{IP: net.IP(append([]byte(nil), rdata...))})
+		}
+	}
+	return ips, nil
+}
+
+// skipDNSName returns the offset just past the (possibly compressed) name
+// starting at offset.
+func skipDNSName(msg []byte, offset int) (int, error) {
+	for {
+		if offset >= len(msg) {
+			return 0, errors.New("Truncated DNS name")
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			return offset + 1, nil
+		case length&0xc0 == 0xc0:
+			// compression pointer, which ends the name
+			return offset + 2, nil
+		default:
+			offset += 1 + length
+		}
+	}
+}
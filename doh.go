@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+)
+
+const (
+	dohAnswerTTL = 60 * time.Second
+
+	dnsFlagQR        = 0x8000
+	dnsFlagRA        = 0x0080
+	dnsOpcodeMask    = 0x7800
+	dnsRcodeServFail = 2
+	dnsRcodeFormErr  = 1
+	dnsRcodeNotImp   = 4
+	dnsNamePointer   = 0xc00c
+)
+
+// dohFilter returns a filter that answers DNS over HTTPS (RFC 8484) queries
+// sent to the proxy itself at DoHPath, resolving them with Resolver.
+func (proxy *proxy) dohFilter() filters.Filter {
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		if req.Method == http.MethodConnect || req.URL.Host != "" || ctx.IsMITMing() || req.URL.Path != proxy.DoHPath {
+			return next(ctx, req)
+		}
+		query, status, err := readDoHQuery(req)
+		if err != nil {
+			log.Debugf("Rejecting DoH request: %v", err)
+			return filters.Fail(ctx, req, status, err)
+		}
+		answer := proxy.answerDNS(ctx, query)
+		header := make(http.Header)
+		header.Set("Content-Type", dnsMessageContentType)
+		header.Set("Cache-Control", "max-age="+strconv.Itoa(int(dohAnswerTTL/time.Second)))
+		return filters.ShortCircuit(ctx, req, &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        header,
+			Body:          ioutil.NopCloser(bytes.NewReader(answer)),
+			ContentLength: int64(len(answer)),
+		})
+	})
+}
+
+// readDoHQuery reads the DNS query from a GET request's dns parameter or a
+// POST request's body, returning the status to respond with on failure.
+func readDoHQuery(req *http.Request) ([]byte, int, error) {
+	var query []byte
+	switch req.Method {
+	case http.MethodGet:
+		encoded := req.URL.Query().Get("dns")
+		if encoded == "" {
+			return nil, http.StatusBadRequest, errors.New("Missing dns parameter")
+		}
+		var err error
+		query, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+		if err != nil {
+			return nil, http.StatusBadRequest, errors.New("Invalid dns parameter: %v", err)
+		}
+	case http.MethodPost:
+		if contentType := req.Header.Get("Content-Type"); contentType != dnsMessageContentType {
+			return nil, http.StatusUnsupportedMediaType, errors.New("Unsupported content type %v", contentType)
+		}
+		var err error
+		query, err = ioutil.ReadAll(io.LimitReader(req.Body, maxDNSMessageSize))
+		if err != nil {
+			return nil, http.StatusBadRequest, errors.New("Unable to read query: %v", err)
+		}
+	default:
+		return nil, http.StatusMethodNotAllowed, errors.New("Unsupported method %v", req.Method)
+	}
+	if len(query) < dnsHeaderLen {
+		return nil, http.StatusBadRequest, errors.New("DNS query too short")
+	}
+	return query, 0, nil
+}
+
+// answerDNS builds the response to a DNS query. Only A and AAAA queries are
+// supported, since that's all a Resolver can answer.
+func (proxy *proxy) answerDNS(ctx context.Context, query []byte) []byte {
+	flags := binary.BigEndian.Uint16(query[2:])
+	qdcount := binary.BigEndian.Uint16(query[4:])
+	nameEnd, err := skipDNSName(query, dnsHeaderLen)
+	if qdcount != 1 || err != nil || nameEnd+4 > len(query) || flags&dnsFlagQR != 0 {
+		return dnsResponse(query, dnsHeaderLen, dnsRcodeFormErr, nil)
+	}
+	questionEnd := nameEnd + 4
+	qtype := binary.BigEndian.Uint16(query[nameEnd:])
+	qclass := binary.BigEndian.Uint16(query[nameEnd+2:])
+	if flags&dnsOpcodeMask != 0 || qclass != dnsClassIN || (qtype != dnsTypeA && qtype != dnsTypeAAAA) {
+		return dnsResponse(query, questionEnd, dnsRcodeNotImp, nil)
+	}
+	host, err := dnsName(query, dnsHeaderLen)
+	if err != nil {
+		return dnsResponse(query, dnsHeaderLen, dnsRcodeFormErr, nil)
+	}
+
+	ips, err := proxy.lookupIPs(ctx, host)
+	if err != nil {
+		log.Debugf("Unable to resolve %v for DoH client: %v", host, err)
+		rcode := dnsRcodeServFail
+		if causedBy(err, isNotFound) {
+			rcode = dnsRcodeNXDomain
+		}
+		return dnsResponse(query, questionEnd, uint16(rcode), nil)
+	}
+	var answers [][]byte
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && qtype == dnsTypeA {
+			answers = append(answers, ip4)
+		} else if ip4 == nil && qtype == dnsTypeAAAA {
+			answers = append(answers, ip.To16())
+		}
+	}
+	return dnsResponse(query, questionEnd, 0, answers)
+}
+
+// dnsResponse builds a response to query that repeats its question (which
+// ends at questionEnd, or is left out if that's the end of the header) and
+// answers it with the given A or AAAA record data.
+func dnsResponse(query []byte, questionEnd int, rcode uint16, answers [][]byte) []byte {
+	msg := make([]byte, questionEnd, questionEnd+len(answers)*(12+net.IPv6len))
+	copy(msg, query[:questionEnd])
+	flags := binary.BigEndian.Uint16(query[2:])
+	flags = dnsFlagQR | flags&(dnsOpcodeMask|dnsFlagRD) | dnsFlagRA | rcode
+	binary.BigEndian.PutUint16(msg[2:], flags)
+	qdcount := uint16(1)
+	if questionEnd == dnsHeaderLen {
+		qdcount = 0
+	}
+	binary.BigEndian.PutUint16(msg[4:], qdcount)
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint32(msg[8:], 0)
+	for _, rdata := range answers {
+		rtype := uint16(dnsTypeA)
+		if len(rdata) == net.IPv6len {
+			rtype = dnsTypeAAAA
+		}
+		var rr [12]byte
+		binary.BigEndian.PutUint16(rr[0:], dnsNamePointer)
+		binary.BigEndian.PutUint16(rr[2:], rtype)
+		binary.BigEndian.PutUint16(rr[4:], dnsClassIN)
+		binary.BigEndian.PutUint32(rr[6:], uint32(dohAnswerTTL/time.Second))
+		binary.BigEndian.PutUint16(rr[10:], uint16(len(rdata)))
+		msg = append(msg, rr[:]...)
+		msg = append(msg, rdata...)
+	}
+	return msg
+}
+
+// dnsName decodes the uncompressed name starting at offset.
+func dnsName(msg []byte, offset int) (string, error) {
+	var labels []string
+	for {
+		if offset >= len(msg) {
+			return "", errors.New("Truncated DNS name")
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if len(labels) == 0 {
+				return "", errors.New("Empty DNS name")
+			}
+			return strings.Join(labels, "."), nil
+		case length&0xc0 != 0:
+			return "", errors.New("Unexpected compression in DNS question")
+		case offset+1+length > len(msg):
+			return "", errors.New("Truncated DNS name")
+		}
+		labels = append(labels, string(msg[offset+1:offset+1+length]))
+		offset += 1 + length
+	}
+}
+
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
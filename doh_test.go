@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoH(t *testing.T) {
+	l := serveProxy(t, &Opts{
+		DoHPath: "/dns-query",
+		Resolver: ResolverFunc(func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			if host != "example.com" {
+				return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+			}
+			return []net.IPAddr{{IP: net.ParseIP("1.2.3.4")}, {IP: net.ParseIP("2001:db8::1")}}, nil
+		}),
+	})
+	defer l.Close()
+	dohURL := "http://" + l.Addr().String() + "/dns-query"
+
+	// Resolving through the proxy with POST queries
+	tr := &http.Transport{}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+	ips, err := NewDoHResolver(dohURL, client).LookupIPAddr(context.Background(), "example.com")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"1.2.3.4", "2001:db8::1"}, []string{ips[0].IP.String(), ips[1].IP.String()})
+
+	_, err = NewDoHResolver(dohURL, client).LookupIPAddr(context.Background(), "unknown.com")
+	assert.True(t, causedBy(err, isNotFound), "Expected NXDOMAIN, got %v", err)
+
+	get := func(query []byte) (*http.Response, []byte) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		req, _ := http.NewRequest(http.MethodGet, dohURL+"?dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+		require.NoError(t, req.Write(conn))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		require.NoError(t, err)
+		msg, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, msg
+	}
+
+	query, err := buildDNSQuery("example.com", dnsTypeA)
+	require.NoError(t, err)
+	binary.BigEndian.PutUint16(query, 1234)
+	resp, msg := get(query)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, dnsMessageContentType, resp.Header.Get("Content-Type"))
+	assert.Equal(t, uint16(1234), binary.BigEndian.Uint16(msg), "Response should keep the query's ID")
+	ips, err = parseDNSResponse("example.com", msg)
+	require.NoError(t, err)
+	if assert.Len(t, ips, 1) {
+		assert.Equal(t, "1.2.3.4", ips[0].IP.String())
+	}
+
+	txtQuery, err := buildDNSQuery("example.com", 16)
+	require.NoError(t, err)
+	_, msg = get(txtQuery)
+	assert.Equal(t, uint16(dnsRcodeNotImp), binary.BigEndian.Uint16(msg[2:])&dnsRcodeMask)
+
+	resp, _ = get([]byte("short"))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestAnswerDNSRejectsMalformedQueries(t *testing.T) {
+	p := newProxy(&Opts{}).(*proxy)
+	query, err := buildDNSQuery("example.com", dnsTypeA)
+	require.NoError(t, err)
+
+	truncated := query[:len(query)-3]
+	msg := p.answerDNS(context.Background(), truncated)
+	assert.Equal(t, uint16(dnsRcodeFormErr), binary.BigEndian.Uint16(msg[2:])&dnsRcodeMask)
+	assert.Equal(t, uint16(0), binary.BigEndian.Uint16(msg[4:]), "Unparseable question shouldn't be repeated")
+	assert.Len(t, msg, dnsHeaderLen)
+
+	response := append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(response[2:], dnsFlagQR)
+	msg = p.answerDNS(context.Background(), response)
+	assert.Equal(t, uint16(dnsRcodeFormErr), binary.BigEndian.Uint16(msg[2:])&dnsRcodeMask)
+}
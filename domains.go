@@ -1,8 +1,30 @@
 package proxy
 
 import (
+	"bufio"
+	"io"
+	"net"
+	"net/http/cookiejar"
+	"os"
 	"regexp"
 	"strings"
+	"sync/atomic"
+
+	"github.com/getlantern/errors"
+)
+
+var (
+	// hostsFileIgnored are the names that hosts files typically map to
+	// themselves, which shouldn't become rules
+	hostsFileIgnored = map[string]bool{
+		"localhost":             true,
+		"localhost.localdomain": true,
+		"local":                 true,
+		"broadcasthost":         true,
+		"ip6-localhost":         true,
+		"ip6-loopback":          true,
+		"0.0.0.0":               true,
+	}
 )
 
 func domainToRegex(domain string) (*regexp.Regexp, error) {
@@ -14,3 +36,194 @@ func domainToRegex(domain string) (*regexp.Regexp, error) {
 	}
 	return regexp.Compile("^" + strings.Join(parts, "\\."))
 }
+
+// DomainMatcher matches hostnames against a set of rules, for example to
+// block or allow destinations with DenyDomains and AllowDomains. Rules can be
+// replaced at any time, which takes effect atomically. Supported rules are:
+//
+//	example.com    matches example.com only
+//	*.example.com  matches subdomains of example.com, but not example.com
+//	.example.com   matches example.com and its subdomains
+//	example.*      matches example under any public suffix (e.g. example.com
+//	               and example.co.uk) and its subdomains
+//
+// Matching is case insensitive. The zero value matches nothing.
+type DomainMatcher struct {
+	// PublicSuffixes determines the public suffixes for rules like example.*,
+	// e.g. golang.org/x/net/publicsuffix.List. If nil, only the last label of
+	// a hostname is considered its public suffix.
+	PublicSuffixes cookiejar.PublicSuffixList
+
+	rules atomic.Value
+}
+
+type domainRules struct {
+	exact      map[string]bool
+	subdomains map[string]bool
+	anySuffix  map[string]bool
+	count      int
+}
+
+// NewDomainMatcher creates a DomainMatcher with the given rules.
+func NewDomainMatcher(rules ...string) (*DomainMatcher, error) {
+	m := &DomainMatcher{}
+	if err := m.Set(rules...); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Set replaces the rules of this matcher. If any rule is invalid, the current
+// rules stay in effect.
+func (m *DomainMatcher) Set(rules ...string) error {
+	parsed := &domainRules{
+		exact:      make(map[string]bool),
+		subdomains: make(map[string]bool),
+		anySuffix:  make(map[string]bool),
+	}
+	for _, rule := range rules {
+		if err := parsed.add(rule); err != nil {
+			return err
+		}
+	}
+	m.rules.Store(parsed)
+	return nil
+}
+
+// Load replaces the rules of this matcher with the ones read from r, which
+// is in hosts file format: each line either maps an IP to one or more
+// hostnames (the IP is ignored) or lists rules directly. Comments start with #.
+func (m *DomainMatcher) Load(r io.Reader) error {
+	var rules []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if comment := strings.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+		for _, field := range fields {
+			if !hostsFileIgnored[strings.ToLower(field)] {
+				rules = append(rules, field)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.New("Unable to read domain rules: %v", err)
+	}
+	return m.Set(rules...)
+}
+
+// LoadFile replaces the rules of this matcher with the ones in the given file,
+// see Load.
+func (m *DomainMatcher) LoadFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.New("Unable to open domain rules %v: %v", file, err)
+	}
+	defer f.Close()
+	return m.Load(f)
+}
+
+// Len returns the number of rules.
+func (m *DomainMatcher) Len() int {
+	return m.current().count
+}
+
+// Match indicates whether host matches any of the rules.
+func (m *DomainMatcher) Match(host string) bool {
+	rules := m.current()
+	if rules.count == 0 {
+		return false
+	}
+	host = normalizeDomain(host)
+	if rules.exact[host] {
+		return true
+	}
+	for parent := host; ; {
+		dot := strings.IndexByte(parent, '.')
+		if dot < 0 {
+			break
+		}
+		parent = parent[dot+1:]
+		if rules.subdomains[parent] {
+			return true
+		}
+	}
+	if len(rules.anySuffix) > 0 && net.ParseIP(host) == nil {
+		if name := m.registrableName(host); name != "" && rules.anySuffix[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// registrableName returns the label of host just in front of its public
+// suffix, e.g. example for www.example.co.uk.
+func (m *DomainMatcher) registrableName(host string) string {
+	suffix := ""
+	if m.PublicSuffixes != nil {
+		suffix = m.PublicSuffixes.PublicSuffix(host)
+	} else if dot := strings.LastIndexByte(host, '.'); dot >= 0 {
+		suffix = host[dot+1:]
+	}
+	if suffix == "" || len(host) <= len(suffix)+1 || !strings.HasSuffix(host, "."+suffix) {
+		return ""
+	}
+	name := host[:len(host)-len(suffix)-1]
+	if dot := strings.LastIndexByte(name, '.'); dot >= 0 {
+		name = name[dot+1:]
+	}
+	return name
+}
+
+func (m *DomainMatcher) current() *domainRules {
+	rules, _ := m.rules.Load().(*domainRules)
+	if rules == nil {
+		return &domainRules{}
+	}
+	return rules
+}
+
+func (rules *domainRules) add(original string) error {
+	rule := normalizeDomain(original)
+	switch {
+	case strings.HasPrefix(rule, "*."):
+		rule = rule[2:]
+		if !validDomainRule(rule) {
+			return errors.New("Invalid domain rule %v", original)
+		}
+		rules.subdomains[rule] = true
+	case strings.HasPrefix(rule, "."):
+		rule = rule[1:]
+		if !validDomainRule(rule) {
+			return errors.New("Invalid domain rule %v", original)
+		}
+		rules.exact[rule] = true
+		rules.subdomains[rule] = true
+	case strings.HasSuffix(rule, ".*"):
+		rule = rule[:len(rule)-2]
+		if rule == "" || strings.ContainsAny(rule, ".*") {
+			return errors.New("Invalid domain rule %v, expected a single label before .*", original)
+		}
+		rules.anySuffix[rule] = true
+	default:
+		if !validDomainRule(rule) {
+			return errors.New("Invalid domain rule %v", original)
+		}
+		rules.exact[rule] = true
+	}
+	rules.count++
+	return nil
+}
+
+func validDomainRule(domain string) bool {
+	return domain != "" && !strings.Contains(domain, "*") && !strings.HasPrefix(domain, ".") && !strings.Contains(domain, "..")
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
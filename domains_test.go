@@ -1,9 +1,11 @@
 package proxy
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDomains(t *testing.T) {
@@ -32,3 +34,65 @@ func TestDomains(t *testing.T) {
 	assert.True(t, d2.MatchString("other.youtube.com"))
 	assert.False(t, d3.MatchString("other.youtube.com"))
 }
+
+type testSuffixes map[string]bool
+
+func (s testSuffixes) PublicSuffix(domain string) string {
+	for suffix := domain; suffix != ""; {
+		if s[suffix] {
+			return suffix
+		}
+		dot := strings.IndexByte(suffix, '.')
+		if dot < 0 {
+			break
+		}
+		suffix = suffix[dot+1:]
+	}
+	return domain[strings.LastIndexByte(domain, '.')+1:]
+}
+
+func (s testSuffixes) String() string {
+	return "test"
+}
+
+func TestDomainMatcher(t *testing.T) {
+	m, err := NewDomainMatcher("exact.com", "*.sub.com", ".both.com", "brand.*")
+	require.NoError(t, err)
+	m.PublicSuffixes = testSuffixes{"co.uk": true}
+	assert.Equal(t, 4, m.Len())
+
+	matches := []string{"exact.com", "EXACT.com.", "a.sub.com", "a.b.sub.com", "both.com", "www.both.com", "brand.com", "brand.co.uk", "www.brand.co.uk"}
+	for _, host := range matches {
+		assert.True(t, m.Match(host), host)
+	}
+	misses := []string{"www.exact.com", "sub.com", "notboth.com", "brand.evil.com", "brand", "co.uk", "1.2.3.4"}
+	for _, host := range misses {
+		assert.False(t, m.Match(host), host)
+	}
+
+	for _, invalid := range []string{"*.", "a.*.com", "a..com", "*.*", "a.b.*"} {
+		assert.Error(t, m.Set(invalid), invalid)
+	}
+	assert.True(t, m.Match("exact.com"), "Invalid rules should leave current rules in effect")
+
+	assert.False(t, (&DomainMatcher{}).Match("exact.com"), "Zero value should match nothing")
+}
+
+func TestDomainMatcherLoad(t *testing.T) {
+	m := &DomainMatcher{}
+	require.NoError(t, m.Load(strings.NewReader(`# blocklist
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.com # inline comment
+::1 ip6-localhost
+*.doubleclick.net
+`)))
+	assert.Equal(t, 3, m.Len())
+	assert.True(t, m.Match("ads.example.com"))
+	assert.True(t, m.Match("tracker.example.com"))
+	assert.True(t, m.Match("x.doubleclick.net"))
+	assert.False(t, m.Match("localhost"))
+	assert.False(t, m.Match("example.com"))
+
+	assert.Error(t, m.LoadFile("does-not-exist"))
+	assert.Equal(t, 3, m.Len())
+}
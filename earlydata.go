@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"io"
+	"net"
+
+	"github.com/getlantern/errors"
+)
+
+// earlyDataResult is the outcome of reading early data.
+type earlyDataResult struct {
+	n   int
+	err error
+}
+
+// earlyData reads what the client of a tunnel sends while upstream is still
+// being dialed, after it was already told OK.
+type earlyData struct {
+	src     io.Reader
+	source  BufferSource
+	buf     []byte
+	result  chan earlyDataResult
+	pending []byte
+	err     error
+	done    bool
+}
+
+// readEarlyData starts reading from src in the background.
+func (proxy *proxy) readEarlyData(src io.Reader) *earlyData {
+	ed := &earlyData{
+		src:    src,
+		source: proxy.BufferSource,
+		buf:    proxy.BufferSource.Get(),
+		result: make(chan earlyDataResult, 1),
+	}
+	go func() {
+		n, err := src.Read(ed.buf)
+		ed.result <- earlyDataResult{n, err}
+	}()
+	return ed
+}
+
+// flush writes the early data to the now dialed upstream if the client has
+// sent any by now. If it hasn't, nothing is waited for, so that protocols in
+// which the server speaks first keep working. In that case, the returned
+// reader replaces src, picking up the read that's still in progress.
+// Otherwise, it's nil and src can be read from as usual.
+func (ed *earlyData) flush(upstream net.Conn) (io.Reader, error) {
+	select {
+	case r := <-ed.result:
+		defer ed.source.Put(ed.buf)
+		if r.n > 0 {
+			if _, err := upstream.Write(ed.buf[:r.n]); err != nil {
+				return nil, errors.New("Unable to write early data upstream: %v", err)
+			}
+		}
+		if r.err != nil {
+			// The client is done already, so read the error again from src
+			log.Debugf("Error reading early data: %v", r.err)
+		}
+		return nil, nil
+	default:
+		return ed, nil
+	}
+}
+
+// Read returns the data of the pending read first and then reads from src.
+func (ed *earlyData) Read(b []byte) (int, error) {
+	if !ed.done {
+		r := <-ed.result
+		ed.done = true
+		ed.pending, ed.err = ed.buf[:r.n], r.err
+	}
+	if len(ed.pending) > 0 {
+		n := copy(b, ed.pending)
+		ed.pending = ed.pending[n:]
+		if len(ed.pending) == 0 && ed.buf != nil {
+			ed.source.Put(ed.buf)
+			ed.buf = nil
+		}
+		return n, nil
+	}
+	if ed.buf != nil {
+		ed.source.Put(ed.buf)
+		ed.buf = nil
+	}
+	if ed.err != nil {
+		return 0, ed.err
+	}
+	return ed.src.Read(b)
+}
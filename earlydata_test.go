@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCONNECTEarlyData(t *testing.T) {
+	for name, serve := range map[string]func(p Proxy, l net.Listener) error{
+		"Serve":        Proxy.Serve,
+		"ServeCONNECT": Proxy.ServeCONNECT,
+	} {
+		t.Run(name, func(t *testing.T) {
+			origin, err := net.Listen("tcp", "localhost:0")
+			require.NoError(t, err)
+			defer origin.Close()
+			firstRead := make(chan string, 1)
+			go func() {
+				conn, err := origin.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				b := make([]byte, 100)
+				n, _ := conn.Read(b)
+				firstRead <- string(b[:n])
+				conn.Write(b[:n])
+			}()
+
+			dialing := make(chan interface{})
+			dial := make(chan interface{})
+			p := newProxy(&Opts{
+				CONNECTEarlyData: true,
+				Dial: func(ctx context.Context, isConnect bool, network, addr string) (net.Conn, error) {
+					close(dialing)
+					<-dial
+					return net.Dial(network, addr)
+				},
+			})
+			l, err := net.Listen("tcp", "localhost:0")
+			require.NoError(t, err)
+			defer l.Close()
+			go serve(p, l)
+
+			conn, br, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+			defer conn.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			<-dialing
+			// The client speaks before upstream is connected
+			_, err = conn.Write([]byte("hello "))
+			require.NoError(t, err)
+			time.Sleep(50 * time.Millisecond)
+			close(dial)
+			assert.Equal(t, "hello ", <-firstRead, "Early data should be written upstream at once")
+			echoed := make([]byte, 6)
+			_, err = io.ReadFull(br, echoed)
+			require.NoError(t, err)
+			assert.Equal(t, "hello ", string(echoed))
+		})
+	}
+}
+
+func TestCONNECTEarlyDataServerFirst(t *testing.T) {
+	origin, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer origin.Close()
+	go func() {
+		conn, err := origin.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("220 "))
+		b := make([]byte, 4)
+		io.ReadFull(conn, b)
+		conn.Write(b)
+	}()
+
+	l := serveProxy(t, &Opts{CONNECTEarlyData: true})
+	conn, br, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+	defer conn.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	greeting := make([]byte, 4)
+	_, err = io.ReadFull(br, greeting)
+	require.NoError(t, err)
+	assert.Equal(t, "220 ", string(greeting), "Servers that speak first shouldn't wait for the client")
+	_, err = conn.Write([]byte("EHLO"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(br, greeting)
+	require.NoError(t, err)
+	assert.Equal(t, "EHLO", string(greeting))
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"context"
+	"hash/fnv"
+	"net"
+	"sync/atomic"
+
+	"github.com/getlantern/errors"
+)
+
+// EgressStrategy determines how an EgressPool picks the local IP that a dial
+// originates from.
+type EgressStrategy int
+
+const (
+	// EgressRoundRobin uses each IP in turn
+	EgressRoundRobin EgressStrategy = iota
+
+	// EgressPerDestination always uses the same IP for a given destination
+	// host
+	EgressPerDestination
+
+	// EgressPerClient always uses the same IP for a given client, identified
+	// like for ClientTunnelQuota
+	EgressPerClient
+)
+
+// EgressOpts configures an EgressPool.
+type EgressOpts struct {
+	// IPs are the local IPs to dial from. They must be assigned to the host.
+	IPs []net.IP
+
+	// Strategy is how IPs are picked, defaults to EgressRoundRobin.
+	Strategy EgressStrategy
+
+	// DialerOptions, if specified, tunes the dialed sockets. Its LocalAddr is
+	// ignored.
+	DialerOptions *DialerOptions
+}
+
+// EgressPool binds upstream dials to local IPs from a pool, so that traffic
+// leaves from specific addresses. Use its Dial method as Opts.Dial or as the
+// Dial of a Route.
+type EgressPool struct {
+	strategy EgressStrategy
+	ips      []net.IP
+	dials    []DialFunc
+	next     uint32
+}
+
+// NewEgressPool creates an EgressPool using the given opts.
+func NewEgressPool(opts *EgressOpts) (*EgressPool, error) {
+	if len(opts.IPs) == 0 {
+		return nil, errors.New("Egress pool needs at least one IP")
+	}
+	p := &EgressPool{strategy: opts.Strategy}
+	for _, ip := range opts.IPs {
+		if ip == nil {
+			return nil, errors.New("Invalid egress IP")
+		}
+		var dialerOpts DialerOptions
+		if opts.DialerOptions != nil {
+			dialerOpts = *opts.DialerOptions
+		}
+		dialerOpts.LocalAddr = net.JoinHostPort(ip.String(), "0")
+		p.ips = append(p.ips, ip)
+		p.dials = append(p.dials, NewDialer(&dialerOpts))
+	}
+	return p, nil
+}
+
+// Dial is a DialFunc that dials addr from one of the pool's IPs. Only IPs of
+// the same family as addr are considered if addr is an IP, otherwise the
+// hostname is resolved to addresses of the picked IP's family.
+func (p *EgressPool) Dial(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.New("Unable to split host and port for %v: %v", addr, err)
+	}
+	candidates := make([]int, 0, len(p.ips))
+	destIP := net.ParseIP(host)
+	for i, ip := range p.ips {
+		if destIP == nil || (ip.To4() == nil) == (destIP.To4() == nil) {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, errors.New("No egress IP of the same family as %v", host)
+	}
+
+	var picked int
+	switch p.strategy {
+	case EgressPerDestination:
+		picked = candidates[hashString(host)%uint32(len(candidates))]
+	case EgressPerClient:
+		picked = candidates[hashString(tunnelClient(ctx, ""))%uint32(len(candidates))]
+	default:
+		picked = candidates[(atomic.AddUint32(&p.next, 1)-1)%uint32(len(candidates))]
+	}
+	conn, err := p.dials[picked](ctx, isCONNECT, familyNetwork(network, p.ips[picked]), addr)
+	if err != nil {
+		return nil, errors.New("Unable to dial %v from %v: %v", addr, p.ips[picked], err)
+	}
+	return conn, nil
+}
+
+// familyNetwork restricts network to the family of ip, so that hostnames
+// resolve to addresses that can be reached from it.
+func familyNetwork(network string, ip net.IP) string {
+	if network != "tcp" && network != "udp" {
+		return network
+	}
+	if ip.To4() != nil {
+		return network + "4"
+	}
+	return network + "6"
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
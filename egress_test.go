@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sourceIPs returns a listener that reports the source IP of every accepted
+// connection.
+func sourceIPs(t *testing.T) (net.Listener, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	sources := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			sources <- conn.RemoteAddr().(*net.TCPAddr).IP.String()
+			conn.Close()
+		}
+	}()
+	return l, sources
+}
+
+func TestEgressPool(t *testing.T) {
+	l, sources := sourceIPs(t)
+	defer l.Close()
+	ips := []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2"), net.ParseIP("::1")}
+
+	dialN := func(pool *EgressPool, ctx context.Context, addr string, n int) []string {
+		var seen []string
+		for i := 0; i < n; i++ {
+			conn, err := pool.Dial(ctx, true, "tcp", addr)
+			require.NoError(t, err)
+			conn.Close()
+			seen = append(seen, <-sources)
+		}
+		return seen
+	}
+
+	pool, err := NewEgressPool(&EgressOpts{IPs: ips})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1", "127.0.0.2", "127.0.0.1", "127.0.0.2"}, dialN(pool, context.Background(), l.Addr().String(), 4),
+		"Should rotate among IPs of the destination's family")
+
+	pool, err = NewEgressPool(&EgressOpts{IPs: ips, Strategy: EgressPerDestination})
+	require.NoError(t, err)
+	seen := dialN(pool, context.Background(), l.Addr().String(), 3)
+	assert.Equal(t, seen[0], seen[1])
+	assert.Equal(t, seen[0], seen[2])
+
+	pool, err = NewEgressPool(&EgressOpts{IPs: ips[:2], Strategy: EgressPerClient})
+	require.NoError(t, err)
+	clients := make(map[string]string)
+	for _, client := range []string{"alice", "bob", "carol", "dave", "alice", "bob"} {
+		ctx := context.WithValue(context.Background(), ctxKeyIdentity, client)
+		source := dialN(pool, ctx, l.Addr().String(), 1)[0]
+		if previous, ok := clients[client]; ok {
+			assert.Equal(t, previous, source, "Client %v should stick to its IP", client)
+		}
+		clients[client] = source
+	}
+
+	pool, err = NewEgressPool(&EgressOpts{IPs: ips[2:]})
+	require.NoError(t, err)
+	_, err = pool.Dial(context.Background(), true, "tcp", l.Addr().String())
+	assert.Error(t, err, "IPv6 egress IP can't reach IPv4 destination")
+
+	_, err = NewEgressPool(&EgressOpts{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+)
+
+var (
+	// ErrBlocked is the cause of errors from dialers that refuse destinations
+	// by policy, such as BlockDial.
+	ErrBlocked = errors.New("Destination blocked")
+)
+
+// ErrorRenderer renders the responses that the proxy generates when it can't
+// complete a request, for example to serve branded HTML or JSON error pages or
+// localized messages.
+type ErrorRenderer interface {
+	// RenderError returns the response to send for req, which failed with err.
+	// It returns nil to fall back to the proxy's default response.
+	RenderError(ctx context.Context, req *http.Request, err error) *http.Response
+}
+
+// ErrorRendererFunc adapts a function to an ErrorRenderer
+type ErrorRendererFunc func(ctx context.Context, req *http.Request, err error) *http.Response
+
+// RenderError implements the interface ErrorRenderer
+func (f ErrorRendererFunc) RenderError(ctx context.Context, req *http.Request, err error) *http.Response {
+	return f(ctx, req, err)
+}
+
+// ErrorStatus maps err to the status code to report to the client: 504
+// Gateway Timeout for timeouts (see TimeoutError), 429 Too Many Requests and
+// 503 Service Unavailable for tunnels denied by ClientTunnelQuota and
+// ConcurrencyLimit or DestinationConcurrencyLimit, 403 Forbidden for destinations denied by other policies
+// (see PolicyDeniedError and ErrBlocked), StatusInvalidUpstreamCertificate
+// for upstream certificates that failed verification (see
+// UpstreamCertificateError), 500 Internal Server Error for HijackError and
+// 502 Bad Gateway for anything else.
+func ErrorStatus(err error) int {
+	var denied *PolicyDeniedError
+	causedBy(err, func(cause error) bool {
+		denied, _ = cause.(*PolicyDeniedError)
+		return denied != nil
+	})
+	switch {
+	case causedBy(err, isTimeout):
+		return http.StatusGatewayTimeout
+	case denied != nil && denied.Policy == PolicyClientTunnelQuota:
+		return http.StatusTooManyRequests
+	case denied != nil && (denied.Policy == PolicyConcurrencyLimit || denied.Policy == PolicyDestinationConcurrencyLimit):
+		return http.StatusServiceUnavailable
+	case denied != nil, causedBy(err, func(cause error) bool { return cause == ErrBlocked }):
+		return http.StatusForbidden
+	case causedBy(err, isCertificateError):
+		return StatusInvalidUpstreamCertificate
+	case causedBy(err, func(cause error) bool { _, ok := cause.(*HijackError); return ok }):
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func isTimeout(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	timeout, ok := err.(interface{ Timeout() bool })
+	return ok && timeout.Timeout()
+}
+
+// causedBy indicates whether check matches err or any error it wraps.
+func causedBy(err error, check func(error) bool) bool {
+	for err != nil {
+		if check(err) {
+			return true
+		}
+		unwrapper, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return false
+		}
+		err = unwrapper.Unwrap()
+	}
+	return false
+}
+
+// ErrorPage is the data that TemplateErrorRenderer passes to its template.
+type ErrorPage struct {
+	// StatusCode is the status of the response, see ErrorStatus
+	StatusCode int
+
+	// StatusText is the standard text for StatusCode, e.g. "Bad Gateway"
+	StatusText string
+
+	// Host is the host that the client requested
+	Host string
+
+	// Error describes what went wrong
+	Error string
+
+	// AcceptLanguage is the client's Accept-Language header, for localizing
+	// messages
+	AcceptLanguage string
+}
+
+// Template is implemented by both text/template and html/template.
+type Template interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// TemplateErrorRenderer returns an ErrorRenderer that renders an ErrorPage
+// with tmpl, serving it with the given content type (e.g. "text/html;
+// charset=utf-8" or "application/json").
+func TemplateErrorRenderer(tmpl Template, contentType string) ErrorRenderer {
+	return ErrorRendererFunc(func(ctx context.Context, req *http.Request, err error) *http.Response {
+		statusCode := ErrorStatus(err)
+		page := &ErrorPage{
+			StatusCode:     statusCode,
+			StatusText:     statusText(statusCode),
+			Host:           req.Host,
+			Error:          err.Error(),
+			AcceptLanguage: req.Header.Get("Accept-Language"),
+		}
+		body := &bytes.Buffer{}
+		if execErr := tmpl.Execute(body, page); execErr != nil {
+			log.Errorf("Unable to render error page: %v", execErr)
+			return nil
+		}
+		resp := &http.Response{
+			StatusCode:    statusCode,
+			Header:        make(http.Header),
+			Body:          ioutil.NopCloser(body),
+			ContentLength: int64(body.Len()),
+			Close:         true,
+		}
+		resp.Header.Set("Content-Type", contentType)
+		return resp
+	})
+}
+
+// errorResponse responds to a request that failed with err, using the
+// ErrorRenderer if configured or else a plain 502 Bad Gateway.
+func (proxy *proxy) errorResponse(ctx filters.Context, req *http.Request, err error) (*http.Response, filters.Context, error) {
+	if proxy.ErrorRenderer != nil {
+		if resp := proxy.ErrorRenderer.RenderError(ctx, req, err); resp != nil {
+			log.Debugf("Responding %v: %v", resp.StatusCode, err)
+			if resp.Header == nil {
+				resp.Header = make(http.Header)
+			}
+			return resp, ctx, err
+		}
+	}
+	return badGateway(ctx, req, err)
+}
+
+// renderErrorOnError is the default OnError when an ErrorRenderer is
+// configured, rendering errors round-tripping upstream.
+func (opts *Opts) renderErrorOnError(ctx filters.Context, req *http.Request, read bool, err error) *http.Response {
+	if read {
+		return nil
+	}
+	return opts.ErrorRenderer.RenderError(ctx, req, err)
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"text/template"
+
+	"github.com/getlantern/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorStatus(t *testing.T) {
+	_, err := BlockDial(context.Background(), true, "tcp", "example.com:443")
+	assert.Equal(t, http.StatusForbidden, ErrorStatus(errors.New("Unable to dial: %v", err)))
+	assert.Equal(t, http.StatusGatewayTimeout, ErrorStatus(errors.New("Unable to dial: %v", timeoutError{})))
+	assert.Equal(t, http.StatusGatewayTimeout, ErrorStatus(context.DeadlineExceeded))
+	assert.Equal(t, http.StatusBadGateway, ErrorStatus(errors.New("connection refused")))
+}
+
+func TestErrorRenderer(t *testing.T) {
+	tmpl := template.Must(template.New("error").Parse(`{"status":{{.StatusCode}},"host":"{{.Host}}","lang":"{{.AcceptLanguage}}"}`))
+	router, err := NewRouter(nil, &Route{Hosts: []string{"blocked.example.com"}, Dial: BlockDial})
+	require.NoError(t, err)
+	l := serveProxy(t, &Opts{
+		OKWaitsForUpstream: true,
+		Dial:               router.Dial,
+		ErrorRenderer:      TemplateErrorRenderer(tmpl, "application/json"),
+	})
+	defer l.Close()
+
+	roundTrip := func(req *http.Request) *http.Response {
+		conn, dialErr := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, dialErr)
+		defer conn.Close()
+		req.Header.Set("Accept-Language", "de")
+		if req.Method == http.MethodConnect {
+			req.Write(conn)
+		} else {
+			req.WriteProxy(conn)
+		}
+		resp, readErr := http.ReadResponse(bufio.NewReader(conn), req)
+		require.NoError(t, readErr)
+		return resp
+	}
+
+	req, _ := http.NewRequest(http.MethodConnect, "http://blocked.example.com:443", nil)
+	resp := roundTrip(req)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, `{"status":403,"host":"blocked.example.com:443","lang":"de"}`, string(body))
+
+	req, _ = http.NewRequest(http.MethodGet, "http://blocked.example.com/", nil)
+	resp = roundTrip(req)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	body, _ = ioutil.ReadAll(resp.Body)
+	assert.Equal(t, `{"status":403,"host":"blocked.example.com","lang":"de"}`, string(body))
+}
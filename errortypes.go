@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"context"
+)
+
+// Phase is the stage of handling a request or tunnel at which an error
+// occurred.
+type Phase string
+
+const (
+	// PhaseResolve is resolving the upstream hostname
+	PhaseResolve Phase = "resolve"
+
+	// PhaseDial is dialing upstream
+	PhaseDial Phase = "dial"
+
+	// PhaseRoundTrip is forwarding a request upstream and awaiting its
+	// response
+	PhaseRoundTrip Phase = "roundtrip"
+
+	// PhaseHijack is taking over the connection of a request served with
+	// ServeHTTP
+	PhaseHijack Phase = "hijack"
+
+	// PhaseAdmission is deciding whether a tunnel may be opened at all
+	PhaseAdmission Phase = "admission"
+
+	// PhaseSniff is classifying the protocol spoken in a tunnel, see
+	// Opts.ProtocolPolicy
+	PhaseSniff Phase = "sniff"
+)
+
+// Policies that a PolicyDeniedError can report.
+const (
+	// PolicyAccessControl is Opts.AccessControl denying the destination
+	PolicyAccessControl = "access control"
+
+	// PolicyBlocked is a dialer like BlockDial refusing the destination, see
+	// ErrBlocked
+	PolicyBlocked = "blocked"
+
+	// PolicyClientTunnelQuota is the client reaching Opts.ClientTunnelQuota
+	PolicyClientTunnelQuota = "client tunnel quota"
+
+	// PolicyConcurrencyLimit is the proxy reaching Opts.ConcurrencyLimit
+	PolicyConcurrencyLimit = "concurrency limit"
+
+	// PolicyDestinationConcurrencyLimit is a destination reaching
+	// Opts.DestinationConcurrencyLimit
+	PolicyDestinationConcurrencyLimit = "destination concurrency limit"
+
+	// PolicyProtocol is Opts.ProtocolPolicy denying the protocol spoken in a
+	// tunnel
+	PolicyProtocol = "protocol"
+)
+
+// The error types below are found among the causes of the errors that the
+// proxy reports, e.g. from Handle, to OnError and ErrorRenderer, and to
+// EventListener and Metrics. Like other errors, they may be wrapped, so use
+// errors.As to find them, or errors.Is with a partially filled in value to
+// match on some fields, e.g. errors.Is(err, &DialError{Phase: PhaseResolve}).
+// They don't change the message of the error they carry, so error text seen
+// by clients and logs stays the same.
+
+// DialError reports that upstream couldn't be resolved or dialed.
+type DialError struct {
+	// Addr is the destination that was dialed
+	Addr string
+
+	// Phase is PhaseResolve or PhaseDial
+	Phase Phase
+
+	// Err is the underlying error
+	Err error
+}
+
+func (e *DialError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches a *DialError whose non-empty fields equal those of e.
+func (e *DialError) Is(target error) bool {
+	t, ok := target.(*DialError)
+	return ok && matchesDestination(e.Addr, e.Phase, t.Addr, t.Phase)
+}
+
+// TimeoutError reports that upstream didn't respond in time, for example
+// because a dial or Timeouts.ResponseHeader expired.
+type TimeoutError struct {
+	// Addr is the upstream destination
+	Addr string
+
+	// Phase is the phase that timed out, e.g. PhaseDial or PhaseRoundTrip
+	Phase Phase
+
+	// Err is the underlying error
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return e.Err.Error()
+}
+
+// Timeout implements the interface net.Error
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// Unwrap returns the underlying error
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches context.DeadlineExceeded as well as a *TimeoutError whose
+// non-empty fields equal those of e.
+func (e *TimeoutError) Is(target error) bool {
+	if target == context.DeadlineExceeded {
+		return true
+	}
+	t, ok := target.(*TimeoutError)
+	return ok && matchesDestination(e.Addr, e.Phase, t.Addr, t.Phase)
+}
+
+// PolicyDeniedError reports that the proxy refused to serve a destination or
+// client by policy.
+type PolicyDeniedError struct {
+	// Addr is the requested destination
+	Addr string
+
+	// Phase is where the policy was enforced, e.g. PhaseAdmission or
+	// PhaseDial
+	Phase Phase
+
+	// Policy is the policy that denied the request, e.g. PolicyAccessControl
+	Policy string
+
+	// Err is the underlying error
+	Err error
+}
+
+func (e *PolicyDeniedError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *PolicyDeniedError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches ErrBlocked for destinations refused by dialers, as well as a
+// *PolicyDeniedError whose non-empty fields equal those of e.
+func (e *PolicyDeniedError) Is(target error) bool {
+	if target == ErrBlocked {
+		return e.Policy == PolicyBlocked
+	}
+	t, ok := target.(*PolicyDeniedError)
+	return ok && matchesDestination(e.Addr, e.Phase, t.Addr, t.Phase) && (t.Policy == "" || t.Policy == e.Policy)
+}
+
+// HijackError reports that the connection of a request served with ServeHTTP
+// couldn't be taken over.
+type HijackError struct {
+	// Err is the underlying error
+	Err error
+}
+
+func (e *HijackError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *HijackError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches any *HijackError.
+func (e *HijackError) Is(target error) bool {
+	_, ok := target.(*HijackError)
+	return ok
+}
+
+// UpstreamCertificateError reports that the certificate presented by an
+// upstream server failed verification, see UpstreamVerification.
+type UpstreamCertificateError struct {
+	// Host is the server name that was verified
+	Host string
+
+	// Err is the underlying error
+	Err error
+}
+
+func (e *UpstreamCertificateError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *UpstreamCertificateError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches an *UpstreamCertificateError with the same Host, if specified.
+func (e *UpstreamCertificateError) Is(target error) bool {
+	t, ok := target.(*UpstreamCertificateError)
+	return ok && (t.Host == "" || t.Host == e.Host)
+}
+
+func matchesDestination(addr string, phase Phase, targetAddr string, targetPhase Phase) bool {
+	return (targetAddr == "" || targetAddr == addr) && (targetPhase == "" || targetPhase == phase)
+}
+
+// dialError classifies an error dialing addr during phase.
+func dialError(addr string, phase Phase, err error) error {
+	if causedBy(err, func(cause error) bool { return cause == ErrBlocked }) {
+		return &PolicyDeniedError{Addr: addr, Phase: phase, Policy: PolicyBlocked, Err: err}
+	}
+	var wrapped error = &DialError{Addr: addr, Phase: phase, Err: err}
+	if causedBy(err, isTimeout) {
+		wrapped = &TimeoutError{Addr: addr, Phase: phase, Err: wrapped}
+	}
+	return wrapped
+}
+
+// roundTripError classifies an error forwarding a request to addr, marking
+// timeouts that weren't already classified.
+func roundTripError(addr string, err error) error {
+	if causedBy(err, isTypedError) || !causedBy(err, isTimeout) {
+		return err
+	}
+	return &TimeoutError{Addr: addr, Phase: PhaseRoundTrip, Err: err}
+}
+
+func isTypedError(err error) bool {
+	switch err.(type) {
+	case *DialError, *TimeoutError, *PolicyDeniedError, *UpstreamCertificateError:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/getlantern/mockconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorTypesMatching(t *testing.T) {
+	err := fmt.Errorf("wrapped: %w", &DialError{Addr: "example.com:443", Phase: PhaseResolve, Err: errors.New("no such host")})
+	assert.True(t, errors.Is(err, &DialError{}))
+	assert.True(t, errors.Is(err, &DialError{Phase: PhaseResolve}))
+	assert.True(t, errors.Is(err, &DialError{Addr: "example.com:443", Phase: PhaseResolve}))
+	assert.False(t, errors.Is(err, &DialError{Phase: PhaseDial}))
+	assert.False(t, errors.Is(err, &DialError{Addr: "other.com:443"}))
+	assert.False(t, errors.Is(err, &TimeoutError{}))
+	assert.Equal(t, "wrapped: no such host", err.Error(), "Typed errors shouldn't change the message")
+
+	timeout := roundTripError("example.com:80", context.DeadlineExceeded)
+	var te *TimeoutError
+	require.True(t, errors.As(timeout, &te))
+	assert.Equal(t, "example.com:80", te.Addr)
+	assert.Equal(t, PhaseRoundTrip, te.Phase)
+	assert.True(t, errors.Is(timeout, context.DeadlineExceeded))
+	assert.Equal(t, timeout, roundTripError("example.com:80", timeout), "Classified errors shouldn't be wrapped again")
+	refused := errors.New("connection refused")
+	assert.Equal(t, refused, roundTripError("example.com:80", refused))
+
+	denied := &PolicyDeniedError{Addr: "example.com:443", Phase: PhaseAdmission, Policy: PolicyAccessControl, Err: errors.New("denied")}
+	assert.True(t, errors.Is(denied, &PolicyDeniedError{Policy: PolicyAccessControl}))
+	assert.False(t, errors.Is(denied, &PolicyDeniedError{Policy: PolicyBlocked}))
+	assert.False(t, errors.Is(denied, ErrBlocked))
+
+	assert.True(t, errors.Is(&HijackError{Err: errors.New("hijacked")}, &HijackError{}))
+}
+
+func TestDialErrorClassification(t *testing.T) {
+	_, blockErr := BlockDial(context.Background(), true, "tcp", "example.com:443")
+	var denied *PolicyDeniedError
+	require.True(t, errors.As(dialError("example.com:443", PhaseDial, blockErr), &denied))
+	assert.Equal(t, PolicyBlocked, denied.Policy)
+	assert.True(t, errors.Is(denied, ErrBlocked))
+
+	err := dialError("example.com:443", PhaseDial, timeoutError{})
+	var te *TimeoutError
+	require.True(t, errors.As(err, &te))
+	assert.Equal(t, PhaseDial, te.Phase)
+	assert.True(t, errors.Is(err, &DialError{Addr: "example.com:443", Phase: PhaseDial}), "Timeouts should still be dial errors")
+
+	err = dialError("example.com:443", PhaseDial, errors.New("connection refused"))
+	assert.True(t, errors.Is(err, &DialError{Phase: PhaseDial}))
+	assert.False(t, errors.Is(err, &TimeoutError{}))
+}
+
+func TestErrorStatusForTypedErrors(t *testing.T) {
+	admission := func(policy string) error {
+		return fmt.Errorf("Unable to open tunnel: %w", &PolicyDeniedError{Phase: PhaseAdmission, Policy: policy, Err: errors.New("denied")})
+	}
+	assert.Equal(t, http.StatusTooManyRequests, ErrorStatus(admission(PolicyClientTunnelQuota)))
+	assert.Equal(t, http.StatusServiceUnavailable, ErrorStatus(admission(PolicyConcurrencyLimit)))
+	assert.Equal(t, http.StatusServiceUnavailable, ErrorStatus(admission(PolicyDestinationConcurrencyLimit)))
+	assert.Equal(t, http.StatusForbidden, ErrorStatus(admission(PolicyAccessControl)))
+	assert.Equal(t, http.StatusGatewayTimeout, ErrorStatus(&TimeoutError{Phase: PhaseRoundTrip, Err: errors.New("slow")}))
+	assert.Equal(t, http.StatusInternalServerError, ErrorStatus(&HijackError{Err: errors.New("hijacked")}))
+	assert.Equal(t, http.StatusBadGateway, ErrorStatus(&DialError{Phase: PhaseDial, Err: errors.New("connection refused")}))
+}
+
+func TestHandleReturnsTypedErrors(t *testing.T) {
+	d := mockconn.FailingDialer(errors.New("I don't want to dial"))
+	p := newProxy(&Opts{
+		OKWaitsForUpstream: true,
+		Dial: func(ctx context.Context, isConnect bool, net, addr string) (net.Conn, error) {
+			return d.Dial(net, addr)
+		},
+	})
+	req, _ := http.NewRequest("CONNECT", "http://thehost:123", nil)
+	_, _, handleErr := roundTrip(p, req, false)
+	var dialErr *DialError
+	require.True(t, errors.As(handleErr, &dialErr), "Expected a DialError, got %v", handleErr)
+	assert.Equal(t, "thehost:123", dialErr.Addr)
+	assert.Equal(t, PhaseDial, dialErr.Phase)
+
+	p = newProxy(&Opts{
+		Resolver: ResolverFunc(func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			return nil, errors.New("no such host")
+		}),
+	})
+	req, _ = http.NewRequest("GET", "http://thehost:123/", nil)
+	_, _, handleErr = roundTrip(p, req, false)
+	assert.True(t, errors.Is(handleErr, &DialError{Addr: "thehost:123", Phase: PhaseResolve}), "Expected a resolve error, got %v", handleErr)
+}
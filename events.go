@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	noopEventListener EventListener = &EventListenerFuncs{}
+)
+
+// EventListener is notified of connection lifecycle events, for custom
+// telemetry, banning or debugging. Unlike Metrics, callbacks receive the
+// context of the request or tunnel along with the connections involved.
+// Callbacks are invoked synchronously on the proxy's goroutines, so they
+// should return quickly. Implementations must be safe for concurrent use.
+type EventListener interface {
+	// UpstreamDialed is called after every attempt to dial upstream. conn is
+	// nil if the dial failed.
+	UpstreamDialed(ctx context.Context, network, addr string, conn net.Conn, latency time.Duration, err error)
+
+	// TunnelOpened is called when data starts being piped between downstream
+	// and upstream (CONNECT, SOCKS, transparent and upgraded connections).
+	TunnelOpened(ctx context.Context, upstreamAddr string, upstream net.Conn, downstream net.Conn)
+
+	// TunnelClosed is called when a tunnel finishes, with the error that ended
+	// it, if any.
+	TunnelClosed(ctx context.Context, upstreamAddr string, duration time.Duration, err error)
+
+	// RequestForwarded is called after round-tripping a non-CONNECT request
+	// upstream, with the response or error. The response body must not be
+	// read.
+	RequestForwarded(ctx context.Context, req *http.Request, resp *http.Response, err error)
+}
+
+// EventListenerFuncs adapts a set of functions to an EventListener. Any of the
+// functions may be nil, in which case the corresponding event is ignored.
+type EventListenerFuncs struct {
+	OnUpstreamDialed   func(ctx context.Context, network, addr string, conn net.Conn, latency time.Duration, err error)
+	OnTunnelOpened     func(ctx context.Context, upstreamAddr string, upstream net.Conn, downstream net.Conn)
+	OnTunnelClosed     func(ctx context.Context, upstreamAddr string, duration time.Duration, err error)
+	OnRequestForwarded func(ctx context.Context, req *http.Request, resp *http.Response, err error)
+}
+
+// UpstreamDialed implements the interface EventListener
+func (f *EventListenerFuncs) UpstreamDialed(ctx context.Context, network, addr string, conn net.Conn, latency time.Duration, err error) {
+	if f.OnUpstreamDialed != nil {
+		f.OnUpstreamDialed(ctx, network, addr, conn, latency, err)
+	}
+}
+
+// TunnelOpened implements the interface EventListener
+func (f *EventListenerFuncs) TunnelOpened(ctx context.Context, upstreamAddr string, upstream net.Conn, downstream net.Conn) {
+	if f.OnTunnelOpened != nil {
+		f.OnTunnelOpened(ctx, upstreamAddr, upstream, downstream)
+	}
+}
+
+// TunnelClosed implements the interface EventListener
+func (f *EventListenerFuncs) TunnelClosed(ctx context.Context, upstreamAddr string, duration time.Duration, err error) {
+	if f.OnTunnelClosed != nil {
+		f.OnTunnelClosed(ctx, upstreamAddr, duration, err)
+	}
+}
+
+// RequestForwarded implements the interface EventListener
+func (f *EventListenerFuncs) RequestForwarded(ctx context.Context, req *http.Request, resp *http.Response, err error) {
+	if f.OnRequestForwarded != nil {
+		f.OnRequestForwarded(ctx, req, resp, err)
+	}
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingListener struct {
+	mx     sync.Mutex
+	events []string
+}
+
+func (l *recordingListener) record(event string) {
+	l.mx.Lock()
+	l.events = append(l.events, event)
+	l.mx.Unlock()
+}
+
+func (l *recordingListener) recorded() []string {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	return append([]string(nil), l.events...)
+}
+
+func (l *recordingListener) funcs() *EventListenerFuncs {
+	return &EventListenerFuncs{
+		OnUpstreamDialed: func(ctx context.Context, network, addr string, conn net.Conn, latency time.Duration, err error) {
+			l.record("dialed")
+		},
+		OnTunnelOpened: func(ctx context.Context, upstreamAddr string, upstream net.Conn, downstream net.Conn) {
+			l.record("opened")
+		},
+		OnTunnelClosed: func(ctx context.Context, upstreamAddr string, duration time.Duration, err error) {
+			l.record("closed")
+		},
+		OnRequestForwarded: func(ctx context.Context, req *http.Request, resp *http.Response, err error) {
+			if err != nil {
+				l.record("failed " + err.Error())
+				return
+			}
+			l.record("forwarded " + resp.Status)
+		},
+	}
+}
+
+func TestEventListenerTunnel(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	listener := &recordingListener{}
+	l := serveProxy(t, &Opts{OKWaitsForUpstream: true, EventListener: listener.funcs()})
+	defer l.Close()
+
+	conn, br, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	conn.Write([]byte("ping"))
+	b := make([]byte, 4)
+	_, err := io.ReadFull(br, b)
+	require.NoError(t, err)
+	conn.Close()
+
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"dialed", "opened", "closed"}, listener.recorded())
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestEventListenerRequestForwarded(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer origin.Close()
+
+	listener := &recordingListener{}
+	l := serveProxy(t, &Opts{EventListener: listener.funcs()})
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+	req.WriteProxy(conn)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTeapot, resp.StatusCode)
+	assert.Equal(t, []string{"dialed", "forwarded 418 I'm a teapot"}, listener.recorded())
+}
@@ -0,0 +1,319 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+)
+
+const (
+	// fastCONNECTBufferSize is how much of a connection HandleCONNECT buffers,
+	// which bounds the size of the request heads it parses itself
+	fastCONNECTBufferSize = 4096
+
+	// fastCONNECTHeadTimeout is how long HandleCONNECT waits for the request
+	// head
+	fastCONNECTHeadTimeout = 30 * time.Second
+)
+
+var (
+	connectOK = []byte("HTTP/1.1 200 OK\r\n\r\n")
+)
+
+// HandleCONNECT implements the interface Proxy
+func (proxy *proxy) HandleCONNECT(ctx context.Context, downstreamIn io.Reader, downstream net.Conn) error {
+	// Track the connection while waiting for the request head, so that
+	// Shutdown closes it if the client stays idle
+	tc := proxy.tracker.add(downstream, false)
+	if tc == nil {
+		safeClose(downstream)
+		return ErrShutdown
+	}
+	// The connection's authentication state carries over to the regular path
+	ctx = context.WithValue(withEarlyAuthFailure(ctx), ctxKeyConnAuth, &connAuth{})
+	br := bufio.NewReaderSize(downstreamIn, fastCONNECTBufferSize)
+	downstream.SetReadDeadline(time.Now().Add(fastCONNECTHeadTimeout))
+	req, headLen, err := proxy.peekCONNECT(withClientConn(ctx, downstream), br)
+	downstream.SetReadDeadline(time.Time{})
+	proxy.tracker.remove(tc)
+	if err != nil {
+		safeClose(downstream)
+		return errors.New("Unable to read request head from %v: %v", downstream.RemoteAddr(), err)
+	}
+	if req == nil {
+		// Not something the fast path can handle, so process it as usual. Nothing
+		// has been consumed from br yet.
+		return proxy.Handle(ctx, br, downstream)
+	}
+	br.Discard(headLen)
+	if remoteAddr := downstream.RemoteAddr(); remoteAddr != nil {
+		req.RemoteAddr = remoteAddr.String()
+	}
+	return proxy.fastCONNECT(ctx, req, br, downstream)
+}
+
+// ServeCONNECT implements the interface Proxy
+func (proxy *proxy) ServeCONNECT(l net.Listener) error {
+	if !proxy.tracker.addListener(l) {
+		return ErrShutdown
+	}
+	defer proxy.tracker.removeListener(l)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if proxy.tracker.isShuttingDown() {
+				return ErrShutdown
+			}
+			return errors.New("Unable to accept: %v", err)
+		}
+		go proxy.HandleCONNECT(context.Background(), conn, conn)
+	}
+}
+
+// peekCONNECT parses the request head buffered in br if it's a CONNECT request
+// that the fast path can handle, returning it along with the length of the
+// head. It returns nil for anything else, including requests that the regular
+// path rejects or that need Filter, Rules, MITM or tunnel compression, and
+// requests that fail to authenticate (so that the regular path challenges
+// them, without authenticating them again, see withEarlyAuthFailure). It
+// returns an error if the connection fails before a head fitting br arrives.
+func (proxy *proxy) peekCONNECT(ctx context.Context, br *bufio.Reader) (*http.Request, int, error) {
+	head, err := peekHead(br)
+	if head == nil || len(head) > proxy.maxHeaderBytes() {
+		return nil, 0, err
+	}
+	req, fields := parseCONNECTHead(head)
+	if req == nil || proxy.validateCONNECTTarget(req) != nil {
+		return nil, 0, nil
+	}
+	if proxy.MaxHeaderFields > 0 && fields > proxy.MaxHeaderFields {
+		return nil, 0, nil
+	}
+	if proxy.Rules != nil || proxy.ShouldMITM(req, req.URL.Host) || (proxy.TunnelCompression && acceptsTunnelCompression(req.Header)) {
+		return nil, 0, nil
+	}
+	if auth := proxy.currentConfig().Authenticator; auth != nil {
+		identity, ok := auth.Authenticate(ctx, req)
+		if !ok {
+			setEarlyAuthFailure(ctx)
+			return nil, 0, nil
+		}
+		req = req.WithContext(context.WithValue(ctx, ctxKeyIdentity, identity))
+	}
+	return req, len(head), nil
+}
+
+// peekHead waits for a complete request head to be buffered in br, returning
+// nil if it doesn't fit, or the error if the connection fails first.
+func peekHead(br *bufio.Reader) ([]byte, error) {
+	for {
+		buffered, _ := br.Peek(br.Buffered())
+		if end := headerEnd(buffered); end >= 0 {
+			return buffered[:end], nil
+		}
+		if br.Buffered() >= br.Size() {
+			return nil, nil
+		}
+		// Block until more arrives
+		if _, err := br.Peek(br.Buffered() + 1); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseCONNECTHead parses a CONNECT request head and counts its header fields.
+// It only accepts the plain heads that clients send, leaving anything unusual
+// (like folded lines or message bodies) to the regular path.
+func parseCONNECTHead(head []byte) (*http.Request, int) {
+	lines := strings.Split(string(head), "\n")
+	parts := strings.Split(strings.TrimSuffix(lines[0], "\r"), " ")
+	if len(parts) != 3 || parts[0] != http.MethodConnect {
+		return nil, 0
+	}
+	major, minor, ok := http.ParseHTTPVersion(parts[2])
+	if !ok || major != 1 {
+		return nil, 0
+	}
+	header := make(http.Header)
+	fields := 0
+	for _, line := range lines[1:] {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon <= 0 || strings.ContainsAny(line[:colon], " \t") {
+			return nil, 0
+		}
+		fields++
+		header.Add(line[:colon], strings.TrimSpace(line[colon+1:]))
+	}
+	if _, found := header["Content-Length"]; found {
+		return nil, 0
+	}
+	if _, found := header["Transfer-Encoding"]; found {
+		return nil, 0
+	}
+	return &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: parts[1]},
+		Host:       parts[1],
+		RequestURI: parts[1],
+		Proto:      parts[2],
+		ProtoMajor: major,
+		ProtoMinor: minor,
+		Header:     header,
+		Body:       http.NoBody,
+	}, fields
+}
+
+// fastCONNECT tunnels req like a SOCKS tunnel, without going through Filter.
+func (proxy *proxy) fastCONNECT(ctx context.Context, req *http.Request, downstreamIn *bufio.Reader, downstream net.Conn) (err error) {
+	defer func() {
+		p := recover()
+		if p != nil {
+			safeClose(downstream)
+			err = errors.New("Recovered from panic handling CONNECT: %v", p)
+		}
+	}()
+
+	defer func() {
+		if closeErr := downstream.Close(); closeErr != nil {
+			log.Tracef("Error closing downstream connection: %s", closeErr)
+		}
+	}()
+
+	tc := proxy.tracker.add(downstream, true)
+	if tc == nil {
+		return ErrShutdown
+	}
+	defer proxy.tracker.remove(tc)
+	ctx = withClientGeo(ctx, proxy.GeoIP, connClientIP(downstream))
+
+	upstreamAddr := req.URL.Host
+	fctx := filters.WrapContext(withTunnelStats(withResolvedIPs(withDialedAddr(ctx))), downstream).WithValue(ctxKeyUpstreamAddr, upstreamAddr)
+	if identity := AuthenticatedIdentity(req.Context()); identity != "" {
+		fctx = fctx.WithValue(ctxKeyIdentity, identity)
+	}
+	rec := proxy.newTunnelAccessRecord(AccessProtocolHTTP, downstream, upstreamAddr)
+	if rec != nil {
+		rec.Proto = req.Proto
+		fctx = fctx.WithValue(ctxKeyAccessRecord, rec)
+		defer func() {
+			proxy.logAccess(fctx, rec, err)
+		}()
+	}
+	if accessErr := proxy.checkTunnelAccess(fctx, downstream, upstreamAddr); accessErr != nil {
+		proxy.writeCONNECTError(fctx, req, rec, downstream, accessErr)
+		return accessErr
+	}
+	release, err := proxy.acquireTunnel(fctx)
+	if err != nil {
+		proxy.writeCONNECTError(fctx, req, rec, downstream, err)
+		return err
+	}
+	defer release()
+
+	if !proxy.OKWaitsForUpstream {
+		if err := proxy.writeCONNECTOK(req, rec, downstream, 0); err != nil {
+			return err
+		}
+	}
+	var early *earlyData
+	if proxy.CONNECTEarlyData && !proxy.OKWaitsForUpstream {
+		early = proxy.readEarlyData(downstreamIn)
+	}
+	start := time.Now()
+	dialCtx, cancelDial := addDialDeadlineIfNecessary(fctx, req)
+	upstream, err := proxy.dialUpstream(dialCtx, true, "tcp", upstreamAddr)
+	cancelDial()
+	if err != nil {
+		if proxy.OKWaitsForUpstream {
+			proxy.writeCONNECTError(fctx, req, rec, downstream, err)
+		}
+		return errors.New("Unable to dial upstream %v: %v", upstreamAddr, err)
+	}
+	defer func() {
+		if closeErr := upstream.Close(); closeErr != nil {
+			log.Tracef("Error closing upstream connection: %s", closeErr)
+		}
+	}()
+	if proxy.OKWaitsForUpstream {
+		if err := proxy.writeCONNECTOK(req, rec, downstream, time.Since(start)); err != nil {
+			return err
+		}
+	}
+
+	if early != nil {
+		rest, flushErr := early.flush(upstream)
+		if flushErr != nil {
+			return flushErr
+		}
+		if rest != nil {
+			return proxy.pipe(fctx, upstreamAddr, upstream, &readerConn{downstream, rest})
+		}
+	}
+	if downstreamIn.Buffered() > 0 {
+		return proxy.pipe(fctx, upstreamAddr, upstream, &readerConn{downstream, downstreamIn})
+	}
+	// Leave the connection unwrapped, so that it can be spliced
+	return proxy.pipe(fctx, upstreamAddr, upstream, downstream)
+}
+
+// writeCONNECTOK responds OK to a CONNECT request with the same headers as the
+// regular path, where dialTime is how long dialing upstream took before the
+// response, if it waited for that.
+func (proxy *proxy) writeCONNECTOK(req *http.Request, rec *AccessRecord, downstream net.Conn, dialTime time.Duration) error {
+	if rec != nil {
+		rec.StatusCode = http.StatusOK
+	}
+	var err error
+	if proxy.OnCONNECTResponse == nil && !proxy.OKSendsServerTiming && proxy.IdleTimeout <= 0 {
+		_, err = downstream.Write(connectOK)
+	} else {
+		resp := &http.Response{StatusCode: http.StatusOK, ProtoMajor: 1, ProtoMinor: 1, Header: make(http.Header)}
+		if proxy.OKSendsServerTiming {
+			addDialUpstreamHeader(resp, dialTime)
+		}
+		proxy.addIdleKeepAlive(resp.Header)
+		proxy.customizeCONNECTResponse(req, resp)
+		err = resp.Write(downstream)
+	}
+	if err != nil {
+		return errors.New("Unable to respond OK to CONNECT: %v", err)
+	}
+	return nil
+}
+
+// writeCONNECTError responds to a CONNECT request that failed with err, using
+// the ErrorRenderer if configured or else the status from ErrorStatus.
+func (proxy *proxy) writeCONNECTError(ctx filters.Context, req *http.Request, rec *AccessRecord, downstream net.Conn, err error) {
+	var resp *http.Response
+	if proxy.ErrorRenderer != nil {
+		resp = proxy.ErrorRenderer.RenderError(ctx, req, err)
+	}
+	if resp == nil {
+		resp = &http.Response{StatusCode: ErrorStatus(err), Header: make(http.Header), Body: http.NoBody}
+		resp.Status = statusText(resp.StatusCode)
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	resp.ProtoMajor, resp.ProtoMinor = 1, 1
+	resp.Close = true
+	proxy.customizeCONNECTResponse(req, resp)
+	if rec != nil {
+		rec.StatusCode = resp.StatusCode
+	}
+	if writeErr := resp.Write(downstream); writeErr != nil {
+		log.Debugf("Unable to respond to CONNECT for %v: %v", req.URL.Host, writeErr)
+	}
+}
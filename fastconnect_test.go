@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCONNECTHead(t *testing.T) {
+	req, fields := parseCONNECTHead([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nProxy-Authorization: Basic Zm9vOmJhcg==\r\n\r\n"))
+	require.NotNil(t, req)
+	assert.Equal(t, 2, fields)
+	assert.Equal(t, "example.com:443", req.URL.Host)
+	assert.Equal(t, "example.com:443", req.Host)
+	assert.Equal(t, "HTTP/1.1", req.Proto)
+	assert.Equal(t, "Basic Zm9vOmJhcg==", req.Header.Get("Proxy-Authorization"))
+
+	for _, head := range []string{
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"CONNECT example.com:443 HTTP/2.0\r\n\r\n",
+		"CONNECT example.com:443\r\n\r\n",
+		"CONNECT example.com:443 HTTP/1.1\r\nX-Folded: a\r\n b\r\n\r\n",
+		"CONNECT example.com:443 HTTP/1.1\r\nBad Name: a\r\n\r\n",
+		"CONNECT example.com:443 HTTP/1.1\r\nContent-Length: 5\r\n\r\n",
+	} {
+		req, _ := parseCONNECTHead([]byte(head))
+		assert.Nil(t, req, "%q should be left to the regular path", head)
+	}
+}
+
+func TestServeCONNECT(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer web.Close()
+
+	var filtered int32
+	p := newProxy(&Opts{
+		Filter: filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+			atomic.AddInt32(&filtered, 1)
+			return next(ctx, req)
+		}),
+		Authenticator: BasicAuth("proxy", func(username, password string) bool {
+			return username == "alice" && password == "secret"
+		}),
+		AccessControl: AllowPorts(portOf(t, origin.Addr()), portOf(t, web.Listener.Addr())),
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go p.ServeCONNECT(l)
+
+	connect := func(addr string, authenticate bool) (net.Conn, *http.Response) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		req, _ := http.NewRequest(http.MethodConnect, "http://"+addr, nil)
+		if authenticate {
+			req.Header.Set("Proxy-Authorization", "Basic YWxpY2U6c2VjcmV0")
+		}
+		require.NoError(t, req.Write(conn))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		require.NoError(t, err)
+		return conn, resp
+	}
+
+	conn, resp := connect(origin.Addr().String(), true)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	echoed := make([]byte, 4)
+	_, err = conn.Read(echoed)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(echoed))
+	conn.Close()
+	assert.Equal(t, int32(0), atomic.LoadInt32(&filtered), "Fast path shouldn't go through Filter")
+
+	conn, resp = connect("localhost:1", true)
+	conn.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "Access control should apply")
+
+	conn, resp = connect(origin.Addr().String(), false)
+	conn.Close()
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode, "Unauthenticated requests should be challenged by the regular path")
+
+	conn, err = net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	req, _ := http.NewRequest(http.MethodGet, web.URL, nil)
+	req.Header.Set("Proxy-Authorization", "Basic YWxpY2U6c2VjcmV0")
+	require.NoError(t, req.WriteProxy(conn))
+	resp, err = http.ReadResponse(bufio.NewReader(conn), req)
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "hello", string(body), "Other requests should be forwarded as usual")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&filtered))
+}
+
+func TestServeCONNECTWaitsForUpstream(t *testing.T) {
+	p := newProxy(&Opts{
+		OKWaitsForUpstream: true,
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			return nil, errors.New("nope")
+		},
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go p.ServeCONNECT(l)
+
+	conn, _, resp := openTunnel(t, l.Addr().String(), "example.com:443")
+	defer conn.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
+
+func TestServeCONNECTHeaders(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+	p := newProxy(&Opts{
+		OKWaitsForUpstream:  true,
+		OKSendsServerTiming: true,
+		IdleTimeout:         30 * time.Second,
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go p.ServeCONNECT(l)
+
+	conn, br, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+	defer conn.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get(serverTimingHeader), "dialupstream;dur=")
+	assert.Equal(t, "timeout=28", resp.Header.Get("Keep-Alive"))
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(br, b)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(b))
+}
+
+func portOf(t *testing.T, addr net.Addr) int {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	require.True(t, ok)
+	return tcpAddr.Port
+}
+
+func TestServeCONNECTAuthenticatesOnce(t *testing.T) {
+	var attempts int32
+	p := newProxy(&Opts{
+		Authenticator: BasicAuth("proxy", func(username, password string) bool {
+			atomic.AddInt32(&attempts, 1)
+			return false
+		}),
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go p.ServeCONNECT(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	req, _ := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+	req.Header.Set("Proxy-Authorization", "Basic YWxpY2U6d3Jvbmc=")
+	require.NoError(t, req.Write(conn))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&attempts), "Failed attempt should only be authenticated once")
+
+	require.NoError(t, req.Write(conn))
+	resp, err = http.ReadResponse(br, req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&attempts), "Later requests should be authenticated as usual")
+}
+
+func TestServeCONNECTShutdownClosesIdle(t *testing.T) {
+	p := newProxy(&Opts{})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go p.ServeCONNECT(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	// Wait for the connection to be tracked
+	require.Eventually(t, func() bool {
+		pp := p.(*proxy)
+		pp.tracker.mx.Lock()
+		defer pp.tracker.mx.Unlock()
+		return len(pp.tracker.conns) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, aborted, err := p.Shutdown(ctx)
+	assert.NoError(t, err)
+	assert.Zero(t, aborted)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "Idle client should be disconnected")
+}
@@ -75,7 +75,7 @@ type ctext struct {
 }
 
 func (ctx *ctext) DownstreamConn() net.Conn {
-	downstreamConn := ctx.Value(ctxKeyDownstream).(func() net.Conn)
+	downstreamConn, _ := ctx.Value(ctxKeyDownstream).(func() net.Conn)
 	if downstreamConn == nil {
 		return nil
 	}
@@ -0,0 +1,197 @@
+package filters
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	ctxKeyContentEncoding = contextKey("contentEncoding")
+)
+
+// Decoder creates a reader that decodes data with a particular content coding.
+type Decoder func(r io.Reader) (io.ReadCloser, error)
+
+// Encoder creates a writer that encodes data with a particular content coding.
+type Encoder func(w io.Writer) (io.WriteCloser, error)
+
+// DefaultDecoders are the decoders used by Decompress for gzip and deflate.
+// Others, like br, can be added by passing additional decoders.
+var DefaultDecoders = map[string]Decoder{
+	"gzip": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"deflate": func(r io.Reader) (io.ReadCloser, error) {
+		return flate.NewReader(r), nil
+	},
+}
+
+// DefaultEncoders are the encoders used by Recompress for gzip and deflate.
+var DefaultEncoders = map[string]Encoder{
+	"gzip": func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	},
+	"deflate": func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, flate.DefaultCompression)
+	},
+}
+
+// Decompress returns a Filter that decodes compressed responses so that
+// filters before it in the chain can inspect and rewrite plain bodies. Only
+// codings for which there is a decoder (DefaultDecoders plus the given ones)
+// are requested from upstream. Decoded responses have their Content-Encoding
+// and Content-Length removed. To re-encode responses for the client, place
+// Recompress at the start of the chain, e.g.
+//
+//	filters.Join(filters.Recompress(nil), rewriter, filters.Decompress(nil))
+func Decompress(decoders map[string]Decoder) Filter {
+	all := make(map[string]Decoder, len(DefaultDecoders)+len(decoders))
+	for coding, decoder := range DefaultDecoders {
+		all[coding] = decoder
+	}
+	for coding, decoder := range decoders {
+		all[strings.ToLower(coding)] = decoder
+	}
+
+	return FilterFunc(func(ctx Context, req *http.Request, next Next) (*http.Response, Context, error) {
+		if req.Method == http.MethodConnect {
+			return next(ctx, req)
+		}
+		if acceptEncoding := req.Header.Get("Accept-Encoding"); acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", supportedCodings(acceptEncoding, all))
+			if req.Header.Get("Accept-Encoding") == "" {
+				req.Header.Del("Accept-Encoding")
+			}
+		}
+
+		resp, nextCtx, err := next(ctx, req)
+		if err != nil || resp == nil || !hasBody(req, resp) {
+			return resp, nextCtx, err
+		}
+		coding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+		decoder := all[coding]
+		if decoder == nil {
+			// Identity, unknown or multiple codings, leave alone
+			return resp, nextCtx, err
+		}
+		decoded, decodeErr := decoder(resp.Body)
+		if decodeErr != nil {
+			// The decoder may have consumed part of the body, so it can't be
+			// passed through
+			resp.Body.Close()
+			return Fail(ctx, req, http.StatusBadGateway, decodeErr)
+		}
+		resp.Body = &decodedBody{ReadCloser: decoded, orig: resp.Body}
+		resp.Header.Del("Content-Encoding")
+		chunk(resp)
+		if nextCtx == nil {
+			nextCtx = ctx
+		}
+		return resp, nextCtx.WithValue(ctxKeyContentEncoding, coding), err
+	})
+}
+
+// Recompress returns a Filter that re-encodes responses decoded by Decompress
+// with their original content coding, provided that the client accepts it and
+// there is an encoder for it (DefaultEncoders plus the given ones). Otherwise,
+// responses are sent to the client unencoded.
+func Recompress(encoders map[string]Encoder) Filter {
+	all := make(map[string]Encoder, len(DefaultEncoders)+len(encoders))
+	for coding, encoder := range DefaultEncoders {
+		all[coding] = encoder
+	}
+	for coding, encoder := range encoders {
+		all[strings.ToLower(coding)] = encoder
+	}
+
+	return FilterFunc(func(ctx Context, req *http.Request, next Next) (*http.Response, Context, error) {
+		acceptEncoding := req.Header.Get("Accept-Encoding")
+		resp, nextCtx, err := next(ctx, req)
+		if err != nil || resp == nil || nextCtx == nil {
+			return resp, nextCtx, err
+		}
+		coding, _ := nextCtx.Value(ctxKeyContentEncoding).(string)
+		encoder := all[coding]
+		if encoder == nil || !hasBody(req, resp) || !accepts(acceptEncoding, coding) {
+			return resp, nextCtx, err
+		}
+
+		body := resp.Body
+		pr, pw := io.Pipe()
+		go func() {
+			defer body.Close()
+			enc, encErr := encoder(pw)
+			if encErr == nil {
+				_, encErr = io.Copy(enc, body)
+				if closeErr := enc.Close(); encErr == nil {
+					encErr = closeErr
+				}
+			}
+			pw.CloseWithError(encErr)
+		}()
+		resp.Body = pr
+		resp.Header.Set("Content-Encoding", coding)
+		chunk(resp)
+		return resp, nextCtx, err
+	})
+}
+
+// chunk prepares resp for a body of unknown length.
+func chunk(resp *http.Response) {
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.TransferEncoding = []string{"chunked"}
+}
+
+type decodedBody struct {
+	io.ReadCloser
+	orig io.ReadCloser
+}
+
+func (b *decodedBody) Close() error {
+	b.ReadCloser.Close()
+	return b.orig.Close()
+}
+
+func hasBody(req *http.Request, resp *http.Response) bool {
+	if req.Method == http.MethodHead || resp.Body == nil || resp.Body == http.NoBody {
+		return false
+	}
+	return resp.StatusCode >= 200 && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified
+}
+
+// supportedCodings filters the codings in an Accept-Encoding header down to
+// identity and those with decoders.
+func supportedCodings(acceptEncoding string, decoders map[string]Decoder) string {
+	var supported []string
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		part = strings.TrimSpace(part)
+		coding := strings.ToLower(strings.TrimSpace(strings.SplitN(part, ";", 2)[0]))
+		if coding == "identity" || decoders[coding] != nil {
+			supported = append(supported, part)
+		}
+	}
+	return strings.Join(supported, ", ")
+}
+
+// accepts determines whether an Accept-Encoding header allows coding.
+func accepts(acceptEncoding string, coding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name != coding && name != "*" {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.Replace(strings.TrimSpace(param), " ", "", -1)
+			if param == "q=0" || param == "q=0.0" || param == "q=0.00" || param == "q=0.000" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
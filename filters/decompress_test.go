@@ -0,0 +1,83 @@
+package filters
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func gzipped(t *testing.T, s string) []byte {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	w.Write([]byte(s))
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestDecompressRecompress(t *testing.T) {
+	var upstreamAcceptEncoding string
+	var inspected string
+	upstream := func(ctx Context, req *http.Request) (*http.Response, Context, error) {
+		upstreamAcceptEncoding = req.Header.Get("Accept-Encoding")
+		body := gzipped(t, "hello world")
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Encoding": {"gzip"}, "Content-Length": {"99"}},
+			Body:          ioutil.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+		}, ctx, nil
+	}
+	inspector := FilterFunc(func(ctx Context, req *http.Request, next Next) (*http.Response, Context, error) {
+		resp, nextCtx, err := next(ctx, req)
+		body, _ := ioutil.ReadAll(resp.Body)
+		inspected = string(body)
+		resp.Body = ioutil.NopCloser(bytes.NewReader(bytes.Replace(body, []byte("world"), []byte("there"), 1)))
+		return resp, nextCtx, err
+	})
+	chain := Join(Recompress(nil), inspector, Decompress(nil))
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Accept-Encoding", "br, gzip;q=0.8")
+	resp, _, err := chain.Apply(BackgroundContext(), req, upstream)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "gzip;q=0.8", upstreamAcceptEncoding, "Only decodable codings should be requested")
+	assert.Equal(t, "hello world", inspected)
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Empty(t, resp.Header.Get("Content-Length"))
+	assert.EqualValues(t, -1, resp.ContentLength)
+	gr, err := gzip.NewReader(resp.Body)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(gr)
+		assert.Equal(t, "hello there", string(body))
+	}
+
+	// Client that doesn't accept gzip gets identity
+	req, _ = http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Accept-Encoding", "gzip;q=0")
+	resp, _, err = chain.Apply(BackgroundContext(), req, upstream)
+	if assert.NoError(t, err) {
+		assert.Empty(t, resp.Header.Get("Content-Encoding"))
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "hello there", string(body))
+	}
+}
+
+func TestDecompressCorrupt(t *testing.T) {
+	upstream := func(ctx Context, req *http.Request) (*http.Response, Context, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Encoding": {"gzip"}},
+			Body:       ioutil.NopCloser(bytes.NewReader([]byte("not gzip"))),
+		}, ctx, nil
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	resp, _, err := Decompress(nil).Apply(BackgroundContext(), req, upstream)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
@@ -1,3 +1,9 @@
+// Package filters provides the Filter API used by proxy to intercept requests
+// and responses. Filters are composed with Join into a Chain and run around
+// both CONNECT and forwarded requests. Each filter may modify the request,
+// short-circuit with its own response, or call next and modify the response.
+// The Context returned from next carries values set further down the chain
+// (and by the proxy itself) back up to earlier filters.
 package filters
 
 import (
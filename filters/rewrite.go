@@ -0,0 +1,277 @@
+package filters
+
+import (
+	"bufio"
+	"bytes"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultMaxMatchLength = 1024
+	rewriteReadSize       = 32 << 10
+)
+
+// DefaultRewriteContentTypes are the media types whose bodies Rewrite
+// rewrites unless configured otherwise.
+var DefaultRewriteContentTypes = []string{
+	"text/html",
+	"text/css",
+	"text/plain",
+	"text/javascript",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"application/xhtml+xml",
+}
+
+// Replacement is a find/replace applied to response bodies as they stream
+// through, see Rewrite.
+type Replacement struct {
+	// Pattern matches the text to replace. Patterns are applied to raw body
+	// bytes, so they should only match ASCII or UTF-8. Since bodies are
+	// matched piece by piece, anchors like ^ and \A aren't meaningful.
+	Pattern *regexp.Regexp
+
+	// With replaces each match, with $1 and the like expanded as by
+	// regexp.Expand. It's ignored if Func is specified.
+	With string
+
+	// Func, if specified, computes the replacement for each match.
+	Func func(match []byte) []byte
+
+	// MaxMatchLength bounds the length of the text that Pattern matches,
+	// defaults to 1KB. Since matches may straddle the chunks in which bodies
+	// arrive, this much of the body is held back until more of it arrives,
+	// which also bounds the memory used per body.
+	MaxMatchLength int
+}
+
+// ReplaceString returns a Replacement of the literal text old with new.
+func ReplaceString(old, new string) *Replacement {
+	return &Replacement{
+		Pattern:        regexp.MustCompile(regexp.QuoteMeta(old)),
+		Func:           func([]byte) []byte { return []byte(new) },
+		MaxMatchLength: len(old),
+	}
+}
+
+var htmlURLAttribute = regexp.MustCompile(`(?i)(\s(?:href|src|action|poster|formaction)\s*=\s*)("[^"]*"|'[^']*')`)
+
+// RewriteHTMLURLs returns a Replacement that rewrites the URLs in the href,
+// src, action, poster and formaction attributes of HTML with rewrite, which
+// receives and returns unescaped URLs. Only quoted attribute values of up to
+// about 4KB are rewritten.
+func RewriteHTMLURLs(rewrite func(url string) string) *Replacement {
+	return &Replacement{
+		Pattern: htmlURLAttribute,
+		Func: func(match []byte) []byte {
+			parts := htmlURLAttribute.FindSubmatch(match)
+			quoted := parts[2]
+			quote, value := quoted[:1], string(quoted[1:len(quoted)-1])
+			rewritten := html.EscapeString(rewrite(html.UnescapeString(value)))
+			result := append([]byte(nil), parts[1]...)
+			result = append(result, quote...)
+			result = append(result, rewritten...)
+			return append(result, quote...)
+		},
+		MaxMatchLength: 4096,
+	}
+}
+
+// RewriteOpts configures Rewrite.
+type RewriteOpts struct {
+	// Replacements are applied to bodies in order.
+	Replacements []*Replacement
+
+	// ContentTypes are the media types whose bodies are rewritten, defaults to
+	// DefaultRewriteContentTypes.
+	ContentTypes []string
+}
+
+// Rewrite returns a Filter that rewrites the bodies of responses as they
+// stream through, without buffering them in full, for both forwarded and
+// MITM'ed requests. Rewritten responses are sent chunked. Only bodies in an
+// ASCII compatible charset (going by Content-Type, HTML meta tags and byte
+// order marks) are rewritten. Encoded bodies are left alone, so place
+// Decompress after Rewrite in the chain to rewrite those, e.g.
+//
+//	filters.Join(filters.Recompress(nil), filters.Rewrite(opts), filters.Decompress(nil))
+func Rewrite(opts *RewriteOpts) Filter {
+	contentTypes := opts.ContentTypes
+	if len(contentTypes) == 0 {
+		contentTypes = DefaultRewriteContentTypes
+	}
+	rewritten := make(map[string]bool, len(contentTypes))
+	for _, contentType := range contentTypes {
+		rewritten[strings.ToLower(contentType)] = true
+	}
+
+	return FilterFunc(func(ctx Context, req *http.Request, next Next) (*http.Response, Context, error) {
+		if req.Method == http.MethodConnect {
+			return next(ctx, req)
+		}
+		resp, nextCtx, err := next(ctx, req)
+		if err != nil || resp == nil || !hasBody(req, resp) || len(opts.Replacements) == 0 {
+			return resp, nextCtx, err
+		}
+		if coding := resp.Header.Get("Content-Encoding"); coding != "" && !strings.EqualFold(coding, "identity") {
+			return resp, nextCtx, err
+		}
+		mediaType, params, parseErr := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if parseErr != nil || !rewritten[mediaType] {
+			return resp, nextCtx, err
+		}
+		charset, declared := params["charset"]
+		if declared && !isASCIICompatible(charset) {
+			return resp, nextCtx, err
+		}
+		resp.Body = &rewrittenBody{
+			ReadCloser:   resp.Body,
+			replacements: opts.Replacements,
+			sniffHTML:    !declared && mediaType == "text/html",
+		}
+		chunk(resp)
+		return resp, nextCtx, err
+	})
+}
+
+// rewrittenBody applies replacements to a body, checking its charset on the
+// first read.
+type rewrittenBody struct {
+	io.ReadCloser
+	replacements []*Replacement
+	sniffHTML    bool
+	r            io.Reader
+}
+
+func (b *rewrittenBody) Read(p []byte) (int, error) {
+	if b.r == nil {
+		b.r = b.reader()
+	}
+	return b.r.Read(p)
+}
+
+func (b *rewrittenBody) reader() io.Reader {
+	br := bufio.NewReaderSize(b.ReadCloser, rewriteReadSize)
+	// Sniff whatever arrives first without waiting for more
+	br.Peek(1)
+	sniffed, _ := br.Peek(br.Buffered())
+	if !sniffedASCIICompatible(sniffed, b.sniffHTML) {
+		return br
+	}
+	var r io.Reader = br
+	for _, replacement := range b.replacements {
+		r = newReplacingReader(r, replacement)
+	}
+	return r
+}
+
+var metaCharset = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?([a-z0-9_:.-]+)`)
+
+// sniffedASCIICompatible checks the start of a body for byte order marks and,
+// for HTML, meta tags declaring a charset that isn't ASCII compatible.
+func sniffedASCIICompatible(sniffed []byte, html bool) bool {
+	if bytes.HasPrefix(sniffed, []byte{0xFE, 0xFF}) || bytes.HasPrefix(sniffed, []byte{0xFF, 0xFE}) {
+		// UTF-16 (or UTF-32LE)
+		return false
+	}
+	if html {
+		if len(sniffed) > 1024 {
+			sniffed = sniffed[:1024]
+		}
+		if match := metaCharset.FindSubmatch(sniffed); match != nil {
+			return isASCIICompatible(string(match[1]))
+		}
+	}
+	return true
+}
+
+func isASCIICompatible(charset string) bool {
+	charset = strings.ToLower(strings.TrimSpace(charset))
+	switch {
+	case charset == "utf-8", charset == "utf8", charset == "us-ascii", charset == "ascii", charset == "latin1":
+		return true
+	case strings.HasPrefix(charset, "iso-8859-"), strings.HasPrefix(charset, "windows-125"):
+		return true
+	}
+	return false
+}
+
+// replacingReader applies a Replacement to what it reads from src, holding
+// back MaxMatchLength bytes at a time in case a match continues in data that
+// hasn't arrived yet.
+type replacingReader struct {
+	src         io.Reader
+	replacement *Replacement
+	window      int
+	readBuf     []byte
+	pending     []byte
+	out         bytes.Buffer
+	err         error
+}
+
+func newReplacingReader(src io.Reader, replacement *Replacement) *replacingReader {
+	window := replacement.MaxMatchLength
+	if window <= 0 {
+		window = defaultMaxMatchLength
+	}
+	return &replacingReader{src: src, replacement: replacement, window: window, readBuf: make([]byte, rewriteReadSize)}
+}
+
+func (rr *replacingReader) Read(p []byte) (int, error) {
+	for rr.out.Len() == 0 {
+		if rr.err != nil {
+			return 0, rr.err
+		}
+		n, err := rr.src.Read(rr.readBuf)
+		rr.pending = append(rr.pending, rr.readBuf[:n]...)
+		if err != nil {
+			rr.err = err
+		}
+		rr.process(err != nil)
+	}
+	return rr.out.Read(p)
+}
+
+// process replaces the matches in pending that can't grow any further and
+// moves what's done to out. If final, everything is processed.
+func (rr *replacingReader) process(final bool) {
+	safe := len(rr.pending)
+	if !final {
+		// Any match that starts before safe ends within pending
+		safe -= rr.window
+		if safe <= 0 {
+			return
+		}
+	}
+	cursor := 0
+	for _, match := range rr.replacement.Pattern.FindAllSubmatchIndex(rr.pending, -1) {
+		if match[0] >= safe {
+			break
+		}
+		if match[0] == match[1] {
+			// Empty matches would be found again in the held back data
+			continue
+		}
+		rr.out.Write(rr.pending[cursor:match[0]])
+		rr.out.Write(rr.replace(match))
+		cursor = match[1]
+	}
+	if cursor < safe {
+		rr.out.Write(rr.pending[cursor:safe])
+		cursor = safe
+	}
+	rr.pending = rr.pending[:copy(rr.pending, rr.pending[cursor:])]
+}
+
+func (rr *replacingReader) replace(match []int) []byte {
+	if rr.replacement.Func != nil {
+		return rr.replacement.Func(rr.pending[match[0]:match[1]])
+	}
+	return rr.replacement.Pattern.Expand(nil, []byte(rr.replacement.With), rr.pending, match)
+}
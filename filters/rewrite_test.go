@@ -0,0 +1,91 @@
+package filters
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplacingReader(t *testing.T) {
+	body := strings.Repeat("hello world, ", 1000)
+	for _, replacement := range []*Replacement{
+		ReplaceString("world", "there"),
+		{Pattern: regexp.MustCompile(`w(or)ld`), With: "th${1}e", MaxMatchLength: 5},
+	} {
+		r := newReplacingReader(iotest.OneByteReader(strings.NewReader(body)), replacement)
+		rewritten, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		expected := strings.Replace(body, "world", "there", -1)
+		if replacement.With != "" {
+			expected = strings.Replace(body, "world", "thore", -1)
+		}
+		assert.Equal(t, expected, string(rewritten), "Matches split across reads should be replaced")
+	}
+}
+
+func TestRewriteHTMLURLs(t *testing.T) {
+	replacement := RewriteHTMLURLs(func(url string) string {
+		return strings.Replace(url, "http://example.com", "https://mirror.example.net", 1)
+	})
+	page := `<a href="http://example.com/a?x=1&amp;y=2">a</a><img SRC='http://example.com/b.png'><p>http://example.com/c</p>`
+	rewritten, err := ioutil.ReadAll(newReplacingReader(strings.NewReader(page), replacement))
+	require.NoError(t, err)
+	assert.Equal(t, `<a href="https://mirror.example.net/a?x=1&amp;y=2">a</a><img SRC='https://mirror.example.net/b.png'><p>http://example.com/c</p>`, string(rewritten))
+}
+
+func TestRewrite(t *testing.T) {
+	respond := func(contentType string, header http.Header, body []byte) Next {
+		return func(ctx Context, req *http.Request) (*http.Response, Context, error) {
+			if header == nil {
+				header = make(http.Header)
+			}
+			header.Set("Content-Type", contentType)
+			header.Set("Content-Length", "99")
+			return &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        header,
+				Body:          ioutil.NopCloser(bytes.NewReader(body)),
+				ContentLength: int64(len(body)),
+			}, ctx, nil
+		}
+	}
+	rewrite := Rewrite(&RewriteOpts{Replacements: []*Replacement{ReplaceString("cat", "dog"), ReplaceString("dog", "bird")}})
+	get := func(next Next) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		resp, _, err := rewrite.Apply(BackgroundContext(), req, next)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	resp, body := get(respond("text/html; charset=UTF-8", nil, []byte("my cat")))
+	assert.Equal(t, "my bird", body, "Replacements should apply in order")
+	assert.EqualValues(t, -1, resp.ContentLength)
+	assert.Empty(t, resp.Header.Get("Content-Length"))
+
+	_, body = get(respond("image/png", nil, []byte("my cat")))
+	assert.Equal(t, "my cat", body, "Other content types should be left alone")
+
+	_, body = get(respond("text/plain", http.Header{"Content-Encoding": {"gzip"}}, []byte("my cat")))
+	assert.Equal(t, "my cat", body, "Encoded bodies should be left alone")
+
+	_, body = get(respond("text/plain; charset=utf-16", nil, []byte("my cat")))
+	assert.Equal(t, "my cat", body, "Other charsets should be left alone")
+
+	_, body = get(respond("text/plain", nil, []byte("\xff\xfemy cat")))
+	assert.Equal(t, "\xff\xfemy cat", body, "UTF-16 byte order marks should be detected")
+
+	_, body = get(respond("text/html", nil, []byte(`<meta charset="shift_jis">my cat`)))
+	assert.Equal(t, `<meta charset="shift_jis">my cat`, body, "HTML meta charset should be detected")
+
+	_, body = get(respond("text/html", nil, []byte(`<meta charset="utf-8">my cat`)))
+	assert.Equal(t, `<meta charset="utf-8">my bird`, body)
+}
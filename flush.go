@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"bufio"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// flushInterval determines how often resp needs to be flushed downstream
+// while its body is being written, using the same conventions as
+// httputil.ReverseProxy: negative flushes after every write and zero only
+// flushes once the whole response has been written. Unless configured
+// otherwise, streaming responses (server-sent events and bodies of unknown
+// length) are flushed after every write.
+func (proxy *proxy) flushInterval(resp *http.Response) time.Duration {
+	if proxy.FlushInterval != 0 {
+		return proxy.FlushInterval
+	}
+	if resp.Body == nil || resp.Body == http.NoBody {
+		return 0
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "text/event-stream" {
+		return -1
+	}
+	if resp.ContentLength == -1 {
+		return -1
+	}
+	return 0
+}
+
+// maxLatencyWriter writes to a bufio.Writer, making sure that written data
+// is flushed within latency, or immediately if latency is negative.
+type maxLatencyWriter struct {
+	latency time.Duration
+
+	mx      sync.Mutex
+	w       *bufio.Writer
+	timer   *time.Timer
+	pending bool
+}
+
+func (m *maxLatencyWriter) Write(b []byte) (int, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	n, err := m.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	if m.latency < 0 {
+		return n, m.w.Flush()
+	}
+	if !m.pending {
+		m.pending = true
+		if m.timer == nil {
+			m.timer = time.AfterFunc(m.latency, m.delayedFlush)
+		} else {
+			m.timer.Reset(m.latency)
+		}
+	}
+	return n, nil
+}
+
+func (m *maxLatencyWriter) delayedFlush() {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if !m.pending {
+		// stopped or already flushed
+		return
+	}
+	if err := m.w.Flush(); err != nil {
+		log.Tracef("Unable to flush response downstream: %v", err)
+	}
+	m.pending = false
+}
+
+// stop stops periodic flushing. The caller is responsible for the final
+// flush.
+func (m *maxLatencyWriter) stop() {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.pending = false
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func streamingClient(t *testing.T, opts *Opts) (*http.Client, func()) {
+	opts.Dial = func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		return net.Dial(network, addr)
+	}
+	l := serveProxy(t, opts)
+	proxyURL, _ := url.Parse("http://" + l.Addr().String())
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	return &http.Client{Transport: tr, Timeout: 5 * time.Second}, func() {
+		tr.CloseIdleConnections()
+		l.Close()
+	}
+}
+
+func TestFlushServerSentEvents(t *testing.T) {
+	done := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-done
+		io.WriteString(w, "data: second\n\n")
+	}))
+	defer origin.Close()
+	defer close(done)
+
+	client, stop := streamingClient(t, &Opts{})
+	defer stop()
+	resp, err := client.Get(origin.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	line, err := readLineWithin(bufio.NewReader(resp.Body), time.Second)
+	require.NoError(t, err, "First event should arrive before the response completes")
+	assert.Equal(t, "data: first\n", line)
+}
+
+func TestFlushInterval(t *testing.T) {
+	done := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Length", "12")
+		io.WriteString(w, "first\n")
+		w.(http.Flusher).Flush()
+		<-done
+		io.WriteString(w, "last!\n")
+	}))
+	defer origin.Close()
+	defer close(done)
+
+	client, stop := streamingClient(t, &Opts{FlushInterval: 10 * time.Millisecond})
+	defer stop()
+	resp, err := client.Get(origin.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	line, err := readLineWithin(bufio.NewReader(resp.Body), time.Second)
+	require.NoError(t, err, "Partial body should have been flushed")
+	assert.Equal(t, "first\n", line)
+}
+
+func TestStreamRequestBody(t *testing.T) {
+	received := make(chan string, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		line, _ := bufio.NewReader(req.Body).ReadString('\n')
+		received <- line
+		ioutil.ReadAll(req.Body)
+	}))
+	defer origin.Close()
+
+	client, stop := streamingClient(t, &Opts{})
+	defer stop()
+	pr, pw := io.Pipe()
+	go func() {
+		io.WriteString(pw, "chunk 1\n")
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+		}
+		pw.Close()
+	}()
+
+	errCh := make(chan error, 1)
+	go func() {
+		resp, err := client.Post(origin.URL, "application/octet-stream", pr)
+		if err == nil {
+			resp.Body.Close()
+		}
+		errCh <- err
+	}()
+
+	select {
+	case line := <-received:
+		assert.Equal(t, "chunk 1\n", line)
+		received <- line
+	case <-time.After(time.Second):
+		t.Fatal("Origin should have received the first chunk before the body was complete")
+	}
+	assert.NoError(t, <-errCh)
+}
+
+func readLineWithin(r *bufio.Reader, timeout time.Duration) (string, error) {
+	type result struct {
+		line string
+		err  error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		line, err := r.ReadString('\n')
+		resultCh <- result{line, err}
+	}()
+	select {
+	case res := <-resultCh:
+		return res.line, res.err
+	case <-time.After(timeout):
+		return "", context.DeadlineExceeded
+	}
+}
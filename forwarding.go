@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// anonymizedHeaders are request headers that identify the client or the
+// proxies in front of it.
+var anonymizedHeaders = []string{
+	"Client-Ip",
+	"Forwarded",
+	"From",
+	"True-Client-Ip",
+	"X-Client-Ip",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+}
+
+// ForwardingOptions controls how the headers of forwarded (non-CONNECT)
+// requests are rewritten. Hop-by-hop headers are always stripped. Without
+// ForwardingOptions, a client's Proxy-Connection header is passed upstream as
+// Connection for compatibility.
+type ForwardingOptions struct {
+	// Via, if specified, is the pseudonym with which the proxy identifies
+	// itself in the Via header appended to each request, e.g. "myproxy".
+	Via string
+
+	// AddXForwardedFor appends the client's IP to X-Forwarded-For. Any
+	// X-Forwarded-For sent by the client is only kept if the client's IP falls
+	// within TrustedProxies.
+	AddXForwardedFor bool
+
+	// AddXForwardedHostAndProto sets X-Forwarded-Host and X-Forwarded-Proto to
+	// the host and scheme requested by the client. If the client's IP falls
+	// within TrustedProxies, the values it sent (if any) are kept instead.
+	AddXForwardedHostAndProto bool
+
+	// AddForwarded appends an element describing the client's IP, the scheme
+	// and the host it requested to the standard Forwarded header (RFC 7239),
+	// e.g. "for=1.2.3.4;proto=http;host=example.com". Any Forwarded header
+	// sent by the client is only kept if the client's IP falls within
+	// TrustedProxies.
+	AddForwarded bool
+
+	// TrustedProxies are the networks of downstream proxies whose
+	// Forwarded and X-Forwarded-* headers are trusted.
+	TrustedProxies []*net.IPNet
+
+	// Anonymize removes headers that identify the client, like From,
+	// Forwarded, X-Forwarded-For and X-Real-IP, and disables adding any of
+	// them.
+	Anonymize bool
+}
+
+// apply rewrites the headers of req, which has already been prepared for
+// forwarding. protoMajor and protoMinor are the protocol version with which
+// the request was received, proto and host are the scheme and host that the
+// client requested.
+func (fo *ForwardingOptions) apply(req *http.Request, protoMajor int, protoMinor int, proto string, host string) {
+	// Connection has already been processed, what's left was translated from
+	// Proxy-Connection
+	req.Header.Del("Connection")
+
+	if fo.Anonymize {
+		for _, header := range anonymizedHeaders {
+			req.Header.Del(header)
+		}
+	} else {
+		clientIP := clientIPFromAddr(req.RemoteAddr)
+		trusted := fo.trusts(clientIP)
+		if fo.AddXForwardedFor {
+			var forwardedFor string
+			if clientIP != nil {
+				forwardedFor = clientIP.String()
+			}
+			appendForwardingHeader(req.Header, "X-Forwarded-For", trusted, forwardedFor)
+		}
+		if fo.AddXForwardedHostAndProto {
+			if !trusted || req.Header.Get("X-Forwarded-Host") == "" {
+				req.Header.Set("X-Forwarded-Host", host)
+			}
+			if !trusted || req.Header.Get("X-Forwarded-Proto") == "" {
+				req.Header.Set("X-Forwarded-Proto", proto)
+			}
+		}
+		if fo.AddForwarded {
+			appendForwardingHeader(req.Header, "Forwarded", trusted, forwardedElement(clientIP, proto, host))
+		}
+	}
+
+	if fo.Via != "" {
+		via := fmt.Sprintf("%d.%d %s", protoMajor, protoMinor, fo.Via)
+		if prior := req.Header["Via"]; len(prior) > 0 {
+			via = strings.Join(prior, ", ") + ", " + via
+		}
+		req.Header.Set("Via", via)
+	}
+}
+
+// appendForwardingHeader appends value (if any) to the list in the given
+// header, dropping what the client sent unless it's trusted.
+func appendForwardingHeader(header http.Header, name string, trusted bool, value string) {
+	prior := header[name]
+	if !trusted {
+		prior = nil
+	}
+	header.Del(name)
+	if value != "" {
+		prior = append(prior, value)
+	}
+	if len(prior) > 0 {
+		header.Set(name, strings.Join(prior, ", "))
+	}
+}
+
+// forwardedElement builds a Forwarded element as defined in RFC 7239 section
+// 4.
+func forwardedElement(clientIP net.IP, proto string, host string) string {
+	forwardedFor := "unknown"
+	if clientIP != nil {
+		if clientIP.To4() == nil {
+			forwardedFor = "[" + clientIP.String() + "]"
+		} else {
+			forwardedFor = clientIP.String()
+		}
+	}
+	pairs := []string{"for=" + forwardedValue(forwardedFor)}
+	if proto != "" {
+		pairs = append(pairs, "proto="+forwardedValue(proto))
+	}
+	if host != "" {
+		pairs = append(pairs, "host="+forwardedValue(host))
+	}
+	return strings.Join(pairs, ";")
+}
+
+// forwardedValue returns value as a token, or as a quoted string if it
+// contains characters that aren't allowed in tokens (like the colons of ports
+// and IPv6 addresses).
+func forwardedValue(value string) string {
+	for _, c := range value {
+		if !isTokenChar(c) {
+			return strconv.Quote(value)
+		}
+	}
+	return value
+}
+
+func isTokenChar(c rune) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
+
+func (fo *ForwardingOptions) trusts(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range fo.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newForwardingRequest(remoteAddr string) *http.Request {
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = remoteAddr
+	req.Header.Set("Connection", "keep-alive, X-Custom")
+	req.Header.Set("X-Custom", "hop")
+	req.Header.Set("Proxy-Connection", "close")
+	req.Header.Set("Te", "trailers")
+	req.Header.Set("Trailer", "X-Checksum")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	req.Header.Set("X-Real-Ip", "10.0.0.1")
+	req.Header.Set("From", "user@example.com")
+	req.Header.Set("Via", "1.1 other")
+	return req
+}
+
+func TestForwardingHopByHop(t *testing.T) {
+	req := prepareRequest(newForwardingRequest("1.2.3.4:5678"), nil)
+	for _, header := range []string{"X-Custom", "Te", "Trailer", "Proxy-Connection"} {
+		assert.Empty(t, req.Header.Get(header), header)
+	}
+	assert.Equal(t, "close", req.Header.Get("Connection"), "Without ForwardingOptions, Proxy-Connection should be translated")
+	assert.Equal(t, "10.0.0.1", req.Header.Get("X-Forwarded-For"))
+
+	req = prepareRequest(newForwardingRequest("1.2.3.4:5678"), &ForwardingOptions{})
+	assert.Empty(t, req.Header.Get("Connection"))
+}
+
+func TestForwardingXForwardedFor(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("1.2.3.0/24")
+	fo := &ForwardingOptions{
+		Via:              "test",
+		AddXForwardedFor: true,
+		TrustedProxies:   []*net.IPNet{trusted},
+	}
+
+	req := prepareRequest(newForwardingRequest("1.2.3.4:5678"), fo)
+	assert.Equal(t, "10.0.0.1, 1.2.3.4", req.Header.Get("X-Forwarded-For"), "Trusted client's X-Forwarded-For should be kept")
+	assert.Equal(t, "1.1 other, 1.1 test", req.Header.Get("Via"))
+
+	req = prepareRequest(newForwardingRequest("5.6.7.8:5678"), fo)
+	assert.Equal(t, "5.6.7.8", req.Header.Get("X-Forwarded-For"), "Untrusted client's X-Forwarded-For should be replaced")
+}
+
+func TestForwardingAnonymize(t *testing.T) {
+	req := prepareRequest(newForwardingRequest("1.2.3.4:5678"), &ForwardingOptions{Anonymize: true, AddXForwardedFor: true})
+	for _, header := range []string{"X-Forwarded-For", "X-Real-Ip", "From"} {
+		assert.Empty(t, req.Header.Get(header), header)
+	}
+	assert.Equal(t, "1.1 other", req.Header.Get("Via"))
+}
+
+func TestForwardingForwarded(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("1.2.3.0/24")
+	fo := &ForwardingOptions{
+		AddForwarded:              true,
+		AddXForwardedHostAndProto: true,
+		TrustedProxies:            []*net.IPNet{trusted},
+	}
+	newRequest := func(remoteAddr string) *http.Request {
+		req := newForwardingRequest(remoteAddr)
+		req.Host = "example.com:8080"
+		req.Header.Set("Forwarded", "for=10.0.0.1;proto=https")
+		req.Header.Set("X-Forwarded-Host", "original.com")
+		return req
+	}
+
+	req := prepareRequest(newRequest("1.2.3.4:5678"), fo)
+	assert.Equal(t, `for=10.0.0.1;proto=https, for=1.2.3.4;proto=http;host="example.com:8080"`, req.Header.Get("Forwarded"), "Trusted client's Forwarded should be appended to")
+	assert.Equal(t, "original.com", req.Header.Get("X-Forwarded-Host"), "Trusted client's X-Forwarded-Host should be kept")
+	assert.Equal(t, "http", req.Header.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "10.0.0.1", req.Header.Get("X-Forwarded-For"), "X-Forwarded-For shouldn't be changed unless enabled")
+
+	req = prepareRequest(newRequest("[2001:db8::1]:5678"), fo)
+	assert.Equal(t, `for="[2001:db8::1]";proto=http;host="example.com:8080"`, req.Header.Get("Forwarded"), "Untrusted client's Forwarded should be replaced")
+	assert.Equal(t, "example.com:8080", req.Header.Get("X-Forwarded-Host"))
+
+	req = prepareRequest(newRequest(""), fo)
+	assert.Equal(t, `for=unknown;proto=http;host="example.com:8080"`, req.Header.Get("Forwarded"))
+
+	req = prepareRequest(newRequest("1.2.3.4:5678"), &ForwardingOptions{AddForwarded: true, Anonymize: true})
+	assert.Empty(t, req.Header.Get("Forwarded"))
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	ctxKeyClientGeo = contextKey("clientGeo")
+)
+
+// GeoInfo describes where an IP address is located.
+type GeoInfo struct {
+	// Country is the ISO 3166-1 alpha-2 code of the country, e.g. "US", if
+	// known
+	Country string
+
+	// ASN is the number of the autonomous system that announces the IP, if
+	// known
+	ASN uint
+
+	// ASOrg is the organization that operates the autonomous system, if known
+	ASOrg string
+}
+
+// GeoIP looks up where IP addresses are located, see OpenMaxMind.
+type GeoIP interface {
+	// Lookup returns what's known about ip, or nil if nothing is.
+	Lookup(ip net.IP) (*GeoInfo, error)
+}
+
+// GeoIPFunc adapts a function to a GeoIP
+type GeoIPFunc func(ip net.IP) (*GeoInfo, error)
+
+// Lookup implements the interface GeoIP
+func (f GeoIPFunc) Lookup(ip net.IP) (*GeoInfo, error) {
+	return f(ip)
+}
+
+// clientGeo looks up the client of a connection at most once.
+type clientGeo struct {
+	geo  GeoIP
+	ip   net.IP
+	once sync.Once
+	info *GeoInfo
+}
+
+// withClientGeo allows looking up the client at clientIP with ClientGeo, if
+// geo is specified.
+func withClientGeo(ctx context.Context, geo GeoIP, clientIP net.IP) context.Context {
+	if geo == nil || clientIP == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, ctxKeyClientGeo, &clientGeo{geo: geo, ip: clientIP})
+}
+
+// ClientGeo returns what Opts.GeoIP knows about the location of the client
+// that sent the current request, or nil if GeoIP isn't configured or doesn't
+// know. The lookup happens once per connection.
+func ClientGeo(ctx context.Context) *GeoInfo {
+	cg, _ := ctx.Value(ctxKeyClientGeo).(*clientGeo)
+	if cg == nil {
+		return nil
+	}
+	cg.once.Do(func() {
+		info, err := cg.geo.Lookup(cg.ip)
+		if err != nil {
+			log.Debugf("Unable to look up location of %v: %v", cg.ip, err)
+			return
+		}
+		cg.info = info
+	})
+	return cg.info
+}
+
+// AllowClientCountries returns an AccessControl that only allows clients that
+// geo locates in one of the given countries (ISO 3166-1 alpha-2 codes).
+// Clients whose location is unknown are denied.
+func AllowClientCountries(geo GeoIP, countries ...string) AccessControl {
+	allowed := countrySet(countries)
+	return AccessControlFunc(func(ctx context.Context, clientIP net.IP, dest *Destination) error {
+		country := lookupCountry(geo, clientIP)
+		if !allowed[country] {
+			return errors.New("Clients from %v are not allowed", unknownIfEmpty(country))
+		}
+		return nil
+	})
+}
+
+// DenyClientCountries returns an AccessControl that denies clients that geo
+// locates in any of the given countries (ISO 3166-1 alpha-2 codes).
+func DenyClientCountries(geo GeoIP, countries ...string) AccessControl {
+	denied := countrySet(countries)
+	return AccessControlFunc(func(ctx context.Context, clientIP net.IP, dest *Destination) error {
+		if country := lookupCountry(geo, clientIP); denied[country] {
+			return errors.New("Clients from %v are not allowed", country)
+		}
+		return nil
+	})
+}
+
+// DenyDestinationCountries returns an AccessControl that denies access to
+// destinations that geo locates in any of the given countries (ISO 3166-1
+// alpha-2 codes). Hostnames are resolved and denied if any of their addresses
+// is located in one of these countries.
+func DenyDestinationCountries(geo GeoIP, countries ...string) AccessControl {
+	denied := countrySet(countries)
+	return denyDestinationGeo(geo, func(info *GeoInfo) bool {
+		return denied[strings.ToUpper(info.Country)]
+	})
+}
+
+// DenyDestinationASNs returns an AccessControl that denies access to
+// destinations in any of the given autonomous systems, according to geo.
+// Hostnames are resolved and denied if any of their addresses is in one of
+// them.
+func DenyDestinationASNs(geo GeoIP, asns ...uint) AccessControl {
+	denied := make(map[uint]bool, len(asns))
+	for _, asn := range asns {
+		denied[asn] = true
+	}
+	return denyDestinationGeo(geo, func(info *GeoInfo) bool {
+		return denied[info.ASN]
+	})
+}
+
+func denyDestinationGeo(geo GeoIP, deny func(info *GeoInfo) bool) AccessControl {
+	return AccessControlFunc(func(ctx context.Context, clientIP net.IP, dest *Destination) error {
+		ips, err := dest.IPs(ctx)
+		if err != nil {
+			return errors.New("Unable to resolve %v: %v", dest.Host, err)
+		}
+		for _, ip := range ips {
+			info, err := geo.Lookup(ip)
+			if err != nil {
+				return errors.New("Unable to look up location of %v: %v", ip, err)
+			}
+			if info != nil && deny(info) {
+				return errors.New("Access to %v (%v) is not allowed: %v", dest.Host, ip, ErrBlocked)
+			}
+		}
+		return nil
+	})
+}
+
+func lookupCountry(geo GeoIP, ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	info, err := geo.Lookup(ip)
+	if err != nil {
+		log.Debugf("Unable to look up location of %v: %v", ip, err)
+		return ""
+	}
+	if info == nil {
+		return ""
+	}
+	return strings.ToUpper(info.Country)
+}
+
+func countrySet(countries []string) map[string]bool {
+	set := make(map[string]bool, len(countries))
+	for _, country := range countries {
+		set[strings.ToUpper(country)] = true
+	}
+	return set
+}
+
+func unknownIfEmpty(country string) string {
+	if country == "" {
+		return "unknown locations"
+	}
+	return country
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testGeo = GeoIPFunc(func(ip net.IP) (*GeoInfo, error) {
+	switch ip.String() {
+	case "127.0.0.1":
+		return &GeoInfo{Country: "nz"}, nil
+	case "1.1.1.1":
+		return &GeoInfo{Country: "AU", ASN: 13335}, nil
+	case "8.8.8.8":
+		return &GeoInfo{Country: "US", ASN: 15169}, nil
+	}
+	return nil, nil
+})
+
+func TestGeoAccessControls(t *testing.T) {
+	check := func(ac AccessControl, clientIP string, addr string) error {
+		dest, err := parseDestination(addr, 0)
+		require.NoError(t, err)
+		return ac.Check(context.Background(), net.ParseIP(clientIP), dest)
+	}
+
+	allow := AllowClientCountries(testGeo, "au", "NZ")
+	assert.NoError(t, check(allow, "1.1.1.1", "8.8.8.8:53"))
+	assert.NoError(t, check(allow, "127.0.0.1", "8.8.8.8:53"))
+	assert.Error(t, check(allow, "8.8.8.8", "8.8.8.8:53"))
+	assert.Error(t, check(allow, "9.9.9.9", "8.8.8.8:53"), "Unknown clients should be denied")
+
+	deny := DenyClientCountries(testGeo, "US")
+	assert.Error(t, check(deny, "8.8.8.8", "1.1.1.1:53"))
+	assert.NoError(t, check(deny, "9.9.9.9", "1.1.1.1:53"))
+
+	denyDest := DenyDestinationCountries(testGeo, "us")
+	assert.Error(t, check(denyDest, "1.1.1.1", "8.8.8.8:53"))
+	assert.NoError(t, check(denyDest, "1.1.1.1", "1.1.1.1:53"))
+	assert.Equal(t, http.StatusForbidden, ErrorStatus(check(denyDest, "1.1.1.1", "8.8.8.8:53")))
+
+	denyASN := DenyDestinationASNs(testGeo, 13335)
+	assert.Error(t, check(denyASN, "8.8.8.8", "1.1.1.1:443"))
+	assert.NoError(t, check(denyASN, "8.8.8.8", "8.8.8.8:443"))
+}
+
+func TestClientGeo(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	var lookups int32
+	countries := make(chan string, 1)
+	l := serveProxy(t, &Opts{
+		GeoIP: GeoIPFunc(func(ip net.IP) (*GeoInfo, error) {
+			atomic.AddInt32(&lookups, 1)
+			return testGeo(ip)
+		}),
+		Filter: filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+			ClientGeo(ctx)
+			if info := ClientGeo(ctx); info != nil {
+				countries <- info.Country
+			}
+			return next(ctx, req)
+		}),
+	})
+	defer l.Close()
+
+	conn, _, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+	conn.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "nz", <-countries)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&lookups), "Client should only be looked up once")
+
+	assert.Nil(t, ClientGeo(context.Background()))
+}
@@ -22,4 +22,5 @@ require (
 	github.com/google/go-cmp v0.5.2 // indirect
 	github.com/mitchellh/go-server-timing v1.0.0
 	github.com/stretchr/testify v1.5.1
+	gopkg.in/yaml.v2 v2.2.2
 )
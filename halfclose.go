@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/getlantern/netx"
+)
+
+const halfCloseStopTimeout = 1 * time.Second
+
+// closeWriter is implemented by connections that can be half-closed, like
+// *net.TCPConn and *tls.Conn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWriterOf finds the connection underlying conn that can be half-closed,
+// if any. Wrappers are assumed to write through to the wrapped connection
+// synchronously.
+func closeWriterOf(conn net.Conn) closeWriter {
+	var cw closeWriter
+	netx.WalkWrapped(conn, func(wrapped net.Conn) bool {
+		cw, _ = wrapped.(closeWriter)
+		return cw == nil
+	})
+	return cw
+}
+
+// halfCloseCopy copies data between upstream and downstream in both
+// directions. Unlike BidiCopy, once one side is done sending, the other side's
+// write half is closed and copying continues in the opposite direction until
+// that's done too, so protocols that rely on half-closes keep working. If
+// copying fails in one direction, or the write half can't be closed, the other
+// direction is given a short grace period like with BidiCopy. Each direction
+// is copied with vectoredCopy using its own buffers.
+func halfCloseCopy(upstream net.Conn, downstream net.Conn, upstreamCW closeWriter, downstreamCW closeWriter, bufOut copyBuffers, bufIn copyBuffers) (writeErr error, readErr error) {
+	writeErrCh := make(chan error, 1)
+	readErrCh := make(chan error, 1)
+	go copyHalf(upstream, downstream, upstreamCW, bufOut, writeErrCh)
+	go copyHalf(downstream, upstream, downstreamCW, bufIn, readErrCh)
+	return <-writeErrCh, <-readErrCh
+}
+
+func copyHalf(dst net.Conn, src net.Conn, dstCW closeWriter, buffers copyBuffers, errCh chan error) {
+	_, err := vectoredCopy(dst, src, buffers)
+	if err == nil && dstCW.CloseWrite() == nil {
+		errCh <- nil
+		return
+	}
+	// Unblock the opposite direction, which reads from dst
+	dst.SetReadDeadline(time.Now().Add(halfCloseStopTimeout))
+	errCh <- err
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHalfClose(t *testing.T) {
+	// origin reads the whole request before responding, like a client that
+	// signals the end of its request by half-closing
+	origin, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer origin.Close()
+	go func() {
+		for {
+			conn, err := origin.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := ioutil.ReadAll(conn)
+				if err != nil {
+					return
+				}
+				conn.Write(append([]byte("got "), req...))
+			}()
+		}
+	}()
+
+	test := func(t *testing.T, opts *Opts) {
+		l, err := net.Listen("tcp", "localhost:0")
+		require.NoError(t, err)
+		defer l.Close()
+		go newProxy(opts).Serve(l)
+
+		conn, br, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+		defer conn.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		_, err = conn.Write([]byte("request"))
+		require.NoError(t, err)
+		require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		received, err := ioutil.ReadAll(br)
+		require.NoError(t, err)
+		assert.Equal(t, "got request", string(received))
+	}
+
+	t.Run("spliced", func(t *testing.T) {
+		test(t, &Opts{})
+	})
+	t.Run("copied", func(t *testing.T) {
+		// Counting tunnel stats wraps upstream, which prevents splicing
+		test(t, &Opts{OnTunnelComplete: func(ctx context.Context, stats *TunnelStats) {}})
+	})
+	t.Run("adaptive buffers", func(t *testing.T) {
+		test(t, &Opts{OnTunnelComplete: func(ctx context.Context, stats *TunnelStats) {}, TunnelBuffers: &TunnelBufferOptions{}})
+	})
+}
+
+func TestCloseWriterOf(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, conn, closeWriterOf(&countingConn{Conn: conn}), "Should find wrapped connection")
+	assert.Nil(t, closeWriterOf(&h2Conn{}), "HTTP/2 streams can't be half-closed")
+}
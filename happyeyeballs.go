@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	// DefaultConnectionAttemptDelay is the delay between starting successive
+	// connection attempts recommended by RFC 8305.
+	DefaultConnectionAttemptDelay = 250 * time.Millisecond
+)
+
+// HappyEyeballsDial returns a DialFunc that implements Happy Eyeballs (RFC
+// 8305) on top of dial. Hostnames are resolved using resolver (or the default
+// resolver if nil) and connection attempts to the resulting addresses are
+// started attemptDelay apart, alternating between IPv6 and IPv4 and starting
+// with IPv6. The first successful connection wins and any others are closed. A
+// failed attempt immediately starts the next one. If dial is nil, a plain TCP
+// dialer is used and if attemptDelay is 0, DefaultConnectionAttemptDelay is
+// used.
+func HappyEyeballsDial(dial DialFunc, resolver Resolver, attemptDelay time.Duration) DialFunc {
+	if dial == nil {
+		dialer := &net.Dialer{}
+		dial = func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	if attemptDelay <= 0 {
+		attemptDelay = DefaultConnectionAttemptDelay
+	}
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, isCONNECT, network, addr)
+		}
+		ipAddrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, errors.New("Unable to resolve %v: %v", host, err)
+		}
+		if len(ipAddrs) == 0 {
+			return nil, errors.New("No addresses found for %v", host)
+		}
+		ips := make([]net.IP, 0, len(ipAddrs))
+		for _, ipAddr := range ipAddrs {
+			ips = append(ips, ipAddr.IP)
+		}
+		return raceDials(ctx, isCONNECT, network, port, interleaveFamilies(ips), dial, attemptDelay)
+	}
+}
+
+// interleaveFamilies orders ips alternating between IPv6 and IPv4, starting
+// with IPv6 and otherwise preserving the resolver's order.
+func interleaveFamilies(ips []net.IP) []net.IP {
+	var v6, v4 []net.IP
+	for _, ip := range ips {
+		if ip.To4() == nil {
+			v6 = append(v6, ip)
+		} else {
+			v4 = append(v4, ip)
+		}
+	}
+	result := make([]net.IP, 0, len(ips))
+	for len(v6) > 0 || len(v4) > 0 {
+		if len(v6) > 0 {
+			result = append(result, v6[0])
+			v6 = v6[1:]
+		}
+		if len(v4) > 0 {
+			result = append(result, v4[0])
+			v4 = v4[1:]
+		}
+	}
+	return result
+}
+
+// raceDials dials ips (in order) attemptDelay apart and returns the first
+// successful connection.
+func raceDials(ctx context.Context, isCONNECT bool, network, port string, ips []net.IP, dial DialFunc, attemptDelay time.Duration) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, len(ips))
+	startNext := func(i int) {
+		go func() {
+			conn, err := dial(ctx, isCONNECT, network, net.JoinHostPort(ips[i].String(), port))
+			results <- result{conn, err}
+		}()
+	}
+
+	startNext(0)
+	started, pending := 1, 1
+	timer := time.NewTimer(attemptDelay)
+	defer timer.Stop()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// Close connections from attempts that succeed after this one
+				go func(remaining int) {
+					for i := 0; i < remaining; i++ {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if started < len(ips) {
+				startNext(started)
+				started++
+				pending++
+				timer.Reset(attemptDelay)
+			}
+		case <-timer.C:
+			if started < len(ips) {
+				startNext(started)
+				started++
+				pending++
+				timer.Reset(attemptDelay)
+			}
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHappyEyeballsDial(t *testing.T) {
+	resolver := ResolverFunc(func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("2001:db8::1")}, {IP: net.ParseIP("192.0.2.1")}}, nil
+	})
+
+	doTest := func(v6 func(ctx context.Context) (net.Conn, error)) (string, time.Duration, error) {
+		dial := HappyEyeballsDial(func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			if addr == "[2001:db8::1]:443" {
+				return v6(ctx)
+			}
+			client, server := net.Pipe()
+			server.Close()
+			return &fixedRemoteAddrConn{client, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}}, nil
+		}, resolver, 100*time.Millisecond)
+		start := time.Now()
+		conn, err := dial(context.Background(), true, "tcp", "example.com:443")
+		if err != nil {
+			return "", time.Since(start), err
+		}
+		defer conn.Close()
+		return conn.RemoteAddr().String(), time.Since(start), nil
+	}
+
+	addr, elapsed, err := doTest(func(ctx context.Context) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "192.0.2.1:443", addr, "Should have fallen back to IPv4 while IPv6 hangs")
+		assert.True(t, elapsed >= 100*time.Millisecond, "IPv4 attempt should have waited for the attempt delay")
+	}
+
+	addr, elapsed, err = doTest(func(ctx context.Context) (net.Conn, error) {
+		return nil, errors.New("network unreachable")
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "192.0.2.1:443", addr)
+		assert.True(t, elapsed < 100*time.Millisecond, "Failed IPv6 attempt should have started IPv4 immediately")
+	}
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	ips := interleaveFamilies([]net.IP{
+		net.ParseIP("192.0.2.1"),
+		net.ParseIP("192.0.2.2"),
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("192.0.2.3"),
+	})
+	var strs []string
+	for _, ip := range ips {
+		strs = append(strs, ip.String())
+	}
+	assert.Equal(t, []string{"2001:db8::1", "192.0.2.1", "192.0.2.2", "192.0.2.3"}, strs)
+}
@@ -0,0 +1,418 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+)
+
+const (
+	defaultHARMaxEntries = 1000
+
+	harVersion = "1.2"
+)
+
+// HAROptions configures a HARRecorder.
+type HAROptions struct {
+	// Writer, if specified, receives every entry as soon as it's complete, in
+	// JSON, one per line. Writes are serialized.
+	Writer io.Writer
+
+	// MaxEntries is how many of the most recent entries are kept for
+	// AdminHandler to serve, defaults to 1000. If negative, none are kept.
+	MaxEntries int
+
+	// IncludeMITM also records the requests in MITM'ed tunnels, see
+	// Opts.MITMOpts.
+	IncludeMITM bool
+}
+
+// HARRecorder records forwarded requests as entries of an HTTP Archive (HAR
+// 1.2), see Opts.HAR. Entries include headers, sizes and timings, but not
+// bodies. Requests that fail without a response are recorded with a status of
+// 0 and the error in _error. CONNECT tunnels and upgrades aren't recorded.
+type HARRecorder struct {
+	opts HAROptions
+
+	mx      sync.Mutex
+	entries []*HAREntry
+	next    int
+	enc     *json.Encoder
+}
+
+// NewHARRecorder creates a HARRecorder with opts, which may be nil.
+func NewHARRecorder(opts *HAROptions) *HARRecorder {
+	h := &HARRecorder{}
+	if opts != nil {
+		h.opts = *opts
+	}
+	if h.opts.MaxEntries == 0 {
+		h.opts.MaxEntries = defaultHARMaxEntries
+	}
+	if h.opts.Writer != nil {
+		h.enc = json.NewEncoder(h.opts.Writer)
+	}
+	return h
+}
+
+// HAR is an HTTP Archive.
+type HAR struct {
+	Log *HARLog `json:"log"`
+}
+
+// HARLog is the log of an HTTP Archive.
+type HARLog struct {
+	Version string      `json:"version"`
+	Creator *HARCreator `json:"creator"`
+	Entries []*HAREntry `json:"entries"`
+}
+
+// HARCreator identifies the creator of an HTTP Archive.
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// HAREntry is a request recorded in an HTTP Archive.
+type HAREntry struct {
+	StartedDateTime string       `json:"startedDateTime"`
+	Time            float64      `json:"time"`
+	Request         *HARRequest  `json:"request"`
+	Response        *HARResponse `json:"response"`
+	Cache           struct{}     `json:"cache"`
+	Timings         *HARTimings  `json:"timings"`
+	ServerIPAddress string       `json:"serverIPAddress,omitempty"`
+	Error           string       `json:"_error,omitempty"`
+}
+
+// HARRequest is the request of a HAREntry.
+type HARRequest struct {
+	Method      string          `json:"method"`
+	URL         string          `json:"url"`
+	HTTPVersion string          `json:"httpVersion"`
+	Cookies     []*HARNameValue `json:"cookies"`
+	Headers     []*HARNameValue `json:"headers"`
+	QueryString []*HARNameValue `json:"queryString"`
+	HeadersSize int64           `json:"headersSize"`
+	BodySize    int64           `json:"bodySize"`
+}
+
+// HARResponse is the response of a HAREntry.
+type HARResponse struct {
+	Status      int             `json:"status"`
+	StatusText  string          `json:"statusText"`
+	HTTPVersion string          `json:"httpVersion"`
+	Cookies     []*HARNameValue `json:"cookies"`
+	Headers     []*HARNameValue `json:"headers"`
+	Content     *HARContent     `json:"content"`
+	RedirectURL string          `json:"redirectURL"`
+	HeadersSize int64           `json:"headersSize"`
+	BodySize    int64           `json:"bodySize"`
+}
+
+// HARContent describes the body of a HARResponse.
+type HARContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+}
+
+// HARNameValue is a header, cookie or query parameter.
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// HARTimings are the phases of a HAREntry in milliseconds, -1 if they don't
+// apply, for example dns and connect for requests on reused connections.
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// Snapshot returns a HAR of the most recent entries, oldest first.
+func (h *HARRecorder) Snapshot() *HAR {
+	h.mx.Lock()
+	entries := make([]*HAREntry, 0, len(h.entries))
+	entries = append(entries, h.entries[h.next:]...)
+	entries = append(entries, h.entries[:h.next]...)
+	h.mx.Unlock()
+	return &HAR{Log: &HARLog{
+		Version: harVersion,
+		Creator: &HARCreator{Name: "github.com/getlantern/proxy"},
+		Entries: entries,
+	}}
+}
+
+func (h *HARRecorder) add(entry *HAREntry) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	if h.opts.MaxEntries > 0 {
+		if len(h.entries) < h.opts.MaxEntries {
+			h.entries = append(h.entries, entry)
+		} else {
+			h.entries[h.next] = entry
+			h.next = (h.next + 1) % len(h.entries)
+		}
+	}
+	if h.enc != nil {
+		if err := h.enc.Encode(entry); err != nil {
+			log.Debugf("Unable to write HAR entry: %v", err)
+		}
+	}
+}
+
+// harTimings collects the timings of a forwarded request. The dial phases are
+// recorded by dialResolved, since the transport doesn't dial itself.
+type harTimings struct {
+	mx        sync.Mutex
+	start     time.Time
+	dns       time.Duration
+	connect   time.Duration
+	dialed    bool
+	sslStart  time.Time
+	ssl       time.Duration
+	gotConn   time.Time
+	reused    bool
+	wrote     time.Time
+	firstByte time.Time
+}
+
+func harTimingsFrom(ctx context.Context) *harTimings {
+	timings, _ := ctx.Value(ctxKeyHARTimings).(*harTimings)
+	return timings
+}
+
+func (t *harTimings) recordDial(dns time.Duration, connect time.Duration) {
+	t.mx.Lock()
+	t.dns, t.connect, t.dialed = dns, connect, true
+	t.mx.Unlock()
+}
+
+func (t *harTimings) trace() *httptrace.ClientTrace {
+	at := func(field *time.Time) {
+		t.mx.Lock()
+		*field = time.Now()
+		t.mx.Unlock()
+	}
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mx.Lock()
+			t.gotConn, t.reused = time.Now(), info.Reused
+			t.mx.Unlock()
+		},
+		TLSHandshakeStart: func() { at(&t.sslStart) },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mx.Lock()
+			t.ssl = time.Since(t.sslStart)
+			t.mx.Unlock()
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { at(&t.wrote) },
+		GotFirstResponseByte: func() { at(&t.firstByte) },
+	}
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// harSince is the time from start to end in milliseconds, -1 if either is
+// unknown.
+func harSince(start time.Time, end time.Time) float64 {
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		return -1
+	}
+	return millis(end.Sub(start))
+}
+
+func (t *harTimings) toHAR(end time.Time) *HARTimings {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	timings := &HARTimings{
+		Blocked: harSince(t.start, t.gotConn),
+		DNS:     -1,
+		Connect: -1,
+		SSL:     -1,
+		Send:    harSince(t.gotConn, t.wrote),
+		Wait:    harSince(t.wrote, t.firstByte),
+		Receive: harSince(t.firstByte, end),
+	}
+	if t.dialed && !t.reused {
+		// Connect includes SSL, and blocked is what remains of the time to
+		// the connection
+		connect := t.connect + t.ssl
+		if t.dns > 0 {
+			timings.DNS = millis(t.dns)
+		}
+		timings.Connect = millis(connect)
+		if t.ssl > 0 {
+			timings.SSL = millis(t.ssl)
+		}
+		if timings.Blocked >= 0 {
+			timings.Blocked -= millis(t.dns + connect)
+			if timings.Blocked < 0 {
+				timings.Blocked = 0
+			}
+		}
+	}
+	return timings
+}
+
+// traceHAR prepares req for being recorded, returning the request to forward
+// and a function to call with the outcome of forwarding it. If req isn't to
+// be recorded, it's returned as is.
+func (proxy *proxy) traceHAR(ctx filters.Context, req *http.Request) (*http.Request, func(*http.Response, error)) {
+	if proxy.HAR == nil || (ctx.IsMITMing() && !proxy.HAR.opts.IncludeMITM) {
+		return req, func(*http.Response, error) {}
+	}
+	timings := &harTimings{start: time.Now()}
+	entry := &HAREntry{
+		StartedDateTime: timings.start.UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+		Request: &HARRequest{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			HTTPVersion: req.Proto,
+			Cookies:     harCookies(req.Cookies()),
+			Headers:     harHeaders(req.Header),
+			QueryString: []*HARNameValue{},
+			HeadersSize: -1,
+			BodySize:    req.ContentLength,
+		},
+	}
+	for name, values := range req.URL.Query() {
+		for _, value := range values {
+			entry.Request.QueryString = append(entry.Request.QueryString, &HARNameValue{name, value})
+		}
+	}
+	reqBody := &countingBody{ReadCloser: req.Body}
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = reqBody
+	}
+	req = req.WithContext(httptrace.WithClientTrace(context.WithValue(req.Context(), ctxKeyHARTimings, timings), timings.trace()))
+
+	return req, func(resp *http.Response, err error) {
+		finish := func(bodySize int64) {
+			end := time.Now()
+			entry.Time = millis(end.Sub(timings.start))
+			entry.Timings = timings.toHAR(end)
+			entry.Request.BodySize = reqBody.count()
+			if entry.Response != nil {
+				entry.Response.BodySize = bodySize
+				entry.Response.Content.Size = bodySize
+			}
+			if host, _, splitErr := net.SplitHostPort(DialedAddr(req.Context())); splitErr == nil {
+				entry.ServerIPAddress = host
+			}
+			proxy.HAR.add(entry)
+		}
+		if err != nil {
+			entry.Response = &HARResponse{
+				Cookies:     []*HARNameValue{},
+				Headers:     []*HARNameValue{},
+				Content:     &HARContent{},
+				HeadersSize: -1,
+			}
+			entry.Error = err.Error()
+			finish(0)
+			return
+		}
+		entry.Response = &HARResponse{
+			Status:      resp.StatusCode,
+			StatusText:  http.StatusText(resp.StatusCode),
+			HTTPVersion: resp.Proto,
+			Cookies:     harCookies(resp.Cookies()),
+			Headers:     harHeaders(resp.Header),
+			Content:     &HARContent{MimeType: resp.Header.Get("Content-Type")},
+			RedirectURL: resp.Header.Get("Location"),
+			HeadersSize: -1,
+		}
+		if resp.Body == nil || resp.Body == http.NoBody {
+			finish(0)
+			return
+		}
+		resp.Body = &countingBody{ReadCloser: resp.Body, onClose: finish}
+	}
+}
+
+func harHeaders(header http.Header) []*HARNameValue {
+	headers := []*HARNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			headers = append(headers, &HARNameValue{name, value})
+		}
+	}
+	return headers
+}
+
+func harCookies(cookies []*http.Cookie) []*HARNameValue {
+	result := make([]*HARNameValue, 0, len(cookies))
+	for _, cookie := range cookies {
+		result = append(result, &HARNameValue{cookie.Name, cookie.Value})
+	}
+	return result
+}
+
+// countingBody counts the bytes read from a body, calling onClose with the
+// count once it's closed, or read up to EOF.
+type countingBody struct {
+	io.ReadCloser
+	mx      sync.Mutex
+	n       int64
+	onClose func(int64)
+	once    sync.Once
+}
+
+func (cb *countingBody) Read(b []byte) (int, error) {
+	n, err := cb.ReadCloser.Read(b)
+	cb.mx.Lock()
+	cb.n += int64(n)
+	cb.mx.Unlock()
+	if err == io.EOF {
+		cb.done()
+	}
+	return n, err
+}
+
+func (cb *countingBody) Close() error {
+	err := cb.ReadCloser.Close()
+	cb.done()
+	return err
+}
+
+func (cb *countingBody) done() {
+	if cb.onClose != nil {
+		cb.once.Do(func() { cb.onClose(cb.count()) })
+	}
+}
+
+func (cb *countingBody) count() int64 {
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+	return cb.n
+}
+
+func (proxy *proxy) adminHAR(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if proxy.HAR == nil {
+		http.Error(w, "No HAR recorder configured", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "proxy.har"))
+	writeAdminJSON(w, proxy.HAR.Snapshot())
+}
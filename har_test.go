@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	ht "net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHARRecorder(t *testing.T) {
+	origin := ht.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+
+	streamed := &lockedBuffer{}
+	har := NewHARRecorder(&HAROptions{Writer: streamed, MaxEntries: 2})
+	p := newProxy(&Opts{HAR: har, TryAlternateAddrs: true})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go p.Serve(l)
+
+	proxyURL, _ := url.Parse("http://" + l.Addr().String())
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+	for _, query := range []string{"?a=1", "?a=2", "?a=3"} {
+		resp, err := client.Post("http://localhost:"+port+"/path"+query, "text/plain", strings.NewReader("data"))
+		require.NoError(t, err)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	require.Eventually(t, func() bool {
+		return strings.Count(streamed.String(), "\n") == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	var first HAREntry
+	require.NoError(t, json.Unmarshal([]byte(strings.SplitN(streamed.String(), "\n", 2)[0]), &first))
+	assert.Equal(t, http.MethodPost, first.Request.Method)
+	assert.Equal(t, []*HARNameValue{{"a", "1"}}, first.Request.QueryString)
+	assert.Equal(t, int64(4), first.Request.BodySize)
+	assert.Equal(t, http.StatusOK, first.Response.Status)
+	assert.Equal(t, int64(5), first.Response.Content.Size)
+	assert.Equal(t, "text/plain", first.Response.Content.MimeType)
+	assert.Equal(t, []*HARNameValue{{"session", "abc"}}, first.Response.Cookies)
+	assert.Equal(t, "127.0.0.1", first.ServerIPAddress)
+	assert.True(t, first.Timings.DNS >= 0, "Lookup should be timed")
+	assert.True(t, first.Timings.Connect >= 0, "Dial should be timed")
+	assert.Equal(t, float64(-1), first.Timings.SSL)
+	for _, timing := range []float64{first.Timings.Blocked, first.Timings.Send, first.Timings.Wait, first.Timings.Receive} {
+		assert.True(t, timing >= 0)
+	}
+	assert.True(t, first.Time >= first.Timings.Wait)
+
+	snapshot := har.Snapshot()
+	assert.Equal(t, "1.2", snapshot.Log.Version)
+	require.Len(t, snapshot.Log.Entries, 2, "Only the most recent entries should be kept")
+	assert.Contains(t, snapshot.Log.Entries[0].Request.URL, "a=2")
+	assert.Contains(t, snapshot.Log.Entries[1].Request.URL, "a=3")
+	assert.Equal(t, float64(-1), snapshot.Log.Entries[1].Timings.Connect, "Reused connections aren't dialed")
+
+	w := ht.NewRecorder()
+	p.AdminHandler().ServeHTTP(w, ht.NewRequest(http.MethodGet, "/har", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "proxy.har")
+	var served HAR
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &served))
+	assert.Len(t, served.Log.Entries, 2)
+}
+
+func TestHARRecorderError(t *testing.T) {
+	unreachable, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	addr := unreachable.Addr().String()
+	unreachable.Close()
+
+	har := NewHARRecorder(nil)
+	l := serveProxy(t, &Opts{HAR: har})
+	defer l.Close()
+	_, err = proxiedRequest(t, l.Addr().String(), http.MethodGet, "http://"+addr+"/")
+	assert.Error(t, err)
+	require.Eventually(t, func() bool {
+		return len(har.Snapshot().Log.Entries) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	entry := har.Snapshot().Log.Entries[0]
+	assert.Equal(t, 0, entry.Response.Status)
+	assert.NotEmpty(t, entry.Error)
+}
+
+func TestHARAdminNotConfigured(t *testing.T) {
+	w := ht.NewRecorder()
+	newProxy(&Opts{}).AdminHandler().ServeHTTP(w, ht.NewRequest(http.MethodGet, "/har", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
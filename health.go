@@ -0,0 +1,248 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+)
+
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+
+	defaultHealthWindow       = time.Minute
+	defaultMaxDialFailureRate = 0.5
+	defaultMinHealthDials     = 10
+	defaultMaxSaturation      = 1
+
+	// healthBuckets is how many buckets the window of dial outcomes is split
+	// into for expiring old outcomes
+	healthBuckets = 12
+
+	// HealthOK is the Status of a healthy proxy in a HealthReport.
+	HealthOK = "ok"
+
+	// HealthUnavailable is the Status of an unhealthy proxy in a HealthReport.
+	HealthUnavailable = "unavailable"
+)
+
+// HealthCheckOptions configures the /healthz and /readyz endpoints, which are
+// meant for liveness and readiness probes (e.g. in Kubernetes). /healthz only
+// fails once the proxy is shutting down. /readyz also fails while the proxy
+// isn't serving any listeners, while too many recent upstream dials have
+// failed, and while the concurrency limit is saturated. Both respond with a
+// HealthReport as JSON, with status 200 if healthy and 503 otherwise.
+type HealthCheckOptions struct {
+	// ServeOnProxyPort, if true, also answers GET and HEAD requests sent to the
+	// proxy itself at /healthz and /readyz, without authentication. They're
+	// always served by AdminHandler.
+	ServeOnProxyPort bool
+
+	// Window is how far back upstream dials count towards the dial failure
+	// rate, defaults to 1 minute.
+	Window time.Duration
+
+	// MaxDialFailureRate is the fraction of dials within Window that may fail
+	// before the proxy isn't ready, defaults to 0.5.
+	MaxDialFailureRate float64
+
+	// MinDials is how many dials must have been made within Window before the
+	// dial failure rate counts, defaults to 10.
+	MinDials int
+
+	// MaxSaturation is the fraction of ConcurrencyLimit that may be in use
+	// before the proxy isn't ready, defaults to 1 (i.e. all of it).
+	MaxSaturation float64
+}
+
+// HealthReport is the JSON output of the /healthz and /readyz endpoints.
+type HealthReport struct {
+	Status   string   `json:"status"`
+	Problems []string `json:"problems,omitempty"`
+
+	// Listeners counts the listeners being served with Serve and friends
+	Listeners    int  `json:"listeners"`
+	ShuttingDown bool `json:"shuttingDown"`
+
+	// Dials and DialFailures count the upstream dials within the window
+	Dials           int     `json:"dials"`
+	DialFailures    int     `json:"dialFailures"`
+	DialFailureRate float64 `json:"dialFailureRate"`
+
+	// Saturation is the fraction of ConcurrencyLimit in use, 0 without a limit
+	Saturation float64 `json:"saturation"`
+}
+
+// dialHealth counts the outcomes of upstream dials over a sliding window.
+type dialHealth struct {
+	bucketSize time.Duration
+	mx         sync.Mutex
+	buckets    [healthBuckets]dialBucket
+}
+
+type dialBucket struct {
+	start    int64
+	dials    int
+	failures int
+}
+
+func newDialHealth(window time.Duration) *dialHealth {
+	bucketSize := window / healthBuckets
+	if bucketSize <= 0 {
+		bucketSize = 1
+	}
+	return &dialHealth{bucketSize: bucketSize}
+}
+
+// record records the outcome of a dial, ignoring dials that were abandoned
+// because the client went away.
+func (dh *dialHealth) record(err error) {
+	if err != nil && causedBy(err, func(cause error) bool { return cause == context.Canceled }) {
+		return
+	}
+	start := time.Now().UnixNano() / int64(dh.bucketSize)
+	dh.mx.Lock()
+	bucket := &dh.buckets[start%healthBuckets]
+	if bucket.start != start {
+		*bucket = dialBucket{start: start}
+	}
+	bucket.dials++
+	if err != nil {
+		bucket.failures++
+	}
+	dh.mx.Unlock()
+}
+
+// counts returns the number of dials and failures within the window.
+func (dh *dialHealth) counts() (dials int, failures int) {
+	oldest := time.Now().UnixNano()/int64(dh.bucketSize) - healthBuckets + 1
+	dh.mx.Lock()
+	defer dh.mx.Unlock()
+	for _, bucket := range dh.buckets {
+		if bucket.start >= oldest {
+			dials += bucket.dials
+			failures += bucket.failures
+		}
+	}
+	return
+}
+
+func (proxy *proxy) initHealth() {
+	opts := proxy.healthCheckOptions()
+	window := opts.Window
+	if window <= 0 {
+		window = defaultHealthWindow
+	}
+	proxy.dialHealth = newDialHealth(window)
+}
+
+func (proxy *proxy) healthCheckOptions() *HealthCheckOptions {
+	if proxy.HealthChecks == nil {
+		return &HealthCheckOptions{}
+	}
+	return proxy.HealthChecks
+}
+
+// health reports on the health of the proxy, checking readiness if ready.
+func (proxy *proxy) health(ready bool) *HealthReport {
+	opts := proxy.healthCheckOptions()
+	report := &HealthReport{Status: HealthOK}
+	report.Listeners, report.ShuttingDown = proxy.tracker.listenerStatus()
+	report.Dials, report.DialFailures = proxy.dialHealth.counts()
+	if report.Dials > 0 {
+		report.DialFailureRate = float64(report.DialFailures) / float64(report.Dials)
+	}
+	if proxy.limiter != nil {
+		report.Saturation = float64(len(proxy.limiter.slots)) / float64(cap(proxy.limiter.slots))
+	}
+
+	if report.ShuttingDown {
+		report.Problems = append(report.Problems, "shutting down")
+	}
+	if ready {
+		maxFailureRate := opts.MaxDialFailureRate
+		if maxFailureRate <= 0 {
+			maxFailureRate = defaultMaxDialFailureRate
+		}
+		minDials := opts.MinDials
+		if minDials <= 0 {
+			minDials = defaultMinHealthDials
+		}
+		maxSaturation := opts.MaxSaturation
+		if maxSaturation <= 0 {
+			maxSaturation = defaultMaxSaturation
+		}
+		if report.Listeners == 0 && !report.ShuttingDown {
+			report.Problems = append(report.Problems, "not serving any listeners")
+		}
+		if report.Dials >= minDials && report.DialFailureRate > maxFailureRate {
+			report.Problems = append(report.Problems, fmt.Sprintf("%d of %d recent upstream dials failed", report.DialFailures, report.Dials))
+		}
+		if proxy.limiter != nil && report.Saturation >= maxSaturation {
+			report.Problems = append(report.Problems, "concurrency limit saturated")
+		}
+	}
+	if len(report.Problems) > 0 {
+		report.Status = HealthUnavailable
+	}
+	return report
+}
+
+// healthResponse returns the status and JSON body answering a request to the
+// /healthz or /readyz path.
+func (proxy *proxy) healthResponse(path string) (int, []byte) {
+	report := proxy.health(path == readyzPath)
+	status := http.StatusOK
+	if report.Status != HealthOK {
+		status = http.StatusServiceUnavailable
+	}
+	body, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Debugf("Unable to encode health report: %v", err)
+	}
+	return status, append(body, '\n')
+}
+
+func (proxy *proxy) adminHealth(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "Only GET and HEAD are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	status, body := proxy.healthResponse(req.URL.Path)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if req.Method == http.MethodGet {
+		w.Write(body)
+	}
+}
+
+// healthFilter returns a filter that answers health checks sent to the proxy
+// itself ahead of authentication.
+func (proxy *proxy) healthFilter() filters.Filter {
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead || req.URL.Host != "" || ctx.IsMITMing() {
+			return next(ctx, req)
+		}
+		if req.URL.Path != healthzPath && req.URL.Path != readyzPath {
+			return next(ctx, req)
+		}
+		status, body := proxy.healthResponse(req.URL.Path)
+		header := make(http.Header)
+		header.Set("Content-Type", "application/json")
+		header.Set("Cache-Control", "no-store")
+		return filters.ShortCircuit(ctx, req, &http.Response{
+			StatusCode:    status,
+			Header:        header,
+			Body:          ioutil.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+		})
+	})
+}
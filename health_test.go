@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	ht "net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getHealth(t *testing.T, url string) (int, *HealthReport) {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	report := &HealthReport{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(report))
+	return resp.StatusCode, report
+}
+
+func TestHealthChecks(t *testing.T) {
+	p := newProxy(&Opts{
+		OKWaitsForUpstream: true,
+		HealthChecks:       &HealthCheckOptions{MinDials: 2},
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			return nil, errors.New("nope")
+		},
+	})
+	admin := ht.NewServer(p.AdminHandler())
+	defer admin.Close()
+
+	status, report := getHealth(t, admin.URL+"/healthz")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, HealthOK, report.Status)
+	status, report = getHealth(t, admin.URL+"/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, status, "Shouldn't be ready before serving")
+	assert.Equal(t, HealthUnavailable, report.Status)
+	assert.Equal(t, []string{"not serving any listeners"}, report.Problems)
+
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go p.Serve(l)
+	require.Eventually(t, func() bool {
+		status, _ := getHealth(t, admin.URL+"/readyz")
+		return status == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+
+	conn, _, resp := openTunnel(t, l.Addr().String(), "example.com:443")
+	conn.Close()
+	require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	status, report = getHealth(t, admin.URL+"/readyz")
+	assert.Equal(t, http.StatusOK, status, "A single failure shouldn't count")
+	assert.Equal(t, 1, report.DialFailures)
+
+	conn, _, _ = openTunnel(t, l.Addr().String(), "example.com:443")
+	conn.Close()
+	status, report = getHealth(t, admin.URL+"/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, 2, report.Dials)
+	assert.Equal(t, 2, report.DialFailures)
+	assert.EqualValues(t, 1, report.DialFailureRate)
+	assert.Equal(t, []string{"2 of 2 recent upstream dials failed"}, report.Problems)
+	status, _ = getHealth(t, admin.URL+"/healthz")
+	assert.Equal(t, http.StatusOK, status, "Dial failures shouldn't affect liveness")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	p.Shutdown(ctx)
+	status, report = getHealth(t, admin.URL+"/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.True(t, report.ShuttingDown)
+}
+
+func TestHealthChecksSaturation(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+	p := newProxy(&Opts{
+		ConcurrencyLimit: 1,
+		HealthChecks:     &HealthCheckOptions{},
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go p.Serve(l)
+	admin := ht.NewServer(p.AdminHandler())
+	defer admin.Close()
+
+	conn, _, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+	defer conn.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	status, report := getHealth(t, admin.URL+"/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.EqualValues(t, 1, report.Saturation)
+	assert.Equal(t, []string{"concurrency limit saturated"}, report.Problems)
+
+	conn.Close()
+	require.Eventually(t, func() bool {
+		status, _ := getHealth(t, admin.URL+"/readyz")
+		return status == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestHealthChecksOnProxyPort(t *testing.T) {
+	l := serveProxy(t, &Opts{
+		HealthChecks: &HealthCheckOptions{ServeOnProxyPort: true},
+		Authenticator: BasicAuth("proxy", func(username, password string) bool {
+			return false
+		}),
+	})
+	defer l.Close()
+	// The proxy keeps the connections of http.DefaultClient open otherwise
+	defer http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	require.Eventually(t, func() bool {
+		status, _ := getHealth(t, "http://"+l.Addr().String()+"/readyz")
+		return status == http.StatusOK
+	}, time.Second, 10*time.Millisecond, "Health checks shouldn't need authentication")
+	status, report := getHealth(t, "http://"+l.Addr().String()+"/healthz")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 1, report.Listeners)
+
+	resp, err := http.Head("http://" + l.Addr().String() + "/healthz")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Get("http://" + l.Addr().String() + "/other")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode, "Other requests should still be authenticated")
+}
+
+func TestDialHealthWindow(t *testing.T) {
+	dh := newDialHealth(120 * time.Millisecond)
+	dh.record(nil)
+	dh.record(errors.New("failed"))
+	dh.record(context.Canceled)
+	dials, failures := dh.counts()
+	assert.Equal(t, 2, dials, "Canceled dials shouldn't count")
+	assert.Equal(t, 1, failures)
+	time.Sleep(150 * time.Millisecond)
+	dials, failures = dh.counts()
+	assert.Equal(t, 0, dials, "Old dials should expire")
+	assert.Equal(t, 0, failures)
+}
@@ -0,0 +1,582 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+)
+
+const (
+	defaultICAPPort    = "1344"
+	defaultICAPTimeout = 30 * time.Second
+
+	// maxICAPHeaderBytes limits the size of the HTTP headers that ICAP servers
+	// return
+	maxICAPHeaderBytes = http.DefaultMaxHeaderBytes
+)
+
+// ICAPOptions configures a filter that passes requests and/or responses
+// through an ICAP (RFC 3507) server for content adaptation, for example to an
+// antivirus or DLP service. See NewICAPFilter.
+type ICAPOptions struct {
+	// ReqModURL, if specified, is the icap:// URL of the REQMOD service that
+	// requests are sent to before being forwarded upstream. The service may
+	// return a modified request, or a response (e.g. a block page) that is sent
+	// to the client in place of forwarding the request.
+	ReqModURL string
+
+	// RespModURL, if specified, is the icap:// URL of the RESPMOD service that
+	// responses are sent to before being returned to the client.
+	RespModURL string
+
+	// Preview, if greater than zero, is how many bytes of each body are sent to
+	// the ICAP server up front, allowing it to decide whether it needs the rest
+	// or the message can pass unmodified (204). Without a preview, the whole
+	// body is always sent and echoed back.
+	Preview int
+
+	// BypassOnError, if true, passes messages along unmodified when the ICAP
+	// server can't be reached or fails, rather than failing them. Messages
+	// whose body was already partly sent to the ICAP server fail regardless.
+	BypassOnError bool
+
+	// Timeout limits how long to wait for the ICAP server to respond to each
+	// message, defaults to 30 seconds.
+	Timeout time.Duration
+
+	// Dial is used to connect to the ICAP server, defaults to dialing
+	// directly.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// icapService is an ICAP service at a single URL.
+type icapService struct {
+	method string
+	url    *url.URL
+	addr   string
+	opts   *ICAPOptions
+}
+
+// icapResult is the outcome of an ICAP exchange. With status 204,
+// restoredBody holds the original body. With status 200, the adapted message
+// headers and body are set.
+type icapResult struct {
+	status       int
+	reqHeader    []byte
+	resHeader    []byte
+	body         io.ReadCloser
+	restoredBody io.Reader
+}
+
+// icapError is an error exchanging a message with the ICAP server. If
+// restoredBody is set, the message can still be passed along unmodified.
+type icapError struct {
+	err          error
+	restoredBody io.Reader
+}
+
+func (e *icapError) Error() string {
+	return e.err.Error()
+}
+
+// NewICAPFilter creates a Filter that adapts requests and responses with the
+// ICAP services configured in opts. CONNECT requests are passed along as is,
+// though requests on MITM'ed connections are adapted like any other. Messages
+// that can't be adapted are answered with 502 Bad Gateway.
+func NewICAPFilter(opts *ICAPOptions) (filters.Filter, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultICAPTimeout
+	}
+	if opts.Dial == nil {
+		dialer := &net.Dialer{}
+		opts.Dial = dialer.DialContext
+	}
+	reqmod, err := newICAPService("REQMOD", opts.ReqModURL, opts)
+	if err != nil {
+		return nil, err
+	}
+	respmod, err := newICAPService("RESPMOD", opts.RespModURL, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		if req.Method == http.MethodConnect {
+			return next(ctx, req)
+		}
+		if reqmod != nil {
+			resp, err := reqmod.adaptRequest(ctx, req)
+			if err != nil {
+				return filters.Fail(ctx, req, http.StatusBadGateway, err)
+			}
+			if resp != nil {
+				return filters.ShortCircuit(ctx, req, resp)
+			}
+		}
+		resp, nextCtx, err := next(ctx, req)
+		if respmod == nil || err != nil || resp == nil || resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, nextCtx, err
+		}
+		if err := respmod.adaptResponse(ctx, req, resp); err != nil {
+			resp.Body.Close()
+			return filters.Fail(nextCtx, req, http.StatusBadGateway, err)
+		}
+		return resp, nextCtx, nil
+	}), nil
+}
+
+func newICAPService(method string, rawurl string, opts *ICAPOptions) (*icapService, error) {
+	if rawurl == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, errors.New("Unable to parse ICAP URL %v: %v", rawurl, err)
+	}
+	if u.Scheme != "icap" || u.Host == "" {
+		return nil, errors.New("Invalid ICAP URL %v, expected icap://host[:port]/service", rawurl)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), defaultICAPPort)
+	}
+	return &icapService{method: method, url: u, addr: addr, opts: opts}, nil
+}
+
+// adaptRequest passes req through the REQMOD service, modifying it in place.
+// If the service responds in place of the origin, that response is returned.
+func (svc *icapService) adaptRequest(ctx context.Context, req *http.Request) (*http.Response, error) {
+	body := req.Body
+	if !hasICAPBody(body, req.ContentLength) {
+		body = nil
+	}
+	restore := func(restored io.Reader) {
+		if body != nil {
+			req.Body = &readerAndCloser{restored, req.Body}
+		}
+	}
+	result, err := svc.exchange(ctx, req.RemoteAddr, httpRequestHeader(req), nil, body)
+	if err != nil {
+		return nil, svc.bypass(err, restore)
+	}
+	switch {
+	case result.status == http.StatusNoContent:
+		restore(result.restoredBody)
+		return nil, nil
+	case result.resHeader != nil:
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(result.resHeader)), req)
+		if err != nil {
+			result.body.Close()
+			return nil, errors.New("Unable to parse response from ICAP server: %v", err)
+		}
+		setICAPBody(&resp.Body, &resp.ContentLength, &resp.TransferEncoding, resp.Header, result.body)
+		return resp, nil
+	default:
+		adapted, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(result.reqHeader)))
+		if err != nil {
+			result.body.Close()
+			return nil, errors.New("Unable to parse request from ICAP server: %v", err)
+		}
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		if adapted.URL.Host == "" {
+			adapted.URL.Scheme, adapted.URL.Host = req.URL.Scheme, req.URL.Host
+		}
+		if adapted.URL.Scheme == "" {
+			adapted.URL.Scheme = req.URL.Scheme
+		}
+		req.Method, req.URL, req.Host, req.Header = adapted.Method, adapted.URL, adapted.Host, adapted.Header
+		req.ContentLength, req.TransferEncoding = adapted.ContentLength, adapted.TransferEncoding
+		setICAPBody(&req.Body, &req.ContentLength, &req.TransferEncoding, req.Header, result.body)
+		return nil, nil
+	}
+}
+
+// adaptResponse passes resp through the RESPMOD service, modifying it in
+// place.
+func (svc *icapService) adaptResponse(ctx context.Context, req *http.Request, resp *http.Response) error {
+	body := io.Reader(resp.Body)
+	if req.Method == http.MethodHead || !hasICAPBody(resp.Body, resp.ContentLength) {
+		body = nil
+	}
+	restore := func(restored io.Reader) {
+		if body != nil {
+			resp.Body = &readerAndCloser{restored, resp.Body}
+		}
+	}
+	result, err := svc.exchange(ctx, req.RemoteAddr, httpRequestHeader(req), httpResponseHeader(resp), body)
+	if err != nil {
+		return svc.bypass(err, restore)
+	}
+	if result.status == http.StatusNoContent {
+		restore(result.restoredBody)
+		return nil
+	}
+	if result.resHeader == nil {
+		result.body.Close()
+		return errors.New("ICAP server returned no response")
+	}
+	adapted, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(result.resHeader)), req)
+	if err != nil {
+		result.body.Close()
+		return errors.New("Unable to parse response from ICAP server: %v", err)
+	}
+	resp.Body.Close()
+	resp.Status, resp.StatusCode, resp.Header = adapted.Status, adapted.StatusCode, adapted.Header
+	resp.ContentLength, resp.TransferEncoding = adapted.ContentLength, adapted.TransferEncoding
+	setICAPBody(&resp.Body, &resp.ContentLength, &resp.TransferEncoding, resp.Header, result.body)
+	return nil
+}
+
+// bypass returns nil if the failed message can pass along unmodified,
+// restoring its body with restore, otherwise the error.
+func (svc *icapService) bypass(err error, restore func(restored io.Reader)) error {
+	ie, _ := err.(*icapError)
+	if svc.opts.BypassOnError && ie != nil && ie.restoredBody != nil {
+		log.Debugf("Bypassing ICAP %v service: %v", svc.method, err)
+		restore(ie.restoredBody)
+		return nil
+	}
+	return errors.New("Unable to adapt message with ICAP %v service: %v", svc.method, err)
+}
+
+// exchange sends a message made of the given HTTP request header, response
+// header (for RESPMOD) and body to the ICAP service and reads the result.
+func (svc *icapService) exchange(ctx context.Context, clientAddr string, reqHeader []byte, resHeader []byte, body io.Reader) (*icapResult, error) {
+	// Until the body is sent, it can still be passed along unmodified
+	restorable := body
+	if restorable == nil {
+		restorable = bytes.NewReader(nil)
+	}
+	fail := func(err error) (*icapResult, error) {
+		return nil, &icapError{err, restorable}
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, svc.opts.Timeout)
+	defer cancel()
+	conn, err := svc.opts.Dial(dialCtx, "tcp", svc.addr)
+	if err != nil {
+		return fail(errors.New("Unable to dial ICAP server at %v: %v", svc.addr, err))
+	}
+	closeConn := true
+	defer func() {
+		if closeConn {
+			conn.Close()
+		}
+	}()
+	conn.SetDeadline(time.Now().Add(svc.opts.Timeout))
+
+	head := &bytes.Buffer{}
+	fmt.Fprintf(head, "%v %v ICAP/1.0\r\n", svc.method, svc.url)
+	fmt.Fprintf(head, "Host: %v\r\n", svc.url.Host)
+	var encapsulated []string
+	offset := 0
+	if reqHeader != nil {
+		encapsulated = append(encapsulated, "req-hdr=0")
+		offset += len(reqHeader)
+	}
+	if resHeader != nil {
+		encapsulated = append(encapsulated, fmt.Sprintf("res-hdr=%d", offset))
+		offset += len(resHeader)
+	}
+	bodySection := "null-body"
+	if body != nil {
+		bodySection = "req-body"
+		if resHeader != nil {
+			bodySection = "res-body"
+		}
+	}
+	encapsulated = append(encapsulated, fmt.Sprintf("%v=%d", bodySection, offset))
+	fmt.Fprintf(head, "Encapsulated: %v\r\n", strings.Join(encapsulated, ", "))
+	if body == nil {
+		head.WriteString("Allow: 204\r\n")
+	}
+	if clientIP := clientIPFromAddr(clientAddr); clientIP != nil {
+		fmt.Fprintf(head, "X-Client-IP: %v\r\n", clientIP)
+	}
+
+	var preview []byte
+	previewEOF := false
+	if body != nil && svc.opts.Preview > 0 {
+		preview = make([]byte, svc.opts.Preview)
+		n, readErr := io.ReadFull(body, preview)
+		preview = preview[:n]
+		previewEOF = readErr == io.EOF || readErr == io.ErrUnexpectedEOF
+		if !previewEOF && readErr != nil {
+			return nil, errors.New("Unable to read body for ICAP preview: %v", readErr)
+		}
+		if previewEOF {
+			restorable = bytes.NewReader(preview)
+		} else {
+			restorable = io.MultiReader(bytes.NewReader(preview), body)
+		}
+		fmt.Fprintf(head, "Preview: %d\r\n", len(preview))
+	}
+	head.WriteString("\r\n")
+	head.Write(reqHeader)
+	head.Write(resHeader)
+
+	bw := bufio.NewWriter(conn)
+	bw.Write(head.Bytes())
+	if preview != nil {
+		writeICAPChunk(bw, preview)
+		if previewEOF {
+			bw.WriteString("0; ieof\r\n\r\n")
+		} else {
+			bw.WriteString("0\r\n\r\n")
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return fail(errors.New("Unable to write to ICAP server: %v", err))
+	}
+
+	br := bufio.NewReader(conn)
+	tp := textproto.NewReader(br)
+	sendBody := func() {
+		// Send the (rest of the) body while reading the ICAP server's response,
+		// which may be streamed back before the body is complete
+		go func() {
+			_, err := io.Copy(&icapChunkWriter{bw}, body)
+			if err == nil {
+				_, err = bw.WriteString("0\r\n\r\n")
+			}
+			if err == nil {
+				err = bw.Flush()
+			}
+			if err != nil {
+				log.Debugf("Unable to send body to ICAP server: %v", err)
+			}
+		}()
+	}
+	if body != nil && preview == nil {
+		restorable = nil
+		sendBody()
+	}
+
+	status, header, err := readICAPResponse(tp)
+	if err != nil {
+		return fail(err)
+	}
+	if status == http.StatusContinue {
+		if body == nil || preview == nil || previewEOF {
+			return fail(errors.New("Unexpected 100 Continue from ICAP server"))
+		}
+		restorable = nil
+		sendBody()
+		status, header, err = readICAPResponse(tp)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	switch status {
+	case http.StatusNoContent:
+		if restorable == nil {
+			return fail(errors.New("ICAP server responded 204 after body was sent"))
+		}
+		return &icapResult{status: status, restoredBody: restorable}, nil
+	case http.StatusOK:
+	default:
+		return fail(errors.New("ICAP server responded %d", status))
+	}
+
+	result := &icapResult{status: status}
+	sections, err := parseEncapsulated(header.Get("Encapsulated"))
+	if err != nil {
+		return fail(err)
+	}
+	for i, section := range sections {
+		if strings.HasSuffix(section.name, "-body") {
+			if section.name != "null-body" {
+				result.body = &readerAndCloser{httputil.NewChunkedReader(br), conn}
+				conn.SetDeadline(time.Time{})
+				closeConn = false
+			}
+			break
+		}
+		if i == len(sections)-1 {
+			return fail(errors.New("Encapsulated header from ICAP server has no body section"))
+		}
+		size := sections[i+1].offset - section.offset
+		if size > maxICAPHeaderBytes {
+			return fail(errors.New("%v from ICAP server exceeds %d bytes", section.name, maxICAPHeaderBytes))
+		}
+		section.data = make([]byte, size)
+		if _, err := io.ReadFull(br, section.data); err != nil {
+			return fail(errors.New("Unable to read %v from ICAP server: %v", section.name, err))
+		}
+		switch section.name {
+		case "req-hdr":
+			result.reqHeader = section.data
+		case "res-hdr":
+			result.resHeader = section.data
+		}
+	}
+	if result.body == nil {
+		result.body = http.NoBody
+	}
+	if result.reqHeader == nil && result.resHeader == nil {
+		result.body.Close()
+		return fail(errors.New("ICAP server returned no encapsulated message"))
+	}
+	return result, nil
+}
+
+func readICAPResponse(tp *textproto.Reader) (int, textproto.MIMEHeader, error) {
+	line, err := tp.ReadLine()
+	if err != nil {
+		return 0, nil, errors.New("Unable to read response from ICAP server: %v", err)
+	}
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "ICAP/") {
+		return 0, nil, errors.New("Malformed ICAP status line %v", line)
+	}
+	status, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, nil, errors.New("Malformed ICAP status line %v", line)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return 0, nil, errors.New("Unable to read ICAP headers: %v", err)
+	}
+	return status, header, nil
+}
+
+type icapSection struct {
+	name   string
+	offset int
+	data   []byte
+}
+
+// parseEncapsulated parses an Encapsulated header like
+// "res-hdr=0, res-body=137", checking that offsets are ascending.
+func parseEncapsulated(value string) ([]*icapSection, error) {
+	var sections []*icapSection
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Malformed Encapsulated header %v", value)
+		}
+		offset, err := strconv.Atoi(parts[1])
+		if err != nil || offset < 0 || (len(sections) > 0 && offset < sections[len(sections)-1].offset) {
+			return nil, errors.New("Malformed Encapsulated header %v", value)
+		}
+		sections = append(sections, &icapSection{name: parts[0], offset: offset})
+	}
+	return sections, nil
+}
+
+func httpRequestHeader(req *http.Request) []byte {
+	buf := &bytes.Buffer{}
+	uri := req.URL.RequestURI()
+	if req.URL.IsAbs() {
+		uri = req.URL.String()
+	}
+	fmt.Fprintf(buf, "%v %v HTTP/1.1\r\n", req.Method, uri)
+	fmt.Fprintf(buf, "Host: %v\r\n", req.Host)
+	req.Header.WriteSubset(buf, map[string]bool{"Host": true})
+	writeICAPFraming(buf, req.Header, req.Body, req.ContentLength)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+func httpResponseHeader(resp *http.Response) []byte {
+	buf := &bytes.Buffer{}
+	status := resp.Status
+	if status == "" {
+		status = fmt.Sprintf("%d %v", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	fmt.Fprintf(buf, "HTTP/1.1 %v\r\n", status)
+	resp.Header.Write(buf)
+	writeICAPFraming(buf, resp.Header, resp.Body, resp.ContentLength)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// writeICAPFraming adds the Content-Length or Transfer-Encoding that Go keeps
+// out of Header to an encapsulated message header.
+func writeICAPFraming(buf *bytes.Buffer, header http.Header, body io.Reader, contentLength int64) {
+	if header.Get("Content-Length") != "" || header.Get("Transfer-Encoding") != "" {
+		return
+	}
+	if contentLength > 0 {
+		fmt.Fprintf(buf, "Content-Length: %d\r\n", contentLength)
+	} else if contentLength < 0 && body != nil && body != http.NoBody {
+		buf.WriteString("Transfer-Encoding: chunked\r\n")
+	}
+}
+
+func hasICAPBody(body io.Reader, contentLength int64) bool {
+	return body != nil && body != http.NoBody && contentLength != 0
+}
+
+// setICAPBody sets an adapted body, whose length is only known if the adapted
+// header says so. Bodies of unknown length are sent chunked.
+func setICAPBody(body *io.ReadCloser, contentLength *int64, transferEncoding *[]string, header http.Header, adapted io.ReadCloser) {
+	*body = adapted
+	if adapted == http.NoBody {
+		*contentLength = 0
+		*transferEncoding = nil
+		header.Del("Content-Length")
+		return
+	}
+	if *contentLength == 0 {
+		*contentLength = -1
+	}
+	if *contentLength == -1 {
+		*transferEncoding = []string{"chunked"}
+	}
+}
+
+func writeICAPChunk(w io.Writer, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintf(w, "%x\r\n", len(data)); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// icapChunkWriter writes each Write as an ICAP chunk.
+type icapChunkWriter struct {
+	w io.Writer
+}
+
+func (cw *icapChunkWriter) Write(b []byte) (int, error) {
+	if err := writeICAPChunk(cw.w, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// readerAndCloser reads from one source while closing another.
+type readerAndCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (rc *readerAndCloser) Close() error {
+	if rc.closer == nil {
+		return nil
+	}
+	return rc.closer.Close()
+}
@@ -0,0 +1,302 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	ht "net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type icapTestMessage struct {
+	method  string
+	header  textproto.MIMEHeader
+	reqHdr  string
+	resHdr  string
+	hasBody bool
+	body    []byte
+	ieof    bool
+}
+
+// readICAPTestChunks reads chunks until the terminating one, reporting whether
+// it had the ieof extension.
+func readICAPTestChunks(t *testing.T, br *bufio.Reader) ([]byte, bool) {
+	body := &bytes.Buffer{}
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSpace(line)
+		size, ext := line, ""
+		if i := strings.Index(line, ";"); i >= 0 {
+			size, ext = strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		}
+		n, err := strconv.ParseInt(size, 16, 64)
+		require.NoError(t, err)
+		if n == 0 {
+			_, err = br.ReadString('\n')
+			require.NoError(t, err)
+			return body.Bytes(), ext == "ieof"
+		}
+		_, err = io.CopyN(body, br, n+2)
+		require.NoError(t, err)
+		body.Truncate(body.Len() - 2)
+	}
+}
+
+// serveICAP runs an ICAP server that calls handle for each message. handle
+// writes its response to w, and may read the rest of a previewed body by
+// calling readRest after responding 100 Continue.
+func serveICAP(t *testing.T, handle func(m *icapTestMessage, readRest func() []byte, w io.Writer)) net.Listener {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				tp := textproto.NewReader(br)
+				line, err := tp.ReadLine()
+				if err != nil {
+					return
+				}
+				m := &icapTestMessage{method: strings.Fields(line)[0]}
+				m.header, _ = tp.ReadMIMEHeader()
+				sections, err := parseEncapsulated(m.header.Get("Encapsulated"))
+				require.NoError(t, err)
+				for i, section := range sections {
+					if strings.HasSuffix(section.name, "-body") {
+						m.hasBody = section.name != "null-body"
+						break
+					}
+					data := make([]byte, sections[i+1].offset-section.offset)
+					_, err := io.ReadFull(br, data)
+					require.NoError(t, err)
+					if section.name == "req-hdr" {
+						m.reqHdr = string(data)
+					} else {
+						m.resHdr = string(data)
+					}
+				}
+				if m.hasBody {
+					m.body, m.ieof = readICAPTestChunks(t, br)
+				}
+				handle(m, func() []byte {
+					rest, _ := readICAPTestChunks(t, br)
+					return rest
+				}, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func icapChunked(body string) string {
+	if body == "" {
+		return "0\r\n\r\n"
+	}
+	return fmt.Sprintf("%x\r\n%v\r\n0\r\n\r\n", len(body), body)
+}
+
+// icapResponse builds a 200 response encapsulating the given HTTP header
+// section (named name) and body.
+func icapResponse(name string, header string, body string) string {
+	bodySection := "null-body"
+	if body != "" {
+		bodySection = strings.Split(name, "-")[0] + "-body"
+	}
+	resp := fmt.Sprintf("ICAP/1.0 200 OK\r\nEncapsulated: %v=0, %v=%d\r\n\r\n%v", name, bodySection, len(header), header)
+	if body != "" {
+		resp += icapChunked(body)
+	}
+	return resp
+}
+
+func icapProxyClient(t *testing.T, opts *ICAPOptions) (*http.Client, func()) {
+	filter, err := NewICAPFilter(opts)
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go newProxy(&Opts{Filter: filter}).Serve(l)
+	proxyURL, _ := url.Parse("http://" + l.Addr().String())
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	return &http.Client{Transport: tr}, func() {
+		tr.CloseIdleConnections()
+		l.Close()
+	}
+}
+
+func TestICAPReqMod(t *testing.T) {
+	origin := ht.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		fmt.Fprintf(w, "%v %v %v", req.URL.Path, req.Header.Get("X-Scanned"), string(body))
+	}))
+	defer origin.Close()
+
+	icap := serveICAP(t, func(m *icapTestMessage, readRest func() []byte, w io.Writer) {
+		assert.Equal(t, "REQMOD", m.method)
+		assert.Equal(t, "127.0.0.1", m.header.Get("X-Client-IP"))
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(m.reqHdr)))
+		require.NoError(t, err)
+		switch req.URL.Path {
+		case "/blocked":
+			io.WriteString(w, icapResponse("res-hdr", "HTTP/1.1 403 Forbidden\r\nContent-Type: text/plain\r\n\r\n", "blocked"))
+		case "/unmodified":
+			io.WriteString(w, "ICAP/1.0 204 No Content\r\n\r\n")
+		default:
+			assert.True(t, m.hasBody)
+			req.URL.Path = "/adapted"
+			req.Header.Set("X-Scanned", "yes")
+			req.Header.Del("Content-Length")
+			reqHdr := &bytes.Buffer{}
+			fmt.Fprintf(reqHdr, "POST %v HTTP/1.1\r\nHost: %v\r\n", req.URL, req.Host)
+			req.Header.Write(reqHdr)
+			reqHdr.WriteString("\r\n")
+			io.WriteString(w, icapResponse("req-hdr", reqHdr.String(), strings.ToUpper(string(m.body))))
+		}
+	})
+	defer icap.Close()
+
+	client, stop := icapProxyClient(t, &ICAPOptions{ReqModURL: "icap://" + icap.Addr().String() + "/reqmod"})
+	defer stop()
+
+	do := func(method, path string, body string) (int, string) {
+		req, _ := http.NewRequest(method, origin.URL+path, strings.NewReader(body))
+		if body == "" {
+			req.Body = nil
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	status, body := do(http.MethodPost, "/original", "hello")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "/adapted yes HELLO", body)
+
+	status, body = do(http.MethodGet, "/blocked", "")
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, "blocked", body)
+
+	status, body = do(http.MethodGet, "/unmodified", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "/unmodified  ", body)
+}
+
+func TestICAPRespModPreview(t *testing.T) {
+	origin := ht.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, strings.TrimPrefix(req.URL.Path, "/"))
+	}))
+	defer origin.Close()
+
+	icap := serveICAP(t, func(m *icapTestMessage, readRest func() []byte, w io.Writer) {
+		assert.Equal(t, "RESPMOD", m.method)
+		assert.Equal(t, strconv.Itoa(len(m.body)), m.header.Get("Preview"), "Preview should be the number of bytes previewed")
+		assert.Contains(t, m.reqHdr, "GET ")
+		assert.Contains(t, m.resHdr, "HTTP/1.1 200 OK")
+		if m.ieof {
+			// Whole body fit in the preview
+			assert.Equal(t, "ok", string(m.body))
+			io.WriteString(w, "ICAP/1.0 204 No Content\r\n\r\n")
+			return
+		}
+		assert.Equal(t, "larg", string(m.body))
+		io.WriteString(w, "ICAP/1.0 100 Continue\r\n\r\n")
+		body := string(m.body) + string(readRest())
+		if body == "large-but-clean" {
+			// 204 is only allowed in response to the preview
+			io.WriteString(w, "ICAP/1.0 204 No Content\r\n\r\n")
+			return
+		}
+		io.WriteString(w, icapResponse("res-hdr", "HTTP/1.1 200 OK\r\nX-Adapted: true\r\n\r\n", strings.ToUpper(body)))
+	})
+	defer icap.Close()
+
+	client, stop := icapProxyClient(t, &ICAPOptions{RespModURL: "icap://" + icap.Addr().String() + "/respmod", Preview: 4})
+	defer stop()
+
+	get := func(path string) (*http.Response, string) {
+		resp, err := client.Get(origin.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(data)
+	}
+
+	resp, body := get("/ok")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "ok", body, "Unmodified response should keep its body")
+
+	resp, body = get("/large-body")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "true", resp.Header.Get("X-Adapted"))
+	assert.Equal(t, "LARGE-BODY", body)
+
+	resp, _ = get("/large-but-clean")
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode, "Body that was consumed can't be restored")
+}
+
+func TestICAPBypassOnError(t *testing.T) {
+	origin := ht.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "origin")
+	}))
+	defer origin.Close()
+
+	// Nothing is listening here once closed
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	icapURL := "icap://" + l.Addr().String() + "/respmod"
+	l.Close()
+
+	client, stop := icapProxyClient(t, &ICAPOptions{RespModURL: icapURL, BypassOnError: true})
+	defer stop()
+	resp, err := client.Get(origin.URL)
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "origin", string(body))
+
+	client, stop = icapProxyClient(t, &ICAPOptions{RespModURL: icapURL})
+	defer stop()
+	resp, err = client.Get(origin.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	_, err = NewICAPFilter(&ICAPOptions{ReqModURL: "http://example.com/reqmod"})
+	assert.Error(t, err)
+}
+
+func TestICAPOversizedHeader(t *testing.T) {
+	origin := ht.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "origin")
+	}))
+	defer origin.Close()
+	icap := serveICAP(t, func(m *icapTestMessage, readRest func() []byte, w io.Writer) {
+		io.WriteString(w, "ICAP/1.0 200 OK\r\nEncapsulated: res-hdr=0, null-body=2000000000\r\n\r\nHTTP/1.1 200 OK\r\n")
+	})
+	defer icap.Close()
+
+	client, stop := icapProxyClient(t, &ICAPOptions{RespModURL: "icap://" + icap.Addr().String() + "/respmod"})
+	defer stop()
+	resp, err := client.Get(origin.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode, "Oversized header sections should fail the exchange")
+}
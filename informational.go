@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+)
+
+const (
+	ctxKeyInformational = contextKey("informational")
+)
+
+// informationalWriter writes an interim (1xx) response to downstream.
+type informationalWriter func(code int, header http.Header) error
+
+// traceInformational arranges for interim responses like 100 Continue and
+// 103 Early Hints received while round-tripping req to be forwarded
+// downstream, if the downstream connection supports it.
+func traceInformational(req *http.Request) *http.Request {
+	write, _ := req.Context().Value(ctxKeyInformational).(informationalWriter)
+	if write == nil {
+		return req
+	}
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			forwarded := make(http.Header)
+			copyHeadersForForwarding(forwarded, http.Header(header))
+			if err := write(code, forwarded); err != nil {
+				log.Debugf("Unable to forward %d response downstream: %v", code, err)
+			}
+			return nil
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// http1Informational returns an informationalWriter that writes interim
+// responses to an HTTP/1.1 downstream connection, or nil for HTTP/1.0
+// clients, which don't understand them.
+func http1Informational(downstream io.Writer, req *http.Request) informationalWriter {
+	if !req.ProtoAtLeast(1, 1) {
+		return nil
+	}
+	return func(code int, header http.Header) error {
+		if _, err := fmt.Fprintf(downstream, "HTTP/1.1 %03d %s\r\n", code, http.StatusText(code)); err != nil {
+			return err
+		}
+		if err := header.Write(downstream); err != nil {
+			return err
+		}
+		_, err := io.WriteString(downstream, "\r\n")
+		return err
+	}
+}
+
+// http2Informational returns an informationalWriter that writes interim
+// responses to w. 100 Continue is left to the HTTP/2 server, which sends it
+// on its own once the request body is read.
+func http2Informational(w http.ResponseWriter) informationalWriter {
+	return func(code int, header http.Header) error {
+		if code == http.StatusContinue {
+			return nil
+		}
+		for key, values := range header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(code)
+		// Headers of interim responses don't carry over to the final response
+		for key := range header {
+			w.Header().Del(key)
+		}
+		return nil
+	}
+}
+
+func withInformational(ctx context.Context, write informationalWriter) context.Context {
+	return context.WithValue(ctx, ctxKeyInformational, write)
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwardTrailersAndInformational(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		// Reading the body sends 100 Continue
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Del("Link")
+		w.Header().Set("Trailer", "Grpc-Status, X-Request-Trailer")
+		w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("X-Request-Trailer", req.Trailer.Get("X-Checksum"))
+	}))
+	defer origin.Close()
+
+	l := serveProxy(t, &Opts{
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	})
+	defer l.Close()
+
+	proxyURL, _ := url.Parse("http://" + l.Addr().String())
+	tr := &http.Transport{
+		Proxy:                 http.ProxyURL(proxyURL),
+		ExpectContinueTimeout: 10 * time.Second,
+	}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+
+	var mx sync.Mutex
+	var interim []int
+	var links []string
+	ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			mx.Lock()
+			interim = append(interim, code)
+			links = append(links, header.Get("Link"))
+			mx.Unlock()
+			return nil
+		},
+	})
+	req, _ := http.NewRequest(http.MethodPost, origin.URL, ioutil.NopCloser(strings.NewReader("hello")))
+	req = req.WithContext(ctx)
+	req.Header.Set("Expect", "100-continue")
+	req.Trailer = http.Header{"X-Checksum": []string{"abc"}}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, "abc", resp.Trailer.Get("X-Request-Trailer"), "Request trailer should have reached origin")
+	assert.True(t, time.Since(start) < 5*time.Second, "Client shouldn't have waited for ExpectContinueTimeout")
+
+	mx.Lock()
+	defer mx.Unlock()
+	assert.Equal(t, []int{http.StatusEarlyHints, http.StatusContinue}, interim)
+	assert.Equal(t, "</style.css>; rel=preload", links[0])
+	assert.Empty(t, resp.Header.Get("Link"), "Early hints headers shouldn't carry over")
+}
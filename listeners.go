@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	// ListenerHTTP serves HTTP proxy requests, like Serve.
+	ListenerHTTP = "http"
+
+	// ListenerHTTPS serves HTTPS proxy requests, like ServeTLS.
+	ListenerHTTPS = "https"
+
+	// ListenerCONNECT serves HTTP proxy requests with the CONNECT fast path,
+	// like ServeCONNECT.
+	ListenerCONNECT = "connect"
+
+	// ListenerSOCKS5 serves SOCKS5, like ServeSOCKS5.
+	ListenerSOCKS5 = "socks5"
+
+	// ListenerSOCKS serves SOCKS5, SOCKS4 and SOCKS4a, like ServeSOCKS.
+	ListenerSOCKS = "socks"
+
+	// ListenerTransparent serves redirected TLS traffic, like
+	// ServeTransparent.
+	ListenerTransparent = "transparent"
+
+	// systemdFirstFD is the first file descriptor passed by systemd socket
+	// activation, following stdin, stdout and stderr
+	systemdFirstFD = 3
+)
+
+// ListenerSpec is a listener to serve with ServeListeners.
+type ListenerSpec struct {
+	Listener net.Listener
+
+	// Protocol is one of the Listener* constants, defaults to ListenerHTTP.
+	Protocol string
+
+	// TLSOpts configures ListenerHTTPS.
+	TLSOpts *TLSServerOpts
+}
+
+// ServeListeners serves all of the given listeners with p at once, e.g. plain
+// HTTP, TLS and SOCKS listeners, all of which share p's state (like open
+// tunnels, limits, upstream connections and configuration). It returns once
+// they've all stopped. If serving one of them fails, the others are closed and
+// the first error is returned. Once p is shut down, it returns ErrShutdown.
+func ServeListeners(p Proxy, specs ...*ListenerSpec) error {
+	for _, spec := range specs {
+		switch spec.Protocol {
+		case "", ListenerHTTP, ListenerCONNECT, ListenerSOCKS5, ListenerSOCKS, ListenerTransparent:
+		case ListenerHTTPS:
+			if spec.TLSOpts == nil {
+				return errors.New("Missing TLSOpts for HTTPS listener at %v", spec.Listener.Addr())
+			}
+		default:
+			return errors.New("Unsupported listener protocol %v", spec.Protocol)
+		}
+	}
+
+	errs := make(chan error, len(specs))
+	for _, spec := range specs {
+		spec := spec
+		go func() {
+			errs <- serveListener(p, spec)
+		}()
+	}
+	var firstErr error
+	for range specs {
+		err := <-errs
+		if firstErr == nil {
+			firstErr = err
+			for _, spec := range specs {
+				spec.Listener.Close()
+			}
+		}
+	}
+	return firstErr
+}
+
+func serveListener(p Proxy, spec *ListenerSpec) error {
+	switch spec.Protocol {
+	case ListenerHTTPS:
+		return p.ServeTLS(spec.Listener, spec.TLSOpts)
+	case ListenerCONNECT:
+		return p.ServeCONNECT(spec.Listener)
+	case ListenerSOCKS5:
+		return p.ServeSOCKS5(spec.Listener)
+	case ListenerSOCKS:
+		return p.ServeSOCKS(spec.Listener)
+	case ListenerTransparent:
+		return p.ServeTransparent(spec.Listener)
+	default:
+		return p.Serve(spec.Listener)
+	}
+}
+
+// InheritedListener is a listening socket inherited from the process that
+// started this one.
+type InheritedListener struct {
+	net.Listener
+
+	// Name is the name given to the socket, e.g. with FileDescriptorName= in
+	// a systemd socket unit.
+	Name string
+}
+
+// SystemdListeners returns the listening sockets passed with systemd socket
+// activation (see sd_listen_fds(3)), in order, or none if there are none. The
+// LISTEN_* environment variables are cleared so that child processes don't
+// mistake the sockets as theirs.
+func SystemdListeners() ([]*InheritedListener, error) {
+	pid, fds, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	return systemdListeners(pid, fds, names, systemdFirstFD)
+}
+
+func systemdListeners(pid string, fds string, names string, firstFD uintptr) ([]*InheritedListener, error) {
+	if fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		// Not for us
+		return nil, nil
+	}
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 0 {
+		return nil, errors.New("Invalid LISTEN_FDS %v", fds)
+	}
+	var fdNames []string
+	if names != "" {
+		fdNames = strings.Split(names, ":")
+	}
+	fdList := make([]uintptr, count)
+	for i := range fdList {
+		fdList[i] = firstFD + uintptr(i)
+	}
+	listeners, err := FileListeners(fdList...)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*InheritedListener, 0, count)
+	for i, l := range listeners {
+		name := "unknown"
+		if i < len(fdNames) && fdNames[i] != "" {
+			name = fdNames[i]
+		}
+		result = append(result, &InheritedListener{Listener: l, Name: name})
+	}
+	return result, nil
+}
+
+// FileListeners returns listeners for the given inherited file descriptors of
+// listening sockets, which it takes ownership of. If any of them isn't a
+// listening socket, the others are closed and an error is returned.
+func FileListeners(fds ...uintptr) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(fds))
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	for _, fd := range fds {
+		file := os.NewFile(fd, "listener-"+strconv.Itoa(int(fd)))
+		if file == nil {
+			closeAll()
+			return nil, errors.New("Invalid file descriptor %d", fd)
+		}
+		// FileListener works on a duplicate of the descriptor
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			closeAll()
+			return nil, errors.New("File descriptor %d isn't a listening socket: %v", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
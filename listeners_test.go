@@ -0,0 +1,175 @@
+//go:build !windows
+// +build !windows
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeListeners(t *testing.T) {
+	// The origin answers once and hangs up when told to, so that the tunnel
+	// finishes promptly
+	origin, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer origin.Close()
+	hangUp := make(chan interface{})
+	go func() {
+		for {
+			conn, err := origin.Accept()
+			if err != nil {
+				return
+			}
+			b := make([]byte, 4)
+			io.ReadFull(conn, b)
+			conn.Write(b)
+			<-hangUp
+			conn.Close()
+		}
+	}()
+	p := newProxy(&Opts{ConcurrencyLimit: 1})
+
+	httpL, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	socksL, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeListeners(p,
+			&ListenerSpec{Listener: httpL},
+			&ListenerSpec{Listener: socksL, Protocol: ListenerSOCKS5},
+		)
+	}()
+
+	conn, br, resp := openTunnel(t, httpL.Addr().String(), origin.Addr().String())
+	defer conn.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(br, make([]byte, 4))
+	require.NoError(t, err)
+
+	// The concurrency limit is shared with the SOCKS listener
+	socksConn, err := ChainDial(nil, &Upstream{Protocol: UpstreamSOCKS5, Addr: socksL.Addr().String()})(context.Background(), true, "tcp", origin.Addr().String())
+	if err == nil {
+		socksConn.Close()
+	}
+	assert.Error(t, err, "SOCKS tunnel should exceed the shared concurrency limit")
+
+	close(hangUp)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go p.Shutdown(ctx)
+	select {
+	case err := <-served:
+		assert.Equal(t, ErrShutdown, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeListeners should return once shut down")
+	}
+}
+
+func TestServeListenersFailure(t *testing.T) {
+	p := newProxy(&Opts{})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	err = ServeListeners(p, &ListenerSpec{Listener: l, Protocol: "gopher"})
+	assert.Error(t, err, "Unknown protocols should be rejected")
+	err = ServeListeners(p, &ListenerSpec{Listener: l, Protocol: ListenerHTTPS})
+	assert.Error(t, err, "HTTPS requires TLSOpts")
+
+	failing, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	failing.Close()
+	err = ServeListeners(p, &ListenerSpec{Listener: l}, &ListenerSpec{Listener: failing})
+	assert.Error(t, err)
+	_, err = net.Dial("tcp", l.Addr().String())
+	assert.Error(t, err, "Other listeners should be closed after one fails")
+}
+
+// inheritableFD returns a duplicate of l's file descriptor, as if inherited
+// from a parent process.
+func inheritableFD(t *testing.T, l net.Listener) uintptr {
+	file, err := l.(*net.TCPListener).File()
+	require.NoError(t, err)
+	defer file.Close()
+	fd, err := syscall.Dup(int(file.Fd()))
+	require.NoError(t, err)
+	return uintptr(fd)
+}
+
+func TestSystemdListeners(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	pid := strconv.Itoa(os.Getpid())
+
+	listeners, err := systemdListeners(pid, "", "", systemdFirstFD)
+	require.NoError(t, err)
+	assert.Empty(t, listeners, "Nothing should be inherited without LISTEN_FDS")
+	listeners, err = systemdListeners("1", "1", "", systemdFirstFD)
+	require.NoError(t, err)
+	assert.Empty(t, listeners, "Sockets for other processes should be ignored")
+	_, err = systemdListeners(pid, "many", "", systemdFirstFD)
+	assert.Error(t, err)
+
+	listeners, err = systemdListeners(pid, "1", "proxy", inheritableFD(t, l))
+	require.NoError(t, err)
+	require.Len(t, listeners, 1)
+	inherited := listeners[0]
+	assert.Equal(t, "proxy", inherited.Name)
+	assert.Equal(t, l.Addr().String(), inherited.Addr().String())
+
+	p := newProxy(&Opts{})
+	served := make(chan error, 1)
+	go func() {
+		served <- p.Serve(inherited)
+	}()
+	origin := newEchoServer(t)
+	defer origin.Close()
+	l.Close()
+	conn, _, resp := openTunnel(t, inherited.Addr().String(), origin.Addr().String())
+	conn.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Inherited socket should be served")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	p.Shutdown(ctx)
+	assert.Equal(t, ErrShutdown, <-served)
+}
+
+func TestFileListeners(t *testing.T) {
+	a, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer a.Close()
+	b, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer b.Close()
+
+	listeners, err := FileListeners(inheritableFD(t, a), inheritableFD(t, b))
+	require.NoError(t, err)
+	require.Len(t, listeners, 2)
+	assert.Equal(t, a.Addr().String(), listeners[0].Addr().String())
+	assert.Equal(t, b.Addr().String(), listeners[1].Addr().String())
+	for _, l := range listeners {
+		l.Close()
+	}
+
+	notListening, err := os.Open(os.DevNull)
+	require.NoError(t, err)
+	notListeningFD, err := syscall.Dup(int(notListening.Fd()))
+	require.NoError(t, err)
+	notListening.Close()
+	_, err = FileListeners(inheritableFD(t, a), uintptr(notListeningFD))
+	assert.Error(t, err)
+}
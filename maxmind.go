@@ -0,0 +1,367 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+
+	"github.com/getlantern/errors"
+)
+
+var (
+	maxMindMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+)
+
+const (
+	mmdbPointer   = 1
+	mmdbString    = 2
+	mmdbDouble    = 3
+	mmdbBytes     = 4
+	mmdbUint16    = 5
+	mmdbUint32    = 6
+	mmdbMap       = 7
+	mmdbInt32     = 8
+	mmdbUint64    = 9
+	mmdbUint128   = 10
+	mmdbArray     = 11
+	mmdbContainer = 12
+	mmdbEndMarker = 13
+	mmdbBool      = 14
+	mmdbFloat     = 15
+
+	// mmdbDataSeparator is the size of the gap between the search tree and
+	// the data section
+	mmdbDataSeparator = 16
+)
+
+// MaxMind is a GeoIP backed by MaxMind DB files, like the GeoLite2 or GeoIP2
+// Country, City and ASN databases. The databases are read into memory.
+type MaxMind struct {
+	dbs []*maxMindDB
+}
+
+// OpenMaxMind opens the given MaxMind DB files. The information from all of
+// them is combined, so a Country or City database can be used together with
+// an ASN database.
+func OpenMaxMind(files ...string) (*MaxMind, error) {
+	m := &MaxMind{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.New("Unable to read MaxMind DB %v: %v", file, err)
+		}
+		db, err := parseMaxMindDB(data)
+		if err != nil {
+			return nil, errors.New("Unable to parse MaxMind DB %v: %v", file, err)
+		}
+		m.dbs = append(m.dbs, db)
+	}
+	return m, nil
+}
+
+// Lookup implements the interface GeoIP
+func (m *MaxMind) Lookup(ip net.IP) (*GeoInfo, error) {
+	var info *GeoInfo
+	for _, db := range m.dbs {
+		record, err := db.lookup(ip)
+		if err != nil {
+			return nil, err
+		}
+		fields, ok := record.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if info == nil {
+			info = &GeoInfo{}
+		}
+		if info.Country == "" {
+			info.Country = mmdbCountry(fields, "country")
+		}
+		if info.Country == "" {
+			info.Country = mmdbCountry(fields, "registered_country")
+		}
+		if asn, ok := fields["autonomous_system_number"].(uint64); ok && info.ASN == 0 {
+			info.ASN = uint(asn)
+		}
+		if org, ok := fields["autonomous_system_organization"].(string); ok && info.ASOrg == "" {
+			info.ASOrg = org
+		}
+	}
+	return info, nil
+}
+
+func mmdbCountry(fields map[string]interface{}, key string) string {
+	country, _ := fields[key].(map[string]interface{})
+	code, _ := country["iso_code"].(string)
+	return code
+}
+
+// maxMindDB reads the MaxMind DB format, see
+// https://maxmind.github.io/MaxMind-DB/.
+type maxMindDB struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+}
+
+func parseMaxMindDB(buf []byte) (*maxMindDB, error) {
+	markerAt := bytes.LastIndex(buf, maxMindMetadataMarker)
+	if markerAt < 0 {
+		return nil, errors.New("Metadata not found")
+	}
+	metadataStart := markerAt + len(maxMindMetadataMarker)
+	metadata, _, err := (&mmdbDecoder{buf: buf[metadataStart:]}).decode(0)
+	if err != nil {
+		return nil, errors.New("Unable to decode metadata: %v", err)
+	}
+	fields, ok := metadata.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Metadata isn't a map")
+	}
+	nodeCount, _ := fields["node_count"].(uint64)
+	recordSize, _ := fields["record_size"].(uint64)
+	ipVersion, _ := fields["ip_version"].(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, errors.New("Unsupported record size %d", recordSize)
+	}
+	if ipVersion != 4 && ipVersion != 6 {
+		return nil, errors.New("Unsupported IP version %d", ipVersion)
+	}
+	treeSize := nodeCount * recordSize / 4
+	if treeSize+mmdbDataSeparator > uint64(markerAt) {
+		return nil, errors.New("Search tree exceeds database")
+	}
+	db := &maxMindDB{
+		tree:       buf[:treeSize],
+		data:       buf[treeSize+mmdbDataSeparator : markerAt],
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+		ipVersion:  uint(ipVersion),
+	}
+	if db.ipVersion == 6 {
+		// IPv4 addresses live at ::/96
+		node := uint(0)
+		for i := 0; i < 96 && node < db.nodeCount; i++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// lookup returns the record for ip, or nil if there is none.
+func (db *maxMindDB) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	addr := ip.To4()
+	if addr != nil {
+		node = db.ipv4Start
+	} else if db.ipVersion == 4 {
+		// IPv6 isn't supported by IPv4 databases
+		return nil, nil
+	} else {
+		addr = ip.To16()
+		if addr == nil {
+			return nil, errors.New("Invalid IP %v", ip)
+		}
+	}
+	for i := 0; i < len(addr)*8 && node < db.nodeCount; i++ {
+		bit := uint(addr[i/8]>>(7-uint(i%8))) & 1
+		node = db.record(node, bit)
+	}
+	switch {
+	case node == db.nodeCount:
+		return nil, nil
+	case node < db.nodeCount:
+		return nil, errors.New("Invalid search tree")
+	}
+	offset := node - db.nodeCount - mmdbDataSeparator
+	value, _, err := (&mmdbDecoder{buf: db.data}).decode(offset)
+	return value, err
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (db *maxMindDB) record(node uint, bit uint) uint {
+	b := db.tree[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// mmdbDecoder decodes values in the data section format of MaxMind DBs.
+type mmdbDecoder struct {
+	buf []byte
+}
+
+// decode decodes the value at offset, returning it along with the offset of
+// the next value.
+func (d *mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	typ, size, offset, err := d.decodeControl(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ == mmdbPointer {
+		pointer, next, err := d.decodePointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(pointer)
+		return value, next, err
+	}
+	return d.decodeValue(typ, size, offset)
+}
+
+func (d *mmdbDecoder) decodeControl(offset uint) (typ uint, size uint, next uint, err error) {
+	if offset >= uint(len(d.buf)) {
+		return 0, 0, 0, errors.New("Unexpected end of data")
+	}
+	ctrl := d.buf[offset]
+	offset++
+	typ = uint(ctrl >> 5)
+	if typ == 0 {
+		if offset >= uint(len(d.buf)) {
+			return 0, 0, 0, errors.New("Unexpected end of data")
+		}
+		typ = 7 + uint(d.buf[offset])
+		offset++
+	}
+	size = uint(ctrl & 0x1F)
+	if typ == mmdbPointer || size < 29 {
+		return typ, size, offset, nil
+	}
+	extra := size - 28
+	if offset+extra > uint(len(d.buf)) {
+		return 0, 0, 0, errors.New("Unexpected end of data")
+	}
+	n := uint(0)
+	for _, b := range d.buf[offset : offset+extra] {
+		n = n<<8 | uint(b)
+	}
+	switch size {
+	case 29:
+		size = 29 + n
+	case 30:
+		size = 285 + n
+	default:
+		size = 65821 + n
+	}
+	return typ, size, offset + extra, nil
+}
+
+func (d *mmdbDecoder) decodePointer(size uint, offset uint) (uint, uint, error) {
+	n := (size >> 3) + 1
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, errors.New("Unexpected end of data")
+	}
+	pointer := uint(0)
+	if n < 4 {
+		pointer = size & 0x7
+	}
+	for _, b := range d.buf[offset : offset+n] {
+		pointer = pointer<<8 | uint(b)
+	}
+	switch n {
+	case 2:
+		pointer += 2048
+	case 3:
+		pointer += 526336
+	}
+	return pointer, offset + n, nil
+}
+
+func (d *mmdbDecoder) decodeValue(typ uint, size uint, offset uint) (interface{}, uint, error) {
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			keyString, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("Map key isn't a string")
+			}
+			value, next, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[keyString] = value
+			offset = next
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbContainer, mmdbEndMarker:
+		return nil, offset, nil
+	}
+
+	if offset+size > uint(len(d.buf)) {
+		return nil, 0, errors.New("Unexpected end of data")
+	}
+	b := d.buf[offset : offset+size]
+	next := offset + size
+	switch typ {
+	case mmdbString:
+		return string(b), next, nil
+	case mmdbBytes:
+		return append([]byte(nil), b...), next, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errors.New("Invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errors.New("Invalid float size %d", size)
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), next, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		if size > 8 {
+			return nil, 0, errors.New("Invalid integer size %d", size)
+		}
+		n := uint64(0)
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, next, nil
+	case mmdbInt32:
+		if size > 4 {
+			return nil, 0, errors.New("Invalid integer size %d", size)
+		}
+		n := uint32(0)
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n)), next, nil
+	case mmdbUint128:
+		// Not needed for geolocation, keep the raw bytes
+		return append([]byte(nil), b...), next, nil
+	default:
+		return nil, 0, errors.New("Unknown data type %d", typ)
+	}
+}
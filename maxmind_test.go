@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mmdbTestNode struct {
+	children [2]*mmdbTestNode
+	data     []byte
+	number   uint
+}
+
+// writeTestMaxMindDB writes an IPv6 MaxMind DB with the given record size that
+// maps CIDRs to records.
+func writeTestMaxMindDB(t *testing.T, path string, recordSize uint, records map[string]map[string]interface{}) {
+	root := &mmdbTestNode{}
+	cidrs := make([]string, 0, len(records))
+	for cidr := range records {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		ones, bits := ipNet.Mask.Size()
+		ip := ipNet.IP.To16()
+		if bits == 32 {
+			// IPv4 networks live at ::/96
+			ip = append(make(net.IP, 12), ipNet.IP.To4()...)
+			ones += 96
+		}
+		node := root
+		for i := 0; i < ones; i++ {
+			bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+			if node.children[bit] == nil {
+				node.children[bit] = &mmdbTestNode{}
+			}
+			node = node.children[bit]
+		}
+		node.data = encodeMMDB(records[cidr])
+	}
+
+	// Number the nodes breadth first, leaves with data don't count
+	var nodes []*mmdbTestNode
+	queue := []*mmdbTestNode{root}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		if node.data != nil {
+			continue
+		}
+		node.number = uint(len(nodes))
+		nodes = append(nodes, node)
+		for _, child := range node.children {
+			if child != nil {
+				queue = append(queue, child)
+			}
+		}
+	}
+
+	nodeCount := uint(len(nodes))
+	data := &bytes.Buffer{}
+	recordValue := func(child *mmdbTestNode) uint {
+		switch {
+		case child == nil:
+			return nodeCount
+		case child.data != nil:
+			offset := uint(data.Len())
+			data.Write(child.data)
+			return nodeCount + mmdbDataSeparator + offset
+		default:
+			return child.number
+		}
+	}
+
+	tree := &bytes.Buffer{}
+	for _, node := range nodes {
+		left, right := recordValue(node.children[0]), recordValue(node.children[1])
+		switch recordSize {
+		case 24:
+			tree.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right)})
+		case 28:
+			tree.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(left>>20)&0xF0 | byte(right>>24)&0x0F, byte(right >> 16), byte(right >> 8), byte(right)})
+		default:
+			tree.Write([]byte{byte(left >> 24), byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 24), byte(right >> 16), byte(right >> 8), byte(right)})
+		}
+	}
+
+	file := &bytes.Buffer{}
+	file.Write(tree.Bytes())
+	file.Write(make([]byte, mmdbDataSeparator))
+	file.Write(data.Bytes())
+	file.Write(maxMindMetadataMarker)
+	file.Write(encodeMMDB(map[string]interface{}{
+		"node_count":    uint32(nodeCount),
+		"record_size":   uint16(recordSize),
+		"ip_version":    uint16(6),
+		"database_type": "Test",
+	}))
+
+	require.NoError(t, ioutil.WriteFile(path, file.Bytes(), 0644))
+}
+
+func encodeMMDB(value interface{}) []byte {
+	buf := &bytes.Buffer{}
+	control := func(typ byte, size int) {
+		if size >= 29 {
+			buf.WriteByte(typ<<5 | 29)
+			buf.WriteByte(byte(size - 29))
+			return
+		}
+		buf.WriteByte(typ<<5 | byte(size))
+	}
+	uintBytes := func(n uint64) []byte {
+		var b []byte
+		for ; n > 0; n >>= 8 {
+			b = append([]byte{byte(n)}, b...)
+		}
+		return b
+	}
+	switch v := value.(type) {
+	case string:
+		control(mmdbString, len(v))
+		buf.WriteString(v)
+	case uint16:
+		b := uintBytes(uint64(v))
+		control(mmdbUint16, len(b))
+		buf.Write(b)
+	case uint32:
+		b := uintBytes(uint64(v))
+		control(mmdbUint32, len(b))
+		buf.Write(b)
+	case map[string]interface{}:
+		control(mmdbMap, len(v))
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			buf.Write(encodeMMDB(key))
+			buf.Write(encodeMMDB(v[key]))
+		}
+	default:
+		panic("unsupported type")
+	}
+	return buf.Bytes()
+}
+
+func TestMaxMind(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maxmind")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, recordSize := range []uint{24, 28, 32} {
+		countryDB := filepath.Join(dir, fmt.Sprintf("country%d.mmdb", recordSize))
+		asnDB := filepath.Join(dir, fmt.Sprintf("asn%d.mmdb", recordSize))
+		writeTestMaxMindDB(t, countryDB, recordSize, map[string]map[string]interface{}{
+			"1.2.3.0/24":    {"country": map[string]interface{}{"iso_code": "AU", "names": map[string]interface{}{"en": "Australia"}}},
+			"8.8.0.0/16":    {"registered_country": map[string]interface{}{"iso_code": "US"}},
+			"2001:db8::/32": {"country": map[string]interface{}{"iso_code": "DE"}},
+		})
+		writeTestMaxMindDB(t, asnDB, recordSize, map[string]map[string]interface{}{
+			"8.8.8.0/24": {"autonomous_system_number": uint32(15169), "autonomous_system_organization": "GOOGLE"},
+		})
+
+		geo, err := OpenMaxMind(countryDB, asnDB)
+		require.NoError(t, err)
+
+		info, err := geo.Lookup(net.ParseIP("1.2.3.4"))
+		require.NoError(t, err)
+		assert.Equal(t, &GeoInfo{Country: "AU"}, info)
+
+		info, err = geo.Lookup(net.ParseIP("8.8.8.8"))
+		require.NoError(t, err)
+		assert.Equal(t, &GeoInfo{Country: "US", ASN: 15169, ASOrg: "GOOGLE"}, info, "Should combine databases")
+
+		info, err = geo.Lookup(net.ParseIP("2001:db8::1"))
+		require.NoError(t, err)
+		assert.Equal(t, "DE", info.Country)
+
+		info, err = geo.Lookup(net.ParseIP("9.9.9.9"))
+		require.NoError(t, err)
+		assert.Nil(t, info)
+	}
+
+	bogus := filepath.Join(dir, "bogus.mmdb")
+	require.NoError(t, ioutil.WriteFile(bogus, []byte("not a database"), 0644))
+	_, err = OpenMaxMind(bogus)
+	assert.Error(t, err)
+	_, err = OpenMaxMind(filepath.Join(dir, "missing.mmdb"))
+	assert.Error(t, err)
+}
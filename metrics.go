@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	noopMetrics Metrics = &nullMetrics{}
+)
+
+// Metrics receives measurements about the proxy's operation. Implementations
+// must be safe for concurrent use.
+type Metrics interface {
+	// UpstreamDialed is called after every attempt to dial an upstream
+	// destination with the time it took and the resulting error (if any).
+	UpstreamDialed(addr string, isCONNECT bool, latency time.Duration, err error)
+
+	// TunnelOpened is called when data starts being piped through a tunnel
+	// (CONNECT or SOCKS).
+	TunnelOpened(addr string)
+
+	// TunnelClosed is called when a tunnel finishes.
+	TunnelClosed(addr string, duration time.Duration)
+
+	// BytesUp is called with the number of bytes sent to upstream.
+	BytesUp(n int)
+
+	// BytesDown is called with the number of bytes received from upstream.
+	BytesDown(n int)
+
+	// ResponseWritten is called for every response written to the client,
+	// including CONNECT responses and responses generated by the proxy.
+	ResponseWritten(req *http.Request, statusCode int)
+
+	// DestinationLimited is called when a tunnel or request to host exceeds
+	// Opts.DestinationConcurrencyLimit, with queued true when it starts
+	// waiting for a slot and false when it's rejected.
+	DestinationLimited(host string, queued bool)
+}
+
+type nullMetrics struct{}
+
+func (m *nullMetrics) UpstreamDialed(addr string, isCONNECT bool, latency time.Duration, err error) {}
+func (m *nullMetrics) TunnelOpened(addr string)                                                     {}
+func (m *nullMetrics) TunnelClosed(addr string, duration time.Duration)                             {}
+func (m *nullMetrics) BytesUp(n int)                                                                {}
+func (m *nullMetrics) BytesDown(n int)                                                              {}
+func (m *nullMetrics) ResponseWritten(req *http.Request, statusCode int)                            {}
+func (m *nullMetrics) DestinationLimited(host string, queued bool)                                  {}
+
+// meteredConn reports bytes read from and written to an upstream connection.
+type meteredConn struct {
+	net.Conn
+	metrics Metrics
+}
+
+func (conn *meteredConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	if n > 0 {
+		conn.metrics.BytesDown(n)
+	}
+	return n, err
+}
+
+func (conn *meteredConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	if n > 0 {
+		conn.metrics.BytesUp(n)
+	}
+	return n, err
+}
+
+func (conn *meteredConn) Wrapped() net.Conn {
+	return conn.Conn
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	dialLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+// PrometheusMetrics is an implementation of Metrics that exposes the collected
+// metrics in the Prometheus text exposition format. It implements
+// http.Handler, so it can be mounted directly as a scrape endpoint.
+type PrometheusMetrics struct {
+	namespace string
+
+	bytesUp             int64
+	bytesDown           int64
+	activeTunnels       int64
+	tunnels             int64
+	destinationsQueued  int64
+	destinationsLimited int64
+
+	mx              sync.Mutex
+	dialSuccesses   int64
+	dialFailures    int64
+	dialBuckets     []int64
+	dialLatencySum  float64
+	tunnelSeconds   float64
+	responsesByCode map[int]int64
+	slo             *SLOTracker
+}
+
+// NewPrometheusMetrics creates a PrometheusMetrics whose metric names are
+// prefixed with the given namespace (e.g. "proxy").
+func NewPrometheusMetrics(namespace string) *PrometheusMetrics {
+	return &PrometheusMetrics{
+		namespace:       namespace,
+		dialBuckets:     make([]int64, len(dialLatencyBuckets)),
+		responsesByCode: make(map[int]int64),
+	}
+}
+
+// UpstreamDialed implements the interface Metrics
+func (m *PrometheusMetrics) UpstreamDialed(addr string, isCONNECT bool, latency time.Duration, err error) {
+	seconds := latency.Seconds()
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if err != nil {
+		m.dialFailures++
+		return
+	}
+	m.dialSuccesses++
+	m.dialLatencySum += seconds
+	for i, bound := range dialLatencyBuckets {
+		if seconds <= bound {
+			m.dialBuckets[i]++
+		}
+	}
+}
+
+// TunnelOpened implements the interface Metrics
+func (m *PrometheusMetrics) TunnelOpened(addr string) {
+	atomic.AddInt64(&m.activeTunnels, 1)
+	atomic.AddInt64(&m.tunnels, 1)
+}
+
+// TunnelClosed implements the interface Metrics
+func (m *PrometheusMetrics) TunnelClosed(addr string, duration time.Duration) {
+	atomic.AddInt64(&m.activeTunnels, -1)
+	m.mx.Lock()
+	m.tunnelSeconds += duration.Seconds()
+	m.mx.Unlock()
+}
+
+// BytesUp implements the interface Metrics
+func (m *PrometheusMetrics) BytesUp(n int) {
+	atomic.AddInt64(&m.bytesUp, int64(n))
+}
+
+// BytesDown implements the interface Metrics
+func (m *PrometheusMetrics) BytesDown(n int) {
+	atomic.AddInt64(&m.bytesDown, int64(n))
+}
+
+// ResponseWritten implements the interface Metrics
+func (m *PrometheusMetrics) ResponseWritten(req *http.Request, statusCode int) {
+	m.mx.Lock()
+	m.responsesByCode[statusCode]++
+	m.mx.Unlock()
+}
+
+// DestinationLimited implements the interface Metrics
+func (m *PrometheusMetrics) DestinationLimited(host string, queued bool) {
+	if queued {
+		atomic.AddInt64(&m.destinationsQueued, 1)
+	} else {
+		atomic.AddInt64(&m.destinationsLimited, 1)
+	}
+}
+
+// ExportSLO includes the success rates, error budgets and latency
+// percentiles per destination that tracker maintains in the metrics written by
+// WriteTo.
+func (m *PrometheusMetrics) ExportSLO(tracker *SLOTracker) {
+	m.mx.Lock()
+	m.slo = tracker
+	m.mx.Unlock()
+}
+
+// ServeHTTP implements the interface http.Handler
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// WriteTo writes all metrics to w in the Prometheus text exposition format.
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	m.writeMetric(cw, "bytes_up_total", "counter", "Bytes sent to upstream.", atomic.LoadInt64(&m.bytesUp))
+	m.writeMetric(cw, "bytes_down_total", "counter", "Bytes received from upstream.", atomic.LoadInt64(&m.bytesDown))
+	m.writeMetric(cw, "active_tunnels", "gauge", "Currently open tunnels.", atomic.LoadInt64(&m.activeTunnels))
+	m.writeMetric(cw, "tunnels_total", "counter", "Tunnels opened.", atomic.LoadInt64(&m.tunnels))
+	m.writeHeader(cw, "destination_limited_total", "counter", "Tunnels and requests over the per-destination concurrency limit by outcome.")
+	fmt.Fprintf(cw, "%s_destination_limited_total{result=\"queued\"} %d\n", m.namespace, atomic.LoadInt64(&m.destinationsQueued))
+	fmt.Fprintf(cw, "%s_destination_limited_total{result=\"rejected\"} %d\n", m.namespace, atomic.LoadInt64(&m.destinationsLimited))
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.writeMetric(cw, "tunnel_duration_seconds_total", "counter", "Cumulative duration of closed tunnels.", m.tunnelSeconds)
+
+	m.writeHeader(cw, "dials_total", "counter", "Upstream dial attempts by result.")
+	fmt.Fprintf(cw, "%s_dials_total{result=\"success\"} %d\n", m.namespace, m.dialSuccesses)
+	fmt.Fprintf(cw, "%s_dials_total{result=\"failure\"} %d\n", m.namespace, m.dialFailures)
+
+	m.writeHeader(cw, "dial_duration_seconds", "histogram", "Latency of successful upstream dials.")
+	for i, bound := range dialLatencyBuckets {
+		fmt.Fprintf(cw, "%s_dial_duration_seconds_bucket{le=\"%s\"} %d\n", m.namespace, strconv.FormatFloat(bound, 'g', -1, 64), m.dialBuckets[i])
+	}
+	fmt.Fprintf(cw, "%s_dial_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.namespace, m.dialSuccesses)
+	fmt.Fprintf(cw, "%s_dial_duration_seconds_sum %v\n", m.namespace, m.dialLatencySum)
+	fmt.Fprintf(cw, "%s_dial_duration_seconds_count %d\n", m.namespace, m.dialSuccesses)
+
+	m.writeHeader(cw, "responses_total", "counter", "Responses written to clients by status code.")
+	codes := make([]int, 0, len(m.responsesByCode))
+	for code := range m.responsesByCode {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(cw, "%s_responses_total{code=\"%d\"} %d\n", m.namespace, code, m.responsesByCode[code])
+	}
+	if m.slo != nil {
+		m.slo.writeTo(cw, m)
+	}
+	return cw.n, cw.err
+}
+
+func (m *PrometheusMetrics) writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s_%s %s\n# TYPE %s_%s %s\n", m.namespace, name, help, m.namespace, name, kind)
+}
+
+func (m *PrometheusMetrics) writeMetric(w io.Writer, name string, kind string, help string, value interface{}) {
+	m.writeHeader(w, name, kind, help)
+	fmt.Fprintf(w, "%s_%s %v\n", m.namespace, name, value)
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/getlantern/mockconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	successText := "I'm good!"
+	d := mockconn.SucceedingDialer([]byte(successText))
+	metrics := NewPrometheusMetrics("proxy")
+	p := newProxy(&Opts{
+		OKWaitsForUpstream: true,
+		Metrics:            metrics,
+		Dial: func(ctx context.Context, isConnect bool, net, addr string) (net.Conn, error) {
+			return d.Dial(net, addr)
+		},
+	})
+
+	req, _ := http.NewRequest(http.MethodConnect, "http://thehost:123", strings.NewReader("hello"))
+	_, _, err := roundTrip(p, req, true)
+	assert.NoError(t, err)
+
+	failing := newProxy(&Opts{
+		OKWaitsForUpstream: true,
+		Metrics:            metrics,
+		Dial: func(ctx context.Context, isConnect bool, net, addr string) (net.Conn, error) {
+			return nil, errors.New("I don't want to dial")
+		},
+	})
+	req, _ = http.NewRequest(http.MethodConnect, "http://thehost:123", nil)
+	roundTrip(failing, req, true)
+
+	out := &bytes.Buffer{}
+	_, err = metrics.WriteTo(out)
+	if !assert.NoError(t, err) {
+		return
+	}
+	text := out.String()
+	assert.Contains(t, text, "proxy_bytes_down_total 9\n")
+	assert.Contains(t, text, "proxy_active_tunnels 0\n")
+	assert.Contains(t, text, "proxy_tunnels_total 1\n")
+	assert.Contains(t, text, `proxy_dials_total{result="success"} 1`)
+	assert.Contains(t, text, `proxy_dials_total{result="failure"} 1`)
+	assert.Contains(t, text, `proxy_dial_duration_seconds_count 1`)
+	assert.Contains(t, text, `proxy_responses_total{code="200"} 1`)
+	assert.Contains(t, text, `proxy_responses_total{code="502"} 1`)
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+)
+
+const (
+	defaultMirrorMaxConcurrent = 10
+	defaultMirrorMaxBodySize   = 1024 * 1024
+	defaultMirrorTimeout       = 30 * time.Second
+)
+
+// MirrorOptions configures a filter that duplicates forwarded requests to a
+// secondary upstream, for example to try out a new backend with live traffic.
+// See NewMirrorFilter.
+type MirrorOptions struct {
+	// URL is the http:// or https:// URL of the secondary upstream. Its path
+	// is prepended to the path of mirrored requests.
+	URL string
+
+	// Match, if specified, selects the requests to mirror. By default, all
+	// are mirrored.
+	Match func(req *http.Request) bool
+
+	// PreserveHost sends mirrored requests with the Host requested by the
+	// client instead of the host of URL.
+	PreserveHost bool
+
+	// MaxConcurrent limits how many mirrored requests may be in flight at
+	// once, defaults to 10. Requests beyond the limit aren't mirrored.
+	MaxConcurrent int
+
+	// MaxBodySize is the largest request body that's mirrored, defaults to
+	// 1 MiB. Since bodies are buffered up to this size before being
+	// forwarded, requests with larger bodies aren't mirrored.
+	MaxBodySize int64
+
+	// Timeout limits how long each mirrored request may take, defaults to 30
+	// seconds.
+	Timeout time.Duration
+
+	// Client sends mirrored requests, defaults to an http.Client that doesn't
+	// follow redirects.
+	Client *http.Client
+}
+
+// NewMirrorFilter creates a Filter that sends a copy of each matching request
+// to the upstream configured in opts, in the background. Responses from the
+// mirror are discarded and its failures are only logged, so it never affects
+// the request that's forwarded as usual. CONNECT requests and upgrades aren't
+// mirrored, though requests on MITM'ed connections are like any other.
+func NewMirrorFilter(opts *MirrorOptions) (filters.Filter, error) {
+	target, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, errors.New("Unable to parse mirror URL %v: %v", opts.URL, err)
+	}
+	if (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, errors.New("Mirror URL %v isn't an absolute http or https URL", opts.URL)
+	}
+	if opts.MaxConcurrent <= 0 {
+		opts.MaxConcurrent = defaultMirrorMaxConcurrent
+	}
+	if opts.MaxBodySize <= 0 {
+		opts.MaxBodySize = defaultMirrorMaxBodySize
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultMirrorTimeout
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+	m := &mirror{opts: opts, target: target, slots: make(chan struct{}, opts.MaxConcurrent)}
+
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		if req.Method != http.MethodConnect && req.Header.Get("Upgrade") == "" && (opts.Match == nil || opts.Match(req)) {
+			m.mirror(req)
+		}
+		return next(ctx, req)
+	}), nil
+}
+
+type mirror struct {
+	opts   *MirrorOptions
+	target *url.URL
+	slots  chan struct{}
+}
+
+// mirror sends a copy of req to the mirror if a slot is available, leaving
+// req's body readable.
+func (m *mirror) mirror(req *http.Request) {
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		log.Debugf("Not mirroring %v %v, %d mirrored requests already in flight", req.Method, req.URL, m.opts.MaxConcurrent)
+		return
+	}
+	mirrored, err := m.newRequest(req)
+	if err != nil {
+		<-m.slots
+		log.Debugf("Not mirroring %v %v: %v", req.Method, req.URL, err)
+		return
+	}
+	go func() {
+		defer func() { <-m.slots }()
+		ctx, cancel := context.WithTimeout(context.Background(), m.opts.Timeout)
+		defer cancel()
+		resp, err := m.opts.Client.Do(mirrored.WithContext(ctx))
+		if err != nil {
+			log.Debugf("Unable to mirror %v %v: %v", mirrored.Method, mirrored.URL, err)
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
+
+// newRequest copies req for the mirror. Since the body can only be read once,
+// it's buffered and req's body replaced to read from the buffer.
+func (m *mirror) newRequest(req *http.Request) (*http.Request, error) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.ContentLength > m.opts.MaxBodySize {
+			return nil, errors.New("Body of %d bytes is too large", req.ContentLength)
+		}
+		buffered, err := ioutil.ReadAll(io.LimitReader(req.Body, m.opts.MaxBodySize+1))
+		req.Body = &restoredBody{io.MultiReader(bytes.NewReader(buffered), req.Body), req.Body}
+		if err != nil {
+			return nil, errors.New("Unable to read body: %v", err)
+		}
+		if int64(len(buffered)) > m.opts.MaxBodySize {
+			return nil, errors.New("Body larger than %d bytes", m.opts.MaxBodySize)
+		}
+		body = buffered
+	}
+
+	u := *m.target
+	u.Path = joinURLPath(m.target.Path, req.URL.Path)
+	u.RawPath = ""
+	u.RawQuery = req.URL.RawQuery
+	mirrored, err := http.NewRequest(req.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.New("Unable to create mirrored request: %v", err)
+	}
+	copyHeadersForForwarding(mirrored.Header, req.Header)
+	mirrored.Header.Del("Connection")
+	mirrored.Header.Del("Host")
+	mirrored.ContentLength = int64(len(body))
+	if body == nil {
+		mirrored.Body = http.NoBody
+	}
+	if m.opts.PreserveHost {
+		mirrored.Host = req.Host
+	}
+	return mirrored, nil
+}
+
+// restoredBody reads the part of a body that was buffered followed by the
+// rest, closing the original body.
+type restoredBody struct {
+	io.Reader
+	io.Closer
+}
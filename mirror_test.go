@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	ht "net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newMirrorServer returns a server that reports the requests it receives as
+// method, request URI and body, waiting for release before responding.
+func newMirrorServer(release chan interface{}) (*ht.Server, chan string) {
+	received := make(chan string, 100)
+	return ht.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		received <- req.Method + " " + req.RequestURI + " " + string(body)
+		if release != nil {
+			<-release
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	})), received
+}
+
+func newBodyEchoServer() *ht.Server {
+	return ht.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("X-Body", string(body))
+	}))
+}
+
+func TestMirrorFilter(t *testing.T) {
+	primary := newBodyEchoServer()
+	defer primary.Close()
+	release := make(chan interface{})
+	secondary, received := newMirrorServer(release)
+	defer secondary.Close()
+	defer close(release)
+
+	filter, err := NewMirrorFilter(&MirrorOptions{URL: secondary.URL + "/shadow", MaxConcurrent: 1})
+	require.NoError(t, err)
+	l := serveProxy(t, &Opts{Filter: filter})
+	defer l.Close()
+
+	resp, err := proxiedRequest(t, l.Addr().String(), http.MethodPost, primary.URL+"/path?q=1")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Mirror's response shouldn't matter")
+	assert.Equal(t, "data", resp.Header.Get("X-Body"), "Primary should still get the body")
+	select {
+	case mirrored := <-received:
+		assert.Equal(t, "POST /shadow/path?q=1 data", mirrored)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Request wasn't mirrored")
+	}
+
+	resp, err = proxiedRequest(t, l.Addr().String(), http.MethodGet, primary.URL+"/dropped")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Request should be forwarded while the mirror is busy")
+	release <- nil
+	var mirrored string
+	require.Eventually(t, func() bool {
+		proxiedRequest(t, l.Addr().String(), http.MethodGet, primary.URL+"/after")
+		select {
+		case mirrored = <-received:
+			return true
+		default:
+			return false
+		}
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, "GET /shadow/after ", mirrored, "Request beyond MaxConcurrent shouldn't be mirrored")
+}
+
+func TestMirrorFilterSkipped(t *testing.T) {
+	primary := newBodyEchoServer()
+	defer primary.Close()
+	secondary, received := newMirrorServer(nil)
+	defer secondary.Close()
+
+	filter, err := NewMirrorFilter(&MirrorOptions{
+		URL:         secondary.URL,
+		MaxBodySize: 3,
+		Match: func(req *http.Request) bool {
+			return !strings.HasPrefix(req.URL.Path, "/private")
+		},
+	})
+	require.NoError(t, err)
+	l := serveProxy(t, &Opts{Filter: filter})
+	defer l.Close()
+
+	resp, err := proxiedRequest(t, l.Addr().String(), http.MethodPost, primary.URL+"/large")
+	require.NoError(t, err)
+	assert.Equal(t, "data", resp.Header.Get("X-Body"), "Body too large to mirror should still be forwarded")
+	_, err = proxiedRequest(t, l.Addr().String(), http.MethodGet, primary.URL+"/private")
+	require.NoError(t, err)
+	_, err = proxiedRequest(t, l.Addr().String(), http.MethodGet, primary.URL+"/public")
+	require.NoError(t, err)
+	select {
+	case mirrored := <-received:
+		assert.Equal(t, "GET /public ", mirrored)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Request wasn't mirrored")
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, received)
+}
+
+func TestNewMirrorFilterInvalidURL(t *testing.T) {
+	for _, u := range []string{"", "/relative", "ftp://example.com", "http://%zz"} {
+		_, err := NewMirrorFilter(&MirrorOptions{URL: u})
+		assert.Error(t, err, u)
+	}
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+)
+
+// MuxSession is a session of a stream multiplexer carrying many logical
+// streams over a single physical connection. Sessions from
+// github.com/xtaci/smux and github.com/hashicorp/yamux satisfy it.
+type MuxSession interface {
+	// Accept waits for the next stream opened by the peer.
+	Accept() (net.Conn, error)
+
+	// Close closes the session along with all of its streams and the
+	// underlying connection.
+	Close() error
+}
+
+// MuxServerFunc starts the server side of a multiplexed session on conn, for
+// example:
+//
+//	func(conn net.Conn) (proxy.MuxSession, error) {
+//	  return yamux.Server(conn, nil)
+//	}
+type MuxServerFunc func(conn net.Conn) (MuxSession, error)
+
+// NewMuxListener wraps l so that each connection it accepts is treated as a
+// multiplexed session started with server. Accept returns the individual
+// streams of all sessions, so that Serve (or an http.Server) handles each like
+// a separate client connection. This saves a connection setup per request for
+// clients, like chained proxies, that keep a few long-lived connections open.
+func NewMuxListener(l net.Listener, server MuxServerFunc) net.Listener {
+	ml := &muxListener{
+		Listener: l,
+		server:   server,
+		accepted: newConnListener(l.Addr()),
+		sessions: make(map[MuxSession]bool),
+	}
+	go ml.acceptLoop()
+	return ml
+}
+
+type muxListener struct {
+	net.Listener
+	server   MuxServerFunc
+	accepted *connListener
+
+	mx        sync.Mutex
+	sessions  map[MuxSession]bool
+	closed    bool
+	acceptErr error
+}
+
+func (l *muxListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.mx.Lock()
+			l.acceptErr = err
+			l.mx.Unlock()
+			l.accepted.Close()
+			return
+		}
+		go l.serveSession(conn)
+	}
+}
+
+func (l *muxListener) serveSession(conn net.Conn) {
+	session, err := l.server(conn)
+	if err != nil {
+		log.Debugf("Unable to start multiplexed session with %v: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if !l.addSession(session) {
+		session.Close()
+		return
+	}
+	defer l.removeSession(session)
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			log.Tracef("Multiplexed session with %v ended: %v", conn.RemoteAddr(), err)
+			session.Close()
+			return
+		}
+		if !l.accepted.deliver(stream) {
+			stream.Close()
+			session.Close()
+			return
+		}
+	}
+}
+
+func (l *muxListener) addSession(session MuxSession) bool {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if l.closed {
+		return false
+	}
+	l.sessions[session] = true
+	return true
+}
+
+func (l *muxListener) removeSession(session MuxSession) {
+	l.mx.Lock()
+	delete(l.sessions, session)
+	l.mx.Unlock()
+}
+
+func (l *muxListener) Accept() (net.Conn, error) {
+	conn, err := l.accepted.Accept()
+	if err != nil {
+		l.mx.Lock()
+		defer l.mx.Unlock()
+		if l.acceptErr != nil {
+			return nil, l.acceptErr
+		}
+	}
+	return conn, err
+}
+
+// Close stops listening and closes all open sessions.
+func (l *muxListener) Close() error {
+	l.mx.Lock()
+	l.closed = true
+	sessions := l.sessions
+	l.sessions = make(map[MuxSession]bool)
+	l.mx.Unlock()
+	l.accepted.Close()
+	err := l.Listener.Close()
+	for session := range sessions {
+		session.Close()
+	}
+	return err
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	ht "net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/getlantern/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testMuxSession stands in for a real multiplexer. Its streams are opened by
+// the test with open, and it ends once the physical connection closes.
+type testMuxSession struct {
+	conn      net.Conn
+	streams   chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newTestMuxSession(conn net.Conn) *testMuxSession {
+	s := &testMuxSession{conn: conn, streams: make(chan net.Conn), done: make(chan struct{})}
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		s.Close()
+	}()
+	return s
+}
+
+func (s *testMuxSession) open() net.Conn {
+	client, server := net.Pipe()
+	select {
+	case s.streams <- server:
+	case <-s.done:
+		client.Close()
+	}
+	return client
+}
+
+func (s *testMuxSession) Accept() (net.Conn, error) {
+	select {
+	case stream := <-s.streams:
+		return stream, nil
+	case <-s.done:
+		return nil, errors.New("Session closed")
+	}
+}
+
+func (s *testMuxSession) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	return s.conn.Close()
+}
+
+func TestMuxListener(t *testing.T) {
+	origin := ht.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.URL.Path))
+	}))
+	defer origin.Close()
+
+	sessions := make(chan *testMuxSession, 1)
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	ml := NewMuxListener(l, func(conn net.Conn) (MuxSession, error) {
+		s := newTestMuxSession(conn)
+		sessions <- s
+		return s, nil
+	})
+	go newProxy(&Opts{}).Serve(ml)
+
+	get := func(stream net.Conn, path string) string {
+		defer stream.Close()
+		req, _ := http.NewRequest(http.MethodGet, origin.URL+path, nil)
+		go req.WriteProxy(stream)
+		resp, err := http.ReadResponse(bufio.NewReader(stream), req)
+		require.NoError(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	physical, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	session := <-sessions
+	first, second := session.open(), session.open()
+	assert.Equal(t, "/second", get(second, "/second"), "Streams should be served independently")
+	assert.Equal(t, "/first", get(first, "/first"))
+
+	physical.Close()
+	<-session.done
+
+	physical, err = net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer physical.Close()
+	session = <-sessions
+	stream := session.open()
+	ml.Close()
+	<-session.done
+	stream.Close()
+	_, err = ml.Accept()
+	assert.Error(t, err)
+}
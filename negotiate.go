@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+)
+
+const (
+	ctxKeyConnAuth = contextKey("connAuth")
+)
+
+// NegotiateAcceptor accepts the security contexts that clients establish with
+// the Negotiate scheme (RFC 4559), i.e. Kerberos or SPNEGO as spoken by
+// Windows and browsers in enterprise networks. It's meant to be backed by a
+// Kerberos library (e.g. gokrb5 with the proxy's keytab) or the platform's
+// GSS-API or SSPI.
+type NegotiateAcceptor interface {
+	// NewContext starts accepting a security context for a downstream
+	// connection.
+	NewContext() NegotiateContext
+}
+
+// NegotiateAcceptorFunc adapts a function to a NegotiateAcceptor
+type NegotiateAcceptorFunc func() NegotiateContext
+
+// NewContext implements the interface NegotiateAcceptor
+func (f NegotiateAcceptorFunc) NewContext() NegotiateContext {
+	return f()
+}
+
+// NegotiateContext is the accepting side of a security context being
+// established over one or more rounds.
+type NegotiateContext interface {
+	// Accept processes a token sent by the client. If done, the context is
+	// established and identity is the authenticated client principal (e.g.
+	// alice@EXAMPLE.COM). Otherwise, out is the token to send back to the
+	// client for the next round. Authentication failed if err is non-nil.
+	Accept(token []byte) (out []byte, done bool, identity string, err error)
+}
+
+// connAuth holds the state of connection-based authentication between the
+// requests on a downstream connection, which are handled one at a time.
+type connAuth struct {
+	negotiation NegotiateContext
+	// pending is the token to send back with the next challenge
+	pending  []byte
+	identity string
+}
+
+func connAuthFor(ctx context.Context) *connAuth {
+	state, _ := ctx.Value(ctxKeyConnAuth).(*connAuth)
+	return state
+}
+
+// NegotiateAuth returns an Authenticator for the Negotiate scheme that uses
+// acceptor to establish security contexts with clients. Handshakes that take
+// more than one round are continued over the same keep-alive connection, and
+// since Negotiate authenticates connections rather than requests, later
+// requests on an authenticated connection needn't authenticate again. A final
+// token for mutual authentication isn't sent back to the client.
+//
+// Negotiate can only be used over HTTP/1 connections read by Handle, Serve and
+// HandleCONNECT, where CONNECT requests take the fast path only if their
+// handshake completes in a single round.
+func NegotiateAuth(acceptor NegotiateAcceptor) Authenticator {
+	return &negotiateAuth{acceptor}
+}
+
+type negotiateAuth struct {
+	acceptor NegotiateAcceptor
+}
+
+func (a *negotiateAuth) Authenticate(ctx context.Context, req *http.Request) (string, bool) {
+	state := connAuthFor(ctx)
+	if state == nil {
+		// There's no connection to continue the handshake on
+		return "", false
+	}
+	credentials, ok := authCredentials(req, "Negotiate")
+	if !ok {
+		if state.identity != "" {
+			return state.identity, true
+		}
+		return "", false
+	}
+	token, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		log.Debugf("Invalid Negotiate token: %v", err)
+		state.negotiation, state.identity = nil, ""
+		return "", false
+	}
+	if state.negotiation == nil {
+		// A new handshake also replaces any identity from before
+		state.identity = ""
+		state.negotiation = a.acceptor.NewContext()
+	}
+	out, done, identity, err := state.negotiation.Accept(token)
+	if err != nil {
+		log.Debugf("Unable to accept Negotiate token: %v", err)
+		state.negotiation = nil
+		return "", false
+	}
+	if !done {
+		state.pending = out
+		return "", false
+	}
+	state.negotiation = nil
+	state.identity = identity
+	return identity, true
+}
+
+func (a *negotiateAuth) Challenges(req *http.Request) []string {
+	state := connAuthFor(req.Context())
+	if state == nil || state.pending == nil {
+		return []string{"Negotiate"}
+	}
+	challenge := "Negotiate " + base64.StdEncoding.EncodeToString(state.pending)
+	state.pending = nil
+	return []string{challenge}
+}
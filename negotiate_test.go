@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// twoRoundContext accepts "hello" followed by "response" as the tokens of a
+// handshake
+type twoRoundContext struct {
+	round int
+}
+
+func (c *twoRoundContext) Accept(token []byte) ([]byte, bool, string, error) {
+	c.round++
+	switch {
+	case c.round == 1 && bytes.Equal(token, []byte("hello")):
+		return []byte("challenge"), false, "", nil
+	case c.round == 2 && bytes.Equal(token, []byte("response")):
+		return nil, true, "alice@EXAMPLE.COM", nil
+	}
+	return nil, false, "", errors.New("Unexpected token %q in round %d", token, c.round)
+}
+
+func TestNegotiateAuth(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer web.Close()
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	var mx sync.Mutex
+	var identities []string
+	var contexts int
+	p := newProxy(&Opts{
+		Authenticator: NegotiateAuth(NegotiateAcceptorFunc(func() NegotiateContext {
+			mx.Lock()
+			contexts++
+			mx.Unlock()
+			return &twoRoundContext{}
+		})),
+		Filter: filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+			mx.Lock()
+			identities = append(identities, AuthenticatedIdentity(ctx))
+			mx.Unlock()
+			return next(ctx, req)
+		}),
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go p.ServeCONNECT(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	get := func(token string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, web.URL, nil)
+		if token != "" {
+			req.Header.Set("Proxy-Authorization", "Negotiate "+base64.StdEncoding.EncodeToString([]byte(token)))
+		}
+		require.NoError(t, req.WriteProxy(conn))
+		resp, err := http.ReadResponse(br, req)
+		require.NoError(t, err)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get("")
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	assert.Equal(t, "Negotiate", resp.Header.Get("Proxy-Authenticate"))
+	resp = get("hello")
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	assert.Equal(t, "Negotiate "+base64.StdEncoding.EncodeToString([]byte("challenge")), resp.Header.Get("Proxy-Authenticate"))
+	resp = get("response")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Handshake should complete on the same connection")
+	resp = get("")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Connection should stay authenticated")
+
+	mx.Lock()
+	assert.Equal(t, []string{"alice@EXAMPLE.COM", "alice@EXAMPLE.COM"}, identities)
+	assert.Equal(t, 1, contexts)
+	mx.Unlock()
+
+	resp = get("response")
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode, "Failed handshake should deauthenticate")
+	resp = get("")
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+
+	// Other connections need to authenticate themselves
+	other, _, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+	other.Close()
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+
+	// CONNECT falls back from the fast path
+	tunnel, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer tunnel.Close()
+	tbr := bufio.NewReader(tunnel)
+	connect := func(token string) *http.Response {
+		req, _ := http.NewRequest(http.MethodConnect, "http://"+origin.Addr().String(), nil)
+		req.Header.Set("Proxy-Authorization", "Negotiate "+base64.StdEncoding.EncodeToString([]byte(token)))
+		require.NoError(t, req.Write(tunnel))
+		resp, err := http.ReadResponse(tbr, req)
+		require.NoError(t, err)
+		return resp
+	}
+	resp = connect("hello")
+	require.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	resp = connect("response")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = tunnel.Write([]byte("ping"))
+	require.NoError(t, err)
+	echoed := make([]byte, 4)
+	_, err = tbr.Read(echoed)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(echoed))
+}
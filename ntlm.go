@@ -0,0 +1,263 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"math/bits"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/getlantern/errors"
+)
+
+// The client side of NTLM (MS-NLMP), as needed to authenticate to legacy
+// enterprise proxies. Only NTLMv2 responses are supported, without message
+// integrity codes or session security.
+
+const (
+	ntlmNegotiateUnicode          = 0x00000001
+	ntlmRequestTarget             = 0x00000004
+	ntlmNegotiateNTLM             = 0x00000200
+	ntlmNegotiateAlwaysSign       = 0x00008000
+	ntlmNegotiateExtendedSecurity = 0x00080000
+	ntlmNegotiateTargetInfo       = 0x00800000
+	ntlmNegotiate128              = 0x20000000
+	ntlmNegotiate56               = 0x80000000
+	ntlmNegotiateFlags            = ntlmNegotiateUnicode | ntlmRequestTarget | ntlmNegotiateNTLM | ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSecurity | ntlmNegotiate128 | ntlmNegotiate56
+	ntlmChallengeMinLength        = 32
+	ntlmAuthenticateHeaderLength  = 64
+	ntlmAvTimestamp               = 7
+	ntlmAvEOL                     = 0
+	ntlmWindowsEpochOffsetSeconds = 11644473600
+	ntlmFiletimeTick              = 100 * time.Nanosecond
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// ntlmNegotiateMessage returns the NEGOTIATE_MESSAGE that starts a handshake.
+func ntlmNegotiateMessage() []byte {
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmNegotiateFlags)
+	// Empty domain and workstation fields, since they're only sent along with
+	// the corresponding flags
+	return msg
+}
+
+// ntlmChallenge is a parsed CHALLENGE_MESSAGE.
+type ntlmChallenge struct {
+	flags           uint32
+	serverChallenge []byte
+	targetName      string
+	targetInfo      []byte
+}
+
+func parseNTLMChallenge(msg []byte) (*ntlmChallenge, error) {
+	if len(msg) < ntlmChallengeMinLength || !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 2 {
+		return nil, errors.New("Not an NTLM challenge")
+	}
+	challenge := &ntlmChallenge{
+		flags:           binary.LittleEndian.Uint32(msg[20:]),
+		serverChallenge: msg[24:32],
+	}
+	if challenge.flags&ntlmNegotiateUnicode == 0 {
+		return nil, errors.New("NTLM challenge doesn't support Unicode")
+	}
+	targetName, err := ntlmField(msg, 12)
+	if err != nil {
+		return nil, err
+	}
+	challenge.targetName = fromUTF16LE(targetName)
+	if challenge.flags&ntlmNegotiateTargetInfo != 0 && len(msg) >= 48 {
+		challenge.targetInfo, err = ntlmField(msg, 40)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return challenge, nil
+}
+
+// ntlmField returns the payload referenced by the field (length, allocated
+// length, offset) at the given position of msg.
+func ntlmField(msg []byte, at int) ([]byte, error) {
+	length := int(binary.LittleEndian.Uint16(msg[at:]))
+	offset := int(binary.LittleEndian.Uint32(msg[at+4:]))
+	if offset+length > len(msg) || offset < 0 {
+		return nil, errors.New("NTLM message field out of bounds")
+	}
+	return msg[offset : offset+length], nil
+}
+
+// ntlmTimestamp returns the MsvAvTimestamp from targetInfo, if present.
+func ntlmTimestamp(targetInfo []byte) ([]byte, bool) {
+	for len(targetInfo) >= 4 {
+		id := binary.LittleEndian.Uint16(targetInfo)
+		length := int(binary.LittleEndian.Uint16(targetInfo[2:]))
+		if id == ntlmAvEOL || 4+length > len(targetInfo) {
+			break
+		}
+		if id == ntlmAvTimestamp && length == 8 {
+			return targetInfo[4:12], true
+		}
+		targetInfo = targetInfo[4+length:]
+	}
+	return nil, false
+}
+
+// ntlmAuthenticateMessage answers challenge with an AUTHENTICATE_MESSAGE for
+// the given credentials, where username may be qualified as DOMAIN\user or
+// user@domain. Without a domain, the target name from the challenge is used.
+func ntlmAuthenticateMessage(challenge *ntlmChallenge, username, password string) ([]byte, error) {
+	user, domain := splitNTLMUsername(username)
+	if domain == "" {
+		domain = challenge.targetName
+	}
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, errors.New("Unable to generate NTLM client challenge: %v", err)
+	}
+	timestamp, fromServer := ntlmTimestamp(challenge.targetInfo)
+	if !fromServer {
+		timestamp = ntlmFiletime(time.Now())
+	}
+	ntResponse, lmResponse := ntlmV2Responses(ntlmV2Hash(user, domain, password), challenge.serverChallenge, clientChallenge, timestamp, challenge.targetInfo)
+	if fromServer {
+		// With a timestamp from the server, the LM response is to be left empty
+		lmResponse = make([]byte, 24)
+	}
+
+	payloads := [][]byte{lmResponse, ntResponse, toUTF16LE(domain), toUTF16LE(user), nil, nil}
+	msg := make([]byte, ntlmAuthenticateHeaderLength)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	for i, payload := range payloads {
+		at := 12 + 8*i
+		binary.LittleEndian.PutUint16(msg[at:], uint16(len(payload)))
+		binary.LittleEndian.PutUint16(msg[at+2:], uint16(len(payload)))
+		binary.LittleEndian.PutUint32(msg[at+4:], uint32(len(msg)))
+		msg = append(msg, payload...)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], challenge.flags&ntlmNegotiateFlags)
+	return msg, nil
+}
+
+func splitNTLMUsername(username string) (user string, domain string) {
+	if i := strings.IndexByte(username, '\\'); i >= 0 {
+		return username[i+1:], username[:i]
+	}
+	if i := strings.LastIndexByte(username, '@'); i >= 0 {
+		return username[:i], username[i+1:]
+	}
+	return username, ""
+}
+
+// ntlmV2Hash computes NTOWFv2.
+func ntlmV2Hash(user, domain, password string) []byte {
+	ntHash := md4Sum(toUTF16LE(password))
+	mac := hmac.New(md5.New, ntHash[:])
+	mac.Write(toUTF16LE(strings.ToUpper(user) + domain))
+	return mac.Sum(nil)
+}
+
+// ntlmV2Responses computes the NTLMv2 and LMv2 responses to serverChallenge.
+func ntlmV2Responses(hash, serverChallenge, clientChallenge, timestamp, targetInfo []byte) (ntResponse []byte, lmResponse []byte) {
+	temp := []byte{1, 1, 0, 0, 0, 0, 0, 0}
+	temp = append(temp, timestamp...)
+	temp = append(temp, clientChallenge...)
+	temp = append(temp, 0, 0, 0, 0)
+	temp = append(temp, targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+
+	mac := hmac.New(md5.New, hash)
+	mac.Write(serverChallenge)
+	mac.Write(temp)
+	ntResponse = append(mac.Sum(nil), temp...)
+
+	mac.Reset()
+	mac.Write(serverChallenge)
+	mac.Write(clientChallenge)
+	lmResponse = append(mac.Sum(nil), clientChallenge...)
+	return
+}
+
+// ntlmFiletime encodes t as a little-endian Windows FILETIME.
+func ntlmFiletime(t time.Time) []byte {
+	ticks := uint64(t.Unix()+ntlmWindowsEpochOffsetSeconds)*uint64(time.Second/ntlmFiletimeTick) + uint64(time.Duration(t.Nanosecond())/ntlmFiletimeTick)
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, ticks)
+	return b
+}
+
+func toUTF16LE(s string) []byte {
+	encoded := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(encoded))
+	for i, r := range encoded {
+		binary.LittleEndian.PutUint16(b[2*i:], r)
+	}
+	return b
+}
+
+func fromUTF16LE(b []byte) string {
+	decoded := make([]uint16, len(b)/2)
+	for i := range decoded {
+		decoded[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(decoded))
+}
+
+// md4Sum computes the MD4 digest (RFC 1320) of data, which NTLM hashes
+// passwords with.
+func md4Sum(data []byte) [16]byte {
+	a, b, c, d := uint32(0x67452301), uint32(0xefcdab89), uint32(0x98badcfe), uint32(0x10325476)
+
+	length := uint64(len(data)) << 3
+	padded := append(append([]byte(nil), data...), 0x80)
+	for len(padded)%64 != 56 {
+		padded = append(padded, 0)
+	}
+	var lengthBytes [8]byte
+	binary.LittleEndian.PutUint64(lengthBytes[:], length)
+	padded = append(padded, lengthBytes[:]...)
+
+	f := func(x, y, z uint32) uint32 { return x&y | ^x&z }
+	g := func(x, y, z uint32) uint32 { return x&y | x&z | y&z }
+	h := func(x, y, z uint32) uint32 { return x ^ y ^ z }
+	var x [16]uint32
+	for chunk := padded; len(chunk) > 0; chunk = chunk[64:] {
+		for i := range x {
+			x[i] = binary.LittleEndian.Uint32(chunk[4*i:])
+		}
+		aa, bb, cc, dd := a, b, c, d
+		for _, i := range [4]int{0, 4, 8, 12} {
+			a = bits.RotateLeft32(a+f(b, c, d)+x[i], 3)
+			d = bits.RotateLeft32(d+f(a, b, c)+x[i+1], 7)
+			c = bits.RotateLeft32(c+f(d, a, b)+x[i+2], 11)
+			b = bits.RotateLeft32(b+f(c, d, a)+x[i+3], 19)
+		}
+		for _, i := range [4]int{0, 1, 2, 3} {
+			a = bits.RotateLeft32(a+g(b, c, d)+x[i]+0x5a827999, 3)
+			d = bits.RotateLeft32(d+g(a, b, c)+x[i+4]+0x5a827999, 5)
+			c = bits.RotateLeft32(c+g(d, a, b)+x[i+8]+0x5a827999, 9)
+			b = bits.RotateLeft32(b+g(c, d, a)+x[i+12]+0x5a827999, 13)
+		}
+		for _, i := range [4]int{0, 2, 1, 3} {
+			a = bits.RotateLeft32(a+h(b, c, d)+x[i]+0x6ed9eba1, 3)
+			d = bits.RotateLeft32(d+h(a, b, c)+x[i+8]+0x6ed9eba1, 9)
+			c = bits.RotateLeft32(c+h(d, a, b)+x[i+4]+0x6ed9eba1, 11)
+			b = bits.RotateLeft32(b+h(c, d, a)+x[i+12]+0x6ed9eba1, 15)
+		}
+		a, b, c, d = a+aa, b+bb, c+cc, d+dd
+	}
+
+	var sum [16]byte
+	binary.LittleEndian.PutUint32(sum[0:], a)
+	binary.LittleEndian.PutUint32(sum[4:], b)
+	binary.LittleEndian.PutUint32(sum[8:], c)
+	binary.LittleEndian.PutUint32(sum[12:], d)
+	return sum
+}
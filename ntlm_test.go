@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMD4(t *testing.T) {
+	for input, expected := range map[string]string{
+		"":    "31d6cfe0d16ae931b73c59d7e0c089c0",
+		"abc": "a448017aaf21d8525fc10ae87aa6729d",
+		"12345678901234567890123456789012345678901234567890123456789012345678901234567890": "e33b4ddc9c38f2199c3e7b164fcc0536",
+	} {
+		sum := md4Sum([]byte(input))
+		assert.Equal(t, expected, hex.EncodeToString(sum[:]), "MD4 of %q", input)
+	}
+}
+
+func TestNTLMv2Responses(t *testing.T) {
+	// Test vectors from MS-NLMP section 4.2.4
+	hash := ntlmV2Hash("User", "Domain", "Password")
+	assert.Equal(t, "0c868a403bfd7a93a3001ef22ef02e3f", hex.EncodeToString(hash))
+
+	serverChallenge, _ := hex.DecodeString("0123456789abcdef")
+	clientChallenge, _ := hex.DecodeString("aaaaaaaaaaaaaaaa")
+	targetInfo, _ := hex.DecodeString("02000c0044006f006d00610069006e0001000c0053006500720076006500720000000000")
+	ntResponse, lmResponse := ntlmV2Responses(hash, serverChallenge, clientChallenge, make([]byte, 8), targetInfo)
+	assert.Equal(t, "68cd0ab851e51c96aabc927bebef6a1c", hex.EncodeToString(ntResponse[:16]))
+	assert.Equal(t, "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa", hex.EncodeToString(lmResponse))
+}
+
+func TestSplitNTLMUsername(t *testing.T) {
+	for username, expected := range map[string][2]string{
+		`CORP\alice`:       {"alice", "CORP"},
+		"alice@corp.local": {"alice", "corp.local"},
+		"alice":            {"alice", ""},
+	} {
+		user, domain := splitNTLMUsername(username)
+		assert.Equal(t, expected, [2]string{user, domain}, username)
+	}
+}
+
+// serveNTLMProxy serves an upstream proxy that requires NTLM authentication for
+// the given credentials and then echoes the tunneled data.
+func serveNTLMProxy(t *testing.T, l net.Listener, username, domain, password string) {
+	serverChallenge := []byte("\x01\x02\x03\x04\x05\x06\x07\x08")
+	challenge := make([]byte, 48)
+	copy(challenge, ntlmSignature)
+	binary.LittleEndian.PutUint32(challenge[8:], 2)
+	targetName := toUTF16LE(domain)
+	binary.LittleEndian.PutUint16(challenge[12:], uint16(len(targetName)))
+	binary.LittleEndian.PutUint32(challenge[16:], 48)
+	binary.LittleEndian.PutUint32(challenge[20:], ntlmNegotiateFlags)
+	copy(challenge[24:], serverChallenge)
+	challenge = append(challenge, targetName...)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			br := bufio.NewReader(conn)
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			negotiate := req.Header.Get("Proxy-Authorization")
+			if !strings.HasPrefix(negotiate, "NTLM ") {
+				fmt.Fprintf(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: NTLM\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+				return
+			}
+			fmt.Fprintf(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: NTLM %v\r\nContent-Length: 4\r\n\r\nnope", base64.StdEncoding.EncodeToString(challenge))
+
+			req, err = http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			msg, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(req.Header.Get("Proxy-Authorization"), "NTLM "))
+			if len(msg) < ntlmAuthenticateHeaderLength {
+				fmt.Fprintf(conn, "HTTP/1.1 400 Bad Request\r\n\r\n")
+				return
+			}
+			ntResponse, _ := ntlmField(msg, 20)
+			gotDomain, _ := ntlmField(msg, 28)
+			gotUser, _ := ntlmField(msg, 36)
+			mac := hmac.New(md5.New, ntlmV2Hash(fromUTF16LE(gotUser), fromUTF16LE(gotDomain), password))
+			mac.Write(serverChallenge)
+			mac.Write(ntResponse[16:])
+			if fromUTF16LE(gotUser) != username || fromUTF16LE(gotDomain) != domain || !hmac.Equal(mac.Sum(nil), ntResponse[:16]) {
+				fmt.Fprintf(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nConnection: close\r\n\r\n")
+				return
+			}
+			fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\n\r\n")
+			io.Copy(conn, br)
+		}()
+	}
+}
+
+func TestChainDialNTLM(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go serveNTLMProxy(t, l, "alice", "CORP", "secret")
+
+	for _, username := range []string{`CORP\alice`, "alice"} {
+		upstream := &Upstream{Addr: l.Addr().String(), Username: username, Password: "secret", NTLM: true}
+		conn, err := ChainDial(nil, upstream)(context.Background(), true, "tcp", "example.com:443")
+		if !assert.NoError(t, err, username) {
+			continue
+		}
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		echoed := make([]byte, 5)
+		_, err = io.ReadFull(conn, echoed)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(echoed))
+		conn.Close()
+	}
+
+	upstream := &Upstream{Addr: l.Addr().String(), Username: `CORP\alice`, Password: "wrong", NTLM: true}
+	_, err = ChainDial(nil, upstream)(context.Background(), true, "tcp", "example.com:443")
+	assert.Error(t, err, "Wrong password should fail")
+
+	upstream = &Upstream{Addr: l.Addr().String(), Username: `CORP\alice`, Password: "secret"}
+	_, err = ChainDial(nil, upstream)(context.Background(), true, "tcp", "example.com:443")
+	assert.Error(t, err, "Basic shouldn't be accepted")
+}
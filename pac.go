@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/getlantern/errors"
+)
+
+// PACEvaluator evaluates a proxy auto-config (PAC) script's FindProxyForURL
+// function. Implementations typically load the script into a JavaScript
+// engine along with the standard helper functions from PACFunctions.
+type PACEvaluator interface {
+	FindProxyForURL(ctx context.Context, url string, host string) (string, error)
+}
+
+// PACEvaluatorFunc adapts a function to a PACEvaluator
+type PACEvaluatorFunc func(ctx context.Context, url string, host string) (string, error)
+
+// FindProxyForURL implements the interface PACEvaluator
+func (f PACEvaluatorFunc) FindProxyForURL(ctx context.Context, url string, host string) (string, error) {
+	return f(ctx, url, host)
+}
+
+// ParsePACResult parses a FindProxyForURL result such as
+// "PROXY a:8080; SOCKS5 b:1080; DIRECT" into the Upstreams to try in order,
+// where a nil Upstream means DIRECT. An empty result means DIRECT. Entries of
+// unsupported types (e.g. SOCKS4) are skipped.
+func ParsePACResult(result string) ([]*Upstream, error) {
+	var upstreams []*Upstream
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		kind := strings.ToUpper(fields[0])
+		if kind == "DIRECT" {
+			upstreams = append(upstreams, nil)
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, errors.New("Invalid PAC entry %v", strings.TrimSpace(entry))
+		}
+		upstream := &Upstream{Addr: fields[1]}
+		switch kind {
+		case "PROXY", "HTTP":
+			upstream.Protocol = UpstreamHTTP
+		case "HTTPS":
+			upstream.Protocol = UpstreamHTTP
+			upstream.TLSConfig = &tls.Config{}
+		case "SOCKS", "SOCKS5":
+			upstream.Protocol = UpstreamSOCKS5
+		default:
+			log.Debugf("Skipping unsupported PAC entry %v", strings.TrimSpace(entry))
+			continue
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	if len(upstreams) == 0 {
+		if strings.TrimSpace(result) != "" {
+			return nil, errors.New("No supported entries in PAC result %v", result)
+		}
+		upstreams = append(upstreams, nil)
+	}
+	return upstreams, nil
+}
+
+// PACDial returns a DialFunc that routes each destination as directed by
+// evaluator, trying the returned proxies in order until one succeeds. DIRECT
+// entries, and the connections to the proxies themselves, are dialed using
+// dial, or a plain TCP dial if dial is nil. If the PAC script can't be
+// evaluated, destinations are dialed directly.
+func PACDial(evaluator PACEvaluator, dial DialFunc) DialFunc {
+	direct := ChainDial(dial)
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, errors.New("Unable to split host and port for %v: %v", addr, err)
+		}
+		result, err := evaluator.FindProxyForURL(ctx, pacURL(isCONNECT, host, port), host)
+		if err != nil {
+			log.Debugf("Unable to evaluate PAC script for %v, dialing directly: %v", addr, err)
+			return direct(ctx, isCONNECT, network, addr)
+		}
+		upstreams, err := ParsePACResult(result)
+		if err != nil {
+			return nil, err
+		}
+		var lastErr error
+		for _, upstream := range upstreams {
+			var conn net.Conn
+			if upstream == nil {
+				conn, lastErr = direct(ctx, isCONNECT, network, addr)
+			} else {
+				conn, lastErr = ChainDial(dial, upstream)(ctx, isCONNECT, network, addr)
+			}
+			if lastErr == nil {
+				return conn, nil
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			log.Debugf("Unable to dial %v per PAC result, trying next: %v", addr, lastErr)
+		}
+		return nil, lastErr
+	}
+}
+
+// pacURL builds the URL passed to FindProxyForURL. Since dials don't know the
+// request path, only the scheme and authority are included.
+func pacURL(isCONNECT bool, host string, port string) string {
+	scheme, defaultPort := "http", "80"
+	if isCONNECT {
+		scheme, defaultPort = "https", "443"
+	}
+	authority := host
+	if strings.Contains(host, ":") {
+		authority = "[" + host + "]"
+	}
+	if port != defaultPort {
+		authority += ":" + port
+	}
+	return scheme + "://" + authority + "/"
+}
+
+// PACFunctions returns Go implementations of the standard PAC helper
+// functions (isPlainHostName, dnsDomainIs, localHostOrDomainIs, isResolvable,
+// isInNet, dnsResolve, myIpAddress, dnsDomainLevels and shExpMatch), keyed by
+// name, for registration with a JavaScript engine. Lookups use resolver, or the
+// default resolver if it's nil.
+func PACFunctions(ctx context.Context, resolver Resolver) map[string]interface{} {
+	opts := &Opts{Resolver: resolver}
+	resolve := func(host string) string {
+		if ip := net.ParseIP(host); ip != nil {
+			return ip.String()
+		}
+		ips, err := opts.lookupIPs(ctx, host)
+		if err != nil {
+			return ""
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				return ip.String()
+			}
+		}
+		return ips[0].String()
+	}
+
+	return map[string]interface{}{
+		"isPlainHostName": func(host string) bool {
+			return !strings.Contains(host, ".")
+		},
+		"dnsDomainIs": func(host string, domain string) bool {
+			return strings.HasSuffix(strings.ToLower(host), strings.ToLower(domain))
+		},
+		"localHostOrDomainIs": func(host string, hostdom string) bool {
+			host, hostdom = strings.ToLower(host), strings.ToLower(hostdom)
+			if host == hostdom {
+				return true
+			}
+			return !strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+".")
+		},
+		"isResolvable": func(host string) bool {
+			return resolve(host) != ""
+		},
+		"isInNet": func(host string, pattern string, mask string) bool {
+			ip := net.ParseIP(resolve(host))
+			patternIP := net.ParseIP(pattern)
+			maskIP := net.ParseIP(mask)
+			if ip == nil || patternIP == nil || maskIP == nil {
+				return false
+			}
+			ipMask := net.IPMask(maskIP.To4())
+			if ip.To4() == nil || patternIP.To4() == nil || ipMask == nil {
+				return false
+			}
+			return ip.To4().Mask(ipMask).Equal(patternIP.To4().Mask(ipMask))
+		},
+		"dnsResolve": resolve,
+		"myIpAddress": func() string {
+			return myIPAddress()
+		},
+		"dnsDomainLevels": func(host string) int {
+			return strings.Count(host, ".")
+		},
+		"shExpMatch": func(str string, shexp string) bool {
+			return shExpMatch(str, shexp)
+		},
+	}
+}
+
+// myIPAddress returns the IP of the interface used for outbound traffic,
+// falling back to loopback.
+func myIPAddress() string {
+	conn, err := net.Dial("udp", "198.51.100.1:53")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer conn.Close()
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		return addr.IP.String()
+	}
+	return "127.0.0.1"
+}
+
+// shExpMatch matches str against a shell expression in which * matches any
+// sequence of characters (including slashes) and ? matches one character.
+func shExpMatch(str string, shexp string) bool {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for _, r := range shexp {
+		switch r {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	matched, _ := regexp.MatchString(expr.String(), str)
+	return matched
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePACResult(t *testing.T) {
+	upstreams, err := ParsePACResult("PROXY a:8080; HTTPS b:443 ;SOCKS4 c:1080; SOCKS5 d:1080; DIRECT")
+	if assert.NoError(t, err) && assert.Len(t, upstreams, 4) {
+		assert.Equal(t, &Upstream{Protocol: UpstreamHTTP, Addr: "a:8080"}, upstreams[0])
+		assert.Equal(t, "b:443", upstreams[1].Addr)
+		assert.NotNil(t, upstreams[1].TLSConfig)
+		assert.Equal(t, &Upstream{Protocol: UpstreamSOCKS5, Addr: "d:1080"}, upstreams[2])
+		assert.Nil(t, upstreams[3])
+	}
+
+	upstreams, err = ParsePACResult("")
+	assert.NoError(t, err)
+	assert.Equal(t, []*Upstream{nil}, upstreams, "Empty result should mean DIRECT")
+
+	_, err = ParsePACResult("PROXY")
+	assert.Error(t, err)
+	_, err = ParsePACResult("SOCKS4 c:1080")
+	assert.Error(t, err)
+}
+
+func TestPACDial(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	// Get an address that refuses connections
+	dead, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	var gotURL, gotHost string
+	dial := PACDial(PACEvaluatorFunc(func(ctx context.Context, url string, host string) (string, error) {
+		gotURL, gotHost = url, host
+		return "PROXY " + deadAddr + "; DIRECT", nil
+	}), nil)
+
+	conn, err := dial(context.Background(), true, "tcp", origin.Addr().String())
+	if !assert.NoError(t, err, "Should have failed over to DIRECT") {
+		return
+	}
+	conn.Close()
+	host, port, _ := net.SplitHostPort(origin.Addr().String())
+	assert.Equal(t, "https://"+host+":"+port+"/", gotURL)
+	assert.Equal(t, host, gotHost)
+}
+
+func TestPACFunctions(t *testing.T) {
+	fns := PACFunctions(context.Background(), nil)
+	assert.True(t, fns["isPlainHostName"].(func(string) bool)("intranet"))
+	assert.True(t, fns["dnsDomainIs"].(func(string, string) bool)("www.example.com", ".example.com"))
+	assert.True(t, fns["localHostOrDomainIs"].(func(string, string) bool)("www", "www.example.com"))
+	assert.True(t, fns["isInNet"].(func(string, string, string) bool)("10.1.2.3", "10.0.0.0", "255.0.0.0"))
+	assert.False(t, fns["isInNet"].(func(string, string, string) bool)("11.1.2.3", "10.0.0.0", "255.0.0.0"))
+	assert.Equal(t, 2, fns["dnsDomainLevels"].(func(string) int)("www.example.com"))
+	assert.True(t, fns["shExpMatch"].(func(string, string) bool)("http://example.com/a/b", "*/a/*"))
+	assert.False(t, fns["shExpMatch"].(func(string, string) bool)("http://example.com/", "*.org*"))
+	assert.Equal(t, "https://example.com/", pacURL(true, "example.com", "443"))
+	assert.Equal(t, "http://[::1]:8080/", pacURL(false, "::1", "8080"))
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultUpstreamIdleTimeout = 90 * time.Second
+)
+
+func (proxy *proxy) initPool() {
+	if proxy.MaxIdleUpstreamConnsPerHost <= 0 {
+		return
+	}
+	idleTimeout := proxy.UpstreamIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = proxy.IdleTimeout
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = defaultUpstreamIdleTimeout
+	}
+	proxy.pool = &http.Transport{
+		DialContext:           proxy.pooledDial,
+		IdleConnTimeout:       idleTimeout,
+		MaxIdleConnsPerHost:   proxy.MaxIdleUpstreamConnsPerHost,
+		TLSHandshakeTimeout:   proxy.Timeouts.TLSHandshake,
+		ResponseHeaderTimeout: proxy.Timeouts.ResponseHeader,
+	}
+	proxy.setUpstreamTLS(proxy.pool)
+}
+
+// initHTTP2Transport sets up the transport that forwards HTTP/2 requests,
+// which is shared by all streams since they don't come with a downstream
+// connection of their own.
+func (proxy *proxy) initHTTP2Transport() {
+	proxy.h2Transport = proxy.newTransport()
+}
+
+// newTransport returns the transport used to forward requests read from a
+// single downstream connection. With pooling enabled, this is the shared pool,
+// whose idle connections outlive the downstream connection.
+func (proxy *proxy) newTransport() idleClosingTransport {
+	var tr idleClosingTransport
+	if proxy.pool != nil {
+		tr = &pooledTransport{proxy.pool}
+	} else {
+		hr := &http.Transport{
+			DialContext:     proxy.requestAwareDial,
+			IdleConnTimeout: proxy.IdleTimeout,
+			// since we have one transport per downstream connection, we don't need
+			// more than this
+			MaxIdleConnsPerHost:   1,
+			TLSHandshakeTimeout:   proxy.Timeouts.TLSHandshake,
+			ResponseHeaderTimeout: proxy.Timeouts.ResponseHeader,
+		}
+		proxy.setUpstreamTLS(hr)
+		tr = hr
+	}
+	if proxy.HTTP3RoundTripper != nil {
+		tr = &h3Transport{tr, proxy.HTTP3RoundTripper, proxy.altSvc}
+	}
+	return tr
+}
+
+// pooledTransport is a view onto the shared pool that keeps idle connections
+// open when the downstream connection using it finishes.
+type pooledTransport struct {
+	*http.Transport
+}
+
+func (pt *pooledTransport) CloseIdleConnections() {
+}
+
+// poolStats counts the connections dialed by the shared pool.
+type poolStats struct {
+	dials int64
+	open  int64
+}
+
+// pooledDial dials like requestAwareDial, counting the connections so that
+// they can be reported by the admin handler.
+func (proxy *proxy) pooledDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := proxy.requestAwareDial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&proxy.poolStats.dials, 1)
+	atomic.AddInt64(&proxy.poolStats.open, 1)
+	return &pooledConn{Conn: conn, stats: &proxy.poolStats}, nil
+}
+
+// pooledConn decrements the count of open pooled connections once closed.
+type pooledConn struct {
+	net.Conn
+	stats *poolStats
+	once  sync.Once
+}
+
+func (conn *pooledConn) Close() error {
+	conn.once.Do(func() {
+		atomic.AddInt64(&conn.stats.open, -1)
+	})
+	return conn.Conn.Close()
+}
+
+// Wrapped implements the interface netx.WrappedConn
+func (conn *pooledConn) Wrapped() net.Conn {
+	return conn.Conn
+}
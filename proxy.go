@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/http"
 	"regexp"
+	"sync/atomic"
 	"time"
 
 	"github.com/getlantern/errors"
@@ -47,6 +48,98 @@ type Proxy interface {
 
 	// Serve runs a server on the given Listener
 	Serve(l net.Listener) error
+
+	// HandleCONNECT handles a single connection like Handle, but takes a fast
+	// path for CONNECT requests: it parses the request head itself and tunnels
+	// it like HandleSOCKS5, without passing it through Filter. The response is
+	// a bare 200 OK (see OnCONNECTResponse). Connections that start with
+	// anything other than a plain CONNECT request, or with one that needs
+	// Rules, MITM or an authentication challenge, are handled like Handle.
+	HandleCONNECT(ctx context.Context, in io.Reader, conn net.Conn) error
+
+	// ServeCONNECT runs a server on the given Listener that handles
+	// connections with HandleCONNECT, for tunnel-heavy workloads.
+	ServeCONNECT(l net.Listener) error
+
+	// HandleSOCKS5 handles a single SOCKS5 connection, tunneling it to the
+	// requested destination using the same dialing and piping as CONNECT.
+	HandleSOCKS5(ctx context.Context, in io.Reader, conn net.Conn) error
+
+	// ServeSOCKS5 runs a SOCKS5 server on the given Listener
+	ServeSOCKS5(l net.Listener) error
+
+	// HandleSOCKS handles a single SOCKS connection like HandleSOCKS5, also
+	// accepting SOCKS4 and SOCKS4a from legacy clients.
+	HandleSOCKS(ctx context.Context, in io.Reader, conn net.Conn) error
+
+	// ServeSOCKS runs a server for SOCKS5, SOCKS4 and SOCKS4a on the given
+	// Listener
+	ServeSOCKS(l net.Listener) error
+
+	// ServeHTTP allows the proxy to be used as an http.Handler, including for
+	// HTTP/2 connections and by HTTP/3 servers, which makes it a MASQUE proxy
+	// serving CONNECT and, with Opts.ConnectUDP, CONNECT-UDP.
+	ServeHTTP(w http.ResponseWriter, req *http.Request)
+
+	// HandleTransparent handles a single connection carrying raw TLS traffic,
+	// for example one redirected by iptables, tunneling it to port 443 of the
+	// host named by the SNI extension of the ClientHello.
+	HandleTransparent(ctx context.Context, in io.Reader, conn net.Conn) error
+
+	// ServeTransparent runs a transparent TLS proxy server on the given
+	// Listener
+	ServeTransparent(l net.Listener) error
+
+	// ServeTLS runs a proxy server that accepts TLS connections (an HTTPS
+	// proxy) on the given Listener, see TLSServerOpts.
+	ServeTLS(l net.Listener, opts *TLSServerOpts) error
+
+	// ApplyConfig atomically replaces the access control, authentication, rate
+	// limiting and dialing configuration, without interrupting open tunnels.
+	// See Config, WatchConfigFile and ReloadOnSIGHUP.
+	ApplyConfig(cfg *Config)
+
+	// ActiveTunnelsByClient returns the number of currently open tunnels for
+	// each client, keyed by authenticated identity or else client IP.
+	ActiveTunnelsByClient() map[string]int
+
+	// ActiveConnectionsByDestination returns the number of tunnels and
+	// requests in progress for each destination host, as counted for
+	// DestinationConcurrencyLimit. It's empty without that limit.
+	ActiveConnectionsByDestination() map[string]int
+
+	// ClientUsage returns the bytes tunneled by client (an authenticated
+	// identity or IP) since the start of the time window containing since,
+	// including usage that hasn't been flushed to the store yet. It fails if
+	// Accounting isn't configured.
+	ClientUsage(client string, since time.Time) (Usage, error)
+
+	// AdminHandler returns an http.Handler, meant to be mounted on a separate,
+	// private listener, that exposes the live state of the proxy as JSON:
+	//
+	//   GET /tunnels                  lists open tunnels
+	//   DELETE or POST /tunnels/{id}  force-closes the given tunnel
+	//   GET /config                   summarizes the current configuration
+	//   GET /limits                   reports concurrency limits and usage
+	//   GET /pool                     reports upstream connection pool stats
+	//   GET, PUT or POST /bandwidth   reports or changes Opts.BandwidthLimit
+	//   GET /slo                      reports success rates and latencies by
+	//                                 destination, see Opts.SLO
+	//   GET /har                      downloads recent requests as an HTTP
+	//                                 Archive, see Opts.HAR
+	//   GET /healthz                  reports liveness, see HealthCheckOptions
+	//   GET /readyz                   reports readiness, see HealthCheckOptions
+	AdminHandler() http.Handler
+
+	// Shutdown gracefully shuts down the proxy. It closes the listeners that
+	// the proxy serves, which makes Serve and friends return ErrShutdown, as
+	// well as idle client connections, pooled and warm upstream connections.
+	// It then drains the proxy, waiting for active tunnels and in-flight
+	// requests to finish. If they're all done, it returns how many there were
+	// as drained and a nil error. Once ctx is done, the remaining connections
+	// are closed: drained counts the connections that finished on their own,
+	// aborted those that were force-closed, and err is ctx.Err().
+	Shutdown(ctx context.Context) (drained int, aborted int, err error)
 }
 
 // RequestAware is an interface for connections that are able to modify requests
@@ -67,21 +160,219 @@ type ResponseAware interface {
 // Opts defines options for configuring a Proxy
 type Opts struct {
 	// IdleTimeout, if specified, lets us know to include an appropriate
-	// KeepAlive: timeout header in the responses.
+	// KeepAlive: timeout header in the responses. Tunnels that see no traffic
+	// in either direction for longer than IdleTimeout are closed.
 	IdleTimeout time.Duration
 
+	// OnTunnelIdle, if specified, is called with the upstream address whenever
+	// a tunnel is closed for exceeding IdleTimeout.
+	OnTunnelIdle func(upstreamAddr string)
+
+	// OnTunnelComplete, if specified, is called with the final TunnelStats of
+	// every tunnel once it closes, for example for metering traffic.
+	OnTunnelComplete func(ctx context.Context, stats *TunnelStats)
+
+	// CountTunnelBytes, if true, counts the bytes flowing through every tunnel
+	// so that they can be seen with CurrentTunnelStats and AdminHandler, even
+	// without AccessLogger or OnTunnelComplete. Counted tunnels are never
+	// spliced.
+	CountTunnelBytes bool
+
+	// Accounting, if specified, aggregates the bytes tunneled by each client
+	// (identified by its authenticated identity, or else its IP) over time
+	// windows and periodically flushes them to a UsageStore. Usage can be
+	// queried with ClientUsage, for example to enforce quotas. Accounted
+	// tunnels are never spliced.
+	Accounting *AccountingOpts
+
+	// Tap, if specified, receives the bytes flowing in each direction of every
+	// tunnel. Tapped tunnels are never spliced.
+	Tap Tap
+
+	// Shaping, if specified, injects latency, jitter and pacing into tunnels in
+	// order to simulate network conditions. Shaped tunnels are never spliced.
+	Shaping *ShapingOptions
+
 	// BufferSource specifies a BufferSource, leave nil to use default.
 	BufferSource BufferSource
 
-	// Filter is an optional Filter that will be invoked for every Request
+	// TunnelCompression agrees to compress CONNECT tunnels for downstream
+	// chained proxies that ask for it with TunnelCompressionHeader (see
+	// Upstream.Compress), trading CPU for bandwidth on expensive links
+	// between the two. Compressed tunnels are never spliced.
+	TunnelCompression bool
+
+	// TunnelBuffers, if specified, makes tunnels copy with buffers that grow
+	// for busy tunnels and shrink for idle ones instead of the fixed size
+	// buffers from BufferSource. Spliced tunnels don't use buffers.
+	TunnelBuffers *TunnelBufferOptions
+
+	// Filter is an optional Filter that will be invoked for every Request,
+	// including CONNECT requests. Use filters.Join to compose multiple filters.
 	Filter filters.Filter
 
+	// Authenticator, if specified, is consulted before any other filter to
+	// authenticate proxy users. Requests that fail to authenticate receive a
+	// 407 Proxy Authentication Required response, except that plain HTTP
+	// requests may receive an interstitial page instead if the Authenticator
+	// implements Interstitial, see CaptivePortal. The authenticated identity is
+	// available to filters and dialers via AuthenticatedIdentity(ctx). It also
+	// enables username/password authentication for SOCKS5.
+	Authenticator Authenticator
+
+	// SOCKS4BypassesAuth allows SOCKS4 and SOCKS4a clients, which can't
+	// authenticate, to open tunnels even though an Authenticator is configured.
+	// By default they're rejected in that case.
+	SOCKS4BypassesAuth bool
+
+	// AccessControl, if specified, is consulted after Filter and before dialing
+	// upstream to decide whether the client may access the destination.
+	// Requests to denied destinations receive a 403 Forbidden response.
+	AccessControl AccessControl
+
+	// ProtocolPolicy, if specified, is consulted once the protocol that the
+	// client of a tunnel speaks has been sniffed from the first bytes it sends,
+	// see SniffProtocol. Tunnels with denied protocols are closed before those
+	// bytes reach upstream. It doesn't apply to MITM'ed tunnels, whose requests
+	// pass through Filter instead.
+	ProtocolPolicy ProtocolPolicy
+
+	// SniffTunnels, if true, sniffs the protocol of tunnels even without a
+	// ProtocolPolicy, so that it's available with CurrentTunnelProtocol, for
+	// example to OnTunnelComplete. Sniffed tunnels are never spliced.
+	SniffTunnels bool
+
+	// ALPNRoutes are dedicated routes for transparent TLS connections (see
+	// ServeTransparent) whose ClientHello offers given ALPN protocols. The
+	// first matching route applies. Use ACMEPassthrough to keep certificate
+	// issuance with the TLS-ALPN-01 challenge working for hosts behind the
+	// proxy.
+	ALPNRoutes []*ALPNRoute
+
+	// GeoIP, if specified, locates clients for filters and access controls,
+	// see ClientGeo. To decide based on location, use access controls like
+	// AllowClientCountries and DenyDestinationCountries.
+	GeoIP GeoIP
+
+	// ConcurrencyLimit, if greater than zero, limits the number of tunnels
+	// (CONNECT, SOCKS5 and transparent) that may be open at the same time.
+	// CONNECT requests beyond the limit receive a 503 Service Unavailable with
+	// a Retry-After header, other tunnels are closed.
+	ConcurrencyLimit int
+
+	// ClientTunnelQuota, if greater than zero, limits the number of tunnels
+	// that each client (identified by its authenticated identity, or else its
+	// IP) may have open at the same time. CONNECT requests beyond the quota
+	// receive a 429 Too Many Requests, other tunnels are closed.
+	ClientTunnelQuota int
+
+	// ConcurrencyQueueTimeout, if specified, is how long a new tunnel waits for
+	// another to finish when ConcurrencyLimit has been reached before being
+	// rejected.
+	ConcurrencyQueueTimeout time.Duration
+
+	// DestinationConcurrencyLimit, if greater than zero, limits the number of
+	// tunnels and requests to any one destination host that may be in
+	// progress at the same time, to avoid overwhelming origins or tripping
+	// their rate limits. Like for ConcurrencyLimit, excess ones wait up to
+	// ConcurrencyQueueTimeout and are then rejected with a 503 Service
+	// Unavailable (or closed, for tunnels other than CONNECT). See
+	// Metrics.DestinationLimited.
+	DestinationConcurrencyLimit int
+
 	// OnError, if specified, can return a response to be presented to the client
 	// in the event that there's an error round-tripping upstream. If the function
 	// returns no response, nothing is written to the client. Read indicates
-	// whether the error occurred on reading a request or not. (HTTP only)
+	// whether the error occurred on reading a request or not. By default, only
+	// upstream certificates that failed verification are reported, with
+	// StatusInvalidUpstreamCertificate. (HTTP only)
 	OnError func(ctx filters.Context, req *http.Request, read bool, err error) *http.Response
 
+	// ErrorRenderer, if specified, renders the responses sent when the proxy
+	// can't reach upstream, e.g. to map errors to status codes with
+	// ErrorStatus and serve custom error pages. It's used for CONNECT requests
+	// when OKWaitsForUpstream is set and, unless OnError is specified, for
+	// errors round-tripping other requests.
+	ErrorRenderer ErrorRenderer
+
+	// OnCONNECTResponse, if specified, is called with the headers of the OK
+	// or Bad Gateway response that the proxy itself generates for a CONNECT
+	// request, before that response is written. This allows adding headers
+	// like request IDs or Via. (CONNECT only)
+	OnCONNECTResponse func(req *http.Request, header http.Header)
+
+	// Forwarding, if specified, controls how the headers of forwarded requests
+	// are rewritten, e.g. adding Via and X-Forwarded-For. (HTTP only)
+	Forwarding *ForwardingOptions
+
+	// Cache, if specified, caches cacheable responses to forwarded GET
+	// requests. (HTTP only)
+	Cache *ResponseCache
+
+	// ConnectUDP, if true, lets clients proxy UDP flows (e.g. QUIC or DNS)
+	// using CONNECT-UDP (RFC 9298) over HTTP/1.1, or over HTTP/2 and HTTP/3
+	// with ServeHTTP. Datagrams are carried in DATAGRAM capsules on the
+	// upgraded connection or the request stream. (HTTP only)
+	ConnectUDP bool
+
+	// UDPIdleTimeout is how long a CONNECT-UDP association may go without
+	// datagrams in either direction before it's closed. Defaults to
+	// DefaultUDPIdleTimeout. (HTTP only)
+	UDPIdleTimeout time.Duration
+
+	// FlushInterval specifies how often response bodies are flushed to the
+	// client while they're being forwarded. A negative value flushes after
+	// every write. If zero, server-sent events and responses of unknown length
+	// are flushed after every write, and other responses once they're
+	// complete. (HTTP only)
+	FlushInterval time.Duration
+
+	// MaxRequestBodySize, if specified, limits the size of the request bodies
+	// that are forwarded upstream. Requests whose Content-Length exceeds it
+	// get a 413 Payload Too Large, and forwarding of bodies that turn out to
+	// be larger is aborted with the same status. (HTTP only)
+	MaxRequestBodySize int64
+
+	// MaxResponseBodySize, if specified, limits the size of the response
+	// bodies that are forwarded to clients. Responses whose Content-Length
+	// exceeds it are replaced with a 502 Bad Gateway (or whatever
+	// ErrorRenderer renders), and responses that turn out to be larger are
+	// cut short by closing the client connection. (HTTP only)
+	MaxResponseBodySize int64
+
+	// LimitMITMBodies, if true, also applies MaxRequestBodySize and
+	// MaxResponseBodySize to requests on MITM'ed connections.
+	LimitMITMBodies bool
+
+	// MaxHeaderBytes limits the size of request headers, including the request
+	// line. Clients that send larger headers get a 431 Request Header Fields
+	// Too Large response. Defaults to http.DefaultMaxHeaderBytes. (HTTP/1 only)
+	MaxHeaderBytes int
+
+	// MaxHeaderFields, if specified, limits the number of header fields in a
+	// request. Clients that send more get a 431 Request Header Fields Too Large
+	// response. (HTTP/1 only)
+	MaxHeaderFields int
+
+	// RejectHostMismatch, if true, rejects requests in absolute form (like
+	// "GET http://example.com/ HTTP/1.1") with a 400 Bad Request if their Host
+	// header names a different host or port. Otherwise, the Host header is
+	// replaced with the target's authority as required by RFC 7230. (HTTP/1
+	// only)
+	RejectHostMismatch bool
+
+	// DefaultScheme is the scheme assumed for requests in origin form (like
+	// "GET /path HTTP/1.1" with a Host header, as received when used as a
+	// transparent proxy) that don't arrive on a MITM'ed connection. Defaults
+	// to http. (HTTP/1 only)
+	DefaultScheme string
+
+	// DefaultCONNECTPort, if specified, is the port of CONNECT targets that
+	// don't include one (like "CONNECT example.com HTTP/1.1"). Otherwise such
+	// requests are rejected like other invalid targets, with a 400 Bad Request
+	// explaining what's wrong.
+	DefaultCONNECTPort int
+
 	// OKWaitsForUpstream specifies whether or not to wait on dialing upstream
 	// before responding OK to a CONNECT request (CONNECT only).
 	OKWaitsForUpstream bool
@@ -91,9 +382,169 @@ type Opts struct {
 	// The only metric for now is dialupstream, so the value is in the form "dialupstream;dur=42".
 	OKSendsServerTiming bool
 
+	// CONNECTEarlyData, if OKWaitsForUpstream is false, reads what clients send
+	// on tunnels while upstream is still being dialed and writes it upstream at
+	// once when the connection is established. This saves a round trip for
+	// protocols in which the client speaks first, like TLS with its
+	// ClientHello. It doesn't apply to MITM'ed tunnels.
+	CONNECTEarlyData bool
+
 	// Dial is the function that's used to dial upstream.
 	Dial DialFunc
 
+	// DialMiddleware, if specified, wraps Dial, as well as the Dial of each
+	// Config applied later, see WrapDial. Built-ins include LogDials,
+	// RetryDials, TimeoutDials, MeterDials and RestrictDials.
+	DialMiddleware []DialMiddleware
+
+	// DialerOptions, if specified and Dial isn't, tunes the sockets that the
+	// proxy dials upstream with, see NewDialer.
+	DialerOptions *DialerOptions
+
+	// CircuitBreaker, if specified, stops dialing upstream destinations that
+	// keep failing for a while. Requests to them fail immediately without
+	// dialing.
+	CircuitBreaker *CircuitBreaker
+
+	// DialFailureTTL, if positive, is how long failures to resolve or dial a
+	// destination are remembered. Meanwhile, new tunnels and requests to it
+	// fail immediately with 502 Bad Gateway (see ErrRecentlyFailed) rather
+	// than waiting on the dial timeout again. Keep it short, as a few seconds
+	// are enough to spare clients that retry in a loop.
+	DialFailureTTL time.Duration
+
+	// Prewarm, if specified, keeps idle connections to popular destinations
+	// open ahead of time, so that CONNECT requests to them needn't wait for a
+	// dial. Warm connections are closed by Shutdown.
+	Prewarm *PrewarmOptions
+
+	// Rewriter, if specified, can change the destination of CONNECT and
+	// forwarded requests right before dialing, see MapHosts. Filter and
+	// AccessControl see the original destination, which is also available to
+	// dialers via OriginalAddr(ctx).
+	Rewriter Rewriter
+
+	// NetworkRouter, if specified, can change the network over which
+	// destinations are dialed (after Rewriter), e.g. to reach Unix domain
+	// sockets, see MapNetworks. Dial then receives the routed network and
+	// address, which are only resolved for TCP and UDP.
+	NetworkRouter NetworkRouter
+
+	// Rules, if specified, decide per request whether to dial directly, dial
+	// through an upstream proxy, block, redirect or MITM, see NewRules and
+	// ParseRules. Rules apply after Filter and before AccessControl, and rules
+	// that dial take precedence over Dial. Since a client connection reuses its
+	// upstream connection to a destination, the first rule to dial it applies
+	// to the requests that follow.
+	Rules *Rules
+
+	// Resolver, if specified, is used to resolve upstream hostnames before
+	// dialing, so that Dial receives IP addresses. It's also used when
+	// AccessControl checks destination IPs. See NewDoHResolver,
+	// NewDoTResolver and NewCachingResolver.
+	Resolver Resolver
+
+	// ResolveTimeout, if specified, limits how long each lookup may take.
+	ResolveTimeout time.Duration
+
+	// DoHPath, if specified, makes the proxy answer DNS over HTTPS (RFC 8484)
+	// queries sent to it at this path (e.g. "/dns-query"), so that clients can
+	// send their DNS through the proxy too. A and AAAA queries are resolved
+	// with Resolver (or the default resolver), other queries are answered with
+	// NOTIMP. Queries pass authentication like any other request. (HTTP only)
+	DoHPath string
+
+	// TryAlternateAddrs, if true, resolves upstream hostnames (using Resolver
+	// or the default resolver) and if dialing the first address fails, tries
+	// the remaining addresses in turn before giving up. The address that was
+	// dialed is available to filters via DialedAddr(ctx).
+	TryAlternateAddrs bool
+
+	// MaxRetries limits how often GET, HEAD and OPTIONS requests without a
+	// body are retried if upstream can't be dialed or drops the connection
+	// before responding, defaults to 2. Retries skip resolved addresses that
+	// failed to dial.
+	MaxRetries int
+
+	// DisableRetries disables retrying requests, see MaxRetries.
+	DisableRetries bool
+
+	// DialAttemptTimeout, if specified, limits how long each individual dial
+	// attempt may take.
+	DialAttemptTimeout time.Duration
+
+	// MaxDialTime, if specified, limits the total time spent resolving and
+	// dialing upstream, across all attempts.
+	//
+	// Deprecated: use Timeouts.Dial instead.
+	MaxDialTime time.Duration
+
+	// EventListener, if specified, is notified of dials, tunnels opening and
+	// closing and forwarded requests.
+	EventListener EventListener
+
+	// Tracer, if specified, traces the handling of requests, dials, MITM
+	// handshakes and tunnels, and propagates trace context from incoming
+	// requests to forwarded ones. Tracing is disabled by default.
+	Tracer Tracer
+
+	// Timeouts bounds how long the proxy waits on upstream for dials,
+	// handshakes, responses and tunnels.
+	Timeouts Timeouts
+
+	// MaxIdleUpstreamConnsPerHost, if greater than zero, enables a pool of
+	// upstream connections shared by all downstream connections for forwarded
+	// (non-CONNECT) requests, keeping up to this many idle connections per host
+	// for reuse. When pooling, RequestAware and ResponseAware connections are
+	// only informed of requests from the downstream connection that dialed
+	// them. (HTTP only)
+	MaxIdleUpstreamConnsPerHost int
+
+	// UpstreamIdleTimeout is how long pooled idle upstream connections are kept
+	// before being closed. Defaults to IdleTimeout, or 90 seconds if that's
+	// unset. (HTTP only)
+	UpstreamIdleTimeout time.Duration
+
+	// HTTP3RoundTripper, if specified, is used to forward requests to https
+	// origins that have advertised HTTP/3 support via the Alt-Svc header, for
+	// example an http3.RoundTripper from github.com/quic-go/quic-go. If a
+	// request fails over HTTP/3, it's retried over TCP and the origin is no
+	// longer considered to support HTTP/3. (HTTP only)
+	HTTP3RoundTripper http.RoundTripper
+
+	// RateLimiter, if specified, caps the bandwidth of tunnels and forwarded
+	// requests per connection and/or per client IP.
+	RateLimiter *RateLimiter
+
+	// BandwidthLimit, if specified, caps the total bandwidth of all tunnels and
+	// forwarded requests, sharing it fairly between connections. Its limits
+	// can be changed at runtime, for example with AdminHandler. See
+	// NewBandwidthLimit.
+	BandwidthLimit *BandwidthLimit
+
+	// AccessLogger, if specified, receives a record for every request and
+	// tunnel once it completes. See JSONAccessLogger and CombinedAccessLogger.
+	AccessLogger AccessLogger
+
+	// Metrics, if specified, receives measurements of dials, tunnels, bytes
+	// transferred and response status codes. See NewPrometheusMetrics.
+	Metrics Metrics
+
+	// SLO, if specified, tracks the success rate and latency of tunnels and
+	// requests to each destination, which AdminHandler serves and
+	// PrometheusMetrics.ExportSLO exposes. See NewSLOTracker.
+	SLO *SLOTracker
+
+	// HAR, if specified, records forwarded requests with their timings as an
+	// HTTP Archive, which AdminHandler serves for download and which can be
+	// streamed to a writer. See NewHARRecorder.
+	HAR *HARRecorder
+
+	// HealthChecks configures the /healthz and /readyz endpoints of
+	// AdminHandler, and can serve them on the proxy port too. See
+	// HealthCheckOptions.
+	HealthChecks *HealthCheckOptions
+
 	// ShouldMITM is an optional function for determining whether or not the given
 	// HTTP CONNECT request to the given upstreamAddr is eligible for being MITM'ed.
 	ShouldMITM func(req *http.Request, upstreamAddr string) bool
@@ -102,13 +553,45 @@ type Opts struct {
 	// connections and handle them as an HTTP proxy. If the connection cannot be
 	// mitm'ed (e.g. Client Hello doesn't include an SNI header) or if the
 	// contents isn't HTTP, the connection is handled as normal without MITM.
+	//
+	// The CA used to sign dynamically generated leaf certificates is loaded
+	// from MITMOpts.PKFile and MITMOpts.CertFile (and generated there if
+	// missing). Decrypted requests are passed through Filter just like
+	// regular HTTP requests, with ctx.IsMITMing() returning true.
 	MITMOpts *mitm.Opts
+
+	// UpstreamTLSConfig, if specified, configures the TLS that the proxy
+	// originates to upstream servers, i.e. to MITM'ed destinations and when
+	// forwarding requests for https URLs (including WebSocket upgrades). It
+	// takes precedence over MITMOpts.ClientTLSConfig, which is still used for
+	// hosts for which it returns nil.
+	UpstreamTLSConfig TLSConfigFunc
+
+	// UpstreamVerification, if specified, pins the public keys of upstream
+	// servers and adds custom checks when the proxy originates TLS to them.
+	// Clients get StatusInvalidUpstreamCertificate if verification fails.
+	UpstreamVerification *UpstreamVerification
 }
 
 type proxy struct {
 	*Opts
-	mitmIC      *mitm.Interceptor
-	mitmDomains []*regexp.Regexp
+	// poolStats is kept first for 64-bit alignment
+	poolStats          poolStats
+	pool               *http.Transport
+	h2Transport        idleClosingTransport
+	tunnels            *tunnelRegistry
+	warm               *warmPool
+	accounting         *accountant
+	tracker            *connTracker
+	altSvc             *altSvcCache
+	limiter            *tunnelLimiter
+	dialHealth         *dialHealth
+	dialFailures       *dialFailureCache
+	clientTunnels      *clientTunnels
+	destinationLimiter *destinationLimiter
+	mitmIC             *mitm.Interceptor
+	mitmDomains        []*regexp.Regexp
+	config             atomic.Value // *Config
 }
 
 // New creates a new Proxy configured with the specified Opts. If there's an
@@ -116,21 +599,32 @@ type proxy struct {
 // usable (it just won't MITM).
 func New(opts *Opts) (newProxy Proxy, mitmErr error) {
 	if opts.Dial == nil {
-		opts.Dial = func(ctx context.Context, isCONNECT bool, network, addr string) (conn net.Conn, err error) {
-			timeout := 30 * time.Second
-			deadline, hasDeadline := ctx.Deadline()
-			if hasDeadline {
-				timeout = deadline.Sub(time.Now())
-			}
-			return net.DialTimeout(network, addr, timeout)
-		}
+		opts.Dial = defaultDial(opts)
 	}
+	opts.Dial = WrapDial(opts.Dial, opts.DialMiddleware...)
 	p := &proxy{
 		Opts:        opts,
+		tracker:     newConnTracker(),
+		tunnels:     newTunnelRegistry(),
+		altSvc:      newAltSvcCache(),
 		mitmDomains: make([]*regexp.Regexp, 0),
 	}
+	p.config.Store(&Config{
+		AccessControl: opts.AccessControl,
+		Authenticator: opts.Authenticator,
+		RateLimiter:   opts.RateLimiter,
+		Dial:          opts.Dial,
+	})
 	p.applyHTTPDefaults()
 	p.applyCONNECTDefaults()
+	p.initPool()
+	p.initHTTP2Transport()
+	p.initPrewarm()
+	p.initAccounting()
+	p.initConcurrencyLimit()
+	p.initDestinationLimit()
+	p.initDialFailureCache()
+	p.initHealth()
 
 	if opts.MITMOpts != nil {
 		p.mitmIC, mitmErr = mitm.Configure(opts.MITMOpts)
@@ -12,6 +12,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/getlantern/idletiming"
 	"github.com/getlantern/netx"
 	"github.com/getlantern/proxy/filters"
 	"github.com/getlantern/reconn"
@@ -32,6 +33,15 @@ type BufferSource interface {
 
 func (proxy *proxy) applyCONNECTDefaults() {
 	// Apply defaults
+	if proxy.Metrics == nil {
+		proxy.Metrics = noopMetrics
+	}
+	if proxy.Tracer == nil {
+		proxy.Tracer = noopTracer
+	}
+	if proxy.EventListener == nil {
+		proxy.EventListener = noopEventListener
+	}
 	if proxy.BufferSource == nil {
 		proxy.BufferSource = &defaultBufferSource{sync.Pool{
 			New: func() interface{} {
@@ -81,6 +91,8 @@ func (proxy *proxy) nextCONNECT(downstream net.Conn) filters.Next {
 			if proxy.OKSendsServerTiming {
 				addDialUpstreamHeader(resp, 0)
 			}
+			nextCtx = proxy.negotiateTunnelCompression(nextCtx, modifiedReq, resp)
+			proxy.customizeCONNECTResponse(modifiedReq, resp)
 			return resp, nextCtx, nil
 		}
 
@@ -93,11 +105,15 @@ func (proxy *proxy) nextCONNECT(downstream net.Conn) filters.Next {
 		// Host header. See discussion here:
 		// https://ask.wireshark.org/questions/22988/http-host-header-with-and-without-port-number
 		dialCtx, cancelDial := addDialDeadlineIfNecessary(ctx, modifiedReq)
-		upstream, err := proxy.Dial(dialCtx, true, "tcp", upstreamAddr)
+		dialCtx, cancelGone := cancelWhenClientGone(dialCtx)
+		upstream, err := proxy.dialUpstream(dialCtx, true, "tcp", upstreamAddr)
+		cancelGone()
 		cancelDial()
 		if err != nil {
 			if proxy.OKWaitsForUpstream {
-				return badGateway(ctx, modifiedReq, err)
+				resp, ctx, err = proxy.errorResponse(ctx, modifiedReq, err)
+				proxy.customizeCONNECTResponse(modifiedReq, resp)
+				return resp, ctx, err
 			}
 			return nil, ctx, err
 		}
@@ -112,12 +128,22 @@ func (proxy *proxy) nextCONNECT(downstream net.Conn) filters.Next {
 		if proxy.OKSendsServerTiming {
 			addDialUpstreamHeader(resp, time.Since(start))
 		}
+		nextCtx = proxy.negotiateTunnelCompression(nextCtx, modifiedReq, resp)
+		proxy.customizeCONNECTResponse(modifiedReq, resp)
 
 		nextCtx = nextCtx.WithValue(ctxKeyUpstream, upstream)
 		return resp, nextCtx, nil
 	}
 }
 
+// customizeCONNECTResponse gives OnCONNECTResponse a chance to modify the
+// headers of a response generated by the proxy for a CONNECT request.
+func (proxy *proxy) customizeCONNECTResponse(req *http.Request, resp *http.Response) {
+	if resp != nil && proxy.OnCONNECTResponse != nil {
+		proxy.OnCONNECTResponse(req, resp.Header)
+	}
+}
+
 func addDialUpstreamHeader(resp *http.Response, duration time.Duration) {
 	resp.Header.Add(serverTimingHeader, fmt.Sprintf("dialupstream;dur=%d", duration/time.Millisecond))
 }
@@ -162,12 +188,32 @@ func (proxy *proxy) Connect(ctx context.Context, in io.Reader, conn net.Conn, or
 }
 
 func (proxy *proxy) proceedWithConnect(ctx filters.Context, req *http.Request, upstreamAddr string, upstream net.Conn, downstream net.Conn) error {
+	if compressesTunnel(ctx) {
+		// The OK response has gone out uncompressed, everything after it is
+		// compressed
+		downstream = newCompressedConn(downstream)
+	}
+	shouldMITM := proxy.ShouldMITM(req, upstreamAddr)
 	if upstream == nil {
+		var early *earlyData
+		if proxy.CONNECTEarlyData && !shouldMITM {
+			early = proxy.readEarlyData(downstream)
+		}
 		var dialErr error
-		upstream, dialErr = proxy.Dial(ctx, true, "tcp", upstreamAddr)
+		upstream, dialErr = proxy.dialUpstream(ctx, true, "tcp", upstreamAddr)
 		if dialErr != nil {
 			return dialErr
 		}
+		if early != nil {
+			rest, flushErr := early.flush(upstream)
+			if flushErr != nil {
+				upstream.Close()
+				return flushErr
+			}
+			if rest != nil {
+				downstream = &readerConn{downstream, rest}
+			}
+		}
 	}
 	defer func() {
 		if closeErr := upstream.Close(); closeErr != nil {
@@ -176,9 +222,26 @@ func (proxy *proxy) proceedWithConnect(ctx filters.Context, req *http.Request, u
 	}()
 
 	var rr io.Reader
-	if proxy.ShouldMITM(req, upstreamAddr) {
+	if shouldMITM {
 		// Try to MITM the connection
-		downstreamMITM, upstreamMITM, mitming, err := proxy.mitmIC.MITM(downstream, upstream)
+		_, span := proxy.Tracer.StartSpan(ctx, SpanHandshake)
+		// With UpstreamTLSConfig or UpstreamVerification, we originate TLS to
+		// upstream ourselves
+		upstreamTLS := proxy.originatesUpstreamTLS() && !skipsMITMEncryption(upstream)
+		toMITM := upstream
+		if upstreamTLS {
+			toMITM = &skipMITMEncryptionConn{upstream}
+		}
+		downstreamMITM, upstreamMITM, mitming, err := proxy.mitmIC.MITM(downstream, toMITM)
+		if err == nil && mitming && upstreamTLS {
+			upstreamMITM, err = proxy.mitmUpstreamTLS(downstreamMITM, upstream)
+			if err != nil && causedBy(err, isCertificateError) {
+				proxy.respondToMITMed(ctx, downstreamMITM, err)
+			}
+		} else if upstreamMITM == toMITM {
+			upstreamMITM = upstream
+		}
+		endSpan(span, err)
 		if err != nil {
 			return log.Errorf("Unable to MITM connection: %v", err)
 		}
@@ -210,29 +273,157 @@ func (proxy *proxy) proceedWithConnect(ctx filters.Context, req *http.Request, u
 		}
 	}
 
-	// Prepare to pipe data between the client and the proxy.
-	bufOut := proxy.BufferSource.Get()
-	bufIn := proxy.BufferSource.Get()
-	defer proxy.BufferSource.Put(bufOut)
-	defer proxy.BufferSource.Put(bufIn)
-
 	if rr != nil {
 		// We tried and failed to MITM. First copy already read data to upstream
 		// before we start piping as usual
-		_, copyErr := io.CopyBuffer(upstream, rr, bufOut)
+		buf := proxy.BufferSource.Get()
+		_, copyErr := io.CopyBuffer(upstream, rr, buf)
+		proxy.BufferSource.Put(buf)
 		if copyErr != nil {
 			return log.Errorf("Error copying initial data to upstream: %v", copyErr)
 		}
 	}
 
-	// Pipe data between the client and the proxy.
-	writeErr, readErr := netx.BidiCopy(upstream, downstream, bufOut, bufIn)
-	if isUnexpected(readErr) {
-		return log.Errorf("Error piping data to downstream: %v", readErr)
+	return proxy.pipe(ctx, upstreamAddr, upstream, downstream)
+}
+
+// pipe copies data between upstream and downstream in both directions until
+// one of the sides is done. It is shared by all tunneling protocols (CONNECT,
+// SOCKS).
+func (proxy *proxy) pipe(ctx context.Context, upstreamAddr string, upstream net.Conn, downstream net.Conn) error {
+	start := time.Now()
+	_, span := proxy.Tracer.StartSpan(ctx, SpanCopy)
+	span.SetAttribute("net.peer.name", upstreamAddr)
+	proxy.Metrics.TunnelOpened(upstreamAddr)
+	proxy.EventListener.TunnelOpened(ctx, upstreamAddr, upstream, downstream)
+	var err error
+	defer func() {
+		proxy.Metrics.TunnelClosed(upstreamAddr, time.Since(start))
+		proxy.EventListener.TunnelClosed(ctx, upstreamAddr, time.Since(start), err)
+	}()
+
+	rec := accessRecord(ctx)
+	if proxy.countTunnelBytes() || rec != nil {
+		stats := &TunnelStats{UpstreamAddr: upstreamAddr, Start: start}
+		upstream = &countingConn{Conn: upstream, stats: stats}
+		setCurrentTunnelStats(ctx, stats)
+		if proxy.accounting != nil {
+			defer proxy.accounting.track(tunnelClient(ctx, ""), stats)()
+		}
+		defer func() {
+			setCurrentTunnelStats(ctx, nil)
+			stats.Duration = time.Since(start)
+			if rec != nil {
+				rec.BytesUp += stats.BytesUp()
+				rec.BytesDown += stats.BytesDown()
+			}
+			if proxy.OnTunnelComplete != nil {
+				proxy.OnTunnelComplete(ctx, stats)
+			}
+		}()
+	}
+	var sniffer *protocolSniffer
+	if proxy.sniffsTunnels() {
+		ctx, sniffer, downstream = proxy.sniffTunnel(ctx, upstreamAddr, upstream, downstream)
+	}
+	defer proxy.registerTunnel(ctx, upstreamAddr, upstream, downstream, start)()
+	if proxy.Tap != nil {
+		info := newTapInfo(ctx, upstreamAddr, downstream)
+		upstream = &tappedConn{Conn: upstream, tap: proxy.Tap, info: info}
+		defer proxy.Tap.Closed(info)
+	}
+	if proxy.Timeouts.MaxTunnelDuration > 0 {
+		// Closing upstream stops BidiCopy in both directions
+		toClose := upstream
+		timer := time.AfterFunc(proxy.Timeouts.MaxTunnelDuration, func() {
+			log.Debugf("Closing tunnel to %v after %v", upstreamAddr, proxy.Timeouts.MaxTunnelDuration)
+			toClose.Close()
+		})
+		defer timer.Stop()
+	}
+	if done := ctx.Done(); done != nil {
+		// Abort the tunnel if the context is canceled, e.g. because the caller
+		// of Handle gave up on the connection
+		toClose := upstream
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-done:
+				log.Debugf("Closing tunnel to %v: %v", upstreamAddr, ctx.Err())
+				toClose.Close()
+			case <-stop:
+			}
+		}()
+	}
+	// Shaped connections queue writes, so they can't be half-closed right away
+	var upstreamCW, downstreamCW closeWriter
+	if proxy.Shaping == nil {
+		upstreamCW, downstreamCW = closeWriterOf(upstream), closeWriterOf(downstream)
+	} else {
+		shapedUpstream := newShapedConn(upstream, proxy.Shaping)
+		shapedDownstream := newShapedConn(downstream, proxy.Shaping)
+		upstream, downstream = shapedUpstream, shapedDownstream
+		defer shapedUpstream.drain()
+		defer shapedDownstream.drain()
+	}
+	if proxy.IdleTimeout > 0 {
+		// All traffic passes through upstream, so timing it is enough to detect
+		// idleness in both directions. BidiCopy stops once it's closed.
+		upstream = idletiming.Conn(upstream, proxy.IdleTimeout, func() {
+			log.Debugf("Closing idle tunnel to %v", upstreamAddr)
+			if proxy.OnTunnelIdle != nil {
+				proxy.OnTunnelIdle(upstreamAddr)
+			}
+		})
+	}
+
+	// Pipe data between the client and the proxy, zero-copy if possible.
+	writeErr, readErr, spliced := spliceTunnel(upstream, downstream)
+	if !spliced {
+		if upstreamCW != nil && downstreamCW != nil {
+			// Propagate half-closes between both sides
+			writeErr, readErr = halfCloseCopy(upstream, downstream, upstreamCW, downstreamCW, proxy.tunnelBuffers(), proxy.tunnelBuffers())
+		} else {
+			bufOut := proxy.BufferSource.Get()
+			bufIn := proxy.BufferSource.Get()
+			defer proxy.BufferSource.Put(bufOut)
+			defer proxy.BufferSource.Put(bufIn)
+			writeErr, readErr = netx.BidiCopy(upstream, downstream, bufOut, bufIn)
+		}
+	}
+	if sniffer != nil && sniffer.denied != nil {
+		err = sniffer.denied
+	} else if isUnexpected(readErr) {
+		err = log.Errorf("Error piping data to downstream: %v", readErr)
 	} else if isUnexpected(writeErr) {
-		return log.Errorf("Error piping data to upstream at %v: %v", upstream.RemoteAddr(), writeErr)
+		err = log.Errorf("Error piping data to upstream at %v: %v", upstream.RemoteAddr(), writeErr)
+	}
+	endSpan(span, err)
+	return err
+}
+
+// mitmErrorReadTimeout limits how long respondToMITMed waits for the request
+// to respond to.
+const mitmErrorReadTimeout = 10 * time.Second
+
+// respondToMITMed reports err, which kept us from originating TLS upstream, to
+// the client of a MITM'ed tunnel in response to its first request.
+func (proxy *proxy) respondToMITMed(ctx filters.Context, downstream net.Conn, err error) {
+	downstream.SetReadDeadline(time.Now().Add(mitmErrorReadTimeout))
+	req, readErr := http.ReadRequest(bufio.NewReader(downstream))
+	if readErr != nil {
+		log.Debugf("Unable to read MITM'ed request to report %v: %v", err, readErr)
+		return
+	}
+	resp := proxy.OnError(ctx, req, false, err)
+	if resp == nil {
+		return
+	}
+	resp.Close = true
+	if writeErr := resp.Write(downstream); writeErr != nil {
+		log.Debugf("Unable to report %v to MITM'ed client: %v", err, writeErr)
 	}
-	return nil
 }
 
 func badGateway(ctx filters.Context, req *http.Request, err error) (*http.Response, filters.Context, error) {
@@ -254,6 +445,11 @@ func (proxy *proxy) defaultShouldMITM(req *http.Request, upstreamAddr string) bo
 	if proxy.mitmIC == nil {
 		return false
 	}
+	if proxy.Rules != nil {
+		if rule := proxy.Rules.Match(req); rule != nil && rule.Action == ActionMITM {
+			return true
+		}
+	}
 	host, _, err := net.SplitHostPort(upstreamAddr)
 	if err != nil {
 		return false
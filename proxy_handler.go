@@ -0,0 +1,365 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+)
+
+// ServeHTTP implements the interface http.Handler so that the proxy can be
+// served by an http.Server. HTTP/1.x connections are hijacked and handled like
+// any other connection. HTTP/2 requests can't be hijacked, so CONNECT requests
+// are tunneled over the HTTP/2 stream itself, using the request body as the
+// read side and flushing writes to the ResponseWriter as the write side. The
+// same goes for HTTP/3 requests from an HTTP/3 server using the proxy as its
+// handler, which together with CONNECT-UDP makes for a MASQUE proxy.
+func (proxy *proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.ProtoMajor == 2 || req.ProtoMajor == 3 {
+		proxy.serveHTTP2(w, req)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	_, span := proxy.Tracer.StartSpan(proxy.Tracer.Extract(req.Context(), req.Header), SpanHijack)
+	conn, bufrw, err := hj.Hijack()
+	endSpan(span, err)
+	if err != nil {
+		log.Error(&HijackError{Err: errors.New("Unable to hijack connection: %v", err)})
+		return
+	}
+	// net/http has already consumed the request head, so replay it. Whatever it
+	// buffered beyond that (like data that the client sent early, ahead of the
+	// 200 OK to a CONNECT) is read through the connection itself, since tunnels
+	// read from the connection rather than from downstreamIn.
+	if bufrw.Reader.Buffered() > 0 {
+		conn = &readerConn{conn, bufrw.Reader}
+	}
+	head := &bytes.Buffer{}
+	writeRequestHead(head, req)
+	proxy.Handle(context.Background(), io.MultiReader(head, conn), conn)
+}
+
+// serveHTTP2 serves an HTTP/2 or HTTP/3 request.
+func (proxy *proxy) serveHTTP2(w http.ResponseWriter, req *http.Request) {
+	// The target of CONNECT-UDP is in the path, the authority is the proxy's
+	connectUDP := proxy.ConnectUDP && isExtendedConnectUDP(req)
+	if !connectUDP {
+		if err := proxy.validateCONNECTTarget(req); err != nil {
+			log.Debugf("Rejecting request: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	downstream := newH2Conn(w, req)
+	defer downstream.Close()
+	tc := proxy.tracker.add(downstream, true)
+	if tc == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer proxy.tracker.remove(tc)
+
+	ctx := req.Context()
+	if ClientCertificate(ctx) == nil {
+		ctx = withClientIdentity(ctx, req.TLS, nil)
+	}
+	ctx = withInformational(ctx, http2Informational(w))
+	ctx = withClientGeo(ctx, proxy.GeoIP, clientIPFromAddr(req.RemoteAddr))
+	fctx := filters.WrapContext(withTunnelStats(withResolvedIPs(withDialedAddr(withAwareConn(ctx)))), downstream)
+	fctx = proxy.startRequestSpan(fctx, req)
+	rec := proxy.newAccessRecord(req)
+	if rec != nil {
+		fctx = fctx.WithValue(ctxKeyAccessRecord, rec)
+	}
+	var logErr error
+	defer func() {
+		proxy.finishRequest(fctx, rec, logErr)
+	}()
+
+	var next filters.Next
+	switch {
+	case connectUDP:
+		next = proxy.connectUDP
+	case req.Method == http.MethodConnect:
+		next = proxy.nextCONNECT(downstream)
+	default:
+		next = proxy.nextNonCONNECT(proxy.h2Transport)
+	}
+
+	resp, fctx, err := proxy.Filter.Apply(fctx, req, next)
+	defer releaseTunnel(fctx)
+	logErr = err
+	if err != nil && resp == nil {
+		resp = proxy.OnError(fctx, req, false, err)
+		if resp == nil && proxy.ErrorRenderer != nil {
+			resp = proxy.ErrorRenderer.RenderError(fctx, req, err)
+		}
+		if resp == nil {
+			log.Debugf("Responding BadGateway to HTTP/2 request: %v", err)
+			w.WriteHeader(http.StatusBadGateway)
+			proxy.Metrics.ResponseWritten(req, http.StatusBadGateway)
+			if rec != nil {
+				rec.StatusCode = http.StatusBadGateway
+			}
+			return
+		}
+	}
+	if resp == nil {
+		return
+	}
+
+	resp = prepareResponse(resp, false)
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	for key := range resp.Trailer {
+		w.Header().Add("Trailer", key)
+	}
+	w.WriteHeader(resp.StatusCode)
+	proxy.Metrics.ResponseWritten(req, resp.StatusCode)
+	if rec != nil {
+		rec.StatusCode = resp.StatusCode
+	}
+	if resp.Body != nil {
+		n, _ := io.Copy(downstream, resp.Body)
+		resp.Body.Close()
+		if rec != nil {
+			rec.BytesDown = n
+		}
+		// Trailer values are only known once the body has been read
+		for key, values := range resp.Trailer {
+			w.Header()[key] = values
+		}
+	}
+	downstream.flush()
+
+	if err != nil {
+		return
+	}
+	if upgraded := upgradedUpstream(fctx); upgraded != nil {
+		defer upgraded.Close()
+		logErr = proxy.pipe(fctx, upgraded.RemoteAddr().String(), upgraded, downstream)
+		return
+	}
+	upstream := upstreamConn(fctx)
+	upstreamAddr := upstreamAddr(fctx)
+	if upstream != nil || upstreamAddr != "" {
+		if connectErr := proxy.proceedWithConnect(fctx, req, upstreamAddr, upstream, downstream); connectErr != nil {
+			logErr = connectErr
+			log.Debugf("Error tunneling HTTP/2 CONNECT to %v: %v", upstreamAddr, connectErr)
+		}
+	}
+}
+
+// writeRequestHead writes the request line and headers of a request that was
+// parsed by net/http, without its body.
+func writeRequestHead(w io.Writer, req *http.Request) {
+	fmt.Fprintf(w, "%s %s HTTP/%d.%d\r\nHost: %s\r\n", req.Method, req.RequestURI, req.ProtoMajor, req.ProtoMinor, req.Host)
+	req.Header.Write(w)
+	if len(req.TransferEncoding) > 0 && req.Header.Get("Transfer-Encoding") == "" {
+		fmt.Fprintf(w, "Transfer-Encoding: %s\r\n", req.TransferEncoding[0])
+	}
+	io.WriteString(w, "\r\n")
+}
+
+// h2Conn adapts an HTTP/2 request/response stream to a net.Conn. Since reads
+// from the request body can't be interrupted, the body is read in the
+// background, and Read waits for the next chunk until the read deadline
+// passes, which leaves the body intact for reads after a new deadline.
+type h2Conn struct {
+	w          io.Writer
+	flusher    http.Flusher
+	body       io.ReadCloser
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	readOnce sync.Once
+	reads    chan h2Read
+	done     chan struct{}
+
+	mx        sync.Mutex
+	pending   []byte
+	readErr   error
+	readTimer *time.Timer
+	// deadline is closed once the read deadline passes, nil without one
+	deadline chan struct{}
+	closed   bool
+}
+
+// h2Read is a chunk read from the request body in the background
+type h2Read struct {
+	data []byte
+	err  error
+}
+
+func newH2Conn(w http.ResponseWriter, req *http.Request) *h2Conn {
+	flusher, _ := w.(http.Flusher)
+	localAddr, _ := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if localAddr == nil {
+		localAddr = &stringAddr{"tcp", ""}
+	}
+	return &h2Conn{
+		w:          w,
+		flusher:    flusher,
+		body:       req.Body,
+		localAddr:  localAddr,
+		remoteAddr: &stringAddr{"tcp", req.RemoteAddr},
+		reads:      make(chan h2Read),
+		done:       make(chan struct{}),
+	}
+}
+
+func (conn *h2Conn) Read(b []byte) (int, error) {
+	conn.mx.Lock()
+	if len(conn.pending) > 0 {
+		n := copy(b, conn.pending)
+		conn.pending = conn.pending[n:]
+		conn.mx.Unlock()
+		return n, nil
+	}
+	if conn.readErr != nil {
+		conn.mx.Unlock()
+		return 0, conn.readErr
+	}
+	deadline := conn.deadline
+	conn.mx.Unlock()
+
+	conn.readOnce.Do(func() {
+		go conn.readBody()
+	})
+	select {
+	case read := <-conn.reads:
+		n := copy(b, read.data)
+		conn.mx.Lock()
+		defer conn.mx.Unlock()
+		conn.pending = read.data[n:]
+		conn.readErr = read.err
+		if len(conn.pending) > 0 {
+			return n, nil
+		}
+		return n, read.err
+	case <-deadline:
+		return 0, timeoutError{}
+	case <-conn.done:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+// readBody reads the request body until it fails, handing each chunk to Read.
+func (conn *h2Conn) readBody() {
+	for {
+		buf := make([]byte, 16384)
+		n, err := conn.body.Read(buf)
+		select {
+		case conn.reads <- h2Read{buf[:n], err}:
+		case <-conn.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (conn *h2Conn) Write(b []byte) (int, error) {
+	conn.mx.Lock()
+	closed := conn.closed
+	conn.mx.Unlock()
+	if closed {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := conn.w.Write(b)
+	conn.flush()
+	return n, err
+}
+
+func (conn *h2Conn) flush() {
+	if conn.flusher != nil {
+		conn.flusher.Flush()
+	}
+}
+
+func (conn *h2Conn) Close() error {
+	conn.mx.Lock()
+	defer conn.mx.Unlock()
+	if conn.closed {
+		return nil
+	}
+	conn.closed = true
+	close(conn.done)
+	if conn.readTimer != nil {
+		conn.readTimer.Stop()
+	}
+	return conn.body.Close()
+}
+
+func (conn *h2Conn) LocalAddr() net.Addr {
+	return conn.localAddr
+}
+
+func (conn *h2Conn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+func (conn *h2Conn) SetDeadline(t time.Time) error {
+	return conn.SetReadDeadline(t)
+}
+
+func (conn *h2Conn) SetReadDeadline(t time.Time) error {
+	conn.mx.Lock()
+	defer conn.mx.Unlock()
+	if conn.readTimer != nil {
+		conn.readTimer.Stop()
+		conn.readTimer = nil
+	}
+	// A new deadline replaces one that has already passed
+	conn.deadline = nil
+	if t.IsZero() || conn.closed {
+		return nil
+	}
+	deadline := make(chan struct{})
+	conn.deadline = deadline
+	if d := time.Until(t); d > 0 {
+		conn.readTimer = time.AfterFunc(d, func() {
+			close(deadline)
+		})
+	} else {
+		close(deadline)
+	}
+	return nil
+}
+
+func (conn *h2Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type stringAddr struct {
+	network string
+	addr    string
+}
+
+func (a *stringAddr) Network() string {
+	return a.network
+}
+
+func (a *stringAddr) String() string {
+	return a.addr
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
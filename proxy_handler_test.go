@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	ht "net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/getlantern/mockconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTP2CONNECT(t *testing.T) {
+	d := mockconn.SucceedingDialer([]byte("I'm good!"))
+	p := newProxy(&Opts{
+		Dial: func(ctx context.Context, isConnect bool, net, addr string) (net.Conn, error) {
+			return d.Dial(net, addr)
+		},
+	})
+
+	s := ht.NewUnstartedServer(p)
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req, _ := http.NewRequest(http.MethodConnect, s.URL, pr)
+	req.Host = "thehost:123"
+	tr := &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}
+	defer tr.CloseIdleConnections()
+	resp, err := tr.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, err = pw.Write([]byte("hello"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	received := make([]byte, len("I'm good!"))
+	_, err = io.ReadFull(resp.Body, received)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "I'm good!", string(received))
+	assert.Equal(t, "thehost:123", d.LastDialed())
+}
+
+func TestServeHTTPHijacked(t *testing.T) {
+	origin := ht.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Host))
+	}))
+	defer origin.Close()
+
+	p := newProxy(&Opts{})
+	s := ht.NewServer(p)
+	defer s.Close()
+
+	proxyURL, _ := http.NewRequest(http.MethodGet, s.URL, nil)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL.URL)}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+	resp, err := tr.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, origin.Listener.Addr().String(), string(body))
+}
+
+func TestServeHTTPHijackedEarlyData(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	p := newProxy(&Opts{})
+	s := ht.NewServer(p)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	// Send data along with the CONNECT, without waiting for the 200 OK, so
+	// that net/http buffers it before the connection is hijacked
+	_, err = fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\nearly data", origin.Addr(), origin.Addr())
+	if !assert.NoError(t, err) {
+		return
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	echoed := make([]byte, len("early data"))
+	_, err = io.ReadFull(br, echoed)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "early data", string(echoed), "Data buffered by net/http should be tunneled")
+}
+
+func TestHTTP2Trailers(t *testing.T) {
+	origin := ht.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte("hello"))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	defer origin.Close()
+
+	p := newProxy(&Opts{
+		Dial: func(ctx context.Context, isConnect bool, network, addr string) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	})
+	s := ht.NewUnstartedServer(p)
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	var interim []int
+	ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			interim = append(interim, code)
+			return nil
+		},
+	})
+	req, _ := http.NewRequest(http.MethodGet, s.URL, nil)
+	req = req.WithContext(ctx)
+	req.Host = origin.Listener.Addr().String()
+	tr := &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}
+	defer tr.CloseIdleConnections()
+	resp, err := tr.RoundTrip(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, []int{http.StatusEarlyHints}, interim)
+	assert.Empty(t, resp.Header.Get("Link"))
+}
+
+func TestH2ConnReadDeadline(t *testing.T) {
+	body, bodyWriter := io.Pipe()
+	req := ht.NewRequest(http.MethodConnect, "http://example.com:443", body)
+	conn := newH2Conn(ht.NewRecorder(), req)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	netErr, ok := err.(net.Error)
+	if assert.True(t, ok, "Expected timeout, got %v", err) {
+		assert.True(t, netErr.Timeout())
+	}
+
+	conn.SetReadDeadline(time.Time{})
+	go bodyWriter.Write([]byte("hello"))
+	b := make([]byte, 3)
+	n, err := conn.Read(b)
+	require.NoError(t, err, "Clearing the deadline should reset it")
+	assert.Equal(t, "hel", string(b[:n]))
+
+	conn.SetReadDeadline(time.Now().Add(-time.Second))
+	n, err = conn.Read(b)
+	require.NoError(t, err, "Data already read should be returned despite the deadline")
+	assert.Equal(t, "lo", string(b[:n]))
+	_, err = conn.Read(b)
+	_, isTimeout := err.(timeoutError)
+	assert.True(t, isTimeout, "Past deadlines should time out right away")
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	go bodyWriter.Write([]byte("again"))
+	n, err = conn.Read(make([]byte, 5))
+	require.NoError(t, err, "Reads should continue after a deadline passed")
+	assert.Equal(t, 5, n)
+
+	bodyWriter.Close()
+	_, err = conn.Read(b)
+	assert.Equal(t, io.EOF, err)
+}
@@ -13,17 +13,37 @@ import (
 
 	"github.com/getlantern/errors"
 	"github.com/getlantern/netx"
-	"github.com/getlantern/preconn"
 	"github.com/getlantern/proxy/filters"
 )
 
-func (opts *Opts) applyHTTPDefaults() {
+func (proxy *proxy) applyHTTPDefaults() {
 	// Apply defaults
-	if opts.Filter == nil {
-		opts.Filter = filters.FilterFunc(defaultFilter)
+	if proxy.Filter == nil {
+		proxy.Filter = filters.FilterFunc(defaultFilter)
 	}
-	if opts.OnError == nil {
-		opts.OnError = defaultOnError
+	if proxy.DoHPath != "" {
+		proxy.Filter = filters.Join(proxy.dohFilter(), proxy.Filter)
+	}
+	if proxy.Rules != nil {
+		proxy.Filter = filters.Join(proxy.Filter, proxy.Rules.filter())
+	}
+	if proxy.MaxRequestBodySize > 0 || proxy.MaxResponseBodySize > 0 {
+		proxy.Filter = filters.Join(proxy.Filter, proxy.bodyLimitsFilter())
+	}
+	// Authentication and access control consult the current Config, so that
+	// they can be changed with ApplyConfig
+	proxy.Filter = filters.Join(proxy.Filter, proxy.configuredAccessControlFilter())
+	proxy.Filter = filters.Join(proxy.configuredAuthFilter(), proxy.Filter)
+	if proxy.HealthChecks != nil && proxy.HealthChecks.ServeOnProxyPort {
+		// Probes don't authenticate
+		proxy.Filter = filters.Join(proxy.healthFilter(), proxy.Filter)
+	}
+	if proxy.OnError == nil {
+		if proxy.ErrorRenderer != nil {
+			proxy.OnError = proxy.renderErrorOnError
+		} else {
+			proxy.OnError = defaultOnError
+		}
 	}
 }
 
@@ -37,7 +57,14 @@ func (proxy *proxy) Handle(ctx context.Context, downstreamIn io.Reader, downstre
 		}
 	}()
 
-	err = proxy.handle(ctx, downstreamIn, downstream, nil)
+	tc := proxy.tracker.add(downstream, false)
+	if tc == nil {
+		safeClose(downstream)
+		return ErrShutdown
+	}
+	defer proxy.tracker.remove(tc)
+
+	err = proxy.handle(context.WithValue(ctx, ctxKeyTrackedConn, tc), downstreamIn, downstream, nil)
 	return
 }
 
@@ -82,11 +109,19 @@ func (proxy *proxy) handle(ctx context.Context, downstreamIn io.Reader, downstre
 		}
 	}()
 
-	downstreamBuffered := bufio.NewReader(downstreamIn)
-	fctx := filters.WrapContext(withAwareConn(ctx), downstream)
+	headers := &headerRecorder{r: downstreamIn}
+	downstreamBuffered := bufio.NewReader(headers)
+	ctx = withClientGeo(ctx, proxy.GeoIP, connClientIP(downstream))
+	auth := connAuthFor(ctx)
+	if auth == nil {
+		auth = &connAuth{}
+	}
+	fctx := filters.WrapContext(withTunnelStats(withResolvedIPs(withDialedAddr(withAwareConn(ctx)))), downstream).
+		WithValue(ctxKeyConnAuth, auth)
 
 	// Read initial request
-	req, err := http.ReadRequest(downstreamBuffered)
+	req, err := proxy.readRequest(downstreamBuffered, headers)
+	proxy.tracker.setActive(ctx, true)
 	if req != nil {
 		remoteAddr := downstream.RemoteAddr()
 		if remoteAddr != nil {
@@ -100,11 +135,18 @@ func (proxy *proxy) handle(ctx context.Context, downstreamIn io.Reader, downstre
 		}
 	}
 
+	state := &connState{}
+	// Whatever is still running for this connection mustn't respond once it's
+	// done with
+	defer state.close()
 	if err != nil {
+		if proxy.rejectInvalidRequest(state, downstream, req, err) {
+			return err
+		}
 		if isUnexpected(err) {
 			errResp := proxy.OnError(fctx, req, true, err)
 			if errResp != nil {
-				proxy.writeResponse(downstream, req, errResp)
+				proxy.respond(state, downstream, req, errResp)
 			}
 
 			return proxy.logInitialReadError(downstream, err)
@@ -134,24 +176,21 @@ func (proxy *proxy) handle(ctx context.Context, downstreamIn io.Reader, downstre
 				upstream: upstream,
 			}
 		} else {
-			tr = &http.Transport{
-				DialContext:     proxy.requestAwareDial,
-				IdleConnTimeout: proxy.IdleTimeout,
-				// since we have one transport per downstream connection, we don't need
-				// more than this
-				MaxIdleConnsPerHost: 1,
-			}
+			tr = proxy.newTransport()
 		}
 
 		defer tr.CloseIdleConnections()
 		next = proxy.nextNonCONNECT(tr)
 	}
 
-	return proxy.processRequests(fctx, req.RemoteAddr, req, downstream, downstreamBuffered, next)
+	// The client can only be watched for disconnects if reading from
+	// downstreamIn is interrupted by downstream's read deadline
+	watchable := downstreamIn == io.Reader(downstream)
+	return proxy.processRequests(fctx, state, req.RemoteAddr, req, downstream, downstreamBuffered, headers, watchable, next)
 }
 
 func (proxy *proxy) requestAwareDial(ctx context.Context, network, addr string) (net.Conn, error) {
-	conn, err := proxy.Dial(ctx, false, network, addr)
+	conn, err := proxy.dialUpstream(ctx, false, network, addr)
 	if err == nil {
 		// On first dialing conn, handle RequestAware
 		setUpstreamForAwareConn(ctx, conn)
@@ -163,7 +202,21 @@ func (proxy *proxy) requestAwareDial(ctx context.Context, network, addr string)
 func (proxy *proxy) nextNonCONNECT(tr idleClosingTransport) func(ctx filters.Context, modifiedReq *http.Request) (*http.Response, filters.Context, error) {
 	return func(ctx filters.Context, modifiedReq *http.Request) (*http.Response, filters.Context, error) {
 		modifiedReq = modifiedReq.WithContext(ctx)
-		modifiedReq = prepareRequest(modifiedReq)
+		if proxy.ConnectUDP && isConnectUDP(modifiedReq) {
+			return proxy.connectUDP(ctx, modifiedReq)
+		}
+		upgrade := isWebSocketUpgrade(modifiedReq.Header)
+		modifiedReq = prepareRequest(modifiedReq, proxy.Forwarding)
+		proxy.Tracer.Inject(ctx, modifiedReq.Header)
+		if upgrade {
+			// Upgrade and Connection are hop-by-hop, but the upgrade needs to be
+			// negotiated end to end.
+			modifiedReq.Header.Set("Connection", "Upgrade")
+			modifiedReq.Header.Set("Upgrade", "websocket")
+			resp, ctx, err := proxy.roundTripUpgrade(ctx, tr, modifiedReq)
+			proxy.EventListener.RequestForwarded(ctx, modifiedReq, resp, err)
+			return resp, ctx, err
+		}
 
 		// Note that the following request aware handling only applies when the upstream
 		// connection has already been made -- i.e. when there is a net.Conn that is possibly
@@ -171,16 +224,46 @@ func (proxy *proxy) nextNonCONNECT(tr idleClosingTransport) func(ctx filters.Con
 		// RoundTrip call creates the upstream connection in that case. See DialContext above.
 		setRequestForAwareConn(ctx, modifiedReq)
 		handleRequestAware(ctx)
-		resp, err := tr.RoundTrip(modifiedReq)
+		reqCtx, cancel := proxy.withRequestTimeout(modifiedReq.Context())
+		modifiedReq = traceInformational(modifiedReq.WithContext(reqCtx))
+		modifiedReq, recordHAR := proxy.traceHAR(ctx, modifiedReq)
+		recordForwarded := func(error) {}
+		if proxy.CircuitBreaker != nil {
+			modifiedReq, recordForwarded = proxy.CircuitBreaker.traceForwarding(modifiedReq)
+		}
+		roundTrip := tr.RoundTrip
+		if proxy.Cache != nil {
+			roundTrip = func(req *http.Request) (*http.Response, error) {
+				return proxy.Cache.roundTrip(tr, req)
+			}
+		}
+		var resp *http.Response
+		var err error
+		start := time.Now()
+		if _, fixedUpstream := tr.(*addressLoggingTransport); fixedUpstream {
+			// Retrying would only reuse the same upstream connection
+			resp, err = roundTrip(modifiedReq)
+		} else {
+			resp, err = proxy.roundTripWithRetries(modifiedReq, roundTrip)
+		}
 		handleResponseAware(ctx, modifiedReq, resp, err)
+		proxy.EventListener.RequestForwarded(ctx, modifiedReq, resp, err)
+		recordForwarded(err)
+		proxy.recordForwardedSLO(modifiedReq, time.Since(start), resp, err)
+		recordHAR(resp, err)
 		if err != nil {
-			err = errors.New("Unable to round-trip http request to upstream: %v", err)
+			cancel()
+			err = errors.New("Unable to round-trip http request to upstream: %v", roundTripError(modifiedReq.URL.Host, err))
+		} else if resp.Body != nil {
+			resp.Body = &cancelOnClose{resp.Body, cancel}
+		} else {
+			cancel()
 		}
 		return resp, ctx, err
 	}
 }
 
-func (proxy *proxy) processRequests(ctx filters.Context, remoteAddr string, req *http.Request, downstream net.Conn, downstreamBuffered *bufio.Reader, next filters.Next) error {
+func (proxy *proxy) processRequests(ctx filters.Context, state *connState, remoteAddr string, req *http.Request, downstream net.Conn, downstreamBuffered *bufio.Reader, headers *headerRecorder, watchable bool, next filters.Next) error {
 	var readErr error
 	var resp *http.Response
 	var err error
@@ -188,6 +271,9 @@ func (proxy *proxy) processRequests(ctx filters.Context, remoteAddr string, req
 	for {
 		if req.URL.Scheme == "" {
 			req.URL.Scheme = origURLScheme(ctx)
+			if req.URL.Scheme == "" && req.Method != http.MethodConnect {
+				req.URL.Scheme = proxy.DefaultScheme
+			}
 		}
 		if req.URL.Host == "" {
 			req.URL.Host = origURLHost(ctx)
@@ -195,7 +281,25 @@ func (proxy *proxy) processRequests(ctx filters.Context, remoteAddr string, req
 		if req.Host == "" {
 			req.Host = origHost(ctx)
 		}
+		ctx = proxy.startRequestSpan(ctx, req)
+		ctx = ctx.WithValue(ctxKeyInformational, http1Informational(downstream, req))
+		rec := proxy.newAccessRecord(req)
+		if rec != nil {
+			ctx = ctx.WithValue(ctxKeyAccessRecord, rec)
+		}
+		var watch *downstreamWatch
+		var gone chan struct{}
+		if watchable && proxy.shouldWatchDownstream(req) {
+			watch = watchDownstream(downstream, downstreamBuffered)
+			if watch != nil {
+				gone = watch.gone
+			}
+		}
+		ctx = ctx.WithValue(ctxKeyClientGone, gone)
 		resp, ctx, err = proxy.Filter.Apply(ctx, req, next)
+		if watch != nil {
+			watch.stop()
+		}
 		if err != nil && resp == nil {
 			resp = proxy.OnError(ctx, req, false, err)
 			if resp != nil {
@@ -206,8 +310,23 @@ func (proxy *proxy) processRequests(ctx filters.Context, remoteAddr string, req
 		}
 
 		if resp != nil {
-			writeErr := proxy.writeResponse(downstream, req, resp)
+			counted := &countingWriter{w: downstream}
+			writeErr := proxy.respond(state, counted, req, resp)
+			if rec != nil {
+				rec.StatusCode = resp.StatusCode
+				rec.BytesDown = counted.n
+			}
 			if writeErr != nil {
+				if upstream := upstreamConn(ctx); upstream != nil {
+					// The client never learned about the tunnel, so nothing will
+					// close it otherwise
+					upstream.Close()
+				}
+				releaseTunnel(ctx)
+				proxy.finishRequest(ctx, rec, err)
+				if writeErr == errResponseSuppressed {
+					return log.Errorf("Already responded to %v: %v", requestTarget(req), writeErr)
+				}
 				if isUnexpected(writeErr) {
 					return log.Errorf("Unable to write response to downstream: %v", writeErr)
 				}
@@ -218,6 +337,7 @@ func (proxy *proxy) processRequests(ctx filters.Context, remoteAddr string, req
 
 		if err != nil {
 			// We encountered an error on round-tripping, stop now
+			proxy.finishRequest(ctx, rec, err)
 			return err
 		}
 
@@ -225,16 +345,28 @@ func (proxy *proxy) processRequests(ctx filters.Context, remoteAddr string, req
 		upstreamAddr := upstreamAddr(ctx)
 		isConnect := upstream != nil || upstreamAddr != ""
 
-		buffered := downstreamBuffered.Buffered()
-		if buffered > 0 {
-			b, _ := downstreamBuffered.Peek(buffered)
-			downstream = preconn.Wrap(downstream, b)
+		if downstreamBuffered.Buffered() > 0 {
+			// Read the rest through the buffer. Unlike preconn, this doesn't block
+			// on the connection while buffered data is waiting to be piped.
+			downstream = &readerConn{downstream, downstreamBuffered}
 		}
 
 		if isConnect {
-			return proxy.proceedWithConnect(ctx, req, upstreamAddr, upstream, downstream)
+			connectErr := proxy.proceedWithConnect(ctx, req, upstreamAddr, upstream, downstream)
+			releaseTunnel(ctx)
+			proxy.finishRequest(ctx, rec, connectErr)
+			return connectErr
 		}
 
+		if upgraded := upgradedUpstream(ctx); upgraded != nil {
+			defer upgraded.Close()
+			pipeErr := proxy.pipe(ctx, req.Host, upgraded, downstream)
+			proxy.finishRequest(ctx, rec, pipeErr)
+			return pipeErr
+		}
+
+		proxy.finishRequest(ctx, rec, nil)
+
 		if req.Close {
 			// Client signaled that they would close the connection after this
 			// request, finish
@@ -246,13 +378,27 @@ func (proxy *proxy) processRequests(ctx filters.Context, remoteAddr string, req
 			return err
 		}
 
+		if !state.nextRequest() {
+			// The last response ended the connection
+			return err
+		}
+
+		if !proxy.tracker.setActive(ctx, false) {
+			// Shutting down, don't wait for more requests
+			return err
+		}
+
 		// read the next request
-		req, readErr = http.ReadRequest(downstreamBuffered)
+		req, readErr = proxy.readRequest(downstreamBuffered, headers)
+		proxy.tracker.setActive(ctx, true)
 		if readErr != nil {
+			if proxy.rejectInvalidRequest(state, downstream, req, readErr) {
+				return readErr
+			}
 			if isUnexpected(readErr) {
 				errResp := proxy.OnError(ctx, req, true, readErr)
 				if errResp != nil {
-					proxy.writeResponse(downstream, req, errResp)
+					proxy.respond(state, downstream, req, errResp)
 				}
 				return log.Errorf("Unable to read next request from downstream: %v", readErr)
 			}
@@ -316,8 +462,16 @@ func (proxy *proxy) writeResponse(downstream io.Writer, req *http.Request, resp
 		proxy.addIdleKeepAlive(resp.Header)
 	}
 
+	proxy.Metrics.ResponseWritten(req, resp.StatusCode)
 	bout := bufio.NewWriter(out)
-	err := resp.Write(bout)
+	var err error
+	if latency := proxy.flushInterval(resp); latency != 0 {
+		mlw := &maxLatencyWriter{latency: latency, w: bout}
+		err = resp.Write(mlw)
+		mlw.stop()
+	} else {
+		err = resp.Write(bout)
+	}
 	// always try to flush what we have
 	err1 := bout.Flush()
 	// take first error
@@ -333,8 +487,10 @@ func (proxy *proxy) writeResponse(downstream io.Writer, req *http.Request, resp
 	return err
 }
 
-// prepareRequest prepares the request in line with the HTTP spec for proxies.
-func prepareRequest(req *http.Request) *http.Request {
+// prepareRequest prepares the request in line with the HTTP spec for proxies,
+// applying the given ForwardingOptions (if any).
+func prepareRequest(req *http.Request, fo *ForwardingOptions) *http.Request {
+	protoMajor, protoMinor := req.ProtoMajor, req.ProtoMinor
 	req.Proto = "HTTP/1.1"
 	req.ProtoMajor = 1
 	req.ProtoMinor = 1
@@ -366,6 +522,9 @@ func prepareRequest(req *http.Request) *http.Request {
 		req.Header.Set("User-Agent", userAgent)
 	}
 
+	if fo != nil {
+		fo.apply(req, protoMajor, protoMinor, req.URL.Scheme, req.Host)
+	}
 	return req
 }
 
@@ -374,6 +533,17 @@ func prepareResponse(resp *http.Response, belowHTTP11 bool) *http.Response {
 	origHeader := resp.Header
 	resp.Header = make(http.Header)
 	copyHeadersForForwarding(resp.Header, origHeader)
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		// Proxy-Authenticate is hop-by-hop, but it's the whole point of a 407
+		for _, challenge := range origHeader["Proxy-Authenticate"] {
+			resp.Header.Add("Proxy-Authenticate", challenge)
+		}
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// Let the client know which protocol we switched to
+		resp.Header.Set("Connection", "Upgrade")
+		resp.Header.Set("Upgrade", origHeader.Get("Upgrade"))
+	}
 	// Below added due to CoAdvisor test failure
 	if resp.Header.Get("Date") == "" {
 		resp.Header.Set("Date", time.Now().Format(time.RFC850))
@@ -397,18 +567,27 @@ func cloneURL(i *url.URL) *url.URL {
 // copyHeadersForForwarding will copy the headers but filter those that shouldn't be
 // forwarded
 func copyHeadersForForwarding(dst, src http.Header) {
+	// section 14.10 of rfc2616, headers listed in Connection are hop-by-hop too
+	// the slice is short typically, don't bother sort it to speed up lookup
 	var extraHopByHopHeaders []string
+	for _, v := range src["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				extraHopByHopHeaders = append(extraHopByHopHeaders, http.CanonicalHeaderKey(token))
+			}
+		}
+	}
 	for k, vv := range src {
 		switch k {
 		// Skip hop-by-hop headers, ref section 13.5.1 of http://www.ietf.org/rfc/rfc2616.txt
 		case "Connection":
-			// section 14.10 of rfc2616
-			// the slice is short typically, don't bother sort it to speed up lookup
-			extraHopByHopHeaders = vv
 		case "Keep-Alive":
 		case "Proxy-Authenticate":
 		case "Proxy-Authorization":
+		case "Proxy-Connection":
+		case "Te":
 		case "TE":
+		case "Trailer":
 		case "Trailers":
 		case "Transfer-Encoding":
 		case "Upgrade":
@@ -467,6 +646,9 @@ func defaultFilter(ctx filters.Context, req *http.Request, next filters.Next) (*
 }
 
 func defaultOnError(ctx filters.Context, req *http.Request, read bool, err error) *http.Response {
+	if !read && causedBy(err, isCertificateError) {
+		return certificateErrorResponse(err)
+	}
 	return nil
 }
 
@@ -12,7 +12,7 @@ import (
 	"net"
 	"net/http"
 	ht "net/http/httptest"
-	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -39,20 +39,6 @@ const (
 	testHeaderValue     = "true"
 )
 
-func init() {
-	// Clean up certs
-	files, _ := ioutil.ReadDir(".")
-	for _, file := range files {
-		filename := file.Name()
-		if strings.Contains(filename, "serverpk.pem") ||
-			strings.Contains(filename, "servercert.pem") ||
-			strings.Contains(filename, "proxypk.pem") ||
-			strings.Contains(filename, "proxycert.pem") {
-			os.Remove(file.Name())
-		}
-	}
-}
-
 type requestAware struct {
 	net.Conn
 }
@@ -293,6 +279,33 @@ func TestDialFailureCONNECTDontWaitForUpstream(t *testing.T) {
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 }
 
+func TestCONNECTResponseHeaders(t *testing.T) {
+	onResponse := func(req *http.Request, header http.Header) {
+		header.Set("Via", "1.1 testproxy")
+		header.Set("X-Request-Host", req.URL.Host)
+	}
+	for _, dialer := range []mockconn.Dialer{
+		mockconn.SucceedingDialer([]byte{}),
+		mockconn.FailingDialer(errors.New("I don't want to dial")),
+	} {
+		d := dialer
+		p := newProxy(&Opts{
+			OKWaitsForUpstream: true,
+			OnCONNECTResponse:  onResponse,
+			Dial: func(ctx context.Context, isConnect bool, net, addr string) (net.Conn, error) {
+				return d.Dial(net, addr)
+			},
+		})
+		req, _ := http.NewRequest("CONNECT", "http://thehost:123", nil)
+		resp, roundTripErr, _ := roundTrip(p, req, true)
+		if !assert.NoError(t, roundTripErr) {
+			return
+		}
+		assert.Equal(t, "1.1 testproxy", resp.Header.Get("Via"), "Status %d", resp.StatusCode)
+		assert.Equal(t, "thehost:123", resp.Header.Get("X-Request-Host"), "Status %d", resp.StatusCode)
+	}
+}
+
 func TestPanicRecover(t *testing.T) {
 	p := newProxy(&Opts{
 		Filter: filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
@@ -503,13 +516,14 @@ func TestHTTPDownstreamError(t *testing.T) {
 }
 
 func doTest(t *testing.T, requestMethod string, discardFirstRequest bool, okWaitsForUpstream bool, shouldMITM bool) {
-	l, err := tlsdefaults.Listen("localhost:0", "serverpk.pem", "servercert.pem")
+	dir := t.TempDir()
+	l, err := tlsdefaults.Listen("localhost:0", filepath.Join(dir, "serverpk.pem"), filepath.Join(dir, "servercert.pem"))
 	if !assert.NoError(t, err) {
 		return
 	}
 	defer l.Close()
 
-	serverCert, err := keyman.LoadCertificateFromFile("servercert.pem")
+	serverCert, err := keyman.LoadCertificateFromFile(filepath.Join(dir, "servercert.pem"))
 	if !assert.NoError(t, err) {
 		return
 	}
@@ -582,8 +596,8 @@ func doTest(t *testing.T, requestMethod string, discardFirstRequest bool, okWait
 	var mitmOpts *mitm.Opts
 	if shouldMITM {
 		mitmOpts = &mitm.Opts{
-			PKFile:   "proxypk.pem",
-			CertFile: "proxycert.pem",
+			PKFile:   filepath.Join(dir, "proxypk.pem"),
+			CertFile: filepath.Join(dir, "proxycert.pem"),
 			ClientTLSConfig: &tls.Config{
 				RootCAs: serverCert.PoolContainingCert(),
 			},
@@ -887,3 +901,421 @@ func TestPipeliningWithIdleTimingServer(t *testing.T) {
 		assert.Equal(t, http.StatusOK, resp.StatusCode)
 	}
 }
+
+func TestUpstreamPool(t *testing.T) {
+	origin := ht.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	var dials int32
+	p := newProxy(&Opts{
+		MaxIdleUpstreamConnsPerHost: 1,
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return net.Dial(network, addr)
+		},
+	})
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+		resp, roundTripErr, handleErr := roundTrip(p, req, true)
+		if !assert.NoError(t, roundTripErr) || !assert.NoError(t, handleErr) {
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "hello", string(body))
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&dials), "Separate downstream connections should have shared one upstream connection")
+}
+
+func TestWebSocketUpgrade(t *testing.T) {
+	origin := ht.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !isWebSocketUpgrade(req.Header) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		bufrw.Flush()
+		io.Copy(conn, bufrw)
+	}))
+	defer origin.Close()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go newProxy(&Opts{}).Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	if !assert.NoError(t, req.WriteProxy(conn)) {
+		return
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "websocket", resp.Header.Get("Upgrade"))
+
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	echoed := make([]byte, 5)
+	_, err = io.ReadFull(br, echoed)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(echoed))
+}
+
+// newEchoServer starts a TCP server that echoes back whatever it receives.
+func newEchoServer(t *testing.T) net.Listener {
+	origin, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, acceptErr := origin.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return origin
+}
+
+// openTunnel sends a CONNECT for addr to the proxy at proxyAddr and returns
+// the connection along with the proxy's response.
+func openTunnel(t *testing.T, proxyAddr string, addr string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodConnect, "http://"+addr, nil)
+	req.Write(conn)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, resp
+}
+
+func TestShutdown(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	doTestShutdown := func(closeTunnel bool, timeout time.Duration) {
+		p := newProxy(&Opts{OKWaitsForUpstream: true})
+		l, err := net.Listen("tcp", "localhost:0")
+		if !assert.NoError(t, err) {
+			return
+		}
+		serveErr := make(chan error, 1)
+		go func() {
+			serveErr <- p.Serve(l)
+		}()
+
+		tunnel, err := net.Dial("tcp", l.Addr().String())
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer tunnel.Close()
+		req, _ := http.NewRequest(http.MethodConnect, "http://"+origin.Addr().String(), nil)
+		req.Write(tunnel)
+		br := bufio.NewReader(tunnel)
+		resp, err := http.ReadResponse(br, req)
+		if !assert.NoError(t, err) || !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			return
+		}
+
+		idle, err := net.Dial("tcp", l.Addr().String())
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer idle.Close()
+		// give the proxy a chance to start handling the idle connection
+		time.Sleep(50 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		type result struct {
+			drained, aborted int
+			err              error
+		}
+		shutdownResult := make(chan result, 1)
+		go func() {
+			drained, aborted, err := p.Shutdown(ctx)
+			shutdownResult <- result{drained, aborted, err}
+		}()
+
+		assert.Equal(t, ErrShutdown, <-serveErr)
+		_, err = idle.Read(make([]byte, 1))
+		assert.Error(t, err, "Idle connection should have been closed")
+
+		// active tunnel keeps working while draining
+		tunnel.Write([]byte("hello"))
+		echoed := make([]byte, 5)
+		_, err = io.ReadFull(br, echoed)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(echoed))
+
+		if closeTunnel {
+			tunnel.Close()
+			r := <-shutdownResult
+			assert.NoError(t, r.err)
+			assert.Equal(t, 1, r.drained)
+			assert.Equal(t, 0, r.aborted)
+		} else {
+			r := <-shutdownResult
+			assert.Equal(t, context.DeadlineExceeded, r.err)
+			assert.Equal(t, 0, r.drained)
+			assert.Equal(t, 1, r.aborted)
+		}
+	}
+
+	// BidiCopy takes up to a second to notice that the tunnel was closed
+	doTestShutdown(true, 5*time.Second)
+	doTestShutdown(false, 250*time.Millisecond)
+}
+
+func TestTransparent(t *testing.T) {
+	origin := ht.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	var mx sync.Mutex
+	var dialed string
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go newProxy(&Opts{
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			mx.Lock()
+			dialed = addr
+			mx.Unlock()
+			return net.Dial(network, origin.Listener.Addr().String())
+		},
+	}).ServeTransparent(l)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return net.Dial(network, l.Addr().String())
+			},
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	resp, err := client.Get("https://www.example.com/")
+	if !assert.NoError(t, err) {
+		return
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "hello", string(body))
+	mx.Lock()
+	assert.Equal(t, "www.example.com:443", dialed)
+	mx.Unlock()
+
+	hello, err := net.Dial("tcp", l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer hello.Close()
+	hello.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	_, err = hello.Read(make([]byte, 1))
+	assert.Error(t, err, "Non-TLS connection should have been closed")
+}
+
+func TestTunnelIdleTimeout(t *testing.T) {
+	origin, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer origin.Close()
+	go func() {
+		for {
+			conn, acceptErr := origin.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	idled := make(chan string, 1)
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go newProxy(&Opts{
+		IdleTimeout:        250 * time.Millisecond,
+		OKWaitsForUpstream: true,
+		OnTunnelIdle: func(upstreamAddr string) {
+			idled <- upstreamAddr
+		},
+	}).Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	req, _ := http.NewRequest(http.MethodConnect, "http://"+origin.Addr().String(), nil)
+	req.Write(conn)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if !assert.NoError(t, err) || !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+		return
+	}
+
+	select {
+	case addr := <-idled:
+		assert.Equal(t, origin.Addr().String(), addr)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "Tunnel should have idled")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = br.ReadByte()
+	assert.Equal(t, io.EOF, err, "Downstream should have been closed")
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go newProxy(&Opts{
+		OKWaitsForUpstream:      true,
+		ConcurrencyLimit:        1,
+		ConcurrencyQueueTimeout: 100 * time.Millisecond,
+	}).Serve(l)
+
+	first, _, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	second, _, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+	second.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "Tunnel beyond the limit should be rejected")
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	// Closing the first tunnel frees its slot, which a queued tunnel can take
+	// once BidiCopy notices
+	first.Close()
+	var third net.Conn
+	for i := 0; i < 30; i++ {
+		third, _, resp = openTunnel(t, l.Addr().String(), origin.Addr().String())
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+		third.Close()
+	}
+	defer third.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Slot should have been released")
+}
+
+func TestClientTunnelQuota(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	p := newProxy(&Opts{
+		OKWaitsForUpstream: true,
+		ClientTunnelQuota:  1,
+	})
+	go p.Serve(l)
+
+	first, _, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, map[string]int{"127.0.0.1": 1}, p.ActiveTunnelsByClient())
+
+	second, _, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+	second.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "Tunnel beyond the quota should be rejected")
+
+	first.Close()
+	for i := 0; i < 30 && len(p.ActiveTunnelsByClient()) > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Empty(t, p.ActiveTunnelsByClient(), "Closed tunnel should no longer count")
+}
+
+func TestOnTunnelComplete(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	completed := make(chan *TunnelStats, 1)
+	var dialCtx context.Context
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go newProxy(&Opts{
+		OKWaitsForUpstream: true,
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			dialCtx = ctx
+			return net.Dial(network, addr)
+		},
+		OnTunnelComplete: func(ctx context.Context, stats *TunnelStats) {
+			completed <- stats
+		},
+	}).Serve(l)
+
+	conn, br, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+	if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+		conn.Close()
+		return
+	}
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(br, buf)
+	assert.NoError(t, err)
+	live := CurrentTunnelStats(dialCtx)
+	if assert.NotNil(t, live, "Live stats should be available from context") {
+		assert.EqualValues(t, 5, live.BytesUp())
+		assert.EqualValues(t, 5, live.BytesDown())
+	}
+	conn.Close()
+
+	select {
+	case stats := <-completed:
+		assert.Equal(t, origin.Addr().String(), stats.UpstreamAddr)
+		assert.EqualValues(t, 5, stats.BytesUp())
+		assert.EqualValues(t, 5, stats.BytesDown())
+		assert.True(t, stats.Duration > 0)
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnTunnelComplete not called")
+	}
+	assert.Nil(t, CurrentTunnelStats(dialCtx), "Stats should be cleared once the tunnel completes")
+}
@@ -0,0 +1,224 @@
+package proxytest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy"
+)
+
+// Upstream serves the upstream end of a connection that the proxy dialed with
+// a Dialer. If it returns an error, the Dialer reports it with Err.
+type Upstream func(conn net.Conn) error
+
+// Dialer is a fake proxy.DialFunc that connects the proxy to Upstreams in
+// memory instead of dialing real destinations.
+type Dialer struct {
+	mx        sync.Mutex
+	upstreams map[string]Upstream
+	failures  map[string]error
+	fallback  Upstream
+	dialed    []string
+	errs      []error
+	wg        sync.WaitGroup
+}
+
+// NewDialer creates a Dialer that fails to dial any address until told how to
+// handle it.
+func NewDialer() *Dialer {
+	return &Dialer{
+		upstreams: make(map[string]Upstream),
+		failures:  make(map[string]error),
+	}
+}
+
+// Handle serves connections to addr (host:port) with upstream.
+func (d *Dialer) Handle(addr string, upstream Upstream) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	d.upstreams[addr] = upstream
+	delete(d.failures, addr)
+}
+
+// HandleAll serves connections to addresses without their own Upstream with
+// upstream.
+func (d *Dialer) HandleAll(upstream Upstream) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	d.fallback = upstream
+}
+
+// Fail makes dials to addr fail with err.
+func (d *Dialer) Fail(addr string, err error) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	d.failures[addr] = err
+	delete(d.upstreams, addr)
+}
+
+// Dial implements proxy.DialFunc.
+func (d *Dialer) Dial(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+	d.mx.Lock()
+	d.dialed = append(d.dialed, addr)
+	upstream, failure := d.upstreams[addr], d.failures[addr]
+	if upstream == nil && failure == nil {
+		upstream = d.fallback
+	}
+	d.mx.Unlock()
+	if failure != nil {
+		return nil, failure
+	}
+	if upstream == nil {
+		return nil, errors.New("No upstream for %v", addr)
+	}
+	client, server := net.Pipe()
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	remote, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		remote = &net.TCPAddr{}
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer server.Close()
+		if err := upstream(&pipeConn{server, remote, local}); err != nil {
+			d.mx.Lock()
+			d.errs = append(d.errs, errors.New("Upstream %v failed: %v", addr, err))
+			d.mx.Unlock()
+		}
+	}()
+	return &pipeConn{client, local, remote}, nil
+}
+
+// Dialed returns the addresses dialed so far, in order.
+func (d *Dialer) Dialed() []string {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	return append([]string(nil), d.dialed...)
+}
+
+// Err returns the first error returned by an Upstream, if any, after waiting
+// for all Upstreams to finish.
+func (d *Dialer) Err() error {
+	d.wg.Wait()
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	if len(d.errs) == 0 {
+		return nil
+	}
+	return d.errs[0]
+}
+
+var _ proxy.DialFunc = (&Dialer{}).Dial
+
+// Echo is an Upstream that echoes everything it receives.
+func Echo(conn net.Conn) error {
+	_, err := io.Copy(conn, conn)
+	return ignoreClosed(err)
+}
+
+// HTTP returns an Upstream that serves HTTP/1.1 requests with handler.
+func HTTP(handler http.Handler) Upstream {
+	return func(conn net.Conn) error {
+		l := &singleConnListener{conn: conn, closed: make(chan struct{})}
+		server := &http.Server{
+			Handler: handler,
+			ConnState: func(c net.Conn, state http.ConnState) {
+				if state == http.StateClosed || state == http.StateHijacked {
+					l.Close()
+				}
+			},
+		}
+		err := server.Serve(l)
+		if err == errListenerDone {
+			return nil
+		}
+		return err
+	}
+}
+
+// Step is a step of a Script.
+type Step func(conn net.Conn) error
+
+// Expect is a Step that reads len(data) bytes and fails unless they equal
+// data.
+func Expect(data string) Step {
+	return func(conn net.Conn) error {
+		b := make([]byte, len(data))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return errors.New("Unable to read %q: %v", data, err)
+		}
+		if !bytes.Equal(b, []byte(data)) {
+			return errors.New("Expected %q but got %q", data, b)
+		}
+		return nil
+	}
+}
+
+// Send is a Step that writes data.
+func Send(data string) Step {
+	return func(conn net.Conn) error {
+		if _, err := conn.Write([]byte(data)); err != nil {
+			return errors.New("Unable to send %q: %v", data, err)
+		}
+		return nil
+	}
+}
+
+// Script returns an Upstream that runs steps in order and then closes the
+// connection, failing at the first Step that fails.
+func Script(steps ...Step) Upstream {
+	return func(conn net.Conn) error {
+		for _, step := range steps {
+			if err := step(conn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+var errListenerDone = errors.New("Connection done")
+
+// singleConnListener is a net.Listener that accepts a single connection.
+type singleConnListener struct {
+	mx       sync.Mutex
+	conn     net.Conn
+	closed   chan struct{}
+	closeErr sync.Once
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	l.mx.Lock()
+	conn := l.conn
+	l.conn = nil
+	l.mx.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, errListenerDone
+}
+
+func (l *singleConnListener) Close() error {
+	l.closeErr.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return pipeAddr("upstream")
+}
+
+func ignoreClosed(err error) error {
+	if err == io.EOF || err == io.ErrClosedPipe {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+package proxytest
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/getlantern/errors"
+)
+
+var (
+	// ErrClosed is returned by Listener once it's closed.
+	ErrClosed = errors.New("Listener closed")
+)
+
+// Listener is an in-memory net.Listener whose connections are created with
+// Dial, each as the ends of a net.Pipe.
+type Listener struct {
+	nextPort  int32
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewListener creates a Listener.
+func NewListener() *Listener {
+	return &Listener{
+		nextPort: 40000,
+		conns:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Dial connects to the listener from 127.0.0.1, returning the client end of
+// the connection once the server end has been accepted.
+func (l *Listener) Dial() (net.Conn, error) {
+	return l.DialFrom(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(atomic.AddInt32(&l.nextPort, 1))})
+}
+
+// DialFrom is like Dial, but the server end sees from as the remote address
+// of the connection, for example to test access control by client IP.
+func (l *Listener) DialFrom(from net.Addr) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- &pipeConn{server, l.Addr(), from}:
+		return &pipeConn{client, from, l.Addr()}, nil
+	case <-l.closed:
+		client.Close()
+		server.Close()
+		return nil, ErrClosed
+	}
+}
+
+// Accept implements the interface net.Listener
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, ErrClosed
+	}
+}
+
+// Close implements the interface net.Listener
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+// Addr implements the interface net.Listener
+func (l *Listener) Addr() net.Addr {
+	return pipeAddr("proxytest")
+}
+
+// pipeAddr is the address of the listener.
+type pipeAddr string
+
+func (addr pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (addr pipeAddr) String() string {
+	return string(addr)
+}
+
+// pipeConn is an end of a net.Pipe with distinct addresses for both ends.
+type pipeConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (conn *pipeConn) LocalAddr() net.Addr {
+	return conn.local
+}
+
+func (conn *pipeConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
@@ -0,0 +1,125 @@
+// Package proxytest provides an in-memory harness for testing code that uses
+// proxy, like filters, access controls and dialers, without opening real
+// sockets. A Harness serves a Proxy on a Listener whose connections are
+// net.Pipes, and dials upstream with a Dialer that connects to scripted
+// Upstreams.
+//
+//	h, err := proxytest.New(&proxy.Opts{Filter: myFilter})
+//	...
+//	defer h.Close()
+//	h.Dialer.Handle("example.com:80", proxytest.HTTP(handler))
+//	resp, err := h.Client().Get("http://example.com/")
+package proxytest
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy"
+)
+
+// Harness is a Proxy served in memory.
+type Harness struct {
+	// Proxy is the proxy under test
+	Proxy proxy.Proxy
+
+	// Listener is the listener that Proxy serves
+	Listener *Listener
+
+	// Dialer dials upstream for Proxy, unless Opts.Dial was specified
+	Dialer *Dialer
+
+	transport *http.Transport
+	served    chan error
+}
+
+// New creates a Proxy with opts and serves it in memory. Unless opts.Dial is
+// specified, the proxy dials upstream with the Harness' Dialer.
+func New(opts *proxy.Opts) (*Harness, error) {
+	h := &Harness{
+		Listener: NewListener(),
+		Dialer:   NewDialer(),
+		served:   make(chan error, 1),
+	}
+	if opts.Dial == nil {
+		opts.Dial = h.Dialer.Dial
+	}
+	p, err := proxy.New(opts)
+	if err != nil {
+		return nil, errors.New("Unable to create proxy: %v", err)
+	}
+	h.Proxy = p
+	h.transport = &http.Transport{
+		Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: "proxytest"}),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return h.Listener.Dial()
+		},
+	}
+	go func() {
+		h.served <- p.Serve(h.Listener)
+	}()
+	return h, nil
+}
+
+// Dial opens a connection to the proxy.
+func (h *Harness) Dial() (net.Conn, error) {
+	return h.Listener.Dial()
+}
+
+// Client returns an http.Client that sends requests through the proxy.
+func (h *Harness) Client() *http.Client {
+	return &http.Client{Transport: h.transport}
+}
+
+// Connect opens a CONNECT tunnel to addr through the proxy, sending header
+// with the request if it isn't nil. It returns the connection and the
+// proxy's response, whose status may tell that the tunnel was refused. Data
+// sent on the tunnel before the response may be buffered in reader, which
+// should be used to read from the tunnel.
+func (h *Harness) Connect(addr string, header http.Header) (conn net.Conn, reader *bufio.Reader, resp *http.Response, err error) {
+	conn, err = h.Dial()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: addr},
+		Host:   addr,
+		Header: header,
+	}
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	written := make(chan error, 1)
+	go func() {
+		written <- req.Write(conn)
+	}()
+	reader = bufio.NewReader(conn)
+	resp, err = http.ReadResponse(reader, req)
+	if err == nil {
+		err = <-written
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, errors.New("Unable to CONNECT to %v: %v", addr, err)
+	}
+	return conn, reader, resp, nil
+}
+
+// Close shuts the proxy down, waiting up to 5 seconds for open connections to
+// finish, and returns the error of the first Upstream that failed, if any.
+func (h *Harness) Close() error {
+	h.transport.CloseIdleConnections()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h.Proxy.Shutdown(ctx)
+	if err := <-h.served; err != proxy.ErrShutdown {
+		return errors.New("Unable to serve proxy: %v", err)
+	}
+	return h.Dialer.Err()
+}
@@ -0,0 +1,84 @@
+package proxytest
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy"
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTP(t *testing.T) {
+	h, err := New(&proxy.Opts{
+		Filter: filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+			req.Header.Set("X-Filtered", "true")
+			return next(ctx, req)
+		}),
+	})
+	require.NoError(t, err)
+	h.Dialer.Handle("example.com:80", HTTP(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Header.Get("X-Filtered")))
+	})))
+
+	resp, err := h.Client().Get("http://example.com/")
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "true", string(body), "Request should have passed through the filter")
+	assert.Equal(t, []string{"example.com:80"}, h.Dialer.Dialed())
+
+	h.Dialer.Fail("down.example.com:80", errors.New("connection refused"))
+	_, err = h.Client().Get("http://down.example.com/")
+	assert.Error(t, err, "Without OnError, failed requests are closed without a response")
+	assert.Contains(t, h.Dialer.Dialed(), "down.example.com:80")
+	assert.NoError(t, h.Close())
+}
+
+func TestConnect(t *testing.T) {
+	h, err := New(&proxy.Opts{OKWaitsForUpstream: true})
+	require.NoError(t, err)
+	h.Dialer.Handle("example.com:22", Script(Send("SSH-2.0-test\r\n"), Expect("hello")))
+
+	conn, reader, resp, err := h.Connect("example.com:22", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	banner := make([]byte, 14)
+	_, err = io.ReadFull(reader, banner)
+	require.NoError(t, err)
+	assert.Equal(t, "SSH-2.0-test\r\n", string(banner))
+	_, err = conn.Write([]byte("howdy"))
+	require.NoError(t, err)
+	conn.Close()
+	assert.Error(t, h.Close(), "Unexpected data should fail the script")
+}
+
+func TestAccessControl(t *testing.T) {
+	ac, err := proxy.AllowClientCIDRs("10.0.0.0/8")
+	require.NoError(t, err)
+	h, err := New(&proxy.Opts{OKWaitsForUpstream: true, AccessControl: ac})
+	require.NoError(t, err)
+	defer h.Close()
+	h.Dialer.HandleAll(Echo)
+
+	conn, _, resp, err := h.Connect("example.com:443", nil)
+	require.NoError(t, err)
+	conn.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "Loopback client should be denied")
+	assert.Empty(t, h.Dialer.Dialed())
+
+	conn, err = h.Listener.DialFrom(&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234})
+	require.NoError(t, err)
+	defer conn.Close()
+	go conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	b := make([]byte, 12)
+	_, err = io.ReadFull(conn, b)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200", string(b), "Allowed client should get its tunnel")
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+)
+
+// clientTunnels tracks the number of active tunnels per client, where clients
+// are identified by their authenticated identity or else their IP.
+type clientTunnels struct {
+	quota  int
+	mx     sync.Mutex
+	counts map[string]int
+}
+
+func newClientTunnels(quota int) *clientTunnels {
+	return &clientTunnels{quota: quota, counts: make(map[string]int)}
+}
+
+// acquire counts a new tunnel for client, returning a function that releases
+// it (safe to call multiple times), or nil if the client is over quota.
+func (ct *clientTunnels) acquire(client string) func() {
+	ct.mx.Lock()
+	defer ct.mx.Unlock()
+	if ct.quota > 0 && ct.counts[client] >= ct.quota {
+		return nil
+	}
+	ct.counts[client]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ct.mx.Lock()
+			defer ct.mx.Unlock()
+			ct.counts[client]--
+			if ct.counts[client] <= 0 {
+				delete(ct.counts, client)
+			}
+		})
+	}
+}
+
+func (ct *clientTunnels) snapshot() map[string]int {
+	ct.mx.Lock()
+	defer ct.mx.Unlock()
+	result := make(map[string]int, len(ct.counts))
+	for client, count := range ct.counts {
+		result[client] = count
+	}
+	return result
+}
+
+// ActiveTunnelsByClient implements the interface Proxy
+func (proxy *proxy) ActiveTunnelsByClient() map[string]int {
+	return proxy.clientTunnels.snapshot()
+}
+
+// tunnelClient identifies the client of a tunnel for quota purposes.
+func tunnelClient(ctx context.Context, remoteAddr string) string {
+	if identity := AuthenticatedIdentity(ctx); identity != "" {
+		return identity
+	}
+	if ip := clientIPFromAddr(remoteAddr); ip != nil {
+		return ip.String()
+	}
+	if ip := clientIPFromContext(ctx); ip != nil {
+		return ip.String()
+	}
+	return remoteAddr
+}
+
+// limitClientTunnels is a filter that counts CONNECT tunnels per client and
+// responds 429 Too Many Requests once a client reaches ClientTunnelQuota.
+func (proxy *proxy) limitClientTunnels(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+	if req.Method != http.MethodConnect {
+		return next(ctx, req)
+	}
+	client := tunnelClient(ctx, req.RemoteAddr)
+	release := proxy.clientTunnels.acquire(client)
+	if release == nil {
+		log.Debugf("Client %v is over its tunnel quota, rejecting CONNECT to %v", client, req.URL.Host)
+		filters.Discard(ctx, req)
+		return filters.ShortCircuit(ctx, req, &http.Response{
+			StatusCode: http.StatusTooManyRequests,
+		})
+	}
+	return holdUntilTunnelDone(release, next)(ctx, req)
+}
+
+// acquireClientTunnel counts a tunnel that doesn't pass through the HTTP
+// filter chain against the client's quota.
+func (proxy *proxy) acquireClientTunnel(ctx context.Context) (func(), error) {
+	client := tunnelClient(ctx, "")
+	release := proxy.clientTunnels.acquire(client)
+	if release == nil {
+		return nil, &PolicyDeniedError{Phase: PhaseAdmission, Policy: PolicyClientTunnelQuota, Err: errors.New("Client %v is over its tunnel quota", client)}
+	}
+	return release, nil
+}
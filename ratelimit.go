@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+)
+
+// RateLimiter caps the rate at which bytes flow between the proxy and upstream,
+// per connection and/or per client IP, using token buckets. Limits apply
+// separately to each direction.
+type RateLimiter struct {
+	perConnection int
+	perClientIP   int
+
+	mx      sync.Mutex
+	clients map[string]*clientBuckets
+}
+
+type clientBuckets struct {
+	up   *tokenBucket
+	down *tokenBucket
+	refs int
+}
+
+// NewRateLimiter creates a RateLimiter that limits each connection to
+// perConnection bytes per second and all connections from the same client IP
+// to perClientIP bytes per second. A limit of 0 means unlimited.
+func NewRateLimiter(perConnection int, perClientIP int) *RateLimiter {
+	return &RateLimiter{
+		perConnection: perConnection,
+		perClientIP:   perClientIP,
+		clients:       make(map[string]*clientBuckets),
+	}
+}
+
+// wrap wraps the given upstream connection so that reads and writes are
+// throttled according to this RateLimiter's limits for the client in ctx.
+func (rl *RateLimiter) wrap(ctx context.Context, conn net.Conn) net.Conn {
+	tc := &throttledConn{Conn: conn, rl: rl}
+	if rl.perConnection > 0 {
+		tc.up = append(tc.up, newTokenBucket(rl.perConnection))
+		tc.down = append(tc.down, newTokenBucket(rl.perConnection))
+	}
+	if rl.perClientIP > 0 {
+		if ip := clientIPFromContext(ctx); ip != nil {
+			tc.clientIP = ip.String()
+			cb := rl.acquire(tc.clientIP)
+			tc.up = append(tc.up, cb.up)
+			tc.down = append(tc.down, cb.down)
+		}
+	}
+	if len(tc.up) == 0 {
+		return conn
+	}
+	return tc
+}
+
+func (rl *RateLimiter) acquire(clientIP string) *clientBuckets {
+	rl.mx.Lock()
+	defer rl.mx.Unlock()
+	cb := rl.clients[clientIP]
+	if cb == nil {
+		cb = &clientBuckets{
+			up:   newTokenBucket(rl.perClientIP),
+			down: newTokenBucket(rl.perClientIP),
+		}
+		rl.clients[clientIP] = cb
+	}
+	cb.refs++
+	return cb
+}
+
+func (rl *RateLimiter) release(clientIP string) {
+	rl.mx.Lock()
+	defer rl.mx.Unlock()
+	cb := rl.clients[clientIP]
+	if cb == nil {
+		return
+	}
+	cb.refs--
+	if cb.refs <= 0 {
+		delete(rl.clients, clientIP)
+	}
+}
+
+// clientIPFromContext returns the IP of the downstream connection associated
+// with ctx, if any.
+func clientIPFromContext(ctx context.Context) net.IP {
+	downstream := clientConnFromContext(ctx)
+	if downstream == nil {
+		return nil
+	}
+	return connClientIP(downstream)
+}
+
+// clientConnFromContext returns the downstream connection associated with ctx,
+// either by withClientConn or as a filters.Context, if any.
+func clientConnFromContext(ctx context.Context) net.Conn {
+	if downstream, ok := ctx.Value(ctxKeyClientConn).(net.Conn); ok {
+		return downstream
+	}
+	return filters.AdaptContext(ctx).DownstreamConn()
+}
+
+// withClientConn associates downstream with ctx for code that identifies
+// clients before a filters.Context exists, like authentication of SOCKS5 and
+// HandleCONNECT.
+func withClientConn(ctx context.Context, downstream net.Conn) context.Context {
+	return context.WithValue(ctx, ctxKeyClientConn, downstream)
+}
+
+// tokenBucket is a token bucket holding up to one second's worth of tokens.
+type tokenBucket struct {
+	mx     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSecond int) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// burst returns the maximum number of bytes that can be taken at once.
+func (b *tokenBucket) burst() int {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return int(b.rate)
+}
+
+// setRate changes the rate of the bucket, 0 meaning that take doesn't wait.
+func (b *tokenBucket) setRate(bytesPerSecond int) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	b.rate = float64(bytesPerSecond)
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+// take takes n tokens from the bucket, sleeping until they're available.
+// Tokens are reserved immediately (the bucket may go negative) so that
+// concurrent takers are served in order.
+func (b *tokenBucket) take(n int) {
+	b.mx.Lock()
+	if b.rate <= 0 {
+		b.mx.Unlock()
+		return
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mx.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// throttledConn is an upstream connection whose reads and writes are
+// throttled by token buckets.
+type throttledConn struct {
+	net.Conn
+	rl       *RateLimiter
+	clientIP string
+	up       []*tokenBucket
+	down     []*tokenBucket
+
+	closeOnce sync.Once
+}
+
+func (conn *throttledConn) Read(b []byte) (int, error) {
+	if max := minBurst(conn.down); len(b) > max {
+		b = b[:max]
+	}
+	n, err := conn.Conn.Read(b)
+	for _, bucket := range conn.down {
+		bucket.take(n)
+	}
+	return n, err
+}
+
+func (conn *throttledConn) Write(b []byte) (int, error) {
+	max := minBurst(conn.up)
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		for _, bucket := range conn.up {
+			bucket.take(len(chunk))
+		}
+		n, err := conn.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (conn *throttledConn) Close() error {
+	conn.closeOnce.Do(func() {
+		if conn.clientIP != "" {
+			conn.rl.release(conn.clientIP)
+		}
+	})
+	return conn.Conn.Close()
+}
+
+func (conn *throttledConn) Wrapped() net.Conn {
+	return conn.Conn
+}
+
+func minBurst(buckets []*tokenBucket) int {
+	max := 0
+	for _, bucket := range buckets {
+		if burst := bucket.burst(); max == 0 || burst < max {
+			max = burst
+		}
+	}
+	if max < 1 {
+		max = 1
+	}
+	return max
+}
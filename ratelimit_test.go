@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(10000)
+	start := time.Now()
+	b.take(10000)
+	assert.True(t, time.Since(start) < 50*time.Millisecond, "Full bucket shouldn't block")
+	b.take(2000)
+	assert.True(t, time.Since(start) >= 180*time.Millisecond, "Empty bucket should block until refilled")
+}
+
+func TestRateLimiterPerClient(t *testing.T) {
+	rl := NewRateLimiter(0, 10000)
+	client, _ := net.Pipe()
+	ctx := filters.WrapContext(context.Background(), &fixedRemoteAddrConn{client, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}})
+
+	up1, down1 := net.Pipe()
+	up2, down2 := net.Pipe()
+	conn1 := rl.wrap(ctx, up1)
+	conn2 := rl.wrap(ctx, up2)
+	assert.Len(t, rl.clients, 1, "Both connections should share the client's bucket")
+
+	go io.Copy(ioutil.Discard, down1)
+	go io.Copy(ioutil.Discard, down2)
+	start := time.Now()
+	conn1.Write(make([]byte, 10000))
+	conn2.Write(make([]byte, 3000))
+	assert.True(t, time.Since(start) >= 250*time.Millisecond, "Second write should have been throttled by shared bucket")
+
+	conn1.Close()
+	assert.Len(t, rl.clients, 1)
+	conn2.Close()
+	assert.Empty(t, rl.clients, "Buckets should be released once the client's connections are closed")
+}
+
+type fixedRemoteAddrConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (conn *fixedRemoteAddrConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
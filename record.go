@@ -0,0 +1,337 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+)
+
+// maxRecordedBody is the largest request or response body that's recorded.
+// Interactions with larger bodies aren't recorded.
+const maxRecordedBody = 10 * 1024 * 1024
+
+// Interaction is a request and its response as recorded by NewRecordingFilter.
+// Cassettes are streams of Interactions in JSON, one per line.
+type Interaction struct {
+	Request  *RecordedMessage `json:"request"`
+	Response *RecordedMessage `json:"response"`
+}
+
+// RecordedMessage is a recorded request or response.
+type RecordedMessage struct {
+	// Method and URL are only set for requests
+	Method string `json:"method,omitempty"`
+	URL    string `json:"url,omitempty"`
+
+	// StatusCode is only set for responses
+	StatusCode int `json:"status,omitempty"`
+
+	Header http.Header `json:"header"`
+
+	// Body is the body as sent, so it may be compressed. Unless it's valid
+	// UTF-8, it's base64 encoded and BodyEncoding is "base64".
+	Body         string `json:"body"`
+	BodyEncoding string `json:"bodyEncoding,omitempty"`
+}
+
+func newRecordedBody(msg *RecordedMessage, body []byte) {
+	if utf8.Valid(body) {
+		msg.Body = string(body)
+	} else {
+		msg.Body = base64.StdEncoding.EncodeToString(body)
+		msg.BodyEncoding = "base64"
+	}
+}
+
+func (msg *RecordedMessage) body() ([]byte, error) {
+	if msg.BodyEncoding == "base64" {
+		return base64.StdEncoding.DecodeString(msg.Body)
+	}
+	return []byte(msg.Body), nil
+}
+
+// NewRecordingFilter returns a Filter that records forwarded requests, including
+// those in MITM'ed tunnels, along with their responses to w as a cassette,
+// see Interaction. Each Interaction is written once its response body has
+// been read in full, so ones whose client gave up early aren't recorded.
+// CONNECT requests and upgrades aren't recorded either. ReplayDial serves the
+// recorded responses.
+func NewRecordingFilter(w io.Writer) filters.Filter {
+	rec := &recorder{enc: json.NewEncoder(w)}
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		if req.Method == http.MethodConnect {
+			return next(ctx, req)
+		}
+		interaction := &Interaction{Request: &RecordedMessage{
+			Method: req.Method,
+			URL:    req.URL.String(),
+			Header: req.Header.Clone(),
+		}}
+		reqBody := &recordedBody{}
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = &teeBody{ReadCloser: req.Body, recorded: reqBody, length: -1}
+		}
+		resp, nextCtx, err := next(ctx, req)
+		if err != nil || resp == nil || resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, nextCtx, err
+		}
+		interaction.Response = &RecordedMessage{
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header.Clone(),
+		}
+		respBody := &recordedBody{}
+		done := func() {
+			rec.write(interaction, reqBody, respBody)
+		}
+		if resp.Body == nil || resp.Body == http.NoBody {
+			done()
+		} else {
+			resp.Body = &teeBody{ReadCloser: resp.Body, recorded: respBody, length: resp.ContentLength, onEOF: done}
+		}
+		return resp, nextCtx, nil
+	})
+}
+
+type recorder struct {
+	mx  sync.Mutex
+	enc *json.Encoder
+}
+
+func (rec *recorder) write(interaction *Interaction, reqBody *recordedBody, respBody *recordedBody) {
+	req, reqOK := reqBody.get()
+	resp, respOK := respBody.get()
+	if !reqOK || !respOK {
+		log.Debugf("Not recording %v %v with a body over %d bytes", interaction.Request.Method, interaction.Request.URL, maxRecordedBody)
+		return
+	}
+	newRecordedBody(interaction.Request, req)
+	newRecordedBody(interaction.Response, resp)
+	rec.mx.Lock()
+	defer rec.mx.Unlock()
+	if err := rec.enc.Encode(interaction); err != nil {
+		log.Errorf("Unable to record %v %v: %v", interaction.Request.Method, interaction.Request.URL, err)
+	}
+}
+
+// recordedBody collects a body as it's read, possibly from another goroutine
+// than the one recording it.
+type recordedBody struct {
+	mx       sync.Mutex
+	buf      bytes.Buffer
+	tooLarge bool
+}
+
+func (rb *recordedBody) add(b []byte) {
+	rb.mx.Lock()
+	defer rb.mx.Unlock()
+	if rb.tooLarge || rb.buf.Len()+len(b) > maxRecordedBody {
+		rb.tooLarge = true
+		rb.buf.Reset()
+		return
+	}
+	rb.buf.Write(b)
+}
+
+func (rb *recordedBody) get() ([]byte, bool) {
+	rb.mx.Lock()
+	defer rb.mx.Unlock()
+	return append([]byte(nil), rb.buf.Bytes()...), !rb.tooLarge
+}
+
+// teeBody records what's read from a body, calling onEOF once it's been read
+// in full. Since readers of bodies with a known length may stop short of
+// reading EOF, having read length bytes counts as well once it's closed.
+type teeBody struct {
+	io.ReadCloser
+	recorded *recordedBody
+	length   int64
+	read     int64
+	onEOF    func()
+	once     sync.Once
+}
+
+func (tb *teeBody) Read(b []byte) (int, error) {
+	n, err := tb.ReadCloser.Read(b)
+	if n > 0 {
+		tb.recorded.add(b[:n])
+		tb.read += int64(n)
+	}
+	if err == io.EOF {
+		tb.eof()
+	}
+	return n, err
+}
+
+func (tb *teeBody) Close() error {
+	if tb.length >= 0 && tb.read == tb.length {
+		tb.eof()
+	}
+	return tb.ReadCloser.Close()
+}
+
+func (tb *teeBody) eof() {
+	if tb.onEOF != nil {
+		tb.once.Do(tb.onEOF)
+	}
+}
+
+// LoadCassette reads the Interactions recorded by NewRecordingFilter from r.
+func LoadCassette(r io.Reader) ([]*Interaction, error) {
+	var interactions []*Interaction
+	dec := json.NewDecoder(r)
+	for {
+		interaction := &Interaction{}
+		err := dec.Decode(interaction)
+		if err == io.EOF {
+			return interactions, nil
+		}
+		if err != nil {
+			return nil, errors.New("Unable to read interaction %d: %v", len(interactions)+1, err)
+		}
+		if interaction.Request == nil || interaction.Response == nil {
+			return nil, errors.New("Interaction %d is incomplete", len(interactions)+1)
+		}
+		interactions = append(interactions, interaction)
+	}
+}
+
+// ReplayDial returns a DialFunc that serves the responses of interactions
+// instead of dialing upstream, for deterministic tests of clients behind the
+// proxy. Requests are matched to interactions by method, host and request
+// URI. Interactions with the same match are replayed in order, the last one
+// repeating once they're used up. Requests without a match are answered with
+// 502 Bad Gateway, and destinations without any interactions fail to dial.
+// MITM'ed tunnels are replayed as plain HTTP, without originating TLS.
+func ReplayDial(interactions []*Interaction) DialFunc {
+	r := &replayer{interactions: make(map[string][]*Interaction), hosts: make(map[string]bool)}
+	for _, interaction := range interactions {
+		key, host, err := interactionKey(interaction.Request.Method, interaction.Request.URL)
+		if err != nil {
+			log.Debugf("Unable to replay interaction: %v", err)
+			continue
+		}
+		r.interactions[key] = append(r.interactions[key], interaction)
+		r.hosts[host] = true
+	}
+	return r.dial
+}
+
+type replayer struct {
+	mx           sync.Mutex
+	interactions map[string][]*Interaction
+	hosts        map[string]bool
+}
+
+// interactionKey returns the key by which a request for rawurl is matched, as
+// well as its host.
+func interactionKey(method string, rawurl string) (string, string, error) {
+	req, err := http.NewRequest(method, rawurl, nil)
+	if err != nil {
+		return "", "", errors.New("Invalid URL %v: %v", rawurl, err)
+	}
+	return requestKey(req, req.URL.Host), replayHost(req.URL.Host), nil
+}
+
+func requestKey(req *http.Request, host string) string {
+	return req.Method + " " + replayHost(host) + req.URL.RequestURI()
+}
+
+// replayHost is host without its port if it's a default one.
+func replayHost(host string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(host), ":80"), ":443")
+}
+
+func (r *replayer) dial(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+	if !r.hosts[replayHost(addr)] {
+		return nil, errors.New("No recorded interactions for %v", addr)
+	}
+	client, server := net.Pipe()
+	go r.serve(server)
+	return &replayConn{client}, nil
+}
+
+// next returns the next interaction for key, if any.
+func (r *replayer) next(key string) *Interaction {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	interactions := r.interactions[key]
+	if len(interactions) == 0 {
+		return nil
+	}
+	if len(interactions) > 1 {
+		r.interactions[key] = interactions[1:]
+	}
+	return interactions[0]
+}
+
+func (r *replayer) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, req.Body)
+		req.Body.Close()
+		resp := r.respond(req)
+		if err := resp.Write(conn); err != nil || req.Close {
+			return
+		}
+	}
+}
+
+func (r *replayer) respond(req *http.Request) *http.Response {
+	key := requestKey(req, req.Host)
+	interaction := r.next(key)
+	var body []byte
+	var err error
+	if interaction != nil {
+		body, err = interaction.Response.body()
+	}
+	if interaction == nil || err != nil {
+		body = []byte(fmt.Sprintf("No recorded response for %v\n", key))
+		return &http.Response{
+			StatusCode:    http.StatusBadGateway,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}},
+			Body:          ioutil.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+		}
+	}
+	header := interaction.Response.Header.Clone()
+	header.Del("Content-Length")
+	header.Del("Transfer-Encoding")
+	return &http.Response{
+		StatusCode:    interaction.Response.StatusCode,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// replayConn is a connection to a replayer, on which the mitm package
+// shouldn't originate TLS.
+type replayConn struct {
+	net.Conn
+}
+
+// MITMSkipEncryption implements the marker interface of the mitm package
+func (conn *replayConn) MITMSkipEncryption() {}
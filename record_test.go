@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	ht "net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lockedBuffer is a bytes.Buffer that's safe for concurrent use.
+type lockedBuffer struct {
+	mx  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.String()
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	hits := 0
+	origin := ht.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hits++
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("X-Hits", strings.Repeat("x", hits))
+		switch req.URL.Path {
+		case "/binary":
+			w.Write([]byte{0xff, 0xfe, 0x00})
+		case "/empty":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Write([]byte(req.Method + " " + string(body)))
+		}
+	}))
+	defer origin.Close()
+
+	cassette := &lockedBuffer{}
+	l := serveProxy(t, &Opts{Filter: NewRecordingFilter(cassette)})
+	defer l.Close()
+	for _, path := range []string{"/", "/", "/binary", "/empty"} {
+		resp, err := proxiedRequest(t, l.Addr().String(), http.MethodGet, origin.URL+path)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	resp, err := proxiedRequest(t, l.Addr().String(), http.MethodPost, origin.URL+"/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Eventually(t, func() bool {
+		return strings.Count(cassette.String(), "\n") == 5
+	}, 5*time.Second, 10*time.Millisecond)
+
+	interactions, err := LoadCassette(strings.NewReader(cassette.String()))
+	require.NoError(t, err)
+	require.Len(t, interactions, 5)
+	byPath := make(map[string]*Interaction)
+	for _, interaction := range interactions {
+		byPath[interaction.Request.Method+" "+interaction.Request.URL] = interaction
+	}
+	post := byPath["POST "+origin.URL+"/"]
+	require.NotNil(t, post)
+	assert.Equal(t, "data", post.Request.Body)
+	assert.Equal(t, "POST data", post.Response.Body)
+	binary := byPath["GET "+origin.URL+"/binary"]
+	require.NotNil(t, binary)
+	assert.Equal(t, "base64", binary.Response.BodyEncoding)
+	origin.Close()
+
+	replay := ReplayDial(interactions)
+	l = serveProxy(t, &Opts{Dial: replay})
+	defer l.Close()
+	proxyURL, _ := url.Parse("http://" + l.Addr().String())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true}}
+	get := func(path string) (*http.Response, string) {
+		resp, err := client.Get(origin.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+	resp, body := get("/")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "GET ", body)
+	assert.Equal(t, "x", resp.Header.Get("X-Hits"))
+	resp, _ = get("/")
+	assert.Equal(t, "xx", resp.Header.Get("X-Hits"), "Interactions should be replayed in order")
+	resp, _ = get("/")
+	assert.Equal(t, "xx", resp.Header.Get("X-Hits"), "Last interaction should repeat")
+	_, body = get("/binary")
+	assert.Equal(t, string([]byte{0xff, 0xfe, 0x00}), body)
+	resp, _ = get("/empty")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, body = get("/unknown")
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Contains(t, body, "No recorded response for GET")
+
+	_, err = replay(context.Background(), false, "tcp", "example.com:80")
+	assert.Error(t, err, "Destinations without interactions shouldn't be dialed")
+}
+
+func TestLoadCassetteInvalid(t *testing.T) {
+	_, err := LoadCassette(strings.NewReader("{\"request\":{\"method\":\"GET\"}}\n"))
+	assert.Error(t, err)
+	_, err = LoadCassette(strings.NewReader("not json"))
+	assert.Error(t, err)
+	interactions, err := LoadCassette(strings.NewReader(""))
+	assert.NoError(t, err)
+	assert.Empty(t, interactions)
+}
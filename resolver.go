@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	dnsMessageContentType = "application/dns-message"
+	maxDNSMessageSize     = 65535
+)
+
+// Resolver resolves hostnames to IP addresses. *net.Resolver implements this.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// ResolverFunc adapts a function to a Resolver
+type ResolverFunc func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+// LookupIPAddr implements the interface Resolver
+func (f ResolverFunc) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return f(ctx, host)
+}
+
+// NewDoTResolver returns a Resolver that sends queries using DNS over TLS
+// (RFC 7858) to the server at addr (e.g. "1.1.1.1:853"). If tlsConfig is nil,
+// the server's certificate is verified against the host in addr.
+func NewDoTResolver(addr string, tlsConfig *tls.Config) Resolver {
+	if tlsConfig == nil {
+		host, _, _ := net.SplitHostPort(addr)
+		tlsConfig = &tls.Config{ServerName: host}
+	}
+	dialer := &net.Dialer{}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			// Since this isn't a net.PacketConn, the resolver uses TCP framing
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+			return tls.Client(conn, tlsConfig), nil
+		},
+	}
+}
+
+// NewDoHResolver returns a Resolver that sends queries using DNS over HTTPS
+// (RFC 8484) to the given URL (e.g. "https://cloudflare-dns.com/dns-query").
+// If client is nil, http.DefaultClient is used.
+func NewDoHResolver(url string, client *http.Client) Resolver {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &dohResolver{url: url, client: client}
+}
+
+type dohResolver struct {
+	url    string
+	client *http.Client
+}
+
+func (r *dohResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	type result struct {
+		ips []net.IPAddr
+		err error
+	}
+	results := make(chan result, 2)
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		go func(qtype uint16) {
+			ips, err := r.query(ctx, host, qtype)
+			results <- result{ips, err}
+		}(qtype)
+	}
+
+	var ips []net.IPAddr
+	var firstErr error
+	for i := 0; i < 2; i++ {
+		res := <-results
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue
+		}
+		ips = append(ips, res.ips...)
+	}
+	if len(ips) == 0 {
+		if firstErr == nil {
+			firstErr = errors.New("No addresses found for %v", host)
+		}
+		return nil, firstErr
+	}
+	return ips, nil
+}
+
+func (r *dohResolver) query(ctx context.Context, host string, qtype uint16) ([]net.IPAddr, error) {
+	query, err := buildDNSQuery(host, qtype)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, r.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, errors.New("Unable to build DoH request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", dnsMessageContentType)
+	req.Header.Set("Accept", dnsMessageContentType)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, errors.New("Unable to query %v: %v", r.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Unexpected DoH response status from %v: %v", r.url, resp.Status)
+	}
+	msg, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDNSMessageSize))
+	if err != nil {
+		return nil, errors.New("Unable to read DoH response from %v: %v", r.url, err)
+	}
+	return parseDNSResponse(host, msg)
+}
+
+// NewCachingResolver returns a Resolver that caches successful lookups by
+// wrapped for the given ttl.
+func NewCachingResolver(wrapped Resolver, ttl time.Duration) Resolver {
+	return &cachingResolver{
+		wrapped: wrapped,
+		ttl:     ttl,
+		cache:   make(map[string]*cachedIPs),
+	}
+}
+
+type cachingResolver struct {
+	wrapped Resolver
+	ttl     time.Duration
+	mx      sync.Mutex
+	cache   map[string]*cachedIPs
+}
+
+type cachedIPs struct {
+	ips     []net.IPAddr
+	expires time.Time
+}
+
+func (r *cachingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	now := time.Now()
+	r.mx.Lock()
+	cached := r.cache[host]
+	r.mx.Unlock()
+	if cached != nil && now.Before(cached.expires) {
+		return cached.ips, nil
+	}
+
+	ips, err := r.wrapped.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	r.mx.Lock()
+	r.cache[host] = &cachedIPs{ips: ips, expires: now.Add(r.ttl)}
+	r.mx.Unlock()
+	return ips, nil
+}
+
+// lookupIPs resolves host using the configured Resolver (or the default
+// resolver), applying ResolveTimeout.
+func (opts *Opts) lookupIPs(ctx context.Context, host string) ([]net.IP, error) {
+	resolver := opts.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	if opts.ResolveTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.ResolveTimeout)
+		defer cancel()
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("No addresses found for %v", host)
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+// resolveAddr resolves the host in addr to the IPs that access control checked
+// it at, if it did, and otherwise using the configured Resolver, or the
+// default resolver if trying alternate addresses. Otherwise, or if the host is
+// already an IP, addrs is just addr.
+func (opts *Opts) resolveAddr(ctx context.Context, addr string) (addrs []string, err error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return []string{addr}, nil
+	}
+	ips := resolvedIPsFor(ctx, host)
+	if ips == nil {
+		if opts.Resolver == nil && !opts.TryAlternateAddrs {
+			return []string{addr}, nil
+		}
+		ips, err = opts.lookupIPs(ctx, host)
+		if err != nil {
+			return nil, errors.New("Unable to resolve %v: %v", host, err)
+		}
+	}
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	return addrs, nil
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	ht "net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/mockconn"
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoHResolver(t *testing.T) {
+	server := ht.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query, _ := ioutil.ReadAll(req.Body)
+		question := query[dnsHeaderLen:]
+		qtype := binary.BigEndian.Uint16(question[len(question)-4:])
+
+		resp := make([]byte, dnsHeaderLen)
+		binary.BigEndian.PutUint16(resp[2:], 0x8180)
+		binary.BigEndian.PutUint16(resp[4:], 1)
+		resp = append(resp, question...)
+		if qtype == dnsTypeA {
+			binary.BigEndian.PutUint16(resp[6:], 1)
+			resp = append(resp, 0xc0, dnsHeaderLen, 0, dnsTypeA, 0, dnsClassIN, 0, 0, 0, 60, 0, 4, 93, 184, 216, 34)
+		}
+		w.Header().Set("Content-Type", dnsMessageContentType)
+		w.Write(resp)
+	}))
+	defer server.Close()
+
+	ips, err := NewDoHResolver(server.URL, nil).LookupIPAddr(context.Background(), "example.com")
+	if assert.NoError(t, err) && assert.Len(t, ips, 1) {
+		assert.Equal(t, "93.184.216.34", ips[0].IP.String())
+	}
+}
+
+func TestResolverDial(t *testing.T) {
+	var mx sync.Mutex
+	lookups := 0
+	resolver := NewCachingResolver(ResolverFunc(func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		mx.Lock()
+		lookups++
+		mx.Unlock()
+		return []net.IPAddr{{IP: net.ParseIP("10.1.2.3")}}, nil
+	}), time.Minute)
+
+	d := mockconn.SucceedingDialer([]byte{})
+	p := newProxy(&Opts{
+		OKWaitsForUpstream: true,
+		Resolver:           resolver,
+		Dial: func(ctx context.Context, isConnect bool, net, addr string) (net.Conn, error) {
+			return d.Dial(net, addr)
+		},
+	})
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("CONNECT", "http://thehost:443", nil)
+		_, roundTripErr, _ := roundTrip(p, req, true)
+		assert.NoError(t, roundTripErr)
+		assert.Equal(t, "10.1.2.3:443", d.LastDialed(), "Should have dialed the resolved IP")
+	}
+	mx.Lock()
+	assert.Equal(t, 1, lookups, "Second lookup should have been cached")
+	mx.Unlock()
+}
+
+func TestTryAlternateAddrs(t *testing.T) {
+	resolver := ResolverFunc(func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("10.0.0.2")}, {IP: net.ParseIP("10.0.0.3")}}, nil
+	})
+	var mx sync.Mutex
+	var attempts []string
+	var dialed string
+	succeedOn := "10.0.0.3:443"
+	p := newProxy(&Opts{
+		OKWaitsForUpstream: true,
+		Resolver:           resolver,
+		TryAlternateAddrs:  true,
+		DialAttemptTimeout: time.Second,
+		Dial: func(ctx context.Context, isConnect bool, network, addr string) (net.Conn, error) {
+			mx.Lock()
+			attempts = append(attempts, addr)
+			mx.Unlock()
+			if addr != succeedOn {
+				return nil, errors.New("unreachable")
+			}
+			return mockconn.SucceedingDialer([]byte{}).Dial(network, addr)
+		},
+		Filter: filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+			resp, nextCtx, err := next(ctx, req)
+			mx.Lock()
+			dialed = DialedAddr(nextCtx)
+			mx.Unlock()
+			return resp, nextCtx, err
+		}),
+	})
+
+	req, _ := http.NewRequest("CONNECT", "http://thehost:443", nil)
+	resp, roundTripErr, _ := roundTrip(p, req, true)
+	if assert.NoError(t, roundTripErr) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	mx.Lock()
+	assert.Equal(t, []string{"10.0.0.1:443", "10.0.0.2:443", "10.0.0.3:443"}, attempts)
+	assert.Equal(t, "10.0.0.3:443", dialed)
+	attempts = nil
+	mx.Unlock()
+
+	succeedOn = ""
+	resp, roundTripErr, _ = roundTrip(p, req, true)
+	if assert.NoError(t, roundTripErr) {
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	}
+	mx.Lock()
+	assert.Len(t, attempts, 3)
+	mx.Unlock()
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	defaultMaxRetries = 2
+
+	ctxKeyFailedAddrs = contextKey("failedAddrs")
+)
+
+// roundTripWithRetries round-trips req, retrying idempotent requests without a
+// body if upstream couldn't be dialed or reset the connection before
+// responding. Retries avoid the resolved addresses that failed to dial, so
+// with TryAlternateAddrs they move on to the next address, and otherwise they
+// get a fresh (or another pooled) connection.
+func (proxy *proxy) roundTripWithRetries(req *http.Request, roundTrip func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	retries := proxy.maxRetries()
+	if retries == 0 || !isRetryable(req) {
+		return roundTrip(req)
+	}
+	req = req.WithContext(context.WithValue(req.Context(), ctxKeyFailedAddrs, &failedAddrs{}))
+	for attempt := 0; ; attempt++ {
+		resp, err := roundTrip(req)
+		if err == nil || attempt == retries || req.Context().Err() != nil || !isRetryableError(err) {
+			return resp, err
+		}
+		log.Debugf("Retrying %v %v after failed attempt %d: %v", req.Method, req.URL, attempt+1, err)
+	}
+}
+
+func (proxy *proxy) maxRetries() int {
+	switch {
+	case proxy.DisableRetries:
+		return 0
+	case proxy.MaxRetries > 0:
+		return proxy.MaxRetries
+	default:
+		return defaultMaxRetries
+	}
+}
+
+// isRetryable indicates whether req can safely be sent again, i.e. it's
+// idempotent and has no body that might have been consumed already.
+func isRetryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+// isRetryableError indicates whether a failed round trip might succeed if
+// tried again: dials that failed (but didn't time out) and connections that
+// upstream dropped without responding.
+func isRetryableError(err error) bool {
+	if causedBy(err, isTimeout) || causedBy(err, isCertificateError) {
+		return false
+	}
+	return causedBy(err, func(cause error) bool {
+		if dialErr, ok := cause.(*DialError); ok {
+			return dialErr.Phase == PhaseDial
+		}
+		return cause == io.EOF || cause == io.ErrUnexpectedEOF || cause == syscall.ECONNRESET
+	}) || isConnectionDropped(err)
+}
+
+// isConnectionDropped recognizes errors from net/http that don't carry their
+// cause.
+func isConnectionDropped(err error) bool {
+	text := err.Error()
+	return strings.HasSuffix(text, "EOF") ||
+		strings.Contains(text, "connection reset by peer") ||
+		strings.Contains(text, "server closed idle connection")
+}
+
+// failedAddrs tracks the resolved addresses that failed to dial while
+// retrying a request.
+type failedAddrs struct {
+	mx    sync.Mutex
+	addrs map[string]bool
+}
+
+func (fa *failedAddrs) add(addr string) {
+	fa.mx.Lock()
+	defer fa.mx.Unlock()
+	if fa.addrs == nil {
+		fa.addrs = make(map[string]bool)
+	}
+	fa.addrs[addr] = true
+}
+
+// isRetry indicates whether ctx belongs to a retry of a request whose earlier
+// attempt failed to dial, which shouldn't be failed for that same reason.
+func isRetry(ctx context.Context) bool {
+	failed, _ := ctx.Value(ctxKeyFailedAddrs).(*failedAddrs)
+	if failed == nil {
+		return false
+	}
+	failed.mx.Lock()
+	defer failed.mx.Unlock()
+	return len(failed.addrs) > 0
+}
+
+// without returns addrs without the failed ones, unless all of them failed.
+func (fa *failedAddrs) without(addrs []string) []string {
+	fa.mx.Lock()
+	defer fa.mx.Unlock()
+	remaining := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if !fa.addrs[addr] {
+			remaining = append(remaining, addr)
+		}
+	}
+	if len(remaining) == 0 {
+		return addrs
+	}
+	return remaining
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newResettingServer returns a server that resets the first failures
+// connections after reading their request and responds OK on the others.
+func newResettingServer(t *testing.T, failures int32) (net.Listener, *int32) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	var accepted int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			n := atomic.AddInt32(&accepted, 1)
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				if n <= failures {
+					conn.(*net.TCPConn).SetLinger(0)
+					return
+				}
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok"))
+			}()
+		}
+	}()
+	return l, &accepted
+}
+
+// proxiedRequest sends a request through the proxy at proxyAddr, failing if
+// the proxy closes the connection without responding, as it does when
+// forwarding fails.
+func proxiedRequest(t *testing.T, proxyAddr string, method string, url string) (*http.Response, error) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	req, _ := http.NewRequest(method, url, nil)
+	if method == http.MethodPost {
+		req, _ = http.NewRequest(method, url, strings.NewReader("data"))
+	}
+	require.NoError(t, req.WriteProxy(conn))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return nil, err
+	}
+	ioutil.ReadAll(resp.Body)
+	return resp, nil
+}
+
+func TestRetryIdempotentRequests(t *testing.T) {
+	origin, accepted := newResettingServer(t, 1)
+	defer origin.Close()
+	l := serveProxy(t, &Opts{})
+	defer l.Close()
+
+	resp, err := proxiedRequest(t, l.Addr().String(), http.MethodGet, "http://"+origin.Addr().String()+"/")
+	require.NoError(t, err, "Reset GET should be retried")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(accepted))
+
+	atomic.StoreInt32(accepted, 0)
+	_, err = proxiedRequest(t, l.Addr().String(), http.MethodPost, "http://"+origin.Addr().String()+"/")
+	assert.Error(t, err, "POST shouldn't be retried")
+	assert.Equal(t, int32(1), atomic.LoadInt32(accepted))
+}
+
+func TestRetryLimits(t *testing.T) {
+	origin, accepted := newResettingServer(t, 10)
+	defer origin.Close()
+
+	l := serveProxy(t, &Opts{MaxRetries: 3})
+	defer l.Close()
+	_, err := proxiedRequest(t, l.Addr().String(), http.MethodHead, "http://"+origin.Addr().String()+"/")
+	assert.Error(t, err)
+	assert.Equal(t, int32(4), atomic.LoadInt32(accepted), "Should give up after MaxRetries")
+
+	atomic.StoreInt32(accepted, 0)
+	disabled := serveProxy(t, &Opts{DisableRetries: true})
+	defer disabled.Close()
+	_, err = proxiedRequest(t, disabled.Addr().String(), http.MethodGet, "http://"+origin.Addr().String()+"/")
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(accepted))
+}
+
+func TestRetrySkipsFailedAddrs(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+	port := strconv.Itoa(portOf(t, origin.Listener.Addr()))
+
+	var mx sync.Mutex
+	var attempts []string
+	l := serveProxy(t, &Opts{
+		Resolver: ResolverFunc(func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("127.0.0.1")}}, nil
+		}),
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			mx.Lock()
+			attempts = append(attempts, addr)
+			mx.Unlock()
+			if strings.HasPrefix(addr, "10.0.0.1:") {
+				return nil, errors.New("unreachable")
+			}
+			return net.Dial(network, addr)
+		},
+	})
+	defer l.Close()
+
+	resp, err := proxiedRequest(t, l.Addr().String(), http.MethodGet, "http://thehost:"+port+"/")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	mx.Lock()
+	defer mx.Unlock()
+	assert.Equal(t, []string{"10.0.0.1:" + port, "127.0.0.1:" + port}, attempts, "Retry should move on to the next address")
+}
+
+func TestIsRetryable(t *testing.T) {
+	get, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	assert.True(t, isRetryable(get))
+	withBody, _ := http.NewRequest(http.MethodGet, "http://example.com", strings.NewReader("body"))
+	assert.False(t, isRetryable(withBody))
+	post, _ := http.NewRequest(http.MethodPost, "http://example.com", nil)
+	assert.False(t, isRetryable(post))
+
+	assert.True(t, isRetryableError(&DialError{Addr: "example.com:80", Phase: PhaseDial, Err: errors.New("refused")}))
+	assert.False(t, isRetryableError(&DialError{Addr: "example.com:80", Phase: PhaseResolve, Err: errors.New("no such host")}))
+	assert.False(t, isRetryableError(&TimeoutError{Addr: "example.com:80", Phase: PhaseDial, Err: context.DeadlineExceeded}))
+	assert.False(t, isRetryableError(errors.New("something else")))
+}
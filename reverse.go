@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+)
+
+// VirtualHost routes requests whose Host and path match it to a backend.
+type VirtualHost struct {
+	// Hosts are patterns for the Host header in the syntax of path.Match,
+	// e.g. "*.example.com". Matching is case-insensitive and ignores the port.
+	// If empty, any host matches.
+	Hosts []string
+
+	// PathPrefix, if specified, restricts this VirtualHost to request paths
+	// equal to or under the prefix, e.g. "/api" matches "/api" and "/api/v1"
+	// but not "/apiary".
+	PathPrefix string
+
+	// StripPrefix removes PathPrefix from the request path before forwarding.
+	StripPrefix bool
+
+	// Backend is where matching requests are sent, e.g.
+	// "http://10.0.0.1:8080/app". The backend's path is prepended to the
+	// request path and its query is merged into the request's.
+	Backend *url.URL
+
+	// PreserveHost sends the client's Host header to the backend instead of
+	// the backend's host.
+	PreserveHost bool
+}
+
+// ReverseProxyOpts configures a ReverseProxy.
+type ReverseProxyOpts struct {
+	// VirtualHosts are consulted in order, and each request is sent to the
+	// first that matches it. Requests that match none receive a 404.
+	VirtualHosts []*VirtualHost
+
+	// Dial is used to dial backends. Defaults to dialing directly.
+	Dial DialFunc
+
+	// Filter is an optional Filter that will be invoked for every request
+	// after it has been rewritten for its backend.
+	Filter filters.Filter
+
+	// Forwarding controls how request headers are rewritten. X-Forwarded-For,
+	// X-Forwarded-Host and X-Forwarded-Proto are always added unless
+	// Forwarding.Anonymize is set. Forwarded is added if
+	// Forwarding.AddForwarded is set.
+	Forwarding *ForwardingOptions
+
+	// ErrorRenderer, if specified, renders the responses sent when a backend
+	// can't be reached. Otherwise, the status is chosen with ErrorStatus.
+	ErrorRenderer ErrorRenderer
+
+	// Timeouts bounds how long to wait on backends. Only Dial, TLSHandshake
+	// and ResponseHeader apply.
+	Timeouts Timeouts
+
+	// MaxIdleConnsPerHost is how many idle connections to keep to each
+	// backend. Defaults to http.DefaultMaxIdleConnsPerHost.
+	MaxIdleConnsPerHost int
+
+	// TLSConfig, if specified, configures TLS to https backends.
+	TLSConfig TLSConfigFunc
+}
+
+// ReverseProxy is an http.Handler that forwards requests to backends based on
+// their Host header and path, making this package usable as a reverse proxy.
+type ReverseProxy struct {
+	opts       *ReverseProxyOpts
+	forwarding *ForwardingOptions
+	filter     filters.Filter
+	transport  *http.Transport
+}
+
+// NewReverseProxy creates a ReverseProxy using the given opts.
+func NewReverseProxy(opts *ReverseProxyOpts) (*ReverseProxy, error) {
+	for i, vh := range opts.VirtualHosts {
+		if vh.Backend == nil || vh.Backend.Host == "" {
+			return nil, errors.New("VirtualHost %d has no Backend", i)
+		}
+		if vh.Backend.Scheme != "http" && vh.Backend.Scheme != "https" {
+			return nil, errors.New("Unsupported scheme for backend %v", vh.Backend)
+		}
+		for _, pattern := range vh.Hosts {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, errors.New("Invalid host pattern %v: %v", pattern, err)
+			}
+		}
+	}
+
+	dial := opts.Dial
+	if dial == nil {
+		dial = ChainDial(nil)
+	}
+	dialTimeout := opts.Timeouts.Dial
+	if dialTimeout <= 0 {
+		dialTimeout = DefaultDialTimeout
+	}
+	forwarding := &ForwardingOptions{AddXForwardedFor: true, AddXForwardedHostAndProto: true}
+	if opts.Forwarding != nil {
+		*forwarding = *opts.Forwarding
+		forwarding.AddXForwardedFor = true
+		forwarding.AddXForwardedHostAndProto = true
+	}
+	filter := opts.Filter
+	if filter == nil {
+		filter = filters.FilterFunc(defaultFilter)
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+			defer cancel()
+			return dial(ctx, false, network, addr)
+		},
+		TLSHandshakeTimeout:   opts.Timeouts.TLSHandshake,
+		ResponseHeaderTimeout: opts.Timeouts.ResponseHeader,
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	if opts.TLSConfig != nil {
+		transport.DialTLSContext = dialTLSWith(opts.TLSConfig, opts.Timeouts.TLSHandshake, transport.DialContext)
+	}
+	return &ReverseProxy{
+		opts:       opts,
+		forwarding: forwarding,
+		filter:     filter,
+		transport:  transport,
+	}, nil
+}
+
+// ServeHTTP implements the interface http.Handler
+func (rp *ReverseProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	vh, reqPath := rp.route(req)
+	if vh == nil {
+		http.Error(w, "No backend for "+req.Host, http.StatusNotFound)
+		return
+	}
+
+	fctx := filters.WrapContext(req.Context(), nil)
+	resp, fctx, err := rp.filter.Apply(fctx, rp.rewrite(fctx, req, vh, reqPath), func(ctx filters.Context, modifiedReq *http.Request) (*http.Response, filters.Context, error) {
+		resp, err := rp.transport.RoundTrip(modifiedReq.WithContext(ctx))
+		if err != nil {
+			return nil, ctx, errors.New("Unable to round-trip request to backend %v: %v", vh.Backend.Host, err)
+		}
+		return resp, ctx, nil
+	})
+	if err != nil && resp == nil {
+		log.Debugf("Error proxying %v%v: %v", req.Host, req.URL.Path, err)
+		if rp.opts.ErrorRenderer != nil {
+			resp = rp.opts.ErrorRenderer.RenderError(fctx, req, err)
+		}
+		if resp == nil {
+			http.Error(w, err.Error(), ErrorStatus(err))
+			return
+		}
+	}
+	if resp == nil {
+		return
+	}
+
+	copyHeadersForForwarding(w.Header(), resp.Header)
+	w.Header().Del("Connection")
+	w.WriteHeader(resp.StatusCode)
+	if resp.Body != nil {
+		io.Copy(&flushingWriter{w}, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// Close closes idle connections to backends.
+func (rp *ReverseProxy) Close() {
+	rp.transport.CloseIdleConnections()
+}
+
+// route finds the VirtualHost for req and the path to request from it.
+func (rp *ReverseProxy) route(req *http.Request) (*VirtualHost, string) {
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+	}
+	host = strings.ToLower(host)
+	for _, vh := range rp.opts.VirtualHosts {
+		if !vh.matchesHost(host) {
+			continue
+		}
+		if reqPath, ok := vh.matchPath(req.URL.Path); ok {
+			return vh, reqPath
+		}
+	}
+	return nil, ""
+}
+
+func (vh *VirtualHost) matchesHost(host string) bool {
+	if len(vh.Hosts) == 0 {
+		return true
+	}
+	for _, pattern := range vh.Hosts {
+		if matched, _ := path.Match(strings.ToLower(pattern), host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPath checks reqPath against PathPrefix, returning the path with the
+// prefix stripped if so configured.
+func (vh *VirtualHost) matchPath(reqPath string) (string, bool) {
+	reqPath = cleanURLPath(reqPath)
+	prefix := strings.TrimSuffix(vh.PathPrefix, "/")
+	if prefix == "" {
+		return reqPath, true
+	}
+	if reqPath != prefix && !strings.HasPrefix(reqPath, prefix+"/") {
+		return "", false
+	}
+	if !vh.StripPrefix {
+		return reqPath, true
+	}
+	stripped := strings.TrimPrefix(reqPath, prefix)
+	if stripped == "" {
+		stripped = "/"
+	}
+	return stripped, true
+}
+
+// rewrite builds the request to send to the backend.
+func (rp *ReverseProxy) rewrite(ctx context.Context, req *http.Request, vh *VirtualHost, reqPath string) *http.Request {
+	out := req.WithContext(ctx)
+	out.RequestURI = ""
+	out.Close = false
+	if out.ContentLength == 0 {
+		out.Body = nil
+	}
+
+	backend := vh.Backend
+	out.URL = &url.URL{
+		Scheme:   backend.Scheme,
+		Host:     backend.Host,
+		Path:     joinURLPath(backend.Path, reqPath),
+		RawQuery: backend.RawQuery,
+	}
+	if req.URL.RawQuery != "" {
+		if out.URL.RawQuery != "" {
+			out.URL.RawQuery += "&"
+		}
+		out.URL.RawQuery += req.URL.RawQuery
+	}
+	if !vh.PreserveHost {
+		out.Host = backend.Host
+	}
+
+	out.Header = make(http.Header)
+	copyHeadersForForwarding(out.Header, req.Header)
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	rp.forwarding.apply(out, req.ProtoMajor, req.ProtoMinor, proto, req.Host)
+	if _, ok := out.Header["User-Agent"]; !ok {
+		// Don't let the transport add its own User-Agent
+		out.Header.Set("User-Agent", "")
+	}
+	return out
+}
+
+func joinURLPath(base, reqPath string) string {
+	if base == "" || base == "/" {
+		return reqPath
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(reqPath, "/")
+}
+
+// flushingWriter flushes after every write so that streamed responses reach
+// the client promptly.
+type flushingWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw *flushingWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	if flusher, ok := fw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
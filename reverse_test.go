@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newBackend(t *testing.T, name string) (*httptest.Server, *url.URL) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "%s %s %s xff=%s xfh=%s xfp=%s", name, req.Host, req.URL.RequestURI(),
+			req.Header.Get("X-Forwarded-For"), req.Header.Get("X-Forwarded-Host"), req.Header.Get("X-Forwarded-Proto"))
+	}))
+	u, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+	return backend, u
+}
+
+func TestReverseProxy(t *testing.T) {
+	api, apiURL := newBackend(t, "api")
+	defer api.Close()
+	web, webURL := newBackend(t, "web")
+	defer web.Close()
+	apiURL.Path = "/v2"
+
+	rp, err := NewReverseProxy(&ReverseProxyOpts{
+		VirtualHosts: []*VirtualHost{
+			{Hosts: []string{"*.example.com"}, PathPrefix: "/api/", StripPrefix: true, Backend: apiURL},
+			{Hosts: []string{"www.example.com"}, Backend: webURL, PreserveHost: true},
+		},
+		Filter: filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+			if req.URL.Path == "/forbidden" {
+				return filters.Fail(ctx, req, http.StatusForbidden, fmt.Errorf("forbidden"))
+			}
+			return next(ctx, req)
+		}),
+	})
+	require.NoError(t, err)
+	defer rp.Close()
+	front := httptest.NewServer(rp)
+	defer front.Close()
+
+	get := func(host string, uri string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, front.URL+uri, nil)
+		req.Host = host
+		resp, reqErr := http.DefaultClient.Do(req)
+		require.NoError(t, reqErr)
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := get("shop.Example.com:8080", "/api/items?id=1")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, fmt.Sprintf("api %s /v2/items?id=1 xff=127.0.0.1 xfh=shop.Example.com:8080 xfp=http", apiURL.Host), body)
+
+	status, body = get("shop.example.com", "/api/./items/")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, fmt.Sprintf("api %s /v2/items/ xff=127.0.0.1 xfh=shop.example.com xfp=http", apiURL.Host), body, "Paths should be cleaned before forwarding")
+
+	status, body = get("www.example.com", "/api/../apiary")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "web www.example.com /apiary xff=127.0.0.1 xfh=www.example.com xfp=http", body, "Paths should be cleaned before matching prefixes")
+
+	status, body = get("www.example.com", "/apiary")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "web www.example.com /apiary xff=127.0.0.1 xfh=www.example.com xfp=http", body)
+
+	status, _ = get("www.example.com", "/forbidden")
+	assert.Equal(t, http.StatusForbidden, status)
+
+	status, _ = get("other.org", "/")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestReverseProxyBackendDown(t *testing.T) {
+	backend, backendURL := newBackend(t, "down")
+	backend.Close()
+
+	rp, err := NewReverseProxy(&ReverseProxyOpts{VirtualHosts: []*VirtualHost{{Backend: backendURL}}})
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	rp.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+
+	_, err = NewReverseProxy(&ReverseProxyOpts{VirtualHosts: []*VirtualHost{{}}})
+	assert.Error(t, err, "VirtualHost without backend should be rejected")
+}
+
+func TestVirtualHostMatchPath(t *testing.T) {
+	vh := &VirtualHost{PathPrefix: "/api/", StripPrefix: true}
+	for reqPath, expected := range map[string]string{
+		"/api":          "/",
+		"/api/items":    "/items",
+		"/api//items/":  "/items/",
+		"/api/./x/../y": "/y",
+		"/./api/items":  "/items",
+	} {
+		stripped, ok := vh.matchPath(reqPath)
+		assert.True(t, ok, reqPath)
+		assert.Equal(t, expected, stripped, reqPath)
+	}
+	for _, reqPath := range []string{"/api/../admin", "/apiary", "/admin/api", "/api/.."} {
+		_, ok := vh.matchPath(reqPath)
+		assert.False(t, ok, reqPath)
+	}
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/getlantern/errors"
+)
+
+// Rewriter changes the destination (host:port) of CONNECT and forwarded
+// requests before they're dialed, for example to send requests for internal
+// hosts to an internal load balancer or to pin a host to a specific IP. The
+// original destination remains available via OriginalAddr(ctx).
+type Rewriter interface {
+	// Rewrite returns the address to dial instead of addr, or addr itself to
+	// leave it unchanged.
+	Rewrite(ctx context.Context, addr string) (string, error)
+}
+
+// RewriterFunc adapts a function to a Rewriter
+type RewriterFunc func(ctx context.Context, addr string) (string, error)
+
+// Rewrite implements the interface Rewriter
+func (f RewriterFunc) Rewrite(ctx context.Context, addr string) (string, error) {
+	return f(ctx, addr)
+}
+
+// HostMapping maps destination hosts matching Pattern to Target.
+type HostMapping struct {
+	// Pattern is matched against the destination host (without port) using
+	// path.Match, case-insensitively, e.g. "*.internal".
+	Pattern string
+
+	// Target is the host or host:port to dial instead. If it has no port, the
+	// port of the original destination is kept.
+	Target string
+}
+
+// MapHosts returns a Rewriter that rewrites destinations according to the
+// first of the given mappings whose Pattern matches. Destinations that match
+// none are left unchanged.
+func MapHosts(mappings ...HostMapping) (Rewriter, error) {
+	for _, mapping := range mappings {
+		if _, err := path.Match(mapping.Pattern, ""); err != nil {
+			return nil, errors.New("Invalid host pattern %v: %v", mapping.Pattern, err)
+		}
+		if mapping.Target == "" {
+			return nil, errors.New("Missing target for host pattern %v", mapping.Pattern)
+		}
+	}
+	return RewriterFunc(func(ctx context.Context, addr string) (string, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return "", errors.New("Unable to split host and port for %v: %v", addr, err)
+		}
+		host = strings.ToLower(host)
+		for _, mapping := range mappings {
+			if matched, _ := path.Match(strings.ToLower(mapping.Pattern), host); !matched {
+				continue
+			}
+			if _, _, err := net.SplitHostPort(mapping.Target); err == nil {
+				return mapping.Target, nil
+			}
+			return net.JoinHostPort(strings.Trim(mapping.Target, "[]"), port), nil
+		}
+		return addr, nil
+	}), nil
+}
+
+// NetworkRouter chooses the network over which to dial a destination, so that
+// CONNECT and forwarded requests for names like "internal-service:80" can
+// reach Unix domain sockets or other endpoints that aren't TCP, as in service
+// mesh style deployments.
+type NetworkRouter interface {
+	// RouteNetwork returns the network and address to dial instead of network
+	// (usually "tcp") and addr, or both unchanged.
+	RouteNetwork(ctx context.Context, network, addr string) (string, string, error)
+}
+
+// NetworkRouterFunc adapts a function to a NetworkRouter
+type NetworkRouterFunc func(ctx context.Context, network, addr string) (string, string, error)
+
+// RouteNetwork implements the interface NetworkRouter
+func (f NetworkRouterFunc) RouteNetwork(ctx context.Context, network, addr string) (string, string, error) {
+	return f(ctx, network, addr)
+}
+
+// NetworkMapping routes destination hosts matching Pattern to Addr on
+// Network.
+type NetworkMapping struct {
+	// Pattern is matched against the destination host (without port) like
+	// with HostMapping.
+	Pattern string
+
+	// Network is the network to dial, e.g. "unix".
+	Network string
+
+	// Addr is the address to dial on Network, e.g. the path of a Unix socket.
+	Addr string
+}
+
+// MapNetworks returns a NetworkRouter that routes destinations according to
+// the first of the given mappings whose Pattern matches. Destinations that
+// match none are left unchanged.
+func MapNetworks(mappings ...NetworkMapping) (NetworkRouter, error) {
+	for _, mapping := range mappings {
+		if _, err := path.Match(mapping.Pattern, ""); err != nil {
+			return nil, errors.New("Invalid host pattern %v: %v", mapping.Pattern, err)
+		}
+		if mapping.Network == "" || mapping.Addr == "" {
+			return nil, errors.New("Missing network or address for host pattern %v", mapping.Pattern)
+		}
+	}
+	return NetworkRouterFunc(func(ctx context.Context, network, addr string) (string, string, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return "", "", errors.New("Unable to split host and port for %v: %v", addr, err)
+		}
+		host = strings.ToLower(host)
+		for _, mapping := range mappings {
+			if matched, _ := path.Match(strings.ToLower(mapping.Pattern), host); matched {
+				return mapping.Network, mapping.Addr, nil
+			}
+		}
+		return network, addr, nil
+	}), nil
+}
+
+// isIPNetwork indicates whether addresses on network are host:port pairs that
+// can be resolved.
+func isIPNetwork(network string) bool {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMapHosts(t *testing.T) {
+	rewriter, err := MapHosts(
+		HostMapping{Pattern: "*.internal", Target: "10.0.0.1:8443"},
+		HostMapping{Pattern: "pinned.example.com", Target: "192.0.2.7"},
+		HostMapping{Pattern: "v6.example.com", Target: "[2001:db8::1]"},
+	)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	for addr, expected := range map[string]string{
+		"api.internal:443":        "10.0.0.1:8443",
+		"API.Internal:80":         "10.0.0.1:8443",
+		"pinned.example.com:443":  "192.0.2.7:443",
+		"v6.example.com:80":       "[2001:db8::1]:80",
+		"other.example.com:443":   "other.example.com:443",
+		"api.internal.evil.com:1": "api.internal.evil.com:1",
+	} {
+		rewritten, err := rewriter.Rewrite(ctx, addr)
+		if assert.NoError(t, err, addr) {
+			assert.Equal(t, expected, rewritten, addr)
+		}
+	}
+
+	_, err = rewriter.Rewrite(ctx, "noport")
+	assert.Error(t, err)
+	_, err = MapHosts(HostMapping{Pattern: "[", Target: "1.2.3.4"})
+	assert.Error(t, err, "Invalid pattern should be rejected")
+	_, err = MapHosts(HostMapping{Pattern: "*"})
+	assert.Error(t, err, "Missing target should be rejected")
+}
+
+func TestRewriter(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	var mx sync.Mutex
+	var dialed, originals []string
+	l := serveProxy(t, &Opts{
+		OKWaitsForUpstream: true,
+		Rewriter: RewriterFunc(func(ctx context.Context, addr string) (string, error) {
+			if addr == "origin.internal:443" {
+				return origin.Addr().String(), nil
+			}
+			return addr, nil
+		}),
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			mx.Lock()
+			dialed = append(dialed, addr)
+			originals = append(originals, OriginalAddr(ctx))
+			mx.Unlock()
+			return net.Dial(network, addr)
+		},
+	})
+	defer l.Close()
+
+	conn, _, resp := openTunnel(t, l.Addr().String(), "origin.internal:443")
+	defer conn.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	mx.Lock()
+	defer mx.Unlock()
+	assert.Equal(t, []string{origin.Addr().String()}, dialed)
+	assert.Equal(t, []string{"origin.internal:443"}, originals)
+}
+
+func TestMapNetworks(t *testing.T) {
+	router, err := MapNetworks(NetworkMapping{Pattern: "*.sock.internal", Network: "unix", Addr: "/run/service.sock"})
+	require.NoError(t, err)
+	network, addr, err := router.RouteNetwork(context.Background(), "tcp", "API.sock.internal:80")
+	require.NoError(t, err)
+	assert.Equal(t, "unix", network)
+	assert.Equal(t, "/run/service.sock", addr)
+	network, addr, err = router.RouteNetwork(context.Background(), "tcp", "example.com:80")
+	require.NoError(t, err)
+	assert.Equal(t, "tcp", network)
+	assert.Equal(t, "example.com:80", addr)
+
+	_, err = MapNetworks(NetworkMapping{Pattern: "*", Network: "unix"})
+	assert.Error(t, err, "Missing address should be rejected")
+}
+
+func TestNetworkRouter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netrouter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	echoSocket := filepath.Join(dir, "echo.sock")
+	echo, err := net.Listen("unix", echoSocket)
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	webSocket := filepath.Join(dir, "web.sock")
+	web, err := net.Listen("unix", webSocket)
+	require.NoError(t, err)
+	defer web.Close()
+	go http.Serve(web, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello from " + req.Host))
+	}))
+
+	router, err := MapNetworks(
+		NetworkMapping{Pattern: "echo-service", Network: "unix", Addr: echoSocket},
+		NetworkMapping{Pattern: "web-service", Network: "unix", Addr: webSocket},
+	)
+	require.NoError(t, err)
+	// Resolving would fail for the made up hosts
+	l := serveProxy(t, &Opts{OKWaitsForUpstream: true, NetworkRouter: router, TryAlternateAddrs: true})
+	defer l.Close()
+
+	conn, br, resp := openTunnel(t, l.Addr().String(), "echo-service:80")
+	defer conn.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	echoed := make([]byte, 4)
+	_, err = io.ReadFull(br, echoed)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(echoed))
+
+	resp, err = proxiedRequest(t, l.Addr().String(), http.MethodGet, "http://web-service/")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/errors"
+)
+
+// Route sends destinations matching its patterns to a particular DialFunc.
+type Route struct {
+	// Hosts are glob patterns (as in path.Match) matched case-insensitively
+	// against the destination host, for example "*.example.com" (which matches
+	// any subdomain of example.com but not example.com itself).
+	Hosts []string
+
+	// HostRegexps are regular expressions matched against the destination host.
+	HostRegexps []*regexp.Regexp
+
+	// Ports, if specified, restricts the route to the given destination ports.
+	Ports []int
+
+	// Dial is used to dial matching destinations. Use BlockDial to refuse them.
+	Dial DialFunc
+}
+
+// BlockDial is a DialFunc that refuses all destinations, for use in Routes.
+func BlockDial(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+	return nil, errors.New("Unable to dial %v: %v", addr, ErrBlocked)
+}
+
+// Router selects among DialFuncs based on the destination, allowing a single
+// proxy to implement split-tunneling policies. Use its Dial method as
+// Opts.Dial.
+type Router struct {
+	routes      []*Route
+	defaultDial DialFunc
+}
+
+// NewRouter creates a Router that dials each destination using the first of
+// routes that matches it, or defaultDial if none match. A route with neither
+// Hosts nor HostRegexps matches any host. If defaultDial is nil, unmatched
+// destinations are dialed directly.
+func NewRouter(defaultDial DialFunc, routes ...*Route) (*Router, error) {
+	for i, route := range routes {
+		if route.Dial == nil {
+			return nil, errors.New("Route %d has no Dial", i)
+		}
+		for _, pattern := range route.Hosts {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, errors.New("Invalid host pattern %v: %v", pattern, err)
+			}
+		}
+	}
+	if defaultDial == nil {
+		defaultDial = ChainDial(nil)
+	}
+	return &Router{routes: routes, defaultDial: defaultDial}, nil
+}
+
+// Dial is a DialFunc that dials addr using the matching route.
+func (r *Router) Dial(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+	return r.route(addr)(ctx, isCONNECT, network, addr)
+}
+
+func (r *Router) route(addr string) DialFunc {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	port, _ := strconv.Atoi(portString)
+	host = normalizeDomain(host)
+	for _, route := range r.routes {
+		if route.matches(host, port) {
+			return route.Dial
+		}
+	}
+	return r.defaultDial
+}
+
+func (route *Route) matches(host string, port int) bool {
+	if len(route.Ports) > 0 {
+		portMatched := false
+		for _, p := range route.Ports {
+			if p == port {
+				portMatched = true
+				break
+			}
+		}
+		if !portMatched {
+			return false
+		}
+	}
+	if len(route.Hosts) == 0 && len(route.HostRegexps) == 0 {
+		return true
+	}
+	for _, pattern := range route.Hosts {
+		if matched, _ := path.Match(strings.ToLower(pattern), host); matched {
+			return true
+		}
+	}
+	for _, re := range route.HostRegexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
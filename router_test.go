@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouter(t *testing.T) {
+	var dialed []string
+	namedDial := func(name string) DialFunc {
+		return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, name)
+			return nil, nil
+		}
+	}
+
+	router, err := NewRouter(namedDial("direct"),
+		&Route{Hosts: []string{"*.blocked.com"}, Dial: BlockDial},
+		&Route{Hosts: []string{"*.example.com"}, Ports: []int{443}, Dial: namedDial("a")},
+		&Route{HostRegexps: []*regexp.Regexp{regexp.MustCompile(`^internal\d+$`)}, Dial: namedDial("b")},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ctx := context.Background()
+	_, err = router.Dial(ctx, true, "tcp", "www.blocked.com:443")
+	assert.Error(t, err, "Blocked destination should fail")
+	_, err = router.Dial(ctx, true, "tcp", "www.blocked.com.:443")
+	assert.Error(t, err, "Trailing dot shouldn't escape routes")
+	router.Dial(ctx, true, "tcp", "WWW.Example.com:443")
+	router.Dial(ctx, true, "tcp", "www.example.com:80")
+	router.Dial(ctx, false, "tcp", "internal12:8080")
+	router.Dial(ctx, false, "tcp", "example.com:443")
+	assert.Equal(t, []string{"a", "direct", "b", "direct"}, dialed)
+
+	_, err = NewRouter(nil, &Route{Hosts: []string{"["}, Dial: BlockDial})
+	assert.Error(t, err, "Invalid pattern should be rejected")
+	_, err = NewRouter(nil, &Route{Hosts: []string{"*"}})
+	assert.Error(t, err, "Route without Dial should be rejected")
+}
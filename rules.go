@@ -0,0 +1,304 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	ctxKeyRule = contextKey("rule")
+)
+
+// RuleAction is what a Rule does with the requests it matches.
+type RuleAction string
+
+const (
+	// ActionDirect forwards requests by dialing their destination directly,
+	// bypassing Opts.Dial
+	ActionDirect RuleAction = "direct"
+
+	// ActionProxy forwards requests through the upstream proxy at
+	// Rule.Upstream
+	ActionProxy RuleAction = "proxy"
+
+	// ActionBlock responds with Rule.Status, 403 Forbidden by default
+	ActionBlock RuleAction = "block"
+
+	// ActionRedirect responds with a redirect to Rule.Location, using
+	// Rule.Status, 302 Found by default
+	ActionRedirect RuleAction = "redirect"
+
+	// ActionMITM intercepts the TLS traffic of CONNECT tunnels, which
+	// requires Opts.MITMOpts. It's in addition to MITMOpts.Domains.
+	ActionMITM RuleAction = "mitm"
+)
+
+// Rule matches requests by method, host, path and header values, and decides
+// what to do with them. Empty criteria match any request. Rules can be built
+// programmatically or loaded from YAML (or JSON) with ParseRules.
+type Rule struct {
+	// Methods, if specified, are the request methods to match, e.g. CONNECT.
+	Methods []string `yaml:"methods"`
+
+	// Hosts are glob patterns (as in path.Match) matched case-insensitively
+	// against the destination host, like for Route.
+	Hosts []string `yaml:"hosts"`
+
+	// Ports, if specified, are the destination ports to match.
+	Ports []int `yaml:"ports"`
+
+	// Paths are shell expressions (as in shExpMatch, so * matches across
+	// slashes) matched against the request path, once cleaned of elements
+	// like . and .. and repeated slashes. CONNECT requests have no
+	// path, so they don't match rules with Paths, but the requests of MITMed
+	// tunnels do.
+	Paths []string `yaml:"paths"`
+
+	// Headers are shell expressions that one of the values of the named
+	// header has to match, for every header listed.
+	Headers map[string]string `yaml:"headers"`
+
+	// Action is what to do with matching requests.
+	Action RuleAction `yaml:"action"`
+
+	// Upstream is the URL of the upstream proxy for ActionProxy, see
+	// ParseUpstream.
+	Upstream string `yaml:"upstream"`
+
+	// Dial, if specified, is used instead of Upstream for ActionProxy.
+	Dial DialFunc `yaml:"-"`
+
+	// Status is the status code for ActionBlock and ActionRedirect.
+	Status int `yaml:"status"`
+
+	// Location is the URL to redirect to for ActionRedirect.
+	Location string `yaml:"location"`
+
+	dial DialFunc
+}
+
+// Rules is an ordered list of Rules, of which the first that matches a
+// request applies. Requests that match no rule are handled as usual. Use it
+// as Opts.Rules.
+type Rules struct {
+	rules []*Rule
+}
+
+// NewRules validates the given rules and combines them in order.
+func NewRules(rules ...*Rule) (*Rules, error) {
+	for i, rule := range rules {
+		if err := rule.init(); err != nil {
+			return nil, errors.New("Invalid rule %d: %v", i, err)
+		}
+	}
+	return &Rules{rules: rules}, nil
+}
+
+// ParseRules parses a YAML (or JSON) list of rules, for example:
+//
+//   - hosts: ["*.internal.example.com"]
+//     action: direct
+//   - headers: {X-Tenant: "acme"}
+//     action: proxy
+//     upstream: socks5://egress.acme.example.com:1080
+//   - hosts: ["ads.example.com"]
+//     action: block
+func ParseRules(data []byte) (*Rules, error) {
+	var rules []*Rule
+	if err := yaml.UnmarshalStrict(data, &rules); err != nil {
+		return nil, errors.New("Unable to parse rules: %v", err)
+	}
+	return NewRules(rules...)
+}
+
+// Append returns Rules that apply r's rules and then the given rules.
+func (r *Rules) Append(rules ...*Rule) (*Rules, error) {
+	appended, err := NewRules(rules...)
+	if err != nil {
+		return nil, err
+	}
+	appended.rules = append(append([]*Rule(nil), r.rules...), appended.rules...)
+	return appended, nil
+}
+
+func (rule *Rule) init() error {
+	for _, pattern := range rule.Hosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.New("Invalid host pattern %v: %v", pattern, err)
+		}
+	}
+	switch rule.Action {
+	case ActionDirect:
+		rule.dial = ChainDial(nil)
+	case ActionProxy:
+		rule.dial = rule.Dial
+		if rule.dial == nil {
+			if rule.Upstream == "" {
+				return errors.New("Proxy action needs an upstream")
+			}
+			upstream, err := ParseUpstream(rule.Upstream)
+			if err != nil {
+				return err
+			}
+			rule.dial = ChainDial(nil, upstream)
+		}
+	case ActionBlock:
+		if rule.Status == 0 {
+			rule.Status = http.StatusForbidden
+		}
+	case ActionRedirect:
+		if rule.Location == "" {
+			return errors.New("Redirect action needs a location")
+		}
+		if rule.Status == 0 {
+			rule.Status = http.StatusFound
+		}
+		if rule.Status/100 != 3 {
+			return errors.New("Invalid redirect status %d", rule.Status)
+		}
+	case ActionMITM:
+	default:
+		return errors.New("Unknown action %v", rule.Action)
+	}
+	return nil
+}
+
+// Match returns the first rule that matches req, or nil if none does.
+func (r *Rules) Match(req *http.Request) *Rule {
+	host, port := requestHostPort(req)
+	for _, rule := range r.rules {
+		if rule.matches(req, host, port) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (rule *Rule) matches(req *http.Request, host string, port int) bool {
+	if len(rule.Methods) > 0 && !containsFold(rule.Methods, req.Method) {
+		return false
+	}
+	route := &Route{Hosts: rule.Hosts, Ports: rule.Ports}
+	if !route.matches(host, port) {
+		return false
+	}
+	if len(rule.Paths) > 0 {
+		if req.Method == http.MethodConnect {
+			return false
+		}
+		matched := false
+		for _, pattern := range rule.Paths {
+			if shExpMatch(cleanURLPath(req.URL.Path), pattern) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for name, pattern := range rule.Headers {
+		matched := false
+		for _, value := range req.Header[http.CanonicalHeaderKey(name)] {
+			if shExpMatch(value, pattern) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// requestHostPort determines the destination host (in lower case and without
+// a trailing dot) and port of req.
+func requestHostPort(req *http.Request) (string, int) {
+	authority := req.URL.Host
+	if authority == "" {
+		authority = req.Host
+	}
+	defaultPort := 80
+	if req.Method == http.MethodConnect || req.URL.Scheme == "https" {
+		defaultPort = 443
+	}
+	host, portString, err := net.SplitHostPort(authority)
+	if err != nil {
+		return normalizeDomain(strings.Trim(authority, "[]")), defaultPort
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		port = defaultPort
+	}
+	return normalizeDomain(host), port
+}
+
+// cleanURLPath cleans p like path.Clean, so that paths like /./admin and
+// //admin are matched as /admin, but keeps a trailing slash.
+func cleanURLPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+func containsFold(values []string, s string) bool {
+	for _, value := range values {
+		if strings.EqualFold(value, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter applies the rule matching each request, responding to blocked and
+// redirected requests and remembering the rule for dialing.
+func (r *Rules) filter() filters.Filter {
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		rule := r.Match(req)
+		if rule == nil {
+			return next(ctx, req)
+		}
+		switch rule.Action {
+		case ActionBlock:
+			log.Debugf("Blocking request to %v by rule", req.Host)
+			return filters.ShortCircuit(ctx, req, &http.Response{
+				StatusCode: rule.Status,
+				Header:     make(http.Header),
+				Body:       http.NoBody,
+			})
+		case ActionRedirect:
+			header := make(http.Header)
+			header.Set("Location", rule.Location)
+			return filters.ShortCircuit(ctx, req, &http.Response{
+				StatusCode: rule.Status,
+				Header:     header,
+				Body:       http.NoBody,
+			})
+		}
+		return next(ctx.WithValue(ctxKeyRule, rule), req)
+	})
+}
+
+// ruleDial returns the DialFunc of the rule that matched the request being
+// dialed for, if it dictates one.
+func ruleDial(ctx context.Context) DialFunc {
+	rule, _ := ctx.Value(ctxKeyRule).(*Rule)
+	if rule == nil {
+		return nil
+	}
+	return rule.dial
+}
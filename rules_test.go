@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRulesMatch(t *testing.T) {
+	rules, err := NewRules(
+		&Rule{Methods: []string{"connect"}, Hosts: []string{"*.example.com"}, Ports: []int{443}, Action: ActionMITM},
+		&Rule{Hosts: []string{"example.com"}, Paths: []string{"/admin/*"}, Action: ActionBlock},
+		&Rule{Headers: map[string]string{"x-tenant": "acme*"}, Action: ActionDirect},
+		&Rule{Hosts: []string{"old.example.org"}, Action: ActionRedirect, Location: "http://new.example.org/"},
+	)
+	require.NoError(t, err)
+
+	action := func(method, url string, header http.Header) RuleAction {
+		req, err := http.NewRequest(method, url, nil)
+		require.NoError(t, err)
+		if header != nil {
+			req.Header = header
+		}
+		rule := rules.Match(req)
+		if rule == nil {
+			return ""
+		}
+		return rule.Action
+	}
+
+	assert.Equal(t, ActionMITM, action(http.MethodConnect, "http://www.example.com:443", nil))
+	assert.Equal(t, RuleAction(""), action(http.MethodConnect, "http://www.example.com:8443", nil), "Port should have to match")
+	assert.Equal(t, RuleAction(""), action(http.MethodGet, "https://www.example.com/", nil), "Method should have to match")
+	assert.Equal(t, ActionBlock, action(http.MethodGet, "http://EXAMPLE.com/admin/users/1", nil))
+	assert.Equal(t, RuleAction(""), action(http.MethodGet, "http://example.com/", nil))
+	assert.Equal(t, ActionBlock, action(http.MethodGet, "http://example.com./admin/users", nil), "Trailing dot shouldn't escape rules")
+	assert.Equal(t, ActionMITM, action(http.MethodConnect, "http://www.example.com.:443", nil), "Trailing dot shouldn't escape rules")
+	for _, escaped := range []string{"/./admin/users", "//admin/users", "/public/../admin/users", "/admin//"} {
+		assert.Equal(t, ActionBlock, action(http.MethodGet, "http://example.com"+escaped, nil), "%v should be cleaned", escaped)
+	}
+	assert.Equal(t, RuleAction(""), action(http.MethodConnect, "http://example.com:443", nil), "CONNECT has no path")
+	assert.Equal(t, ActionDirect, action(http.MethodGet, "http://example.net/", http.Header{"X-Tenant": {"other", "acme-eu"}}))
+	assert.Equal(t, RuleAction(""), action(http.MethodGet, "http://example.net/", http.Header{"X-Tenant": {"other"}}))
+	assert.Equal(t, ActionRedirect, action(http.MethodGet, "http://old.example.org/page", nil))
+
+	for p, cleaned := range map[string]string{"": "/", "/": "/", "/a/./b": "/a/b", "//a": "/a", "/a/../b/": "/b/", "a": "/a", "/a/..": "/"} {
+		assert.Equal(t, cleaned, cleanURLPath(p), p)
+	}
+
+	for _, rule := range []*Rule{
+		{Action: "teleport"},
+		{Action: ActionProxy},
+		{Action: ActionProxy, Upstream: "ftp://example.com:21"},
+		{Action: ActionRedirect},
+		{Action: ActionRedirect, Location: "http://example.com/", Status: http.StatusOK},
+		{Hosts: []string{"["}, Action: ActionBlock},
+	} {
+		_, err := NewRules(rule)
+		assert.Error(t, err, "%+v", rule)
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules([]byte(`
+- hosts: ["*.internal.example.com"]
+  action: direct
+- headers: {X-Tenant: "acme"}
+  action: proxy
+  upstream: socks5://localhost:1080
+- hosts: ["ads.example.com"]
+  action: block
+  status: 451
+`))
+	require.NoError(t, err)
+	req, _ := http.NewRequest(http.MethodGet, "http://ads.example.com/banner.png", nil)
+	rule := rules.Match(req)
+	require.NotNil(t, rule)
+	assert.Equal(t, http.StatusUnavailableForLegalReasons, rule.Status)
+
+	rules, err = ParseRules([]byte(`[{"hosts": ["example.com"], "action": "redirect", "location": "https://example.com/"}]`))
+	require.NoError(t, err, "JSON should be accepted too")
+	req, _ = http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	rule = rules.Match(req)
+	require.NotNil(t, rule)
+	assert.Equal(t, http.StatusFound, rule.Status)
+
+	_, err = ParseRules([]byte(`- hosts: ["example.com"]
+  action: block
+  unknown: true
+`))
+	assert.Error(t, err, "Unknown fields should be rejected")
+}
+
+func TestRulesFilter(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	var defaultDials, ruleDials int32
+	countingDial := func(count *int32) DialFunc {
+		return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(count, 1)
+			return net.Dial(network, origin.Listener.Addr().String())
+		}
+	}
+	rules, err := NewRules(
+		&Rule{Hosts: []string{"blocked.example.com"}, Action: ActionBlock},
+		&Rule{Hosts: []string{"old.example.com"}, Action: ActionRedirect, Location: "http://new.example.com/", Status: http.StatusMovedPermanently},
+		&Rule{Headers: map[string]string{"X-Route": "upstream"}, Action: ActionProxy, Dial: countingDial(&ruleDials)},
+	)
+	require.NoError(t, err)
+	l := serveProxy(t, &Opts{Dial: countingDial(&defaultDials), Rules: rules})
+	defer l.Close()
+
+	get := func(url string, header http.Header) *http.Response {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		require.NoError(t, req.Write(conn))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	assert.Equal(t, http.StatusForbidden, get("http://blocked.example.com/", nil).StatusCode)
+	resp := get("http://old.example.com/page", nil)
+	assert.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+	assert.Equal(t, "http://new.example.com/", resp.Header.Get("Location"))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&defaultDials)+atomic.LoadInt32(&ruleDials), "Blocked and redirected requests shouldn't dial")
+
+	assert.Equal(t, http.StatusOK, get("http://site.example.com/", http.Header{"X-Route": {"upstream"}}).StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ruleDials))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&defaultDials))
+
+	assert.Equal(t, http.StatusOK, get("http://site.example.com/", nil).StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&defaultDials), "Unmatched requests should use Opts.Dial")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ruleDials))
+}
@@ -3,17 +3,140 @@ package proxy
 import (
 	"context"
 	"net"
+	"sync"
 
 	"github.com/getlantern/errors"
 )
 
+const (
+	// DefaultServerAddr is the address on which a Server listens if its Addr
+	// isn't set.
+	DefaultServerAddr = ":8080"
+)
+
 // Serve runs a proxy server using the given Listener
 func (proxy *proxy) Serve(l net.Listener) error {
+	if !proxy.tracker.addListener(l) {
+		return ErrShutdown
+	}
+	defer proxy.tracker.removeListener(l)
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if proxy.tracker.isShuttingDown() {
+				return ErrShutdown
+			}
 			return errors.New("Unable to accept: %v", err)
 		}
 		go proxy.Handle(context.Background(), conn, conn)
 	}
 }
+
+// Server is a ready-to-run proxy server, analogous to http.Server. It
+// creates a Proxy from Opts the first time it's used, so that Filter,
+// Dial, MITMOpts and all other options take effect without having to wire up
+// listeners or hijacking by hand.
+type Server struct {
+	// Addr is the TCP address to listen on, DefaultServerAddr if empty.
+	Addr string
+
+	// Opts configures the proxy. If nil, the defaults are used.
+	Opts *Opts
+
+	// TLSOpts configures ListenAndServeTLS and ServeTLS. The certificate
+	// and key files passed to those take precedence over TLSOpts.CertFile and
+	// TLSOpts.KeyFile.
+	TLSOpts *TLSServerOpts
+
+	initOnce sync.Once
+	proxy    Proxy
+	initErr  error
+}
+
+// Proxy returns the underlying Proxy, creating it if necessary.
+func (s *Server) Proxy() (Proxy, error) {
+	s.initOnce.Do(func() {
+		opts := s.Opts
+		if opts == nil {
+			opts = &Opts{}
+		}
+		s.proxy, s.initErr = New(opts)
+	})
+	return s.proxy, s.initErr
+}
+
+// ListenAndServe listens on Addr and serves HTTP proxy requests, including
+// CONNECT, until the listener fails or the server is shut down.
+func (s *Server) ListenAndServe() error {
+	l, err := s.listen()
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// ListenAndServeTLS listens on Addr and serves HTTPS proxy requests using the
+// given certificate and key files, see TLSServerOpts.
+func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	l, err := s.listen()
+	if err != nil {
+		return err
+	}
+	return s.ServeTLS(l, certFile, keyFile)
+}
+
+// Serve serves HTTP proxy requests on l, closing it when done.
+func (s *Server) Serve(l net.Listener) error {
+	p, err := s.Proxy()
+	if err != nil {
+		l.Close()
+		return err
+	}
+	defer l.Close()
+	return p.Serve(l)
+}
+
+// ServeTLS serves HTTPS proxy requests on l using the given certificate and
+// key files, closing l when done.
+func (s *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	p, err := s.Proxy()
+	if err != nil {
+		l.Close()
+		return err
+	}
+	defer l.Close()
+	opts := &TLSServerOpts{}
+	if s.TLSOpts != nil {
+		copied := *s.TLSOpts
+		opts = &copied
+	}
+	if certFile != "" {
+		opts.CertFile = certFile
+	}
+	if keyFile != "" {
+		opts.KeyFile = keyFile
+	}
+	return p.ServeTLS(l, opts)
+}
+
+// Shutdown gracefully shuts down the server, see Proxy.Shutdown.
+func (s *Server) Shutdown(ctx context.Context) error {
+	p, err := s.Proxy()
+	if err != nil {
+		return err
+	}
+	_, _, err = p.Shutdown(ctx)
+	return err
+}
+
+func (s *Server) listen() (net.Listener, error) {
+	addr := s.Addr
+	if addr == "" {
+		addr = DefaultServerAddr
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.New("Unable to listen at %v: %v", addr, err)
+	}
+	return l, nil
+}
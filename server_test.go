@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestServerListenAndServe(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	s := &Server{Addr: freeAddr(t), Opts: &Opts{OKWaitsForUpstream: true}}
+	served := make(chan error, 1)
+	go func() {
+		served <- s.ListenAndServe()
+	}()
+
+	require.Eventually(t, func() bool {
+		c, err := net.Dial("tcp", s.Addr)
+		if err == nil {
+			c.Close()
+		}
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	conn, _, resp := openTunnel(t, s.Addr, origin.Addr().String())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, s.Shutdown(ctx))
+	select {
+	case err := <-served:
+		assert.Equal(t, ErrShutdown, err)
+	case <-time.After(time.Second):
+		t.Fatal("ListenAndServe should have returned after Shutdown")
+	}
+}
+
+func TestServerServeTLS(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	dir, err := ioutil.TempDir("", "server")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, issueTestCert(t, "proxy", 1, nil), certFile, keyFile)
+
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	s := &Server{Opts: &Opts{OKWaitsForUpstream: true}, TLSOpts: &TLSServerOpts{DisableHTTP2: true}}
+	go s.ServeTLS(l, certFile, keyFile)
+	defer s.Shutdown(context.Background())
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer conn.Close()
+	req, _ := http.NewRequest(http.MethodConnect, "http://"+origin.Addr().String(), nil)
+	req.Write(conn)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, err = (&Server{Addr: "not an address"}).Proxy()
+	assert.NoError(t, err, "Proxy is created lazily regardless of Addr")
+	assert.Error(t, (&Server{Addr: "not an address"}).ListenAndServe())
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	shapingQueueSize    = 64
+	shapingDrainTimeout = 5 * time.Second
+)
+
+// ShapingOptions simulates network conditions on tunnels, which is useful for
+// testing how clients behave on slow or unreliable networks. Shaping applies
+// separately to each direction.
+type ShapingOptions struct {
+	// Latency is the delay added to all data
+	Latency time.Duration
+
+	// Jitter, if specified, adds a further random delay of up to Jitter. Data
+	// is never reordered.
+	Jitter time.Duration
+
+	// PacketSize, if specified, splits writes into packets of at most this many
+	// bytes
+	PacketSize int
+
+	// PacketInterval, if specified, is the minimum time between packets, which
+	// limits throughput to PacketSize bytes per PacketInterval
+	PacketInterval time.Duration
+}
+
+func (opts *ShapingOptions) delay() time.Duration {
+	delay := opts.Latency
+	if opts.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(opts.Jitter)))
+	}
+	return delay
+}
+
+// shapedConn delays and paces writes to the wrapped connection according to
+// ShapingOptions. Writes are queued and delivered in order by a separate
+// goroutine, so that latency doesn't reduce throughput.
+type shapedConn struct {
+	net.Conn
+	opts  *ShapingOptions
+	queue chan *shapedPacket
+	done  chan struct{}
+	last  time.Time
+
+	mx  sync.Mutex
+	err error
+}
+
+type shapedPacket struct {
+	data      []byte
+	deliverAt time.Time
+}
+
+func newShapedConn(conn net.Conn, opts *ShapingOptions) *shapedConn {
+	sc := &shapedConn{
+		Conn:  conn,
+		opts:  opts,
+		queue: make(chan *shapedPacket, shapingQueueSize),
+		done:  make(chan struct{}),
+	}
+	go sc.deliver()
+	return sc
+}
+
+func (conn *shapedConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		if err := conn.writeErr(); err != nil {
+			return written, err
+		}
+		chunk := b
+		if conn.opts.PacketSize > 0 && len(chunk) > conn.opts.PacketSize {
+			chunk = chunk[:conn.opts.PacketSize]
+		}
+		deliverAt := time.Now().Add(conn.opts.delay())
+		if !conn.last.IsZero() {
+			earliest := conn.last.Add(conn.opts.PacketInterval)
+			if deliverAt.Before(earliest) {
+				deliverAt = earliest
+			}
+		}
+		conn.last = deliverAt
+		conn.queue <- &shapedPacket{data: append([]byte(nil), chunk...), deliverAt: deliverAt}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+func (conn *shapedConn) deliver() {
+	defer close(conn.done)
+	for packet := range conn.queue {
+		if conn.writeErr() != nil {
+			// Keep consuming so that writers don't block
+			continue
+		}
+		time.Sleep(time.Until(packet.deliverAt))
+		if _, err := conn.Conn.Write(packet.data); err != nil {
+			conn.mx.Lock()
+			conn.err = err
+			conn.mx.Unlock()
+		}
+	}
+}
+
+func (conn *shapedConn) writeErr() error {
+	conn.mx.Lock()
+	defer conn.mx.Unlock()
+	return conn.err
+}
+
+// drain waits for queued data to be delivered. It must only be called once no
+// more writes will happen.
+func (conn *shapedConn) drain() {
+	close(conn.queue)
+	select {
+	case <-conn.done:
+	case <-time.After(shapingDrainTimeout):
+		log.Debugf("Gave up delivering shaped data to %v", conn.RemoteAddr())
+	}
+}
+
+func (conn *shapedConn) Wrapped() net.Conn {
+	return conn.Conn
+}
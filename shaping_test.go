@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingConn struct {
+	net.Conn
+	mx     sync.Mutex
+	writes []int
+	times  []time.Time
+}
+
+func (conn *recordingConn) Write(b []byte) (int, error) {
+	conn.mx.Lock()
+	defer conn.mx.Unlock()
+	conn.writes = append(conn.writes, len(b))
+	conn.times = append(conn.times, time.Now())
+	return len(b), nil
+}
+
+func TestShapedConnPacing(t *testing.T) {
+	rc := &recordingConn{}
+	conn := newShapedConn(rc, &ShapingOptions{
+		Latency:        50 * time.Millisecond,
+		PacketSize:     4,
+		PacketInterval: 20 * time.Millisecond,
+	})
+	start := time.Now()
+	n, err := conn.Write([]byte("0123456789"))
+	assert.NoError(t, err)
+	assert.Equal(t, 10, n)
+	assert.True(t, time.Since(start) < 50*time.Millisecond, "Write shouldn't block for latency")
+	conn.drain()
+
+	rc.mx.Lock()
+	defer rc.mx.Unlock()
+	assert.Equal(t, []int{4, 4, 2}, rc.writes)
+	if assert.Len(t, rc.times, 3) {
+		assert.True(t, rc.times[0].Sub(start) >= 50*time.Millisecond, "First packet should be delayed by latency")
+		assert.True(t, rc.times[2].Sub(rc.times[0]) >= 40*time.Millisecond, "Packets should be paced")
+	}
+}
+
+func TestShapedTunnel(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go newProxy(&Opts{
+		OKWaitsForUpstream: true,
+		Shaping: &ShapingOptions{
+			Latency: 100 * time.Millisecond,
+			Jitter:  10 * time.Millisecond,
+		},
+	}).Serve(l)
+
+	conn, br, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+	defer conn.Close()
+	if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+		return
+	}
+	start := time.Now()
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(br, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	assert.True(t, time.Since(start) >= 200*time.Millisecond, "Round trip should include latency in both directions")
+}
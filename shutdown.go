@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	shutdownPollInterval = 50 * time.Millisecond
+)
+
+var (
+	// ErrShutdown is returned by Serve, Handle and friends once the proxy has
+	// been shut down.
+	ErrShutdown = errors.New("Proxy shut down")
+)
+
+// connTracker keeps track of listeners and downstream connections so that the
+// proxy can shut down gracefully. A connection is active while it's handling
+// a request or tunnel and idle while waiting for the next request.
+type connTracker struct {
+	mx           sync.Mutex
+	shuttingDown bool
+	listeners    map[net.Listener]bool
+	conns        map[*trackedConn]bool
+}
+
+type trackedConn struct {
+	net.Conn
+	active bool
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[*trackedConn]bool),
+	}
+}
+
+func (ct *connTracker) addListener(l net.Listener) bool {
+	ct.mx.Lock()
+	defer ct.mx.Unlock()
+	if ct.shuttingDown {
+		return false
+	}
+	ct.listeners[l] = true
+	return true
+}
+
+func (ct *connTracker) removeListener(l net.Listener) {
+	ct.mx.Lock()
+	delete(ct.listeners, l)
+	ct.mx.Unlock()
+}
+
+// listenerStatus returns the number of listeners being served and whether the
+// proxy is shutting down.
+func (ct *connTracker) listenerStatus() (int, bool) {
+	ct.mx.Lock()
+	defer ct.mx.Unlock()
+	return len(ct.listeners), ct.shuttingDown
+}
+
+func (ct *connTracker) isShuttingDown() bool {
+	ct.mx.Lock()
+	defer ct.mx.Unlock()
+	return ct.shuttingDown
+}
+
+// add starts tracking conn, returning nil if the proxy is shutting down.
+func (ct *connTracker) add(conn net.Conn, active bool) *trackedConn {
+	ct.mx.Lock()
+	defer ct.mx.Unlock()
+	if ct.shuttingDown {
+		return nil
+	}
+	tc := &trackedConn{Conn: conn, active: active}
+	ct.conns[tc] = true
+	return tc
+}
+
+func (ct *connTracker) remove(tc *trackedConn) {
+	ct.mx.Lock()
+	delete(ct.conns, tc)
+	ct.mx.Unlock()
+}
+
+// setActive marks the connection tracked in ctx (if any) as active or idle. It
+// returns false if the connection was marked idle while shutting down, in
+// which case the caller should stop processing the connection.
+func (ct *connTracker) setActive(ctx context.Context, active bool) bool {
+	tc, _ := ctx.Value(ctxKeyTrackedConn).(*trackedConn)
+	if tc == nil {
+		return true
+	}
+	ct.mx.Lock()
+	defer ct.mx.Unlock()
+	tc.active = active
+	return active || !ct.shuttingDown
+}
+
+// shutdown stops accepting new connections, closes idle connections and
+// returns the number of connections that are still active.
+func (ct *connTracker) shutdown() int {
+	ct.mx.Lock()
+	defer ct.mx.Unlock()
+	ct.shuttingDown = true
+	for l := range ct.listeners {
+		l.Close()
+	}
+	active := 0
+	for tc := range ct.conns {
+		if tc.active {
+			active++
+		} else {
+			tc.Close()
+		}
+	}
+	return active
+}
+
+// numActive returns the number of connections that are still active.
+func (ct *connTracker) numActive() int {
+	ct.mx.Lock()
+	defer ct.mx.Unlock()
+	active := 0
+	for tc := range ct.conns {
+		if tc.active {
+			active++
+		}
+	}
+	return active
+}
+
+// closeAll closes all remaining connections, returning how many were still
+// active.
+func (ct *connTracker) closeAll() int {
+	ct.mx.Lock()
+	defer ct.mx.Unlock()
+	aborted := 0
+	for tc := range ct.conns {
+		if tc.active {
+			aborted++
+		}
+		tc.Close()
+	}
+	return aborted
+}
+
+// Shutdown implements the interface Proxy
+func (proxy *proxy) Shutdown(ctx context.Context) (drained int, aborted int, err error) {
+	active := proxy.tracker.shutdown()
+	if proxy.accounting != nil {
+		// Flush once the remaining tunnels are done
+		defer proxy.accounting.close()
+	}
+	if proxy.pool != nil {
+		proxy.pool.CloseIdleConnections()
+	}
+	proxy.h2Transport.CloseIdleConnections()
+	if proxy.warm != nil {
+		proxy.warm.close()
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		remaining := proxy.tracker.numActive()
+		if remaining == 0 {
+			return active, 0, nil
+		}
+		select {
+		case <-ctx.Done():
+			aborted = proxy.tracker.closeAll()
+			drained = active - aborted
+			if drained < 0 {
+				drained = 0
+			}
+			log.Debugf("Shut down after draining %d and aborting %d connections", drained, aborted)
+			return drained, aborted, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
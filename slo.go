@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	sloBuckets = 10
+
+	defaultSLOWindow          = 5 * time.Minute
+	defaultSLOObjective       = 0.99
+	defaultSLOMaxDestinations = 1000
+)
+
+var (
+	// sloLatencyBounds are the upper bounds of the latency histogram buckets
+	// from which percentiles are estimated, followed by an unbounded bucket.
+	sloLatencyBounds = [...]time.Duration{
+		time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+		10 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond,
+		100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+		time.Second, 2 * time.Second, 5 * time.Second,
+		10 * time.Second, 30 * time.Second, time.Minute,
+	}
+
+	sloQuantiles = []float64{0.5, 0.9, 0.99}
+)
+
+// SLOOptions configures an SLOTracker.
+type SLOOptions struct {
+	// Window is how far back outcomes count towards success rates and
+	// latencies, defaults to 5 minutes.
+	Window time.Duration
+
+	// Objective is the fraction of tunnels and requests to each destination
+	// that are meant to succeed, from which the remaining error budget is
+	// calculated. Defaults to 0.99.
+	Objective float64
+
+	// MaxDestinations limits how many destinations are tracked at once, the
+	// ones seen least recently being dropped first. Defaults to 1000.
+	MaxDestinations int
+}
+
+// SLOTracker maintains rolling success rates and latency percentiles for each
+// upstream destination (host:port), see Opts.SLO. For tunnels, the outcome is
+// that of dialing upstream and the latency that of the dial. For forwarded
+// requests, it's the time to the response headers, and responses with a 5xx
+// status count as failures. Tunnels and requests that clients abandon, and
+// those that fail without reaching upstream (see CircuitBreaker and
+// DialFailureTTL), don't count.
+type SLOTracker struct {
+	opts       SLOOptions
+	bucketSize time.Duration
+
+	mx           sync.Mutex
+	destinations map[string]*destinationOutcomes
+}
+
+type destinationOutcomes struct {
+	lastSeen time.Time
+	buckets  [sloBuckets]outcomeBucket
+}
+
+type outcomeBucket struct {
+	start     int64
+	total     int64
+	failures  int64
+	latencies [len(sloLatencyBounds) + 1]int64
+}
+
+// DestinationSLO reports how a destination has fared within the window of an
+// SLOTracker.
+type DestinationSLO struct {
+	Destination string  `json:"destination"`
+	Total       int64   `json:"total"`
+	Failures    int64   `json:"failures"`
+	SuccessRate float64 `json:"successRate"`
+
+	// ErrorBudgetRemaining is the fraction of the failures allowed by the
+	// objective that's still left, negative once the objective is missed.
+	ErrorBudgetRemaining float64 `json:"errorBudgetRemaining"`
+
+	// The latency percentiles of successful tunnels and requests in seconds,
+	// estimated from a histogram
+	LatencyP50 float64 `json:"latencyP50Seconds"`
+	LatencyP90 float64 `json:"latencyP90Seconds"`
+	LatencyP99 float64 `json:"latencyP99Seconds"`
+}
+
+// NewSLOTracker creates an SLOTracker with the given options, which may be nil
+// for the defaults.
+func NewSLOTracker(opts *SLOOptions) *SLOTracker {
+	t := &SLOTracker{destinations: make(map[string]*destinationOutcomes)}
+	if opts != nil {
+		t.opts = *opts
+	}
+	if t.opts.Window <= 0 {
+		t.opts.Window = defaultSLOWindow
+	}
+	if t.opts.Objective <= 0 || t.opts.Objective >= 1 {
+		t.opts.Objective = defaultSLOObjective
+	}
+	if t.opts.MaxDestinations <= 0 {
+		t.opts.MaxDestinations = defaultSLOMaxDestinations
+	}
+	t.bucketSize = t.opts.Window / sloBuckets
+	if t.bucketSize <= 0 {
+		t.bucketSize = 1
+	}
+	return t
+}
+
+// record records the outcome of a tunnel or request to dest.
+func (t *SLOTracker) record(ctx context.Context, dest string, latency time.Duration, success bool) {
+	if !success && ctx.Err() != nil {
+		return
+	}
+	now := time.Now()
+	start := now.UnixNano() / int64(t.bucketSize)
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	outcomes := t.destinations[dest]
+	if outcomes == nil {
+		if len(t.destinations) >= t.opts.MaxDestinations {
+			t.evictStalest()
+		}
+		outcomes = &destinationOutcomes{}
+		t.destinations[dest] = outcomes
+	}
+	outcomes.lastSeen = now
+	bucket := &outcomes.buckets[start%sloBuckets]
+	if bucket.start != start {
+		*bucket = outcomeBucket{start: start}
+	}
+	bucket.total++
+	if !success {
+		bucket.failures++
+		return
+	}
+	i := sort.Search(len(sloLatencyBounds), func(i int) bool { return latency <= sloLatencyBounds[i] })
+	bucket.latencies[i]++
+}
+
+func (t *SLOTracker) evictStalest() {
+	var stalest string
+	var stalestSeen time.Time
+	for dest, outcomes := range t.destinations {
+		if stalest == "" || outcomes.lastSeen.Before(stalestSeen) {
+			stalest, stalestSeen = dest, outcomes.lastSeen
+		}
+	}
+	delete(t.destinations, stalest)
+}
+
+// Snapshot reports on the destinations that were tunneled or forwarded to
+// within the window, sorted by destination.
+func (t *SLOTracker) Snapshot() []*DestinationSLO {
+	oldest := time.Now().UnixNano()/int64(t.bucketSize) - sloBuckets + 1
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	result := make([]*DestinationSLO, 0, len(t.destinations))
+	for dest, outcomes := range t.destinations {
+		slo := &DestinationSLO{Destination: dest}
+		var latencies [len(sloLatencyBounds) + 1]int64
+		for _, bucket := range outcomes.buckets {
+			if bucket.start < oldest {
+				continue
+			}
+			slo.Total += bucket.total
+			slo.Failures += bucket.failures
+			for i, n := range bucket.latencies {
+				latencies[i] += n
+			}
+		}
+		if slo.Total == 0 {
+			// Nothing within the window, so forget about dest
+			delete(t.destinations, dest)
+			continue
+		}
+		slo.SuccessRate = float64(slo.Total-slo.Failures) / float64(slo.Total)
+		slo.ErrorBudgetRemaining = 1 - (1-slo.SuccessRate)/(1-t.opts.Objective)
+		slo.LatencyP50 = latencyPercentile(latencies[:], 0.5)
+		slo.LatencyP90 = latencyPercentile(latencies[:], 0.9)
+		slo.LatencyP99 = latencyPercentile(latencies[:], 0.99)
+		result = append(result, slo)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Destination < result[j].Destination
+	})
+	return result
+}
+
+// latencyPercentile estimates the q quantile of the histogram counts in
+// seconds, interpolating linearly within the bucket that it falls into.
+func latencyPercentile(counts []int64, q float64) float64 {
+	var total int64
+	for _, n := range counts {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := q * float64(total)
+	var cumulative int64
+	for i, n := range counts {
+		if n == 0 || float64(cumulative+n) < rank {
+			cumulative += n
+			continue
+		}
+		var lower time.Duration
+		if i > 0 {
+			lower = sloLatencyBounds[i-1]
+		}
+		if i == len(sloLatencyBounds) {
+			return lower.Seconds()
+		}
+		upper := sloLatencyBounds[i]
+		fraction := (rank - float64(cumulative)) / float64(n)
+		return (lower + time.Duration(fraction*float64(upper-lower))).Seconds()
+	}
+	return sloLatencyBounds[len(sloLatencyBounds)-1].Seconds()
+}
+
+// writeTo writes the snapshot as Prometheus gauges, see
+// PrometheusMetrics.ExportSLO.
+func (t *SLOTracker) writeTo(w io.Writer, m *PrometheusMetrics) {
+	slos := t.Snapshot()
+	m.writeHeader(w, "destination_success_ratio", "gauge", "Fraction of tunnels and requests to each destination that succeeded within the SLO window.")
+	for _, slo := range slos {
+		fmt.Fprintf(w, "%s_destination_success_ratio{destination=%q} %v\n", m.namespace, slo.Destination, slo.SuccessRate)
+	}
+	m.writeHeader(w, "destination_error_budget_remaining", "gauge", "Fraction of each destination's error budget that's left within the SLO window.")
+	for _, slo := range slos {
+		fmt.Fprintf(w, "%s_destination_error_budget_remaining{destination=%q} %v\n", m.namespace, slo.Destination, slo.ErrorBudgetRemaining)
+	}
+	m.writeHeader(w, "destination_latency_seconds", "summary", "Latency of successful tunnels and requests to each destination within the SLO window.")
+	for _, slo := range slos {
+		for i, value := range []float64{slo.LatencyP50, slo.LatencyP90, slo.LatencyP99} {
+			fmt.Fprintf(w, "%s_destination_latency_seconds{destination=%q,quantile=\"%s\"} %v\n", m.namespace, slo.Destination, strconv.FormatFloat(sloQuantiles[i], 'g', -1, 64), value)
+		}
+		fmt.Fprintf(w, "%s_destination_latency_seconds_count{destination=%q} %d\n", m.namespace, slo.Destination, slo.Total-slo.Failures)
+	}
+}
+
+// recordForwardedSLO records the outcome of forwarding req, if Opts.SLO is
+// configured.
+func (proxy *proxy) recordForwardedSLO(req *http.Request, latency time.Duration, resp *http.Response, err error) {
+	if proxy.SLO == nil {
+		return
+	}
+	dest, destErr := requestDestination(req)
+	if destErr != nil {
+		return
+	}
+	proxy.SLO.record(req.Context(), dest.Addr(), latency, err == nil && resp.StatusCode < http.StatusInternalServerError)
+}
+
+func (proxy *proxy) adminSLO(w http.ResponseWriter, req *http.Request) {
+	if proxy.SLO == nil {
+		writeAdminJSON(w, []*DestinationSLO{})
+		return
+	}
+	writeAdminJSON(w, proxy.SLO.Snapshot())
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	ht "net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSLOTracker(t *testing.T) {
+	tracker := NewSLOTracker(&SLOOptions{Window: time.Minute, Objective: 0.9, MaxDestinations: 2})
+	ctx := context.Background()
+	for i := 0; i < 8; i++ {
+		tracker.record(ctx, "a:443", 10*time.Millisecond, true)
+	}
+	tracker.record(ctx, "a:443", 100*time.Millisecond, true)
+	tracker.record(ctx, "a:443", time.Second, false)
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	tracker.record(cancelled, "a:443", time.Second, false)
+
+	slos := tracker.Snapshot()
+	require.Len(t, slos, 1)
+	slo := slos[0]
+	assert.Equal(t, "a:443", slo.Destination)
+	assert.EqualValues(t, 10, slo.Total, "Abandoned tunnels shouldn't count")
+	assert.EqualValues(t, 1, slo.Failures)
+	assert.InDelta(t, 0.9, slo.SuccessRate, 0.0001)
+	assert.InDelta(t, 0, slo.ErrorBudgetRemaining, 0.0001, "Error budget should be used up")
+	assert.True(t, slo.LatencyP50 > 0.005 && slo.LatencyP50 <= 0.01, "Unexpected p50 %v", slo.LatencyP50)
+	assert.True(t, slo.LatencyP99 > 0.05 && slo.LatencyP99 <= 0.1, "Unexpected p99 %v", slo.LatencyP99)
+
+	tracker.record(ctx, "b:443", time.Millisecond, true)
+	tracker.record(ctx, "c:443", time.Millisecond, true)
+	slos = tracker.Snapshot()
+	require.Len(t, slos, 2)
+	assert.Equal(t, "b:443", slos[0].Destination, "Stalest destination should have been dropped")
+	assert.Equal(t, "c:443", slos[1].Destination)
+}
+
+func TestSLO(t *testing.T) {
+	origin := ht.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer origin.Close()
+	tracker := NewSLOTracker(nil)
+	metrics := NewPrometheusMetrics("proxy")
+	metrics.ExportSLO(tracker)
+	p := newProxy(&Opts{SLO: tracker, Metrics: metrics})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go p.Serve(l)
+
+	for _, path := range []string{"/", "/fail"} {
+		resp, err := proxiedRequest(t, l.Addr().String(), http.MethodGet, origin.URL+path)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	dest := strings.TrimPrefix(origin.URL, "http://")
+
+	admin := ht.NewServer(p.AdminHandler())
+	defer admin.Close()
+	resp, err := admin.Client().Get(admin.URL + "/slo")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var slos []*DestinationSLO
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&slos))
+	require.Len(t, slos, 1)
+	assert.Equal(t, dest, slos[0].Destination)
+	assert.EqualValues(t, 2, slos[0].Total)
+	assert.EqualValues(t, 1, slos[0].Failures, "5xx responses should count as failures")
+
+	var buf bytes.Buffer
+	metrics.WriteTo(&buf)
+	assert.Contains(t, buf.String(), `proxy_destination_success_ratio{destination="`+dest+`"} 0.5`)
+	assert.Contains(t, buf.String(), `proxy_destination_latency_seconds_count{destination="`+dest+`"} 1`)
+}
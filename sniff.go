@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/getlantern/errors"
+)
+
+// TunnelProtocol is the protocol that a client speaks in a tunnel, as
+// classified by sniffing the data it sends first.
+type TunnelProtocol string
+
+const (
+	// TunnelProtocolUnknown is a protocol that isn't recognized
+	TunnelProtocolUnknown TunnelProtocol = "unknown"
+
+	// TunnelProtocolTLS is TLS, recognized by its handshake record
+	TunnelProtocolTLS TunnelProtocol = "tls"
+
+	// TunnelProtocolHTTP is plain HTTP/1.x, or HTTP/2 with prior knowledge
+	TunnelProtocolHTTP TunnelProtocol = "http"
+
+	// TunnelProtocolSSH is SSH, recognized by its version banner
+	TunnelProtocolSSH TunnelProtocol = "ssh"
+
+	// TunnelProtocolBitTorrent is the BitTorrent peer wire protocol,
+	// recognized by its handshake
+	TunnelProtocolBitTorrent TunnelProtocol = "bittorrent"
+
+	ctxKeyTunnelProtocol = contextKey("tunnelProtocol")
+)
+
+// protocolSignatures are the prefixes that identify protocols.
+var protocolSignatures = []struct {
+	prefix   []byte
+	protocol TunnelProtocol
+}{
+	{[]byte("SSH-"), TunnelProtocolSSH},
+	{[]byte("\x13BitTorrent protocol"), TunnelProtocolBitTorrent},
+	{[]byte("PRI * HTTP/2.0"), TunnelProtocolHTTP},
+	{[]byte("GET "), TunnelProtocolHTTP},
+	{[]byte("HEAD "), TunnelProtocolHTTP},
+	{[]byte("POST "), TunnelProtocolHTTP},
+	{[]byte("PUT "), TunnelProtocolHTTP},
+	{[]byte("DELETE "), TunnelProtocolHTTP},
+	{[]byte("OPTIONS "), TunnelProtocolHTTP},
+	{[]byte("PATCH "), TunnelProtocolHTTP},
+	{[]byte("TRACE "), TunnelProtocolHTTP},
+	{[]byte("CONNECT "), TunnelProtocolHTTP},
+}
+
+// maxSniffBytes is the most that's held back from upstream while sniffing,
+// enough for the longest signature.
+const maxSniffBytes = 20
+
+// ProtocolPolicy decides whether tunnels may carry the protocols that their
+// clients speak, see Opts.ProtocolPolicy.
+type ProtocolPolicy interface {
+	// CheckProtocol is consulted once the protocol of a tunnel to dest has
+	// been sniffed. It returns nil if the tunnel may continue and otherwise an
+	// error explaining why it was closed.
+	CheckProtocol(ctx context.Context, dest *Destination, protocol TunnelProtocol) error
+}
+
+// ProtocolPolicyFunc adapts a function to a ProtocolPolicy
+type ProtocolPolicyFunc func(ctx context.Context, dest *Destination, protocol TunnelProtocol) error
+
+// CheckProtocol implements the interface ProtocolPolicy
+func (f ProtocolPolicyFunc) CheckProtocol(ctx context.Context, dest *Destination, protocol TunnelProtocol) error {
+	return f(ctx, dest, protocol)
+}
+
+// RequireTLSOnPorts returns a ProtocolPolicy that closes tunnels to the given
+// destination ports, for example 443, unless they carry TLS.
+func RequireTLSOnPorts(ports ...int) ProtocolPolicy {
+	required := make(map[int]bool, len(ports))
+	for _, port := range ports {
+		required[port] = true
+	}
+	return ProtocolPolicyFunc(func(ctx context.Context, dest *Destination, protocol TunnelProtocol) error {
+		if required[dest.Port] && protocol != TunnelProtocolTLS {
+			return errors.New("Only TLS is allowed to port %d, not %v", dest.Port, protocol)
+		}
+		return nil
+	})
+}
+
+// DenyProtocols returns a ProtocolPolicy that closes tunnels carrying any of
+// the given protocols.
+func DenyProtocols(protocols ...TunnelProtocol) ProtocolPolicy {
+	return ProtocolPolicyFunc(func(ctx context.Context, dest *Destination, protocol TunnelProtocol) error {
+		for _, denied := range protocols {
+			if protocol == denied {
+				return errors.New("Tunneling %v is not allowed", protocol)
+			}
+		}
+		return nil
+	})
+}
+
+// SniffProtocol classifies the protocol that data, the first bytes sent by
+// the client of a tunnel, belongs to. If data is too short to tell, complete
+// is false.
+func SniffProtocol(data []byte) (protocol TunnelProtocol, complete bool) {
+	if len(data) >= 3 && data[0] == 0x16 && data[1] == 0x03 && data[2] <= 0x04 {
+		return TunnelProtocolTLS, true
+	}
+	incomplete := len(data) < 3 && bytes.HasPrefix([]byte{0x16, 0x03}, data)
+	for _, sig := range protocolSignatures {
+		if bytes.HasPrefix(data, sig.prefix) {
+			return sig.protocol, true
+		}
+		if bytes.HasPrefix(sig.prefix, data) {
+			incomplete = true
+		}
+	}
+	return TunnelProtocolUnknown, !incomplete
+}
+
+// CurrentTunnelProtocol returns the protocol sniffed for the tunnel associated
+// with ctx, or "" if it isn't known (yet). Tunnels are only sniffed with
+// Opts.SniffTunnels or Opts.ProtocolPolicy, once their client sends data.
+func CurrentTunnelProtocol(ctx context.Context) TunnelProtocol {
+	holder, ok := ctx.Value(ctxKeyTunnelProtocol).(*atomic.Value)
+	if !ok {
+		return ""
+	}
+	protocol, _ := holder.Load().(TunnelProtocol)
+	return protocol
+}
+
+func (proxy *proxy) sniffsTunnels() bool {
+	return proxy.SniffTunnels || proxy.ProtocolPolicy != nil
+}
+
+// sniffTunnel wraps downstream so that the protocol of the tunnel to
+// upstreamAddr is sniffed from what the client sends first. The returned
+// context makes the protocol available with CurrentTunnelProtocol.
+func (proxy *proxy) sniffTunnel(ctx context.Context, upstreamAddr string, upstream net.Conn, downstream net.Conn) (context.Context, *protocolSniffer, net.Conn) {
+	holder := &atomic.Value{}
+	ctx = context.WithValue(ctx, ctxKeyTunnelProtocol, holder)
+	sniffer := &protocolSniffer{
+		ctx:          ctx,
+		proxy:        proxy,
+		upstreamAddr: upstreamAddr,
+		upstream:     upstream,
+		src:          downstream,
+		protocol:     holder,
+	}
+	return ctx, sniffer, &readerConn{downstream, sniffer}
+}
+
+// protocolSniffer reads from src, holding back data until it has sniffed the
+// protocol. Once the protocol is known and allowed, data passes through
+// unchanged.
+type protocolSniffer struct {
+	ctx          context.Context
+	proxy        *proxy
+	upstreamAddr string
+	upstream     net.Conn
+	src          io.Reader
+	protocol     *atomic.Value
+	buf          []byte
+	pending      []byte
+	sniffed      bool
+	denied       error
+}
+
+func (ps *protocolSniffer) Read(b []byte) (int, error) {
+	if !ps.sniffed {
+		if err := ps.sniff(); err != nil {
+			return 0, err
+		}
+	}
+	if len(ps.pending) > 0 {
+		n := copy(b, ps.pending)
+		ps.pending = ps.pending[n:]
+		return n, nil
+	}
+	return ps.src.Read(b)
+}
+
+// sniff reads until the protocol is known and checks it against
+// ProtocolPolicy.
+func (ps *protocolSniffer) sniff() error {
+	b := make([]byte, maxSniffBytes)
+	for {
+		n, err := ps.src.Read(b[len(ps.buf):])
+		ps.buf = b[:len(ps.buf)+n]
+		protocol, complete := SniffProtocol(ps.buf)
+		if complete || len(ps.buf) == maxSniffBytes || (err != nil && len(ps.buf) > 0) {
+			ps.sniffed = true
+			ps.pending = ps.buf
+			ps.protocol.Store(protocol)
+			log.Tracef("Sniffed %v in tunnel to %v", protocol, ps.upstreamAddr)
+			if denyErr := ps.check(protocol); denyErr != nil {
+				return denyErr
+			}
+			// err, if any, is read again from src once pending is drained
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (ps *protocolSniffer) check(protocol TunnelProtocol) error {
+	policy := ps.proxy.ProtocolPolicy
+	if policy == nil {
+		return nil
+	}
+	dest, err := parseDestination(ps.upstreamAddr, 0)
+	if err == nil {
+		err = policy.CheckProtocol(ps.ctx, dest, protocol)
+	}
+	if err == nil {
+		return nil
+	}
+	ps.denied = &PolicyDeniedError{Addr: ps.upstreamAddr, Phase: PhaseSniff, Policy: PolicyProtocol, Err: errors.New("Tunnel to %v denied: %v", ps.upstreamAddr, err)}
+	log.Debug(ps.denied)
+	// Closing upstream stops copying in both directions, before anything that
+	// was held back reaches upstream
+	ps.pending = nil
+	ps.upstream.Close()
+	return ps.denied
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSniffProtocol(t *testing.T) {
+	for data, expected := range map[string]TunnelProtocol{
+		"\x16\x03\x01\x02\x00":               TunnelProtocolTLS,
+		"GET / HTTP/1.1\r\n":                 TunnelProtocolHTTP,
+		"PRI * HTTP/2.0\r\n":                 TunnelProtocolHTTP,
+		"SSH-2.0-OpenSSH_9.6\r\n":            TunnelProtocolSSH,
+		"\x13BitTorrent protocol\x00\x00":    TunnelProtocolBitTorrent,
+		"\x00\x01 hello there, how are you?": TunnelProtocolUnknown,
+		"GETTING":                            TunnelProtocolUnknown,
+	} {
+		protocol, complete := SniffProtocol([]byte(data))
+		assert.True(t, complete, "%q should be complete", data)
+		assert.Equal(t, expected, protocol, "%q", data)
+	}
+	for _, data := range []string{"", "\x16", "\x16\x03", "SS", "PO", "\x13BitTor"} {
+		_, complete := SniffProtocol([]byte(data))
+		assert.False(t, complete, "%q should need more data", data)
+	}
+}
+
+func TestProtocolPolicy(t *testing.T) {
+	received := make(chan string, 10)
+	origin, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer origin.Close()
+	go func() {
+		for {
+			conn, err := origin.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b, _ := ioutil.ReadAll(io.LimitReader(conn, 3))
+				received <- string(b)
+				conn.Write(b)
+			}()
+		}
+	}()
+	_, portString, _ := net.SplitHostPort(origin.Addr().String())
+	port, _ := strconv.Atoi(portString)
+
+	protocols := make(chan TunnelProtocol, 10)
+	l := serveProxy(t, &Opts{
+		OKWaitsForUpstream: true,
+		ProtocolPolicy:     RequireTLSOnPorts(port),
+		OnTunnelComplete: func(ctx context.Context, stats *TunnelStats) {
+			protocols <- CurrentTunnelProtocol(ctx)
+		},
+	})
+	defer l.Close()
+
+	conn, br, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = conn.Write([]byte("\x16\x03\x01"))
+	require.NoError(t, err)
+	echoed := make([]byte, 3)
+	_, err = io.ReadFull(br, echoed)
+	require.NoError(t, err)
+	assert.Equal(t, "\x16\x03\x01", string(echoed), "TLS should pass")
+	assert.Equal(t, "\x16\x03\x01", <-received)
+	conn.Close()
+	assert.Equal(t, TunnelProtocolTLS, <-protocols)
+
+	conn, br, resp = openTunnel(t, l.Addr().String(), origin.Addr().String())
+	defer conn.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n"))
+	require.NoError(t, err)
+	_, err = br.ReadByte()
+	assert.Error(t, err, "Tunnel that isn't TLS should be closed")
+	assert.Equal(t, TunnelProtocolHTTP, <-protocols)
+	assert.Equal(t, "", <-received, "Nothing should have reached upstream")
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const defaultDialerTimeout = 30 * time.Second
+
+// DialerOptions tunes the sockets of the upstream connections dialed by
+// NewDialer. Zero values leave the operating system's defaults alone. Options
+// marked (Linux only) make dials fail elsewhere.
+type DialerOptions struct {
+	// Timeout limits how long each dial may take, defaults to 30 seconds. A
+	// deadline on the dial's context takes precedence.
+	Timeout time.Duration
+
+	// DisableNoDelay, if true, clears TCP_NODELAY so that small writes are
+	// coalesced (Nagle's algorithm). Go sets TCP_NODELAY by default.
+	DisableNoDelay bool
+
+	// KeepAlive is the interval between TCP keepalive probes. Defaults to
+	// Go's default of 15 seconds, a negative value disables keepalives.
+	KeepAlive time.Duration
+
+	// ReusePort, if true, sets SO_REUSEPORT so that several sockets can be
+	// bound to the same LocalAddr. (Linux only)
+	ReusePort bool
+
+	// FastOpen, if true, sets TCP_FASTOPEN_CONNECT so that data written right
+	// after connecting is carried by the SYN, if the destination supports TCP
+	// Fast Open. Kernels that don't support it dial as usual. (Linux only)
+	FastOpen bool
+
+	// TOS, if specified, marks packets with this type of service byte (IP_TOS
+	// for IPv4, IPV6_TCLASS for IPv6). The DSCP is the upper six bits, e.g.
+	// 0xb8 for Expedited Forwarding. (Linux only)
+	TOS int
+
+	// Interface, if specified, binds sockets to the named network interface
+	// (SO_BINDTODEVICE) so that they're routed through it. (Linux only)
+	Interface string
+
+	// Mark, if specified, sets SO_MARK so that policy routing and firewall
+	// rules can match the connections. Requires CAP_NET_ADMIN. (Linux only)
+	Mark int
+
+	// LocalAddr, if specified, is the local address to dial from, e.g.
+	// "192.0.2.1:0".
+	LocalAddr string
+}
+
+// NewDialer returns a DialFunc that dials upstream directly, applying the
+// given socket options. If Opts.Dial isn't set, the proxy uses NewDialer with
+// Opts.DialerOptions.
+func NewDialer(opts *DialerOptions) DialFunc {
+	if opts == nil {
+		opts = &DialerOptions{}
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultDialerTimeout
+	}
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		dialer := &net.Dialer{
+			KeepAlive: opts.KeepAlive,
+			Control: func(network, address string, c syscall.RawConn) error {
+				var sockErr error
+				err := c.Control(func(fd uintptr) {
+					sockErr = setSocketOptions(opts, network, fd)
+				})
+				if err != nil {
+					return err
+				}
+				return sockErr
+			},
+		}
+		if !isIPNetwork(network) {
+			// Socket options and local addresses only apply to IP sockets, not to
+			// those routed elsewhere by NetworkRouter
+			dialer.Control = nil
+		} else if opts.LocalAddr != "" {
+			local, err := resolveLocalAddr(network, opts.LocalAddr)
+			if err != nil {
+				return nil, errors.New("Unable to resolve local address %v: %v", opts.LocalAddr, err)
+			}
+			dialer.LocalAddr = local
+		}
+		if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if tcpConn, ok := conn.(*net.TCPConn); ok && opts.DisableNoDelay {
+			if err := tcpConn.SetNoDelay(false); err != nil {
+				conn.Close()
+				return nil, errors.New("Unable to disable TCP_NODELAY: %v", err)
+			}
+		}
+		return conn, nil
+	}
+}
+
+func resolveLocalAddr(network, addr string) (net.Addr, error) {
+	if isUDPNetwork(network) {
+		return net.ResolveUDPAddr(network, addr)
+	}
+	return net.ResolveTCPAddr(network, addr)
+}
+
+func isUDPNetwork(network string) bool {
+	return network == "udp" || network == "udp4" || network == "udp6"
+}
+
+func isIPv6Network(network string) bool {
+	return network == "tcp6" || network == "udp6"
+}
@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"syscall"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	// These aren't defined by the syscall package
+	soReusePort        = 0xf
+	tcpFastOpenConnect = 30
+)
+
+// setSocketOptions applies opts to the socket fd before it's connected.
+func setSocketOptions(opts *DialerOptions, network string, fd uintptr) error {
+	sock := int(fd)
+	if opts.ReusePort {
+		if err := syscall.SetsockoptInt(sock, syscall.SOL_SOCKET, soReusePort, 1); err != nil {
+			return errors.New("Unable to set SO_REUSEPORT: %v", err)
+		}
+	}
+	if opts.FastOpen && !isUDPNetwork(network) {
+		if err := syscall.SetsockoptInt(sock, syscall.IPPROTO_TCP, tcpFastOpenConnect, 1); err != nil {
+			log.Debugf("Unable to enable TCP Fast Open, dialing without it: %v", err)
+		}
+	}
+	if opts.TOS != 0 {
+		var err error
+		if isIPv6Network(network) {
+			err = syscall.SetsockoptInt(sock, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, opts.TOS)
+		} else {
+			err = syscall.SetsockoptInt(sock, syscall.IPPROTO_IP, syscall.IP_TOS, opts.TOS)
+		}
+		if err != nil {
+			return errors.New("Unable to set type of service %#x: %v", opts.TOS, err)
+		}
+	}
+	if opts.Interface != "" {
+		if err := syscall.BindToDevice(sock, opts.Interface); err != nil {
+			return errors.New("Unable to bind to interface %v: %v", opts.Interface, err)
+		}
+	}
+	if opts.Mark != 0 {
+		if err := syscall.SetsockoptInt(sock, syscall.SOL_SOCKET, syscall.SO_MARK, opts.Mark); err != nil {
+			return errors.New("Unable to set SO_MARK %d: %v", opts.Mark, err)
+		}
+	}
+	return nil
+}
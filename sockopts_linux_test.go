@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getsockopt(t *testing.T, conn net.Conn, level, opt int) int {
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	require.NoError(t, err)
+	var value int
+	var sockErr error
+	require.NoError(t, raw.Control(func(fd uintptr) {
+		value, sockErr = syscall.GetsockoptInt(int(fd), level, opt)
+	}))
+	require.NoError(t, sockErr)
+	return value
+}
+
+func TestNewDialerSocketOptions(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	dial := NewDialer(&DialerOptions{DisableNoDelay: true, ReusePort: true, FastOpen: true, TOS: 0xb8})
+	conn, err := dial(context.Background(), true, "tcp4", origin.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, 0, getsockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY))
+	assert.Equal(t, 1, getsockopt(t, conn, syscall.SOL_SOCKET, soReusePort))
+	assert.Equal(t, 0xb8, getsockopt(t, conn, syscall.IPPROTO_IP, syscall.IP_TOS))
+
+	conn, err = NewDialer(&DialerOptions{Mark: 42, Interface: "lo"})(context.Background(), true, "tcp4", origin.Addr().String())
+	if err != nil {
+		t.Skipf("Unable to set privileged socket options: %v", err)
+	}
+	defer conn.Close()
+	assert.Equal(t, 42, getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_MARK))
+
+	_, err = NewDialer(&DialerOptions{Interface: "nosuchinterface0"})(context.Background(), true, "tcp4", origin.Addr().String())
+	assert.Error(t, err)
+}
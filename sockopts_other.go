@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"github.com/getlantern/errors"
+)
+
+// setSocketOptions fails if any of the options that are only supported on
+// Linux are set.
+func setSocketOptions(opts *DialerOptions, network string, fd uintptr) error {
+	if opts.ReusePort || opts.FastOpen || opts.TOS != 0 || opts.Interface != "" || opts.Mark != 0 {
+		return errors.New("ReusePort, FastOpen, TOS, Interface and Mark are only supported on Linux")
+	}
+	return nil
+}
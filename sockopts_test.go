@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDialer(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	dial := NewDialer(&DialerOptions{DisableNoDelay: true, LocalAddr: "127.0.0.1:0"})
+	conn, err := dial(context.Background(), true, "tcp", origin.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "127.0.0.1", conn.LocalAddr().(*net.TCPAddr).IP.String())
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer udp.Close()
+	conn, err = dial(context.Background(), true, "udp", udp.LocalAddr().String())
+	require.NoError(t, err, "Local address should apply to UDP too")
+	conn.Close()
+
+	_, err = NewDialer(&DialerOptions{LocalAddr: "bogus"})(context.Background(), true, "tcp", origin.Addr().String())
+	assert.Error(t, err)
+
+	l := serveProxy(t, &Opts{DialerOptions: &DialerOptions{KeepAlive: -1}})
+	defer l.Close()
+	tunnel, br, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+	defer tunnel.Close()
+	require.Equal(t, 200, resp.StatusCode)
+	_, err = tunnel.Write([]byte("hi"))
+	require.NoError(t, err)
+	echoed := make([]byte, 2)
+	_, err = br.Read(echoed)
+	require.NoError(t, err)
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	socks4Version = 0x04
+
+	socks4ReplyVersion  = 0x00
+	socks4ReplyGranted  = 0x5a
+	socks4ReplyRejected = 0x5b
+
+	// socks4MaxField limits the length of the null-terminated user ID and
+	// domain fields
+	socks4MaxField = 255
+)
+
+// readSOCKS4 reads the rest of a SOCKS4 or SOCKS4a request (following the
+// version). SOCKS4 has no means of authentication, so unless
+// SOCKS4BypassesAuth is set, requests are rejected if an Authenticator is
+// configured.
+func (proxy *proxy) readSOCKS4(in io.Reader, out io.Writer) (*socksRequest, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return nil, errors.New("Unable to read SOCKS4 request: %v", err)
+	}
+	command, port, ip := header[0], binary.BigEndian.Uint16(header[1:3]), net.IP(header[3:7])
+	if _, err := readSOCKS4Field(in); err != nil {
+		return nil, errors.New("Unable to read SOCKS4 user ID: %v", err)
+	}
+	host := ip.String()
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		// SOCKS4a, the domain follows the user ID
+		domain, err := readSOCKS4Field(in)
+		if err != nil {
+			return nil, errors.New("Unable to read SOCKS4a domain: %v", err)
+		}
+		host = domain
+	}
+
+	if command != socksCmdConnect {
+		writeSOCKS4Reply(out, socksReplyCommandNotSupported, nil)
+		return nil, errors.New("Unsupported SOCKS4 command %d", command)
+	}
+	if proxy.currentConfig().Authenticator != nil && !proxy.SOCKS4BypassesAuth {
+		writeSOCKS4Reply(out, socksReplyNotAllowed, nil)
+		return nil, errors.New("SOCKS4 clients can't authenticate")
+	}
+	return &socksRequest{
+		protocol:     AccessProtocolSOCKS4,
+		upstreamAddr: net.JoinHostPort(host, strconv.Itoa(int(port))),
+		reply:        writeSOCKS4Reply,
+	}, nil
+}
+
+// readSOCKS4Field reads a null-terminated field byte by byte, so as to not
+// consume any data that follows it.
+func readSOCKS4Field(in io.Reader) (string, error) {
+	field := make([]byte, 0, 32)
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(in, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(field), nil
+		}
+		if len(field) == socks4MaxField {
+			return "", errors.New("Field exceeds %d bytes", socks4MaxField)
+		}
+		field = append(field, b[0])
+	}
+}
+
+// writeSOCKS4Reply writes a SOCKS4 reply for the given SOCKS5 reply code,
+// which SOCKS4 only distinguishes as granted or rejected.
+func writeSOCKS4Reply(out io.Writer, reply byte, addr net.Addr) error {
+	status := byte(socks4ReplyRejected)
+	if reply == socksReplySucceeded {
+		status = socks4ReplyGranted
+	}
+	msg := []byte{socks4ReplyVersion, status, 0, 0, 0, 0, 0, 0}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		if ip4 := tcpAddr.IP.To4(); ip4 != nil {
+			binary.BigEndian.PutUint16(msg[2:4], uint16(tcpAddr.Port))
+			copy(msg[4:], ip4)
+		}
+	}
+	_, err := out.Write(msg)
+	return err
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/getlantern/mockconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSOCKS4(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+	_, originPort, _ := net.SplitHostPort(origin.Addr().String())
+	port, _ := strconv.Atoi(originPort)
+
+	dialed := make(chan string, 10)
+	p := newProxy(&Opts{
+		Dial: func(ctx context.Context, isConnect bool, network, addr string) (net.Conn, error) {
+			dialed <- addr
+			return net.Dial(network, origin.Addr().String())
+		},
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go p.ServeSOCKS(l)
+
+	echo := func(t *testing.T, req []byte, replyLen int) []byte {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write(req)
+		require.NoError(t, err)
+		reply := make([]byte, replyLen)
+		_, err = io.ReadFull(conn, reply)
+		require.NoError(t, err)
+
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		echoed := make([]byte, 5)
+		_, err = io.ReadFull(conn, echoed)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(echoed))
+		return reply
+	}
+
+	t.Run("SOCKS4", func(t *testing.T) {
+		req := []byte{socks4Version, socksCmdConnect, byte(port >> 8), byte(port), 127, 0, 0, 1}
+		req = append(req, "user\x00"...)
+		reply := echo(t, req, 8)
+		assert.EqualValues(t, socks4ReplyVersion, reply[0])
+		assert.EqualValues(t, socks4ReplyGranted, reply[1])
+		assert.Equal(t, net.JoinHostPort("127.0.0.1", originPort), <-dialed)
+	})
+
+	t.Run("SOCKS4a", func(t *testing.T) {
+		req := []byte{socks4Version, socksCmdConnect, byte(port >> 8), byte(port), 0, 0, 0, 1}
+		req = append(req, "\x00thehost\x00"...)
+		reply := echo(t, req, 8)
+		assert.EqualValues(t, socks4ReplyGranted, reply[1])
+		assert.Equal(t, net.JoinHostPort("thehost", originPort), <-dialed)
+	})
+
+	t.Run("SOCKS5", func(t *testing.T) {
+		req := []byte{socks5Version, 1, socksAuthNone, socks5Version, socksCmdConnect, 0, socksAddrIPv4, 127, 0, 0, 1, byte(port >> 8), byte(port)}
+		reply := echo(t, req, 12)
+		assert.EqualValues(t, socksReplySucceeded, reply[3])
+		assert.Equal(t, net.JoinHostPort("127.0.0.1", originPort), <-dialed)
+	})
+}
+
+func TestSOCKS4Rejected(t *testing.T) {
+	auth := BasicAuth("test", func(username, password string) bool { return true })
+	handle := func(opts *Opts, req []byte) ([]byte, error) {
+		received := &bytes.Buffer{}
+		conn := mockconn.New(received, bytes.NewReader(req))
+		err := newProxy(opts).HandleSOCKS(context.Background(), conn, conn)
+		return received.Bytes(), err
+	}
+	connect := []byte{socks4Version, socksCmdConnect, 0, 80, 127, 0, 0, 1, 0}
+
+	out, err := handle(&Opts{Authenticator: auth}, connect)
+	assert.Error(t, err, "SOCKS4 should be rejected when authentication is required")
+	assert.Equal(t, []byte{socks4ReplyVersion, socks4ReplyRejected, 0, 0, 0, 0, 0, 0}, out)
+
+	out, err = handle(&Opts{Authenticator: auth, SOCKS4BypassesAuth: true, Dial: func(ctx context.Context, isConnect bool, network, addr string) (net.Conn, error) {
+		return nil, io.EOF
+	}}, connect)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Unable to dial", "SOCKS4 should get as far as dialing when bypassing auth")
+	assert.Equal(t, []byte{socks4ReplyVersion, socks4ReplyRejected, 0, 0, 0, 0, 0, 0}, out)
+
+	bind := []byte{socks4Version, 0x02, 0, 80, 127, 0, 0, 1, 0}
+	_, err = handle(&Opts{}, bind)
+	assert.Error(t, err, "BIND isn't supported")
+
+	conn := mockconn.New(&bytes.Buffer{}, bytes.NewReader(connect))
+	err = newProxy(&Opts{}).HandleSOCKS5(context.Background(), conn, conn)
+	assert.Error(t, err, "HandleSOCKS5 shouldn't accept SOCKS4")
+}
@@ -0,0 +1,361 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+)
+
+const (
+	socks5Version = 0x05
+
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthNoAcceptable = 0xff
+
+	socksPasswordVersion = 0x01
+
+	socksCmdConnect = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksReplySucceeded           = 0x00
+	socksReplyGeneralFailure      = 0x01
+	socksReplyNotAllowed          = 0x02
+	socksReplyHostUnreachable     = 0x04
+	socksReplyCommandNotSupported = 0x07
+	socksReplyAddrNotSupported    = 0x08
+)
+
+// HandleSOCKS5 implements the interface Proxy
+func (proxy *proxy) HandleSOCKS5(ctx context.Context, downstreamIn io.Reader, downstream net.Conn) error {
+	return proxy.handleSOCKS(ctx, downstreamIn, downstream, socks5Version)
+}
+
+// HandleSOCKS implements the interface Proxy
+func (proxy *proxy) HandleSOCKS(ctx context.Context, downstreamIn io.Reader, downstream net.Conn) error {
+	return proxy.handleSOCKS(ctx, downstreamIn, downstream, 0)
+}
+
+// socksRequest is a request to open a tunnel received over any SOCKS version.
+type socksRequest struct {
+	protocol     string
+	identity     string
+	upstreamAddr string
+	// reply writes a reply in the client's SOCKS version, given a SOCKS5 reply
+	// code
+	reply func(out io.Writer, reply byte, addr net.Addr) error
+}
+
+// handleSOCKS handles a SOCKS connection, only accepting the given version
+// unless it's 0.
+func (proxy *proxy) handleSOCKS(ctx context.Context, downstreamIn io.Reader, downstream net.Conn, onlyVersion byte) (err error) {
+	defer func() {
+		p := recover()
+		if p != nil {
+			safeClose(downstream)
+			err = errors.New("Recovered from panic handling SOCKS connection: %v", p)
+		}
+	}()
+
+	defer func() {
+		if closeErr := downstream.Close(); closeErr != nil {
+			log.Tracef("Error closing downstream connection: %s", closeErr)
+		}
+	}()
+
+	tc := proxy.tracker.add(downstream, true)
+	if tc == nil {
+		return ErrShutdown
+	}
+	defer proxy.tracker.remove(tc)
+	ctx = withClientGeo(ctx, proxy.GeoIP, connClientIP(downstream))
+
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(downstreamIn, version); err != nil {
+		return errors.New("Unable to read SOCKS version: %v", err)
+	}
+	if onlyVersion != 0 && version[0] != onlyVersion {
+		return errors.New("Unsupported SOCKS version %d", version[0])
+	}
+	var req *socksRequest
+	switch version[0] {
+	case socks5Version:
+		req, err = proxy.readSOCKS5(ctx, downstreamIn, downstream)
+	case socks4Version:
+		req, err = proxy.readSOCKS4(downstreamIn, downstream)
+	default:
+		return errors.New("Unsupported SOCKS version %d", version[0])
+	}
+	if err != nil {
+		return err
+	}
+	return proxy.socksTunnel(ctx, req, downstreamIn, downstream)
+}
+
+// readSOCKS5 negotiates authentication with a SOCKS5 client and reads its
+// request.
+func (proxy *proxy) readSOCKS5(ctx context.Context, downstreamIn io.Reader, downstream net.Conn) (*socksRequest, error) {
+	identity, err := proxy.socks5Negotiate(withClientConn(ctx, downstream), downstreamIn, downstream)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamAddr, reply, err := readSOCKS5Request(downstreamIn)
+	if err != nil {
+		if reply != socksReplySucceeded {
+			writeSOCKS5Reply(downstream, reply, nil)
+		}
+		return nil, err
+	}
+	return &socksRequest{
+		protocol:     AccessProtocolSOCKS5,
+		identity:     identity,
+		upstreamAddr: upstreamAddr,
+		reply:        writeSOCKS5Reply,
+	}, nil
+}
+
+// socksTunnel dials upstream for req and pipes data between it and the client.
+func (proxy *proxy) socksTunnel(ctx context.Context, req *socksRequest, downstreamIn io.Reader, downstream net.Conn) (err error) {
+	upstreamAddr := req.upstreamAddr
+	fctx := filters.WrapContext(withTunnelStats(withResolvedIPs(withDialedAddr(ctx))), downstream).WithValue(ctxKeyUpstreamAddr, upstreamAddr)
+	if req.identity != "" {
+		fctx = fctx.WithValue(ctxKeyIdentity, req.identity)
+	}
+	if rec := proxy.newTunnelAccessRecord(req.protocol, downstream, upstreamAddr); rec != nil {
+		fctx = fctx.WithValue(ctxKeyAccessRecord, rec)
+		defer func() {
+			proxy.logAccess(fctx, rec, err)
+		}()
+	}
+	if accessErr := proxy.checkTunnelAccess(fctx, downstream, upstreamAddr); accessErr != nil {
+		req.reply(downstream, socksReplyNotAllowed, nil)
+		return accessErr
+	}
+	release, err := proxy.acquireTunnel(fctx)
+	if err != nil {
+		req.reply(downstream, socksReplyGeneralFailure, nil)
+		return err
+	}
+	defer release()
+
+	upstream, err := proxy.dialUpstream(fctx, true, "tcp", upstreamAddr)
+	if err != nil {
+		req.reply(downstream, socksReplyHostUnreachable, nil)
+		return errors.New("Unable to dial upstream %v: %v", upstreamAddr, err)
+	}
+	defer func() {
+		if closeErr := upstream.Close(); closeErr != nil {
+			log.Tracef("Error closing upstream connection: %s", closeErr)
+		}
+	}()
+
+	err = req.reply(downstream, socksReplySucceeded, upstream.LocalAddr())
+	if err != nil {
+		return errors.New("Unable to write SOCKS reply: %v", err)
+	}
+
+	if downstreamIn != io.Reader(downstream) {
+		downstream = &readerConn{downstream, downstreamIn}
+	}
+	return proxy.pipe(fctx, upstreamAddr, upstream, downstream)
+}
+
+// ServeSOCKS5 implements the interface Proxy
+func (proxy *proxy) ServeSOCKS5(l net.Listener) error {
+	return proxy.serveSOCKS(l, proxy.HandleSOCKS5)
+}
+
+// ServeSOCKS implements the interface Proxy
+func (proxy *proxy) ServeSOCKS(l net.Listener) error {
+	return proxy.serveSOCKS(l, proxy.HandleSOCKS)
+}
+
+func (proxy *proxy) serveSOCKS(l net.Listener, handle func(ctx context.Context, in io.Reader, conn net.Conn) error) error {
+	if !proxy.tracker.addListener(l) {
+		return ErrShutdown
+	}
+	defer proxy.tracker.removeListener(l)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if proxy.tracker.isShuttingDown() {
+				return ErrShutdown
+			}
+			return errors.New("Unable to accept: %v", err)
+		}
+		go handle(context.Background(), conn, conn)
+	}
+}
+
+// socks5Negotiate reads the rest of the client's greeting (following the
+// version) and selects an authentication method. If an Authenticator is
+// configured, username/password authentication (RFC 1929) is required and the
+// authenticated identity is returned.
+func (proxy *proxy) socks5Negotiate(ctx context.Context, in io.Reader, out io.Writer) (string, error) {
+	methodCount := make([]byte, 1)
+	if _, err := io.ReadFull(in, methodCount); err != nil {
+		return "", errors.New("Unable to read SOCKS5 greeting: %v", err)
+	}
+	methods := make([]byte, methodCount[0])
+	if _, err := io.ReadFull(in, methods); err != nil {
+		return "", errors.New("Unable to read SOCKS5 auth methods: %v", err)
+	}
+
+	auth := proxy.currentConfig().Authenticator
+	wanted := byte(socksAuthNone)
+	if auth != nil {
+		wanted = socksAuthPassword
+	}
+	for _, method := range methods {
+		if method == wanted {
+			if _, err := out.Write([]byte{socks5Version, wanted}); err != nil {
+				return "", err
+			}
+			if wanted == socksAuthPassword {
+				return socks5Authenticate(ctx, auth, in, out)
+			}
+			return "", nil
+		}
+	}
+	out.Write([]byte{socks5Version, socksAuthNoAcceptable})
+	return "", errors.New("No acceptable SOCKS5 auth method among %v", methods)
+}
+
+// socks5Authenticate performs username/password authentication by presenting
+// the credentials to auth as Basic Proxy-Authorization.
+func socks5Authenticate(ctx context.Context, auth Authenticator, in io.Reader, out io.Writer) (string, error) {
+	readField := func() (string, error) {
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(in, length); err != nil {
+			return "", err
+		}
+		field := make([]byte, length[0])
+		_, err := io.ReadFull(in, field)
+		return string(field), err
+	}
+
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(in, version); err != nil {
+		return "", errors.New("Unable to read SOCKS5 auth version: %v", err)
+	}
+	if version[0] != socksPasswordVersion {
+		return "", errors.New("Unsupported SOCKS5 auth version %d", version[0])
+	}
+	username, err := readField()
+	if err != nil {
+		return "", errors.New("Unable to read SOCKS5 username: %v", err)
+	}
+	password, err := readField()
+	if err != nil {
+		return "", errors.New("Unable to read SOCKS5 password: %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodConnect, "", nil)
+	req.SetBasicAuth(username, password)
+	req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+	req.Header.Del("Authorization")
+	identity, ok := auth.Authenticate(ctx, req)
+	if !ok {
+		out.Write([]byte{socksPasswordVersion, 0x01})
+		return "", errors.New("SOCKS5 authentication failed for %v", username)
+	}
+	_, err = out.Write([]byte{socksPasswordVersion, 0x00})
+	return identity, err
+}
+
+// readSOCKS5Request reads a SOCKS5 request and returns the requested host:port.
+// If the request can't be honored, the returned reply code indicates the
+// reason.
+func readSOCKS5Request(in io.Reader) (string, byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return "", socksReplySucceeded, errors.New("Unable to read SOCKS5 request: %v", err)
+	}
+	if header[0] != socks5Version {
+		return "", socksReplyGeneralFailure, errors.New("Unsupported SOCKS version %d", header[0])
+	}
+
+	var host string
+	switch header[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if header[3] == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(in, ip); err != nil {
+			return "", socksReplySucceeded, errors.New("Unable to read SOCKS5 address: %v", err)
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(in, length); err != nil {
+			return "", socksReplySucceeded, errors.New("Unable to read SOCKS5 domain length: %v", err)
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(in, domain); err != nil {
+			return "", socksReplySucceeded, errors.New("Unable to read SOCKS5 domain: %v", err)
+		}
+		host = string(domain)
+	default:
+		return "", socksReplyAddrNotSupported, errors.New("Unsupported SOCKS5 address type %d", header[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(in, port); err != nil {
+		return "", socksReplySucceeded, errors.New("Unable to read SOCKS5 port: %v", err)
+	}
+
+	if header[1] != socksCmdConnect {
+		return "", socksReplyCommandNotSupported, errors.New("Unsupported SOCKS5 command %d", header[1])
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), socksReplySucceeded, nil
+}
+
+// writeSOCKS5Reply writes a reply with the given code and bound address. If
+// addr is not a TCP address, the unspecified IPv4 address is used.
+func writeSOCKS5Reply(out io.Writer, reply byte, addr net.Addr) error {
+	ip := net.IPv4zero.To4()
+	port := 0
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok && tcpAddr.IP != nil {
+		ip = tcpAddr.IP
+		port = tcpAddr.Port
+	}
+	atyp := byte(socksAddrIPv4)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		atyp = socksAddrIPv6
+	}
+	msg := make([]byte, 0, 6+len(ip))
+	msg = append(msg, socks5Version, reply, 0x00, atyp)
+	msg = append(msg, ip...)
+	msg = append(msg, byte(port>>8), byte(port))
+	_, err := out.Write(msg)
+	return err
+}
+
+// readerConn is a net.Conn that reads from a separate io.Reader, for example a
+// buffered reader that has already consumed data from the underlying conn.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (conn *readerConn) Read(b []byte) (int, error) {
+	return conn.r.Read(b)
+}
+
+func (conn *readerConn) Wrapped() net.Conn {
+	return conn.Conn
+}
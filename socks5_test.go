@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/getlantern/mockconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSOCKS5(t *testing.T) {
+	origin, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer origin.Close()
+	go func() {
+		for {
+			conn, acceptErr := origin.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	_, originPort, _ := net.SplitHostPort(origin.Addr().String())
+	port, _ := strconv.Atoi(originPort)
+
+	var mx sync.Mutex
+	var dialed string
+	p := newProxy(&Opts{
+		Dial: func(ctx context.Context, isConnect bool, network, addr string) (net.Conn, error) {
+			mx.Lock()
+			dialed = addr
+			mx.Unlock()
+			return net.Dial(network, origin.Addr().String())
+		},
+	})
+
+	pl, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pl.Close()
+	go p.ServeSOCKS5(pl)
+
+	conn, err := net.Dial("tcp", pl.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte{socks5Version, 1, socksAuthNone})
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp := make([]byte, 2)
+	_, err = io.ReadFull(conn, resp)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []byte{socks5Version, socksAuthNone}, resp)
+
+	domain := "thehost"
+	req := []byte{socks5Version, socksCmdConnect, 0, socksAddrDomain, byte(len(domain))}
+	req = append(req, domain...)
+	req = append(req, byte(port>>8), byte(port))
+	_, err = conn.Write(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	reply := make([]byte, 10)
+	_, err = io.ReadFull(conn, reply)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.EqualValues(t, socksReplySucceeded, reply[1])
+	mx.Lock()
+	assert.Equal(t, net.JoinHostPort(domain, originPort), dialed)
+	mx.Unlock()
+
+	_, err = conn.Write([]byte("hello"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	echoed := make([]byte, 5)
+	_, err = io.ReadFull(conn, echoed)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "hello", string(echoed))
+}
+
+func TestSOCKS5DialFailure(t *testing.T) {
+	d := mockconn.FailingDialer(errors.New("I don't want to dial"))
+	p := newProxy(&Opts{
+		Dial: func(ctx context.Context, isConnect bool, net, addr string) (net.Conn, error) {
+			return d.Dial(net, addr)
+		},
+	})
+
+	req := []byte{socks5Version, 1, socksAuthNone, socks5Version, socksCmdConnect, 0, socksAddrIPv4, 127, 0, 0, 1, 0, 80}
+	received := &bytes.Buffer{}
+	conn := mockconn.New(received, bytes.NewReader(req))
+	err := p.HandleSOCKS5(context.Background(), conn, conn)
+	assert.Error(t, err)
+	assert.Equal(t, "127.0.0.1:80", d.LastDialed())
+	out := received.Bytes()
+	if assert.Len(t, out, 12) {
+		assert.EqualValues(t, socksReplyHostUnreachable, out[3])
+	}
+}
@@ -0,0 +1,47 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"net"
+	"time"
+)
+
+const spliceStopTimeout = 1 * time.Second
+
+// spliceTunnel copies data between upstream and downstream in both directions
+// if both are plain TCP connections, in which case the runtime moves the bytes
+// with splice(2) without copying them through user space. Like halfCloseCopy,
+// once one side is done sending the other side's write half is closed. ok is
+// false if the connections don't support splicing.
+func spliceTunnel(upstream net.Conn, downstream net.Conn) (writeErr error, readErr error, ok bool) {
+	upstreamTCP, upOK := upstream.(*net.TCPConn)
+	downstreamTCP, downOK := downstream.(*net.TCPConn)
+	if !upOK || !downOK {
+		return nil, nil, false
+	}
+
+	writeErrCh := make(chan error, 1)
+	readErrCh := make(chan error, 1)
+	go spliceOne(upstreamTCP, downstreamTCP, writeErrCh)
+	go spliceOne(downstreamTCP, upstreamTCP, readErrCh)
+	select {
+	case writeErr = <-writeErrCh:
+		readErr = <-readErrCh
+	case readErr = <-readErrCh:
+		writeErr = <-writeErrCh
+	}
+	return writeErr, readErr, true
+}
+
+func spliceOne(dst *net.TCPConn, src *net.TCPConn, errCh chan error) {
+	_, err := dst.ReadFrom(src)
+	if err == nil && dst.CloseWrite() == nil {
+		errCh <- nil
+		return
+	}
+	// Unblock the opposite direction, which reads from dst
+	dst.SetReadDeadline(time.Now().Add(spliceStopTimeout))
+	errCh <- err
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpliceTunnel(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	result := make(chan bool, 1)
+	go func() {
+		downstream, err := l.Accept()
+		if err != nil {
+			result <- false
+			return
+		}
+		defer downstream.Close()
+		upstream, err := net.Dial("tcp", origin.Addr().String())
+		if err != nil {
+			result <- false
+			return
+		}
+		defer upstream.Close()
+		_, _, ok := spliceTunnel(upstream, downstream)
+		result <- ok
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	conn.Close()
+	assert.True(t, <-result, "TCP connections should have been spliced")
+
+	_, _, ok := spliceTunnel(&fixedRemoteAddrConn{Conn: conn}, conn)
+	assert.False(t, ok, "Wrapped connections shouldn't be spliced")
+}
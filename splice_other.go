@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"net"
+)
+
+// spliceTunnel is only supported on Linux, elsewhere tunnels always use
+// BidiCopy.
+func spliceTunnel(upstream net.Conn, downstream net.Conn) (writeErr error, readErr error, ok bool) {
+	return nil, nil, false
+}
@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+// TapDirection identifies which way tapped bytes were flowing.
+type TapDirection int
+
+const (
+	// TapUp identifies bytes sent from the client to upstream
+	TapUp TapDirection = iota
+
+	// TapDown identifies bytes sent from upstream to the client
+	TapDown
+)
+
+func (d TapDirection) String() string {
+	if d == TapUp {
+		return "up"
+	}
+	return "down"
+}
+
+// TapInfo describes a tapped tunnel.
+type TapInfo struct {
+	// ID uniquely identifies the tunnel within this process
+	ID uint64
+
+	// Start is when the tunnel was opened
+	Start time.Time
+
+	// ClientAddr is the address of the client
+	ClientAddr string
+
+	// Identity is the authenticated identity of the client, if any
+	Identity string
+
+	// UpstreamAddr is the address being tunneled to
+	UpstreamAddr string
+}
+
+// Tap receives the bytes flowing in each direction of every tunnel, for
+// example for debugging or intrusion detection. Calls happen synchronously on
+// the tunnel's copy path, so implementations should be fast.
+type Tap interface {
+	// Data is called with bytes that passed through the tunnel described by
+	// info. b is only valid for the duration of the call.
+	Data(info *TapInfo, dir TapDirection, b []byte)
+
+	// Closed is called once the tunnel described by info has closed.
+	Closed(info *TapInfo)
+}
+
+var nextTapID uint64
+
+func newTapInfo(ctx context.Context, upstreamAddr string, downstream net.Conn) *TapInfo {
+	info := &TapInfo{
+		ID:           atomic.AddUint64(&nextTapID, 1),
+		Start:        time.Now(),
+		Identity:     AuthenticatedIdentity(ctx),
+		UpstreamAddr: upstreamAddr,
+	}
+	if remoteAddr := downstream.RemoteAddr(); remoteAddr != nil {
+		info.ClientAddr = remoteAddr.String()
+	}
+	return info
+}
+
+// tappedConn passes the bytes written to (up) and read from (down) an upstream
+// connection to a Tap.
+type tappedConn struct {
+	net.Conn
+	tap  Tap
+	info *TapInfo
+}
+
+func (conn *tappedConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	if n > 0 {
+		conn.tap.Data(conn.info, TapDown, b[:n])
+	}
+	return n, err
+}
+
+func (conn *tappedConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	if n > 0 {
+		conn.tap.Data(conn.info, TapUp, b[:n])
+	}
+	return n, err
+}
+
+func (conn *tappedConn) Wrapped() net.Conn {
+	return conn.Conn
+}
+
+// RollingFileTap is a Tap that writes tapped data to a file, rotating it once
+// it reaches a maximum size. Each chunk of data is written as a header line of
+// the form
+//
+//	<RFC3339 time> <tunnel id> <up|down> <client addr> <upstream addr> <length>
+//
+// followed by exactly length bytes of raw data and a newline. Closed tunnels
+// are recorded as a header line with direction "close" and length 0.
+type RollingFileTap struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+
+	mx   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewRollingFileTap creates a RollingFileTap that writes to the file at path.
+// Once the file would exceed maxBytes, it is renamed to path.1 (shifting any
+// existing path.1 to path.2 and so on, keeping at most maxBackups old files)
+// and a new file is started. A maxBytes of 0 disables rotation.
+func NewRollingFileTap(path string, maxBytes int64, maxBackups int) (*RollingFileTap, error) {
+	t := &RollingFileTap{
+		path:       path,
+		maxBytes:   maxBytes,
+		maxBackups: maxBackups,
+	}
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Data implements the interface Tap
+func (t *RollingFileTap) Data(info *TapInfo, dir TapDirection, b []byte) {
+	t.write(info, dir.String(), b)
+}
+
+// Closed implements the interface Tap
+func (t *RollingFileTap) Closed(info *TapInfo) {
+	t.write(info, "close", nil)
+}
+
+// Close closes the current file.
+func (t *RollingFileTap) Close() error {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if t.file == nil {
+		return nil
+	}
+	err := t.file.Close()
+	t.file = nil
+	return err
+}
+
+func (t *RollingFileTap) write(info *TapInfo, dir string, b []byte) {
+	header := fmt.Sprintf("%s %d %s %s %s %d\n",
+		time.Now().UTC().Format(time.RFC3339Nano),
+		info.ID,
+		dir,
+		dashIfEmpty(info.ClientAddr),
+		dashIfEmpty(info.UpstreamAddr),
+		len(b))
+	recordSize := int64(len(header) + len(b) + 1)
+
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if t.file == nil {
+		return
+	}
+	if t.maxBytes > 0 && t.size > 0 && t.size+recordSize > t.maxBytes {
+		if err := t.rotate(); err != nil {
+			log.Errorf("Unable to rotate tap file %v: %v", t.path, err)
+			return
+		}
+	}
+	record := make([]byte, 0, recordSize)
+	record = append(record, header...)
+	record = append(record, b...)
+	record = append(record, '\n')
+	n, err := t.file.Write(record)
+	t.size += int64(n)
+	if err != nil {
+		log.Errorf("Unable to write to tap file %v: %v", t.path, err)
+	}
+}
+
+func (t *RollingFileTap) open() error {
+	file, err := os.OpenFile(t.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.New("Unable to open tap file %v: %v", t.path, err)
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.New("Unable to stat tap file %v: %v", t.path, err)
+	}
+	t.file = file
+	t.size = fi.Size()
+	return nil
+}
+
+func (t *RollingFileTap) rotate() error {
+	if err := t.file.Close(); err != nil {
+		log.Debugf("Error closing tap file %v: %v", t.path, err)
+	}
+	t.file = nil
+	if t.maxBackups > 0 {
+		for i := t.maxBackups - 1; i > 0; i-- {
+			os.Rename(t.backupPath(i), t.backupPath(i+1))
+		}
+		if err := os.Rename(t.path, t.backupPath(1)); err != nil {
+			return errors.New("Unable to rename tap file: %v", err)
+		}
+	} else if err := os.Remove(t.path); err != nil {
+		return errors.New("Unable to remove tap file: %v", err)
+	}
+	return t.open()
+}
+
+func (t *RollingFileTap) backupPath(i int) string {
+	return fmt.Sprintf("%s.%d", t.path, i)
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingTap struct {
+	mx     sync.Mutex
+	up     []byte
+	down   []byte
+	closed []*TapInfo
+}
+
+func (t *recordingTap) Data(info *TapInfo, dir TapDirection, b []byte) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if dir == TapUp {
+		t.up = append(t.up, b...)
+	} else {
+		t.down = append(t.down, b...)
+	}
+}
+
+func (t *recordingTap) Closed(info *TapInfo) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.closed = append(t.closed, info)
+}
+
+func TestTap(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	tap := &recordingTap{}
+	go newProxy(&Opts{OKWaitsForUpstream: true, Tap: tap}).Serve(l)
+
+	conn, br, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+	if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+		conn.Close()
+		return
+	}
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = br.Read(buf)
+	assert.NoError(t, err)
+	conn.Close()
+
+	for i := 0; i < 30; i++ {
+		tap.mx.Lock()
+		done := len(tap.closed) > 0
+		tap.mx.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	tap.mx.Lock()
+	defer tap.mx.Unlock()
+	assert.Equal(t, "hello", string(tap.up))
+	assert.Equal(t, "hello", string(tap.down))
+	if assert.Len(t, tap.closed, 1) {
+		assert.Equal(t, origin.Addr().String(), tap.closed[0].UpstreamAddr)
+		assert.NotEmpty(t, tap.closed[0].ClientAddr)
+	}
+}
+
+func TestRollingFileTap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tap")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tap.log")
+
+	tap, err := NewRollingFileTap(path, 150, 2)
+	if !assert.NoError(t, err) {
+		return
+	}
+	info := &TapInfo{ID: 7, ClientAddr: "127.0.0.1:1234", UpstreamAddr: "example.com:443"}
+	for i := 0; i < 4; i++ {
+		tap.Data(info, TapUp, []byte(strings.Repeat("x", 50)))
+	}
+	tap.Closed(info)
+	assert.NoError(t, tap.Close())
+
+	current, err := ioutil.ReadFile(path)
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(current), " 7 close 127.0.0.1:1234 example.com:443 0\n")
+	}
+	backup, err := ioutil.ReadFile(path + ".1")
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(backup), " 7 up 127.0.0.1:1234 example.com:443 50\n"+strings.Repeat("x", 50)+"\n")
+		assert.True(t, len(backup) <= 150, "Rotated file should respect the maximum size")
+	}
+	_, err = os.Stat(path + ".2")
+	assert.NoError(t, err, "Should have kept a second backup")
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err), "Should not keep more than maxBackups files")
+}
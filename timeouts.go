@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+const (
+	// DefaultDialTimeout is how long dialing upstream may take if neither
+	// Timeouts.Dial nor MaxDialTime is specified.
+	DefaultDialTimeout = 30 * time.Second
+)
+
+// Timeouts bounds how long the proxy waits on upstream. Zero values mean no
+// limit unless noted otherwise.
+type Timeouts struct {
+	// Dial limits the total time spent resolving and dialing upstream, across
+	// all attempts. Defaults to MaxDialTime if specified, otherwise to
+	// DefaultDialTimeout.
+	Dial time.Duration
+
+	// TLSHandshake limits how long TLS handshakes with upstream servers of
+	// forwarded https requests may take. (HTTP only)
+	TLSHandshake time.Duration
+
+	// ResponseHeader limits how long to wait for upstream's response headers
+	// after fully writing a forwarded request. (HTTP only)
+	ResponseHeader time.Duration
+
+	// Request limits the total time of a forwarded request, from dialing to
+	// reading the end of the response body. WebSocket upgrades are exempt.
+	// (HTTP only)
+	Request time.Duration
+
+	// MaxTunnelDuration closes tunnels that have been open for longer than
+	// this, regardless of activity.
+	MaxTunnelDuration time.Duration
+}
+
+func (proxy *proxy) dialTimeout() time.Duration {
+	if proxy.Timeouts.Dial > 0 {
+		return proxy.Timeouts.Dial
+	}
+	if proxy.MaxDialTime > 0 {
+		return proxy.MaxDialTime
+	}
+	return DefaultDialTimeout
+}
+
+// withRequestTimeout applies Timeouts.Request to ctx, returning a cancel
+// function that must be called once the response body is done.
+func (proxy *proxy) withRequestTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if proxy.Timeouts.Request <= 0 {
+		return ctx, noopCancel
+	}
+	return context.WithTimeout(ctx, proxy.Timeouts.Request)
+}
+
+// cancelOnClose cancels a context once the wrapped body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
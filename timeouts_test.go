@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func serveProxy(t *testing.T, opts *Opts) net.Listener {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go newProxy(opts).Serve(l)
+	return l
+}
+
+func TestDialTimeout(t *testing.T) {
+	l := serveProxy(t, &Opts{
+		OKWaitsForUpstream: true,
+		Timeouts:           Timeouts{Dial: 100 * time.Millisecond},
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			// Simulate a dialer that only gives up when its context does
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	})
+	defer l.Close()
+
+	start := time.Now()
+	conn, _, resp := openTunnel(t, l.Addr().String(), "example.com:443")
+	conn.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.True(t, time.Since(start) < 2*time.Second, "Hung dial should have timed out")
+}
+
+func TestMaxTunnelDuration(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+	l := serveProxy(t, &Opts{
+		OKWaitsForUpstream: true,
+		Timeouts:           Timeouts{MaxTunnelDuration: 200 * time.Millisecond},
+	})
+	defer l.Close()
+
+	conn, br, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+	defer conn.Close()
+	if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+		return
+	}
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := br.ReadByte()
+	assert.Equal(t, io.EOF, err, "Tunnel should have been closed")
+	assert.True(t, time.Since(start) >= 200*time.Millisecond)
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	// An origin that accepts requests but never responds
+	origin, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer origin.Close()
+	go func() {
+		for {
+			conn, err := origin.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	l := serveProxy(t, &Opts{Timeouts: Timeouts{ResponseHeader: 100 * time.Millisecond}})
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	req, _ := http.NewRequest(http.MethodGet, "http://"+origin.Addr().String()+"/", nil)
+	req.WriteProxy(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// With the default OnError, failed requests close the connection
+	_, err = http.ReadResponse(bufio.NewReader(conn), req)
+	if assert.Error(t, err) {
+		netErr, isNetErr := err.(net.Error)
+		assert.False(t, isNetErr && netErr.Timeout(), "Proxy should have given up before the client")
+	}
+}
@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	// DefaultCertReloadInterval is how often ServeTLS checks its certificate
+	// files for changes if TLSServerOpts.ReloadInterval isn't set.
+	DefaultCertReloadInterval = 1 * time.Minute
+
+	tlsServerHandshakeTimeout = 10 * time.Second
+)
+
+// TLSServerOpts configures serving the proxy itself over TLS (an HTTPS proxy).
+type TLSServerOpts struct {
+	// CertFile and KeyFile are PEM files holding the proxy's certificate chain
+	// and private key. They're reloaded on SIGHUP and whenever their
+	// modification time changes.
+	CertFile string
+	KeyFile  string
+
+	// ReloadInterval is how often to check CertFile and KeyFile for changes.
+	// Defaults to DefaultCertReloadInterval.
+	ReloadInterval time.Duration
+
+	// ClientCAs, if specified, requires clients to present a certificate signed
+	// by one of these CAs (mutual TLS). The certificate is available via
+	// ClientCertificate and the identity it maps to (see ClientIdentity)
+	// becomes the authenticated identity of the proxy user, see
+	// AuthenticatedIdentity.
+	ClientCAs *x509.CertPool
+
+	// ClientIdentity maps verified client certificates to identities. Defaults
+	// to CommonNameIdentity.
+	ClientIdentity func(cert *x509.Certificate) string
+
+	// RevocationChecker, if specified, rejects client certificates that have
+	// been revoked, see NewCRLChecker and RevocationCheckerFunc.
+	RevocationChecker RevocationChecker
+
+	// DisableHTTP2, if true, only offers http/1.1 via ALPN. Otherwise, h2 is
+	// offered too and HTTP/2 clients are served via ServeHTTP.
+	DisableHTTP2 bool
+}
+
+func (opts *TLSServerOpts) reloadInterval() time.Duration {
+	if opts.ReloadInterval > 0 {
+		return opts.ReloadInterval
+	}
+	return DefaultCertReloadInterval
+}
+
+// ServeTLS runs a proxy server that accepts TLS connections on the given
+// Listener.
+func (proxy *proxy) ServeTLS(l net.Listener, opts *TLSServerOpts) error {
+	certs, err := newCertReloader(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go certs.watch(opts.reloadInterval(), stop)
+
+	tlsConfig := &tls.Config{
+		GetCertificate: certs.getCertificate,
+		NextProtos:     []string{"http/1.1"},
+	}
+	if opts.ClientCAs != nil {
+		tlsConfig.ClientCAs = opts.ClientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		if opts.RevocationChecker != nil {
+			tlsConfig.VerifyPeerCertificate = verifyRevocation(opts.RevocationChecker)
+		}
+	}
+
+	var h2 *connListener
+	if !opts.DisableHTTP2 {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		h2 = newConnListener(l.Addr())
+		defer h2.Close()
+		handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			proxy.ServeHTTP(w, req.WithContext(withClientIdentity(req.Context(), req.TLS, opts.ClientIdentity)))
+		})
+		go (&http.Server{Handler: handler}).Serve(h2)
+	}
+
+	if !proxy.tracker.addListener(l) {
+		return ErrShutdown
+	}
+	defer proxy.tracker.removeListener(l)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if proxy.tracker.isShuttingDown() {
+				return ErrShutdown
+			}
+			return errors.New("Unable to accept: %v", err)
+		}
+		go proxy.handleTLS(tls.Server(conn, tlsConfig), opts, h2)
+	}
+}
+
+func (proxy *proxy) handleTLS(conn *tls.Conn, opts *TLSServerOpts, h2 *connListener) {
+	conn.SetDeadline(time.Now().Add(tlsServerHandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		log.Debugf("TLS handshake with %v failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol == "h2" && h2 != nil {
+		if !h2.deliver(conn) {
+			conn.Close()
+		}
+		return
+	}
+
+	proxy.Handle(withClientIdentity(context.Background(), &state, opts.ClientIdentity), conn, conn)
+}
+
+// certReloader holds a certificate loaded from files, reloading it when the
+// files change or the process receives SIGHUP.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mx      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	modTime := r.latestModTime()
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.New("Unable to load certificate from %v and %v: %v", r.certFile, r.keyFile, err)
+	}
+	r.mx.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mx.Unlock()
+	return nil
+}
+
+func (r *certReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		if fi, err := os.Stat(file); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
+
+func (r *certReloader) changed() bool {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return !r.latestModTime().Equal(r.modTime)
+}
+
+// watch reloads the certificate on SIGHUP and whenever the files change,
+// until stop is closed. If reloading fails, the previous certificate stays in
+// use.
+func (r *certReloader) watch(interval time.Duration, stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+		}
+		if err := r.reload(); err != nil {
+			log.Errorf("Unable to reload certificate: %v", err)
+		} else {
+			log.Debugf("Reloaded certificate from %v", r.certFile)
+		}
+	}
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return r.cert, nil
+}
+
+// connListener is a net.Listener that accepts connections delivered to it,
+// used to hand connections that negotiated HTTP/2 to an http.Server.
+type connListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *connListener) deliver(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.closed:
+		return false
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("Listener closed")
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// issueTestCert creates a certificate for cn signed by parent (self-signed if
+// parent is nil).
+func issueTestCert(t *testing.T, cn string, serial int64, parent *tls.Certificate) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		DNSNames:              []string{"localhost"},
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	issuer, signer := template, interface{}(key)
+	if parent != nil {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func writeTestCert(t *testing.T, cert *tls.Certificate, certFile, keyFile string) {
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+}
+
+func serveTLSProxy(t *testing.T, opts *Opts, tlsOpts *TLSServerOpts) net.Listener {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go newProxy(opts).ServeTLS(l, tlsOpts)
+	return l
+}
+
+func TestServeTLS(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	dir, err := ioutil.TempDir("", "tlsserver")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, issueTestCert(t, "proxy", 1, nil), certFile, keyFile)
+
+	l := serveTLSProxy(t, &Opts{OKWaitsForUpstream: true}, &TLSServerOpts{
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		ReloadInterval: 20 * time.Millisecond,
+	})
+	defer l.Close()
+
+	dial := func(proto string) *tls.Conn {
+		conn, dialErr := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{proto}})
+		require.NoError(t, dialErr)
+		return conn
+	}
+
+	conn := dial("h2")
+	assert.Equal(t, "h2", conn.ConnectionState().NegotiatedProtocol)
+	conn.Close()
+
+	conn = dial("http/1.1")
+	defer conn.Close()
+	assert.Equal(t, "http/1.1", conn.ConnectionState().NegotiatedProtocol)
+	assert.EqualValues(t, 1, conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64())
+	req, _ := http.NewRequest(http.MethodConnect, "http://"+origin.Addr().String(), nil)
+	req.Write(conn)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	conn.Write([]byte("hello"))
+	b := make([]byte, 5)
+	_, err = io.ReadFull(br, b)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	// Replace the certificate and make sure new connections pick it up
+	writeTestCert(t, issueTestCert(t, "proxy", 2, nil), certFile, keyFile)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	os.Chtimes(keyFile, future, future)
+	assert.Eventually(t, func() bool {
+		reloaded := dial("http/1.1")
+		defer reloaded.Close()
+		return reloaded.ConnectionState().PeerCertificates[0].SerialNumber.Int64() == 2
+	}, 2*time.Second, 20*time.Millisecond)
+}
+
+func TestServeTLSClientCerts(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	dir, err := ioutil.TempDir("", "tlsserver")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, issueTestCert(t, "proxy", 1, nil), certFile, keyFile)
+	ca := issueTestCert(t, "ca", 2, nil)
+	clientCert := issueTestCert(t, "alice", 3, ca)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Leaf)
+
+	var mx sync.Mutex
+	var identities []string
+	l := serveTLSProxy(t, &Opts{
+		OKWaitsForUpstream: true,
+		AccessLogger: AccessLoggerFunc(func(record *AccessRecord) {
+			mx.Lock()
+			identities = append(identities, record.Identity)
+			mx.Unlock()
+		}),
+	}, &TLSServerOpts{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAs:    clientCAs,
+		DisableHTTP2: true,
+	})
+	defer l.Close()
+
+	anonymous, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		// With TLS 1.3, the client only learns of the rejection on first read
+		_, err = anonymous.Read(make([]byte, 1))
+		anonymous.Close()
+	}
+	assert.Error(t, err, "Client without certificate should be rejected")
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{*clientCert},
+	})
+	require.NoError(t, err)
+	req, _ := http.NewRequest(http.MethodConnect, "http://"+origin.Addr().String(), nil)
+	req.Write(conn)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	conn.Close()
+
+	assert.Eventually(t, func() bool {
+		mx.Lock()
+		defer mx.Unlock()
+		return len(identities) == 1 && identities[0] == "alice"
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/getlantern/proxy/filters"
+)
+
+const (
+	// SpanRequest covers the handling of a single request, including any
+	// tunnel that follows a CONNECT
+	SpanRequest = "proxy.request"
+
+	// SpanHijack covers hijacking an HTTP/1.x connection in ServeHTTP
+	SpanHijack = "proxy.hijack"
+
+	// SpanDial covers dialing upstream, including resolution and retries
+	SpanDial = "proxy.dial"
+
+	// SpanHandshake covers the TLS handshakes performed when MITMing
+	SpanHandshake = "proxy.handshake"
+
+	// SpanCopy covers piping data through a tunnel
+	SpanCopy = "proxy.copy"
+)
+
+var (
+	noopTracer Tracer = &nullTracer{}
+)
+
+// Tracer creates tracing spans for the proxy's work and propagates trace
+// context through HTTP headers. It is designed to be easily backed by
+// OpenTelemetry, using a trace.Tracer for StartSpan and a
+// propagation.TextMapPropagator with a HeaderCarrier for Extract and Inject.
+type Tracer interface {
+	// StartSpan starts a span with the given name as a child of any span in
+	// ctx, returning a context containing the new span.
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+
+	// Extract returns ctx with the trace context carried by header, if any.
+	Extract(ctx context.Context, header http.Header) context.Context
+
+	// Inject adds the trace context of ctx to header.
+	Inject(ctx context.Context, header http.Header)
+}
+
+// Span is a single traced operation.
+type Span interface {
+	// SetAttribute records an attribute of the operation
+	SetAttribute(key string, value interface{})
+
+	// RecordError records that the operation failed with err
+	RecordError(err error)
+
+	// End completes the span
+	End()
+}
+
+type nullTracer struct{}
+
+func (t *nullTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, noopSpan
+}
+func (t *nullTracer) Extract(ctx context.Context, header http.Header) context.Context { return ctx }
+func (t *nullTracer) Inject(ctx context.Context, header http.Header)                  {}
+
+var noopSpan Span = &nullSpan{}
+
+type nullSpan struct{}
+
+func (s *nullSpan) SetAttribute(key string, value interface{}) {}
+func (s *nullSpan) RecordError(err error)                      {}
+func (s *nullSpan) End()                                       {}
+
+// startRequestSpan extracts trace context from req and starts a SpanRequest,
+// which is ended by finishRequest.
+func (proxy *proxy) startRequestSpan(ctx filters.Context, req *http.Request) filters.Context {
+	spanCtx, span := proxy.Tracer.StartSpan(proxy.Tracer.Extract(ctx, req.Header), SpanRequest)
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.host", req.Host)
+	return filters.AdaptContext(spanCtx).WithValue(ctxKeyRequestSpan, span)
+}
+
+// finishRequest ends the request's span and logs its access record.
+func (proxy *proxy) finishRequest(ctx context.Context, rec *AccessRecord, err error) {
+	if span, ok := ctx.Value(ctxKeyRequestSpan).(Span); ok {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}
+	proxy.logAccess(ctx, rec, err)
+}
+
+// endSpan ends span, recording err (if any).
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
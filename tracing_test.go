@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testSpanKey struct{}
+
+type testSpan struct {
+	tracer *testTracer
+	name   string
+	parent string
+}
+
+func (s *testSpan) SetAttribute(key string, value interface{}) {}
+func (s *testSpan) RecordError(err error)                      {}
+func (s *testSpan) End() {
+	s.tracer.mx.Lock()
+	defer s.tracer.mx.Unlock()
+	s.tracer.ended = append(s.tracer.ended, s.parent+">"+s.name)
+}
+
+// testTracer records ended spans as parent>name, where the root parent is the
+// trace ID propagated in the X-Trace header.
+type testTracer struct {
+	mx    sync.Mutex
+	ended []string
+}
+
+func (t *testTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(testSpanKey{}).(string)
+	return context.WithValue(ctx, testSpanKey{}, name), &testSpan{tracer: t, name: name, parent: parent}
+}
+
+func (t *testTracer) Extract(ctx context.Context, header http.Header) context.Context {
+	if trace := header.Get("X-Trace"); trace != "" {
+		return context.WithValue(ctx, testSpanKey{}, trace)
+	}
+	return ctx
+}
+
+func (t *testTracer) Inject(ctx context.Context, header http.Header) {
+	if span, ok := ctx.Value(testSpanKey{}).(string); ok {
+		header.Set("X-Trace", span)
+	}
+}
+
+func (t *testTracer) endedSpans() []string {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	result := append([]string(nil), t.ended...)
+	sort.Strings(result)
+	return result
+}
+
+func TestTracingForwarded(t *testing.T) {
+	var upstreamTrace string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstreamTrace = req.Header.Get("X-Trace")
+	}))
+	defer origin.Close()
+
+	tracer := &testTracer{}
+	l := serveProxy(t, &Opts{Tracer: tracer})
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+	req.Header.Set("X-Trace", "client")
+	req.Header.Set("Connection", "close")
+	req.WriteProxy(conn)
+	io.Copy(ioutil.Discard, conn)
+
+	assert.Equal(t, SpanRequest, upstreamTrace, "Upstream request should carry the proxy's span")
+	for i := 0; i < 20 && len(tracer.endedSpans()) < 2; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equal(t, []string{"client>" + SpanRequest, SpanRequest + ">" + SpanDial}, tracer.endedSpans())
+}
+
+func TestTracingCONNECT(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	tracer := &testTracer{}
+	l := serveProxy(t, &Opts{OKWaitsForUpstream: true, Tracer: tracer})
+	defer l.Close()
+
+	conn, _, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	conn.Close()
+	for i := 0; i < 60 && len(tracer.endedSpans()) < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equal(t, []string{">" + SpanRequest, SpanRequest + ">" + SpanCopy, SpanRequest + ">" + SpanDial}, tracer.endedSpans())
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+)
+
+const (
+	transparentPort = "443"
+)
+
+var (
+	errHelloRead = errors.New("ClientHello read")
+)
+
+// HandleTransparent implements the interface Proxy
+func (proxy *proxy) HandleTransparent(ctx context.Context, downstreamIn io.Reader, downstream net.Conn) (err error) {
+	defer func() {
+		p := recover()
+		if p != nil {
+			safeClose(downstream)
+			err = errors.New("Recovered from panic handling transparent connection: %v", p)
+		}
+	}()
+
+	defer func() {
+		if closeErr := downstream.Close(); closeErr != nil {
+			log.Tracef("Error closing downstream connection: %s", closeErr)
+		}
+	}()
+
+	tc := proxy.tracker.add(downstream, true)
+	if tc == nil {
+		return ErrShutdown
+	}
+	defer proxy.tracker.remove(tc)
+
+	serverName, protocols, hello, err := peekServerName(downstreamIn)
+	if err != nil {
+		return errors.New("Unable to read ClientHello from %v: %v", downstream.RemoteAddr(), err)
+	}
+	route := proxy.alpnRoute(protocols)
+	upstreamAddr := net.JoinHostPort(serverName, transparentPort)
+	if route != nil && route.Addr != "" {
+		upstreamAddr = route.Addr
+	} else if serverName == "" {
+		return errors.New("ClientHello from %v has no SNI", downstream.RemoteAddr())
+	}
+	if route != nil {
+		log.Debugf("Routing %v connection for %v to %v", route.Protocol, serverName, upstreamAddr)
+	}
+	bypass := route != nil && route.Bypass
+
+	fctx := filters.WrapContext(withTunnelStats(withResolvedIPs(withDialedAddr(ctx))), downstream).WithValue(ctxKeyUpstreamAddr, upstreamAddr)
+	if rec := proxy.newTunnelAccessRecord(AccessProtocolTransparent, downstream, upstreamAddr); rec != nil {
+		fctx = fctx.WithValue(ctxKeyAccessRecord, rec)
+		defer func() {
+			proxy.logAccess(fctx, rec, err)
+		}()
+	}
+	if !route.exemptsFromLimits() {
+		if accessErr := proxy.checkTunnelAccess(fctx, downstream, upstreamAddr); accessErr != nil {
+			return accessErr
+		}
+		release, acquireErr := proxy.acquireTunnel(fctx)
+		if acquireErr != nil {
+			return acquireErr
+		}
+		defer release()
+	}
+	var upstream net.Conn
+	if bypass {
+		upstream, err = proxy.dialBypassing(fctx, upstreamAddr)
+	} else {
+		upstream, err = proxy.dialUpstream(fctx, true, "tcp", upstreamAddr)
+	}
+	if err != nil {
+		return errors.New("Unable to dial upstream %v: %v", upstreamAddr, err)
+	}
+	defer func() {
+		if closeErr := upstream.Close(); closeErr != nil {
+			log.Tracef("Error closing upstream connection: %s", closeErr)
+		}
+	}()
+
+	if _, err := upstream.Write(hello); err != nil {
+		return errors.New("Unable to write ClientHello to upstream %v: %v", upstreamAddr, err)
+	}
+
+	if downstreamIn != io.Reader(downstream) {
+		downstream = &readerConn{downstream, downstreamIn}
+	}
+	return proxy.pipe(fctx, upstreamAddr, upstream, downstream)
+}
+
+// ServeTransparent implements the interface Proxy
+func (proxy *proxy) ServeTransparent(l net.Listener) error {
+	if !proxy.tracker.addListener(l) {
+		return ErrShutdown
+	}
+	defer proxy.tracker.removeListener(l)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if proxy.tracker.isShuttingDown() {
+				return ErrShutdown
+			}
+			return errors.New("Unable to accept: %v", err)
+		}
+		go proxy.HandleTransparent(context.Background(), conn, conn)
+	}
+}
+
+// peekServerName reads the TLS ClientHello from in and returns the requested
+// server name and offered ALPN protocols along with the raw bytes read, which
+// need to be replayed upstream. It lets crypto/tls do the parsing and aborts
+// the handshake as soon as the ClientHello has been read.
+func peekServerName(in io.Reader) (string, []string, []byte, error) {
+	hello := &bytes.Buffer{}
+	var serverName string
+	var protocols []string
+	helloRead := false
+	err := tls.Server(&helloConn{r: io.TeeReader(in, hello)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = info.ServerName
+			protocols = info.SupportedProtos
+			helloRead = true
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if !helloRead {
+		return "", nil, nil, err
+	}
+	return serverName, protocols, hello.Bytes(), nil
+}
+
+// helloConn is a read-only net.Conn used for parsing a ClientHello. Anything
+// written to it (i.e. TLS alerts) is discarded.
+type helloConn struct {
+	r io.Reader
+}
+
+func (conn *helloConn) Read(b []byte) (int, error) {
+	return conn.r.Read(b)
+}
+
+func (conn *helloConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (conn *helloConn) Close() error {
+	return nil
+}
+
+func (conn *helloConn) LocalAddr() net.Addr {
+	return &stringAddr{"tcp", ""}
+}
+
+func (conn *helloConn) RemoteAddr() net.Addr {
+	return &stringAddr{"tcp", ""}
+}
+
+func (conn *helloConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (conn *helloConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (conn *helloConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const defaultTransportHandshakeTimeout = 10 * time.Second
+
+// Transport obfuscates the connections between clients and the proxy, for
+// example by camouflaging them as TLS to a popular site, encrypting them with
+// a shadowsocks-style cipher or reshaping them like obfs4, so that
+// deployments facing censorship can plug in their own. Clients (typically
+// chained proxies, see Upstream.Transport) and the proxy (see
+// NewTransportListener) have to use the same transport.
+type Transport interface {
+	// Client wraps conn, which is connected to a server using this transport,
+	// performing the client side of any handshake within the bounds of ctx.
+	Client(ctx context.Context, conn net.Conn) (net.Conn, error)
+
+	// Server wraps conn, which was accepted from a client using this
+	// transport, performing the server side of any handshake.
+	Server(conn net.Conn) (net.Conn, error)
+}
+
+// ChainTransports layers transports on top of each other, with the first one
+// closest to the network.
+func ChainTransports(transports ...Transport) Transport {
+	return chainedTransports(transports)
+}
+
+type chainedTransports []Transport
+
+func (transports chainedTransports) Client(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	for _, transport := range transports {
+		wrapped, err := transport.Client(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+		conn = wrapped
+	}
+	return conn, nil
+}
+
+func (transports chainedTransports) Server(conn net.Conn) (net.Conn, error) {
+	for _, transport := range transports {
+		wrapped, err := transport.Server(conn)
+		if err != nil {
+			return nil, err
+		}
+		conn = wrapped
+	}
+	return conn, nil
+}
+
+// TLSTransport is a Transport that wraps connections in TLS, with
+// serverConfig on the proxy and clientConfig on clients. Setting the
+// ServerName of clientConfig to that of a popular site (and presenting a
+// matching certificate, or verifying with VerifyPeerCertificate instead)
+// camouflages proxy traffic as regular HTTPS.
+func TLSTransport(serverConfig *tls.Config, clientConfig *tls.Config) Transport {
+	return &tlsTransport{serverConfig: serverConfig, clientConfig: clientConfig}
+}
+
+type tlsTransport struct {
+	serverConfig *tls.Config
+	clientConfig *tls.Config
+}
+
+func (t *tlsTransport) Client(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	if t.clientConfig == nil {
+		return nil, errors.New("TLS transport has no client config")
+	}
+	if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	tlsConn := tls.Client(conn, t.clientConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, errors.New("TLS transport handshake with %v failed: %v", conn.RemoteAddr(), err)
+	}
+	return tlsConn, nil
+}
+
+func (t *tlsTransport) Server(conn net.Conn) (net.Conn, error) {
+	if t.serverConfig == nil {
+		return nil, errors.New("TLS transport has no server config")
+	}
+	tlsConn := tls.Server(conn, t.serverConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, errors.New("TLS transport handshake with %v failed: %v", conn.RemoteAddr(), err)
+	}
+	return tlsConn, nil
+}
+
+// TransportDial returns a DialFunc that wraps the connections from dial with
+// transport, or from a plain TCP dial if dial is nil.
+func TransportDial(dial DialFunc, transport Transport) DialFunc {
+	if dial == nil {
+		dial = ChainDial(nil)
+	}
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, isCONNECT, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		wrapped, err := transport.Client(ctx, conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return wrapped, nil
+	}
+}
+
+// NewTransportListener wraps l so that the connections it accepts are
+// unwrapped with the server side of transport, which lets Serve, ServeSOCKS
+// and the like serve obfuscated clients. Handshakes happen in the background,
+// so that slow clients don't hold up others, and have to complete within 10
+// seconds. Connections that fail the handshake are closed.
+func NewTransportListener(l net.Listener, transport Transport) net.Listener {
+	tl := &transportListener{
+		Listener:  l,
+		transport: transport,
+		accepted:  newConnListener(l.Addr()),
+	}
+	go tl.acceptLoop()
+	return tl
+}
+
+type transportListener struct {
+	net.Listener
+	transport Transport
+	accepted  *connListener
+
+	mx        sync.Mutex
+	acceptErr error
+}
+
+func (l *transportListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.mx.Lock()
+			l.acceptErr = err
+			l.mx.Unlock()
+			l.accepted.Close()
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *transportListener) handshake(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(defaultTransportHandshakeTimeout))
+	wrapped, err := l.transport.Server(conn)
+	if err != nil {
+		log.Debugf("Unable to accept transport connection from %v: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	if !l.accepted.deliver(wrapped) {
+		wrapped.Close()
+	}
+}
+
+func (l *transportListener) Accept() (net.Conn, error) {
+	conn, err := l.accepted.Accept()
+	if err != nil {
+		l.mx.Lock()
+		defer l.mx.Unlock()
+		if l.acceptErr != nil {
+			return nil, l.acceptErr
+		}
+	}
+	return conn, err
+}
+
+func (l *transportListener) Close() error {
+	l.accepted.Close()
+	return l.Listener.Close()
+}
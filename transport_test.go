@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// xorTransport is a toy cipher that stands in for real obfuscation.
+type xorTransport byte
+
+func (t xorTransport) Client(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	return &xorConn{Conn: conn, key: byte(t)}, nil
+}
+
+func (t xorTransport) Server(conn net.Conn) (net.Conn, error) {
+	return &xorConn{Conn: conn, key: byte(t)}, nil
+}
+
+type xorConn struct {
+	net.Conn
+	key byte
+}
+
+func (conn *xorConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	for i := 0; i < n; i++ {
+		b[i] ^= conn.key
+	}
+	return n, err
+}
+
+func (conn *xorConn) Write(b []byte) (int, error) {
+	xored := make([]byte, len(b))
+	for i := range b {
+		xored[i] = b[i] ^ conn.key
+	}
+	return conn.Conn.Write(xored)
+}
+
+func TestTransport(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	cert := issueTestCert(t, "localhost", 1, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	transport := ChainTransports(
+		xorTransport(0x5a),
+		TLSTransport(&tls.Config{Certificates: []tls.Certificate{*cert}}, &tls.Config{ServerName: "localhost", RootCAs: roots}),
+	)
+
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	tl := NewTransportListener(l, transport)
+	defer tl.Close()
+	go newProxy(&Opts{}).Serve(tl)
+
+	conn, err := ChainDial(nil, &Upstream{Addr: l.Addr().String(), Transport: transport})(context.Background(), true, "tcp", origin.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	echoed := make([]byte, 5)
+	_, err = io.ReadFull(conn, echoed)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(echoed))
+
+	// Clients that don't use the transport aren't served
+	plain, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer plain.Close()
+	req, _ := http.NewRequest(http.MethodConnect, "http://"+origin.Addr().String(), nil)
+	require.NoError(t, req.Write(plain))
+	plain.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response := make([]byte, 12)
+	n, _ := io.ReadFull(plain, response)
+	assert.False(t, bytes.HasPrefix(response[:n], []byte("HTTP/1.1 200")), "Plain clients should be rejected")
+}
+
+func TestTransportDial(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	tl := NewTransportListener(l, xorTransport(0x42))
+	defer tl.Close()
+	go func() {
+		conn, err := tl.Accept()
+		if err == nil {
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+
+	conn, err := TransportDial(nil, xorTransport(0x42))(context.Background(), true, "tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	echoed := make([]byte, 4)
+	_, err = io.ReadFull(conn, echoed)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(echoed))
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"compress/flate"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+)
+
+const (
+	// TunnelCompressionHeader is the header with which a chained proxy asks
+	// its upstream proxy to compress a CONNECT tunnel between the two, and with
+	// which the upstream proxy confirms that it does.
+	TunnelCompressionHeader = "X-Lantern-Tunnel-Compression"
+
+	// TunnelCompressionDeflate compresses tunnel bytes with DEFLATE, flushing
+	// after every write.
+	TunnelCompressionDeflate = "deflate"
+
+	ctxKeyTunnelCompression = contextKey("tunnelCompression")
+)
+
+// negotiateTunnelCompression agrees to compress the tunnel requested by req if
+// TunnelCompression is enabled and the client asked for it.
+func (proxy *proxy) negotiateTunnelCompression(ctx filters.Context, req *http.Request, resp *http.Response) filters.Context {
+	if !proxy.TunnelCompression || resp == nil || !acceptsTunnelCompression(req.Header) {
+		return ctx
+	}
+	resp.Header.Set(TunnelCompressionHeader, TunnelCompressionDeflate)
+	return ctx.WithValue(ctxKeyTunnelCompression, TunnelCompressionDeflate)
+}
+
+func acceptsTunnelCompression(header http.Header) bool {
+	for _, value := range strings.Split(header.Get(TunnelCompressionHeader), ",") {
+		if strings.EqualFold(strings.TrimSpace(value), TunnelCompressionDeflate) {
+			return true
+		}
+	}
+	return false
+}
+
+func compressesTunnel(ctx filters.Context) bool {
+	return ctx.Value(ctxKeyTunnelCompression) != nil
+}
+
+// compressedConn compresses what's written to the wrapped connection and
+// decompresses what's read from it. Every write is flushed, so that it doesn't
+// hold up interactive protocols.
+type compressedConn struct {
+	net.Conn
+
+	readOnce sync.Once
+	reader   io.ReadCloser
+
+	writeMx sync.Mutex
+	writer  *flate.Writer
+}
+
+func newCompressedConn(conn net.Conn) *compressedConn {
+	// BestSpeed can't fail
+	writer, _ := flate.NewWriter(conn, flate.BestSpeed)
+	return &compressedConn{Conn: conn, writer: writer}
+}
+
+func (conn *compressedConn) Read(b []byte) (int, error) {
+	// Creating the reader already reads from the connection, so it waits for
+	// the first Read
+	conn.readOnce.Do(func() {
+		conn.reader = flate.NewReader(conn.Conn)
+	})
+	n, err := conn.reader.Read(b)
+	if err == io.ErrUnexpectedEOF {
+		// The peer went away without finishing the stream, which for a tunnel is
+		// like a connection closed without half-closing first
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (conn *compressedConn) Write(b []byte) (int, error) {
+	conn.writeMx.Lock()
+	defer conn.writeMx.Unlock()
+	n, err := conn.writer.Write(b)
+	if err != nil {
+		return n, err
+	}
+	if err := conn.writer.Flush(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// CloseWrite finishes the compressed stream and half-closes the wrapped
+// connection, if it can be.
+func (conn *compressedConn) CloseWrite() error {
+	conn.writeMx.Lock()
+	err := conn.writer.Close()
+	conn.writeMx.Unlock()
+	if err != nil {
+		return err
+	}
+	cw := closeWriterOf(conn.Conn)
+	if cw == nil {
+		return errors.New("Unable to half-close compressed tunnel")
+	}
+	return cw.CloseWrite()
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingListener counts the bytes read from its connections.
+type countingListener struct {
+	net.Listener
+	read int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &readCountingConn{Conn: conn, read: &l.read}, nil
+}
+
+type readCountingConn struct {
+	net.Conn
+	read *int64
+}
+
+func (conn *readCountingConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	atomic.AddInt64(conn.read, int64(n))
+	return n, err
+}
+
+func TestTunnelCompression(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	serve := func(opts *Opts) *countingListener {
+		l, err := net.Listen("tcp", "localhost:0")
+		require.NoError(t, err)
+		cl := &countingListener{Listener: l}
+		go newProxy(opts).Serve(cl)
+		return cl
+	}
+	compressing := serve(&Opts{TunnelCompression: true})
+	defer compressing.Close()
+	plain := serve(&Opts{})
+	defer plain.Close()
+
+	data := make([]byte, 256<<10)
+	roundTrip := func(conn net.Conn) {
+		go conn.Write(data)
+		echoed := make([]byte, len(data))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := io.ReadFull(conn, echoed)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(data, echoed))
+	}
+
+	conn, err := ChainDial(nil, &Upstream{Addr: compressing.Addr().String(), Compress: true})(context.Background(), true, "tcp", origin.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	compressed, ok := conn.(*compressedConn)
+	require.True(t, ok, "Upstream should agree to compress")
+	roundTrip(conn)
+	assert.True(t, atomic.LoadInt64(&compressing.read) < int64(len(data)/10), "Tunnel should be compressed on the wire, read %d bytes", atomic.LoadInt64(&compressing.read))
+
+	// Half-closing finishes the stream, after which the origin is done too
+	require.NoError(t, compressed.CloseWrite())
+	rest, err := ioutil.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Empty(t, rest)
+
+	conn, err = ChainDial(nil, &Upstream{Addr: plain.Addr().String(), Compress: true})(context.Background(), true, "tcp", origin.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, ok = conn.(*compressedConn)
+	assert.False(t, ok, "Proxies without TunnelCompression shouldn't compress")
+	roundTrip(conn)
+}
+
+func TestAcceptsTunnelCompression(t *testing.T) {
+	for value, expected := range map[string]bool{
+		"":              false,
+		"deflate":       true,
+		"zstd, Deflate": true,
+		"gzip":          false,
+	} {
+		assert.Equal(t, expected, acceptsTunnelCompression(map[string][]string{TunnelCompressionHeader: {value}}), value)
+	}
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// TunnelStats counts the bytes flowing through a single tunnel.
+type TunnelStats struct {
+	// kept first for 64-bit alignment
+	bytesUp   int64
+	bytesDown int64
+
+	// UpstreamAddr is the address being tunneled to
+	UpstreamAddr string
+
+	// Start is when data started flowing through the tunnel
+	Start time.Time
+
+	// Duration is how long the tunnel lasted, only set once it's complete
+	Duration time.Duration
+}
+
+// BytesUp returns the number of bytes sent from the client to upstream so far.
+func (stats *TunnelStats) BytesUp() int64 {
+	return atomic.LoadInt64(&stats.bytesUp)
+}
+
+// BytesDown returns the number of bytes sent from upstream to the client so
+// far.
+func (stats *TunnelStats) BytesDown() int64 {
+	return atomic.LoadInt64(&stats.bytesDown)
+}
+
+// CurrentTunnelStats returns the live TunnelStats of the tunnel currently open
+// on the connection associated with ctx, or nil if there is none. Bytes are
+// only counted if AccessLogger, OnTunnelComplete, CountTunnelBytes or
+// Accounting is configured.
+func CurrentTunnelStats(ctx context.Context) *TunnelStats {
+	holder, ok := ctx.Value(ctxKeyTunnelStats).(*atomic.Value)
+	if !ok {
+		return nil
+	}
+	stats, _ := holder.Load().(*TunnelStats)
+	return stats
+}
+
+func withTunnelStats(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKeyTunnelStats, &atomic.Value{})
+}
+
+func setCurrentTunnelStats(ctx context.Context, stats *TunnelStats) {
+	if holder, ok := ctx.Value(ctxKeyTunnelStats).(*atomic.Value); ok {
+		holder.Store(stats)
+	}
+}
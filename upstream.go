@@ -0,0 +1,385 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/preconn"
+)
+
+const (
+	// UpstreamHTTP identifies an upstream HTTP proxy that supports CONNECT.
+	UpstreamHTTP = "http"
+
+	// UpstreamSOCKS5 identifies an upstream SOCKS5 proxy.
+	UpstreamSOCKS5 = "socks5"
+)
+
+// Upstream describes an upstream proxy through which dials can be chained.
+type Upstream struct {
+	// Protocol is one of UpstreamHTTP or UpstreamSOCKS5, defaults to
+	// UpstreamHTTP.
+	Protocol string
+
+	// Addr is the host:port of the upstream proxy.
+	Addr string
+
+	// Username and Password, if specified, are used to authenticate to the
+	// upstream proxy (Basic or NTLM for HTTP, RFC 1929 for SOCKS5).
+	Username string
+	Password string
+
+	// NTLM authenticates to the upstream proxy with NTLMv2 rather than Basic
+	// (HTTP only), in which case Username may be qualified with the domain as
+	// DOMAIN\user or user@domain. The handshake takes two CONNECT requests on
+	// the same connection.
+	NTLM bool
+
+	// Transport, if specified, obfuscates the connection to the upstream
+	// proxy, which has to accept it with NewTransportListener. It's applied
+	// before TLSConfig.
+	Transport Transport
+
+	// TLSConfig, if specified, causes the connection to the upstream proxy to
+	// be encrypted with TLS. If no ServerName is configured, the host from Addr
+	// is used.
+	TLSConfig *tls.Config
+
+	// Header contains additional headers to send with CONNECT requests (HTTP
+	// only).
+	Header http.Header
+
+	// Compress asks the upstream proxy to compress tunnels with
+	// TunnelCompressionHeader (HTTP only), which only proxies like this one with
+	// TunnelCompression enabled agree to. Tunnels stay uncompressed if the
+	// upstream proxy doesn't agree. Since compression happens on top of TLS,
+	// it only pays off for tunnels of compressible data, like plain HTTP.
+	Compress bool
+}
+
+// ParseUpstream parses an upstream proxy URL of the form
+// scheme://[user:password@]host:port[?compress=true][&auth=ntlm], where scheme
+// is one of http, https or socks5.
+func ParseUpstream(rawurl string) (*Upstream, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, errors.New("Unable to parse upstream URL %v: %v", rawurl, err)
+	}
+	upstream := &Upstream{Addr: u.Host}
+	switch u.Scheme {
+	case "http":
+		upstream.Protocol = UpstreamHTTP
+	case "https":
+		upstream.Protocol = UpstreamHTTP
+		upstream.TLSConfig = &tls.Config{}
+	case "socks5":
+		upstream.Protocol = UpstreamSOCKS5
+	default:
+		return nil, errors.New("Unsupported upstream scheme %v", u.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, errors.New("Upstream URL %v is missing a port", rawurl)
+	}
+	if u.User != nil {
+		upstream.Username = u.User.Username()
+		upstream.Password, _ = u.User.Password()
+	}
+	if compress := u.Query().Get("compress"); compress != "" {
+		upstream.Compress, err = strconv.ParseBool(compress)
+		if err != nil {
+			return nil, errors.New("Invalid compress parameter in upstream URL %v: %v", rawurl, err)
+		}
+	}
+	switch auth := u.Query().Get("auth"); auth {
+	case "", "basic":
+	case "ntlm":
+		if upstream.Protocol != UpstreamHTTP {
+			return nil, errors.New("NTLM is only supported for HTTP upstream proxies, not %v", rawurl)
+		}
+		upstream.NTLM = true
+	default:
+		return nil, errors.New("Unsupported auth %v in upstream URL %v", auth, rawurl)
+	}
+	return upstream, nil
+}
+
+// ChainDial returns a DialFunc that reaches its destination by tunneling
+// through the given upstream proxies in order (multi-hop). The connection to
+// the first upstream is made using dial, or a plain TCP dial if dial is nil.
+// Both CONNECT and plain HTTP requests are tunneled, so upstream HTTP proxies
+// need to allow CONNECT to all destination ports.
+func ChainDial(dial DialFunc, upstreams ...*Upstream) DialFunc {
+	if dial == nil {
+		dialer := &net.Dialer{}
+		dial = func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		if len(upstreams) == 0 {
+			return dial(ctx, isCONNECT, network, addr)
+		}
+		conn, err := dial(ctx, isCONNECT, "tcp", upstreams[0].Addr)
+		if err != nil {
+			return nil, errors.New("Unable to dial upstream proxy at %v: %v", upstreams[0].Addr, err)
+		}
+		for i, upstream := range upstreams {
+			target := addr
+			if i < len(upstreams)-1 {
+				target = upstreams[i+1].Addr
+			}
+			conn, err = upstream.tunnel(ctx, conn, target)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return conn, nil
+	}
+}
+
+// tunnel establishes a tunnel to target over conn, which is connected to this
+// upstream proxy.
+func (upstream *Upstream) tunnel(ctx context.Context, conn net.Conn, target string) (net.Conn, error) {
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if upstream.Transport != nil {
+		wrapped, err := upstream.Transport.Client(ctx, conn)
+		if err != nil {
+			return conn, errors.New("Unable to establish transport to upstream proxy at %v: %v", upstream.Addr, err)
+		}
+		conn = wrapped
+		if hasDeadline {
+			// The transport may have cleared the deadline after its handshake
+			conn.SetDeadline(deadline)
+		}
+	}
+
+	if upstream.TLSConfig != nil {
+		tlsConfig := upstream.TLSConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(upstream.Addr)
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return conn, errors.New("TLS handshake with upstream proxy at %v failed: %v", upstream.Addr, err)
+		}
+		conn = tlsConn
+	}
+
+	switch upstream.Protocol {
+	case "", UpstreamHTTP:
+		return upstream.tunnelHTTP(conn, target)
+	case UpstreamSOCKS5:
+		return conn, upstream.tunnelSOCKS5(conn, target)
+	default:
+		return conn, errors.New("Unsupported upstream protocol %v", upstream.Protocol)
+	}
+}
+
+func (upstream *Upstream) tunnelHTTP(conn net.Conn, target string) (net.Conn, error) {
+	br := bufio.NewReader(conn)
+	var resp *http.Response
+	var err error
+	if upstream.NTLM {
+		resp, err = upstream.connectNTLM(conn, br, target)
+	} else {
+		var authorization string
+		if upstream.Username != "" || upstream.Password != "" {
+			authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(upstream.Username+":"+upstream.Password))
+		}
+		resp, err = upstream.connect(conn, br, target, authorization)
+	}
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, errors.New("Upstream proxy at %v responded to CONNECT %v with %v", upstream.Addr, target, resp.Status)
+	}
+	if buffered := br.Buffered(); buffered > 0 {
+		b, _ := br.Peek(buffered)
+		conn = preconn.Wrap(conn, b)
+	}
+	if upstream.Compress && acceptsTunnelCompression(resp.Header) {
+		return newCompressedConn(conn), nil
+	}
+	return conn, nil
+}
+
+// connect sends a CONNECT request for target and reads the response, leaving
+// its body to the caller.
+func (upstream *Upstream) connect(conn net.Conn, br *bufio.Reader, target string, authorization string) (*http.Response, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	for key, values := range upstream.Header {
+		req.Header[key] = values
+	}
+	if authorization != "" {
+		req.Header.Set("Proxy-Authorization", authorization)
+	}
+	if upstream.Compress {
+		req.Header.Set(TunnelCompressionHeader, TunnelCompressionDeflate)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, errors.New("Unable to send CONNECT to upstream proxy at %v: %v", upstream.Addr, err)
+	}
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, errors.New("Unable to read CONNECT response from upstream proxy at %v: %v", upstream.Addr, err)
+	}
+	return resp, nil
+}
+
+// connectNTLM sends CONNECT requests for target that take the upstream proxy
+// through an NTLM handshake, returning the response to the last one.
+func (upstream *Upstream) connectNTLM(conn net.Conn, br *bufio.Reader, target string) (*http.Response, error) {
+	resp, err := upstream.connect(conn, br, target, "NTLM "+base64.StdEncoding.EncodeToString(ntlmNegotiateMessage()))
+	if err != nil || resp.StatusCode != http.StatusProxyAuthRequired {
+		return resp, err
+	}
+	// The handshake continues on this connection, so the body has to be read
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		return nil, errors.New("Unable to read NTLM challenge from upstream proxy at %v: %v", upstream.Addr, err)
+	}
+	resp.Body.Close()
+	if resp.Close {
+		return nil, errors.New("Upstream proxy at %v closed the connection during the NTLM handshake", upstream.Addr)
+	}
+	var encoded string
+	for _, value := range resp.Header["Proxy-Authenticate"] {
+		if len(value) > 5 && strings.EqualFold(value[:5], "NTLM ") {
+			encoded = strings.TrimSpace(value[5:])
+			break
+		}
+	}
+	if encoded == "" {
+		return nil, errors.New("Upstream proxy at %v didn't send an NTLM challenge", upstream.Addr)
+	}
+	msg, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("Invalid NTLM challenge from upstream proxy at %v: %v", upstream.Addr, err)
+	}
+	challenge, err := parseNTLMChallenge(msg)
+	if err != nil {
+		return nil, errors.New("Invalid NTLM challenge from upstream proxy at %v: %v", upstream.Addr, err)
+	}
+	authenticate, err := ntlmAuthenticateMessage(challenge, upstream.Username, upstream.Password)
+	if err != nil {
+		return nil, err
+	}
+	return upstream.connect(conn, br, target, "NTLM "+base64.StdEncoding.EncodeToString(authenticate))
+}
+
+func (upstream *Upstream) tunnelSOCKS5(conn net.Conn, target string) error {
+	methods := []byte{socksAuthNone}
+	if upstream.Username != "" {
+		methods = append(methods, socksAuthPassword)
+	}
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return errors.New("Unable to send SOCKS5 greeting to %v: %v", upstream.Addr, err)
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return errors.New("Unable to read SOCKS5 auth method from %v: %v", upstream.Addr, err)
+	}
+	switch resp[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		msg := []byte{socksPasswordVersion, byte(len(upstream.Username))}
+		msg = append(msg, upstream.Username...)
+		msg = append(msg, byte(len(upstream.Password)))
+		msg = append(msg, upstream.Password...)
+		if _, err := conn.Write(msg); err != nil {
+			return errors.New("Unable to send SOCKS5 credentials to %v: %v", upstream.Addr, err)
+		}
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return errors.New("Unable to read SOCKS5 auth status from %v: %v", upstream.Addr, err)
+		}
+		if resp[1] != 0x00 {
+			return errors.New("SOCKS5 proxy at %v rejected credentials", upstream.Addr)
+		}
+	default:
+		return errors.New("SOCKS5 proxy at %v accepted none of our auth methods", upstream.Addr)
+	}
+
+	host, portString, err := net.SplitHostPort(target)
+	if err != nil {
+		return errors.New("Invalid SOCKS5 target %v: %v", target, err)
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return errors.New("Invalid SOCKS5 target port %v: %v", target, err)
+	}
+	req := []byte{socks5Version, socksCmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		req = append(req, socksAddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socksAddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socksAddrIPv6)
+		req = append(req, ip...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return errors.New("Unable to send SOCKS5 request to %v: %v", upstream.Addr, err)
+	}
+
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return errors.New("Unable to read SOCKS5 reply from %v: %v", upstream.Addr, err)
+	}
+	if reply[1] != socksReplySucceeded {
+		return errors.New("SOCKS5 proxy at %v failed to connect to %v with reply code %d", upstream.Addr, target, reply[1])
+	}
+	var skip int
+	switch reply[3] {
+	case socksAddrIPv4:
+		skip = net.IPv4len
+	case socksAddrIPv6:
+		skip = net.IPv6len
+	case socksAddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return errors.New("Unable to read SOCKS5 bound address from %v: %v", upstream.Addr, err)
+		}
+		skip = int(length[0])
+	default:
+		return errors.New("SOCKS5 proxy at %v replied with unknown address type %d", upstream.Addr, reply[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip+2)); err != nil {
+		return errors.New("Unable to read SOCKS5 bound address from %v: %v", upstream.Addr, err)
+	}
+	return nil
+}
+
+func (upstream *Upstream) String() string {
+	protocol := upstream.Protocol
+	if protocol == "" {
+		protocol = UpstreamHTTP
+	}
+	return fmt.Sprintf("%v://%v", protocol, upstream.Addr)
+}
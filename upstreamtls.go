@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/netx"
+)
+
+// TLSConfigFunc returns the TLS configuration to use when originating TLS to
+// the given upstream host, for example to set per-destination roots, pinned
+// certificates, cipher suites or session caches. Returning nil uses the
+// default configuration. If the returned config has no ServerName, host is
+// used.
+type TLSConfigFunc func(host string) *tls.Config
+
+// tlsConfigFor returns a copy of the config that configFor returns for host,
+// falling back to a copy of fallback, with ServerName defaulting to host.
+func tlsConfigFor(configFor TLSConfigFunc, host string, fallback *tls.Config) *tls.Config {
+	var cfg *tls.Config
+	if configFor != nil {
+		cfg = configFor(host)
+	}
+	if cfg == nil {
+		cfg = fallback
+	}
+	if cfg == nil {
+		cfg = &tls.Config{}
+	} else {
+		cfg = cfg.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	return cfg
+}
+
+// tlsClientHandshake originates TLS on conn and completes the handshake within
+// timeout, if specified.
+func tlsClientHandshake(conn net.Conn, cfg *tls.Config, timeout time.Duration) (*tls.Conn, error) {
+	tlsConn := tls.Client(conn, cfg)
+	if timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		err = errors.New("Unable to complete TLS handshake with %v: %v", cfg.ServerName, err)
+		if causedBy(err, isCertificateError) && !causedBy(err, func(cause error) bool { _, ok := cause.(*UpstreamCertificateError); return ok }) {
+			err = &UpstreamCertificateError{Host: cfg.ServerName, Err: err}
+		}
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// dialTLSWith returns a function for http.Transport.DialTLSContext that dials
+// with dial and originates TLS configured by configFor.
+func dialTLSWith(configFor TLSConfigFunc, timeout time.Duration, dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, errors.New("Unable to split host and port for %v: %v", addr, err)
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return tlsClientHandshake(conn, tlsConfigFor(configFor, host, nil), timeout)
+	}
+}
+
+// upstreamTLSConfig returns the config for originating TLS to host, as
+// configured by UpstreamTLSConfig and UpstreamVerification.
+func (proxy *proxy) upstreamTLSConfig(host string, fallback *tls.Config) *tls.Config {
+	cfg := tlsConfigFor(proxy.UpstreamTLSConfig, host, fallback)
+	if proxy.UpstreamVerification != nil {
+		proxy.UpstreamVerification.apply(cfg, host)
+	}
+	return cfg
+}
+
+// originatesUpstreamTLS indicates whether the proxy originates TLS to
+// upstream itself, rather than leaving it to http.Transport and the mitm
+// package.
+func (proxy *proxy) originatesUpstreamTLS() bool {
+	return proxy.UpstreamTLSConfig != nil || proxy.UpstreamVerification != nil
+}
+
+// setUpstreamTLS makes tr originate TLS as configured by UpstreamTLSConfig
+// and UpstreamVerification, if specified.
+func (proxy *proxy) setUpstreamTLS(tr *http.Transport) {
+	if proxy.originatesUpstreamTLS() {
+		configFor := func(host string) *tls.Config {
+			return proxy.upstreamTLSConfig(host, nil)
+		}
+		tr.DialTLSContext = dialTLSWith(configFor, proxy.Timeouts.TLSHandshake, tr.DialContext)
+	}
+}
+
+// skipMITMEncryptionConn marks upstream connections on which the mitm package
+// shouldn't originate TLS, because we do so ourselves, see
+// originatesUpstreamTLS.
+type skipMITMEncryptionConn struct {
+	net.Conn
+}
+
+// MITMSkipEncryption implements the marker interface of the mitm package
+func (conn *skipMITMEncryptionConn) MITMSkipEncryption() {}
+
+// Wrapped implements the interface netx.WrappedConn
+func (conn *skipMITMEncryptionConn) Wrapped() net.Conn {
+	return conn.Conn
+}
+
+// skipsMITMEncryption indicates whether conn (or a connection it wraps) is
+// already marked as not to be encrypted by the mitm package.
+func skipsMITMEncryption(conn net.Conn) bool {
+	skip := false
+	netx.WalkWrapped(conn, func(wrapped net.Conn) bool {
+		_, skip = wrapped.(interface{ MITMSkipEncryption() })
+		return !skip
+	})
+	return skip
+}
+
+// mitmUpstreamTLS originates TLS on the MITM'ed upstream connection using the
+// server name requested by the client.
+func (proxy *proxy) mitmUpstreamTLS(downstream net.Conn, upstream net.Conn) (net.Conn, error) {
+	tlsDown, ok := downstream.(*tls.Conn)
+	if !ok {
+		return nil, errors.New("Unexpected MITM'ed connection type %T", downstream)
+	}
+	host := tlsDown.ConnectionState().ServerName
+	return tlsClientHandshake(upstream, proxy.upstreamTLSConfig(host, proxy.MITMOpts.ClientTLSConfig), proxy.Timeouts.TLSHandshake)
+}
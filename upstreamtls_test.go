@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	ht "net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/getlantern/mitm"
+	"github.com/getlantern/mockconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSConfigFor(t *testing.T) {
+	fallback := &tls.Config{MinVersion: tls.VersionTLS12}
+	cfg := tlsConfigFor(nil, "example.com", fallback)
+	assert.Equal(t, "example.com", cfg.ServerName)
+	assert.EqualValues(t, tls.VersionTLS12, cfg.MinVersion)
+	assert.Empty(t, fallback.ServerName, "Fallback shouldn't be modified")
+
+	configured := &tls.Config{ServerName: "other.com"}
+	configFor := func(host string) *tls.Config {
+		if host == "example.com" {
+			return configured
+		}
+		return nil
+	}
+	cfg = tlsConfigFor(configFor, "example.com", fallback)
+	assert.Equal(t, "other.com", cfg.ServerName)
+	assert.True(t, cfg != configured, "Config should be copied")
+	assert.Equal(t, "example.org", tlsConfigFor(configFor, "example.org", nil).ServerName)
+}
+
+// upstreamTLSConfigFor returns a TLSConfigFunc that trusts origin and records
+// the hosts it was called for.
+func upstreamTLSConfigFor(origin *ht.Server) (TLSConfigFunc, func() []string) {
+	var mx sync.Mutex
+	var hosts []string
+	roots := x509.NewCertPool()
+	roots.AddCert(origin.Certificate())
+	return func(host string) *tls.Config {
+			mx.Lock()
+			hosts = append(hosts, host)
+			mx.Unlock()
+			return &tls.Config{RootCAs: roots}
+		}, func() []string {
+			mx.Lock()
+			defer mx.Unlock()
+			return append([]string(nil), hosts...)
+		}
+}
+
+func TestUpstreamTLSConfigForwarding(t *testing.T) {
+	origin := ht.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	get := func(opts *Opts) (*http.Response, error) {
+		req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+		toSend := &bytes.Buffer{}
+		require.NoError(t, req.WriteProxy(toSend))
+		received := &bytes.Buffer{}
+		conn := mockconn.New(received, toSend)
+		if err := newProxy(opts).Handle(context.Background(), conn, conn); err != nil {
+			return nil, err
+		}
+		return http.ReadResponse(bufio.NewReader(received), req)
+	}
+
+	_, err := get(&Opts{})
+	assert.Error(t, err, "Origin with self-signed certificate shouldn't be trusted by default")
+
+	configFor, hosts := upstreamTLSConfigFor(origin)
+	resp, err := get(&Opts{UpstreamTLSConfig: configFor})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, []string{"127.0.0.1"}, hosts())
+}
+
+func TestUpstreamTLSConfigMITM(t *testing.T) {
+	dir := t.TempDir()
+	origin := ht.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Host))
+	}))
+	defer origin.Close()
+
+	configFor, hosts := upstreamTLSConfigFor(origin)
+	p := newProxy(&Opts{
+		MITMOpts: &mitm.Opts{
+			PKFile:   filepath.Join(dir, "proxypk.pem"),
+			CertFile: filepath.Join(dir, "proxycert.pem"),
+			Domains:  []string{"example.com"},
+		},
+		UpstreamTLSConfig: configFor,
+		Dial: func(ctx context.Context, isConnect bool, network, addr string) (net.Conn, error) {
+			return net.Dial(network, origin.Listener.Addr().String())
+		},
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go p.Serve(l)
+
+	conn, _, resp := openTunnel(t, l.Addr().String(), "example.com:443")
+	defer conn.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+	require.NoError(t, req.Write(tlsConn))
+	resp, err = http.ReadResponse(bufio.NewReader(tlsConn), req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "example.com", string(body))
+	assert.Equal(t, []string{"example.com"}, hosts(), "Should have originated TLS to the client's server name")
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/getlantern/errors"
+)
+
+// StatusInvalidUpstreamCertificate is the status of responses to requests
+// whose upstream presented a certificate that failed verification, after the
+// similar 526 Invalid SSL Certificate of some CDNs.
+const StatusInvalidUpstreamCertificate = 526
+
+// UpstreamVerification tightens the verification of the certificates
+// presented by upstream servers when the proxy originates TLS to them, i.e.
+// to MITM'ed destinations and when forwarding requests for https URLs. The
+// usual verification against the roots of UpstreamTLSConfig (or the system
+// roots) still applies first, unless the config skips it. Failures are
+// reported to clients with StatusInvalidUpstreamCertificate.
+type UpstreamVerification struct {
+	// Pins restrict which public keys destinations may present. The first pin
+	// set whose Hosts match the destination applies, destinations that match
+	// none aren't pinned.
+	Pins []*PinSet
+
+	// Verify, if specified, is called with the destination host and the
+	// verified chains (or the presented chain if verification against roots
+	// is skipped) once they have passed the pins, and rejects the connection
+	// if it returns an error.
+	Verify func(host string, chains [][]*x509.Certificate) error
+}
+
+// PinSet pins the destinations matching Hosts to a set of public keys.
+type PinSet struct {
+	// Hosts are glob patterns (as in path.Match) matched case-insensitively
+	// against the destination host, like for Route.
+	Hosts []string
+
+	// SPKI are the accepted pins, see SPKIPin. A destination matches if any
+	// certificate in its chain has one of them, so that pinning an
+	// intermediate covers all of its leaves. If verification against roots is
+	// skipped, the presented chain only counts up to where it stops being
+	// linked by signatures from the leaf, since anyone can append a public
+	// intermediate to their own leaf.
+	SPKI []string
+}
+
+// SPKIPin returns the pin of cert's public key, the base64 encoded SHA-256
+// digest of its SubjectPublicKeyInfo like in the pin-sha256 of HPKP (RFC
+// 7469). It can be computed with
+//
+//	openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func SPKIPin(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// apply makes cfg verify host's certificates as configured.
+func (v *UpstreamVerification) apply(cfg *tls.Config, host string) {
+	pins := v.pinsFor(host)
+	if pins == nil && v.Verify == nil {
+		return
+	}
+	verifyPeerCertificate := cfg.VerifyPeerCertificate
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if verifyPeerCertificate != nil {
+			if err := verifyPeerCertificate(rawCerts, verifiedChains); err != nil {
+				return err
+			}
+		}
+		chains := verifiedChains
+		verified := len(chains) > 0
+		if !verified {
+			presented := make([]*x509.Certificate, 0, len(rawCerts))
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return &UpstreamCertificateError{Host: host, Err: errors.New("Unable to parse certificate of %v: %v", host, err)}
+				}
+				presented = append(presented, cert)
+			}
+			chains = [][]*x509.Certificate{presented}
+		}
+		matched := matchesPins
+		if !verified {
+			matched = linkedChainMatchesPins
+		}
+		if pins != nil && !matched(chains, pins) {
+			return &UpstreamCertificateError{Host: host, Err: errors.New("No certificate of %v matches its pins", host)}
+		}
+		if v.Verify != nil {
+			if err := v.Verify(host, chains); err != nil {
+				return &UpstreamCertificateError{Host: host, Err: errors.New("Certificate of %v rejected: %v", host, err)}
+			}
+		}
+		return nil
+	}
+}
+
+func (v *UpstreamVerification) pinsFor(host string) []string {
+	host = strings.ToLower(host)
+	for _, set := range v.Pins {
+		for _, pattern := range set.Hosts {
+			if matched, _ := path.Match(strings.ToLower(pattern), host); matched {
+				return set.SPKI
+			}
+		}
+	}
+	return nil
+}
+
+func matchesPins(chains [][]*x509.Certificate, pins []string) bool {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if hasPin(cert, pins) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// linkedChainMatchesPins is like matchesPins for the presented chain that
+// wasn't verified, only considering certificates that sign the previous one, starting from the
+// leaf. The leaf itself counts since the handshake proves possession of its
+// key.
+func linkedChainMatchesPins(chains [][]*x509.Certificate, pins []string) bool {
+	chain := chains[0]
+	for i, cert := range chain {
+		if i > 0 && chain[i-1].CheckSignatureFrom(cert) != nil {
+			return false
+		}
+		if hasPin(cert, pins) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPin(cert *x509.Certificate, pins []string) bool {
+	pin := SPKIPin(cert)
+	for _, candidate := range pins {
+		if pin == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+// isCertificateError indicates whether err reports an upstream certificate
+// that failed verification.
+func isCertificateError(err error) bool {
+	switch err.(type) {
+	case *UpstreamCertificateError, x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError:
+		return true
+	}
+	return false
+}
+
+// certificateErrorResponse is the response to requests whose upstream failed
+// certificate verification with err.
+func certificateErrorResponse(err error) *http.Response {
+	body := err.Error()
+	resp := &http.Response{
+		StatusCode:    StatusInvalidUpstreamCertificate,
+		Status:        "526 " + statusText(StatusInvalidUpstreamCertificate),
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	return resp
+}
+
+// statusText is like http.StatusText, but also knows
+// StatusInvalidUpstreamCertificate.
+func statusText(statusCode int) string {
+	if statusCode == StatusInvalidUpstreamCertificate {
+		return "Invalid Upstream Certificate"
+	}
+	return http.StatusText(statusCode)
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	ht "net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/getlantern/mitm"
+	"github.com/getlantern/mockconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamVerificationForwarding(t *testing.T) {
+	origin := ht.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+	configFor, _ := upstreamTLSConfigFor(origin)
+	pin := SPKIPin(origin.Certificate())
+
+	get := func(opts *Opts) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+		toSend := &bytes.Buffer{}
+		require.NoError(t, req.WriteProxy(toSend))
+		received := &bytes.Buffer{}
+		conn := mockconn.New(received, toSend)
+		newProxy(opts).Handle(context.Background(), conn, conn)
+		resp, err := http.ReadResponse(bufio.NewReader(received), req)
+		require.NoError(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := get(&Opts{
+		UpstreamTLSConfig:    configFor,
+		UpstreamVerification: &UpstreamVerification{Pins: []*PinSet{{Hosts: []string{"127.0.0.*"}, SPKI: []string{"bogus", pin}}}},
+	})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "hello", body)
+
+	status, body = get(&Opts{
+		UpstreamTLSConfig:    configFor,
+		UpstreamVerification: &UpstreamVerification{Pins: []*PinSet{{Hosts: []string{"127.0.0.1"}, SPKI: []string{"bogus"}}}},
+	})
+	assert.Equal(t, StatusInvalidUpstreamCertificate, status)
+	assert.Contains(t, body, "matches its pins")
+
+	status, _ = get(&Opts{
+		UpstreamTLSConfig:    configFor,
+		UpstreamVerification: &UpstreamVerification{Pins: []*PinSet{{Hosts: []string{"example.com"}, SPKI: []string{"bogus"}}}},
+	})
+	assert.Equal(t, http.StatusOK, status, "Unpinned hosts should pass")
+
+	var verifiedHost string
+	status, body = get(&Opts{
+		UpstreamTLSConfig: configFor,
+		UpstreamVerification: &UpstreamVerification{Verify: func(host string, chains [][]*x509.Certificate) error {
+			verifiedHost = host
+			return errors.New("not on my watch")
+		}},
+	})
+	assert.Equal(t, StatusInvalidUpstreamCertificate, status)
+	assert.Contains(t, body, "not on my watch")
+	assert.Equal(t, "127.0.0.1", verifiedHost)
+
+	status, _ = get(&Opts{})
+	assert.Equal(t, StatusInvalidUpstreamCertificate, status, "Untrusted roots should be reported too")
+}
+
+func TestUpstreamVerificationMITM(t *testing.T) {
+	dir := t.TempDir()
+	origin := ht.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Host))
+	}))
+	defer origin.Close()
+
+	l := serveProxy(t, &Opts{
+		MITMOpts: &mitm.Opts{
+			PKFile:   filepath.Join(dir, "proxypk.pem"),
+			CertFile: filepath.Join(dir, "proxycert.pem"),
+			Domains:  []string{"example.com"},
+		},
+		UpstreamVerification: &UpstreamVerification{
+			Pins: []*PinSet{{Hosts: []string{"*"}, SPKI: []string{"bogus"}}},
+		},
+		Dial: func(ctx context.Context, isConnect bool, network, addr string) (net.Conn, error) {
+			return net.Dial(network, origin.Listener.Addr().String())
+		},
+	})
+	defer l.Close()
+
+	conn, _, resp := openTunnel(t, l.Addr().String(), "example.com:443")
+	defer conn.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+	require.NoError(t, req.Write(tlsConn))
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), req)
+	require.NoError(t, err)
+	assert.Equal(t, StatusInvalidUpstreamCertificate, resp.StatusCode)
+}
+
+func TestUpstreamCertificateErrorStatus(t *testing.T) {
+	err := &UpstreamCertificateError{Host: "example.com", Err: errors.New("bad pin")}
+	assert.Equal(t, StatusInvalidUpstreamCertificate, ErrorStatus(fmt.Errorf("wrapped: %w", err)))
+	assert.True(t, errors.Is(err, &UpstreamCertificateError{Host: "example.com"}))
+	assert.False(t, errors.Is(err, &UpstreamCertificateError{Host: "example.org"}))
+	assert.Equal(t, StatusInvalidUpstreamCertificate, ErrorStatus(x509.UnknownAuthorityError{}))
+	assert.Equal(t, "Invalid Upstream Certificate", statusText(StatusInvalidUpstreamCertificate))
+}
+
+func TestUpstreamVerificationUnverifiedChain(t *testing.T) {
+	intermediate := issueTestCert(t, "intermediate", 1, nil)
+	leaf := issueTestCert(t, "leaf", 2, intermediate)
+	forged := issueTestCert(t, "forged", 3, nil)
+	v := &UpstreamVerification{Pins: []*PinSet{{Hosts: []string{"*"}, SPKI: []string{SPKIPin(intermediate.Leaf)}}}}
+	cfg := &tls.Config{InsecureSkipVerify: true}
+	v.apply(cfg, "example.com")
+
+	assert.NoError(t, cfg.VerifyPeerCertificate([][]byte{leaf.Certificate[0], intermediate.Certificate[0]}, nil))
+	err := cfg.VerifyPeerCertificate([][]byte{forged.Certificate[0], intermediate.Certificate[0]}, nil)
+	assert.Error(t, err, "Pinned intermediate that didn't sign the leaf shouldn't match")
+	assert.True(t, isCertificateError(err))
+	assert.Error(t, cfg.VerifyPeerCertificate([][]byte{forged.Certificate[0], leaf.Certificate[0], intermediate.Certificate[0]}, nil))
+
+	v = &UpstreamVerification{Pins: []*PinSet{{Hosts: []string{"*"}, SPKI: []string{SPKIPin(leaf.Leaf)}}}}
+	cfg = &tls.Config{InsecureSkipVerify: true}
+	v.apply(cfg, "example.com")
+	assert.NoError(t, cfg.VerifyPeerCertificate([][]byte{leaf.Certificate[0]}, nil), "Pinned leaf should match by itself")
+}
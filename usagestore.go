@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+// NewMemoryUsageStore creates a UsageStore that keeps usage in memory, so it's
+// lost when the process exits.
+func NewMemoryUsageStore() UsageStore {
+	return &memoryUsageStore{usage: make(map[string]map[int64]*Usage)}
+}
+
+type memoryUsageStore struct {
+	mx    sync.Mutex
+	usage map[string]map[int64]*Usage
+}
+
+func (s *memoryUsageStore) Add(records []UsageRecord) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for _, record := range records {
+		windows := s.usage[record.Client]
+		if windows == nil {
+			windows = make(map[int64]*Usage)
+			s.usage[record.Client] = windows
+		}
+		window := record.Window.UnixNano()
+		usage := windows[window]
+		if usage == nil {
+			usage = &Usage{}
+			windows[window] = usage
+		}
+		usage.add(record.Usage)
+	}
+	return nil
+}
+
+func (s *memoryUsageStore) Usage(client string, since time.Time) (Usage, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	var result Usage
+	for window, usage := range s.usage[client] {
+		if window >= since.UnixNano() {
+			result.add(*usage)
+		}
+	}
+	return result, nil
+}
+
+const (
+	sqliteCreateUsageTable = `CREATE TABLE IF NOT EXISTS proxy_usage (
+	client TEXT NOT NULL,
+	window_start INTEGER NOT NULL,
+	bytes_up INTEGER NOT NULL,
+	bytes_down INTEGER NOT NULL,
+	PRIMARY KEY (client, window_start)
+)`
+	sqliteAddUsage = `INSERT INTO proxy_usage (client, window_start, bytes_up, bytes_down) VALUES (?, ?, ?, ?)
+ON CONFLICT (client, window_start) DO UPDATE SET bytes_up = bytes_up + excluded.bytes_up, bytes_down = bytes_down + excluded.bytes_down`
+	sqliteQueryUsage = `SELECT COALESCE(SUM(bytes_up), 0), COALESCE(SUM(bytes_down), 0) FROM proxy_usage WHERE client = ? AND window_start >= ?`
+)
+
+// NewSQLiteUsageStore creates a UsageStore that keeps usage in the table
+// proxy_usage of the given SQLite database, creating the table if necessary.
+// Windows are stored as Unix timestamps in seconds. The database can be opened
+// with any SQLite driver (SQLite 3.24 or later), for example
+// github.com/mattn/go-sqlite3 or modernc.org/sqlite.
+func NewSQLiteUsageStore(db *sql.DB) (UsageStore, error) {
+	if _, err := db.Exec(sqliteCreateUsageTable); err != nil {
+		return nil, errors.New("Unable to create usage table: %v", err)
+	}
+	return &sqliteUsageStore{db: db}, nil
+}
+
+type sqliteUsageStore struct {
+	db *sql.DB
+}
+
+func (s *sqliteUsageStore) Add(records []UsageRecord) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.New("Unable to begin transaction: %v", err)
+	}
+	stmt, err := tx.Prepare(sqliteAddUsage)
+	if err != nil {
+		tx.Rollback()
+		return errors.New("Unable to prepare statement: %v", err)
+	}
+	defer stmt.Close()
+	for _, record := range records {
+		if _, err := stmt.Exec(record.Client, record.Window.Unix(), record.BytesUp, record.BytesDown); err != nil {
+			tx.Rollback()
+			return errors.New("Unable to add usage of %v: %v", record.Client, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.New("Unable to commit usage: %v", err)
+	}
+	return nil
+}
+
+func (s *sqliteUsageStore) Usage(client string, since time.Time) (Usage, error) {
+	var result Usage
+	err := s.db.QueryRow(sqliteQueryUsage, client, since.Unix()).Scan(&result.BytesUp, &result.BytesDown)
+	if err != nil {
+		return Usage{}, errors.New("Unable to query usage: %v", err)
+	}
+	return result, nil
+}
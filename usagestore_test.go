@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testUsageStore(t *testing.T, store UsageStore) {
+	hour := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	require.NoError(t, store.Add([]UsageRecord{
+		{Client: "alice", Window: hour, Usage: Usage{BytesUp: 1, BytesDown: 10}},
+		{Client: "bob", Window: hour, Usage: Usage{BytesUp: 1000, BytesDown: 1000}},
+	}))
+	require.NoError(t, store.Add([]UsageRecord{
+		{Client: "alice", Window: hour, Usage: Usage{BytesUp: 2, BytesDown: 20}},
+		{Client: "alice", Window: hour.Add(time.Hour), Usage: Usage{BytesUp: 4, BytesDown: 40}},
+	}))
+
+	usage, err := store.Usage("alice", hour)
+	require.NoError(t, err)
+	assert.Equal(t, Usage{BytesUp: 7, BytesDown: 70}, usage)
+	usage, err = store.Usage("alice", hour.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, Usage{BytesUp: 4, BytesDown: 40}, usage)
+	usage, err = store.Usage("carol", hour)
+	require.NoError(t, err)
+	assert.Equal(t, Usage{}, usage)
+}
+
+func TestMemoryUsageStore(t *testing.T) {
+	testUsageStore(t, NewMemoryUsageStore())
+}
+
+func TestSQLiteUsageStore(t *testing.T) {
+	fakeUsageDB.mx.Lock()
+	fakeUsageDB.created, fakeUsageDB.rows = false, make(map[string]map[int64]Usage)
+	fakeUsageDB.mx.Unlock()
+	db, err := sql.Open("fakeusage", "")
+	require.NoError(t, err)
+	defer db.Close()
+	store, err := NewSQLiteUsageStore(db)
+	require.NoError(t, err)
+	testUsageStore(t, store)
+
+	fakeUsageDB.mx.Lock()
+	assert.True(t, fakeUsageDB.created)
+	fakeUsageDB.mx.Unlock()
+}
+
+func init() {
+	sql.Register("fakeusage", fakeUsageDriver{})
+}
+
+// fakeUsageDB stands in for SQLite, interpreting only the statements used by
+// the SQLite usage store.
+var fakeUsageDB = &struct {
+	mx      sync.Mutex
+	created bool
+	rows    map[string]map[int64]Usage
+}{rows: make(map[string]map[int64]Usage)}
+
+type fakeUsageDriver struct{}
+
+func (fakeUsageDriver) Open(name string) (driver.Conn, error) {
+	return fakeUsageConn{}, nil
+}
+
+type fakeUsageConn struct{}
+
+func (fakeUsageConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeUsageStmt(query), nil
+}
+
+func (fakeUsageConn) Close() error { return nil }
+
+func (fakeUsageConn) Begin() (driver.Tx, error) { return fakeUsageTx{}, nil }
+
+type fakeUsageTx struct{}
+
+func (fakeUsageTx) Commit() error { return nil }
+
+func (fakeUsageTx) Rollback() error { return nil }
+
+type fakeUsageStmt string
+
+func (stmt fakeUsageStmt) Close() error { return nil }
+
+func (stmt fakeUsageStmt) NumInput() int { return -1 }
+
+func (stmt fakeUsageStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db := fakeUsageDB
+	db.mx.Lock()
+	defer db.mx.Unlock()
+	switch {
+	case string(stmt) == sqliteCreateUsageTable:
+		db.created = true
+	case string(stmt) == sqliteAddUsage:
+		client, window := args[0].(string), args[1].(int64)
+		if db.rows[client] == nil {
+			db.rows[client] = make(map[int64]Usage)
+		}
+		usage := db.rows[client][window]
+		usage.add(Usage{BytesUp: args[2].(int64), BytesDown: args[3].(int64)})
+		db.rows[client][window] = usage
+	default:
+		return nil, errors.New("Unexpected statement: %v", stmt)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (stmt fakeUsageStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if string(stmt) != sqliteQueryUsage {
+		return nil, errors.New("Unexpected query: %v", stmt)
+	}
+	db := fakeUsageDB
+	db.mx.Lock()
+	defer db.mx.Unlock()
+	var total Usage
+	for window, usage := range db.rows[args[0].(string)] {
+		if window >= args[1].(int64) {
+			total.add(usage)
+		}
+	}
+	return &fakeUsageRows{values: []driver.Value{total.BytesUp, total.BytesDown}}, nil
+}
+
+type fakeUsageRows struct {
+	values []driver.Value
+	done   bool
+}
+
+func (rows *fakeUsageRows) Columns() []string { return []string{"bytes_up", "bytes_down"} }
+
+func (rows *fakeUsageRows) Close() error { return nil }
+
+func (rows *fakeUsageRows) Next(dest []driver.Value) error {
+	if rows.done {
+		return io.EOF
+	}
+	rows.done = true
+	copy(dest, rows.values)
+	return nil
+}
@@ -0,0 +1,337 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	// headerReadAhead is how much more than MaxHeaderBytes may be read while
+	// reading headers, to account for buffering (like net/http does)
+	headerReadAhead = 4096
+)
+
+var (
+	errHeaderTooLarge = errors.New("Request headers too large")
+)
+
+// invalidRequestError is returned for requests that the proxy refuses to
+// forward because they're malformed or ambiguous.
+type invalidRequestError struct {
+	status int
+	reason string
+}
+
+func (err *invalidRequestError) Error() string {
+	return fmt.Sprintf("Invalid request: %v", err.reason)
+}
+
+func invalidRequest(status int, reason string, args ...interface{}) error {
+	return &invalidRequestError{status: status, reason: fmt.Sprintf(reason, args...)}
+}
+
+// headerRecorder sits below the bufio.Reader that requests are read from,
+// recording the raw header block while a request is being read so that it can
+// be validated before net/http normalizes it, and limiting its size.
+type headerRecorder struct {
+	r         io.Reader
+	recording bool
+	limit     int
+	head      []byte
+}
+
+func (hr *headerRecorder) Read(b []byte) (int, error) {
+	if !hr.recording {
+		return hr.r.Read(b)
+	}
+	remaining := hr.limit - len(hr.head)
+	if remaining <= 0 {
+		return 0, errHeaderTooLarge
+	}
+	if len(b) > remaining {
+		b = b[:remaining]
+	}
+	n, err := hr.r.Read(b)
+	hr.head = append(hr.head, b[:n]...)
+	return n, err
+}
+
+func (proxy *proxy) maxHeaderBytes() int {
+	if proxy.MaxHeaderBytes > 0 {
+		return proxy.MaxHeaderBytes
+	}
+	return http.DefaultMaxHeaderBytes
+}
+
+// readRequest reads the next request from br, which reads from hr, and makes
+// sure that it's safe to forward. Requests that aren't are reported with an
+// *invalidRequestError.
+func (proxy *proxy) readRequest(br *bufio.Reader, hr *headerRecorder) (*http.Request, error) {
+	maxHeaderBytes := proxy.maxHeaderBytes()
+	// Data that's already buffered belongs to this request too
+	buffered, _ := br.Peek(br.Buffered())
+	hr.head = append(hr.head[:0], buffered...)
+	hr.limit = maxHeaderBytes + headerReadAhead
+	hr.recording = true
+	req, err := http.ReadRequest(br)
+	hr.recording = false
+	head := hr.head
+	hr.head = hr.head[:0]
+	if err != nil {
+		if causedBy(err, func(cause error) bool { return cause == errHeaderTooLarge }) || len(head) >= hr.limit {
+			return nil, invalidRequest(http.StatusRequestHeaderFieldsTooLarge, "headers exceed %d bytes", maxHeaderBytes)
+		}
+		if target, ok := connectTargetOf(head); ok {
+			// net/http fails to parse some invalid targets, which deserve a
+			// better explanation
+			if _, invalid := validateCONNECTAuthority(target, proxy.DefaultCONNECTPort); invalid != nil {
+				return nil, invalid
+			}
+		}
+		return req, err
+	}
+
+	end := headerEnd(head)
+	if end < 0 || end > maxHeaderBytes {
+		return req, invalidRequest(http.StatusRequestHeaderFieldsTooLarge, "headers exceed %d bytes", maxHeaderBytes)
+	}
+	if err := proxy.validateHeaderBlock(head[:end]); err != nil {
+		return req, err
+	}
+	if err := proxy.validateCONNECTTarget(req); err != nil {
+		return req, err
+	}
+	return req, validateRequestTarget(req, rawHeaderValues(head[:end], "Host"), proxy.RejectHostMismatch)
+}
+
+// headerEnd finds the end of the header block at the start of head, or -1.
+func headerEnd(head []byte) int {
+	crlf := bytes.Index(head, []byte("\n\r\n"))
+	lf := bytes.Index(head, []byte("\n\n"))
+	switch {
+	case crlf < 0 && lf < 0:
+		return -1
+	case lf < 0 || (crlf >= 0 && crlf < lf):
+		return crlf + 3
+	default:
+		return lf + 2
+	}
+}
+
+// validateHeaderBlock checks the raw header fields of a request (which net/http
+// would otherwise normalize) for ambiguous message framing, which could be used
+// to smuggle requests past the proxy to origins that resolve it differently.
+func (proxy *proxy) validateHeaderBlock(block []byte) error {
+	lines := strings.Split(string(block), "\n")
+	// Skip the request line
+	fields := 0
+	hasContentLength, hasTransferEncoding := false, false
+	for _, line := range lines[1:] {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		fields++
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		switch strings.ToLower(line[:colon]) {
+		case "content-length":
+			hasContentLength = true
+		case "transfer-encoding":
+			hasTransferEncoding = true
+		}
+	}
+	if proxy.MaxHeaderFields > 0 && fields > proxy.MaxHeaderFields {
+		return invalidRequest(http.StatusRequestHeaderFieldsTooLarge, "more than %d header fields", proxy.MaxHeaderFields)
+	}
+	if hasContentLength && hasTransferEncoding {
+		return invalidRequest(http.StatusBadRequest, "both Content-Length and Transfer-Encoding specified")
+	}
+	return nil
+}
+
+// validateCONNECTTarget makes sure that CONNECT requests target a host and
+// port, without userinfo, applying DefaultCONNECTPort to targets without a
+// port.
+func (proxy *proxy) validateCONNECTTarget(req *http.Request) error {
+	if req.Method != http.MethodConnect {
+		return nil
+	}
+	if req.URL.User != nil {
+		return invalidRequest(http.StatusBadRequest, "CONNECT target %v contains userinfo", req.RequestURI)
+	}
+	target, err := validateCONNECTAuthority(req.URL.Host, proxy.DefaultCONNECTPort)
+	if err != nil {
+		return err
+	}
+	if target != req.URL.Host {
+		if req.Host == req.URL.Host {
+			req.Host = target
+		}
+		req.URL.Host = target
+	}
+	return nil
+}
+
+// validateCONNECTAuthority checks the host:port that a CONNECT request
+// targets, returning it with defaultPort added if it lacks a port and
+// defaultPort is specified. Failures explain how the target is invalid.
+func validateCONNECTAuthority(target string, defaultPort int) (string, error) {
+	if target == "" {
+		return "", invalidRequest(http.StatusBadRequest, "CONNECT target is empty, expected host:port")
+	}
+	if strings.Contains(target, "@") {
+		return "", invalidRequest(http.StatusBadRequest, "CONNECT target %v contains userinfo", target)
+	}
+	if !strings.HasPrefix(target, "[") && strings.Count(target, ":") > 1 {
+		// Going by the last colon first, since ::1:443 could be either
+		if colon := strings.LastIndexByte(target, ':'); net.ParseIP(target[:colon]) != nil {
+			return "", invalidRequest(http.StatusBadRequest, "IPv6 address in CONNECT target %v must be enclosed in brackets, like [%v]%v", target, target[:colon], target[colon:])
+		}
+		if ip := net.ParseIP(target); ip != nil {
+			return "", invalidRequest(http.StatusBadRequest, "IPv6 address in CONNECT target %v must be enclosed in brackets, like [%v]:443", target, target)
+		}
+		return "", invalidRequest(http.StatusBadRequest, "CONNECT target %v must be host:port", target)
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		if !strings.Contains(err.Error(), "missing port") {
+			return "", invalidRequest(http.StatusBadRequest, "CONNECT target %v must be host:port", target)
+		}
+		host = strings.TrimSuffix(strings.TrimPrefix(target, "["), "]")
+	}
+	if host == "" {
+		return "", invalidRequest(http.StatusBadRequest, "CONNECT target %v is missing a host", target)
+	}
+	if port == "" {
+		if defaultPort <= 0 {
+			return "", invalidRequest(http.StatusBadRequest, "CONNECT target %v is missing a port, expected host:port", target)
+		}
+		return net.JoinHostPort(host, strconv.Itoa(defaultPort)), nil
+	}
+	number, err := strconv.Atoi(port)
+	if err != nil || strings.TrimLeft(port, "0123456789") != "" {
+		return "", invalidRequest(http.StatusBadRequest, "port %v of CONNECT target %v isn't numeric", port, target)
+	}
+	if number < 1 || number > 65535 {
+		return "", invalidRequest(http.StatusBadRequest, "port %v of CONNECT target %v is out of range", port, target)
+	}
+	return target, nil
+}
+
+// connectTargetOf returns the target from the request line of head if it's
+// a CONNECT request.
+func connectTargetOf(head []byte) (string, bool) {
+	if !bytes.HasPrefix(head, []byte(http.MethodConnect+" ")) {
+		return "", false
+	}
+	line := head[len(http.MethodConnect)+1:]
+	if end := bytes.IndexAny(line, " \r\n"); end >= 0 {
+		line = line[:end]
+	}
+	return string(line), true
+}
+
+// validateRequestTarget checks the target of non-CONNECT requests. Requests in
+// absolute form (as sent to proxies) go to the authority of their URI, which
+// replaces the Host header as required by RFC 7230 section 5.4, unless
+// rejectMismatch is set, in which case requests whose Host header names a
+// different authority are rejected. HTTP/1.1 requests in origin form (as
+// received by transparent proxies) must have a Host header to go to. rawHost
+// are the Host headers as received.
+func validateRequestTarget(req *http.Request, rawHost []string, rejectMismatch bool) error {
+	if req.Method == http.MethodConnect {
+		return nil
+	}
+	if req.URL.Host != "" {
+		switch req.URL.Scheme {
+		case "http", "https", "ws", "wss":
+		default:
+			return invalidRequest(http.StatusBadRequest, "unsupported scheme in target %v", req.RequestURI)
+		}
+		if rejectMismatch && len(rawHost) > 0 && !sameAuthority(req.URL.Scheme, rawHost[0], req.URL.Host) {
+			return invalidRequest(http.StatusBadRequest, "Host %v doesn't match target %v", rawHost[0], req.RequestURI)
+		}
+		return nil
+	}
+	if req.Host == "" && req.ProtoAtLeast(1, 1) {
+		return invalidRequest(http.StatusBadRequest, "missing Host header for target %v", req.RequestURI)
+	}
+	return nil
+}
+
+// sameAuthority indicates whether a and b name the same host and port, with
+// the port defaulting to that of scheme.
+func sameAuthority(scheme string, a string, b string) bool {
+	return normalizeAuthority(scheme, a) == normalizeAuthority(scheme, b)
+}
+
+func normalizeAuthority(scheme string, authority string) string {
+	authority = strings.ToLower(strings.TrimSpace(authority))
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		host, port = authority, ""
+	}
+	switch {
+	case port == "80" && (scheme == "http" || scheme == "ws"), port == "443" && (scheme == "https" || scheme == "wss"):
+		port = ""
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	if port == "" {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// rawHeaderValues returns the values of the named header in the raw header
+// block, which net/http may have dropped (like Host) or normalized.
+func rawHeaderValues(block []byte, name string) []string {
+	var values []string
+	lines := strings.Split(string(block), "\n")
+	for _, line := range lines[1:] {
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		if strings.EqualFold(line[:colon], name) {
+			values = append(values, strings.TrimSpace(line[colon+1:]))
+		}
+	}
+	return values
+}
+
+// rejectInvalidRequest responds to a request that failed validation, returning
+// false if err isn't a validation failure.
+func (proxy *proxy) rejectInvalidRequest(state *connState, downstream io.Writer, req *http.Request, err error) bool {
+	invalid, ok := err.(*invalidRequestError)
+	if !ok {
+		return false
+	}
+	log.Debugf("Rejecting request: %v", err)
+	body := []byte(err.Error() + "\n")
+	resp := &http.Response{
+		StatusCode:    invalid.status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+	if req == nil {
+		req = &http.Request{Method: http.MethodGet}
+	}
+	proxy.respond(state, downstream, req, resp)
+	return true
+}
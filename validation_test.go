@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	ht "net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestValidation(t *testing.T) {
+	var dials int32
+	origin := newEchoServer(t)
+	defer origin.Close()
+	l := serveProxy(t, &Opts{
+		MaxHeaderBytes:  1024,
+		MaxHeaderFields: 10,
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return net.Dial(network, addr)
+		},
+	})
+	defer l.Close()
+
+	send := func(t *testing.T, raw string) int {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte(raw))
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	tests := []struct {
+		name   string
+		raw    string
+		status int
+	}{
+		{"conflicting length", "POST http://" + origin.Addr().String() + "/ HTTP/1.1\r\nHost: " + origin.Addr().String() + "\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", http.StatusBadRequest},
+		{"oversized headers", "GET http://" + origin.Addr().String() + "/ HTTP/1.1\r\nHost: " + origin.Addr().String() + "\r\nX-Big: " + strings.Repeat("a", 2048) + "\r\n\r\n", http.StatusRequestHeaderFieldsTooLarge},
+		{"too many fields", "GET http://" + origin.Addr().String() + "/ HTTP/1.1\r\nHost: " + origin.Addr().String() + "\r\n" + strings.Repeat("X-Field: a\r\n", 11) + "\r\n", http.StatusRequestHeaderFieldsTooLarge},
+		{"CONNECT without port", "CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n", http.StatusBadRequest},
+		{"CONNECT with userinfo", "CONNECT user:pass@" + origin.Addr().String() + " HTTP/1.1\r\nHost: " + origin.Addr().String() + "\r\n\r\n", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.status, send(t, test.raw))
+		})
+	}
+	assert.Zero(t, atomic.LoadInt32(&dials), "Invalid requests shouldn't be forwarded")
+
+	// Valid requests are forwarded
+	assert.Equal(t, http.StatusOK, send(t, "CONNECT "+origin.Addr().String()+" HTTP/1.1\r\nHost: "+origin.Addr().String()+"\r\nX-Pad: "+strings.Repeat("a", 512)+"\r\n\r\n"))
+}
+
+func TestValidateCONNECTAuthority(t *testing.T) {
+	for target, expected := range map[string]string{
+		"example.com:443": "example.com:443",
+		"[::1]:443":       "[::1]:443",
+		"example.com":     "example.com:8443",
+		"[::1]":           "[::1]:8443",
+	} {
+		validated, err := validateCONNECTAuthority(target, 8443)
+		if assert.NoError(t, err, target) {
+			assert.Equal(t, expected, validated)
+		}
+	}
+
+	for target, reason := range map[string]string{
+		"":                     "CONNECT target is empty, expected host:port",
+		"example.com":          "CONNECT target example.com is missing a port, expected host:port",
+		":443":                 "CONNECT target :443 is missing a host",
+		"::1:443":              "IPv6 address in CONNECT target ::1:443 must be enclosed in brackets, like [::1]:443",
+		"2001:db8::1":          "IPv6 address in CONNECT target 2001:db8::1 must be enclosed in brackets, like [2001:db8::1]:443",
+		"example.com:99999":    "port 99999 of CONNECT target example.com:99999 is out of range",
+		"example.com:0":        "port 0 of CONNECT target example.com:0 is out of range",
+		"example.com:https":    "port https of CONNECT target example.com:https isn't numeric",
+		"example.com:+443":     "port +443 of CONNECT target example.com:+443 isn't numeric",
+		"user@example.com:443": "CONNECT target user@example.com:443 contains userinfo",
+	} {
+		_, err := validateCONNECTAuthority(target, 0)
+		if assert.Error(t, err, target) {
+			assert.Equal(t, "Invalid request: "+reason, err.Error())
+		}
+	}
+}
+
+func TestInvalidCONNECTTargets(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(origin.Addr().String())
+
+	send := func(opts *Opts, target string) (*http.Response, string) {
+		l := serveProxy(t, opts)
+		defer l.Close()
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\n"))
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	for target, reason := range map[string]string{
+		"::1:" + port:     "must be enclosed in brackets",
+		"localhost:abc":   "isn't numeric",
+		"localhost:70000": "is out of range",
+		"localhost":       "is missing a port",
+		":" + port:        "is missing a host",
+	} {
+		resp, body := send(&Opts{}, target)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, target)
+		assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+		assert.Contains(t, body, reason, target)
+	}
+
+	resp, _ := send(&Opts{DefaultCONNECTPort: portOf(t, origin.Addr())}, "localhost")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Default port should apply")
+}
+
+func TestHeaderEnd(t *testing.T) {
+	assert.Equal(t, 18, headerEnd([]byte("GET / HTTP/1.1\r\n\r\nbody")))
+	assert.Equal(t, 16, headerEnd([]byte("GET / HTTP/1.1\n\nbody")))
+	assert.Equal(t, -1, headerEnd([]byte("GET / HTTP/1.1\r\nHost: a\r\n")))
+}
+
+func TestRequestTargetNormalization(t *testing.T) {
+	origin := ht.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Host))
+	}))
+	defer origin.Close()
+	originAddr := origin.Listener.Addr().String()
+	tlsOrigin := ht.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("tls " + req.Host))
+	}))
+	defer tlsOrigin.Close()
+	configFor, _ := upstreamTLSConfigFor(tlsOrigin)
+
+	send := func(opts *Opts, raw string) (int, string) {
+		l := serveProxy(t, opts)
+		defer l.Close()
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte(raw))
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := send(&Opts{}, "GET http://"+originAddr+"/ HTTP/1.1\r\nHost: other.com\r\n\r\n")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, originAddr, body, "Target's authority should replace Host")
+
+	status, _ = send(&Opts{RejectHostMismatch: true}, "GET http://"+originAddr+"/ HTTP/1.1\r\nHost: other.com\r\n\r\n")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, body = send(&Opts{RejectHostMismatch: true}, "GET http://"+strings.ToUpper(originAddr)+"/ HTTP/1.1\r\nHost: "+originAddr+"\r\n\r\n")
+	assert.Equal(t, http.StatusOK, status, "Host should match case-insensitively")
+
+	status, _ = send(&Opts{}, "GET ftp://"+originAddr+"/ HTTP/1.1\r\nHost: "+originAddr+"\r\n\r\n")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, _ = send(&Opts{}, "GET / HTTP/1.1\r\n\r\n")
+	assert.Equal(t, http.StatusBadRequest, status, "Origin form requires Host")
+
+	status, body = send(&Opts{}, "GET / HTTP/1.1\r\nHost: "+originAddr+"\r\n\r\n")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, originAddr, body)
+
+	tlsAddr := tlsOrigin.Listener.Addr().String()
+	status, body = send(&Opts{DefaultScheme: "https", UpstreamTLSConfig: configFor}, "GET / HTTP/1.1\r\nHost: "+tlsAddr+"\r\n\r\n")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "tls "+tlsAddr, body, "Origin form should use DefaultScheme")
+
+	assert.True(t, sameAuthority("http", "Example.com.", "example.com:80"))
+	assert.True(t, sameAuthority("https", "[::1]:443", "[::1]"))
+	assert.False(t, sameAuthority("https", "example.com:80", "example.com"))
+}
@@ -0,0 +1,333 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPrewarmMaxIdle  = 30 * time.Second
+	defaultPrewarmInterval = 10 * time.Second
+)
+
+// PrewarmOptions configures a pool of idle upstream connections that are
+// established ahead of time, so that CONNECT requests to popular destinations
+// don't have to wait for a dial.
+//
+// Warm connections are dialed with the configured Dial (so TLS to upstream
+// proxies is established too), but without the context of any request, so
+// dialers that depend on per-request context values shouldn't be prewarmed.
+// If data arrives on a warm connection before it's used, for example a
+// server's banner, it's kept for the client.
+type PrewarmOptions struct {
+	// Destinations are host:port addresses that are always kept warm.
+	Destinations []string
+
+	// LearnTop, if greater than zero, also keeps warm the LearnTop most
+	// frequently dialed CONNECT destinations. Dial counts are halved every
+	// Interval, so destinations that are no longer used are soon forgotten.
+	LearnTop int
+
+	// ConnsPerDestination is the number of warm connections kept for each
+	// destination, defaults to 1.
+	ConnsPerDestination int
+
+	// MaxIdle is how long a warm connection is kept before being replaced,
+	// which should be shorter than servers' idle timeouts. Defaults to 30
+	// seconds.
+	MaxIdle time.Duration
+
+	// Interval is how often warm connections are replenished and learned
+	// destinations are updated, defaults to 10 seconds.
+	Interval time.Duration
+}
+
+// warmPool maintains the connections configured by PrewarmOptions.
+type warmPool struct {
+	opts  PrewarmOptions
+	dial  func(ctx context.Context, addr string) (net.Conn, error)
+	stop  chan struct{}
+	once  sync.Once
+	kicks chan struct{}
+
+	mx      sync.Mutex
+	conns   map[string][]*warmConn
+	dialing map[string]int
+	counts  map[string]int
+	learned []string
+}
+
+// warmConn is an idle warm connection watched for data or closure by a
+// background read.
+type warmConn struct {
+	net.Conn
+	dialed  time.Time
+	done    chan struct{}
+	pending []byte
+	err     error
+}
+
+func (proxy *proxy) initPrewarm() {
+	if proxy.Prewarm == nil {
+		return
+	}
+	opts := *proxy.Prewarm
+	if opts.ConnsPerDestination <= 0 {
+		opts.ConnsPerDestination = 1
+	}
+	if opts.MaxIdle <= 0 {
+		opts.MaxIdle = defaultPrewarmMaxIdle
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultPrewarmInterval
+	}
+	proxy.warm = newWarmPool(opts, func(ctx context.Context, addr string) (net.Conn, error) {
+		return proxy.dialResolved(ctx, true, "tcp", addr)
+	})
+}
+
+func newWarmPool(opts PrewarmOptions, dial func(ctx context.Context, addr string) (net.Conn, error)) *warmPool {
+	wp := &warmPool{
+		opts:    opts,
+		dial:    dial,
+		stop:    make(chan struct{}),
+		kicks:   make(chan struct{}, 1),
+		conns:   make(map[string][]*warmConn),
+		dialing: make(map[string]int),
+		counts:  make(map[string]int),
+	}
+	go wp.run()
+	return wp
+}
+
+func (wp *warmPool) run() {
+	ticker := time.NewTicker(wp.opts.Interval)
+	defer ticker.Stop()
+	wp.refill()
+	for {
+		select {
+		case <-ticker.C:
+			wp.learn()
+			wp.refill()
+		case <-wp.kicks:
+			wp.refill()
+		case <-wp.stop:
+			return
+		}
+	}
+}
+
+// take returns a warm connection to addr, or nil if there is none. Each take
+// counts as a dial of addr for the purposes of learning destinations.
+func (wp *warmPool) take(addr string) net.Conn {
+	wp.mx.Lock()
+	wp.counts[addr]++
+	conns := wp.conns[addr]
+	wp.mx.Unlock()
+	if len(conns) == 0 {
+		return nil
+	}
+	defer wp.kick()
+	for {
+		wp.mx.Lock()
+		conns = wp.conns[addr]
+		if len(conns) == 0 {
+			wp.mx.Unlock()
+			return nil
+		}
+		// Newest first, as it's the least likely to have been closed
+		wc := conns[len(conns)-1]
+		wp.conns[addr] = conns[:len(conns)-1]
+		wp.mx.Unlock()
+
+		if conn := wc.claim(); conn != nil {
+			return conn
+		}
+	}
+}
+
+// kick triggers replenishing the pool without waiting for the next interval.
+func (wp *warmPool) kick() {
+	select {
+	case wp.kicks <- struct{}{}:
+	default:
+	}
+}
+
+// targets returns the destinations that should currently be kept warm.
+func (wp *warmPool) targets() map[string]bool {
+	targets := make(map[string]bool, len(wp.opts.Destinations)+len(wp.learned))
+	for _, addr := range wp.opts.Destinations {
+		targets[addr] = true
+	}
+	for _, addr := range wp.learned {
+		targets[addr] = true
+	}
+	return targets
+}
+
+// learn replaces the learned destinations with the most frequently dialed ones
+// and decays the dial counts.
+func (wp *warmPool) learn() {
+	if wp.opts.LearnTop <= 0 {
+		return
+	}
+	wp.mx.Lock()
+	defer wp.mx.Unlock()
+	addrs := make([]string, 0, len(wp.counts))
+	for addr := range wp.counts {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		if wp.counts[addrs[i]] != wp.counts[addrs[j]] {
+			return wp.counts[addrs[i]] > wp.counts[addrs[j]]
+		}
+		return addrs[i] < addrs[j]
+	})
+	if len(addrs) > wp.opts.LearnTop {
+		addrs = addrs[:wp.opts.LearnTop]
+	}
+	wp.learned = addrs
+	for addr, count := range wp.counts {
+		if count < 2 {
+			delete(wp.counts, addr)
+		} else {
+			wp.counts[addr] = count / 2
+		}
+	}
+}
+
+// refill discards stale connections and those to destinations that are no
+// longer targeted, and dials replacements in the background.
+func (wp *warmPool) refill() {
+	var stale []*warmConn
+	wp.mx.Lock()
+	targets := wp.targets()
+	for addr, conns := range wp.conns {
+		fresh := conns[:0]
+		for _, wc := range conns {
+			if !targets[addr] || wc.dead() || time.Since(wc.dialed) > wp.opts.MaxIdle {
+				stale = append(stale, wc)
+			} else {
+				fresh = append(fresh, wc)
+			}
+		}
+		if len(fresh) == 0 {
+			delete(wp.conns, addr)
+		} else {
+			wp.conns[addr] = fresh
+		}
+	}
+	for addr := range targets {
+		for i := len(wp.conns[addr]) + wp.dialing[addr]; i < wp.opts.ConnsPerDestination; i++ {
+			wp.dialing[addr]++
+			go wp.dialOne(addr)
+		}
+	}
+	wp.mx.Unlock()
+
+	for _, wc := range stale {
+		wc.Close()
+	}
+}
+
+func (wp *warmPool) dialOne(addr string) {
+	conn, err := wp.dial(context.Background(), addr)
+	wp.mx.Lock()
+	defer wp.mx.Unlock()
+	wp.dialing[addr]--
+	if err != nil {
+		log.Debugf("Unable to prewarm connection to %v: %v", addr, err)
+		return
+	}
+	select {
+	case <-wp.stop:
+		conn.Close()
+		return
+	default:
+	}
+	wp.conns[addr] = append(wp.conns[addr], watchWarm(conn))
+}
+
+// close stops maintaining the pool and closes all idle connections.
+func (wp *warmPool) close() {
+	wp.once.Do(func() {
+		close(wp.stop)
+		wp.mx.Lock()
+		conns := wp.conns
+		wp.conns = make(map[string][]*warmConn)
+		wp.mx.Unlock()
+		for _, list := range conns {
+			for _, wc := range list {
+				wc.Close()
+			}
+		}
+	})
+}
+
+func watchWarm(conn net.Conn) *warmConn {
+	wc := &warmConn{Conn: conn, dialed: time.Now(), done: make(chan struct{})}
+	go func() {
+		defer close(wc.done)
+		b := make([]byte, 1)
+		n, err := conn.Read(b)
+		wc.pending, wc.err = b[:n], err
+	}()
+	return wc
+}
+
+// dead indicates whether the connection was closed or failed while idle.
+func (wc *warmConn) dead() bool {
+	select {
+	case <-wc.done:
+		return wc.err != nil && !isTimeout(wc.err)
+	default:
+		return false
+	}
+}
+
+// claim stops watching the connection and returns it for use, or returns nil
+// (closing the connection) if it's no longer usable.
+func (wc *warmConn) claim() net.Conn {
+	if err := wc.Conn.SetReadDeadline(time.Now()); err != nil {
+		wc.Conn.Close()
+		return nil
+	}
+	<-wc.done
+	if wc.err != nil && !isTimeout(wc.err) {
+		wc.Conn.Close()
+		return nil
+	}
+	if err := wc.Conn.SetReadDeadline(time.Time{}); err != nil {
+		wc.Conn.Close()
+		return nil
+	}
+	if len(wc.pending) > 0 {
+		return &prefixedConn{Conn: wc.Conn, prefix: wc.pending}
+	}
+	return wc.Conn
+}
+
+// prefixedConn returns data that was already read from the connection before
+// reading any more.
+type prefixedConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (conn *prefixedConn) Read(b []byte) (int, error) {
+	if len(conn.prefix) > 0 {
+		n := copy(b, conn.prefix)
+		conn.prefix = conn.prefix[n:]
+		return n, nil
+	}
+	return conn.Conn.Read(b)
+}
+
+// Wrapped implements the interface netx.WrappedConn
+func (conn *prefixedConn) Wrapped() net.Conn {
+	return conn.Conn
+}
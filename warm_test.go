@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func waitForWarm(t *testing.T, wp *warmPool, addr string, n int) {
+	for i := 0; i < 100; i++ {
+		wp.mx.Lock()
+		warm := len(wp.conns[addr])
+		wp.mx.Unlock()
+		if warm >= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("No warm connections to %v", addr)
+}
+
+func TestPrewarm(t *testing.T) {
+	origin := newEchoServer(t)
+	defer origin.Close()
+
+	var dials int32
+	opts := &Opts{
+		Prewarm: &PrewarmOptions{Destinations: []string{origin.Addr().String()}},
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return net.Dial(network, addr)
+		},
+	}
+	p := newProxy(opts)
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go p.Serve(l)
+
+	wp := p.(*proxy).warm
+	waitForWarm(t, wp, origin.Addr().String(), 1)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&dials))
+
+	conn, br, resp := openTunnel(t, l.Addr().String(), origin.Addr().String())
+	defer conn.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	echoed := make([]byte, 5)
+	_, err = io.ReadFull(br, echoed)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(echoed))
+
+	// The tunnel used the warm connection and another one replaced it
+	waitForWarm(t, wp, origin.Addr().String(), 1)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&dials))
+
+	conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, _, err = p.Shutdown(ctx)
+	require.NoError(t, err)
+	wp.mx.Lock()
+	assert.Empty(t, wp.conns, "Shutdown should close warm connections")
+	wp.mx.Unlock()
+}
+
+func TestPrewarmLearn(t *testing.T) {
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	}
+	origin := newEchoServer(t)
+	defer origin.Close()
+	addr := origin.Addr().String()
+
+	wp := newWarmPool(PrewarmOptions{LearnTop: 1, ConnsPerDestination: 2, MaxIdle: time.Minute, Interval: 200 * time.Millisecond}, dial)
+	defer wp.close()
+	assert.Nil(t, wp.take(addr))
+	assert.Nil(t, wp.take("other:443"), "Less popular destination shouldn't be learned")
+	assert.Nil(t, wp.take(addr))
+	waitForWarm(t, wp, addr, 2)
+	wp.mx.Lock()
+	assert.Empty(t, wp.conns["other:443"])
+	wp.mx.Unlock()
+}
+
+func TestWarmConn(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	dialWarm := func() (*warmConn, net.Conn) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		return watchWarm(conn), <-accepted
+	}
+
+	wc, server := dialWarm()
+	server.Write([]byte("banner"))
+	server.Close()
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, wc.dead(), "Connection with pending data should still be usable")
+	conn := wc.claim()
+	require.NotNil(t, conn)
+	received, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "banner", string(received), "Data arriving early should be kept")
+
+	wc, server = dialWarm()
+	server.Close()
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, wc.dead())
+	assert.Nil(t, wc.claim())
+
+	wc, server = dialWarm()
+	defer server.Close()
+	conn = wc.claim()
+	require.NotNil(t, conn)
+	defer conn.Close()
+	server.Write([]byte("x"))
+	b := make([]byte, 1)
+	_, err = conn.Read(b)
+	assert.NoError(t, err, "Claimed connection shouldn't have a deadline")
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/preconn"
+	"github.com/getlantern/proxy/filters"
+)
+
+// isWebSocketUpgrade indicates whether the given request headers ask to
+// upgrade the connection to a WebSocket.
+func isWebSocketUpgrade(header http.Header) bool {
+	return isUpgradeTo(header, "websocket")
+}
+
+// isUpgradeTo indicates whether the given request headers ask to upgrade the
+// connection to the given protocol.
+func isUpgradeTo(header http.Header, protocol string) bool {
+	if !strings.EqualFold(header.Get("Upgrade"), protocol) {
+		return false
+	}
+	for _, value := range header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// roundTripUpgrade sends an upgrade request on a dedicated upstream connection
+// (http.Transport can't hand us the raw connection). If upstream switches
+// protocols, the connection is recorded in the context so that processRequests
+// can tunnel it after writing the 101 response downstream.
+func (proxy *proxy) roundTripUpgrade(ctx filters.Context, tr idleClosingTransport, req *http.Request) (*http.Response, filters.Context, error) {
+	setRequestForAwareConn(ctx, req)
+	var upstream net.Conn
+	if alt, ok := tr.(*addressLoggingTransport); ok {
+		// We're handling MITM'ed traffic on an already established connection
+		upstream = alt.upstream
+		setUpstreamForAwareConn(ctx, upstream)
+		handleRequestAware(ctx)
+	} else {
+		dest, err := requestDestination(req)
+		if err != nil {
+			return nil, ctx, errors.New("Unable to determine upstream address for upgrade: %v", err)
+		}
+		upstream, err = proxy.requestAwareDial(ctx, "tcp", dest.Addr())
+		if err != nil {
+			return nil, ctx, errors.New("Unable to dial upstream for upgrade: %v", err)
+		}
+		if req.URL.Scheme == "https" {
+			upstream = tls.Client(upstream, proxy.upstreamTLSConfig(dest.Host, nil))
+		}
+	}
+
+	resp, upstream, err := writeUpgradeRequest(upstream, req)
+	handleResponseAware(ctx, req, resp, err)
+	if err != nil {
+		upstream.Close()
+		return nil, ctx, errors.New("Unable to round-trip upgrade request to upstream: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// Upstream declined the upgrade, this connection is done once the client
+		// has the response.
+		resp.Close = true
+		resp.Body = &closingBody{resp.Body, upstream}
+		return resp, ctx, nil
+	}
+	return resp, ctx.WithValue(ctxKeyUpgradedUpstream, upstream), nil
+}
+
+// writeUpgradeRequest writes req to upstream and reads the response. It
+// returns the upstream connection including anything upstream sent after the
+// response head, since upstream may have already started talking the new
+// protocol.
+func writeUpgradeRequest(upstream net.Conn, req *http.Request) (*http.Response, net.Conn, error) {
+	if err := req.Write(upstream); err != nil {
+		return nil, upstream, err
+	}
+	br := bufio.NewReader(upstream)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, upstream, err
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if buffered := br.Buffered(); buffered > 0 {
+			b, _ := br.Peek(buffered)
+			upstream = preconn.Wrap(upstream, b)
+		}
+	}
+	return resp, upstream, nil
+}
+
+// closingBody is a response body that also closes the connection from which it
+// was read.
+type closingBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (cb *closingBody) Close() error {
+	cb.ReadCloser.Close()
+	return cb.conn.Close()
+}
@@ -0,0 +1,361 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	defaultWebSocketHandshakeTimeout = 10 * time.Second
+
+	// websocketGUID is appended to the client's key to compute
+	// Sec-WebSocket-Accept, see RFC 6455 section 1.3.
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	wsCloseNormal        = 1000
+	wsCloseProtocolError = 1002
+	wsMaxControlPayload  = 125
+)
+
+// WebSocketListenerOpts configures NewWebSocketListener.
+type WebSocketListenerOpts struct {
+	// Path, if specified, is the only request path on which WebSocket
+	// handshakes are accepted. Requests for other paths get 404 Not Found.
+	Path string
+
+	// HandshakeTimeout limits how long clients have to complete the WebSocket
+	// handshake, defaults to 10 seconds.
+	HandshakeTimeout time.Duration
+}
+
+// NewWebSocketListener wraps l so that it accepts proxy traffic tunneled
+// inside WebSocket messages, letting clients reach the proxy through firewalls
+// that only allow HTTP(S). The connections returned by Accept carry the
+// unwrapped stream, so they can be served with Serve, ServeSOCKS and the like
+// just as if the client had connected directly. For WebSocket over TLS (wss),
+// wrap l with tls.NewListener first.
+func NewWebSocketListener(l net.Listener, opts *WebSocketListenerOpts) net.Listener {
+	if opts == nil {
+		opts = &WebSocketListenerOpts{}
+	}
+	if opts.HandshakeTimeout <= 0 {
+		opts.HandshakeTimeout = defaultWebSocketHandshakeTimeout
+	}
+	wsl := &wsListener{
+		Listener: l,
+		opts:     opts,
+		accepted: newConnListener(l.Addr()),
+	}
+	go wsl.acceptLoop()
+	return wsl
+}
+
+// wsListener accepts connections from the wrapped listener in the background
+// and delivers them once the WebSocket handshake has completed, so that slow
+// clients don't hold up others.
+type wsListener struct {
+	net.Listener
+	opts     *WebSocketListenerOpts
+	accepted *connListener
+
+	mx        sync.Mutex
+	acceptErr error
+}
+
+func (l *wsListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.mx.Lock()
+			l.acceptErr = err
+			l.mx.Unlock()
+			l.accepted.Close()
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *wsListener) handshake(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(l.opts.HandshakeTimeout))
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		log.Debugf("Unable to read WebSocket handshake from %v: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if status := l.checkHandshake(req); status != 0 {
+		log.Debugf("Rejecting WebSocket handshake from %v for %v: %v", conn.RemoteAddr(), req.URL, http.StatusText(status))
+		fmt.Fprintf(conn, "HTTP/1.1 %d %v\r\nSec-WebSocket-Version: 13\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status))
+		conn.Close()
+		return
+	}
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %v\r\n\r\n", websocketAccept(req.Header.Get("Sec-WebSocket-Key")))
+	if err != nil {
+		log.Debugf("Unable to complete WebSocket handshake with %v: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	if !l.accepted.deliver(newWSConn(conn, br, false)) {
+		conn.Close()
+	}
+}
+
+// checkHandshake returns the status with which to reject req, or 0 if it's a
+// valid WebSocket handshake.
+func (l *wsListener) checkHandshake(req *http.Request) int {
+	switch {
+	case l.opts.Path != "" && req.URL.Path != l.opts.Path:
+		return http.StatusNotFound
+	case req.Method != http.MethodGet || !isWebSocketUpgrade(req.Header) || req.Header.Get("Sec-WebSocket-Key") == "":
+		return http.StatusBadRequest
+	case req.Header.Get("Sec-WebSocket-Version") != "13":
+		return http.StatusUpgradeRequired
+	}
+	return 0
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	conn, err := l.accepted.Accept()
+	if err != nil {
+		l.mx.Lock()
+		defer l.mx.Unlock()
+		if l.acceptErr != nil {
+			return nil, l.acceptErr
+		}
+	}
+	return conn, err
+}
+
+func (l *wsListener) Close() error {
+	l.accepted.Close()
+	return l.Listener.Close()
+}
+
+// websocketAccept computes the Sec-WebSocket-Accept value for the given key.
+func websocketAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+websocketGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// wsConn is a net.Conn that carries a byte stream in WebSocket binary
+// messages. Incoming message boundaries are ignored and control frames are
+// handled transparently. It deliberately doesn't expose the connection it
+// wraps, since writes to that don't go through the framing.
+type wsConn struct {
+	net.Conn
+	br *bufio.Reader
+	// client is true if we're the client side, which masks what it sends
+	client bool
+
+	// state of the data frame being read
+	remaining int64
+	masked    bool
+	maskKey   [4]byte
+	maskPos   int
+	readErr   error
+
+	writeMx   sync.Mutex
+	closeOnce sync.Once
+	closeSent bool
+}
+
+func newWSConn(conn net.Conn, br *bufio.Reader, client bool) *wsConn {
+	return &wsConn{Conn: conn, br: br, client: client}
+}
+
+func (conn *wsConn) Read(b []byte) (int, error) {
+	for conn.remaining == 0 {
+		if conn.readErr != nil {
+			return 0, conn.readErr
+		}
+		if err := conn.nextFrame(); err != nil {
+			conn.readErr = err
+			return 0, err
+		}
+	}
+	if int64(len(b)) > conn.remaining {
+		b = b[:conn.remaining]
+	}
+	n, err := conn.br.Read(b)
+	if conn.masked {
+		conn.maskPos = wsMask(conn.maskKey, conn.maskPos, b[:n])
+	}
+	conn.remaining -= int64(n)
+	if err == io.EOF {
+		// The connection ended in the middle of a frame
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nextFrame reads frame headers up to the next data frame with a payload,
+// handling any control frames along the way. It returns io.EOF once the peer
+// closes the WebSocket.
+func (conn *wsConn) nextFrame() error {
+	var head [2]byte
+	if _, err := io.ReadFull(conn.br, head[:]); err != nil {
+		return err
+	}
+	opcode := head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+	length := int64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(conn.br, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(conn.br, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+		if length < 0 {
+			return conn.protocolError("Invalid WebSocket frame length")
+		}
+	}
+	if masked == conn.client {
+		// Clients must mask what they send and servers must not
+		return conn.protocolError("Unexpected WebSocket frame masking")
+	}
+	var maskKey [4]byte
+	if masked {
+		if _, err := io.ReadFull(conn.br, maskKey[:]); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case wsOpContinuation, wsOpText, wsOpBinary:
+		conn.remaining, conn.masked, conn.maskKey, conn.maskPos = length, masked, maskKey, 0
+		return nil
+	case wsOpClose, wsOpPing, wsOpPong:
+		if length > wsMaxControlPayload {
+			return conn.protocolError("WebSocket control frame too large")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(conn.br, payload); err != nil {
+			return err
+		}
+		if masked {
+			wsMask(maskKey, 0, payload)
+		}
+		switch opcode {
+		case wsOpClose:
+			conn.sendClose(wsCloseNormal)
+			return io.EOF
+		case wsOpPing:
+			if err := conn.writeFrame(wsOpPong, payload); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return conn.protocolError("Unknown WebSocket opcode %d", opcode)
+	}
+}
+
+func (conn *wsConn) protocolError(msg string, args ...interface{}) error {
+	conn.sendClose(wsCloseProtocolError)
+	return errors.New(msg, args...)
+}
+
+func (conn *wsConn) Write(b []byte) (int, error) {
+	if err := conn.writeFrame(wsOpBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeFrame writes payload as a single, final frame.
+func (conn *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+	maskBit := byte(0)
+	if conn.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	if conn.client {
+		var maskKey [4]byte
+		if _, err := rand.Read(maskKey[:]); err != nil {
+			return errors.New("Unable to generate WebSocket mask: %v", err)
+		}
+		frame = append(frame, maskKey[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		wsMask(maskKey, 0, frame[start:])
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	conn.writeMx.Lock()
+	defer conn.writeMx.Unlock()
+	if conn.closeSent {
+		return errors.New("WebSocket closed")
+	}
+	if opcode == wsOpClose {
+		conn.closeSent = true
+	}
+	_, err := conn.Conn.Write(frame)
+	return err
+}
+
+// sendClose sends a close frame with the given status code, unless one was
+// sent already.
+func (conn *wsConn) sendClose(code uint16) {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, code)
+	conn.writeFrame(wsOpClose, payload)
+}
+
+func (conn *wsConn) Close() error {
+	conn.closeOnce.Do(func() {
+		conn.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		conn.sendClose(wsCloseNormal)
+	})
+	return conn.Conn.Close()
+}
+
+// wsMask applies the masking key to b, starting at position pos of the key,
+// and returns the position at which to continue.
+func wsMask(key [4]byte, pos int, b []byte) int {
+	for i := range b {
+		b[i] ^= key[pos&3]
+		pos++
+	}
+	return pos & 3
+}
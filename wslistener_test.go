@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	ht "net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dialWebSocket performs a WebSocket handshake for path on conn, returning
+// the handshake response and, if it succeeded, the connection.
+func dialWebSocket(t *testing.T, conn net.Conn, path string) (*wsConn, *http.Response) {
+	req, _ := http.NewRequest(http.MethodGet, "http://"+conn.RemoteAddr().String()+path, nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	require.NoError(t, req.Write(conn))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	require.NoError(t, err)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, resp
+	}
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+	return newWSConn(conn, br, true), resp
+}
+
+func TestWebSocketListener(t *testing.T) {
+	origin := ht.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello " + req.URL.Path))
+	}))
+	defer origin.Close()
+	echo := newEchoServer(t)
+	defer echo.Close()
+	cert := issueTestCert(t, "proxy", 1, nil)
+
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	wsl := NewWebSocketListener(tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{*cert}}), &WebSocketListenerOpts{Path: "/tunnel"})
+	defer wsl.Close()
+	go newProxy(&Opts{}).Serve(wsl)
+
+	dial := func(path string) (*wsConn, *http.Response) {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		require.NoError(t, err)
+		return dialWebSocket(t, conn, path)
+	}
+
+	ws, _ := dial("/tunnel")
+	require.NotNil(t, ws)
+	req, _ := http.NewRequest(http.MethodGet, origin.URL+"/forwarded", nil)
+	require.NoError(t, req.WriteProxy(ws))
+	br := bufio.NewReader(ws)
+	resp, err := http.ReadResponse(br, req)
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "hello /forwarded", string(body))
+	ws.Close()
+
+	ws, _ = dial("/tunnel")
+	require.NotNil(t, ws)
+	br = bufio.NewReader(ws)
+	req, _ = http.NewRequest(http.MethodConnect, "http://"+echo.Addr().String(), nil)
+	require.NoError(t, req.Write(ws))
+	resp, err = http.ReadResponse(br, req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = ws.Write([]byte("ping through tunnel"))
+	require.NoError(t, err)
+	echoed := make([]byte, len("ping through tunnel"))
+	_, err = io.ReadFull(br, echoed)
+	require.NoError(t, err)
+	assert.Equal(t, "ping through tunnel", string(echoed))
+	ws.Close()
+
+	_, resp = dial("/other")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer conn.Close()
+	req, _ = http.NewRequest(http.MethodGet, "http://"+l.Addr().String()+"/tunnel", nil)
+	require.NoError(t, req.Write(conn))
+	resp, err = http.ReadResponse(bufio.NewReader(conn), req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "Plain HTTP request should be rejected")
+
+	l.Close()
+	_, err = wsl.Accept()
+	assert.Error(t, err, "Accept should fail once the wrapped listener is closed")
+}
+
+func TestWSConnControlFrames(t *testing.T) {
+	a, b := net.Pipe()
+	server := newWSConn(a, bufio.NewReader(a), false)
+	client := newWSConn(b, bufio.NewReader(b), true)
+
+	go func() {
+		client.writeFrame(wsOpPing, []byte("are you there"))
+		// Payload split across a message's frames
+		client.writeFrame(wsOpText, []byte("hel"))
+		client.writeFrame(wsOpContinuation, []byte("lo"))
+		client.sendClose(wsCloseNormal)
+	}()
+
+	// The server's pong and close are read (and skipped) on the client side
+	clientErr := make(chan error, 1)
+	go func() {
+		received, err := ioutil.ReadAll(client)
+		assert.Empty(t, received)
+		clientErr <- err
+	}()
+
+	received, err := ioutil.ReadAll(server)
+	require.NoError(t, err, "Close frame should end the stream cleanly")
+	assert.Equal(t, "hello", string(received))
+	require.NoError(t, <-clientErr)
+
+	_, err = server.Write([]byte("too late"))
+	assert.Error(t, err, "Shouldn't write after close")
+
+	// Servers must reject unmasked frames from clients
+	a, b = net.Pipe()
+	defer a.Close()
+	server = newWSConn(a, bufio.NewReader(a), false)
+	unmasked := newWSConn(b, bufio.NewReader(b), false)
+	go unmasked.Write([]byte("hello"))
+	go ioutil.ReadAll(b)
+	_, err = server.Read(make([]byte, 5))
+	assert.Error(t, err)
+}